@@ -0,0 +1,127 @@
+// Package balancer balances requests among an endpoints upstream addresses.
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultFailureTimeout is the duration an upstream is skipped after
+	// failing.
+	defaultFailureTimeout = time.Second * 10
+)
+
+// Balancer selects upstreams using round-robin, skipping upstreams that
+// recently failed, are marked unhealthy by health checks, or are unavailable,
+// such as when their circuit breaker is open.
+//
+// Upstreams are identified by their index.
+type Balancer struct {
+	n int
+
+	// next is the index of the next upstream to try.
+	next int
+
+	// failedAt contains the time each upstream last failed, or zero if the
+	// upstream hasn't failed.
+	failedAt []time.Time
+
+	// unhealthy contains whether each upstream is marked unhealthy.
+	unhealthy []bool
+
+	// available returns whether the upstream with the given index is
+	// available. If nil all upstreams are available.
+	available func(idx int) bool
+
+	failureTimeout time.Duration
+
+	mu sync.Mutex
+
+	now func() time.Time
+}
+
+// New returns a balancer for 'n' upstreams.
+func New(n int) *Balancer {
+	return &Balancer{
+		n:              n,
+		failedAt:       make([]time.Time, n),
+		unhealthy:      make([]bool, n),
+		failureTimeout: defaultFailureTimeout,
+		now:            time.Now,
+	}
+}
+
+// Next returns the index of the next upstream.
+//
+// Upstreams that are unhealthy, unavailable or failed within the failure
+// timeout are skipped, unless all upstreams are unavailable, in which case round-robin is
+// used among all upstreams.
+func (b *Balancer) Next() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for i := 0; i != b.n; i++ {
+		idx := (b.next + i) % b.n
+		if b.unhealthy[idx] {
+			continue
+		}
+		if b.available != nil && !b.available(idx) {
+			continue
+		}
+		if b.failedAt[idx].IsZero() || now.Sub(b.failedAt[idx]) >= b.failureTimeout {
+			b.next = (idx + 1) % b.n
+			return idx
+		}
+	}
+
+	// All upstreams are unavailable.
+	idx := b.next
+	b.next = (idx + 1) % b.n
+	return idx
+}
+
+// Failed marks the upstream with the given index as failed.
+func (b *Balancer) Failed(idx int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failedAt[idx] = b.now()
+}
+
+// Succeeded marks the upstream with the given index as healthy.
+func (b *Balancer) Succeeded(idx int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failedAt[idx] = time.Time{}
+}
+
+// SetHealthy marks whether the upstream with the given index is healthy.
+//
+// Unlike failures, which expire after the failure timeout, unhealthy
+// upstreams are skipped until marked healthy.
+func (b *Balancer) SetHealthy(idx int, healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.unhealthy[idx] = !healthy
+}
+
+// SetAvailable sets a function returning whether the upstream with the given
+// index is available, such as whether its circuit breaker permits requests.
+//
+// The function is called with the balancer lock held so must not call back
+// into the balancer.
+func (b *Balancer) SetAvailable(available func(idx int) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available = available
+}
+
+// Len returns the number of upstreams.
+func (b *Balancer) Len() int {
+	return b.n
+}
@@ -0,0 +1,87 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalancer(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		b := New(3)
+		for i := 0; i != 6; i++ {
+			assert.Equal(t, i%3, b.Next())
+		}
+	})
+
+	t.Run("skip failed", func(t *testing.T) {
+		now := time.Now()
+		b := New(3)
+		b.now = func() time.Time { return now }
+
+		b.Failed(1)
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, 0, b.Next())
+			assert.Equal(t, 2, b.Next())
+		}
+
+		// Once the failure timeout has passed the upstream is retried.
+		now = now.Add(defaultFailureTimeout)
+		assert.Equal(t, 0, b.Next())
+		assert.Equal(t, 1, b.Next())
+		assert.Equal(t, 2, b.Next())
+	})
+
+	t.Run("succeeded", func(t *testing.T) {
+		b := New(2)
+
+		b.Failed(1)
+		assert.Equal(t, 0, b.Next())
+		assert.Equal(t, 0, b.Next())
+
+		b.Succeeded(1)
+		assert.Equal(t, 1, b.Next())
+	})
+
+	t.Run("all failed", func(t *testing.T) {
+		b := New(2)
+
+		b.Failed(0)
+		b.Failed(1)
+		assert.Equal(t, 0, b.Next())
+		assert.Equal(t, 1, b.Next())
+		assert.Equal(t, 0, b.Next())
+	})
+
+	t.Run("skip unhealthy", func(t *testing.T) {
+		now := time.Now()
+		b := New(3)
+		b.now = func() time.Time { return now }
+
+		b.SetHealthy(1, false)
+		// Unhealthy upstreams are skipped even after the failure timeout.
+		now = now.Add(defaultFailureTimeout)
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, 0, b.Next())
+			assert.Equal(t, 2, b.Next())
+		}
+
+		b.SetHealthy(1, true)
+		assert.Equal(t, 0, b.Next())
+		assert.Equal(t, 1, b.Next())
+		assert.Equal(t, 2, b.Next())
+	})
+
+	t.Run("skip unavailable", func(t *testing.T) {
+		b := New(3)
+
+		b.SetAvailable(func(idx int) bool {
+			return idx != 1
+		})
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, 0, b.Next())
+			assert.Equal(t, 2, b.Next())
+		}
+	})
+}
@@ -0,0 +1,192 @@
+// Package breaker implements a circuit breaker to fail fast when an upstream
+// is unavailable.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = time.Second * 30
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed means requests are sent to the upstream.
+	StateClosed State = iota
+	// StateHalfOpen means a single trial request is sent to the upstream to
+	// check whether it has recovered.
+	StateHalfOpen
+	// StateOpen means requests fail without being sent to the upstream.
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker is a circuit breaker for a single upstream.
+//
+// The breaker opens after 'failureThreshold' consecutive failures, then
+// rejects requests until 'openTimeout' has passed. Once the timeout passes the
+// breaker is half-open, where a single trial request is permitted. If the
+// trial succeeds the breaker closes, otherwise it opens again.
+type Breaker struct {
+	state State
+
+	// failures is the number of consecutive failures.
+	failures int
+
+	// openedAt is the time the breaker last opened.
+	openedAt time.Time
+
+	// trial indicates whether a trial request is in progress while the
+	// breaker is half-open.
+	trial bool
+
+	failureThreshold int
+	openTimeout      time.Duration
+
+	onChange func(state State)
+
+	mu sync.Mutex
+
+	now func() time.Time
+}
+
+// New returns a closed circuit breaker.
+//
+// If failureThreshold or openTimeout are zero, defaults are used.
+func New(failureThreshold int, openTimeout time.Duration) *Breaker {
+	if failureThreshold == 0 {
+		failureThreshold = defaultFailureThreshold
+	}
+	if openTimeout == 0 {
+		openTimeout = defaultOpenTimeout
+	}
+	return &Breaker{
+		state:            StateClosed,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		now:              time.Now,
+	}
+}
+
+// OnChange registers a callback called when the state of the breaker
+// changes.
+//
+// The callback is called with the breaker lock held so must not call back
+// into the breaker.
+func (b *Breaker) OnChange(f func(state State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.onChange = f
+}
+
+// Available returns whether the breaker would permit a request, without
+// reserving the half-open trial request.
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		return b.now().Sub(b.openedAt) >= b.openTimeout
+	case StateHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+// Allow returns whether a request may be sent to the upstream. If the
+// request is permitted, the caller must report the result with Succeeded,
+// Failed or Released.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.setStateLocked(StateHalfOpen)
+		b.trial = true
+		return true
+	case StateHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Succeeded records a successful request, which closes the breaker.
+func (b *Breaker) Succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	b.setStateLocked(StateClosed)
+}
+
+// Failed records a failed request, which opens the breaker if the trial
+// request failed or the failure threshold is reached.
+func (b *Breaker) Failed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == StateHalfOpen || b.failures >= b.failureThreshold {
+		b.openedAt = b.now()
+		b.setStateLocked(StateOpen)
+	}
+}
+
+// Released records a request whose result is unknown, such as when the
+// client cancelled the request, so another trial request may be sent if the
+// breaker is half-open.
+func (b *Breaker) Released() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) setStateLocked(state State) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(state)
+	}
+}
@@ -0,0 +1,91 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	t.Run("open after failures", func(t *testing.T) {
+		b := New(3, time.Second)
+
+		for i := 0; i != 2; i++ {
+			assert.True(t, b.Allow())
+			b.Failed()
+		}
+		assert.Equal(t, StateClosed, b.State())
+
+		assert.True(t, b.Allow())
+		b.Failed()
+		assert.Equal(t, StateOpen, b.State())
+
+		// While open requests are rejected.
+		assert.False(t, b.Available())
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		b := New(2, time.Second)
+
+		b.Failed()
+		b.Succeeded()
+		b.Failed()
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("half open", func(t *testing.T) {
+		now := time.Now()
+		b := New(1, time.Second)
+		b.now = func() time.Time { return now }
+
+		b.Failed()
+		assert.False(t, b.Allow())
+
+		// Once the open timeout passes, a single trial request is permitted.
+		now = now.Add(time.Second)
+		assert.True(t, b.Available())
+		assert.True(t, b.Allow())
+		assert.Equal(t, StateHalfOpen, b.State())
+		assert.False(t, b.Available())
+		assert.False(t, b.Allow())
+
+		// If the trial succeeds the breaker closes.
+		b.Succeeded()
+		assert.Equal(t, StateClosed, b.State())
+		assert.True(t, b.Allow())
+	})
+
+	t.Run("half open failed", func(t *testing.T) {
+		now := time.Now()
+		b := New(1, time.Second)
+		b.now = func() time.Time { return now }
+
+		b.Failed()
+		now = now.Add(time.Second)
+		assert.True(t, b.Allow())
+
+		// If the trial fails the breaker opens again.
+		b.Failed()
+		assert.Equal(t, StateOpen, b.State())
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("on change", func(t *testing.T) {
+		now := time.Now()
+		b := New(1, time.Second)
+		b.now = func() time.Time { return now }
+
+		var states []State
+		b.OnChange(func(state State) {
+			states = append(states, state)
+		})
+
+		b.Failed()
+		now = now.Add(time.Second)
+		b.Allow()
+		b.Succeeded()
+		assert.Equal(t, []State{StateOpen, StateHalfOpen, StateClosed}, states)
+	})
+}
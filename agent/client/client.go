@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/url"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -21,6 +22,15 @@ const (
 
 	// defaultProxyURL is the URL of the Piko proxy port when running locally.
 	defaultProxyURL = "ws://localhost:8000"
+
+	defaultReconnectMinBackoff = time.Millisecond * 100
+	defaultReconnectMaxBackoff = time.Second * 15
+	defaultReconnectMultiplier = 2
+	defaultReconnectResetAfter = time.Second * 30
+
+	// rttInterval is the interval to measure the round-trip time of each
+	// listener connection.
+	rttInterval = time.Second * 15
 )
 
 // Client manages registering listeners with Piko.
@@ -30,6 +40,7 @@ const (
 // that outbound connection. Therefore the client never exposes a port.
 type Client struct {
 	options options
+	metrics *Metrics
 	logger  log.Logger
 }
 
@@ -38,7 +49,13 @@ func New(opts ...Option) *Client {
 		token:       "",
 		upstreamURL: defaultUpstreamURL,
 		proxyURL:    defaultProxyURL,
-		logger:      log.NewNopLogger(),
+
+		reconnectMinBackoff: defaultReconnectMinBackoff,
+		reconnectMaxBackoff: defaultReconnectMaxBackoff,
+		reconnectMultiplier: defaultReconnectMultiplier,
+		reconnectResetAfter: defaultReconnectResetAfter,
+
+		logger: log.NewNopLogger(),
 	}
 	for _, o := range opts {
 		o.apply(&options)
@@ -46,6 +63,7 @@ func New(opts ...Option) *Client {
 
 	return &Client{
 		options: options,
+		metrics: NewMetrics(),
 		logger:  options.logger,
 	}
 }
@@ -56,7 +74,7 @@ func New(opts ...Option) *Client {
 //
 // The returned [Listener] is a [net.Listener].
 func (c *Client) Listen(ctx context.Context, endpointID string) (Listener, error) {
-	return listen(ctx, endpointID, c.options, c.logger)
+	return listen(ctx, endpointID, c.options, c.metrics, c.logger)
 }
 
 // ListenAndForward listens for connections on the given endpoint ID and
@@ -64,7 +82,7 @@ func (c *Client) Listen(ctx context.Context, endpointID string) (Listener, error
 func (c *Client) ListenAndForward(
 	ctx context.Context, endpointID string, addr string,
 ) error {
-	ln, err := listen(ctx, endpointID, c.options, c.logger)
+	ln, err := listen(ctx, endpointID, c.options, c.metrics, c.logger)
 	if err != nil {
 		return fmt.Errorf("listen: %w", err)
 	}
@@ -86,6 +104,11 @@ func (c *Client) Dial(ctx context.Context, endpointID string) (net.Conn, error)
 	return websocket.Dial(ctx, proxyTCPURL(c.options.proxyURL, endpointID))
 }
 
+// Metrics returns the metrics for the listeners registered by the client.
+func (c *Client) Metrics() *Metrics {
+	return c.metrics
+}
+
 func (c *Client) forwardConn(ctx context.Context, conn net.Conn, addr string) {
 	defer conn.Close()
 
@@ -2,23 +2,32 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/backoff"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/pkg/websocket"
 )
 
 const (
-	minReconnectBackoff = time.Millisecond * 100
-	maxReconnectBackoff = time.Second * 15
+	// repauseTimeout is the timeout to pause the listener after
+	// reconnecting.
+	repauseTimeout = time.Second * 10
 )
 
 type pikoAddr struct {
@@ -43,6 +52,57 @@ type Listener interface {
 	// EndpointID returns the ID of the endpoint this is listening for
 	// connections on.
 	EndpointID() string
+
+	// Drain requests the server stops routing new connections to the
+	// listener, then waits for the accepted connections to be closed.
+	//
+	// If the context is cancelled before all accepted connections are
+	// closed, returns the context error. Drain doesn't close the listener
+	// or the accepted connections.
+	Drain(ctx context.Context) error
+
+	// Pause requests the server stops routing new connections to the
+	// listener, without waiting for accepted connections to close.
+	//
+	// The listener remains paused until Resume is called, including
+	// across reconnects.
+	Pause(ctx context.Context) error
+
+	// Resume requests the server resumes routing new connections to a
+	// paused or draining listener.
+	Resume(ctx context.Context) error
+
+	// Stats returns a snapshot of the listeners connection to the server.
+	Stats() ListenerStats
+}
+
+// ListenerStats contains a point-in-time snapshot of a listeners connection
+// to the server.
+type ListenerStats struct {
+	// ActiveConns is the number of accepted connections that are still
+	// open.
+	ActiveConns int
+
+	// BytesRead is the number of bytes read from accepted connections.
+	BytesRead uint64
+
+	// BytesWritten is the number of bytes written to accepted connections.
+	BytesWritten uint64
+
+	// RTT is the last measured round-trip time to the server, or zero if
+	// not yet measured.
+	RTT time.Duration
+
+	// ConnectedAt is the time the listener last connected to the server.
+	ConnectedAt time.Time
+
+	// Uptime is the duration the listener has been connected since it last
+	// connected.
+	Uptime time.Duration
+
+	// Reconnects is the number of times the listener reconnected after its
+	// connection to the server was dropped.
+	Reconnects uint64
 }
 
 type listener struct {
@@ -52,6 +112,35 @@ type listener struct {
 
 	options options
 
+	metrics *Metrics
+
+	// backoff is the backoff when reconnecting to the server. This is kept
+	// across reconnects so short-lived connections continue to backoff.
+	backoff *backoff.Backoff
+	// connectedAt is the time the listener last connected.
+	connectedAt *atomic.Time
+
+	// rtt is the last measured round-trip time to the server.
+	rtt *atomic.Duration
+	// reconnects is the number of times the listener has reconnected.
+	reconnects *atomic.Uint64
+
+	// bytesRead and bytesWritten are the number of bytes read from and
+	// written to accepted connections.
+	bytesRead    *atomic.Uint64
+	bytesWritten *atomic.Uint64
+
+	// paused indicates whether the listener has requested the server stops
+	// routing new connections to the listener, which must be requested
+	// again after reconnecting.
+	paused *atomic.Bool
+
+	// conns contains the number of accepted connections that are still
+	// open. connsDone is closed when conns drops to zero.
+	conns     int
+	connsDone chan struct{}
+	connsMu   sync.Mutex
+
 	closeCtx    context.Context
 	closeCancel func()
 
@@ -62,15 +151,29 @@ func listen(
 	ctx context.Context,
 	endpointID string,
 	options options,
+	metrics *Metrics,
 	logger log.Logger,
 ) (*listener, error) {
 	closeCtx, closeCancel := context.WithCancel(context.Background())
 	ln := &listener{
-		endpointID:  endpointID,
-		options:     options,
-		closeCtx:    closeCtx,
-		closeCancel: closeCancel,
-		logger:      logger,
+		endpointID: endpointID,
+		options:    options,
+		metrics:    metrics,
+		backoff: backoff.New(
+			0,
+			options.reconnectMinBackoff,
+			options.reconnectMaxBackoff,
+			options.reconnectMultiplier,
+		),
+		connectedAt:  atomic.NewTime(time.Time{}),
+		rtt:          atomic.NewDuration(0),
+		reconnects:   atomic.NewUint64(0),
+		bytesRead:    atomic.NewUint64(0),
+		bytesWritten: atomic.NewUint64(0),
+		paused:       atomic.NewBool(false),
+		closeCtx:     closeCtx,
+		closeCancel:  closeCancel,
+		logger:       logger,
 	}
 	sess, err := ln.connect(ctx)
 	if err != nil {
@@ -86,7 +189,7 @@ func (l *listener) Accept() (net.Conn, error) {
 	for {
 		conn, err := l.sess.Accept()
 		if err == nil {
-			return conn, nil
+			return l.trackConn(conn), nil
 		}
 
 		if l.closeCtx.Err() != nil {
@@ -95,12 +198,13 @@ func (l *listener) Accept() (net.Conn, error) {
 
 		l.logger.Warn("failed to accept conn", zap.Error(err))
 
-		sess, err := l.connect(l.closeCtx)
+		sess, err := l.reconnect()
 		if err != nil {
 			return nil, err
 		}
 
 		l.sess = sess
+		l.repause()
 	}
 }
 
@@ -108,7 +212,7 @@ func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
 	for {
 		conn, err := l.sess.AcceptStreamWithContext(ctx)
 		if err == nil {
-			return conn, nil
+			return l.trackConn(conn), nil
 		}
 
 		if ctx.Err() != nil {
@@ -120,12 +224,13 @@ func (l *listener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
 
 		l.logger.Warn("failed to accept conn", zap.Error(err))
 
-		sess, err := l.connect(l.closeCtx)
+		sess, err := l.reconnect()
 		if err != nil {
 			return nil, err
 		}
 
 		l.sess = sess
+		l.repause()
 	}
 }
 
@@ -143,14 +248,189 @@ func (l *listener) EndpointID() string {
 	return l.endpointID
 }
 
+// Stats returns a snapshot of the listeners connection to the server.
+//
+// Counters are updated atomically so reading stats doesn't block accepted
+// connections.
+func (l *listener) Stats() ListenerStats {
+	l.connsMu.Lock()
+	conns := l.conns
+	l.connsMu.Unlock()
+
+	connectedAt := l.connectedAt.Load()
+	return ListenerStats{
+		ActiveConns:  conns,
+		BytesRead:    l.bytesRead.Load(),
+		BytesWritten: l.bytesWritten.Load(),
+		RTT:          l.rtt.Load(),
+		ConnectedAt:  connectedAt,
+		Uptime:       time.Since(connectedAt),
+		Reconnects:   l.reconnects.Load(),
+	}
+}
+
+func (l *listener) Drain(ctx context.Context) error {
+	if err := l.Pause(ctx); err != nil {
+		return err
+	}
+
+	l.connsMu.Lock()
+	if l.conns == 0 {
+		l.connsMu.Unlock()
+		return nil
+	}
+	if l.connsDone == nil {
+		l.connsDone = make(chan struct{})
+	}
+	connsDone := l.connsDone
+	l.connsMu.Unlock()
+
+	select {
+	case <-connsDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *listener) Pause(ctx context.Context) error {
+	l.paused.Store(true)
+
+	if err := l.sendControl(ctx, protocol.MessageTypeDrain); err != nil {
+		return fmt.Errorf("send drain: %w", err)
+	}
+
+	l.logger.Info("listener draining")
+
+	return nil
+}
+
+func (l *listener) Resume(ctx context.Context) error {
+	l.paused.Store(false)
+
+	if err := l.sendControl(ctx, protocol.MessageTypeResume); err != nil {
+		return fmt.Errorf("send resume: %w", err)
+	}
+
+	l.logger.Info("listener resumed")
+
+	return nil
+}
+
+// repause requests the server stops routing new connections to the listener
+// after reconnecting, if the listener was paused.
+func (l *listener) repause() {
+	if !l.paused.Load() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(l.closeCtx, repauseTimeout)
+	defer cancel()
+
+	if err := l.sendControl(ctx, protocol.MessageTypeDrain); err != nil {
+		l.logger.Warn("failed to drain listener after reconnect", zap.Error(err))
+	}
+}
+
+// sendControl sends a control message to the server and waits for the
+// server to acknowledge.
+func (l *listener) sendControl(
+	ctx context.Context,
+	messageType protocol.MessageType,
+) error {
+	stream, err := l.sess.OpenStream()
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// nolint
+		stream.SetDeadline(deadline)
+	}
+
+	buf := []byte{byte(messageType)}
+	if _, err := stream.Write(buf); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if protocol.MessageType(buf[0]) != messageType {
+		return fmt.Errorf("unexpected message type: %d", buf[0])
+	}
+	return nil
+}
+
+// trackConn wraps the accepted connection to track the number of open
+// connections.
+func (l *listener) trackConn(conn net.Conn) net.Conn {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	l.conns++
+	return &trackedConn{
+		Conn:         conn,
+		bytesRead:    l.bytesRead,
+		bytesWritten: l.bytesWritten,
+		onClose:      l.untrackConn,
+	}
+}
+
+func (l *listener) untrackConn() {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+
+	l.conns--
+	if l.conns == 0 && l.connsDone != nil {
+		close(l.connsDone)
+		l.connsDone = nil
+	}
+}
+
+// reconnect reconnects to the server after the connection is dropped.
+func (l *listener) reconnect() (*yamux.Session, error) {
+	l.metrics.ReconnectsTotal.With(prometheus.Labels{
+		"endpoint_id": l.endpointID,
+	}).Inc()
+	l.reconnects.Inc()
+
+	if time.Since(l.connectedAt.Load()) >= l.options.reconnectResetAfter {
+		// The connection was stable so reset the backoff and reconnect
+		// immediately.
+		l.backoff.Reset()
+		return l.connect(l.closeCtx)
+	}
+
+	// If the connection was short-lived, wait before reconnecting to avoid
+	// hammering the server if its unhealthy.
+	if !l.wait(l.closeCtx) {
+		return nil, l.closeCtx.Err()
+	}
+	return l.connect(l.closeCtx)
+}
+
+// connect connects to the server to register the listener, retrying
+// retryable errors with backoff.
+//
+// If the connection fails with a non-retryable error, such as the server
+// rejecting the token, or the number of failed attempts exceeds the
+// configured maximum, connect returns an error.
 func (l *listener) connect(ctx context.Context) (*yamux.Session, error) {
-	backoff := backoff.New(0, minReconnectBackoff, maxReconnectBackoff)
+	labels := prometheus.Labels{
+		"endpoint_id": l.endpointID,
+	}
+
+	attempts := 0
 	for {
+		attempts++
+		l.metrics.ConnectAttemptsTotal.With(labels).Inc()
 		conn, err := websocket.Dial(
 			ctx,
 			upstreamURL(l.options.upstreamURL, l.endpointID),
 			websocket.WithToken(l.options.token),
 			websocket.WithTLSConfig(l.options.tlsConfig),
+			websocket.WithWriteTimeout(l.options.writeTimeout),
 		)
 		if err == nil {
 			l.logger.Debug(
@@ -166,33 +446,187 @@ func (l *listener) connect(ctx context.Context) (*yamux.Session, error) {
 				// Will not happen.
 				panic("yamux client: " + err.Error())
 			}
+			l.connectedAt.Store(time.Now())
+
+			l.metrics.ConnectSuccessesTotal.With(labels).Inc()
+			l.metrics.ReconnectBackoff.With(labels).Set(0)
+			l.metrics.ConnectedListeners.With(labels).Inc()
+			go l.monitor(sess)
+
 			return sess, nil
 		}
 
+		l.metrics.ConnectFailuresTotal.With(prometheus.Labels{
+			"endpoint_id": l.endpointID,
+			"reason":      connectFailureReason(err),
+		}).Inc()
+
 		var retryableError *websocket.RetryableError
 		if !errors.As(err, &retryableError) {
 			l.logger.Error(
 				"failed to connect to server; non-retryable",
 				zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+				zap.Int("attempt", attempts),
 				zap.Error(err),
 			)
 			return nil, err
 		}
 
+		maxAttempts := l.options.reconnectMaxAttempts
+		if maxAttempts > 0 && attempts >= maxAttempts {
+			l.logger.Error(
+				"failed to connect to server; max attempts exceeded",
+				zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+				zap.Int("attempt", attempts),
+				zap.Error(err),
+			)
+			return nil, fmt.Errorf("max attempts exceeded: %w", err)
+		}
+
 		l.logger.Warn(
 			"failed to connect to server; retrying",
 			zap.String("url", upstreamURL(l.options.upstreamURL, l.endpointID)),
+			zap.Int("attempt", attempts),
 			zap.Error(err),
 		)
 
-		if !backoff.Wait(ctx) {
+		if !l.wait(ctx) {
 			return nil, ctx.Err()
 		}
 	}
 }
 
+// monitor records the round-trip time of the session until it is closed,
+// then marks the listener as disconnected.
+func (l *listener) monitor(sess *yamux.Session) {
+	labels := prometheus.Labels{
+		"endpoint_id": l.endpointID,
+	}
+
+	defer l.metrics.ConnectedListeners.With(labels).Dec()
+
+	rtt := l.metrics.RTT.With(labels)
+	observeRTT := func() {
+		d, err := sess.Ping()
+		if err != nil {
+			l.logger.Debug("failed to ping server", zap.Error(err))
+			return
+		}
+		rtt.Observe(d.Seconds())
+		l.rtt.Store(d)
+	}
+
+	observeRTT()
+
+	ticker := time.NewTicker(rttInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			observeRTT()
+		case <-sess.CloseChan():
+			return
+		}
+	}
+}
+
+// wait waits for the reconnect backoff. Returns false if the context is
+// cancelled.
+func (l *listener) wait(ctx context.Context) bool {
+	backoff := l.backoff.Next()
+	l.metrics.ReconnectBackoff.With(prometheus.Labels{
+		"endpoint_id": l.endpointID,
+	}).Set(backoff.Seconds())
+	l.logger.Info(
+		"waiting to reconnect",
+		zap.Int("attempt", l.backoff.Attempts()),
+		zap.Duration("backoff", backoff),
+	)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 var _ Listener = &listener{}
 
+// connectFailureReason returns the reason label for an error connecting to
+// the server: 'dns', 'dial', 'tls', 'auth' or 'other'.
+func connectFailureReason(err error) string {
+	// DNS errors are wrapped in a net.OpError so must be checked first.
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return "dns"
+	}
+
+	var recordHeaderError tls.RecordHeaderError
+	var alertError tls.AlertError
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+	if errors.As(err, &recordHeaderError) ||
+		errors.As(err, &alertError) ||
+		errors.As(err, &verificationError) ||
+		errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &hostnameError) ||
+		errors.As(err, &certificateInvalidError) {
+		return "tls"
+	}
+
+	var statusError *websocket.StatusError
+	if errors.As(err, &statusError) {
+		if statusError.StatusCode == http.StatusUnauthorized ||
+			statusError.StatusCode == http.StatusForbidden {
+			return "auth"
+		}
+		return "other"
+	}
+
+	var opError *net.OpError
+	if errors.As(err, &opError) {
+		return "dial"
+	}
+
+	return "other"
+}
+
+// trackedConn counts the bytes read and written, and calls onClose when the
+// connection is first closed.
+type trackedConn struct {
+	net.Conn
+
+	bytesRead    *atomic.Uint64
+	bytesWritten *atomic.Uint64
+
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
 func upstreamURL(urlStr, endpointID string) string {
 	// Already verified URL in Config.Validate.
 	u, _ := url.Parse(urlStr)
@@ -0,0 +1,465 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/pkg/log"
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+)
+
+func TestListener_Connect(t *testing.T) {
+	opts := func(url string) options {
+		return options{
+			upstreamURL:         url,
+			reconnectMinBackoff: time.Millisecond,
+			reconnectMaxBackoff: time.Millisecond * 4,
+			reconnectMultiplier: 2,
+			reconnectResetAfter: time.Minute,
+		}
+	}
+
+	t.Run("transient error", func(t *testing.T) {
+		var attempts atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// Fail the first two attempts.
+				if attempts.Inc() <= 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				<-r.Context().Done()
+			},
+		))
+		defer server.Close()
+
+		ln, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), NewMetrics(), log.NewNopLogger(),
+		)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		assert.Equal(t, int64(3), attempts.Load())
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		var attempts atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				attempts.Inc()
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		))
+		defer server.Close()
+
+		_, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), NewMetrics(), log.NewNopLogger(),
+		)
+		assert.ErrorContains(t, err, "401")
+
+		// Authentication errors should not be retried.
+		assert.Equal(t, int64(1), attempts.Load())
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		var attempts atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				attempts.Inc()
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer server.Close()
+
+		o := opts(server.URL)
+		o.reconnectMaxAttempts = 3
+		_, err := listen(
+			context.TODO(), "my-endpoint", o, NewMetrics(), log.NewNopLogger(),
+		)
+		assert.ErrorContains(t, err, "max attempts exceeded")
+
+		assert.Equal(t, int64(3), attempts.Load())
+	})
+
+	t.Run("reregister after reconnect", func(t *testing.T) {
+		var attempts atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/piko/v1/upstream/my-endpoint", r.URL.Path)
+
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+
+				// Drop the first connection.
+				if attempts.Inc() == 1 {
+					c.Close()
+					return
+				}
+
+				sess, err := yamux.Server(pikowebsocket.New(c), nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer sess.Close()
+
+				// Once the listener has re-registered, send a connection.
+				stream, err := sess.OpenStream()
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = stream.Write([]byte("foo"))
+				assert.NoError(t, err)
+
+				<-r.Context().Done()
+			},
+		))
+		defer server.Close()
+
+		ln, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), NewMetrics(), log.NewNopLogger(),
+		)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(buf))
+
+		assert.Equal(t, int64(2), attempts.Load())
+	})
+}
+
+func TestListener_ReconnectBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			c, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			<-r.Context().Done()
+		},
+	))
+	defer server.Close()
+
+	opts := options{
+		upstreamURL:         server.URL,
+		reconnectMinBackoff: time.Millisecond,
+		reconnectMaxBackoff: time.Millisecond * 4,
+		reconnectMultiplier: 2,
+		reconnectResetAfter: time.Minute,
+	}
+
+	ln, err := listen(context.TODO(), "my-endpoint", opts, NewMetrics(), log.NewNopLogger())
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// Reconnecting after short-lived connections should backoff, growing
+	// up to the max backoff.
+	expected := []time.Duration{
+		time.Millisecond,
+		time.Millisecond * 2,
+		time.Millisecond * 4,
+		time.Millisecond * 4,
+	}
+	for _, backoff := range expected {
+		sess, err := ln.reconnect()
+		require.NoError(t, err)
+		sess.Close()
+
+		assert.Equal(t, backoff, ln.backoff.Backoff())
+	}
+
+	// Reconnecting after a stable connection should reset the backoff.
+	ln.connectedAt.Store(time.Now().Add(-time.Hour))
+	sess, err := ln.reconnect()
+	require.NoError(t, err)
+	sess.Close()
+
+	assert.Equal(t, time.Duration(0), ln.backoff.Backoff())
+	assert.Equal(t, 0, ln.backoff.Attempts())
+}
+
+func TestListener_ConnectMetrics(t *testing.T) {
+	opts := func(url string) options {
+		return options{
+			upstreamURL:          url,
+			reconnectMinBackoff:  time.Millisecond,
+			reconnectMaxBackoff:  time.Millisecond * 4,
+			reconnectMultiplier:  2,
+			reconnectResetAfter:  time.Minute,
+			reconnectMaxAttempts: 2,
+		}
+	}
+
+	failures := func(m *Metrics, reason string) float64 {
+		return testutil.ToFloat64(m.ConnectFailuresTotal.With(prometheus.Labels{
+			"endpoint_id": "my-endpoint",
+			"reason":      reason,
+		}))
+	}
+	labels := prometheus.Labels{
+		"endpoint_id": "my-endpoint",
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var attempts atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// Fail the first attempt.
+				if attempts.Inc() == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				<-r.Context().Done()
+			},
+		))
+		defer server.Close()
+
+		m := NewMetrics()
+		ln, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), m, log.NewNopLogger(),
+		)
+		require.NoError(t, err)
+		defer ln.Close()
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(m.ConnectAttemptsTotal.With(labels)))
+		assert.Equal(t, 1.0, testutil.ToFloat64(m.ConnectSuccessesTotal.With(labels)))
+		assert.Equal(t, 1.0, failures(m, "other"))
+		// The backoff should be cleared once connected.
+		assert.Equal(t, 0.0, testutil.ToFloat64(m.ReconnectBackoff.With(labels)))
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		))
+		defer server.Close()
+
+		m := NewMetrics()
+		_, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), m, log.NewNopLogger(),
+		)
+		assert.Error(t, err)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(m.ConnectAttemptsTotal.With(labels)))
+		assert.Equal(t, 0.0, testutil.ToFloat64(m.ConnectSuccessesTotal.With(labels)))
+		assert.Equal(t, 1.0, failures(m, "auth"))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(
+			func(http.ResponseWriter, *http.Request) {},
+		))
+		defer server.Close()
+
+		// The agent doesn't trust the servers certificate.
+		m := NewMetrics()
+		_, err := listen(
+			context.TODO(), "my-endpoint", opts(server.URL), m, log.NewNopLogger(),
+		)
+		assert.Error(t, err)
+
+		assert.Equal(t, 2.0, failures(m, "tls"))
+		assert.Greater(t, testutil.ToFloat64(m.ReconnectBackoff.With(labels)), 0.0)
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		// Close the listener so connections are refused.
+		ln.Close()
+
+		m := NewMetrics()
+		_, err = listen(
+			context.TODO(), "my-endpoint", opts("http://"+ln.Addr().String()), m, log.NewNopLogger(),
+		)
+		assert.Error(t, err)
+
+		assert.Equal(t, 2.0, failures(m, "dial"))
+	})
+}
+
+func TestConnectFailureReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+	}{
+		{
+			name: "dns",
+			err: &net.OpError{
+				Op:  "dial",
+				Err: &net.DNSError{Err: "no such host", Name: "piko.invalid"},
+			},
+			reason: "dns",
+		},
+		{
+			name: "dial",
+			err: pikowebsocket.NewRetryableError(&net.OpError{
+				Op:  "dial",
+				Err: errors.New("connection refused"),
+			}),
+			reason: "dial",
+		},
+		{
+			name:   "tls unknown authority",
+			err:    &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}},
+			reason: "tls",
+		},
+		{
+			name: "tls alert",
+			err: &net.OpError{
+				Op:  "remote error",
+				Err: tls.AlertError(42),
+			},
+			reason: "tls",
+		},
+		{
+			name:   "unauthorized",
+			err:    &pikowebsocket.StatusError{StatusCode: http.StatusUnauthorized},
+			reason: "auth",
+		},
+		{
+			name:   "forbidden",
+			err:    &pikowebsocket.StatusError{StatusCode: http.StatusForbidden},
+			reason: "auth",
+		},
+		{
+			name: "unavailable",
+			err: pikowebsocket.NewRetryableError(
+				&pikowebsocket.StatusError{StatusCode: http.StatusServiceUnavailable},
+			),
+			reason: "other",
+		},
+		{
+			name:   "unknown",
+			err:    io.ErrUnexpectedEOF,
+			reason: "other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.reason, connectFailureReason(tt.err))
+		})
+	}
+}
+
+func TestListener_Stats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			upgrader := websocket.Upgrader{}
+			c, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+
+			sess, err := yamux.Server(pikowebsocket.New(c), nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer sess.Close()
+
+			// Open two connections, writing 'foo' and reading 'hello' on
+			// each.
+			for i := 0; i != 2; i++ {
+				stream, err := sess.OpenStream()
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = stream.Write([]byte("foo"))
+				assert.NoError(t, err)
+
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(stream, buf)
+				assert.NoError(t, err)
+				assert.Equal(t, "hello", string(buf))
+			}
+
+			<-r.Context().Done()
+		},
+	))
+	defer server.Close()
+
+	opts := options{
+		upstreamURL:         server.URL,
+		reconnectMinBackoff: time.Millisecond,
+		reconnectMaxBackoff: time.Millisecond * 4,
+		reconnectMultiplier: 2,
+		reconnectResetAfter: time.Minute,
+	}
+
+	ln, err := listen(context.TODO(), "my-endpoint", opts, NewMetrics(), log.NewNopLogger())
+	require.NoError(t, err)
+	defer ln.Close()
+
+	var conns []net.Conn
+	for i := 0; i != 2; i++ {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		conns = append(conns, conn)
+	}
+	conns[0].Close()
+
+	stats := ln.Stats()
+	assert.Equal(t, 1, stats.ActiveConns)
+	assert.Equal(t, uint64(6), stats.BytesRead)
+	assert.Equal(t, uint64(10), stats.BytesWritten)
+	assert.False(t, stats.ConnectedAt.IsZero())
+	assert.Greater(t, stats.Uptime, time.Duration(0))
+	assert.Equal(t, uint64(0), stats.Reconnects)
+
+	// The RTT is measured in the background after connecting.
+	assert.Eventually(t, func() bool {
+		return ln.Stats().RTT > 0
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,117 @@
+package client
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics contains the metrics for all listeners registered by the client.
+type Metrics struct {
+	// ConnectedListeners is the number of listeners currently connected to
+	// the server. Labelled by endpoint ID.
+	ConnectedListeners *prometheus.GaugeVec
+
+	// ReconnectsTotal is the number of times a listener has reconnected to
+	// the server after its connection was dropped. Labelled by endpoint ID.
+	ReconnectsTotal *prometheus.CounterVec
+
+	// ConnectAttemptsTotal is the number of attempts to connect a listener
+	// to the server. Labelled by endpoint ID.
+	ConnectAttemptsTotal *prometheus.CounterVec
+
+	// ConnectSuccessesTotal is the number of successful attempts to connect
+	// a listener to the server. Labelled by endpoint ID.
+	ConnectSuccessesTotal *prometheus.CounterVec
+
+	// ConnectFailuresTotal is the number of failed attempts to connect a
+	// listener to the server. Labelled by endpoint ID and reason ('dns',
+	// 'dial', 'tls', 'auth' or 'other').
+	ConnectFailuresTotal *prometheus.CounterVec
+
+	// ReconnectBackoff is the current delay before a listener next attempts
+	// to connect to the server, or zero if the listener isn't waiting.
+	// Labelled by endpoint ID.
+	ReconnectBackoff *prometheus.GaugeVec
+
+	// RTT is the round-trip time of the listener connections to the
+	// server. Labelled by endpoint ID.
+	RTT *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ConnectedListeners: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connected_listeners",
+				Help:      "Number of listeners connected to the server",
+			},
+			[]string{"endpoint_id"},
+		),
+		ReconnectsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "reconnects_total",
+				Help:      "Number of times a listener reconnected to the server",
+			},
+			[]string{"endpoint_id"},
+		),
+		ConnectAttemptsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connect_attempts_total",
+				Help:      "Number of attempts to connect a listener to the server",
+			},
+			[]string{"endpoint_id"},
+		),
+		ConnectSuccessesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connect_successes_total",
+				Help:      "Number of successful attempts to connect a listener to the server",
+			},
+			[]string{"endpoint_id"},
+		),
+		ConnectFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "connect_failures_total",
+				Help:      "Number of failed attempts to connect a listener to the server",
+			},
+			[]string{"endpoint_id", "reason"},
+		),
+		ReconnectBackoff: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "reconnect_backoff_seconds",
+				Help:      "Delay before a listener next attempts to connect to the server",
+			},
+			[]string{"endpoint_id"},
+		),
+		RTT: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "agent",
+				Name:      "rtt_seconds",
+				Help:      "Round-trip time of listener connections to the server",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"endpoint_id"},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ConnectedListeners,
+		m.ReconnectsTotal,
+		m.ConnectAttemptsTotal,
+		m.ConnectSuccessesTotal,
+		m.ConnectFailuresTotal,
+		m.ReconnectBackoff,
+		m.RTT,
+	)
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"crypto/tls"
+	"time"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -11,7 +12,16 @@ type options struct {
 	proxyURL    string
 	upstreamURL string
 	tlsConfig   *tls.Config
-	logger      log.Logger
+
+	writeTimeout time.Duration
+
+	reconnectMinBackoff  time.Duration
+	reconnectMaxBackoff  time.Duration
+	reconnectMultiplier  float64
+	reconnectResetAfter  time.Duration
+	reconnectMaxAttempts int
+
+	logger log.Logger
 }
 
 type Option interface {
@@ -66,6 +76,81 @@ func WithTLSConfig(config *tls.Config) Option {
 	return tlsConfigOption{TLSConfig: config}
 }
 
+type writeTimeoutOption time.Duration
+
+func (o writeTimeoutOption) apply(opts *options) {
+	opts.writeTimeout = time.Duration(o)
+}
+
+// WithWriteTimeout configures the maximum duration to write each message to
+// the server. If a write exceeds the timeout, such as the server stopped
+// reading, the connection is closed and the listener reconnects.
+//
+// Defaults to 0, meaning writes don't time out.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return writeTimeoutOption(timeout)
+}
+
+type reconnectBackoffOption struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+}
+
+func (o reconnectBackoffOption) apply(opts *options) {
+	opts.reconnectMinBackoff = o.MinBackoff
+	opts.reconnectMaxBackoff = o.MaxBackoff
+	opts.reconnectMultiplier = o.Multiplier
+}
+
+// WithReconnectBackoff configures the exponential backoff when reconnecting
+// to the server. The backoff starts at 'minBackoff' and is multiplied by
+// 'multiplier' after each failed attempt, up to 'maxBackoff'.
+//
+// Defaults to a backoff from 100ms to 15s with a multiplier of 2.
+func WithReconnectBackoff(
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	multiplier float64,
+) Option {
+	return reconnectBackoffOption{
+		MinBackoff: minBackoff,
+		MaxBackoff: maxBackoff,
+		Multiplier: multiplier,
+	}
+}
+
+type reconnectResetAfterOption time.Duration
+
+func (o reconnectResetAfterOption) apply(opts *options) {
+	opts.reconnectResetAfter = time.Duration(o)
+}
+
+// WithReconnectResetAfter configures how long a connection must stay up
+// before the reconnect backoff is reset. If the connection is dropped before
+// then, the client waits for the backoff before reconnecting.
+//
+// Defaults to 30s.
+func WithReconnectResetAfter(d time.Duration) Option {
+	return reconnectResetAfterOption(d)
+}
+
+type reconnectMaxAttemptsOption int
+
+func (o reconnectMaxAttemptsOption) apply(opts *options) {
+	opts.reconnectMaxAttempts = int(o)
+}
+
+// WithReconnectMaxAttempts configures the maximum number of consecutive
+// failed attempts to connect to the server before giving up. Only retryable
+// errors are retried, such as the server being unreachable, whereas errors
+// such as authentication failures are never retried.
+//
+// Defaults to 0, meaning retry until the context is cancelled.
+func WithReconnectMaxAttempts(n int) Option {
+	return reconnectMaxAttemptsOption(n)
+}
+
 type loggerOption struct {
 	Logger log.Logger
 }
@@ -3,20 +3,32 @@ package config
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
 
 type ListenerProtocol string
 
+const (
+	// unixSocketPrefix is the prefix of upstream addresses that are Unix
+	// domain sockets.
+	unixSocketPrefix = "unix:"
+	// fileDirPrefix is the prefix of addresses that are a local directory to
+	// serve static files from.
+	fileDirPrefix = "file:"
+)
+
 const (
 	ListenerProtocolHTTP ListenerProtocol = "http"
 	ListenerProtocolTCP  ListenerProtocol = "tcp"
@@ -27,6 +39,16 @@ type ListenerConfig struct {
 	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
 
 	// Addr is the address of the upstream service to forward to.
+	//
+	// Addr may contain a comma separated list of addresses, in which case
+	// requests are balanced among the upstreams, skipping upstreams that
+	// recently failed.
+	//
+	// Addr may also be a Unix domain socket, in the form 'unix:<path>'. Unix
+	// sockets don't support multiple addresses.
+	//
+	// HTTP listeners may also serve static files from a local directory
+	// rather than forwarding to an upstream, in the form 'file:<path>'.
 	Addr string `json:"addr" yaml:"addr"`
 
 	// Protocol is the protocol to listen on. Supports "http" and "tcp".
@@ -39,58 +61,125 @@ type ListenerConfig struct {
 
 	// Timeout is the timeout to forward incoming requests to the upstream.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// HostHeader rewrites the 'Host' header of HTTP requests forwarded to
+	// the upstream. Takes precedence over RewriteHost.
+	HostHeader string `json:"host_header" yaml:"host_header"`
+
+	// RewriteHost indicates whether to rewrite the 'Host' header of HTTP
+	// requests forwarded to the upstream to the upstream address. If false,
+	// and HostHeader is empty, the 'Host' header of the incoming request is
+	// preserved.
+	RewriteHost bool `json:"rewrite_host" yaml:"rewrite_host"`
+
+	// SPAFallback indicates whether to serve 'index.html' from the root of
+	// the directory when a requested file doesn't exist, such as for single
+	// page apps that handle routing in the browser. Only applies when
+	// serving files.
+	SPAFallback bool `json:"spa_fallback" yaml:"spa_fallback"`
+
+	// HTTP2 indicates whether to forward HTTP requests to the upstream using
+	// HTTP/2, such as for gRPC upstreams. Cleartext upstreams use HTTP/2
+	// with prior knowledge (h2c), and TLS upstreams negotiate HTTP/2 with
+	// ALPN.
+	HTTP2 bool `json:"http2" yaml:"http2"`
+
+	// RequestHeaders rewrites the headers of HTTP requests forwarded to the
+	// upstream.
+	RequestHeaders HeadersConfig `json:"request_headers" yaml:"request_headers"`
+
+	// ResponseHeaders rewrites the headers of HTTP responses returned by the
+	// upstream.
+	ResponseHeaders HeadersConfig `json:"response_headers" yaml:"response_headers"`
+
+	// TLS configures the connection to the upstream.
+	TLS UpstreamTLSConfig `json:"tls" yaml:"tls"`
+
+	// HealthCheck configures actively probing the upstreams.
+	HealthCheck HealthCheckConfig `json:"health_check" yaml:"health_check"`
+
+	// CircuitBreaker configures a circuit breaker for each upstream of HTTP
+	// listeners.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker" yaml:"circuit_breaker"`
+
+	// Retry configures retrying HTTP requests that fail to connect to the
+	// upstream.
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+
+	// Transport configures connections to the upstreams of HTTP listeners.
+	Transport TransportConfig `json:"transport" yaml:"transport"`
+}
+
+// UnixSocket returns the path of the upstream Unix domain socket, or false if
+// the upstream isn't a Unix socket.
+func (c *ListenerConfig) UnixSocket() (string, bool) {
+	return strings.CutPrefix(strings.TrimSpace(c.Addr), unixSocketPrefix)
+}
+
+// FileDir returns the path of the directory to serve static files from, or
+// false if the listener forwards to an upstream.
+func (c *ListenerConfig) FileDir() (string, bool) {
+	return strings.CutPrefix(strings.TrimSpace(c.Addr), fileDirPrefix)
 }
 
 // Host parses the given upstream address into a host and port. Return false if
 // the address is invalid.
 //
-// The addr may be either a a host and port or just a port.
+// The addr may be either a a host and port or just a port. If multiple
+// addresses are configured, returns the first.
 func (c *ListenerConfig) Host() (string, bool) {
-	// Port only.
-	port, err := strconv.Atoi(c.Addr)
-	if err == nil && port >= 0 && port < 0xffff {
-		return "localhost:" + c.Addr, true
+	hosts, ok := c.Hosts()
+	if !ok {
+		return "", false
 	}
+	return hosts[0], true
+}
 
-	// Host and port.
-	_, _, err = net.SplitHostPort(c.Addr)
-	if err == nil {
-		return c.Addr, true
+// Hosts parses the upstream addresses into hosts and ports. Return false if
+// any address is invalid.
+//
+// Addr may contain a comma separated list of addresses to balance requests
+// among multiple upstreams.
+func (c *ListenerConfig) Hosts() ([]string, bool) {
+	var hosts []string
+	for _, addr := range strings.Split(c.Addr, ",") {
+		host, ok := parseHost(strings.TrimSpace(addr))
+		if !ok {
+			return nil, false
+		}
+		hosts = append(hosts, host)
 	}
-
-	return "", false
+	return hosts, true
 }
 
 // URL parses the given upstream address into a URL. Return false if the
 // address is invalid.
 //
-// The addr may be either a full URL, a host and port or just a port.
+// The addr may be either a full URL, a host and port or just a port. If
+// multiple addresses are configured, returns the first.
 func (c *ListenerConfig) URL() (*url.URL, bool) {
-	// Port only.
-	port, err := strconv.Atoi(c.Addr)
-	if err == nil && port >= 0 && port < 0xffff {
-		return &url.URL{
-			Scheme: "http",
-			Host:   "localhost:" + c.Addr,
-		}, true
-	}
-
-	// Host and port.
-	host, portStr, err := net.SplitHostPort(c.Addr)
-	if err == nil {
-		return &url.URL{
-			Scheme: "http",
-			Host:   net.JoinHostPort(host, portStr),
-		}, true
+	urls, ok := c.URLs()
+	if !ok {
+		return nil, false
 	}
+	return urls[0], true
+}
 
-	// URL.
-	u, err := url.Parse(c.Addr)
-	if err == nil && u.Scheme != "" && u.Host != "" {
-		return u, true
+// URLs parses the upstream addresses into URLs. Return false if any address
+// is invalid.
+//
+// Addr may contain a comma separated list of addresses to balance requests
+// among multiple upstreams.
+func (c *ListenerConfig) URLs() ([]*url.URL, bool) {
+	var urls []*url.URL
+	for _, addr := range strings.Split(c.Addr, ",") {
+		u, ok := parseURL(strings.TrimSpace(addr))
+		if !ok {
+			return nil, false
+		}
+		urls = append(urls, u)
 	}
-
-	return nil, false
+	return urls, true
 }
 
 func (c *ListenerConfig) Validate() error {
@@ -100,20 +189,304 @@ func (c *ListenerConfig) Validate() error {
 	if c.Addr == "" {
 		return fmt.Errorf("missing addr")
 	}
-	if c.Protocol == "" || c.Protocol == ListenerProtocolHTTP {
+	if c.Protocol != "" && c.Protocol != ListenerProtocolHTTP &&
+		c.Protocol != ListenerProtocolTCP {
+		return fmt.Errorf("unsupported protocol")
+	}
+	if path, ok := c.UnixSocket(); ok {
+		if err := validateUnixSocket(path); err != nil {
+			return fmt.Errorf("invalid addr: %w", err)
+		}
+	} else if path, ok := c.FileDir(); ok {
+		if c.Protocol == ListenerProtocolTCP {
+			return fmt.Errorf("invalid addr: tcp listeners cannot serve files")
+		}
+		if err := validateFileDir(path); err != nil {
+			return fmt.Errorf("invalid addr: %w", err)
+		}
+		if c.HealthCheck.Enabled {
+			return fmt.Errorf("health check: not supported when serving files")
+		}
+	} else if c.Protocol == "" || c.Protocol == ListenerProtocolHTTP {
 		if _, ok := c.URL(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
-	} else if c.Protocol != ListenerProtocolTCP {
+	} else if c.Protocol == ListenerProtocolTCP {
 		if _, ok := c.Host(); !ok {
 			return fmt.Errorf("invalid addr")
 		}
-	} else {
-		return fmt.Errorf("unsupported protocol")
 	}
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if err := c.RequestHeaders.Validate(); err != nil {
+		return fmt.Errorf("request headers: %w", err)
+	}
+	if err := c.ResponseHeaders.Validate(); err != nil {
+		return fmt.Errorf("response headers: %w", err)
+	}
+	if c.ResponseHeaders.SetsHost() {
+		return fmt.Errorf("response headers: cannot rewrite host")
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+	if err := c.CircuitBreaker.Validate(); err != nil {
+		return fmt.Errorf("circuit breaker: %w", err)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if err := c.Transport.Validate(); err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
+	return nil
+}
+
+// HeadersConfig configures rewriting HTTP headers.
+//
+// Headers are first removed, then set, then added.
+//
+// Values may reference the original request from the client, where '{host}'
+// is replaced with the 'Host' header, '{client_ip}' is replaced with the IP of
+// the client that sent the request to Piko, and '{header.<name>}' is replaced
+// with the value of the named request header, such as '{header.X-Real-Ip}'.
+type HeadersConfig struct {
+	// Add appends values to the named headers, preserving any existing
+	// values.
+	Add map[string]string `json:"add" yaml:"add"`
+
+	// Set replaces the named headers with the given values.
+	//
+	// Setting 'Host' on requests overrides the 'Host' header forwarded to
+	// the upstream.
+	Set map[string]string `json:"set" yaml:"set"`
+
+	// Remove removes the named headers.
+	Remove []string `json:"remove" yaml:"remove"`
+}
+
+// Enabled returns whether any header rewrites are configured.
+func (c *HeadersConfig) Enabled() bool {
+	return len(c.Add) > 0 || len(c.Set) > 0 || len(c.Remove) > 0
+}
+
+func (c *HeadersConfig) Validate() error {
+	for name, value := range c.Add {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("add: invalid header name: %q", name)
+		}
+		if strings.EqualFold(name, "Host") {
+			return fmt.Errorf("add: host header must be set rather than added")
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("add: %s: invalid header value", name)
+		}
+	}
+	for name, value := range c.Set {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("set: invalid header name: %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("set: %s: invalid header value", name)
+		}
+	}
+	for _, name := range c.Remove {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("remove: invalid header name: %q", name)
+		}
+		if strings.EqualFold(name, "Host") {
+			return fmt.Errorf("remove: cannot remove host header")
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the config with header values redacted, since values
+// may contain secrets, such as tokens to authenticate with the upstream, and
+// the config is logged on startup.
+func (c HeadersConfig) MarshalJSON() ([]byte, error) {
+	redact := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		redacted := make(map[string]string, len(m))
+		for name := range m {
+			redacted[name] = "<redacted>"
+		}
+		return redacted
+	}
+
+	type headersConfig HeadersConfig
+	return json.Marshal(headersConfig{
+		Add:    redact(c.Add),
+		Set:    redact(c.Set),
+		Remove: c.Remove,
+	})
+}
+
+// SetsHost returns whether the config sets the 'Host' header.
+func (c *HeadersConfig) SetsHost() bool {
+	for name := range c.Set {
+		if strings.EqualFold(name, "Host") {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheckConfig configures actively probing a listeners upstreams.
+//
+// HTTP listeners probe each upstream with a 'GET' request to Path, where any
+// 2xx or 3xx response is healthy. TCP listeners probe each upstream by opening
+// a connection.
+//
+// Unhealthy upstreams are skipped by the load balancer. If all upstreams are
+// unhealthy, the listener is paused so the Piko server stops routing requests
+// to the listener until an upstream recovers.
+type HealthCheckConfig struct {
+	// Enabled indicates whether to probe the upstreams.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Path is the HTTP path to probe. Defaults to '/'.
+	Path string `json:"path" yaml:"path"`
+
+	// Interval is the interval between probes. Defaults to 10 seconds.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+
+	// Timeout is the timeout of each probe. Defaults to 5 seconds.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// HealthyThreshold is the number of consecutive successful probes before
+	// an unhealthy upstream is marked healthy. Defaults to 2.
+	HealthyThreshold int `json:"healthy_threshold" yaml:"healthy_threshold"`
+
+	// UnhealthyThreshold is the number of consecutive failed probes before a
+	// healthy upstream is marked unhealthy. Defaults to 3.
+	UnhealthyThreshold int `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+}
+
+func (c *HealthCheckConfig) Validate() error {
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.HealthyThreshold < 0 {
+		return fmt.Errorf("healthy threshold must not be negative")
+	}
+	if c.UnhealthyThreshold < 0 {
+		return fmt.Errorf("unhealthy threshold must not be negative")
+	}
+	return nil
+}
+
+// CircuitBreakerConfig configures a circuit breaker for each upstream.
+//
+// The breaker opens after FailureThreshold consecutive requests fail to
+// connect to the upstream, or fail before the upstream responds. While open,
+// requests to the upstream fail immediately rather than waiting for the
+// timeout, and the load balancer skips the upstream. After OpenTimeout a
+// single trial request is sent, which closes the breaker if it succeeds.
+type CircuitBreakerConfig struct {
+	// Enabled indicates whether to enable the circuit breaker.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// FailureThreshold is the number of consecutive failures before the
+	// breaker opens. Defaults to 5.
+	FailureThreshold int `json:"failure_threshold" yaml:"failure_threshold"`
+
+	// OpenTimeout is the duration the breaker stays open before sending a
+	// trial request. Defaults to 30 seconds.
+	OpenTimeout time.Duration `json:"open_timeout" yaml:"open_timeout"`
+}
+
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.FailureThreshold < 0 {
+		return fmt.Errorf("failure threshold must not be negative")
+	}
+	if c.OpenTimeout < 0 {
+		return fmt.Errorf("open timeout must not be negative")
+	}
+	return nil
+}
+
+// RetryConfig configures retrying requests that fail to connect to the
+// upstream.
+//
+// Only idempotent requests without a body are retried, since the upstream
+// may have received the request before the connection was reset.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts to send a request,
+	// including the first attempt. If zero or one, requests aren't retried.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+
+	// Backoff is the duration to wait between attempts. Defaults to 100ms.
+	Backoff time.Duration `json:"backoff" yaml:"backoff"`
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must not be negative")
+	}
+	if c.Backoff < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	return nil
+}
+
+// TransportConfig configures connections to the upstream.
+//
+// Zero values use the defaults of Go's http.DefaultTransport.
+type TransportConfig struct {
+	// DialTimeout is the timeout to connect to the upstream. Defaults to 30
+	// seconds.
+	DialTimeout time.Duration `json:"dial_timeout" yaml:"dial_timeout"`
+
+	// KeepAlive is the interval between TCP keep-alive probes. Defaults to
+	// 30 seconds.
+	KeepAlive time.Duration `json:"keep_alive" yaml:"keep_alive"`
+
+	// MaxIdleConns is the maximum number of idle connections to all
+	// upstreams of the listener. Defaults to 100.
+	MaxIdleConns int `json:"max_idle_conns" yaml:"max_idle_conns"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections to each
+	// upstream. Defaults to 2.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+
+	// IdleConnTimeout is the duration an idle connection is kept before
+	// being closed. Defaults to 90 seconds.
+	IdleConnTimeout time.Duration `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+
+	// TLSHandshakeTimeout is the timeout for the TLS handshake with the
+	// upstream. Defaults to 10 seconds.
+	TLSHandshakeTimeout time.Duration `json:"tls_handshake_timeout" yaml:"tls_handshake_timeout"`
+}
+
+func (c *TransportConfig) Validate() error {
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial timeout must not be negative")
+	}
+	if c.KeepAlive < 0 {
+		return fmt.Errorf("keep alive must not be negative")
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("max idle conns must not be negative")
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max idle conns per host must not be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle conn timeout must not be negative")
+	}
+	if c.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("tls handshake timeout must not be negative")
+	}
 	return nil
 }
 
@@ -123,6 +496,23 @@ type TLSConfig struct {
 	//
 	// Defaults to using the host root CAs.
 	RootCAs string `json:"root_cas" yaml:"root_cas"`
+
+	// Cert contains a path to a PEM encoded client certificate to
+	// authenticate with the Piko server using mutual TLS.
+	Cert string `json:"cert" yaml:"cert"`
+
+	// Key contains a path to the PEM encoded key of the client certificate.
+	Key string `json:"key" yaml:"key"`
+}
+
+func (c *TLSConfig) Validate() error {
+	if c.Cert != "" && c.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if c.Key != "" && c.Cert == "" {
+		return fmt.Errorf("missing cert")
+	}
+	return nil
 }
 
 func (c *TLSConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
@@ -137,15 +527,44 @@ validate the TLS connection to the Piko server.
 
 Defaults to using the host root CAs.`,
 	)
+	fs.StringVar(
+		&c.Cert,
+		prefix+"cert",
+		c.Cert,
+		`
+A path to a PEM encoded client certificate to authenticate with the Piko
+server using mutual TLS.
+
+The certificate may be used instead of, or as well as, a token.`,
+	)
+	fs.StringVar(
+		&c.Key,
+		prefix+"key",
+		c.Key,
+		`
+A path to the PEM encoded key of the client certificate.`,
+	)
 }
 
 func (c *TLSConfig) Load() (*tls.Config, error) {
-	if c.RootCAs == "" {
+	if c.RootCAs == "" && c.Cert == "" {
 		return nil, nil
 	}
 
 	tlsConfig := &tls.Config{}
 
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.RootCAs == "" {
+		return tlsConfig, nil
+	}
+
 	caCert, err := os.ReadFile(c.RootCAs)
 	if err != nil {
 		return nil, fmt.Errorf("open root cas: %s: %w", c.RootCAs, err)
@@ -160,6 +579,259 @@ func (c *TLSConfig) Load() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// validateUnixSocket verifies the Unix socket at the given path exists.
+func validateUnixSocket(path string) error {
+	if path == "" {
+		return fmt.Errorf("missing unix socket path")
+	}
+	if strings.Contains(path, ",") {
+		return fmt.Errorf("unix socket: multiple addresses not supported")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("unix socket: %s: not found", path)
+		}
+		return fmt.Errorf("unix socket: %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix socket: %s: not a socket", path)
+	}
+	return nil
+}
+
+// validateFileDir verifies the directory at the given path exists.
+func validateFileDir(path string) error {
+	if path == "" {
+		return fmt.Errorf("missing file directory path")
+	}
+	if strings.Contains(path, ",") {
+		return fmt.Errorf("file: multiple addresses not supported")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file: %s: not found", path)
+		}
+		return fmt.Errorf("file: %s: %w", path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("file: %s: not a directory", path)
+	}
+	return nil
+}
+
+func parseHost(addr string) (string, bool) {
+	// Port only.
+	port, err := strconv.Atoi(addr)
+	if err == nil && port >= 0 && port < 0xffff {
+		return "localhost:" + addr, true
+	}
+
+	// Host and port.
+	_, _, err = net.SplitHostPort(addr)
+	if err == nil {
+		return addr, true
+	}
+
+	return "", false
+}
+
+func parseURL(addr string) (*url.URL, bool) {
+	// Port only.
+	port, err := strconv.Atoi(addr)
+	if err == nil && port >= 0 && port < 0xffff {
+		return &url.URL{
+			Scheme: "http",
+			Host:   "localhost:" + addr,
+		}, true
+	}
+
+	// Host and port.
+	host, portStr, err := net.SplitHostPort(addr)
+	if err == nil {
+		return &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(host, portStr),
+		}, true
+	}
+
+	// URL.
+	u, err := url.Parse(addr)
+	if err == nil && u.Scheme != "" && u.Host != "" {
+		return u, true
+	}
+
+	return nil, false
+}
+
+// UpstreamTLSConfig configures TLS when connecting to an upstream.
+type UpstreamTLSConfig struct {
+	// Enabled indicates whether to connect to the upstream using TLS.
+	//
+	// HTTP upstreams configured with an 'https' URL always use TLS.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// RootCAs contains a path to root certificate authorities to verify the
+	// upstream certificate.
+	//
+	// Defaults to using the host root CAs.
+	RootCAs string `json:"root_cas" yaml:"root_cas"`
+
+	// Cert contains a path to a PEM encoded client certificate to
+	// authenticate with the upstream.
+	Cert string `json:"cert" yaml:"cert"`
+
+	// Key contains a path to the PEM encoded key of the client certificate.
+	Key string `json:"key" yaml:"key"`
+
+	// ServerName overrides the server name used to verify the upstream
+	// certificate and sent using SNI. Defaults to the upstream host.
+	ServerName string `json:"server_name" yaml:"server_name"`
+
+	// InsecureSkipVerify indicates whether to skip verifying the upstream
+	// certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+func (c *UpstreamTLSConfig) Validate() error {
+	if c.Cert != "" && c.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if c.Key != "" && c.Cert == "" {
+		return fmt.Errorf("missing cert")
+	}
+	return nil
+}
+
+// Load returns the TLS configuration to connect to the upstream, or nil if
+// TLS isn't configured.
+func (c *UpstreamTLSConfig) Load() (*tls.Config, error) {
+	if !c.Enabled && c.RootCAs == "" && c.Cert == "" &&
+		c.ServerName == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: c.ServerName,
+		// nolint
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.RootCAs != "" {
+		caCert, err := os.ReadFile(c.RootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("open root cas: %s: %w", c.RootCAs, err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("parse root cas: %s", c.RootCAs)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return tlsConfig, nil
+}
+
+// ReconnectConfig configures the backoff when reconnecting to the Piko server.
+type ReconnectConfig struct {
+	// MinBackoff is the initial backoff after a failed attempt.
+	MinBackoff time.Duration `json:"min_backoff" yaml:"min_backoff"`
+
+	// MaxBackoff is the maximum backoff.
+	MaxBackoff time.Duration `json:"max_backoff" yaml:"max_backoff"`
+
+	// Multiplier is the factor the backoff increases by after each failed
+	// attempt.
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+
+	// ResetAfter is the duration a connection must stay up before the
+	// backoff is reset.
+	ResetAfter time.Duration `json:"reset_after" yaml:"reset_after"`
+
+	// MaxAttempts is the maximum number of consecutive failed attempts to
+	// connect before giving up. If zero the agent retries indefinitely.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+}
+
+func (c *ReconnectConfig) Validate() error {
+	if c.MinBackoff <= 0 {
+		return fmt.Errorf("missing min backoff")
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		return fmt.Errorf("max backoff must be at least min backoff")
+	}
+	if c.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts cannot be negative")
+	}
+	return nil
+}
+
+func (c *ReconnectConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".reconnect."
+	fs.DurationVar(
+		&c.MinBackoff,
+		prefix+"min-backoff",
+		c.MinBackoff,
+		`
+The initial backoff when reconnecting to the Piko server after the connection
+is dropped.
+
+The agent uses exponential backoff with jitter, where the backoff is
+multiplied by '--connect.reconnect.multiplier' after each failed attempt up
+to '--connect.reconnect.max-backoff'.`,
+	)
+	fs.DurationVar(
+		&c.MaxBackoff,
+		prefix+"max-backoff",
+		c.MaxBackoff,
+		`
+The maximum backoff when reconnecting to the Piko server.`,
+	)
+	fs.Float64Var(
+		&c.Multiplier,
+		prefix+"multiplier",
+		c.Multiplier,
+		`
+The factor the reconnect backoff increases by after each failed attempt.`,
+	)
+	fs.DurationVar(
+		&c.ResetAfter,
+		prefix+"reset-after",
+		c.ResetAfter,
+		`
+How long a connection must stay up before the reconnect backoff is reset.
+
+If the connection is dropped before then, the agent waits for the backoff
+before reconnecting.`,
+	)
+	fs.IntVar(
+		&c.MaxAttempts,
+		prefix+"max-attempts",
+		c.MaxAttempts,
+		`
+The maximum number of consecutive failed attempts to connect to the Piko
+server before the agent gives up.
+
+Only transient errors are retried, such as the server being unreachable or
+returning '503 Service Unavailable'. Permanent errors, such as the server
+rejecting the token, are never retried.
+
+Set to 0 to retry indefinitely (bounded by '--connect.timeout' on boot).`,
+	)
+}
+
 type ConnectConfig struct {
 	// URL is the Piko server URL to connect to.
 	URL string
@@ -171,6 +843,12 @@ type ConnectConfig struct {
 	// boot.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
+	// WriteTimeout is the maximum duration to write each message to the
+	// Piko server. If zero, writes don't time out.
+	WriteTimeout time.Duration `json:"write_timeout" yaml:"write_timeout"`
+
+	Reconnect ReconnectConfig `json:"reconnect" yaml:"reconnect"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
 }
 
@@ -184,6 +862,15 @@ func (c *ConnectConfig) Validate() error {
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout cannot be negative")
+	}
+	if err := c.Reconnect.Validate(); err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
 	return nil
 }
 
@@ -215,6 +902,22 @@ is disconnected after the initial connection succeeds it will keep trying to
 reconnect.`,
 	)
 
+	fs.DurationVar(
+		&c.WriteTimeout,
+		"connect.write-timeout",
+		c.WriteTimeout,
+		`
+The maximum duration to write each message to the Piko server.
+
+If a write exceeds the timeout, such as the server or network stops
+accepting data, the connection is closed and the agent reconnects, rather
+than blocking indefinitely.
+
+If zero, writes don't time out.`,
+	)
+
+	c.Reconnect.RegisterFlags(fs, "connect")
+
 	c.TLS.RegisterFlags(fs, "connect")
 }
 
@@ -253,8 +956,9 @@ type Config struct {
 	Log log.Config `json:"log" yaml:"log"`
 
 	// GracePeriod is the duration to gracefully shutdown the agent. During
-	// the grace period, listeners and idle connections are closed, then waits
-	// for active requests to complete and closes their connections.
+	// the grace period, each listener is drained so the server stops routing
+	// new requests to the listener, then waits for active requests to
+	// complete and closes their connections.
 	GracePeriod time.Duration `json:"grace_period" yaml:"grace_period"`
 }
 
@@ -263,12 +967,19 @@ func Default() *Config {
 		Connect: ConnectConfig{
 			URL:     "http://localhost:8001",
 			Timeout: time.Second * 30,
+			Reconnect: ReconnectConfig{
+				MinBackoff: time.Millisecond * 100,
+				MaxBackoff: time.Second * 15,
+				Multiplier: 2,
+				ResetAfter: time.Second * 30,
+			},
 		},
 		Server: ServerConfig{
 			BindAddr: ":5000",
 		},
 		Log: log.Config{
-			Level: "info",
+			Level:  "info",
+			Format: "json",
 		},
 		GracePeriod: time.Minute,
 	}
@@ -317,6 +1028,10 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 		`
 Maximum duration after a shutdown signal is received (SIGTERM or
 SIGINT) to gracefully shutdown each listener.
+
+On shutdown, each listener is drained, meaning the server stops routing new
+requests to the listener, then the agent waits for in-flight requests to
+complete before disconnecting.
 `,
 	)
 
@@ -1,10 +1,16 @@
 package config
 
 import (
+	"encoding/json"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Tests the default configuration is valid.
@@ -13,6 +19,84 @@ func TestConfig_Default(t *testing.T) {
 	assert.NoError(t, conf.Validate())
 }
 
+func TestHeadersConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		conf HeadersConfig
+		ok   bool
+	}{
+		{
+			name: "ok",
+			conf: HeadersConfig{
+				Add:    map[string]string{"X-Add": "{header.X-Foo}"},
+				Set:    map[string]string{"Host": "internal.example.com"},
+				Remove: []string{"X-Remove"},
+			},
+			ok: true,
+		},
+		{
+			name: "invalid name",
+			conf: HeadersConfig{
+				Set: map[string]string{"X Set": "foo"},
+			},
+		},
+		{
+			name: "invalid value",
+			conf: HeadersConfig{
+				Add: map[string]string{"X-Add": "foo\r\nX-Injected: bar"},
+			},
+		},
+		{
+			name: "add host",
+			conf: HeadersConfig{
+				Add: map[string]string{"host": "internal.example.com"},
+			},
+		},
+		{
+			name: "remove host",
+			conf: HeadersConfig{
+				Remove: []string{"Host"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ok {
+				assert.NoError(t, tt.conf.Validate())
+			} else {
+				assert.Error(t, tt.conf.Validate())
+			}
+		})
+	}
+}
+
+// Tests header values are redacted when the config is logged.
+func TestHeadersConfig_MarshalJSON(t *testing.T) {
+	conf := ListenerConfig{
+		RequestHeaders: HeadersConfig{
+			Add:    map[string]string{"X-Add": "secret-1"},
+			Set:    map[string]string{"Authorization": "Bearer secret-2"},
+			Remove: []string{"X-Remove"},
+		},
+	}
+	b, err := json.Marshal(conf)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "secret")
+
+	var decoded struct {
+		RequestHeaders struct {
+			Add    map[string]string `json:"add"`
+			Set    map[string]string `json:"set"`
+			Remove []string          `json:"remove"`
+		} `json:"request_headers"`
+	}
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	assert.Equal(t, map[string]string{"X-Add": "<redacted>"}, decoded.RequestHeaders.Add)
+	assert.Equal(t, map[string]string{"Authorization": "<redacted>"}, decoded.RequestHeaders.Set)
+	assert.Equal(t, []string{"X-Remove"}, decoded.RequestHeaders.Remove)
+}
+
 func TestListenerConfig_URL(t *testing.T) {
 	tests := []struct {
 		addr string
@@ -59,3 +143,118 @@ func TestListenerConfig_URL(t *testing.T) {
 		})
 	}
 }
+
+func TestListenerConfig_URLs(t *testing.T) {
+	conf := &ListenerConfig{Addr: "8080, 1.2.3.4:8080,https://1.2.3.4:8443"}
+	urls, ok := conf.URLs()
+	assert.True(t, ok)
+	assert.Equal(t, []*url.URL{
+		{Scheme: "http", Host: "localhost:8080"},
+		{Scheme: "http", Host: "1.2.3.4:8080"},
+		{Scheme: "https", Host: "1.2.3.4:8443"},
+	}, urls)
+
+	conf = &ListenerConfig{Addr: "8080,invalid"}
+	_, ok = conf.URLs()
+	assert.False(t, ok)
+}
+
+func TestListenerConfig_Hosts(t *testing.T) {
+	conf := &ListenerConfig{Addr: "8080,1.2.3.4:8080"}
+	hosts, ok := conf.Hosts()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"localhost:8080", "1.2.3.4:8080"}, hosts)
+
+	conf = &ListenerConfig{Addr: "8080,"}
+	_, ok = conf.Hosts()
+	assert.False(t, ok)
+}
+
+func TestListenerConfig_ValidateTCP(t *testing.T) {
+	conf := &ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "localhost:3000",
+		Protocol:   ListenerProtocolTCP,
+		Timeout:    time.Second,
+	}
+	assert.NoError(t, conf.Validate())
+
+	conf.Addr = "localhost"
+	assert.EqualError(t, conf.Validate(), "invalid addr")
+}
+
+func TestListenerConfig_UnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	socketPath := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	filePath := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(filePath, nil, 0o600))
+
+	conf := &ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "unix:" + socketPath,
+		Timeout:    time.Second,
+	}
+	path, ok := conf.UnixSocket()
+	assert.True(t, ok)
+	assert.Equal(t, socketPath, path)
+	assert.NoError(t, conf.Validate())
+
+	conf.Protocol = ListenerProtocolTCP
+	assert.NoError(t, conf.Validate())
+
+	conf.Addr = "unix:" + filepath.Join(dir, "missing.sock")
+	assert.ErrorContains(t, conf.Validate(), "not found")
+
+	conf.Addr = "unix:" + filePath
+	assert.ErrorContains(t, conf.Validate(), "not a socket")
+
+	conf.Addr = "unix:"
+	assert.ErrorContains(t, conf.Validate(), "missing unix socket path")
+
+	conf.Addr = "localhost:3000"
+	_, ok = conf.UnixSocket()
+	assert.False(t, ok)
+}
+
+func TestListenerConfig_FileDir(t *testing.T) {
+	dir := t.TempDir()
+
+	filePath := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(filePath, nil, 0o600))
+
+	conf := &ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "file:" + dir,
+		Timeout:    time.Second,
+	}
+	path, ok := conf.FileDir()
+	assert.True(t, ok)
+	assert.Equal(t, dir, path)
+	assert.NoError(t, conf.Validate())
+
+	conf.Protocol = ListenerProtocolTCP
+	assert.ErrorContains(t, conf.Validate(), "tcp listeners cannot serve files")
+	conf.Protocol = ListenerProtocolHTTP
+
+	conf.HealthCheck.Enabled = true
+	assert.ErrorContains(t, conf.Validate(), "not supported when serving files")
+	conf.HealthCheck.Enabled = false
+
+	conf.Addr = "file:" + filepath.Join(dir, "missing")
+	assert.ErrorContains(t, conf.Validate(), "not found")
+
+	conf.Addr = "file:" + filePath
+	assert.ErrorContains(t, conf.Validate(), "not a directory")
+
+	conf.Addr = "file:"
+	assert.ErrorContains(t, conf.Validate(), "missing file directory path")
+
+	conf.Addr = "localhost:3000"
+	_, ok = conf.FileDir()
+	assert.False(t, ok)
+}
@@ -0,0 +1,415 @@
+// Package healthcheck actively probes a listeners upstreams.
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	defaultPath               = "/"
+	defaultInterval           = time.Second * 10
+	defaultTimeout            = time.Second * 5
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+)
+
+// UpstreamStatus contains the health of an upstream.
+type UpstreamStatus struct {
+	Addr    string `json:"addr"`
+	Healthy bool   `json:"healthy"`
+	// Error is the error of the last failed probe, or empty if the last
+	// probe succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Status contains the health of a listeners upstreams.
+type Status struct {
+	EndpointID string `json:"endpoint_id"`
+	// Healthy indicates whether any upstream is healthy.
+	Healthy   bool             `json:"healthy"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+type upstream struct {
+	addr  string
+	probe func(ctx context.Context) error
+
+	healthy bool
+	// successes and failures are the number of consecutive successful and
+	// failed probes.
+	successes int
+	failures  int
+	lastErr   error
+}
+
+// Checker probes a listeners upstreams.
+//
+// Upstreams start healthy, then are marked unhealthy after
+// 'UnhealthyThreshold' consecutive failed probes, and healthy again after
+// 'HealthyThreshold' consecutive successful probes.
+type Checker struct {
+	endpointID string
+
+	upstreams []*upstream
+
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	onUpstreamChange []func(idx int, healthy bool)
+	onChange         []func(healthy bool)
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+// NewChecker returns a checker probing the upstreams of the given listener.
+//
+// tlsConfig configures TLS connections to HTTP upstreams. If nil the default
+// TLS configuration is used for 'https' upstreams.
+func NewChecker(
+	conf config.ListenerConfig,
+	tlsConfig *tls.Config,
+	logger log.Logger,
+) *Checker {
+	logger = logger.WithSubsystem("healthcheck")
+	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
+
+	c := &Checker{
+		endpointID:         conf.EndpointID,
+		interval:           conf.HealthCheck.Interval,
+		timeout:            conf.HealthCheck.Timeout,
+		healthyThreshold:   conf.HealthCheck.HealthyThreshold,
+		unhealthyThreshold: conf.HealthCheck.UnhealthyThreshold,
+		logger:             logger,
+	}
+	if c.interval == 0 {
+		c.interval = defaultInterval
+	}
+	if c.timeout == 0 {
+		c.timeout = defaultTimeout
+	}
+	if c.healthyThreshold == 0 {
+		c.healthyThreshold = defaultHealthyThreshold
+	}
+	if c.unhealthyThreshold == 0 {
+		c.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	if conf.Protocol == config.ListenerProtocolTCP {
+		c.upstreams = tcpUpstreams(conf)
+	} else {
+		c.upstreams = httpUpstreams(conf, tlsConfig)
+	}
+	for _, u := range c.upstreams {
+		u.healthy = true
+	}
+
+	return c
+}
+
+// OnUpstreamChange registers a callback called when an upstream changes
+// between healthy and unhealthy, where the upstream is identified by its
+// index in the listeners addresses.
+//
+// Callbacks are called synchronously, so delay the next probe until they
+// return.
+func (c *Checker) OnUpstreamChange(f func(idx int, healthy bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onUpstreamChange = append(c.onUpstreamChange, f)
+}
+
+// OnChange registers a callback called when the listener changes between
+// healthy, meaning at least one upstream is healthy, and unhealthy.
+//
+// Callbacks are called synchronously, so delay the next probe until they
+// return.
+func (c *Checker) OnChange(f func(healthy bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onChange = append(c.onChange, f)
+}
+
+// Run probes the upstreams every interval until the context is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Healthy returns whether at least one upstream is healthy.
+func (c *Checker) Healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.healthyLocked()
+}
+
+// Status returns the health of the upstreams.
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := Status{
+		EndpointID: c.endpointID,
+		Healthy:    c.healthyLocked(),
+	}
+	for _, u := range c.upstreams {
+		upstreamStatus := UpstreamStatus{
+			Addr:    u.addr,
+			Healthy: u.healthy,
+		}
+		if u.lastErr != nil {
+			upstreamStatus.Error = u.lastErr.Error()
+		}
+		status.Upstreams = append(status.Upstreams, upstreamStatus)
+	}
+	return status
+}
+
+// check probes all upstreams concurrently and updates their health.
+func (c *Checker) check(ctx context.Context) {
+	errs := make([]error, len(c.upstreams))
+	var wg sync.WaitGroup
+	for i, u := range c.upstreams {
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			errs[i] = u.probe(probeCtx)
+		}(i, u)
+	}
+	wg.Wait()
+
+	// Don't update the health of upstreams when shutting down, as probes
+	// fail due to the cancelled context rather than the upstream.
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.update(errs)
+}
+
+func (c *Checker) update(errs []error) {
+	c.mu.Lock()
+
+	wasHealthy := c.healthyLocked()
+
+	// changed contains the indexes of upstreams whose health changed.
+	var changed []int
+	for i, u := range c.upstreams {
+		u.lastErr = errs[i]
+		if errs[i] == nil {
+			u.successes++
+			u.failures = 0
+			if !u.healthy && u.successes >= c.healthyThreshold {
+				u.healthy = true
+				changed = append(changed, i)
+				c.logger.Info(
+					"upstream healthy",
+					zap.String("addr", u.addr),
+				)
+			}
+		} else {
+			u.failures++
+			u.successes = 0
+			if u.healthy && u.failures >= c.unhealthyThreshold {
+				u.healthy = false
+				changed = append(changed, i)
+				c.logger.Warn(
+					"upstream unhealthy",
+					zap.String("addr", u.addr),
+					zap.Error(errs[i]),
+				)
+			}
+		}
+	}
+
+	healthy := c.healthyLocked()
+
+	onUpstreamChange := c.onUpstreamChange
+	onChange := c.onChange
+
+	c.mu.Unlock()
+
+	for _, idx := range changed {
+		// Upstreams are only updated by the checker goroutine so are safe
+		// to read without the lock.
+		for _, f := range onUpstreamChange {
+			f(idx, c.upstreams[idx].healthy)
+		}
+	}
+	if healthy != wasHealthy {
+		for _, f := range onChange {
+			f(healthy)
+		}
+	}
+}
+
+func (c *Checker) healthyLocked() bool {
+	for _, u := range c.upstreams {
+		if u.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// httpUpstreams returns the upstreams of a HTTP listener, which are probed
+// with a 'GET' request.
+func httpUpstreams(conf config.ListenerConfig, tlsConfig *tls.Config) []*upstream {
+	path := conf.HealthCheck.Path
+	if path == "" {
+		path = defaultPath
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// Open a new connection for each probe so the probe verifies the
+	// upstream accepts connections.
+	transport.DisableKeepAlives = true
+	client := &http.Client{
+		Transport: transport,
+		// Redirects are considered healthy so aren't followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var urls []*url.URL
+	if socketPath, ok := conf.UnixSocket(); ok {
+		transport.DialContext = func(
+			ctx context.Context, _, _ string,
+		) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		urls = []*url.URL{{Scheme: "http", Host: "localhost"}}
+	} else {
+		var ok bool
+		urls, ok = conf.URLs()
+		if !ok {
+			// We've already verified the address on boot so don't need to
+			// handle the error.
+			panic("invalid addr: " + conf.Addr)
+		}
+	}
+
+	var upstreams []*upstream
+	for _, u := range urls {
+		probeURL := *u
+		if conf.TLS.Enabled {
+			probeURL.Scheme = "https"
+		}
+		probeURL.Path = path
+
+		addr := u.Host
+		if socketPath, ok := conf.UnixSocket(); ok {
+			addr = "unix:" + socketPath
+		}
+		upstreams = append(upstreams, &upstream{
+			addr: addr,
+			probe: func(ctx context.Context) error {
+				return probeHTTP(ctx, client, probeURL.String(), conf.HostHeader)
+			},
+		})
+	}
+	return upstreams
+}
+
+// tcpUpstreams returns the upstreams of a TCP listener, which are probed by
+// opening a connection.
+func tcpUpstreams(conf config.ListenerConfig) []*upstream {
+	network := "tcp"
+	hosts, ok := conf.Hosts()
+	if path, unixSocket := conf.UnixSocket(); unixSocket {
+		network = "unix"
+		hosts = []string{path}
+	} else if !ok {
+		// We've already verified the address on boot so don't need to handle
+		// the error.
+		panic("invalid addr: " + conf.Addr)
+	}
+
+	var upstreams []*upstream
+	for _, host := range hosts {
+		addr := host
+		if network == "unix" {
+			addr = "unix:" + host
+		}
+		upstreams = append(upstreams, &upstream{
+			addr: addr,
+			probe: func(ctx context.Context) error {
+				return probeTCP(ctx, network, host)
+			},
+		})
+	}
+	return upstreams
+}
+
+func probeHTTP(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	host string,
+) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Discard a bounded amount of the body.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, network string, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,155 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestChecker(t *testing.T) {
+	t.Run("http", func(t *testing.T) {
+		var status atomic.Int64
+		status.Store(http.StatusOK)
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/health", r.URL.Path)
+				w.WriteHeader(int(status.Load()))
+			},
+		))
+		defer upstream.Close()
+
+		checker := NewChecker(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Protocol:   config.ListenerProtocolHTTP,
+			HealthCheck: config.HealthCheckConfig{
+				Enabled:            true,
+				Path:               "/health",
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 2,
+			},
+		}, nil, log.NewNopLogger())
+
+		var changes []bool
+		checker.OnChange(func(healthy bool) {
+			changes = append(changes, healthy)
+		})
+
+		checker.check(context.Background())
+		assert.True(t, checker.Healthy())
+
+		// The upstream is only unhealthy after the unhealthy threshold.
+		status.Store(http.StatusServiceUnavailable)
+		checker.check(context.Background())
+		assert.True(t, checker.Healthy())
+		checker.check(context.Background())
+		assert.False(t, checker.Healthy())
+
+		s := checker.Status()
+		assert.Equal(t, "my-endpoint", s.EndpointID)
+		assert.False(t, s.Healthy)
+		require.Len(t, s.Upstreams, 1)
+		assert.False(t, s.Upstreams[0].Healthy)
+		assert.Equal(t, "bad status: 503", s.Upstreams[0].Error)
+
+		// The upstream is only healthy after the healthy threshold.
+		status.Store(http.StatusOK)
+		checker.check(context.Background())
+		assert.False(t, checker.Healthy())
+		checker.check(context.Background())
+		assert.True(t, checker.Healthy())
+
+		assert.Equal(t, []bool{false, true}, changes)
+	})
+
+	t.Run("multiple upstreams", func(t *testing.T) {
+		healthyUpstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			},
+		))
+		defer healthyUpstream.Close()
+		unhealthyUpstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		))
+		defer unhealthyUpstream.Close()
+
+		checker := NewChecker(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       healthyUpstream.URL + "," + unhealthyUpstream.URL,
+			Protocol:   config.ListenerProtocolHTTP,
+			HealthCheck: config.HealthCheckConfig{
+				Enabled:            true,
+				UnhealthyThreshold: 1,
+			},
+		}, nil, log.NewNopLogger())
+
+		type change struct {
+			idx     int
+			healthy bool
+		}
+		var upstreamChanges []change
+		checker.OnUpstreamChange(func(idx int, healthy bool) {
+			upstreamChanges = append(upstreamChanges, change{idx, healthy})
+		})
+		var changes []bool
+		checker.OnChange(func(healthy bool) {
+			changes = append(changes, healthy)
+		})
+
+		checker.check(context.Background())
+
+		// Only the failing upstream is unhealthy so the listener is still
+		// healthy.
+		assert.Equal(t, []change{{1, false}}, upstreamChanges)
+		assert.Empty(t, changes)
+		assert.True(t, checker.Healthy())
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := ln.Addr().String()
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		checker := NewChecker(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       addr,
+			Protocol:   config.ListenerProtocolTCP,
+			HealthCheck: config.HealthCheckConfig{
+				Enabled:            true,
+				Timeout:            time.Second,
+				UnhealthyThreshold: 1,
+			},
+		}, nil, log.NewNopLogger())
+
+		checker.check(context.Background())
+		assert.True(t, checker.Healthy())
+
+		ln.Close()
+
+		checker.check(context.Background())
+		assert.False(t, checker.Healthy())
+	})
+}
@@ -0,0 +1,192 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/balancer"
+	"github.com/andydunstall/piko/agent/breaker"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	// defaultRetryBackoff is the duration to wait between retries if not
+	// configured.
+	defaultRetryBackoff = time.Millisecond * 100
+)
+
+// errCircuitOpen is returned when the circuit breaker of every upstream is
+// open, so the request isn't sent.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// balancedTransport balances requests among multiple upstream URLs.
+//
+// If dialing an upstream fails, the upstream is skipped and the request is
+// retried with the next upstream. Since the request wasn't sent, this is safe
+// for all methods.
+//
+// If retries are enabled, idempotent requests that fail to connect or whose
+// connection is reset are retried up to 'maxAttempts' times.
+//
+// If circuit breakers are enabled, upstreams whose breaker is open are
+// skipped, and if all breakers are open the request fails immediately.
+type balancedTransport struct {
+	transport http.RoundTripper
+
+	urls     []*url.URL
+	balancer *balancer.Balancer
+
+	// breakers contains the circuit breaker for each upstream, or nil if
+	// circuit breakers are disabled.
+	breakers []*breaker.Breaker
+
+	// maxAttempts is the maximum number of attempts to send idempotent
+	// requests.
+	maxAttempts int
+	backoff     time.Duration
+
+	// rewriteHost indicates whether to rewrite the 'Host' header to the
+	// selected upstream.
+	rewriteHost bool
+
+	endpointID string
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+func (t *balancedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	retry := t.maxAttempts > 1 && isRetryable(r)
+
+	// Dial errors are always retried with the next upstream, though
+	// idempotent requests may be retried up to the configured attempts.
+	attempts := t.balancer.Len()
+	if retry && t.maxAttempts > attempts {
+		attempts = t.maxAttempts
+	}
+
+	var err error
+	for i := 0; i != attempts; i++ {
+		// Only wait before retrying once every upstream has been tried.
+		if i >= t.balancer.Len() && !errors.Is(err, errCircuitOpen) {
+			if !t.wait(r.Context()) {
+				return nil, err
+			}
+		}
+
+		idx := t.balancer.Next()
+		u := t.urls[idx]
+
+		if t.breakers != nil && !t.breakers[idx].Allow() {
+			err = errCircuitOpen
+			continue
+		}
+
+		req := r.Clone(r.Context())
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
+		if t.rewriteHost {
+			req.Host = u.Host
+		}
+
+		if i > 0 {
+			t.metrics.ForwardRetriesTotal.With(prometheus.Labels{
+				"endpoint_id": t.endpointID,
+			}).Inc()
+		}
+
+		var resp *http.Response
+		resp, err = t.transport.RoundTrip(req)
+		if err == nil {
+			t.balancer.Succeeded(idx)
+			if t.breakers != nil {
+				t.breakers[idx].Succeeded()
+			}
+			return resp, nil
+		}
+
+		// If the client cancelled the request, the upstream didn't fail.
+		if errors.Is(context.Cause(r.Context()), context.Canceled) {
+			if t.breakers != nil {
+				t.breakers[idx].Released()
+			}
+			return nil, err
+		}
+		if t.breakers != nil {
+			t.breakers[idx].Failed()
+		}
+
+		switch {
+		case isDialError(err):
+			t.balancer.Failed(idx)
+			t.logger.Warn(
+				"failed to dial upstream; retrying",
+				zap.String("addr", u.Host),
+				zap.Error(err),
+			)
+		case retry && isConnReset(err):
+			t.logger.Warn(
+				"upstream connection reset; retrying",
+				zap.String("addr", u.Host),
+				zap.Error(err),
+			)
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// wait waits for the retry backoff. Returns false if the context is
+// cancelled.
+func (t *balancedTransport) wait(ctx context.Context) bool {
+	backoff := t.backoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isDialError returns whether the error is from failing to dial the upstream,
+// meaning the request was not sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isConnReset returns whether the error is from the upstream resetting the
+// connection.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// isRetryable returns whether the request is safe to retry after it may
+// have been received by the upstream.
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	// The body can't be sent again once read.
+	return r.Body == nil || r.Body == http.NoBody
+}
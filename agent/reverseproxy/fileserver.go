@@ -0,0 +1,77 @@
+package reverseproxy
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// FileServer serves static files from a local directory, rather than
+// forwarding requests to an upstream.
+//
+// Requests for a directory serve the 'index.html' file in the directory if it
+// exists, otherwise a directory listing. The content type is inferred from
+// the file extension or content.
+type FileServer struct {
+	root    http.FileSystem
+	handler http.Handler
+
+	// spaFallback indicates whether to serve the root 'index.html' when the
+	// requested file doesn't exist.
+	spaFallback bool
+}
+
+func NewFileServer(dir string, spaFallback bool) *FileServer {
+	root := http.Dir(dir)
+	return &FileServer{
+		root:        root,
+		handler:     http.FileServer(root),
+		spaFallback: spaFallback,
+	}
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// http.Dir resolves paths relative to the root so can't escape the
+	// directory, though reject traversal explicitly rather than serving a
+	// different file than requested.
+	if containsDotDot(r.URL.Path) {
+		_ = errorResponse(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	if s.spaFallback && !s.exists(r.URL.Path) {
+		r = r.Clone(r.Context())
+		// http.FileServer serves 'index.html' for the root directory.
+		r.URL.Path = "/"
+		r.URL.RawPath = ""
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+// exists returns whether the file at the given path exists.
+func (s *FileServer) exists(name string) bool {
+	f, err := s.root.Open(path.Clean("/" + name))
+	if err != nil {
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+	f.Close()
+	return true
+}
+
+// containsDotDot returns whether the path contains a '..' element.
+func containsDotDot(p string) bool {
+	if !strings.Contains(p, "..") {
+		return false
+	}
+	for _, elem := range strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/' || r == '\\'
+	}) {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package reverseproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+func TestFileServer(t *testing.T) {
+	// Create a parent directory containing a secret file outside of the
+	// served directory.
+	parent := t.TempDir()
+	require.NoError(t, os.WriteFile(
+		filepath.Join(parent, "secret.txt"), []byte("secret"), 0o600,
+	))
+
+	dir := filepath.Join(parent, "www")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "docs"), 0o700))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "index.html"), []byte("<h1>index</h1>"), 0o600,
+	))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "app.js"), []byte("console.log('foo')"), 0o600,
+	))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(dir, "docs", "index.html"), []byte("<h1>docs</h1>"), 0o600,
+	))
+
+	get := func(s *FileServer, path string) (*http.Response, string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		// Set the path directly so it isn't cleaned.
+		r.URL.Path = path
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		resp := w.Result()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("file", func(t *testing.T) {
+		s := NewFileServer(dir, false)
+
+		resp, body := get(s, "/app.js")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "console.log('foo')", body)
+		assert.Equal(t, "text/javascript; charset=utf-8", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("index", func(t *testing.T) {
+		s := NewFileServer(dir, false)
+
+		resp, body := get(s, "/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<h1>index</h1>", body)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+		resp, body = get(s, "/docs/")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<h1>docs</h1>", body)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		s := NewFileServer(dir, false)
+
+		resp, _ := get(s, "/missing.html")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("spa fallback", func(t *testing.T) {
+		s := NewFileServer(dir, true)
+
+		resp, body := get(s, "/users/123")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "<h1>index</h1>", body)
+
+		// Existing files are still served.
+		resp, body = get(s, "/app.js")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "console.log('foo')", body)
+	})
+
+	t.Run("path traversal", func(t *testing.T) {
+		for _, spaFallback := range []bool{false, true} {
+			s := NewFileServer(dir, spaFallback)
+
+			for _, path := range []string{
+				"/../secret.txt",
+				"/docs/../../secret.txt",
+				"/..\\secret.txt",
+			} {
+				resp, body := get(s, path)
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+				assert.NotContains(t, body, "secret")
+			}
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		server := NewServer(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "file:" + dir,
+		}, nil, nil, log.NewNopLogger())
+		assert.Nil(t, server.Balancer())
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			_ = server.Serve(ln)
+		}()
+		defer server.Shutdown(context.Background())
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/app.js")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "console.log('foo')", string(body))
+	})
+}
@@ -0,0 +1,112 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/requestmeta"
+)
+
+// headerVariablePattern matches references to the original client request in
+// header values, such as '{host}' or '{header.X-Real-Ip}'.
+var headerVariablePattern = regexp.MustCompile(`\{(host|client_ip|header\.[^{}]+)\}`)
+
+type headerValue struct {
+	name  string
+	value string
+	// expand indicates whether the value references the original request.
+	expand bool
+}
+
+// headerRewriter rewrites HTTP headers.
+type headerRewriter struct {
+	add    []headerValue
+	set    []headerValue
+	remove []string
+}
+
+func newHeaderRewriter(conf config.HeadersConfig) *headerRewriter {
+	return &headerRewriter{
+		add:    headerValues(conf.Add),
+		set:    headerValues(conf.Set),
+		remove: conf.Remove,
+	}
+}
+
+// RewriteRequest rewrites the headers of the request forwarded to the
+// upstream. orig is the original request from the client.
+func (r *headerRewriter) RewriteRequest(req *http.Request, orig *http.Request) {
+	for _, name := range r.remove {
+		if http.CanonicalHeaderKey(name) == "X-Forwarded-For" {
+			// A nil value stops the reverse proxy adding the header.
+			req.Header["X-Forwarded-For"] = nil
+			continue
+		}
+		req.Header.Del(name)
+	}
+	for _, h := range r.set {
+		value := h.Value(orig)
+		if h.name == "Host" {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(h.name, value)
+	}
+	for _, h := range r.add {
+		req.Header.Add(h.name, h.Value(orig))
+	}
+}
+
+// RewriteResponse rewrites the headers of the response returned to the
+// client. orig is the original request from the client.
+func (r *headerRewriter) RewriteResponse(header http.Header, orig *http.Request) {
+	for _, name := range r.remove {
+		header.Del(name)
+	}
+	for _, h := range r.set {
+		header.Set(h.name, h.Value(orig))
+	}
+	for _, h := range r.add {
+		header.Add(h.name, h.Value(orig))
+	}
+}
+
+// Value returns the header value, replacing any references to the original
+// request.
+func (h *headerValue) Value(orig *http.Request) string {
+	if !h.expand || orig == nil {
+		return h.value
+	}
+	return headerVariablePattern.ReplaceAllStringFunc(h.value, func(s string) string {
+		variable := s[1 : len(s)-1]
+		switch variable {
+		case "host":
+			return orig.Host
+		case "client_ip":
+			meta, _ := requestmeta.FromContext(orig.Context())
+			return meta.ClientIP
+		}
+		name := strings.TrimPrefix(variable, "header.")
+		return strings.Join(orig.Header.Values(name), ", ")
+	})
+}
+
+// headerValues returns the given headers sorted by name, so headers are
+// rewritten in a consistent order.
+func headerValues(m map[string]string) []headerValue {
+	values := make([]headerValue, 0, len(m))
+	for name, value := range m {
+		values = append(values, headerValue{
+			name:   http.CanonicalHeaderKey(name),
+			value:  value,
+			expand: headerVariablePattern.MatchString(value),
+		})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].name < values[j].name
+	})
+	return values
+}
@@ -0,0 +1,108 @@
+package reverseproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andydunstall/piko/pkg/middleware"
+)
+
+const (
+	// outcomeSuccess means the upstream responded with a non-5xx status.
+	outcomeSuccess = "success"
+	// outcomeError means the upstream responded with a 5xx status.
+	outcomeError = "error"
+	// outcomeTimeout means the upstream didn't respond within the timeout.
+	outcomeTimeout = "timeout"
+	// outcomeUnreachable means the request couldn't be sent to the upstream.
+	outcomeUnreachable = "unreachable"
+)
+
+// Metrics contains the metrics for all HTTP listeners.
+type Metrics struct {
+	// ForwardRequestsTotal is the number of requests forwarded to the
+	// upstream. Labelled by endpoint ID and outcome.
+	ForwardRequestsTotal *prometheus.CounterVec
+
+	// ForwardRequestLatency is the latency of requests forwarded to the
+	// upstream. Labelled by endpoint ID and outcome.
+	ForwardRequestLatency *prometheus.HistogramVec
+
+	// UpstreamDialErrorsTotal is the number of failed attempts to dial the
+	// upstream. Labelled by endpoint ID.
+	UpstreamDialErrorsTotal *prometheus.CounterVec
+
+	// ForwardRetriesTotal is the number of times a request was retried,
+	// including with a different upstream. Labelled by endpoint ID.
+	ForwardRetriesTotal *prometheus.CounterVec
+
+	// UpstreamCircuitBreakerState is the state of each upstreams circuit
+	// breaker, where 0 is closed, 1 is half-open and 2 is open. Labelled by
+	// endpoint ID and upstream address.
+	UpstreamCircuitBreakerState *prometheus.GaugeVec
+
+	// HTTP contains metrics for the requests received by the listeners.
+	HTTP *middleware.Metrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ForwardRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent_http",
+				Name:      "forward_requests_total",
+				Help:      "Number of requests forwarded to the upstream",
+			},
+			[]string{"endpoint_id", "outcome"},
+		),
+		ForwardRequestLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "agent_http",
+				Name:      "forward_request_latency_seconds",
+				Help:      "Latency of requests forwarded to the upstream",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"endpoint_id", "outcome"},
+		),
+		UpstreamDialErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent_http",
+				Name:      "upstream_dial_errors_total",
+				Help:      "Number of failed attempts to dial the upstream",
+			},
+			[]string{"endpoint_id"},
+		),
+		ForwardRetriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent_http",
+				Name:      "forward_retries_total",
+				Help:      "Number of retried requests to the upstream",
+			},
+			[]string{"endpoint_id"},
+		),
+		UpstreamCircuitBreakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent_http",
+				Name:      "upstream_circuit_breaker_state",
+				Help:      "State of the upstream circuit breaker (0 closed, 1 half-open, 2 open)",
+			},
+			[]string{"endpoint_id", "upstream"},
+		),
+		HTTP: middleware.NewMetrics("agent"),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ForwardRequestsTotal,
+		m.ForwardRequestLatency,
+		m.UpstreamDialErrorsTotal,
+		m.ForwardRetriesTotal,
+		m.UpstreamCircuitBreakerState,
+	)
+	m.HTTP.Register(registry)
+}
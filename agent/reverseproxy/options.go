@@ -0,0 +1,49 @@
+package reverseproxy
+
+import (
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/andydunstall/piko/pkg/middleware"
+)
+
+type options struct {
+	tracerProvider trace.TracerProvider
+	panicHook      middleware.PanicHook
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type tracerProviderOption struct {
+	provider trace.TracerProvider
+}
+
+func (o tracerProviderOption) apply(opts *options) {
+	opts.tracerProvider = o.provider
+}
+
+// WithTracerProvider configures the OpenTelemetry tracer provider used to
+// trace forwarded requests.
+//
+// If not set (the default) requests are not traced.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return tracerProviderOption{provider: provider}
+}
+
+type panicHookOption struct {
+	hook middleware.PanicHook
+}
+
+func (o panicHookOption) apply(opts *options) {
+	opts.panicHook = o.hook
+}
+
+// WithPanicHook configures a hook called when a listener handler panics, such
+// as to report the panic to an error tracking service. The hook is called
+// with the recovered value and stack trace before the request is aborted.
+//
+// If not set (the default) panics are only logged.
+func WithPanicHook(hook middleware.PanicHook) Option {
+	return panicHookOption{hook: hook}
+}
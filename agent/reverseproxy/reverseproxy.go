@@ -2,78 +2,455 @@ package reverseproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
 
+	"github.com/andydunstall/piko/agent/balancer"
+	"github.com/andydunstall/piko/agent/breaker"
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/requestmeta"
+	"github.com/andydunstall/piko/pkg/stream"
+	"github.com/andydunstall/piko/pkg/tracing"
+)
+
+const (
+	// defaultDialTimeout and defaultKeepAlive match http.DefaultTransport.
+	defaultDialTimeout = time.Second * 30
+	defaultKeepAlive   = time.Second * 30
+)
+
+type contextKey int
+
+const (
+	timeoutTimerContextKey contextKey = iota
+	startTimeContextKey
+	// requestContextKey contains the original request from the client.
+	requestContextKey
 )
 
 type ReverseProxy struct {
 	proxy *httputil.ReverseProxy
 
+	endpointID string
+
+	// balancer balances requests among the upstreams.
+	balancer *balancer.Balancer
+
 	timeout time.Duration
 
+	// responseHeaders rewrites the response headers. If nil headers aren't
+	// rewritten.
+	responseHeaders *headerRewriter
+
+	metrics *Metrics
+
+	tracer trace.Tracer
+
 	logger log.Logger
 }
 
-func NewReverseProxy(conf config.ListenerConfig, logger log.Logger) *ReverseProxy {
-	u, ok := conf.URL()
-	if !ok {
-		// We've already verified the address on boot so don't need to handle
-		// the error.
-		panic("invalid addr: " + conf.Addr)
+// NewReverseProxy returns a reverse proxy forwarding to the configured
+// upstreams.
+//
+// tlsConfig configures TLS connections to the upstreams. If nil the default
+// TLS configuration is used for 'https' upstreams.
+//
+// metrics may be shared by multiple reverse proxies. If nil the metrics
+// aren't exported.
+func NewReverseProxy(
+	conf config.ListenerConfig,
+	tlsConfig *tls.Config,
+	metrics *Metrics,
+	logger log.Logger,
+	opts ...Option,
+) *ReverseProxy {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
 	}
 
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+	tracer := tracing.Tracer(options.tracerProvider)
+
+	socketPath, unixSocket := conf.UnixSocket()
+
+	var urls []*url.URL
+	if unixSocket {
+		// Requests are sent over the Unix socket so the host is only used
+		// for the 'Host' header.
+		urls = []*url.URL{{Scheme: "http", Host: "localhost"}}
+	} else {
+		var ok bool
+		urls, ok = conf.URLs()
+		if !ok {
+			// We've already verified the address on boot so don't need to
+			// handle the error.
+			panic("invalid addr: " + conf.Addr)
+		}
+	}
+	if conf.TLS.Enabled {
+		for _, u := range urls {
+			u.Scheme = "https"
+		}
+	}
+
+	var requestHeaders *headerRewriter
+	if conf.RequestHeaders.Enabled() {
+		requestHeaders = newHeaderRewriter(conf.RequestHeaders)
+	}
+	var responseHeaders *headerRewriter
+	if conf.ResponseHeaders.Enabled() {
+		responseHeaders = newHeaderRewriter(conf.ResponseHeaders)
+	}
+
+	// The path of the first URL is used for all upstreams.
+	u := urls[0]
 	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+
+		switch {
+		case conf.HostHeader != "":
+			req.Host = conf.HostHeader
+		case conf.RewriteHost:
+			req.Host = u.Host
+		}
+
+		if requestHeaders != nil {
+			requestHeaders.RewriteRequest(req, originalRequest(req))
+		}
+	}
+
+	// Use a transport per listener so connections to the upstream are reused
+	// with the listeners TLS configuration.
+	transport := newTransport(conf.Transport, tlsConfig)
+	dial := transport.DialContext
+	transport.DialContext = func(
+		ctx context.Context, network, addr string,
+	) (net.Conn, error) {
+		if unixSocket {
+			network = "unix"
+			addr = socketPath
+		}
+
+		ctx, span := tracer.Start(
+			ctx,
+			"agent.dial",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				tracing.AttributeEndpointID.String(conf.EndpointID),
+			),
+		)
+		defer span.End()
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			metrics.UpstreamDialErrorsTotal.With(prometheus.Labels{
+				"endpoint_id": conf.EndpointID,
+			}).Inc()
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "dial upstream")
+		}
+		return conn, err
+	}
+	var roundTripper http.RoundTripper = transport
+	if conf.HTTP2 && !conf.TLS.Enabled {
+		// Cleartext upstreams use HTTP/2 with prior knowledge (h2c). TLS
+		// upstreams negotiate HTTP/2 with ALPN using the HTTP/1.1 transport.
+		roundTripper = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(
+				ctx context.Context, network, addr string, _ *tls.Config,
+			) (net.Conn, error) {
+				return transport.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	proxy.Transport = roundTripper
+	lb := balancer.New(len(urls))
+	breakers := newBreakers(conf, urls, lb, metrics)
+	if len(urls) > 1 || breakers != nil || conf.Retry.MaxAttempts > 1 {
+		rewriteHost := conf.HostHeader == "" && conf.RewriteHost &&
+			!conf.RequestHeaders.SetsHost()
+		proxy.Transport = &balancedTransport{
+			transport:   roundTripper,
+			urls:        urls,
+			balancer:    lb,
+			breakers:    breakers,
+			maxAttempts: conf.Retry.MaxAttempts,
+			backoff:     conf.Retry.Backoff,
+			rewriteHost: rewriteHost,
+			endpointID:  conf.EndpointID,
+			metrics:     metrics,
+			logger:      logger,
+		}
+	}
 	proxy.ErrorLog = logger.StdLogger(zapcore.WarnLevel)
 	rp := &ReverseProxy{
-		proxy:   proxy,
-		timeout: conf.Timeout,
-		logger:  logger,
+		proxy:           proxy,
+		endpointID:      conf.EndpointID,
+		balancer:        lb,
+		timeout:         conf.Timeout,
+		responseHeaders: responseHeaders,
+		metrics:         metrics,
+		tracer:          tracer,
+		logger:          logger,
 	}
 	proxy.ErrorHandler = rp.errorHandler
+	proxy.ModifyResponse = rp.modifyResponse
 	return rp
 }
 
+// newTransport returns the transport used to connect to the upstreams,
+// using the defaults of http.DefaultTransport for any options that aren't
+// configured.
+func newTransport(
+	conf config.TransportConfig,
+	tlsConfig *tls.Config,
+) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = newDialer(conf).DialContext
+	if conf.MaxIdleConns != 0 {
+		transport.MaxIdleConns = conf.MaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	if conf.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = conf.IdleConnTimeout
+	}
+	if conf.TLSHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = conf.TLSHandshakeTimeout
+	}
+	return transport
+}
+
+// newDialer returns the dialer used to connect to the upstreams, matching
+// the dialer of http.DefaultTransport unless configured.
+func newDialer(conf config.TransportConfig) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultKeepAlive,
+	}
+	if conf.DialTimeout != 0 {
+		dialer.Timeout = conf.DialTimeout
+	}
+	if conf.KeepAlive != 0 {
+		dialer.KeepAlive = conf.KeepAlive
+	}
+	return dialer
+}
+
+// newBreakers returns a circuit breaker for each upstream, or nil if circuit
+// breakers are disabled. Upstreams whose breaker is open are skipped by the
+// balancer.
+func newBreakers(
+	conf config.ListenerConfig,
+	urls []*url.URL,
+	lb *balancer.Balancer,
+	metrics *Metrics,
+) []*breaker.Breaker {
+	if !conf.CircuitBreaker.Enabled {
+		return nil
+	}
+
+	breakers := make([]*breaker.Breaker, 0, len(urls))
+	for _, u := range urls {
+		b := breaker.New(
+			conf.CircuitBreaker.FailureThreshold,
+			conf.CircuitBreaker.OpenTimeout,
+		)
+
+		gauge := metrics.UpstreamCircuitBreakerState.With(prometheus.Labels{
+			"endpoint_id": conf.EndpointID,
+			"upstream":    u.Host,
+		})
+		gauge.Set(float64(breaker.StateClosed))
+		b.OnChange(func(state breaker.State) {
+			gauge.Set(float64(state))
+		})
+
+		breakers = append(breakers, b)
+	}
+	lb.SetAvailable(func(idx int) bool {
+		return breakers[idx].Available()
+	})
+	return breakers
+}
+
+// Balancer returns the balancer used to select upstreams.
+func (p *ReverseProxy) Balancer() *balancer.Balancer {
+	return p.balancer
+}
+
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), startTimeContextKey, time.Now())
+	// The Piko server adds the request metadata to the request headers,
+	// which are stripped so they aren't forwarded to the upstream.
+	if meta, ok := requestmeta.Extract(r.Header); ok {
+		ctx = requestmeta.NewContext(ctx, meta)
+	}
+	requestmeta.Strip(r.Header)
+	r = r.WithContext(ctx)
+	// The request forwarded to the upstream is a copy, so keep the original
+	// request for rewriting headers.
+	ctx = context.WithValue(ctx, requestContextKey, r)
+	r = r.WithContext(ctx)
+
+	// Add the span as a child of the Piko server span, then propagate the
+	// trace context to the upstream.
+	ctx, span := p.tracer.Start(
+		tracing.Extract(ctx, r.Header),
+		"agent.forward",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.AttributeEndpointID.String(p.endpointID)),
+	)
+	defer span.End()
+	r = r.WithContext(ctx)
+	tracing.Inject(ctx, r.Header)
+
 	if p.timeout != 0 {
-		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
-		defer cancel()
+		// Apply the timeout using a timer rather than a context deadline, so
+		// the timer can be stopped when the upstream responds for upgrades
+		// and streaming responses, which may be long lived.
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+
+		timer := time.AfterFunc(p.timeout, func() {
+			cancel(context.DeadlineExceeded)
+		})
+		defer timer.Stop()
 
+		ctx = context.WithValue(ctx, timeoutTimerContextKey, timer)
 		r = r.WithContext(ctx)
 	}
 
 	p.proxy.ServeHTTP(w, r)
 }
 
-func (p *ReverseProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
-	p.logger.Warn("proxy request", zap.Error(err))
+// modifyResponse records the request outcome and stops the timeout for
+// upgrades, streaming responses and responses of unknown length.
+func (p *ReverseProxy) modifyResponse(resp *http.Response) error {
+	if p.responseHeaders != nil {
+		p.responseHeaders.RewriteResponse(
+			resp.Header, originalRequest(resp.Request),
+		)
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		p.observe(resp.Request, outcomeError)
+	} else {
+		p.observe(resp.Request, outcomeSuccess)
+	}
+
+	// Responses of unknown length, such as chunked responses, may be long
+	// lived so are also excluded from the timeout.
+	if resp.StatusCode != http.StatusSwitchingProtocols && !stream.IsUnbounded(resp) {
+		return nil
+	}
+	if timer, ok := resp.Request.Context().Value(timeoutTimerContextKey).(*time.Timer); ok {
+		timer.Stop()
+	}
+	return nil
+}
+
+func (p *ReverseProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	fields := []zap.Field{zap.Error(err)}
+	// Include the request ID set by the Piko server to correlate logs.
+	if meta, ok := requestmeta.FromContext(r.Context()); ok {
+		fields = append(
+			fields,
+			zap.String("request-id", meta.RequestID),
+			zap.String("client-ip", meta.ClientIP),
+		)
+	} else if requestID := r.Header.Get("X-Request-Id"); requestID != "" {
+		fields = append(fields, zap.String("request-id", requestID))
+	}
+	p.logger.Warn("proxy request", fields...)
+
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "proxy request")
 
-	if errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(context.Cause(r.Context()), context.DeadlineExceeded) {
+		p.observe(r, outcomeTimeout)
 		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
 		return
 	}
+	if errors.Is(err, errCircuitOpen) {
+		p.observe(r, outcomeUnreachable)
+		_ = errorResponse(w, http.StatusServiceUnavailable, "upstream unavailable")
+		return
+	}
+	if isDialError(err) {
+		p.observe(r, outcomeUnreachable)
+	} else {
+		p.observe(r, outcomeError)
+	}
 	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
 }
 
+// observe records the outcome and latency of the forwarded request.
+func (p *ReverseProxy) observe(r *http.Request, outcome string) {
+	labels := prometheus.Labels{
+		"endpoint_id": p.endpointID,
+		"outcome":     outcome,
+	}
+	p.metrics.ForwardRequestsTotal.With(labels).Inc()
+	if start, ok := r.Context().Value(startTimeContextKey).(time.Time); ok {
+		p.metrics.ForwardRequestLatency.With(labels).Observe(
+			time.Since(start).Seconds(),
+		)
+	}
+}
+
+// originalRequest returns the original request from the client, or nil if
+// not found.
+func originalRequest(r *http.Request) *http.Request {
+	orig, _ := r.Context().Value(requestContextKey).(*http.Request)
+	return orig
+}
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
 
 func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
+	m := &errorMessage{
+		Error: message,
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode error message: %w", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(statusCode)
 
-	m := &errorMessage{
-		Error: message,
-	}
-	return json.NewEncoder(w).Encode(m)
+	_, err = w.Write(b)
+	return err
 }
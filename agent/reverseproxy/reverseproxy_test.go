@@ -2,18 +2,30 @@ package reverseproxy
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/requestmeta"
+	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/pkg/tracing"
 )
 
 func TestReverseProxy_Forward(t *testing.T) {
@@ -37,7 +49,7 @@ func TestReverseProxy_Forward(t *testing.T) {
 		proxy := NewReverseProxy(config.ListenerConfig{
 			EndpointID: "my-endpoint",
 			Addr:       upstream.URL,
-		}, log.NewNopLogger())
+		}, nil, nil, log.NewNopLogger())
 
 		b := bytes.NewReader([]byte("foo"))
 		r := httptest.NewRequest(http.MethodGet, "/foo/bar?a=b", b)
@@ -70,7 +82,7 @@ func TestReverseProxy_Forward(t *testing.T) {
 			EndpointID: "my-endpoint",
 			Addr:       upstream.URL,
 			Timeout:    time.Millisecond * 1,
-		}, log.NewNopLogger())
+		}, nil, nil, log.NewNopLogger())
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 
@@ -87,11 +99,48 @@ func TestReverseProxy_Forward(t *testing.T) {
 		assert.Equal(t, "upstream timeout", m.Error)
 	})
 
+	// Tests the timeout only applies until the upstream responds for
+	// responses of unknown length.
+	t.Run("chunked response", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				for i := 0; i != 3; i++ {
+					<-time.After(time.Millisecond * 20)
+					// nolint
+					w.Write([]byte("foo"))
+					w.(http.Flusher).Flush()
+				}
+			},
+		))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Millisecond * 20,
+		}, nil, nil, log.NewNopLogger())
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		resp, err := http.Get(proxyServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("foo", 3), string(b))
+	})
+
 	t.Run("upstream unreachable", func(t *testing.T) {
 		proxy := NewReverseProxy(config.ListenerConfig{
 			EndpointID: "my-endpoint",
 			Addr:       "localhost:55555",
-		}, log.NewNopLogger())
+		}, nil, nil, log.NewNopLogger())
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 
@@ -108,3 +157,863 @@ func TestReverseProxy_Forward(t *testing.T) {
 		assert.Equal(t, "upstream unreachable", m.Error)
 	})
 }
+
+func TestReverseProxy_Host(t *testing.T) {
+	tests := []struct {
+		name         string
+		conf         config.ListenerConfig
+		expectedHost func(upstreamHost string) string
+	}{
+		{
+			name: "preserve",
+			conf: config.ListenerConfig{},
+			expectedHost: func(_ string) string {
+				return "my-endpoint.piko.example.com"
+			},
+		},
+		{
+			name: "rewrite to upstream",
+			conf: config.ListenerConfig{RewriteHost: true},
+			expectedHost: func(upstreamHost string) string {
+				return upstreamHost
+			},
+		},
+		{
+			name: "host header",
+			conf: config.ListenerConfig{
+				HostHeader:  "internal.example.com",
+				RewriteHost: true,
+			},
+			expectedHost: func(_ string) string {
+				return "internal.example.com"
+			},
+		},
+		{
+			name: "set host header",
+			conf: config.ListenerConfig{
+				RewriteHost: true,
+				RequestHeaders: config.HeadersConfig{
+					Set: map[string]string{
+						"host": "internal.example.com",
+					},
+				},
+			},
+			expectedHost: func(_ string) string {
+				return "internal.example.com"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostCh := make(chan string, 1)
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(_ http.ResponseWriter, r *http.Request) {
+					hostCh <- r.Host
+				},
+			))
+			defer upstream.Close()
+
+			conf := tt.conf
+			conf.EndpointID = "my-endpoint"
+			conf.Addr = upstream.URL
+			proxy := NewReverseProxy(conf, nil, nil, log.NewNopLogger())
+
+			r := httptest.NewRequest(
+				http.MethodGet, "http://my-endpoint.piko.example.com/", nil,
+			)
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			assert.Equal(
+				t,
+				tt.expectedHost(upstream.Listener.Addr().String()),
+				<-hostCh,
+			)
+		})
+	}
+}
+
+func TestReverseProxy_Headers(t *testing.T) {
+	t.Run("request", func(t *testing.T) {
+		headerCh := make(chan http.Header, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			RequestHeaders: config.HeadersConfig{
+				Add: map[string]string{
+					"X-Add": "added",
+				},
+				Set: map[string]string{
+					"authorization": "Bearer my-token",
+					"X-Set":         "set",
+				},
+				Remove: []string{"x-remove", "X-Forwarded-For"},
+			},
+		}, nil, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("X-Add", "original")
+		r.Header.Set("X-Set", "original")
+		r.Header.Set("X-Remove", "original")
+		r.Header.Set("X-Forwarded-For", "10.26.104.56")
+		r.Header.Set("Authorization", "Bearer client-token")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		header := <-headerCh
+		assert.Equal(t, []string{"original", "added"}, header.Values("X-Add"))
+		assert.Equal(t, []string{"set"}, header.Values("X-Set"))
+		assert.Equal(t, "Bearer my-token", header.Get("Authorization"))
+		// Verify removed headers don't reach the upstream.
+		assert.NotContains(t, header, "X-Remove")
+		assert.NotContains(t, header, "X-Forwarded-For")
+
+		// Verify the client request isn't modified.
+		assert.Equal(t, "Bearer client-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "original", r.Header.Get("X-Remove"))
+	})
+
+	t.Run("response", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("X-Add", "original")
+				w.Header().Set("X-Set", "original")
+				w.Header().Set("X-Remove", "original")
+				w.Header().Set("Server", "internal")
+			},
+		))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			ResponseHeaders: config.HeadersConfig{
+				Add: map[string]string{
+					"X-Add": "added",
+				},
+				Set: map[string]string{
+					"X-Set": "set",
+				},
+				Remove: []string{"x-remove", "Server"},
+			},
+		}, nil, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"original", "added"}, resp.Header.Values("X-Add"))
+		assert.Equal(t, []string{"set"}, resp.Header.Values("X-Set"))
+		assert.NotContains(t, resp.Header, "X-Remove")
+		assert.NotContains(t, resp.Header, "Server")
+	})
+
+	t.Run("original values", func(t *testing.T) {
+		headerCh := make(chan http.Header, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			RequestHeaders: config.HeadersConfig{
+				Set: map[string]string{
+					"X-Original-Host": "{host}",
+					"X-User":          "user={header.X-User-Id}",
+					// Reference the value before it is removed.
+					"X-Client-Auth": "{header.Authorization}",
+					"X-Missing":     "{header.X-Missing}",
+				},
+				Remove: []string{"Authorization"},
+			},
+			ResponseHeaders: config.HeadersConfig{
+				Set: map[string]string{
+					"X-Request-User": "{header.X-User-Id}",
+				},
+			},
+		}, nil, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(
+			http.MethodGet, "http://my-endpoint.piko.example.com/", nil,
+		)
+		r.Header.Set("X-User-Id", "123")
+		r.Header.Set("Authorization", "Bearer client-token")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "123", resp.Header.Get("X-Request-User"))
+
+		header := <-headerCh
+		assert.Equal(t, "my-endpoint.piko.example.com", header.Get("X-Original-Host"))
+		assert.Equal(t, "user=123", header.Get("X-User"))
+		assert.Equal(t, "Bearer client-token", header.Get("X-Client-Auth"))
+		assert.Equal(t, "", header.Get("X-Missing"))
+		assert.NotContains(t, header, "Authorization")
+	})
+}
+
+func TestReverseProxy_RequestMetadata(t *testing.T) {
+	headerCh := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, r *http.Request) {
+			headerCh <- r.Header
+		},
+	))
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		RequestHeaders: config.HeadersConfig{
+			Set: map[string]string{
+				"X-Real-Ip": "{client_ip}",
+			},
+		},
+	}, nil, nil, log.NewNopLogger())
+
+	// Request as sent by the Piko server.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	requestmeta.Inject(requestmeta.Metadata{
+		ClientIP:   "10.0.0.1",
+		EndpointID: "my-endpoint",
+		RequestID:  "my-request",
+	}, r.Header)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	header := <-headerCh
+	assert.Equal(t, "10.0.0.1", header.Get("X-Real-Ip"))
+	// Verify the metadata headers aren't forwarded to the upstream.
+	_, ok := requestmeta.Extract(header)
+	assert.False(t, ok)
+	for name := range header {
+		assert.False(t, strings.HasPrefix(strings.ToLower(name), "x-piko-"), name)
+	}
+}
+
+func TestReverseProxy_MultipleUpstreams(t *testing.T) {
+	t.Run("balance", func(t *testing.T) {
+		var upstreamURLs []string
+		for i := 0; i != 2; i++ {
+			i := i
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					// nolint
+					w.Write([]byte(strconv.Itoa(i)))
+				},
+			))
+			defer upstream.Close()
+			upstreamURLs = append(upstreamURLs, upstream.URL)
+		}
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       strings.Join(upstreamURLs, ","),
+			Timeout:    time.Second,
+		}, nil, nil, log.NewNopLogger())
+
+		for i := 0; i != 4; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			buf := new(strings.Builder)
+			// nolint
+			io.Copy(buf, resp.Body)
+			assert.Equal(t, strconv.Itoa(i%2), buf.String())
+		}
+	})
+
+	t.Run("upstream down", func(t *testing.T) {
+		healthy := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("healthy"))
+			},
+		))
+		defer healthy.Close()
+
+		// Close the upstream so dialing fails.
+		down := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		down.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       down.URL + "," + healthy.URL,
+			Timeout:    time.Second,
+		}, nil, nil, log.NewNopLogger())
+
+		for i := 0; i != 4; i++ {
+			b := bytes.NewReader([]byte("foo"))
+			r := httptest.NewRequest(http.MethodPost, "/", b)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			resp := w.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			buf := new(strings.Builder)
+			// nolint
+			io.Copy(buf, resp.Body)
+			assert.Equal(t, "healthy", buf.String())
+		}
+	})
+
+	t.Run("all upstreams down", func(t *testing.T) {
+		var upstreamURLs []string
+		for i := 0; i != 2; i++ {
+			upstream := httptest.NewServer(http.HandlerFunc(
+				func(_ http.ResponseWriter, _ *http.Request) {},
+			))
+			upstream.Close()
+			upstreamURLs = append(upstreamURLs, upstream.URL)
+		}
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       strings.Join(upstreamURLs, ","),
+			Timeout:    time.Second,
+		}, nil, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	})
+}
+
+func TestReverseProxy_CircuitBreaker(t *testing.T) {
+	t.Run("open on dial failures", func(t *testing.T) {
+		// Close the upstream so dialing fails.
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		upstream.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Enabled:          true,
+				FailureThreshold: 3,
+				OpenTimeout:      time.Minute,
+			},
+		}, nil, metrics, log.NewNopLogger())
+
+		for i := 0; i != 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+		}
+
+		upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+		assert.Equal(t, 2.0, promtestutil.ToFloat64(
+			metrics.UpstreamCircuitBreakerState.WithLabelValues(
+				"my-endpoint", upstreamAddr,
+			),
+		))
+
+		// While the breaker is open, requests fail without dialing the
+		// upstream.
+		for i := 0; i != 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+		}
+		assert.Equal(t, 3.0, promtestutil.ToFloat64(
+			metrics.UpstreamDialErrorsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("skip open upstream", func(t *testing.T) {
+		healthy := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("healthy"))
+			},
+		))
+		defer healthy.Close()
+
+		down := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		down.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       down.URL + "," + healthy.URL,
+			Timeout:    time.Second,
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Enabled:          true,
+				FailureThreshold: 1,
+				OpenTimeout:      time.Minute,
+			},
+		}, nil, metrics, log.NewNopLogger())
+
+		for i := 0; i != 4; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		}
+
+		// The down upstream is only dialed once before its breaker opens.
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.UpstreamDialErrorsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+}
+
+func TestReverseProxy_Retry(t *testing.T) {
+	// newResetUpstream returns an upstream that resets the connection of the
+	// first request.
+	newResetUpstream := func(t *testing.T, requests *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				if requests.Add(1) > 1 {
+					// nolint
+					w.Write([]byte("ok"))
+					return
+				}
+
+				conn, _, err := http.NewResponseController(w).Hijack()
+				require.NoError(t, err)
+				// Discard unsent data on close so the connection is reset.
+				require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+				conn.Close()
+			},
+		))
+	}
+
+	t.Run("connection reset", func(t *testing.T) {
+		var requests atomic.Int64
+		upstream := newResetUpstream(t, &requests)
+		defer upstream.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+			Retry: config.RetryConfig{
+				MaxAttempts: 3,
+				Backoff:     time.Millisecond,
+			},
+		}, nil, metrics, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		assert.Equal(t, int64(2), requests.Load())
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.ForwardRetriesTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("non-idempotent", func(t *testing.T) {
+		var requests atomic.Int64
+		upstream := newResetUpstream(t, &requests)
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+			Retry: config.RetryConfig{
+				MaxAttempts: 3,
+				Backoff:     time.Millisecond,
+			},
+		}, nil, nil, log.NewNopLogger())
+
+		b := bytes.NewReader([]byte("foo"))
+		r := httptest.NewRequest(http.MethodPost, "/", b)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		assert.Equal(t, int64(1), requests.Load())
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		upstream.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+			Retry: config.RetryConfig{
+				MaxAttempts: 3,
+				Backoff:     time.Millisecond,
+			},
+		}, nil, metrics, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		assert.Equal(t, 3.0, promtestutil.ToFloat64(
+			metrics.UpstreamDialErrorsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+}
+
+func TestReverseProxy_TLS(t *testing.T) {
+	rootCAPool, serverCert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	t.Run("custom ca", func(t *testing.T) {
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		upstream.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+		}
+		upstream.StartTLS()
+		defer upstream.Close()
+
+		// Configure the upstream as a host and port, and enable TLS.
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.Listener.Addr().String(),
+			Timeout:    time.Second,
+			TLS: config.UpstreamTLSConfig{
+				Enabled: true,
+			},
+		}, &tls.Config{
+			RootCAs: rootCAPool,
+		}, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "bar", buf.String())
+	})
+
+	t.Run("unknown ca", func(t *testing.T) {
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		upstream.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+		}
+		upstream.StartTLS()
+		defer upstream.Close()
+
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+		}, nil, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	})
+
+	t.Run("client cert", func(t *testing.T) {
+		clientCAPool, clientCert, err := testutil.LocalTLSClientCert("my-agent")
+		require.NoError(t, err)
+
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(
+					t, "my-agent", r.TLS.PeerCertificates[0].Subject.CommonName,
+				)
+			},
+		))
+		upstream.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		upstream.StartTLS()
+		defer upstream.Close()
+
+		conf := config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+			Timeout:    time.Second,
+		}
+
+		// Without a client certificate the request fails.
+		proxy := NewReverseProxy(conf, &tls.Config{
+			RootCAs: rootCAPool,
+		}, nil, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		// With a client certificate the request succeeds.
+		proxy = NewReverseProxy(conf, &tls.Config{
+			RootCAs:      rootCAPool,
+			Certificates: []tls.Certificate{clientCert},
+		}, nil, log.NewNopLogger())
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
+func TestReverseProxy_Metrics(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer upstream.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+		}, nil, metrics, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.ForwardRequestsTotal.WithLabelValues("my-endpoint", "success"),
+		))
+		assert.Equal(t, 1, promtestutil.CollectAndCount(
+			metrics.ForwardRequestLatency,
+		))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer upstream.Close()
+
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+		}, nil, metrics, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.ForwardRequestsTotal.WithLabelValues("my-endpoint", "error"),
+		))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		metrics := NewMetrics()
+		proxy := NewReverseProxy(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:55555",
+		}, nil, metrics, log.NewNopLogger())
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.ForwardRequestsTotal.WithLabelValues("my-endpoint", "unreachable"),
+		))
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(
+			metrics.UpstreamDialErrorsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+}
+
+func TestReverseProxy_UnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/foo/bar", r.URL.Path)
+			// nolint
+			w.Write([]byte("bar"))
+		},
+	))
+	var newConns atomic.Int64
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	upstream.Listener = ln
+	upstream.Start()
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       "unix:" + socketPath,
+		Timeout:    time.Second,
+	}, nil, nil, log.NewNopLogger())
+
+	// Send multiple requests to verify connections are reused.
+	for i := 0; i != 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "bar", buf.String())
+	}
+	assert.Equal(t, int64(1), newConns.Load())
+}
+
+func TestReverseProxy_Transport(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		transport := newTransport(config.TransportConfig{}, nil)
+
+		defaultTransport := http.DefaultTransport.(*http.Transport)
+		assert.Equal(t, defaultTransport.MaxIdleConns, transport.MaxIdleConns)
+		assert.Equal(t, defaultTransport.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, defaultTransport.IdleConnTimeout, transport.IdleConnTimeout)
+		assert.Equal(t, defaultTransport.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+
+		dialer := newDialer(config.TransportConfig{})
+		assert.Equal(t, time.Second*30, dialer.Timeout)
+		assert.Equal(t, time.Second*30, dialer.KeepAlive)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		conf := config.TransportConfig{
+			DialTimeout:         time.Second,
+			KeepAlive:           time.Second * 2,
+			MaxIdleConns:        10,
+			MaxIdleConnsPerHost: 5,
+			IdleConnTimeout:     time.Second * 3,
+			TLSHandshakeTimeout: time.Second * 4,
+		}
+
+		transport := newTransport(conf, nil)
+		assert.Equal(t, 10, transport.MaxIdleConns)
+		assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Second*3, transport.IdleConnTimeout)
+		assert.Equal(t, time.Second*4, transport.TLSHandshakeTimeout)
+
+		dialer := newDialer(conf)
+		assert.Equal(t, time.Second, dialer.Timeout)
+		assert.Equal(t, time.Second*2, dialer.KeepAlive)
+	})
+}
+
+func TestReverseProxy_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	traceparentCh := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, r *http.Request) {
+			traceparentCh <- r.Header.Get("traceparent")
+		},
+	))
+	defer upstream.Close()
+
+	proxy := NewReverseProxy(config.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, nil, nil, log.NewNopLogger(), WithTracerProvider(provider))
+
+	// Add a trace context from the Piko server span.
+	parentTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID := "00f067aa0ba902b7"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-"+parentTraceID+"-"+parentSpanID+"-01")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	var forwardSpan, dialSpan tracetest.SpanStub
+	for _, span := range spans {
+		switch span.Name {
+		case "agent.forward":
+			forwardSpan = span
+		case "agent.dial":
+			dialSpan = span
+		}
+	}
+
+	// The forward span is a child of the server span.
+	assert.Equal(t, parentTraceID, forwardSpan.SpanContext.TraceID().String())
+	assert.Equal(t, parentSpanID, forwardSpan.Parent.SpanID().String())
+	assert.Contains(t, forwardSpan.Attributes, tracing.AttributeEndpointID.String("my-endpoint"))
+
+	// The dial span is a child of the forward span.
+	assert.Equal(t, parentTraceID, dialSpan.SpanContext.TraceID().String())
+	assert.Equal(t, forwardSpan.SpanContext.SpanID(), dialSpan.Parent.SpanID())
+
+	// The upstream receives the forward span as its parent.
+	traceparent := <-traceparentCh
+	assert.Contains(t, traceparent, forwardSpan.SpanContext.SpanID().String())
+}
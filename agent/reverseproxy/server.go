@@ -2,22 +2,31 @@ package reverseproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
+	"github.com/andydunstall/piko/agent/balancer"
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
 )
 
 type Server struct {
-	proxy *ReverseProxy
+	// handler either forwards requests to the upstreams or serves static
+	// files.
+	handler http.Handler
+
+	// balancer balances requests among the upstreams. Nil when serving
+	// files.
+	balancer *balancer.Balancer
 
 	router *gin.Engine
 
@@ -28,33 +37,53 @@ type Server struct {
 
 func NewServer(
 	conf config.ListenerConfig,
-	registry *prometheus.Registry,
+	tlsConfig *tls.Config,
+	metrics *Metrics,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+
 	logger = logger.WithSubsystem("proxy.http")
 	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
 
+	var handler http.Handler
+	var lb *balancer.Balancer
+	if dir, ok := conf.FileDir(); ok {
+		handler = NewFileServer(dir, conf.SPAFallback)
+	} else {
+		proxy := NewReverseProxy(conf, tlsConfig, metrics, logger, opts...)
+		handler = proxy
+		lb = proxy.Balancer()
+	}
+
 	router := gin.New()
 	s := &Server{
-		proxy:  NewReverseProxy(conf, logger),
-		router: router,
+		handler:  handler,
+		balancer: lb,
+		router:   router,
 		httpServer: &http.Server{
-			Handler:  router,
+			// Requests forwarded to HTTP/2 endpoints use cleartext HTTP/2
+			// (h2c).
+			Handler:  h2c.NewHandler(router, &http2.Server{}),
 			ErrorLog: logger.StdLogger(zapcore.WarnLevel),
 		},
 		logger: logger,
 	}
 
 	// Recover from panics.
-	s.router.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
+	s.router.Use(middleware.NewRecovery(logger, metrics.HTTP, options.panicHook))
 
 	s.router.Use(middleware.NewLogger(conf.AccessLog, logger))
 
-	metrics := middleware.NewMetrics("agent")
-	if registry != nil {
-		metrics.Register(registry)
-	}
-	router.Use(metrics.Handler())
+	router.Use(metrics.HTTP.Handler())
 
 	s.router.NoRoute(s.proxyRoute)
 
@@ -74,17 +103,14 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return s.httpServer.Shutdown(ctx)
 }
 
-func (s *Server) proxyRoute(c *gin.Context) {
-	s.proxy.ServeHTTP(c.Writer, c.Request)
+// Balancer returns the balancer used to select upstreams, or nil if the
+// server serves static files.
+func (s *Server) Balancer() *balancer.Balancer {
+	return s.balancer
 }
 
-func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
-	c.AbortWithStatus(http.StatusInternalServerError)
+func (s *Server) proxyRoute(c *gin.Context) {
+	s.handler.ServeHTTP(c.Writer, c.Request)
 }
 
 func init() {
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,13 +14,18 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	"github.com/andydunstall/piko/agent/healthcheck"
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
 )
 
 // Server is an agent server to inspect the status of the agent.
 type Server struct {
 	registry *prometheus.Registry
 
+	healthCheckers   []*healthcheck.Checker
+	healthCheckersMu sync.Mutex
+
 	httpServer *http.Server
 
 	logger log.Logger
@@ -38,13 +45,35 @@ func NewServer(registry *prometheus.Registry, logger log.Logger) *Server {
 	}
 
 	// Recover from panics.
-	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
+	router.Use(middleware.NewRecovery(server.logger, nil, nil))
 
 	server.registerRoutes(router)
 
 	return server
 }
 
+// AddHealthChecker adds a listeners health checker to report at
+// '/status/health'.
+func (s *Server) AddHealthChecker(checker *healthcheck.Checker) {
+	s.healthCheckersMu.Lock()
+	defer s.healthCheckersMu.Unlock()
+
+	s.healthCheckers = append(s.healthCheckers, checker)
+}
+
+// RemoveHealthChecker removes a health checker added with AddHealthChecker.
+func (s *Server) RemoveHealthChecker(checker *healthcheck.Checker) {
+	s.healthCheckersMu.Lock()
+	defer s.healthCheckersMu.Unlock()
+
+	s.healthCheckers = slices.DeleteFunc(
+		slices.Clone(s.healthCheckers),
+		func(c *healthcheck.Checker) bool {
+			return c == checker
+		},
+	)
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	s.logger.Info(
 		"starting http server",
@@ -68,15 +97,21 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 	if s.registry != nil {
 		router.GET("/metrics", s.metricsHandler())
 	}
+	router.GET("/status/health", s.healthStatusRoute)
 }
 
-func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
-	c.AbortWithStatus(http.StatusInternalServerError)
+// healthStatusRoute returns the health of the upstreams of each listener
+// with health checks enabled.
+func (s *Server) healthStatusRoute(c *gin.Context) {
+	s.healthCheckersMu.Lock()
+	checkers := s.healthCheckers
+	s.healthCheckersMu.Unlock()
+
+	statuses := make([]healthcheck.Status, 0, len(checkers))
+	for _, checker := range checkers {
+		statuses = append(statuses, checker.Status())
+	}
+	c.JSON(http.StatusOK, statuses)
 }
 
 func (s *Server) metricsHandler() gin.HandlerFunc {
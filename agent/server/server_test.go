@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/healthcheck"
 	"github.com/andydunstall/piko/pkg/log"
 )
 
@@ -36,6 +39,32 @@ func TestServer_AdminRoutes(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	t.Run("health status", func(t *testing.T) {
+		s.AddHealthChecker(healthcheck.NewChecker(config.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       "localhost:3000",
+			Protocol:   config.ListenerProtocolHTTP,
+		}, nil, log.NewNopLogger()))
+
+		url := fmt.Sprintf("http://%s/status/health", ln.Addr().String())
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var statuses []healthcheck.Status
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&statuses))
+		assert.Equal(t, []healthcheck.Status{{
+			EndpointID: "my-endpoint",
+			Healthy:    true,
+			Upstreams: []healthcheck.UpstreamStatus{{
+				Addr:    "localhost:3000",
+				Healthy: true,
+			}},
+		}}, statuses)
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		url := fmt.Sprintf("http://%s/foo", ln.Addr().String())
 		resp, err := http.Get(url)
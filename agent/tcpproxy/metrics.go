@@ -0,0 +1,66 @@
+package tcpproxy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	// outcomeSuccess means the connection was forwarded to the upstream.
+	outcomeSuccess = "success"
+	// outcomeUnreachable means the connection couldn't be forwarded as no
+	// upstream could be dialed.
+	outcomeUnreachable = "unreachable"
+)
+
+// Metrics contains the metrics for all TCP listeners.
+type Metrics struct {
+	// ForwardConnectionsTotal is the number of connections forwarded to the
+	// upstream. Labelled by endpoint ID and outcome.
+	ForwardConnectionsTotal *prometheus.CounterVec
+
+	// ActiveConnections is the number of connections currently being
+	// forwarded to the upstream. Labelled by endpoint ID.
+	ActiveConnections *prometheus.GaugeVec
+
+	// UpstreamDialErrorsTotal is the number of failed attempts to dial the
+	// upstream. Labelled by endpoint ID.
+	UpstreamDialErrorsTotal *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ForwardConnectionsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent_tcp",
+				Name:      "forward_connections_total",
+				Help:      "Number of connections forwarded to the upstream",
+			},
+			[]string{"endpoint_id", "outcome"},
+		),
+		ActiveConnections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "agent_tcp",
+				Name:      "active_connections",
+				Help:      "Number of connections currently being forwarded to the upstream",
+			},
+			[]string{"endpoint_id"},
+		),
+		UpstreamDialErrorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "agent_tcp",
+				Name:      "upstream_dial_errors_total",
+				Help:      "Number of failed attempts to dial the upstream",
+			},
+			[]string{"endpoint_id"},
+		),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.ForwardConnectionsTotal,
+		m.ActiveConnections,
+		m.UpstreamDialErrorsTotal,
+	)
+}
@@ -1,13 +1,16 @@
 package tcpproxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/andydunstall/piko/agent/balancer"
 	"github.com/andydunstall/piko/agent/config"
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -15,6 +18,16 @@ import (
 type Server struct {
 	conf config.ListenerConfig
 
+	// network is the network of the upstreams, either 'tcp' or 'unix'.
+	network string
+	// hosts contains the upstream addresses to forward to.
+	hosts    []string
+	balancer *balancer.Balancer
+
+	// tlsConfig configures TLS connections to the upstream. If nil
+	// connections to the upstream don't use TLS.
+	tlsConfig *tls.Config
+
 	ln net.Listener
 
 	dialer *net.Dialer
@@ -22,23 +35,52 @@ type Server struct {
 	conns   map[net.Conn]struct{}
 	connsMu sync.Mutex
 
+	metrics *Metrics
+
 	logger       log.Logger
 	accessLogger log.Logger
 }
 
+// NewServer returns a TCP proxy server forwarding connections to the
+// configured upstreams.
+//
+// metrics may be shared by multiple servers. If nil the metrics aren't
+// exported.
 func NewServer(
 	conf config.ListenerConfig,
+	tlsConfig *tls.Config,
+	metrics *Metrics,
 	logger log.Logger,
 ) *Server {
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+
 	logger = logger.WithSubsystem("proxy.tcp")
 	logger = logger.With(zap.String("endpoint-id", conf.EndpointID))
 
+	network := "tcp"
+	hosts, ok := conf.Hosts()
+	if path, unixSocket := conf.UnixSocket(); unixSocket {
+		network = "unix"
+		hosts = []string{path}
+	} else if !ok {
+		// We've already verified the address on boot so don't need to handle
+		// the error.
+		panic("invalid addr: " + conf.Addr)
+	}
+
 	s := &Server{
-		conf: conf,
+		conf:      conf,
+		network:   network,
+		hosts:     hosts,
+		balancer:  balancer.New(len(hosts)),
+		tlsConfig: tlsConfig,
 		dialer: &net.Dialer{
 			Timeout: conf.Timeout,
 		},
 		conns:        make(map[net.Conn]struct{}),
+		metrics:      metrics,
 		logger:       logger,
 		accessLogger: logger.WithSubsystem("proxy.tcp.access"),
 	}
@@ -62,6 +104,11 @@ func (s *Server) Serve(ln net.Listener) error {
 	}
 }
 
+// Balancer returns the balancer used to select upstreams.
+func (s *Server) Balancer() *balancer.Balancer {
+	return s.balancer
+}
+
 func (s *Server) Close() error {
 	if s.ln != nil {
 		s.ln.Close()
@@ -83,22 +130,66 @@ func (s *Server) serveConn(c net.Conn) {
 	s.logConnOpened()
 	defer s.logConnClosed()
 
-	host, ok := s.conf.Host()
-	if !ok {
-		// We've already verified the address on boot so don't need to handle
-		// the error.
-		panic("invalid addr: " + s.conf.Addr)
-	}
-	upstream, err := s.dialer.Dial("tcp", host)
+	upstream, err := s.dialUpstream()
 	if err != nil {
 		s.logger.Warn("failed to dial upstream", zap.Error(err))
+		s.metrics.ForwardConnectionsTotal.With(prometheus.Labels{
+			"endpoint_id": s.conf.EndpointID,
+			"outcome":     outcomeUnreachable,
+		}).Inc()
 		return
 	}
 	defer upstream.Close()
 
+	s.metrics.ForwardConnectionsTotal.With(prometheus.Labels{
+		"endpoint_id": s.conf.EndpointID,
+		"outcome":     outcomeSuccess,
+	}).Inc()
+
+	activeConnections := s.metrics.ActiveConnections.With(prometheus.Labels{
+		"endpoint_id": s.conf.EndpointID,
+	})
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
 	forward(c, upstream)
 }
 
+// dialUpstream dials one of the upstreams. If dialing an upstream fails, it
+// is skipped and the next upstream is tried.
+func (s *Server) dialUpstream() (net.Conn, error) {
+	var err error
+	for i := 0; i != s.balancer.Len(); i++ {
+		idx := s.balancer.Next()
+
+		var conn net.Conn
+		if s.tlsConfig != nil {
+			conn, err = tls.DialWithDialer(
+				s.dialer, s.network, s.hosts[idx], s.tlsConfig,
+			)
+		} else {
+			conn, err = s.dialer.Dial(s.network, s.hosts[idx])
+		}
+		if err == nil {
+			s.balancer.Succeeded(idx)
+			return conn, nil
+		}
+
+		s.balancer.Failed(idx)
+		s.metrics.UpstreamDialErrorsTotal.With(prometheus.Labels{
+			"endpoint_id": s.conf.EndpointID,
+		}).Inc()
+		if s.balancer.Len() > 1 {
+			s.logger.Warn(
+				"failed to dial upstream; trying next upstream",
+				zap.String("addr", s.hosts[idx]),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil, err
+}
+
 func (s *Server) addConn(c net.Conn) {
 	s.connsMu.Lock()
 	defer s.connsMu.Unlock()
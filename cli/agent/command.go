@@ -2,19 +2,26 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	rungroup "github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
+	"github.com/andydunstall/piko/agent/balancer"
 	"github.com/andydunstall/piko/agent/client"
 	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/healthcheck"
 	"github.com/andydunstall/piko/agent/reverseproxy"
 	"github.com/andydunstall/piko/agent/server"
 	"github.com/andydunstall/piko/agent/tcpproxy"
@@ -70,32 +77,120 @@ Examples:
 	loadConf.RegisterFlags(cmd.PersistentFlags())
 
 	cmd.PersistentPreRun = func(_ *cobra.Command, _ []string) {
-		if err := loadConf.Load(conf); err != nil {
+		if err := loadConfig(&loadConf, conf); err != nil {
 			fmt.Println(err.Error())
 			os.Exit(1)
 		}
+	}
+
+	cmd.AddCommand(newStartCommand(conf, &loadConf))
+	cmd.AddCommand(newHTTPCommand(conf))
+	cmd.AddCommand(newTCPCommand(conf))
+
+	return cmd
+}
+
+// loadConfig loads the YAML configuration into conf and validates the
+// loaded configuration.
+func loadConfig(loadConf *pikoconfig.Config, conf *config.Config) error {
+	if err := loadConf.Load(conf); err != nil {
+		return err
+	}
+
+	// Listener protocol defaults to HTTP.
+	for i := range conf.Listeners {
+		if conf.Listeners[i].Protocol == "" {
+			conf.Listeners[i].Protocol = config.ListenerProtocolHTTP
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
 
-		// Listener protocol defaults to HTTP.
-		for _, listener := range conf.Listeners {
-			if listener.Protocol == "" {
-				listener.Protocol = config.ListenerProtocolHTTP
+// newConfigReloader returns a function that reloads the YAML configuration.
+//
+// Each reload starts from the default configuration, applies the command
+// line flags set in flags, then loads the YAML configuration, so keys removed
+// from the YAML file revert to their default (or flag) value. The returned
+// configuration is always a new configuration.
+func newConfigReloader(
+	flags *pflag.FlagSet,
+	loadConf *pikoconfig.Config,
+) func() (*config.Config, error) {
+	return func() (*config.Config, error) {
+		reloaded := config.Default()
+
+		fs := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+		reloaded.RegisterFlags(fs)
+		var err error
+		flags.Visit(func(f *pflag.Flag) {
+			if err != nil {
+				return
 			}
+			if copyErr := copyFlag(fs, f); copyErr != nil {
+				err = fmt.Errorf("flag: %s: %w", f.Name, copyErr)
+			}
+		})
+		if err != nil {
+			return nil, err
 		}
 
-		if err := conf.Validate(); err != nil {
-			fmt.Printf("config: %s\n", err.Error())
-			os.Exit(1)
+		if err := loadConfig(loadConf, reloaded); err != nil {
+			return nil, err
 		}
+		return reloaded, nil
 	}
+}
 
-	cmd.AddCommand(newStartCommand(conf))
-	cmd.AddCommand(newHTTPCommand(conf))
-	cmd.AddCommand(newTCPCommand(conf))
+// copyFlag sets the flag in fs with the same name as f to the value of f.
+// Flags that don't exist in fs are ignored.
+func copyFlag(fs *pflag.FlagSet, f *pflag.Flag) error {
+	dst := fs.Lookup(f.Name)
+	if dst == nil {
+		return nil
+	}
+	// Slice values format as '[a,b]' so must be copied as a slice.
+	if src, ok := f.Value.(pflag.SliceValue); ok {
+		if dst, ok := dst.Value.(pflag.SliceValue); ok {
+			return dst.Replace(src.GetSlice())
+		}
+	}
+	return dst.Value.Set(f.Value.String())
+}
 
-	return cmd
+// restartRequired returns the configuration sections that differ between
+// the running and reloaded configuration and can't be applied without a
+// restart. Only listeners are reloaded.
+func restartRequired(running *config.Config, reloaded *config.Config) []string {
+	var changed []string
+	if !reflect.DeepEqual(running.Connect, reloaded.Connect) {
+		changed = append(changed, "connect")
+	}
+	if !reflect.DeepEqual(running.Server, reloaded.Server) {
+		changed = append(changed, "server")
+	}
+	if !reflect.DeepEqual(running.Log, reloaded.Log) {
+		changed = append(changed, "log")
+	}
+	if running.GracePeriod != reloaded.GracePeriod {
+		changed = append(changed, "grace_period")
+	}
+	return changed
 }
 
-func runAgent(conf *config.Config, logger log.Logger) error {
+// runAgent runs the agent with the given configuration.
+//
+// If reload is not nil, it is called to reload the configuration when the
+// agent receives a SIGHUP, and the agent updates its listeners to match the
+// reloaded configuration.
+func runAgent(
+	conf *config.Config,
+	reload func() (*config.Config, error),
+	logger log.Logger,
+) error {
 	logger.Info(
 		"starting piko agent",
 		zap.String("version", build.Version),
@@ -111,68 +206,72 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 		client.WithToken(conf.Connect.Token),
 		client.WithUpstreamURL(conf.Connect.URL),
 		client.WithTLSConfig(connectTLSConfig),
+		client.WithWriteTimeout(conf.Connect.WriteTimeout),
+		client.WithReconnectBackoff(
+			conf.Connect.Reconnect.MinBackoff,
+			conf.Connect.Reconnect.MaxBackoff,
+			conf.Connect.Reconnect.Multiplier,
+		),
+		client.WithReconnectResetAfter(conf.Connect.Reconnect.ResetAfter),
+		client.WithReconnectMaxAttempts(conf.Connect.Reconnect.MaxAttempts),
 		client.WithLogger(logger.WithSubsystem("client")),
 	)
 
 	registry := prometheus.NewRegistry()
+	client.Metrics().Register(registry)
+
+	// Metrics are shared by all listeners.
+	httpMetrics := reverseproxy.NewMetrics()
+	httpMetrics.Register(registry)
+	tcpMetrics := tcpproxy.NewMetrics()
+	tcpMetrics.Register(registry)
+
+	server := server.NewServer(registry, logger)
 
 	var group rungroup.Group
 
-	for _, listenerConfig := range conf.Listeners {
-		connectCtx, connectCancel := context.WithTimeout(
-			context.Background(),
+	// serveErrCh receives the first error from a listener that stops
+	// serving unexpectedly.
+	serveErrCh := make(chan error, 1)
+
+	start := func(listenerConfig config.ListenerConfig) (func(), error) {
+		return startListener(
+			listenerConfig,
+			client,
+			server,
+			httpMetrics,
+			tcpMetrics,
 			conf.Connect.Timeout,
+			conf.GracePeriod,
+			serveErrCh,
+			logger,
 		)
-		defer connectCancel()
-
-		ln, err := client.Listen(connectCtx, listenerConfig.EndpointID)
-		if err != nil {
-			return fmt.Errorf("listen: %s: %w", listenerConfig.EndpointID, err)
-		}
-		defer ln.Close()
-
-		if listenerConfig.Protocol == config.ListenerProtocolHTTP {
-			server := reverseproxy.NewServer(listenerConfig, registry, logger)
-
-			// Listener handler.
-			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
-				}
-				return nil
-			}, func(error) {
-				shutdownCtx, cancel := context.WithTimeout(
-					context.Background(), conf.GracePeriod,
-				)
-				defer cancel()
+	}
+	listeners := newListenerManager(start, logger)
+	if err := listeners.Start(conf.Listeners); err != nil {
+		return err
+	}
 
-				if err := server.Shutdown(shutdownCtx); err != nil {
-					logger.Warn("failed to gracefully shutdown listener", zap.Error(err))
-				}
-			})
-		} else if listenerConfig.Protocol == config.ListenerProtocolTCP {
-			server := tcpproxy.NewServer(listenerConfig, logger)
-
-			// Listener handler.
-			group.Add(func() error {
-				if err := server.Serve(ln); err != nil {
-					return fmt.Errorf("serve: %w", err)
-				}
-				return nil
-			}, func(error) {
-				if err := server.Close(); err != nil {
-					logger.Warn("failed to close listener", zap.Error(err))
-				}
-			})
+	// Listeners handler.
+	listenersCtx, listenersCancel := context.WithCancel(context.Background())
+	group.Add(func() error {
+		select {
+		case err := <-serveErrCh:
+			return err
+		case <-listenersCtx.Done():
+			return nil
 		}
-	}
+	}, func(error) {
+		listenersCancel()
+		listeners.Close()
+	})
 
 	// Agent server.
 	serverLn, err := net.Listen("tcp", conf.Server.BindAddr)
 	if err != nil {
+		listeners.Close()
 		return fmt.Errorf("server listen: %s: %w", conf.Server.BindAddr, err)
 	}
-	server := server.NewServer(registry, logger)
 
 	group.Add(func() error {
 		if err := server.Serve(serverLn); err != nil {
@@ -190,6 +289,26 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 		}
 	})
 
+	// Reload handler.
+	if reload != nil {
+		reloadCtx, reloadCancel := context.WithCancel(context.Background())
+		reloadCh := make(chan os.Signal, 1)
+		signal.Notify(reloadCh, syscall.SIGHUP)
+		group.Add(func() error {
+			for {
+				select {
+				case <-reloadCh:
+					reloadListeners(reload, conf, listeners, logger)
+				case <-reloadCtx.Done():
+					return nil
+				}
+			}
+		}, func(error) {
+			signal.Stop(reloadCh)
+			reloadCancel()
+		})
+	}
+
 	// Termination handler.
 	signalCtx, signalCancel := context.WithCancel(context.Background())
 	signalCh := make(chan os.Signal, 1)
@@ -211,3 +330,207 @@ func runAgent(conf *config.Config, logger log.Logger) error {
 
 	return group.Run()
 }
+
+// reloadListeners reloads the configuration and updates the running
+// listeners. If the reloaded configuration is invalid, the running listeners
+// are left unchanged.
+//
+// Only listeners are reloaded, so any other changes compared to the running
+// configuration are logged as requiring a restart.
+func reloadListeners(
+	reload func() (*config.Config, error),
+	running *config.Config,
+	listeners *listenerManager,
+	logger log.Logger,
+) {
+	logger.Info("reloading config")
+
+	conf, err := reload()
+	if err != nil {
+		logger.Error("failed to reload config", zap.Error(err))
+		return
+	}
+
+	if changed := restartRequired(running, conf); len(changed) > 0 {
+		logger.Warn(
+			"config changes require a restart",
+			zap.Strings("changed", changed),
+		)
+	}
+
+	if _, err := listeners.Reload(conf.Listeners); err != nil {
+		logger.Error("failed to reload listeners", zap.Error(err))
+	}
+}
+
+// startListener registers the listener with the given configuration and
+// serves incoming connections. Returns a function to drain and close the
+// listener.
+//
+// If the listener stops serving unexpectedly, the error is sent to
+// serveErrCh.
+func startListener(
+	listenerConfig config.ListenerConfig,
+	client *client.Client,
+	server *server.Server,
+	httpMetrics *reverseproxy.Metrics,
+	tcpMetrics *tcpproxy.Metrics,
+	connectTimeout time.Duration,
+	gracePeriod time.Duration,
+	serveErrCh chan<- error,
+	logger log.Logger,
+) (func(), error) {
+	upstreamTLSConfig, err := listenerConfig.TLS.Load()
+	if err != nil {
+		return nil, fmt.Errorf("upstream tls: %w", err)
+	}
+
+	connectCtx, connectCancel := context.WithTimeout(
+		context.Background(),
+		connectTimeout,
+	)
+	defer connectCancel()
+
+	ln, err := client.Listen(connectCtx, listenerConfig.EndpointID)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	var serve func() error
+	var shutdown func(ctx context.Context) error
+	var lb *balancer.Balancer
+	if listenerConfig.Protocol == config.ListenerProtocolTCP {
+		tcpServer := tcpproxy.NewServer(
+			listenerConfig, upstreamTLSConfig, tcpMetrics, logger,
+		)
+		serve = func() error {
+			return tcpServer.Serve(ln)
+		}
+		shutdown = func(context.Context) error {
+			return tcpServer.Close()
+		}
+		lb = tcpServer.Balancer()
+	} else {
+		httpServer := reverseproxy.NewServer(
+			listenerConfig, upstreamTLSConfig, httpMetrics, logger,
+		)
+		serve = func() error {
+			return httpServer.Serve(ln)
+		}
+		shutdown = httpServer.Shutdown
+		lb = httpServer.Balancer()
+	}
+
+	var checker *healthcheck.Checker
+	checkerCtx, checkerCancel := context.WithCancel(context.Background())
+	checkerDone := make(chan struct{})
+	if listenerConfig.HealthCheck.Enabled {
+		checker = newHealthChecker(
+			listenerConfig, upstreamTLSConfig, ln, lb, logger,
+		)
+		server.AddHealthChecker(checker)
+		go func() {
+			defer close(checkerDone)
+			checker.Run(checkerCtx)
+		}()
+	} else {
+		close(checkerDone)
+	}
+
+	// stopped indicates the listener is being stopped, so errors from serve
+	// are expected.
+	stopped := atomic.NewBool(false)
+	go func() {
+		if err := serve(); err != nil && !stopped.Load() {
+			select {
+			case serveErrCh <- fmt.Errorf(
+				"serve: %s: %w", listenerConfig.EndpointID, err,
+			):
+			default:
+			}
+		}
+	}()
+
+	stop := func() {
+		stopped.Store(true)
+
+		checkerCancel()
+		<-checkerDone
+		if checker != nil {
+			server.RemoveHealthChecker(checker)
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(
+			context.Background(), gracePeriod,
+		)
+		defer cancel()
+
+		drainListener(shutdownCtx, ln, logger)
+
+		if err := shutdown(shutdownCtx); err != nil {
+			logger.Warn(
+				"failed to gracefully shutdown listener",
+				zap.String("endpoint-id", listenerConfig.EndpointID),
+				zap.Error(err),
+			)
+		}
+		if err := ln.Close(); err != nil {
+			logger.Warn(
+				"failed to close listener",
+				zap.String("endpoint-id", listenerConfig.EndpointID),
+				zap.Error(err),
+			)
+		}
+	}
+	return stop, nil
+}
+
+// newHealthChecker returns a health checker that removes unhealthy upstreams
+// from the balancer, and pauses the listener when all upstreams are unhealthy
+// so the server stops routing requests to the listener.
+func newHealthChecker(
+	conf config.ListenerConfig,
+	tlsConfig *tls.Config,
+	ln client.Listener,
+	balancer *balancer.Balancer,
+	logger log.Logger,
+) *healthcheck.Checker {
+	checker := healthcheck.NewChecker(conf, tlsConfig, logger)
+	checker.OnUpstreamChange(balancer.SetHealthy)
+	checker.OnChange(func(healthy bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout)
+		defer cancel()
+
+		if healthy {
+			if err := ln.Resume(ctx); err != nil {
+				logger.Warn(
+					"failed to resume listener",
+					zap.String("endpoint-id", ln.EndpointID()),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		if err := ln.Pause(ctx); err != nil {
+			logger.Warn(
+				"failed to pause listener",
+				zap.String("endpoint-id", ln.EndpointID()),
+				zap.Error(err),
+			)
+		}
+	})
+	return checker
+}
+
+// drainListener stops the server routing new connections to the listener
+// and waits for in-flight connections to complete.
+func drainListener(ctx context.Context, ln client.Listener, logger log.Logger) {
+	if err := ln.Drain(ctx); err != nil {
+		logger.Warn(
+			"failed to drain listener",
+			zap.String("endpoint-id", ln.EndpointID()),
+			zap.Error(err),
+		)
+	}
+}
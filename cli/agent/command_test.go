@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
+)
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig := func(s string) {
+		require.NoError(t, os.WriteFile(path, []byte(s), 0o600))
+	}
+
+	writeConfig(`
+listeners:
+  - endpoint_id: endpoint-1
+    addr: localhost:3001
+    timeout: 10s
+  - endpoint_id: endpoint-2
+    addr: localhost:3002
+    timeout: 10s
+`)
+
+	loadConf := &pikoconfig.Config{}
+	conf := config.Default()
+
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	conf.RegisterFlags(fs)
+	loadConf.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{
+		"--config.path", path,
+		"--connect.url", "http://piko.example.com:8001",
+		"--log.subsystems", "a,b",
+	}))
+
+	require.NoError(t, loadConfig(loadConf, conf))
+	require.Len(t, conf.Listeners, 2)
+
+	reload := newConfigReloader(fs, loadConf)
+
+	t.Run("reload", func(t *testing.T) {
+		writeConfig(`
+listeners:
+  - endpoint_id: endpoint-2
+    addr: localhost:3002
+    timeout: 10s
+    protocol: tcp
+`)
+
+		reloaded, err := reload()
+		require.NoError(t, err)
+		assert.Equal(t, []config.ListenerConfig{{
+			EndpointID: "endpoint-2",
+			Addr:       "localhost:3002",
+			Protocol:   config.ListenerProtocolTCP,
+			Timeout:    time.Second * 10,
+		}}, reloaded.Listeners)
+		assert.Equal(t, conf.Connect, reloaded.Connect)
+
+		// The original configuration is not modified.
+		assert.Len(t, conf.Listeners, 2)
+	})
+
+	t.Run("flags", func(t *testing.T) {
+		reloaded, err := reload()
+		require.NoError(t, err)
+
+		assert.Equal(t, "http://piko.example.com:8001", reloaded.Connect.URL)
+		assert.Equal(t, []string{"a", "b"}, reloaded.Log.Subsystems)
+		assert.Empty(t, restartRequired(conf, reloaded))
+	})
+
+	t.Run("removed key", func(t *testing.T) {
+		writeConfig(`
+connect:
+  timeout: 5s
+listeners:
+  - endpoint_id: endpoint-1
+    addr: localhost:3001
+    timeout: 10s
+`)
+		reloaded, err := reload()
+		require.NoError(t, err)
+		assert.Equal(t, time.Second*5, reloaded.Connect.Timeout)
+		assert.Equal(t, []string{"connect"}, restartRequired(conf, reloaded))
+
+		// Removing the key reverts to the default.
+		writeConfig(`
+listeners:
+  - endpoint_id: endpoint-1
+    addr: localhost:3001
+    timeout: 10s
+`)
+		reloaded, err = reload()
+		require.NoError(t, err)
+		assert.Equal(t, config.Default().Connect.Timeout, reloaded.Connect.Timeout)
+		assert.Empty(t, restartRequired(conf, reloaded))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		writeConfig(`
+listeners:
+  - endpoint_id: endpoint-1
+    addr: localhost:3001
+    timeout: 10s
+    protocol: foo
+`)
+
+		_, err := reload()
+		assert.Error(t, err)
+
+		assert.Len(t, conf.Listeners, 2)
+	})
+
+	t.Run("default protocol", func(t *testing.T) {
+		assert.Equal(t, config.ListenerProtocolHTTP, conf.Listeners[0].Protocol)
+	})
+}
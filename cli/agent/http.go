@@ -20,7 +20,13 @@ func newHTTPCommand(conf *config.Config) *cobra.Command {
 		Long: `Listens for HTTP traffic on the given endpoint and forwards
 incoming connections to your upstream service.
 
-The configured upstream address be a port, host and port or a full URL.
+The configured upstream address be a port, host and port, a full URL or a
+Unix socket in the form 'unix:<path>'. To balance requests among multiple
+upstreams, configure a comma separated list of addresses. Upstreams that fail
+to connect are skipped.
+
+Alternatively the agent can serve static files from a local directory, rather
+than forwarding to an upstream, using an address in the form 'file:<path>'.
 
 Examples:
   # Listen for connections from endpoint 'my-endpoint' and forward connections
@@ -32,6 +38,20 @@ Examples:
 
   # Listen and forward to 10.26.104.56:3000 using HTTPS.
   piko agent http my-endpoint https://10.26.104.56:3000
+
+  # Listen and balance requests among 10.26.104.56:3000 and
+  # 10.26.104.57:3000.
+  piko agent http my-endpoint 10.26.104.56:3000,10.26.104.57:3000
+
+  # Listen and forward to the Unix socket at /var/run/app.sock.
+  piko agent http my-endpoint unix:/var/run/app.sock
+
+  # Listen and forward to a gRPC service at localhost:50051 using HTTP/2.
+  piko agent http my-endpoint 50051 --http2
+
+  # Listen and serve static files from the ./dist directory, serving
+  # ./dist/index.html for unknown paths.
+  piko agent http my-endpoint file:./dist --spa-fallback
 `,
 	}
 
@@ -53,21 +73,75 @@ Whether to log all incoming HTTP requests and responses as 'info' logs.`,
 Timeout forwarding incoming HTTP requests to the upstream.`,
 	)
 
+	var hostHeader string
+	cmd.Flags().StringVar(
+		&hostHeader,
+		"host-header",
+		"",
+		`
+Rewrite the 'Host' header of requests forwarded to the upstream to the given
+value.
+
+By default the 'Host' header of the incoming request is preserved.`,
+	)
+
+	var rewriteHost bool
+	cmd.Flags().BoolVar(
+		&rewriteHost,
+		"rewrite-host",
+		false,
+		`
+Whether to rewrite the 'Host' header of requests forwarded to the upstream to
+the upstream address, such as when the upstream uses name-based virtual
+hosting.
+
+By default the 'Host' header of the incoming request is preserved.`,
+	)
+
+	var http2 bool
+	cmd.Flags().BoolVar(
+		&http2,
+		"http2",
+		false,
+		`
+Whether to forward requests to the upstream using HTTP/2, such as for gRPC
+upstreams.
+
+Cleartext upstreams must support HTTP/2 with prior knowledge (h2c).`,
+	)
+
+	var spaFallback bool
+	cmd.Flags().BoolVar(
+		&spaFallback,
+		"spa-fallback",
+		false,
+		`
+When serving static files, whether to serve 'index.html' from the root of the
+directory when the requested file doesn't exist, such as for single page apps
+that handle routing in the browser.`,
+	)
+
 	var logger log.Logger
 
 	cmd.PreRun = func(_ *cobra.Command, args []string) {
 		// Discard any listeners in the configuration file and use from command
 		// line.
 		conf.Listeners = []config.ListenerConfig{{
-			EndpointID: args[0],
-			Addr:       args[1],
-			Protocol:   config.ListenerProtocolHTTP,
-			AccessLog:  accessLog,
-			Timeout:    timeout,
+			EndpointID:  args[0],
+			Addr:        args[1],
+			Protocol:    config.ListenerProtocolHTTP,
+			AccessLog:   accessLog,
+			Timeout:     timeout,
+			HostHeader:  hostHeader,
+			RewriteHost: rewriteHost,
+			HTTP2:       http2,
+			SPAFallback: spaFallback,
 		}}
 
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level, conf.Log.Subsystems, conf.Log.Options()...,
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -75,7 +149,7 @@ Timeout forwarding incoming HTTP requests to the upstream.`,
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runAgent(conf, logger); err != nil {
+		if err := runAgent(conf, nil, logger); err != nil {
 			logger.Error("failed to run agent", zap.Error(err))
 			os.Exit(1)
 		}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// listenerStarter registers and serves the listener with the given
+// configuration. Returns a function to gracefully stop the listener.
+type listenerStarter func(conf config.ListenerConfig) (stop func(), err error)
+
+type runningListener struct {
+	conf config.ListenerConfig
+	stop func()
+}
+
+// listenersDiff describes the changes applied when reloading the listeners.
+type listenersDiff struct {
+	// Added contains the endpoint IDs of new listeners.
+	Added []string
+	// Removed contains the endpoint IDs of removed listeners.
+	Removed []string
+	// Modified contains the endpoint IDs of listeners whose configuration
+	// changed, so were replaced.
+	Modified []string
+	// Unchanged is the number of listeners left running.
+	Unchanged int
+}
+
+// listenerManager starts and stops the agents listeners, and supports
+// reloading the listener configuration without affecting unchanged
+// listeners.
+type listenerManager struct {
+	start listenerStarter
+
+	listeners []*runningListener
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func newListenerManager(start listenerStarter, logger log.Logger) *listenerManager {
+	return &listenerManager{
+		start:  start,
+		logger: logger,
+	}
+}
+
+// Start starts the listeners with the given configuration. If any listener
+// fails to start, listeners started by this call are stopped.
+func (m *listenerManager) Start(confs []config.ListenerConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	started, err := m.startListeners(confs)
+	if err != nil {
+		return err
+	}
+	m.listeners = append(m.listeners, started...)
+	return nil
+}
+
+// Reload updates the running listeners to match the given configuration.
+//
+// Running listeners whose configuration is unchanged are left running. New
+// listeners are started before removed listeners are stopped, so when a
+// listeners configuration is modified, the existing listener keeps serving
+// until its replacement is registered.
+//
+// If any new listener fails to start, the running listeners are left
+// unchanged.
+func (m *listenerManager) Reload(confs []config.ListenerConfig) (listenersDiff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Match each configured listener with a running listener with the same
+	// configuration. Note there may be multiple listeners for the same
+	// endpoint.
+	unmatched := slices.Clone(m.listeners)
+	var unchanged []*runningListener
+	var added []config.ListenerConfig
+	for _, conf := range confs {
+		idx := slices.IndexFunc(unmatched, func(l *runningListener) bool {
+			return reflect.DeepEqual(l.conf, conf)
+		})
+		if idx == -1 {
+			added = append(added, conf)
+			continue
+		}
+		unchanged = append(unchanged, unmatched[idx])
+		unmatched = slices.Delete(unmatched, idx, idx+1)
+	}
+	removed := unmatched
+
+	started, err := m.startListeners(added)
+	if err != nil {
+		return listenersDiff{}, err
+	}
+
+	m.listeners = append(unchanged, started...)
+
+	stopListeners(removed)
+
+	diff := newListenersDiff(added, removed, len(unchanged))
+	m.logger.Info(
+		"reloaded listeners",
+		zap.Strings("added", diff.Added),
+		zap.Strings("removed", diff.Removed),
+		zap.Strings("modified", diff.Modified),
+		zap.Int("unchanged", diff.Unchanged),
+	)
+	return diff, nil
+}
+
+// Close stops all running listeners.
+func (m *listenerManager) Close() {
+	m.mu.Lock()
+	listeners := m.listeners
+	m.listeners = nil
+	m.mu.Unlock()
+
+	stopListeners(listeners)
+}
+
+func (m *listenerManager) startListeners(
+	confs []config.ListenerConfig,
+) ([]*runningListener, error) {
+	var started []*runningListener
+	for _, conf := range confs {
+		stop, err := m.start(conf)
+		if err != nil {
+			stopListeners(started)
+			return nil, fmt.Errorf("start listener: %s: %w", conf.EndpointID, err)
+		}
+		started = append(started, &runningListener{
+			conf: conf,
+			stop: stop,
+		})
+	}
+	return started, nil
+}
+
+// stopListeners stops the given listeners concurrently and waits for them
+// to stop.
+func stopListeners(listeners []*runningListener) {
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *runningListener) {
+			defer wg.Done()
+			l.stop()
+		}(l)
+	}
+	wg.Wait()
+}
+
+func newListenersDiff(
+	added []config.ListenerConfig,
+	removed []*runningListener,
+	unchanged int,
+) listenersDiff {
+	diff := listenersDiff{
+		Unchanged: unchanged,
+	}
+
+	removedIDs := make(map[string]int)
+	for _, l := range removed {
+		removedIDs[l.conf.EndpointID]++
+	}
+
+	// A listener for an endpoint that was both added and removed was
+	// modified.
+	for _, conf := range added {
+		if removedIDs[conf.EndpointID] > 0 {
+			removedIDs[conf.EndpointID]--
+			diff.Modified = append(diff.Modified, conf.EndpointID)
+			continue
+		}
+		diff.Added = append(diff.Added, conf.EndpointID)
+	}
+	for _, l := range removed {
+		if removedIDs[l.conf.EndpointID] > 0 {
+			removedIDs[l.conf.EndpointID]--
+			diff.Removed = append(diff.Removed, l.conf.EndpointID)
+		}
+	}
+
+	return diff
+}
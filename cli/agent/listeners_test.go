@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// fakeListeners tracks the listeners started and stopped by the manager.
+type fakeListeners struct {
+	running map[string]int
+	started []string
+	stopped []string
+
+	// failEndpointID is an endpoint ID that fails to start.
+	failEndpointID string
+
+	// mu protects the above fields, as listeners are stopped concurrently.
+	mu sync.Mutex
+}
+
+func newFakeListeners() *fakeListeners {
+	return &fakeListeners{
+		running: make(map[string]int),
+	}
+}
+
+func (l *fakeListeners) Start(conf config.ListenerConfig) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if conf.EndpointID == l.failEndpointID {
+		return nil, fmt.Errorf("failed to connect")
+	}
+
+	l.running[conf.EndpointID]++
+	l.started = append(l.started, conf.EndpointID)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.running[conf.EndpointID]--
+		l.stopped = append(l.stopped, conf.EndpointID)
+	}, nil
+}
+
+func (l *fakeListeners) Reset() {
+	l.started = nil
+	l.stopped = nil
+}
+
+func TestListenerManager_Reload(t *testing.T) {
+	listenerConfigs := func() []config.ListenerConfig {
+		return []config.ListenerConfig{
+			{
+				EndpointID: "endpoint-1",
+				Addr:       "localhost:3001",
+				Protocol:   config.ListenerProtocolHTTP,
+			},
+			{
+				EndpointID: "endpoint-2",
+				Addr:       "localhost:3002",
+				Protocol:   config.ListenerProtocolTCP,
+			},
+		}
+	}
+
+	t.Run("added", func(t *testing.T) {
+		listeners := newFakeListeners()
+		m := newListenerManager(listeners.Start, log.NewNopLogger())
+		require.NoError(t, m.Start(listenerConfigs()))
+		listeners.Reset()
+
+		confs := append(listenerConfigs(), config.ListenerConfig{
+			EndpointID: "endpoint-3",
+			Addr:       "localhost:3003",
+			Protocol:   config.ListenerProtocolHTTP,
+		})
+		diff, err := m.Reload(confs)
+		require.NoError(t, err)
+
+		assert.Equal(t, listenersDiff{
+			Added:     []string{"endpoint-3"},
+			Unchanged: 2,
+		}, diff)
+		assert.Equal(t, []string{"endpoint-3"}, listeners.started)
+		assert.Empty(t, listeners.stopped)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		listeners := newFakeListeners()
+		m := newListenerManager(listeners.Start, log.NewNopLogger())
+		require.NoError(t, m.Start(listenerConfigs()))
+		listeners.Reset()
+
+		diff, err := m.Reload(listenerConfigs()[:1])
+		require.NoError(t, err)
+
+		assert.Equal(t, listenersDiff{
+			Removed:   []string{"endpoint-2"},
+			Unchanged: 1,
+		}, diff)
+		assert.Empty(t, listeners.started)
+		assert.Equal(t, []string{"endpoint-2"}, listeners.stopped)
+		assert.Equal(t, 1, listeners.running["endpoint-1"])
+		assert.Equal(t, 0, listeners.running["endpoint-2"])
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		listeners := newFakeListeners()
+		m := newListenerManager(listeners.Start, log.NewNopLogger())
+		require.NoError(t, m.Start(listenerConfigs()))
+		listeners.Reset()
+
+		confs := listenerConfigs()
+		confs[1].Timeout = time.Second * 5
+		diff, err := m.Reload(confs)
+		require.NoError(t, err)
+
+		assert.Equal(t, listenersDiff{
+			Modified:  []string{"endpoint-2"},
+			Unchanged: 1,
+		}, diff)
+		// The modified listener is replaced.
+		assert.Equal(t, []string{"endpoint-2"}, listeners.started)
+		assert.Equal(t, []string{"endpoint-2"}, listeners.stopped)
+		assert.Equal(t, 1, listeners.running["endpoint-2"])
+
+		// Reloading the same configuration again has no effect.
+		listeners.Reset()
+		diff, err = m.Reload(confs)
+		require.NoError(t, err)
+		assert.Equal(t, listenersDiff{
+			Unchanged: 2,
+		}, diff)
+		assert.Empty(t, listeners.started)
+		assert.Empty(t, listeners.stopped)
+	})
+
+	t.Run("start failed", func(t *testing.T) {
+		listeners := newFakeListeners()
+		m := newListenerManager(listeners.Start, log.NewNopLogger())
+		require.NoError(t, m.Start(listenerConfigs()))
+		listeners.Reset()
+
+		listeners.failEndpointID = "endpoint-4"
+		confs := append(listenerConfigs()[:1], config.ListenerConfig{
+			EndpointID: "endpoint-3",
+			Addr:       "localhost:3003",
+			Protocol:   config.ListenerProtocolHTTP,
+		}, config.ListenerConfig{
+			EndpointID: "endpoint-4",
+			Addr:       "localhost:3004",
+			Protocol:   config.ListenerProtocolHTTP,
+		})
+		_, err := m.Reload(confs)
+		assert.Error(t, err)
+
+		// The listener started by the reload is stopped, and the existing
+		// listeners are unaffected.
+		assert.Equal(t, []string{"endpoint-3"}, listeners.started)
+		assert.Equal(t, []string{"endpoint-3"}, listeners.stopped)
+		assert.Equal(t, 1, listeners.running["endpoint-1"])
+		assert.Equal(t, 1, listeners.running["endpoint-2"])
+
+		// Reloading the original configuration has no effect.
+		listeners.Reset()
+		diff, err := m.Reload(listenerConfigs())
+		require.NoError(t, err)
+		assert.Equal(t, listenersDiff{
+			Unchanged: 2,
+		}, diff)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		listeners := newFakeListeners()
+		m := newListenerManager(listeners.Start, log.NewNopLogger())
+		require.NoError(t, m.Start(listenerConfigs()))
+		listeners.Reset()
+
+		m.Close()
+
+		sort.Strings(listeners.stopped)
+		assert.Equal(t, []string{"endpoint-1", "endpoint-2"}, listeners.stopped)
+	})
+}
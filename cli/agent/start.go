@@ -8,16 +8,28 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/agent/config"
+	pikoconfig "github.com/andydunstall/piko/pkg/config"
 	"github.com/andydunstall/piko/pkg/log"
 )
 
-func newStartCommand(conf *config.Config) *cobra.Command {
+func newStartCommand(conf *config.Config, loadConf *pikoconfig.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "start [flags]",
 		Short: "register the configured listeners",
 		Long: `Registers the configured listeners with Piko and forwards
 incoming connections for each listener to your upstream services.
 
+When a configuration file is used, sending the agent a SIGHUP reloads the
+listeners from the file. New listeners are registered and removed listeners
+are drained and closed, without affecting unchanged listeners. Listeners whose
+configuration changed are replaced. If the reloaded configuration is invalid,
+it is rejected and the existing listeners are left unchanged.
+
+The reloaded configuration starts from the defaults and command line flags,
+so keys removed from the file revert to their default. Only listeners are
+reloaded, so changing any other configuration requires a restart, and the
+agent logs a warning listing the changed configuration.
+
 Examples:
   # Start all listeners configured in agent.yaml.
   piko agent start --config.file ./agent.yaml
@@ -28,7 +40,9 @@ Examples:
 
 	cmd.PreRun = func(_ *cobra.Command, _ []string) {
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level, conf.Log.Subsystems, conf.Log.Options()...,
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -40,8 +54,13 @@ Examples:
 		}
 	}
 
-	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runAgent(conf, logger); err != nil {
+	cmd.Run = func(cmd *cobra.Command, _ []string) {
+		var reload func() (*config.Config, error)
+		if loadConf.Path != "" {
+			reload = newConfigReloader(cmd.Flags(), loadConf)
+		}
+
+		if err := runAgent(conf, reload, logger); err != nil {
 			logger.Error("failed to run agent", zap.Error(err))
 			os.Exit(1)
 		}
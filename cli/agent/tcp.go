@@ -20,7 +20,10 @@ func newTCPCommand(conf *config.Config) *cobra.Command {
 		Long: `Listens for TCP traffic on the given endpoint and forwards
 incoming connections to your upstream service.
 
-The configured upstream address be a port or host and port.
+The configured upstream address be a port, host and port, or a Unix socket in
+the form 'unix:<path>'. To balance connections among multiple upstreams,
+configure a comma separated list of addresses. Upstreams that fail to connect
+are skipped.
 
 Examples:
   # Listen for connections from endpoint 'my-endpoint' and forward
@@ -29,6 +32,13 @@ Examples:
 
   # Listen and forward to 10.26.104.56:3000.
   piko agent tcp my-endpoint 10.26.104.56:3000
+
+  # Listen and balance connections among 10.26.104.56:3000 and
+  # 10.26.104.57:3000.
+  piko agent tcp my-endpoint 10.26.104.56:3000,10.26.104.57:3000
+
+  # Listen and forward to the Unix socket at /var/run/app.sock.
+  piko agent tcp my-endpoint unix:/var/run/app.sock
 `,
 	}
 
@@ -64,7 +74,9 @@ Timeout connecting to the upstream.`,
 		}}
 
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level, conf.Log.Subsystems, conf.Log.Options()...,
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -72,7 +84,7 @@ Timeout connecting to the upstream.`,
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		if err := runAgent(conf, logger); err != nil {
+		if err := runAgent(conf, nil, logger); err != nil {
 			logger.Error("failed to run agent", zap.Error(err))
 			os.Exit(1)
 		}
@@ -28,7 +28,9 @@ Examples:
 
 	cmd.PreRun = func(_ *cobra.Command, _ []string) {
 		var err error
-		logger, err = log.NewLogger(conf.Log.Level, conf.Log.Subsystems)
+		logger, err = log.NewLogger(
+			conf.Log.Level, conf.Log.Subsystems, conf.Log.Options()...,
+		)
 		if err != nil {
 			fmt.Printf("failed to setup logger: %s\n", err.Error())
 			os.Exit(1)
@@ -1,45 +1,69 @@
 package status
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 
-	yaml "github.com/goccy/go-yaml"
 	"github.com/spf13/cobra"
 
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
 )
 
-func newClusterCommand(c *client.Client) *cobra.Command {
+func newClusterCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "cluster",
 		Short: "inspect proxy cluster",
 	}
 
-	cmd.AddCommand(newClusterNodesCommand(c))
-	cmd.AddCommand(newClusterNodeCommand(c))
+	cmd.AddCommand(newClusterNodesCommand(c, conf))
+	cmd.AddCommand(newClusterNodeCommand(c, conf))
 
 	return cmd
 }
 
-func newClusterNodesCommand(c *client.Client) *cobra.Command {
+func newClusterNodesCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "nodes",
 		Short: "inspect cluster nodes",
 		Long: `Inspect cluster nodes.
 
 Queries the server for the set of nodes the cluster that this node knows about.
-The output contains the state of each known node.
+The output contains the state of each known node, including the Piko version
+each node is running.
+
+Use '--version-skew' to check whether the nodes are running different
+versions, such as to verify a rollout completed. If the versions differ the
+command exits with status 1.
 
 Examples:
   piko server status cluster nodes
+
+  # Check whether all nodes are running the same version.
+  piko server status cluster nodes --version-skew
 `,
 	}
 
+	var checkSkew bool
+	cmd.Flags().BoolVar(
+		&checkSkew,
+		"version-skew",
+		false,
+		`
+Whether to check the nodes are running the same Piko version.
+
+Nodes that have left the cluster are ignored. Nodes running a Piko version
+that doesn't propagate its version have an 'unknown' version.`,
+	)
+
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		showClusterNodes(c)
+		if skewed := showClusterNodes(c, conf, checkSkew, cmd.OutOrStdout()); skewed {
+			os.Exit(1)
+		}
 	}
 
 	return cmd
@@ -47,17 +71,65 @@ Examples:
 
 type clusterNodesOutput struct {
 	Nodes []*cluster.NodeMetadata `json:"nodes"`
+
+	// VersionSkew is only included when checking for version skew.
+	VersionSkew *versionSkew `json:"version_skew,omitempty"`
+}
+
+// versionSkew contains the Piko versions running in the cluster.
+type versionSkew struct {
+	// Skewed indicates whether nodes are running different versions.
+	Skewed bool `json:"skewed"`
+
+	// Versions contains the IDs of the nodes running each version.
+	Versions map[string][]string `json:"versions"`
+}
+
+// checkVersionSkew returns the versions the given nodes are running,
+// ignoring nodes that have left the cluster.
+func checkVersionSkew(nodes []*cluster.NodeMetadata) *versionSkew {
+	versions := make(map[string][]string)
+	for _, node := range nodes {
+		if node.Status == cluster.NodeStatusLeft {
+			continue
+		}
+		version := node.Version
+		if version == "" {
+			version = "unknown"
+		}
+		versions[version] = append(versions[version], node.ID)
+	}
+	return &versionSkew{
+		Skewed:   len(versions) > 1,
+		Versions: versions,
+	}
 }
 
-func showClusterNodes(c *client.Client) {
+// showClusterNodes writes the cluster nodes. If checkSkew is true, returns
+// whether the nodes are running different versions.
+func showClusterNodes(
+	c *client.Client,
+	conf *config.Config,
+	checkSkew bool,
+	w io.Writer,
+) bool {
 	cluster := client.NewCluster(c)
 
-	nodes, err := cluster.Nodes()
+	nodes, err := cluster.Nodes(context.Background())
 	if err != nil {
 		fmt.Printf("failed to get cluster nodes: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	// Filter by ID.
+	filtered := nodes[:0]
+	for _, node := range nodes {
+		if matchFilter(conf.Filter, node.ID) {
+			filtered = append(filtered, node)
+		}
+	}
+	nodes = filtered
+
 	// Sort by ID.
 	sort.Slice(nodes, func(i, j int) bool {
 		return nodes[i].ID < nodes[j].ID
@@ -66,11 +138,18 @@ func showClusterNodes(c *client.Client) {
 	output := clusterNodesOutput{
 		Nodes: nodes,
 	}
-	b, _ := yaml.Marshal(output)
-	fmt.Print(string(b))
+	if checkSkew {
+		output.VersionSkew = checkVersionSkew(nodes)
+	}
+	if err := writeOutput(w, output, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	return output.VersionSkew != nil && output.VersionSkew.Skewed
 }
 
-func newClusterNodeCommand(c *client.Client) *cobra.Command {
+func newClusterNodeCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "node",
 		Args:  cobra.ExactArgs(1),
@@ -90,21 +169,23 @@ Examples:
 	}
 
 	cmd.Run = func(_ *cobra.Command, args []string) {
-		showClusterNode(args[0], c)
+		showClusterNode(args[0], c, conf, cmd.OutOrStdout())
 	}
 
 	return cmd
 }
 
-func showClusterNode(nodeID string, c *client.Client) {
+func showClusterNode(nodeID string, c *client.Client, conf *config.Config, w io.Writer) {
 	cluster := client.NewCluster(c)
 
-	node, err := cluster.Node(nodeID)
+	node, err := cluster.Node(context.Background(), nodeID)
 	if err != nil {
 		fmt.Printf("failed to get cluster nodes: %s: %s\n", nodeID, err.Error())
 		os.Exit(1)
 	}
 
-	b, _ := yaml.Marshal(node)
-	fmt.Print(string(b))
+	if err := writeOutput(w, node, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
 }
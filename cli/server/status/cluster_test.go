@@ -0,0 +1,95 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
+)
+
+func newFakeClusterServer(t *testing.T, nodes []*cluster.NodeMetadata) *client.Client {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/status/cluster/nodes", r.URL.Path)
+			_ = json.NewEncoder(w).Encode(nodes)
+		},
+	))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return client.NewClient(u)
+}
+
+func TestShowClusterNodes_VersionSkew(t *testing.T) {
+	t.Run("same version", func(t *testing.T) {
+		c := newFakeClusterServer(t, []*cluster.NodeMetadata{
+			{ID: "node-b", Status: cluster.NodeStatusActive, Version: "v0.8.0"},
+			{ID: "node-a", Status: cluster.NodeStatusActive, Version: "v0.8.0"},
+			// Nodes that have left are ignored.
+			{ID: "node-c", Status: cluster.NodeStatusLeft, Version: "v0.7.0"},
+		})
+
+		var buf bytes.Buffer
+		skewed := showClusterNodes(c, &config.Config{Output: "json"}, true, &buf)
+		assert.False(t, skewed)
+
+		var output clusterNodesOutput
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+		assert.Equal(t, &versionSkew{
+			Skewed: false,
+			Versions: map[string][]string{
+				"v0.8.0": {"node-a", "node-b"},
+			},
+		}, output.VersionSkew)
+	})
+
+	t.Run("skewed", func(t *testing.T) {
+		c := newFakeClusterServer(t, []*cluster.NodeMetadata{
+			{ID: "node-a", Status: cluster.NodeStatusActive, Version: "v0.8.0"},
+			{ID: "node-b", Status: cluster.NodeStatusActive, Version: "v0.7.0"},
+			{ID: "node-c", Status: cluster.NodeStatusActive},
+		})
+
+		var buf bytes.Buffer
+		skewed := showClusterNodes(c, &config.Config{Output: "json"}, true, &buf)
+		assert.True(t, skewed)
+
+		var output clusterNodesOutput
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+		assert.Equal(t, &versionSkew{
+			Skewed: true,
+			Versions: map[string][]string{
+				"v0.8.0":  {"node-a"},
+				"v0.7.0":  {"node-b"},
+				"unknown": {"node-c"},
+			},
+		}, output.VersionSkew)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newFakeClusterServer(t, []*cluster.NodeMetadata{
+			{ID: "node-a", Status: cluster.NodeStatusActive, Version: "v0.8.0"},
+			{ID: "node-b", Status: cluster.NodeStatusActive, Version: "v0.7.0"},
+		})
+
+		var buf bytes.Buffer
+		skewed := showClusterNodes(c, &config.Config{Output: "json"}, false, &buf)
+		assert.False(t, skewed)
+
+		var output clusterNodesOutput
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+		assert.Nil(t, output.VersionSkew)
+		require.Len(t, output.Nodes, 2)
+		assert.Equal(t, "v0.8.0", output.Nodes[0].Version)
+	})
+}
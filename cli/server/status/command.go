@@ -20,6 +20,7 @@ func NewCommand() *cobra.Command {
 Each Piko server exposes a status API to inspect the state of the node, this
 can be used to answer questions such as:
 * What upstream listeners are attached to each node?
+* Which upstream connections should be force-disconnected?
 * What cluster state does this node know?
 * What is the gossip state of each known node?
 
@@ -31,6 +32,12 @@ Examples:
 
   # Inspect the known nodes by node cv6cdyo.
   piko server status cluster nodes --forward cv6cdyo
+
+  # Output the known nodes as JSON.
+  piko server status cluster nodes -o json
+
+  # Write the known nodes to a file without writing to stdout.
+  piko server status cluster nodes --output-file status/nodes.yaml --quiet
 `,
 	}
 
@@ -48,11 +55,13 @@ Examples:
 		url, _ := url.Parse(conf.Server.URL)
 		c.SetURL(url)
 		c.SetForward(conf.Forward)
+		c.SetToken(conf.Server.Token)
 	}
 
-	cmd.AddCommand(newUpstreamCommand(c))
-	cmd.AddCommand(newClusterCommand(c))
-	cmd.AddCommand(newGossipCommand(c))
+	cmd.AddCommand(newProxyCommand(c, &conf))
+	cmd.AddCommand(newUpstreamCommand(c, &conf))
+	cmd.AddCommand(newClusterCommand(c, &conf))
+	cmd.AddCommand(newGossipCommand(c, &conf))
 
 	return cmd
 }
@@ -0,0 +1,41 @@
+package status
+
+import (
+	"strings"
+)
+
+// matchFilter returns whether the ID matches the filter pattern.
+//
+// The pattern is case-insensitive and may include '*' wildcards matching any
+// sequence of characters. A pattern without wildcards matches IDs with the
+// pattern as a prefix. An empty pattern matches all IDs.
+func matchFilter(pattern string, id string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	pattern = strings.ToLower(pattern)
+	id = strings.ToLower(id)
+
+	if !strings.Contains(pattern, "*") {
+		return strings.HasPrefix(id, pattern)
+	}
+
+	parts := strings.Split(pattern, "*")
+	// The first part must match the start of the ID.
+	if !strings.HasPrefix(id, parts[0]) {
+		return false
+	}
+	id = id[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(id, part)
+		if i < 0 {
+			return false
+		}
+		id = id[i+len(part):]
+	}
+	// The last part must match the end of the ID.
+	return len(id) >= len(last) && strings.HasSuffix(id, last)
+}
@@ -0,0 +1,40 @@
+package status
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		pattern string
+		id      string
+		match   bool
+	}{
+		{"", "my-endpoint", true},
+		// Prefix.
+		{"my", "my-endpoint", true},
+		{"endpoint", "my-endpoint", false},
+		// Case-insensitive.
+		{"MY-", "my-endpoint", true},
+		{"my-*", "MY-ENDPOINT", true},
+		// Wildcards.
+		{"*", "my-endpoint", true},
+		{"*endpoint", "my-endpoint", true},
+		{"*endpoint", "my-endpoint-2", false},
+		{"my-*-2", "my-endpoint-2", true},
+		{"my-*-2", "my-endpoint-3", false},
+		{"*-end*", "my-endpoint", true},
+		{"a*a", "a", false},
+		{"a*a", "aa", true},
+		// No match.
+		{"foo*", "my-endpoint", false},
+		{"foo", "my-endpoint", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.id, func(t *testing.T) {
+			assert.Equal(t, tt.match, matchFilter(tt.pattern, tt.id))
+		})
+	}
+}
@@ -1,30 +1,32 @@
 package status
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 
-	yaml "github.com/goccy/go-yaml"
 	"github.com/spf13/cobra"
 
 	"github.com/andydunstall/piko/pkg/gossip"
 	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
 )
 
-func newGossipCommand(c *client.Client) *cobra.Command {
+func newGossipCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "gossip",
 		Short: "inspect gossip state",
 	}
 
-	cmd.AddCommand(newGossipNodesCommand(c))
-	cmd.AddCommand(newGossipNodeCommand(c))
+	cmd.AddCommand(newGossipNodesCommand(c, conf))
+	cmd.AddCommand(newGossipNodeCommand(c, conf))
 
 	return cmd
 }
 
-func newGossipNodesCommand(c *client.Client) *cobra.Command {
+func newGossipNodesCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "nodes",
 		Short: "inspect gossip nodes",
@@ -39,7 +41,7 @@ Examples:
 	}
 
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		showGossipNodes(c)
+		showGossipNodes(c, conf, cmd.OutOrStdout())
 	}
 
 	return cmd
@@ -49,15 +51,24 @@ type gossipNodesOutput struct {
 	Nodes []gossip.NodeMetadata `json:"nodes"`
 }
 
-func showGossipNodes(c *client.Client) {
+func showGossipNodes(c *client.Client, conf *config.Config, w io.Writer) {
 	gossip := client.NewGossip(c)
 
-	nodes, err := gossip.Nodes()
+	nodes, err := gossip.Nodes(context.Background())
 	if err != nil {
 		fmt.Printf("failed to get gossip nodes: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	// Filter by ID.
+	filtered := nodes[:0]
+	for _, node := range nodes {
+		if matchFilter(conf.Filter, node.ID) {
+			filtered = append(filtered, node)
+		}
+	}
+	nodes = filtered
+
 	// Sort by ID.
 	sort.Slice(nodes, func(i, j int) bool {
 		return nodes[i].ID < nodes[j].ID
@@ -66,11 +77,13 @@ func showGossipNodes(c *client.Client) {
 	output := gossipNodesOutput{
 		Nodes: nodes,
 	}
-	b, _ := yaml.Marshal(output)
-	fmt.Println(string(b))
+	if err := writeOutput(w, output, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
 }
 
-func newGossipNodeCommand(c *client.Client) *cobra.Command {
+func newGossipNodeCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "node",
 		Args:  cobra.ExactArgs(1),
@@ -85,21 +98,23 @@ Examples:
 	}
 
 	cmd.Run = func(_ *cobra.Command, args []string) {
-		showGossipNode(args[0], c)
+		showGossipNode(args[0], c, conf, cmd.OutOrStdout())
 	}
 
 	return cmd
 }
 
-func showGossipNode(nodeID string, c *client.Client) {
+func showGossipNode(nodeID string, c *client.Client, conf *config.Config, w io.Writer) {
 	gossip := client.NewGossip(c)
 
-	node, err := gossip.Node(nodeID)
+	node, err := gossip.Node(context.Background(), nodeID)
 	if err != nil {
 		fmt.Printf("failed to get gossip node: %s: %s\n", nodeID, err.Error())
 		os.Exit(1)
 	}
 
-	b, _ := yaml.Marshal(node)
-	fmt.Println(string(b))
+	if err := writeOutput(w, node, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
 }
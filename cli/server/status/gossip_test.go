@@ -0,0 +1,121 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
+)
+
+func newFakeStatusServer(t *testing.T, nodes []gossip.NodeMetadata) *client.Client {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/status/gossip/nodes", r.URL.Path)
+			_ = json.NewEncoder(w).Encode(nodes)
+		},
+	))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return client.NewClient(u)
+}
+
+func TestShowGossipNodes(t *testing.T) {
+	nodes := []gossip.NodeMetadata{
+		{ID: "node-b", Addr: "10.26.104.2:8003", Version: 2},
+		{ID: "node-a", Addr: "10.26.104.1:8003", Version: 1},
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		c := newFakeStatusServer(t, nodes)
+
+		var buf bytes.Buffer
+		showGossipNodes(c, &config.Config{Output: "yaml"}, &buf)
+
+		out := buf.String()
+		assert.Contains(t, out, "nodes:")
+		assert.Contains(t, out, "id: node-a")
+		// Nodes are sorted by ID.
+		assert.Less(t, strings.Index(out, "node-a"), strings.Index(out, "node-b"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		c := newFakeStatusServer(t, nodes)
+
+		var buf bytes.Buffer
+		showGossipNodes(c, &config.Config{Output: "json"}, &buf)
+
+		// Pretty-printed by default.
+		assert.Contains(t, buf.String(), "\n  \"nodes\": [")
+
+		var output gossipNodesOutput
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+		require.Len(t, output.Nodes, 2)
+		assert.Equal(t, "node-a", output.Nodes[0].ID)
+		assert.Equal(t, "10.26.104.1:8003", output.Nodes[0].Addr)
+		assert.Equal(t, "node-b", output.Nodes[1].ID)
+	})
+
+	t.Run("json compact", func(t *testing.T) {
+		c := newFakeStatusServer(t, nodes)
+
+		var buf bytes.Buffer
+		showGossipNodes(c, &config.Config{Output: "json", Compact: true}, &buf)
+
+		assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+		var output gossipNodesOutput
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+		assert.Len(t, output.Nodes, 2)
+	})
+}
+
+func TestShowGossipNodes_Filter(t *testing.T) {
+	nodes := []gossip.NodeMetadata{
+		{ID: "eu-node-b"},
+		{ID: "us-node-a"},
+		{ID: "eu-node-a"},
+	}
+
+	tests := []struct {
+		filter string
+		ids    []string
+	}{
+		{"", []string{"eu-node-a", "eu-node-b", "us-node-a"}},
+		{"eu", []string{"eu-node-a", "eu-node-b"}},
+		{"*-A", []string{"eu-node-a", "us-node-a"}},
+		{"us-*", []string{"us-node-a"}},
+		{"ap-*", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			c := newFakeStatusServer(t, nodes)
+
+			var buf bytes.Buffer
+			showGossipNodes(c, &config.Config{
+				Output: "json",
+				Filter: tt.filter,
+			}, &buf)
+
+			var output gossipNodesOutput
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &output))
+
+			ids := []string{}
+			for _, node := range output.Nodes {
+				ids = append(ids, node.ID)
+			}
+			assert.Equal(t, tt.ids, ids)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	yaml "github.com/goccy/go-yaml"
+
+	"github.com/andydunstall/piko/server/status/config"
+)
+
+// writeOutput writes v to w in the configured output format.
+//
+// If an output file is configured, the output is also written to the file,
+// or only to the file if quiet is set.
+func writeOutput(w io.Writer, v interface{}, conf *config.Config) error {
+	var b []byte
+	var err error
+	switch {
+	case conf.Output == "json" && conf.Compact:
+		b, err = json.Marshal(v)
+		b = append(b, '\n')
+	case conf.Output == "json":
+		b, err = json.MarshalIndent(v, "", "  ")
+		b = append(b, '\n')
+	default:
+		b, err = yaml.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if conf.OutputFile != "" {
+		if err := writeOutputFile(conf.OutputFile, b); err != nil {
+			return fmt.Errorf("output file: %s: %w", conf.OutputFile, err)
+		}
+		if conf.Quiet {
+			return nil
+		}
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// writeOutputFile writes b to the file at path, creating any missing parent
+// directories.
+func writeOutputFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package status
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/status/config"
+)
+
+func TestWriteOutput_File(t *testing.T) {
+	v := map[string]int{"my-endpoint": 2}
+
+	t.Run("yaml", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bundle", "endpoints.yaml")
+
+		var buf bytes.Buffer
+		require.NoError(t, writeOutput(&buf, v, &config.Config{
+			Output:     "yaml",
+			OutputFile: path,
+		}))
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "my-endpoint: 2\n", string(b))
+		// Still written to stdout.
+		assert.Equal(t, "my-endpoint: 2\n", buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "bundle", "endpoints.json")
+
+		var buf bytes.Buffer
+		require.NoError(t, writeOutput(&buf, v, &config.Config{
+			Output:     "json",
+			OutputFile: path,
+		}))
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "{\n  \"my-endpoint\": 2\n}\n", string(b))
+		assert.Equal(t, string(b), buf.String())
+	})
+
+	t.Run("quiet", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "endpoints.json")
+
+		var buf bytes.Buffer
+		require.NoError(t, writeOutput(&buf, v, &config.Config{
+			Output:     "json",
+			Compact:    true,
+			OutputFile: path,
+			Quiet:      true,
+		}))
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "{\"my-endpoint\":2}\n", string(b))
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		dir := t.TempDir()
+		// The parent is a file so the directory can't be created.
+		parent := filepath.Join(dir, "file")
+		require.NoError(t, os.WriteFile(parent, nil, 0o644))
+		path := filepath.Join(parent, "endpoints.json")
+
+		var buf bytes.Buffer
+		err := writeOutput(&buf, v, &config.Config{
+			Output:     "json",
+			OutputFile: path,
+		})
+		assert.ErrorContains(t, err, "output file: "+path)
+		assert.Empty(t, buf.String())
+	})
+}
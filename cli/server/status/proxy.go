@@ -0,0 +1,201 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
+)
+
+func newProxyCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "inspect and manage the proxy",
+	}
+
+	cmd.AddCommand(newProxyMaintenanceCommand(c, conf))
+	cmd.AddCommand(newProxyEndpointCommand(c, conf))
+	cmd.AddCommand(newProxyInflightCommand(c, conf))
+
+	return cmd
+}
+
+func newProxyMaintenanceCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "maintenance [enable|disable]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "inspect or toggle maintenance mode",
+		Long: `Inspect or toggle maintenance mode.
+
+When maintenance mode is enabled, the node rejects all proxy requests with a
+'503 Service Unavailable' response and a 'Retry-After' header, and reports
+not ready on '/health/ready' so load balancers remove the node from rotation.
+The admin endpoints remain available.
+
+Maintenance mode can be disabled without restarting the node.
+
+Examples:
+  # Inspect whether the node is in maintenance mode.
+  piko server status proxy maintenance
+
+  # Enable maintenance mode.
+  piko server status proxy maintenance enable
+
+  # Disable maintenance mode.
+  piko server status proxy maintenance disable
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		if len(args) == 0 {
+			showProxyMaintenance(c, conf, cmd.OutOrStdout())
+			return
+		}
+
+		switch args[0] {
+		case "enable":
+			setProxyMaintenance(c, true)
+		case "disable":
+			setProxyMaintenance(c, false)
+		default:
+			fmt.Printf("unsupported argument: %s\n", args[0])
+			os.Exit(1)
+		}
+		showProxyMaintenance(c, conf, cmd.OutOrStdout())
+	}
+
+	return cmd
+}
+
+func showProxyMaintenance(c *client.Client, conf *config.Config, w io.Writer) {
+	proxy := client.NewProxy(c)
+
+	enabled, err := proxy.Maintenance(context.Background())
+	if err != nil {
+		fmt.Printf("failed to get maintenance mode: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	out := struct {
+		Enabled bool `json:"enabled"`
+	}{
+		Enabled: enabled,
+	}
+	if err := writeOutput(w, out, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func setProxyMaintenance(c *client.Client, enabled bool) {
+	proxy := client.NewProxy(c)
+
+	if err := proxy.SetMaintenance(context.Background(), enabled); err != nil {
+		fmt.Printf("failed to set maintenance mode: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func newProxyEndpointCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "endpoint",
+		Args:  cobra.ExactArgs(1),
+		Short: "inspect which nodes an endpoint is connected to",
+		Long: `Inspect which nodes an endpoint is connected to.
+
+Queries the server for all nodes in the cluster that have listeners for the
+endpoint with the given ID, including the queried node itself. The output
+contains each nodes ID, proxy address, status and number of listeners.
+
+Nodes that aren't active or whose endpoint has expired are included, though
+the server doesn't forward requests to them, which is useful to diagnose why
+requests are routed to a particular node.
+
+Examples:
+  # Inspect the nodes endpoint my-endpoint is connected to.
+  piko server status proxy endpoint my-endpoint
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		showProxyEndpoint(args[0], c, conf, cmd.OutOrStdout())
+	}
+
+	return cmd
+}
+
+type proxyEndpointOutput struct {
+	EndpointID string                     `json:"endpoint_id"`
+	Nodes      []cluster.EndpointLocation `json:"nodes"`
+}
+
+func showProxyEndpoint(endpointID string, c *client.Client, conf *config.Config, w io.Writer) {
+	cluster := client.NewCluster(c)
+
+	nodes, err := cluster.EndpointNodes(context.Background(), endpointID)
+	if err != nil {
+		fmt.Printf("failed to get endpoint nodes: %s: %s\n", endpointID, err.Error())
+		os.Exit(1)
+	}
+
+	output := proxyEndpointOutput{
+		EndpointID: endpointID,
+		Nodes:      nodes,
+	}
+	if err := writeOutput(w, output, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func newProxyInflightCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inflight",
+		Args:  cobra.NoArgs,
+		Short: "inspect in-flight proxy requests",
+		Long: `Inspect in-flight proxy requests.
+
+Queries the server for the proxy requests it is currently processing, ordered
+from oldest to newest. The output contains each requests endpoint ID, method,
+path, age, whether the request is forwarded to a remote node, and the upstream
+address.
+
+The server tracks up to 10,000 in-flight requests. Requests beyond the limit
+are included in the 'untracked' count.
+
+Examples:
+  # Inspect the in-flight requests.
+  piko server status proxy inflight
+
+  # Inspect the in-flight requests on node cv6cdyo.
+  piko server status proxy inflight --forward cv6cdyo
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showProxyInflight(c, conf, cmd.OutOrStdout())
+	}
+
+	return cmd
+}
+
+func showProxyInflight(c *client.Client, conf *config.Config, w io.Writer) {
+	proxy := client.NewProxy(c)
+
+	status, err := proxy.Inflight(context.Background())
+	if err != nil {
+		fmt.Printf("failed to get inflight requests: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := writeOutput(w, status, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -1,27 +1,32 @@
 package status
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 
-	yaml "github.com/goccy/go-yaml"
 	"github.com/spf13/cobra"
 
+	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status/client"
+	"github.com/andydunstall/piko/server/status/config"
 )
 
-func newUpstreamCommand(c *client.Client) *cobra.Command {
+func newUpstreamCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "upstream",
 		Short: "inspect connected upstreams",
 	}
 
-	cmd.AddCommand(newUpstreamEndpointsCommand(c))
+	cmd.AddCommand(newUpstreamEndpointsCommand(c, conf))
+	cmd.AddCommand(newUpstreamConnectionsCommand(c, conf))
+	cmd.AddCommand(newUpstreamDisconnectCommand(c, conf))
 
 	return cmd
 }
 
-func newUpstreamEndpointsCommand(c *client.Client) *cobra.Command {
+func newUpstreamEndpointsCommand(c *client.Client, conf *config.Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "endpoints",
 		Short: "inspect endpoints",
@@ -29,27 +34,187 @@ func newUpstreamEndpointsCommand(c *client.Client) *cobra.Command {
 
 Queries the server for the number of upstream connections for each endpoint.
 
+By default only includes upstreams connected to the queried node. Use
+'--cluster' to include the endpoints on all nodes in the cluster, as known by
+the queried node, along with the nodes each endpoint is connected to.
+
 Examples:
+  # Inspect the endpoints connected to the node.
   piko server status upstream endpoints
+
+  # Inspect the endpoints connected to all nodes in the cluster.
+  piko server status upstream endpoints --cluster
 `,
 	}
 
+	var clusterWide bool
+	cmd.Flags().BoolVar(
+		&clusterWide,
+		"cluster",
+		false,
+		`
+Whether to include the endpoints connected to all nodes in the cluster rather
+than only the queried node.
+
+Endpoints on nodes the server doesn't forward requests to, such as
+unreachable nodes, are marked as stale and excluded from the endpoints
+listener count.`,
+	)
+
 	cmd.Run = func(_ *cobra.Command, _ []string) {
-		showUpstreamEndpoints(c)
+		if clusterWide {
+			showClusterEndpoints(c, conf, cmd.OutOrStdout())
+			return
+		}
+		showUpstreamEndpoints(c, conf, cmd.OutOrStdout())
 	}
 
 	return cmd
 }
 
-func showUpstreamEndpoints(c *client.Client) {
+func showUpstreamEndpoints(c *client.Client, conf *config.Config, w io.Writer) {
 	upstream := client.NewUpstream(c)
 
-	endpoints, err := upstream.Endpoints()
+	endpoints, err := upstream.Endpoints(context.Background())
 	if err != nil {
 		fmt.Printf("failed to get upstream endpoints: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	b, _ := yaml.Marshal(endpoints)
-	fmt.Print(string(b))
+	for endpointID := range endpoints {
+		if !matchFilter(conf.Filter, endpointID) {
+			delete(endpoints, endpointID)
+		}
+	}
+
+	if err := writeOutput(w, endpoints, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+type clusterEndpointsOutput struct {
+	Endpoints []cluster.Endpoint `json:"endpoints"`
+}
+
+func showClusterEndpoints(c *client.Client, conf *config.Config, w io.Writer) {
+	cluster := client.NewCluster(c)
+
+	endpoints, err := cluster.Endpoints(context.Background())
+	if err != nil {
+		fmt.Printf("failed to get cluster endpoints: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Filter by ID.
+	filtered := endpoints[:0]
+	for _, endpoint := range endpoints {
+		if matchFilter(conf.Filter, endpoint.ID) {
+			filtered = append(filtered, endpoint)
+		}
+	}
+
+	output := clusterEndpointsOutput{
+		Endpoints: filtered,
+	}
+	if err := writeOutput(w, output, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func newUpstreamConnectionsCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "connections",
+		Short: "inspect upstream connections",
+		Long: `Inspect upstream connections.
+
+Queries the server for the upstream connections to the node, including the
+connection ID, endpoint ID and remote address.
+
+Also includes the health of each connection, which the server heartbeats
+periodically: the last measured round-trip time, the time of the last
+successful heartbeat and the number of consecutive missed heartbeats.
+
+Examples:
+  piko server status upstream connections
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, _ []string) {
+		showUpstreamConnections(c, conf, cmd.OutOrStdout())
+	}
+
+	return cmd
+}
+
+func showUpstreamConnections(c *client.Client, conf *config.Config, w io.Writer) {
+	upstream := client.NewUpstream(c)
+
+	conns, err := upstream.Conns(context.Background())
+	if err != nil {
+		fmt.Printf("failed to get upstream connections: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	filtered := conns[:0]
+	for _, conn := range conns {
+		if matchFilter(conf.Filter, conn.EndpointID) {
+			filtered = append(filtered, conn)
+		}
+	}
+
+	if err := writeOutput(w, filtered, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func newUpstreamDisconnectCommand(c *client.Client, conf *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "disconnect [id]",
+		Args:  cobra.ExactArgs(1),
+		Short: "force disconnect an upstream connection",
+		Long: `Force disconnect an upstream connection.
+
+Closes the upstream connection with the given ID, which removes the upstream
+from the node. Use 'piko server status upstream connections' to find the
+connection ID.
+
+Note the upstream may reconnect, so to evict an upstream you should also
+revoke its credentials.
+
+Outputs whether a connection was closed. Disconnecting a connection that is
+already closed or doesn't exist has no effect.
+
+Examples:
+  piko server status upstream disconnect 3f2a9c1e-6b7d-4e8a-9f0c-1d2e3f4a5b6c
+`,
+	}
+
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		disconnectUpstream(c, conf, args[0], cmd.OutOrStdout())
+	}
+
+	return cmd
+}
+
+func disconnectUpstream(c *client.Client, conf *config.Config, id string, w io.Writer) {
+	upstream := client.NewUpstream(c)
+
+	closed, err := upstream.Disconnect(context.Background(), id)
+	if err != nil {
+		fmt.Printf("failed to disconnect upstream: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	out := struct {
+		Closed bool `json:"closed"`
+	}{
+		Closed: closed,
+	}
+	if err := writeOutput(w, out, conf); err != nil {
+		fmt.Printf("failed to write output: %s\n", err.Error())
+		os.Exit(1)
+	}
 }
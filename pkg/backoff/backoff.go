@@ -6,57 +6,86 @@ import (
 	"time"
 )
 
-// Backoff implements exponential backoff with jitter.
+// Backoff implements exponential backoff with full jitter.
 type Backoff struct {
 	// retries is the maximum number of attempts.
 	retries    int
 	minBackoff time.Duration
 	maxBackoff time.Duration
+	multiplier float64
 
 	// attempts is the number of attempts so far.
-	attempts    int
-	lastBackoff time.Duration
+	attempts int
+	// backoff is the current backoff before jitter is applied.
+	backoff time.Duration
 }
 
-// New creates a new backoff.
+// New creates a new backoff, where the backoff starts at 'minBackoff' and
+// is multiplied by 'multiplier' after each attempt up to 'maxBackoff'.
 //
 // Set 'retries' to zero to retry forever.
-func New(retries int, minBackoff time.Duration, maxBackoff time.Duration) *Backoff {
+func New(
+	retries int,
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	multiplier float64,
+) *Backoff {
 	return &Backoff{
 		retries:    retries,
 		minBackoff: minBackoff,
 		maxBackoff: maxBackoff,
+		multiplier: multiplier,
 		attempts:   0,
 	}
 }
 
 // Wait blocks until the next retry. Returns false if the number of retries has
-// been reached so the client should stop.
+// been reached or the context is cancelled so the client should stop.
 func (b *Backoff) Wait(ctx context.Context) bool {
 	if b.retries != 0 && b.attempts > b.retries {
 		return false
 	}
-	b.attempts++
-
-	backoff := b.nextWait()
-	b.lastBackoff = backoff
 
 	select {
-	case <-time.After(b.lastBackoff):
+	case <-time.After(b.Next()):
 		return true
 	case <-ctx.Done():
 		return false
 	}
 }
 
-func (b *Backoff) nextWait() time.Duration {
-	var backoff time.Duration
-	if b.lastBackoff == 0 {
-		backoff = b.minBackoff
+// Next returns the duration to wait before the next attempt.
+//
+// Uses 'full jitter', so the wait is a random duration between zero and the
+// current backoff, which avoids many clients retrying at the same time.
+func (b *Backoff) Next() time.Duration {
+	b.attempts++
+
+	if b.backoff == 0 {
+		b.backoff = b.minBackoff
 	} else {
-		backoff = b.lastBackoff * 2
+		b.backoff = time.Duration(float64(b.backoff) * b.multiplier)
+	}
+	if b.maxBackoff != 0 && b.backoff > b.maxBackoff {
+		b.backoff = b.maxBackoff
 	}
 
-	jitterMultipler := 1.0 + (rand.Float64() * 0.1)
-	return time.Duration(float64(backoff) * jitterMultipler)
+	return time.Duration(rand.Int63n(int64(b.backoff) + 1))
+}
+
+// Reset resets the backoff to the initial state.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.backoff = 0
+}
+
+// Attempts returns the number of attempts since the backoff was created or
+// reset.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Backoff returns the current backoff before jitter is applied.
+func (b *Backoff) Backoff() time.Duration {
+	return b.backoff
 }
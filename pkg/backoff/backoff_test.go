@@ -0,0 +1,86 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Run("grows to max", func(t *testing.T) {
+		b := New(0, time.Millisecond*100, time.Second, 2)
+
+		expected := []time.Duration{
+			time.Millisecond * 100,
+			time.Millisecond * 200,
+			time.Millisecond * 400,
+			time.Millisecond * 800,
+			time.Second,
+			time.Second,
+		}
+		for i, backoff := range expected {
+			wait := b.Next()
+			assert.Equal(t, backoff, b.Backoff())
+			assert.LessOrEqual(t, wait, backoff)
+			assert.Equal(t, i+1, b.Attempts())
+		}
+	})
+
+	t.Run("multiplier", func(t *testing.T) {
+		b := New(0, time.Millisecond*100, time.Second, 1.5)
+
+		b.Next()
+		assert.Equal(t, time.Millisecond*100, b.Backoff())
+		b.Next()
+		assert.Equal(t, time.Millisecond*150, b.Backoff())
+		b.Next()
+		assert.Equal(t, time.Millisecond*225, b.Backoff())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		b := New(0, time.Millisecond*100, time.Second, 2)
+
+		for i := 0; i != 5; i++ {
+			b.Next()
+		}
+		assert.Equal(t, time.Second, b.Backoff())
+
+		b.Reset()
+		assert.Equal(t, 0, b.Attempts())
+
+		assert.LessOrEqual(t, b.Next(), time.Millisecond*100)
+		assert.Equal(t, time.Millisecond*100, b.Backoff())
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		b := New(2, time.Millisecond, time.Millisecond, 2)
+
+		assert.True(t, b.Wait(context.Background()))
+		assert.True(t, b.Wait(context.Background()))
+		assert.True(t, b.Wait(context.Background()))
+		assert.False(t, b.Wait(context.Background()))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		b := New(0, time.Minute, time.Minute, 2)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Use a large backoff to check Wait returns promptly when
+		// cancelled. Note with full jitter the wait may be zero, in which
+		// case either result is possible, so only check it returns.
+		done := make(chan struct{})
+		go func() {
+			b.Wait(ctx)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("wait not cancelled")
+		}
+	})
+}
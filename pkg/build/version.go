@@ -1,4 +1,36 @@
 package build
 
+import (
+	"runtime/debug"
+)
+
 // Version contains the binary version. Set at build time.
 var Version = "unknown"
+
+// Commit contains the VCS commit the binary was built from. Set at build
+// time, otherwise read from the Go build info if available.
+var Commit = ""
+
+// BuildTime contains the time the binary was built (or the commit time when
+// read from the Go build info). Set at build time, otherwise read from the
+// Go build info if available.
+var BuildTime = ""
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if Commit == "" {
+				Commit = setting.Value
+			}
+		case "vcs.time":
+			if BuildTime == "" {
+				BuildTime = setting.Value
+			}
+		}
+	}
+}
@@ -2,35 +2,127 @@ package gossip
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/spf13/pflag"
 )
 
+const (
+	maxFanout = 16
+
+	minSuspicionMultiplier = 2
+	maxSuspicionMultiplier = 1000
+)
+
 type Config struct {
 	// BindAddr is the address to bind to listen for gossip traffic.
 	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
 
 	// AdvertiseAddr is the address to advertise to other nodes.
+	//
+	// This may differ from BindAddr, such as when the node is behind NAT.
+	// The host may be an IP (including IPv6, such as '[::1]:8003') or a
+	// domain name.
 	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
 
+	// ResolveInterval is the interval to re-resolve the advertise addresses
+	// of other nodes that contain a domain name.
+	//
+	// If zero, defaults to 30 seconds.
+	ResolveInterval time.Duration `json:"resolve_interval" yaml:"resolve_interval"`
+
 	// Interval is the rate to initiate a gossip round.
 	Interval time.Duration `json:"interval" yaml:"interval"`
 
 	// MaxPacketSize is the maximum size of any packet sent.
 	MaxPacketSize int `json:"max_packet_size" yaml:"max_packet_size"`
+
+	// Fanout is the number of live nodes to gossip with in each round.
+	//
+	// If zero, defaults to 1.
+	Fanout int `json:"fanout" yaml:"fanout"`
+
+	// SuspicionMultiplier is the number of mean intervals between messages
+	// from a node without hearing from the node before it is considered
+	// unreachable.
+	//
+	// If zero, defaults to 20.
+	SuspicionMultiplier int `json:"suspicion_multiplier" yaml:"suspicion_multiplier"`
+
+	// SyncInterval is the rate to synchronise the full cluster state with
+	// another node using a stream connection.
+	//
+	// Unlike gossip rounds, which are limited to MaxPacketSize, this ensures
+	// large states converge.
+	//
+	// If zero, the state is only synchronised with a stream connection when
+	// joining the cluster.
+	SyncInterval time.Duration `json:"sync_interval" yaml:"sync_interval"`
+
+	// MaxConcurrentSyncs is the maximum number of full state syncs the node
+	// will handle concurrently, including both inbound and outbound syncs.
+	//
+	// If zero, defaults to 1.
+	MaxConcurrentSyncs int `json:"max_concurrent_syncs" yaml:"max_concurrent_syncs"`
+
+	// EncryptionKeys contains base64 encoded AES keys used to encrypt gossip
+	// traffic. The first key is used to encrypt traffic, and all keys are
+	// used to decrypt traffic, which allows keys to be rotated.
+	//
+	// If empty, gossip traffic is not encrypted.
+	EncryptionKeys []string `json:"encryption_keys" yaml:"encryption_keys"`
+
+	// WAN configures gossip with nodes in other datacenters.
+	WAN WANConfig `json:"wan" yaml:"wan"`
 }
 
 func (c *Config) Validate() error {
 	if c.BindAddr == "" {
 		return fmt.Errorf("missing bind addr")
 	}
+	if _, _, err := net.SplitHostPort(c.BindAddr); err != nil {
+		return fmt.Errorf("invalid bind addr: %w", err)
+	}
+	if c.AdvertiseAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid advertise addr: %w", err)
+		}
+	}
+	if c.ResolveInterval < 0 {
+		return fmt.Errorf("resolve interval cannot be negative")
+	}
 	if c.Interval == 0 {
 		return fmt.Errorf("missing interval")
 	}
 	if c.MaxPacketSize == 0 {
 		return fmt.Errorf("missing max packet size")
 	}
+	if c.Fanout < 0 || c.Fanout > maxFanout {
+		return fmt.Errorf("fanout must be between 0 and %d", maxFanout)
+	}
+	if c.SuspicionMultiplier != 0 &&
+		(c.SuspicionMultiplier < minSuspicionMultiplier ||
+			c.SuspicionMultiplier > maxSuspicionMultiplier) {
+		return fmt.Errorf(
+			"suspicion multiplier must be between %d and %d",
+			minSuspicionMultiplier, maxSuspicionMultiplier,
+		)
+	}
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("sync interval cannot be negative")
+	}
+	if c.MaxConcurrentSyncs < 0 {
+		return fmt.Errorf("max concurrent syncs cannot be negative")
+	}
+	for _, key := range c.EncryptionKeys {
+		if _, err := newAEAD(key); err != nil {
+			return fmt.Errorf("encryption keys: %w", err)
+		}
+	}
+	if err := c.WAN.Validate(); err != nil {
+		return fmt.Errorf("wan: %w", err)
+	}
 	return nil
 }
 
@@ -43,7 +135,10 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 The host/port to listen for inter-node gossip traffic.
 
 If the host is unspecified it defaults to all listeners, such as
-'--gossip.bind-addr :8003' will listen on '0.0.0.0:8003'`,
+'--gossip.bind-addr :8003' will listen on '0.0.0.0:8003'.
+
+IPv6 addresses must be enclosed in square brackets, such as
+'--gossip.bind-addr [::1]:8003'.`,
 	)
 
 	fs.StringVar(
@@ -60,7 +155,27 @@ Such as if the listen address is ':8003', the advertised address may be
 By default, if the bind address includes an IP to bind to that will be used.
 If the bind address does not include an IP (such as ':8003') the nodes
 private IP will be used, such as a bind address of ':8003' may have an
-advertise address of '10.26.104.14:8003'.`,
+advertise address of '10.26.104.14:8003'.
+
+The advertise address may differ from the bind address, such as when the node
+is behind NAT or in a container. IPv6 addresses must be enclosed in square
+brackets, such as '[fd00::1]:8003'.
+
+If the advertise address contains a domain name, other nodes periodically
+re-resolve the domain (see '--gossip.resolve-interval'), so the node's IP may
+change without restarting.`,
+	)
+
+	fs.DurationVar(
+		&c.ResolveInterval,
+		"gossip.resolve-interval",
+		c.ResolveInterval,
+		`
+The interval to re-resolve the advertise addresses of other nodes that
+contain a domain name rather than an IP.
+
+Resolved addresses are cached to avoid a DNS lookup for every gossip packet.
+If re-resolving fails, the last resolved address is used.`,
 	)
 
 	fs.DurationVar(
@@ -83,4 +198,81 @@ The maximum size of any packet sent.
 Depending on your networks MTU you may be able to increase to include more data
 in each packet.`,
 	)
+
+	fs.IntVar(
+		&c.Fanout,
+		"gossip.fanout",
+		c.Fanout,
+		`
+The number of live nodes to gossip with in each gossip round.
+
+Increasing the fanout propagates state changes across the cluster faster, at
+the cost of more gossip traffic, as each node sends a packet to each selected
+node every '--gossip.interval'. Small clusters can use a higher fanout for
+faster convergence, though in large clusters the default of 1 is usually
+enough.
+
+Must be between 1 and 16.`,
+	)
+
+	fs.IntVar(
+		&c.SuspicionMultiplier,
+		"gossip.suspicion-multiplier",
+		c.SuspicionMultiplier,
+		`
+The number of mean intervals between messages from a node without hearing
+from the node before the node is considered unreachable.
+
+Such as with a multiplier of 20, if a node is usually heard from every 100ms,
+it is considered unreachable after 2 seconds without hearing from the node.
+
+A lower multiplier detects failed nodes faster, but is more likely to
+consider healthy nodes unreachable due to packet loss or network delays,
+such as in large clusters where nodes are heard from less often. A higher
+multiplier is more stable but takes longer to detect failed nodes.
+
+Must be between 2 and 1000.`,
+	)
+
+	fs.DurationVar(
+		&c.SyncInterval,
+		"gossip.sync-interval",
+		c.SyncInterval,
+		`
+The interval to synchronise the full cluster state with another node using a
+TCP connection.
+
+Gossip rounds are limited to '--gossip.max-packet-size', so synchronising the
+full state ensures large states, such as nodes with many endpoints, converge.
+
+If zero, the full state is only synchronised when joining the cluster.`,
+	)
+
+	fs.IntVar(
+		&c.MaxConcurrentSyncs,
+		"gossip.max-concurrent-syncs",
+		c.MaxConcurrentSyncs,
+		`
+The maximum number of full state synchronisations the node will handle
+concurrently, including both inbound and outbound synchronisations.
+
+Additional synchronisations are rejected to avoid overloading the node.`,
+	)
+
+	fs.StringSliceVar(
+		&c.EncryptionKeys,
+		"gossip.encryption-keys",
+		c.EncryptionKeys,
+		`
+Base64 encoded AES keys used to encrypt gossip traffic between nodes. Each key
+must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256, such as
+generated with 'openssl rand -base64 32'.
+
+The first key is used to encrypt traffic, and all keys are used to decrypt
+traffic. To rotate keys, add the new key as a secondary key to all nodes, then
+make the new key the first key on all nodes, then remove the old key.
+
+If not set, gossip traffic is not encrypted.`,
+	)
+	c.WAN.RegisterFlags(fs)
 }
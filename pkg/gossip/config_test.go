@@ -0,0 +1,79 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		bindAddr      string
+		advertiseAddr string
+		ok            bool
+	}{
+		{":8003", "", true},
+		{":8003", "10.26.104.56:8003", true},
+		{":8003", "node1.cluster:8003", true},
+		{"[::]:8003", "[fd00::1]:8003", true},
+		{"[::1]:8003", "[::1]:8003", true},
+		{"0.0.0.0:8003", "[fd00::1]:9003", true},
+		// IPv6 addresses must be enclosed in square brackets.
+		{"::1:8003", "", false},
+		{":8003", "fd00::1:8003", false},
+		// Missing port.
+		{"10.26.104.56", "", false},
+		{":8003", "node1.cluster", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bindAddr+"/"+tt.advertiseAddr, func(t *testing.T) {
+			conf := &Config{
+				BindAddr:      tt.bindAddr,
+				AdvertiseAddr: tt.advertiseAddr,
+				Interval:      time.Millisecond * 100,
+				MaxPacketSize: 1400,
+			}
+			if tt.ok {
+				assert.NoError(t, conf.Validate())
+			} else {
+				assert.Error(t, conf.Validate())
+			}
+		})
+	}
+}
+
+func TestWANConfig_Validate(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		conf := &WANConfig{}
+		assert.NoError(t, conf.Validate())
+
+		conf.Peers = []string{"10.26.104.56:8004"}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		conf := &WANConfig{
+			BindAddr: ":8004",
+			Peers:    []string{"node1.eu-west-1.cluster:8004"},
+			Cert:     "cert.pem",
+			Key:      "key.pem",
+			CAs:      "cas.pem",
+		}
+		assert.NoError(t, conf.Validate())
+
+		conf.CAs = ""
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("invalid peer", func(t *testing.T) {
+		conf := &WANConfig{
+			BindAddr: ":8004",
+			Peers:    []string{"node1.eu-west-1.cluster"},
+			Cert:     "cert.pem",
+			Key:      "key.pem",
+			CAs:      "cas.pem",
+		}
+		assert.Error(t, conf.Validate())
+	})
+}
@@ -0,0 +1,352 @@
+package gossip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	encryptionVersion uint8 = 0
+
+	// maxFrameSize is the maximum size of a plaintext frame written to an
+	// encrypted stream.
+	maxFrameSize = 1 << 16
+)
+
+var (
+	errDecrypt = errors.New("decrypt: no matching key")
+)
+
+// keyring encrypts and decrypts gossip traffic using AES-GCM.
+//
+// The first key is the primary key, which is used to encrypt traffic. All keys
+// are used to decrypt traffic, so when rotating keys a new key can be added
+// to all nodes, then made primary, then the old key removed.
+type keyring struct {
+	aeads []cipher.AEAD
+}
+
+// newKeyring creates a keyring from the given base64 encoded keys. Each key
+// must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+//
+// If there are no keys, returns nil.
+func newKeyring(keys []string) (*keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var aeads []cipher.AEAD
+	for _, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads = append(aeads, aead)
+	}
+	return &keyring{
+		aeads: aeads,
+	}, nil
+}
+
+// Overhead returns the number of bytes added to a message when encrypted.
+func (k *keyring) Overhead() int {
+	primary := k.aeads[0]
+	return 1 + primary.NonceSize() + primary.Overhead()
+}
+
+// Encrypt encrypts the message with the primary key.
+//
+// The additional data is authenticated but not included in the encrypted
+// message, so the message can only be decrypted with the same additional
+// data.
+//
+// The encrypted message contains the encryption version, the nonce, then
+// the ciphertext.
+func (k *keyring) Encrypt(b []byte, additionalData []byte) ([]byte, error) {
+	primary := k.aeads[0]
+
+	out := make([]byte, 1+primary.NonceSize(), k.Overhead()+len(b))
+	out[0] = encryptionVersion
+	nonce := out[1:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	return primary.Seal(out, nonce, b, additionalData), nil
+}
+
+// Decrypt decrypts the message using each key in the keyring. The
+// additional data must match the data the message was encrypted with.
+func (k *keyring) Decrypt(b []byte, additionalData []byte) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("message too small: %d", len(b))
+	}
+	if b[0] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version: %d", b[0])
+	}
+	b = b[1:]
+
+	for _, aead := range k.aeads {
+		if len(b) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errDecrypt
+}
+
+// encryptedPacketConn is a wrapper for a packet connection that encrypts
+// outgoing packets and decrypts incoming packets.
+//
+// Incoming packets that cannot be decrypted are dropped.
+type encryptedPacketConn struct {
+	net.PacketConn
+
+	keyring *keyring
+
+	readBuf []byte
+
+	metrics *Metrics
+}
+
+func newEncryptedPacketConn(
+	conn net.PacketConn,
+	keyring *keyring,
+	metrics *Metrics,
+) *encryptedPacketConn {
+	return &encryptedPacketConn{
+		PacketConn: conn,
+		keyring:    keyring,
+		// Use the maximum UDP packet size since the configured maximum
+		// packet size may vary between nodes.
+		readBuf: make([]byte, 1<<16),
+		metrics: metrics,
+	}
+}
+
+func (c *encryptedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		plaintext, err := c.keyring.Decrypt(c.readBuf[:n], nil)
+		if err != nil {
+			// Drop packets that can't be decrypted.
+			c.metrics.DecryptErrorsTotal.Inc()
+			continue
+		}
+		return copy(p, plaintext), addr, nil
+	}
+}
+
+func (c *encryptedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	b, err := c.keyring.Encrypt(p, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(b, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// encryptedListener is a wrapper for a listener that encrypts accepted
+// connections.
+type encryptedListener struct {
+	net.Listener
+
+	keyring *keyring
+
+	metrics *Metrics
+}
+
+func newEncryptedListener(
+	ln net.Listener,
+	keyring *keyring,
+	metrics *Metrics,
+) *encryptedListener {
+	return &encryptedListener{
+		Listener: ln,
+		keyring:  keyring,
+		metrics:  metrics,
+	}
+}
+
+func (l *encryptedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedConn(conn, l.keyring, false, l.metrics), nil
+}
+
+// encryptedConn is a wrapper for a stream connection that encrypts written
+// bytes and decrypts read bytes.
+//
+// Each write is sent as one or more frames, where each frame contains a
+// 4 byte length prefix followed by the encrypted frame.
+//
+// Each frame is authenticated with its direction and sequence number in the
+// stream, so frames that are dropped, reordered, replayed or reflected back
+// to the sender fail to decrypt.
+type encryptedConn struct {
+	net.Conn
+
+	keyring *keyring
+
+	// writeDirection and readDirection identify the direction of written
+	// and read frames, which differ depending on which side dialed the
+	// connection.
+	writeDirection uint8
+	readDirection  uint8
+
+	// writeSeq is the sequence number of the next written frame.
+	writeSeq uint64
+	// writeMu protects writeSeq and ensures concurrent writes aren't
+	// interleaved.
+	writeMu sync.Mutex
+
+	// readSeq is the sequence number of the next read frame.
+	readSeq uint64
+	// readBuf contains decrypted bytes that have not yet been read.
+	readBuf []byte
+
+	metrics *Metrics
+}
+
+// newEncryptedConn returns an encrypted connection. dialed indicates whether
+// the local node dialed the connection, which must differ between the two
+// sides of the connection.
+func newEncryptedConn(
+	conn net.Conn,
+	keyring *keyring,
+	dialed bool,
+	metrics *Metrics,
+) *encryptedConn {
+	c := &encryptedConn{
+		Conn:    conn,
+		keyring: keyring,
+		metrics: metrics,
+	}
+	if dialed {
+		c.writeDirection, c.readDirection = 0, 1
+	} else {
+		c.writeDirection, c.readDirection = 1, 0
+	}
+	return c
+}
+
+func (c *encryptedConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *encryptedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		frame := p
+		if len(frame) > maxFrameSize {
+			frame = frame[:maxFrameSize]
+		}
+
+		if err := c.writeFrame(frame); err != nil {
+			return written, err
+		}
+
+		written += len(frame)
+		p = p[len(frame):]
+	}
+	return written, nil
+}
+
+func (c *encryptedConn) readFrame() error {
+	var size [4]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return err
+	}
+	frameSize := binary.BigEndian.Uint32(size[:])
+	if frameSize > uint32(maxFrameSize+c.keyring.Overhead()) {
+		return fmt.Errorf("frame too large: %d", frameSize)
+	}
+
+	frame := make([]byte, frameSize)
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return err
+	}
+
+	plaintext, err := c.keyring.Decrypt(
+		frame, frameAdditionalData(c.readDirection, c.readSeq),
+	)
+	if err != nil {
+		c.metrics.DecryptErrorsTotal.Inc()
+		return err
+	}
+	c.readSeq++
+	c.readBuf = plaintext
+	return nil
+}
+
+func (c *encryptedConn) writeFrame(p []byte) error {
+	ciphertext, err := c.keyring.Encrypt(
+		p, frameAdditionalData(c.writeDirection, c.writeSeq),
+	)
+	if err != nil {
+		return err
+	}
+	c.writeSeq++
+
+	frame := make([]byte, 4, 4+len(ciphertext))
+	binary.BigEndian.PutUint32(frame, uint32(len(ciphertext)))
+	frame = append(frame, ciphertext...)
+
+	_, err = c.Conn.Write(frame)
+	return err
+}
+
+// frameAdditionalData returns the additional data to authenticate a stream
+// frame, containing the frame direction and sequence number.
+func frameAdditionalData(direction uint8, seq uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = direction
+	binary.BigEndian.PutUint64(b[1:], seq)
+	return b
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key: invalid base64: %w", err)
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,338 @@
+package gossip
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	t.Run("encrypt", func(t *testing.T) {
+		keyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+
+		b, err := keyring.Encrypt([]byte("foo"), nil)
+		require.NoError(t, err)
+		assert.NotContains(t, string(b), "foo")
+		assert.Equal(t, len("foo")+keyring.Overhead(), len(b))
+
+		plaintext, err := keyring.Decrypt(b, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), plaintext)
+	})
+
+	t.Run("key sizes", func(t *testing.T) {
+		for _, size := range []int{16, 24, 32} {
+			keyring, err := newKeyring([]string{testKey(t, size)})
+			require.NoError(t, err)
+
+			b, err := keyring.Encrypt([]byte("foo"), nil)
+			require.NoError(t, err)
+			plaintext, err := keyring.Decrypt(b, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("foo"), plaintext)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		oldKey := testKey(t, 32)
+		newKey := testKey(t, 32)
+
+		oldKeyring, err := newKeyring([]string{oldKey})
+		require.NoError(t, err)
+		// Add the new key as a secondary key.
+		addedKeyring, err := newKeyring([]string{oldKey, newKey})
+		require.NoError(t, err)
+		// Make the new key primary.
+		rotatedKeyring, err := newKeyring([]string{newKey, oldKey})
+		require.NoError(t, err)
+
+		// Nodes with the old primary key can decrypt messages from nodes
+		// with the new primary key and vice versa.
+		b, err := oldKeyring.Encrypt([]byte("foo"), nil)
+		require.NoError(t, err)
+		plaintext, err := rotatedKeyring.Decrypt(b, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), plaintext)
+
+		b, err = rotatedKeyring.Encrypt([]byte("bar"), nil)
+		require.NoError(t, err)
+		plaintext, err = addedKeyring.Decrypt(b, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("bar"), plaintext)
+
+		// Nodes that don't have the new key can't decrypt messages
+		// encrypted with the new key.
+		_, err = oldKeyring.Decrypt(b, nil)
+		assert.ErrorIs(t, err, errDecrypt)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		keyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+		unknownKeyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+
+		b, err := unknownKeyring.Encrypt([]byte("foo"), nil)
+		require.NoError(t, err)
+
+		_, err = keyring.Decrypt(b, nil)
+		assert.ErrorIs(t, err, errDecrypt)
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		keyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+
+		b, err := keyring.Encrypt([]byte("foo"), nil)
+		require.NoError(t, err)
+		b[len(b)-1] ^= 0xff
+
+		_, err = keyring.Decrypt(b, nil)
+		assert.ErrorIs(t, err, errDecrypt)
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		keyring, err := newKeyring(nil)
+		require.NoError(t, err)
+		assert.Nil(t, keyring)
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := newKeyring([]string{"invalid"})
+		assert.Error(t, err)
+
+		_, err = newKeyring([]string{testKey(t, 20)})
+		assert.Error(t, err)
+	})
+}
+
+func TestEncryptedPacketConn(t *testing.T) {
+	key := testKey(t, 32)
+
+	t.Run("encrypt", func(t *testing.T) {
+		keyring, err := newKeyring([]string{key})
+		require.NoError(t, err)
+
+		metrics := newMetrics()
+		conn1 := newEncryptedPacketConn(testPacketConn(t), keyring, metrics)
+		defer conn1.Close()
+		conn2 := newEncryptedPacketConn(testPacketConn(t), keyring, metrics)
+		defer conn2.Close()
+
+		_, err = conn1.WriteTo([]byte("foo"), conn2.LocalAddr())
+		require.NoError(t, err)
+
+		buf := make([]byte, 1024)
+		n, addr, err := conn2.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), buf[:n])
+		assert.Equal(t, conn1.LocalAddr().String(), addr.String())
+	})
+
+	t.Run("drop undecryptable", func(t *testing.T) {
+		keyring, err := newKeyring([]string{key})
+		require.NoError(t, err)
+		unknownKeyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+
+		metrics := newMetrics()
+		conn := newEncryptedPacketConn(testPacketConn(t), keyring, metrics)
+		defer conn.Close()
+
+		unknownConn := newEncryptedPacketConn(
+			testPacketConn(t), unknownKeyring, newMetrics(),
+		)
+		defer unknownConn.Close()
+		plaintextConn := testPacketConn(t)
+		defer plaintextConn.Close()
+		validConn := newEncryptedPacketConn(testPacketConn(t), keyring, newMetrics())
+		defer validConn.Close()
+
+		// Send packets encrypted with an unknown key and unencrypted
+		// packets, which should be dropped, followed by a valid packet.
+		_, err = unknownConn.WriteTo([]byte("foo"), conn.LocalAddr())
+		require.NoError(t, err)
+		_, err = plaintextConn.WriteTo([]byte("bar"), conn.LocalAddr())
+		require.NoError(t, err)
+		_, err = validConn.WriteTo([]byte("car"), conn.LocalAddr())
+		require.NoError(t, err)
+
+		buf := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("car"), buf[:n])
+
+		assert.Equal(t, 2.0, promtestutil.ToFloat64(metrics.DecryptErrorsTotal))
+	})
+}
+
+func TestEncryptedConn(t *testing.T) {
+	key := testKey(t, 32)
+
+	t.Run("encrypt", func(t *testing.T) {
+		keyring, err := newKeyring([]string{key})
+		require.NoError(t, err)
+
+		c1, c2 := net.Pipe()
+		conn1 := newEncryptedConn(c1, keyring, true, newMetrics())
+		defer conn1.Close()
+		conn2 := newEncryptedConn(c2, keyring, false, newMetrics())
+		defer conn2.Close()
+
+		// Write a message larger than the maximum frame size.
+		msg := make([]byte, maxFrameSize*2+10)
+		_, err = rand.Read(msg)
+		require.NoError(t, err)
+
+		go func() {
+			_, err := conn1.Write(msg)
+			assert.NoError(t, err)
+		}()
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn2, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, buf)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		keyring, err := newKeyring([]string{key})
+		require.NoError(t, err)
+		unknownKeyring, err := newKeyring([]string{testKey(t, 32)})
+		require.NoError(t, err)
+
+		metrics := newMetrics()
+		c1, c2 := net.Pipe()
+		conn1 := newEncryptedConn(c1, unknownKeyring, true, newMetrics())
+		defer conn1.Close()
+		conn2 := newEncryptedConn(c2, keyring, false, metrics)
+		defer conn2.Close()
+
+		go func() {
+			_, _ = conn1.Write([]byte("foo"))
+		}()
+
+		_ = conn2.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		_, err = conn2.Read(buf)
+		assert.ErrorIs(t, err, errDecrypt)
+
+		assert.Equal(t, 1.0, promtestutil.ToFloat64(metrics.DecryptErrorsTotal))
+	})
+
+	t.Run("modified frames", func(t *testing.T) {
+		keyring, err := newKeyring([]string{key})
+		require.NoError(t, err)
+
+		// Record the frames written by the dialer.
+		recorder := &frameRecorder{}
+		writer := newEncryptedConn(recorder, keyring, true, newMetrics())
+		for _, msg := range []string{"foo", "bar"} {
+			_, err := writer.Write([]byte(msg))
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, len(recorder.frames))
+
+		tests := []struct {
+			name   string
+			frames [][]byte
+			dialed bool
+			// reads contains the expected messages read before the
+			// frame that fails to decrypt.
+			reads []string
+		}{
+			{
+				name:   "ok",
+				frames: recorder.frames,
+				reads:  []string{"foo", "bar"},
+			},
+			{
+				name:   "reordered",
+				frames: [][]byte{recorder.frames[1], recorder.frames[0]},
+			},
+			{
+				name:   "dropped",
+				frames: [][]byte{recorder.frames[1]},
+			},
+			{
+				name: "replayed",
+				frames: [][]byte{
+					recorder.frames[0], recorder.frames[0],
+				},
+				reads: []string{"foo"},
+			},
+			{
+				// Frames written by the dialer are reflected back to
+				// the dialer.
+				name:   "reflected",
+				frames: recorder.frames,
+				dialed: true,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				metrics := newMetrics()
+				c1, c2 := net.Pipe()
+				defer c1.Close()
+				conn := newEncryptedConn(c2, keyring, tt.dialed, metrics)
+				defer conn.Close()
+
+				go func() {
+					for _, frame := range tt.frames {
+						if _, err := c1.Write(frame); err != nil {
+							return
+						}
+					}
+				}()
+
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 1024)
+				for _, msg := range tt.reads {
+					n, err := conn.Read(buf)
+					require.NoError(t, err)
+					assert.Equal(t, msg, string(buf[:n]))
+				}
+				if len(tt.reads) == len(tt.frames) {
+					return
+				}
+
+				_, err = conn.Read(buf)
+				assert.ErrorIs(t, err, errDecrypt)
+				assert.Equal(t, 1.0, promtestutil.ToFloat64(metrics.DecryptErrorsTotal))
+			})
+		}
+	})
+}
+
+// frameRecorder is a connection that records each write.
+type frameRecorder struct {
+	net.Conn
+
+	frames [][]byte
+}
+
+func (r *frameRecorder) Write(b []byte) (int, error) {
+	r.frames = append(r.frames, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func testKey(t *testing.T, size int) string {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func testPacketConn(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return conn
+}
@@ -3,6 +3,7 @@ package gossip
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -12,6 +13,7 @@ import (
 
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -19,8 +21,10 @@ import (
 const (
 	streamTimeout = time.Second * 10
 
-	suspicionThreshold = 20
-	compactThreshold   = 100
+	defaultFanout              = 1
+	defaultSuspicionMultiplier = 20
+	defaultResolveInterval     = time.Second * 30
+	compactThreshold           = 100
 )
 
 type Gossip struct {
@@ -31,9 +35,34 @@ type Gossip struct {
 	streamListener *streamListener
 	packetListener *packetListener
 
+	// wanListener accepts WAN gossip connections. Nil unless ServeWAN is
+	// called.
+	wanListener atomic.Pointer[streamListener]
+	// wanTLSConfig secures WAN gossip connections.
+	wanTLSConfig *tls.Config
+
 	dialer     *net.Dialer
 	packetConn net.PacketConn
 
+	// resolver resolves the advertised addresses of other nodes when
+	// sending packets.
+	resolver *resolver
+
+	// keyring encrypts gossip traffic. If nil traffic is not encrypted.
+	keyring *keyring
+
+	// maxPacketSize is the maximum size of a packet before it is encrypted.
+	maxPacketSize int
+
+	// fanout is the number of live nodes to gossip with in each round.
+	fanout int
+	// suspicionMultiplier is the suspicion level at which a node is
+	// considered unreachable.
+	suspicionMultiplier int
+
+	// syncs limits the number of concurrent full state syncs.
+	syncs *semaphore.Weighted
+
 	metrics *Metrics
 
 	logger log.Logger
@@ -61,6 +90,20 @@ func New(
 
 	metrics := newMetrics()
 
+	keyring, err := newKeyring(config.EncryptionKeys)
+	if err != nil {
+		// We've already verified the keys on boot so don't need to handle
+		// the error.
+		panic("invalid encryption keys: " + err.Error())
+	}
+	maxPacketSize := config.MaxPacketSize
+	if keyring != nil {
+		streamLn = newEncryptedListener(streamLn, keyring, metrics)
+		packetLn = newEncryptedPacketConn(packetLn, keyring, metrics)
+		// Leave space for the encryption overhead.
+		maxPacketSize -= keyring.Overhead()
+	}
+
 	failureDetector := newAccrualFailureDetector(
 		config.Interval*2, 50,
 	)
@@ -72,13 +115,34 @@ func New(
 		watcher,
 	)
 
+	maxConcurrentSyncs := config.MaxConcurrentSyncs
+	if maxConcurrentSyncs == 0 {
+		maxConcurrentSyncs = 1
+	}
+	syncs := semaphore.NewWeighted(int64(maxConcurrentSyncs))
+
+	fanout := config.Fanout
+	if fanout == 0 {
+		fanout = defaultFanout
+	}
+	suspicionMultiplier := config.SuspicionMultiplier
+	if suspicionMultiplier == 0 {
+		suspicionMultiplier = defaultSuspicionMultiplier
+	}
+
+	resolveInterval := config.ResolveInterval
+	if resolveInterval == 0 {
+		resolveInterval = defaultResolveInterval
+	}
+	resolver := newResolver(resolveInterval)
+
 	streamListener := newStreamListener(
-		streamLn, state, streamTimeout, metrics, logger,
+		streamLn, state, streamTimeout, syncs, metrics, logger,
 	)
 	go streamListener.Serve()
 
 	packetListener := newPacketListener(
-		packetLn, state, failureDetector, config.MaxPacketSize, metrics, logger,
+		packetLn, state, failureDetector, resolver, maxPacketSize, metrics, logger,
 	)
 	go packetListener.Serve()
 
@@ -90,11 +154,17 @@ func New(
 		dialer: &net.Dialer{
 			Timeout: streamTimeout,
 		},
-		packetConn: packetLn,
-		metrics:    metrics,
-		logger:     logger,
-		closed:     atomic.NewBool(false),
-		shutdownCh: make(chan struct{}),
+		packetConn:          packetLn,
+		resolver:            resolver,
+		keyring:             keyring,
+		maxPacketSize:       maxPacketSize,
+		fanout:              fanout,
+		suspicionMultiplier: suspicionMultiplier,
+		syncs:               syncs,
+		metrics:             metrics,
+		logger:              logger,
+		closed:              atomic.NewBool(false),
+		shutdownCh:          make(chan struct{}),
 	}
 	gossip.schedule()
 	return gossip
@@ -216,7 +286,7 @@ func (g *Gossip) Leave() error {
 			continue
 		}
 
-		if err := g.leave(node.Addr); err != nil {
+		if err := g.sendLocal(node.Addr); err != nil {
 			g.logger.Warn(
 				"failed to send leave to node",
 				zap.String("node-id", node.ID),
@@ -246,6 +316,44 @@ func (g *Gossip) Leave() error {
 	return lastLeaveErr
 }
 
+// Propagate sends the local state to up to 3 known live nodes and waits for
+// them to acknowledge, rather than waiting for the local state to be
+// propagated by gossip.
+//
+// Returns an error if no known members could be notified.
+func (g *Gossip) Propagate() error {
+	liveNodes := g.state.LiveNodes()
+	rand.Shuffle(len(liveNodes), func(i, j int) {
+		liveNodes[i], liveNodes[j] = liveNodes[j], liveNodes[i]
+	})
+
+	notified := 0
+	var lastErr error
+	for _, node := range liveNodes {
+		if err := g.sendLocal(node.Addr); err != nil {
+			g.logger.Warn(
+				"failed to send local state to node",
+				zap.String("node-id", node.ID),
+				zap.Error(err),
+			)
+			lastErr = err
+			continue
+		}
+
+		notified++
+		if notified == 3 {
+			// If we've notified 3 nodes thats enough to be confident the
+			// update will be propagated.
+			return nil
+		}
+	}
+
+	if notified > 0 {
+		return nil
+	}
+	return lastErr
+}
+
 func (g *Gossip) Metrics() *Metrics {
 	return g.metrics
 }
@@ -269,6 +377,11 @@ func (g *Gossip) Close() error {
 	if err := g.packetListener.Close(); err != nil {
 		errs = errors.Join(errs, err)
 	}
+	if wanListener := g.wanListener.Load(); wanListener != nil {
+		if err := wanListener.Close(); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
 	return errs
 }
 
@@ -280,7 +393,7 @@ func (g *Gossip) schedule() {
 		}
 	})
 	go g.scheduleFunc(g.config.Interval, func() {
-		g.state.UpdateLiveness(float64(suspicionThreshold))
+		g.state.UpdateLiveness(float64(g.suspicionMultiplier))
 	})
 	go g.scheduleFunc(g.config.Interval*10, func() {
 		g.state.CompactLocal(compactThreshold)
@@ -288,6 +401,13 @@ func (g *Gossip) schedule() {
 	go g.scheduleFunc(g.config.Interval*10, func() {
 		g.state.RemoveExpired()
 	})
+	if g.config.SyncInterval > 0 {
+		go g.scheduleFunc(g.config.SyncInterval, func() {
+			if err := g.syncRound(); err != nil {
+				g.logger.Warn("sync round failed", zap.Error(err))
+			}
+		})
+	}
 }
 
 func (g *Gossip) scheduleFunc(interval time.Duration, f func()) {
@@ -314,14 +434,23 @@ func (g *Gossip) scheduleFunc(interval time.Duration, f func()) {
 
 // gossipRound initiates a round of gossip.
 func (g *Gossip) gossipRound() error {
-	// Select a random live node to gossip with.
+	// Select 'fanout' random live nodes to gossip with.
 	nodes := g.state.LiveNodes()
-	if len(nodes) > 0 {
-		node := nodes[rand.Int()%len(nodes)]
+	rand.Shuffle(len(nodes), func(i, j int) {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	})
+	if len(nodes) > g.fanout {
+		nodes = nodes[:g.fanout]
+	}
+	var errs error
+	for _, node := range nodes {
 		if err := g.gossip(node); err != nil {
-			return fmt.Errorf("gossip: %s: %w", node.ID, err)
+			errs = errors.Join(errs, fmt.Errorf("gossip: %s: %w", node.ID, err))
 		}
 	}
+	if errs != nil {
+		return errs
+	}
 
 	// Select a random unreachable node to gossip with.
 	//
@@ -339,6 +468,27 @@ func (g *Gossip) gossipRound() error {
 	return nil
 }
 
+// syncRound synchronises the full cluster state with a random live node.
+func (g *Gossip) syncRound() error {
+	nodes := g.state.LiveNodes()
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	// Skip the round if we're already handling the maximum number of syncs.
+	if !g.syncs.TryAcquire(1) {
+		g.logger.Debug("sync round skipped: too many concurrent syncs")
+		return nil
+	}
+	defer g.syncs.Release(1)
+
+	node := nodes[rand.Int()%len(nodes)]
+	if err := g.sync(node.Addr, false); err != nil {
+		return fmt.Errorf("sync: %s: %w", node.ID, err)
+	}
+	return nil
+}
+
 func (g *Gossip) gossip(node NodeMetadata) error {
 	var buf bytes.Buffer
 	_ = buf.WriteByte(uint8(messageTypeDigest))
@@ -355,10 +505,10 @@ func (g *Gossip) gossip(node NodeMetadata) error {
 		return fmt.Errorf("encode: %w", err)
 	}
 
-	if buf.Len() > g.config.MaxPacketSize {
+	if buf.Len() > g.maxPacketSize {
 		return fmt.Errorf(
 			"max packet size too small for header: %d < %d",
-			g.config.MaxPacketSize, buf.Len(),
+			g.maxPacketSize, buf.Len(),
 		)
 	}
 
@@ -377,13 +527,16 @@ func (g *Gossip) gossip(node NodeMetadata) error {
 			return fmt.Errorf("encode: %w", err)
 		}
 
-		if buf.Len() > g.config.MaxPacketSize {
+		if buf.Len() > g.maxPacketSize {
 			break
 		}
 		bufLen = buf.Len()
 	}
+	if buf.Len() != bufLen {
+		g.metrics.PacketsTruncatedTotal.Inc()
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", node.Addr)
+	udpAddr, err := g.resolver.Resolve(node.Addr)
 	if err != nil {
 		return fmt.Errorf("resolve udp: %s: %w", node.Addr, err)
 	}
@@ -391,6 +544,7 @@ func (g *Gossip) gossip(node NodeMetadata) error {
 		return fmt.Errorf("write packet: %s: %w", node.Addr, err)
 	}
 
+	g.metrics.PacketsOutbound.Inc()
 	g.metrics.PacketBytesOutbound.Add(float64(bufLen))
 
 	return nil
@@ -398,7 +552,7 @@ func (g *Gossip) gossip(node NodeMetadata) error {
 
 // join attempts to synchronise with the node at the given address.
 func (g *Gossip) join(addr string) (string, error) {
-	conn, err := g.dialer.Dial("tcp", addr)
+	conn, err := g.dial(addr)
 	if err != nil {
 		return "", err
 	}
@@ -467,9 +621,112 @@ func (g *Gossip) join(addr string) (string, error) {
 	return header.NodeID, nil
 }
 
-// leave attempts to send our local state to the node at the given address.
-func (g *Gossip) leave(addr string) error {
-	conn, err := g.dialer.Dial("tcp", addr)
+// sync exchanges the full cluster state with the node at the given address.
+//
+// This sends our digest, then the node responds with the state we're missing
+// and its own digest, then we send the state the node is missing.
+//
+// If wan is true, addr is the address of a WAN peer in another datacenter.
+func (g *Gossip) sync(addr string, wan bool) error {
+	var conn net.Conn
+	var err error
+	if wan {
+		conn, err = g.dialWAN(addr)
+	} else {
+		conn, err = g.dial(addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(streamTimeout))
+
+	g.metrics.ConnectionsOutbound.Inc()
+
+	trackedReader := newTrackedReader(conn)
+	defer func() {
+		g.metrics.StreamBytesInbound.Add(float64(trackedReader.NumBytesRead()))
+	}()
+
+	trackedWriter := newTrackedWriter(conn)
+	defer func() {
+		g.metrics.StreamBytesOutbound.Add(float64(trackedWriter.NumBytesWritten()))
+	}()
+
+	r := bufio.NewReader(trackedReader)
+	w := bufio.NewWriter(trackedWriter)
+
+	if err := w.WriteByte(byte(messageTypeSync)); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := w.WriteByte(supportedVersion); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	encoder := newEncoder(w)
+
+	localMeta := g.state.LocalNodeMetadata()
+	if err := encoder.Encode(&syncHeader{
+		NodeID: localMeta.ID,
+		Addr:   localMeta.Addr,
+	}); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	if err := encoder.Encode(g.state.Digest()); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	decoder := newDecoder(r)
+
+	var header syncHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	var delta delta
+	if err := decoder.Decode(&delta); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	var digest digest
+	if err := decoder.Decode(&digest); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	// Apply unknown state from the delta.
+	if wan {
+		g.state.ApplyWANDelta(header.NodeID, delta)
+	} else {
+		g.state.ApplyDelta(delta)
+	}
+
+	// Discover any unknown nodes from the digest.
+	g.state.ApplyDigest(digest)
+
+	// Send the state the node is missing.
+	if err := encoder.Encode(g.state.Delta(digest, true)); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
+
+// sendLocal sends our local state to the node at the given address and waits
+// for the node to acknowledge.
+//
+// This uses the 'leave' message, though the receiver only applies the state,
+// where leaving is indicated by the local state itself, so is also used to
+// propagate other local state updates.
+func (g *Gossip) sendLocal(addr string) error {
+	conn, err := g.dial(addr)
 	if err != nil {
 		return err
 	}
@@ -528,10 +785,25 @@ func (g *Gossip) leave(addr string) error {
 	return nil
 }
 
+// dial opens a stream connection to the node at the given address.
+func (g *Gossip) dial(addr string) (net.Conn, error) {
+	conn, err := g.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if g.keyring != nil {
+		return newEncryptedConn(conn, g.keyring, true, g.metrics), nil
+	}
+	return conn, nil
+}
+
 // ensurePort adds the configured bind port to addr if addr doesn't already
 // have a port.
+//
+// addr may be an IPv6 address, with or without square brackets, such as
+// '[::1]:8003', '[::1]' or '::1'.
 func (g *Gossip) ensurePort(addr string) string {
-	if strings.Contains(addr, ":") {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
 		return addr
 	}
 
@@ -541,7 +813,8 @@ func (g *Gossip) ensurePort(addr string) string {
 		panic("invalid bind addr:" + g.config.BindAddr)
 	}
 
-	return addr + ":" + bindPort
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, bindPort)
 }
 
 // resolveAddr resolves the given address, which may be a domain pointing
@@ -564,7 +837,7 @@ func resolveAddr(addr string) ([]string, error) {
 
 	var addrs []string
 	for _, ip := range ips {
-		addrs = append(addrs, ip.String()+":"+port)
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
 	}
 	return addrs, nil
 }
@@ -4,16 +4,20 @@ package gossip
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/testutil"
 )
 
 func TestGossip_Join(t *testing.T) {
@@ -57,6 +61,34 @@ func TestGossip_Join(t *testing.T) {
 		assertNodesEqual(node2)
 	})
 
+	t.Run("encrypted", func(t *testing.T) {
+		key := testKey(t, 32)
+
+		node1 := testEncryptedNode("node-1", []string{key}, t)
+		defer node1.Close()
+
+		node1.UpsertLocal("k1", "v1")
+
+		// Node 2 has a new primary key, though still accepts the old key.
+		node2 := testEncryptedNode("node-2", []string{testKey(t, 32), key}, t)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		assert.Error(t, err)
+
+		// Node 3 uses the same primary key as node 1.
+		node3 := testEncryptedNode("node-3", []string{key}, t)
+		defer node3.Close()
+
+		nodeIDs, err := node3.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"node-1"}, nodeIDs)
+
+		node, ok := node3.Node("node-1")
+		require.True(t, ok)
+		assert.Contains(t, node.Entries, Entry{Key: "k1", Value: "v1", Version: 1})
+	})
+
 	t.Run("addr unreachable", func(t *testing.T) {
 		node := testNode("node-1", t)
 		defer node.Close()
@@ -66,6 +98,25 @@ func TestGossip_Join(t *testing.T) {
 	})
 }
 
+func TestGossip_Propagate(t *testing.T) {
+	node1 := testNode("node-1", t)
+	defer node1.Close()
+
+	node2 := testNode("node-2", t)
+	defer node2.Close()
+
+	_, err := node2.Join([]string{node1.LocalNode().Addr})
+	require.NoError(t, err)
+
+	node2.UpsertLocal("k1", "v1")
+	assert.NoError(t, node2.Propagate())
+
+	// Node 1 should have the update without waiting for gossip.
+	node, ok := node1.Node("node-2")
+	require.True(t, ok)
+	assert.Contains(t, node.Entries, Entry{Key: "k1", Value: "v1", Version: 1})
+}
+
 func TestGossip_Leave(t *testing.T) {
 	t.Run("leave single node", func(t *testing.T) {
 		node1 := testNode("node-1", t)
@@ -150,6 +201,247 @@ func TestGossip_Gossip(t *testing.T) {
 	})
 }
 
+func TestGossip_AdvertiseAddr(t *testing.T) {
+	t.Run("ipv6", func(t *testing.T) {
+		node1Watcher := &updateWatcher{
+			Ch: make(chan updateEvent, 10),
+		}
+		defer node1Watcher.Close()
+
+		// Bind to all interfaces but advertise the loopback address.
+		node1 := testNodeWithAdvertiseAddr(
+			"node-1", "[::]:0", "[::1]", node1Watcher, t,
+		)
+		defer node1.Close()
+
+		node2 := testNodeWithAdvertiseAddr(
+			"node-2", "[::]:0", "[::1]", newNopWatcher(), t,
+		)
+		defer node2.Close()
+
+		assert.True(t, strings.HasPrefix(node1.LocalNode().Addr, "[::1]:"))
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+
+		// Verify each node learned the advertised address of the other.
+		node, ok := node1.Node("node-2")
+		require.True(t, ok)
+		assert.Equal(t, node2.LocalNode().Addr, node.Addr)
+		node, ok = node2.Node("node-1")
+		require.True(t, ok)
+		assert.Equal(t, node1.LocalNode().Addr, node.Addr)
+
+		// Verify gossip packets are sent to the advertised address.
+		node2.UpsertLocal("k1", "v1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+
+		event, err := node1Watcher.Next(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, updateEvent{
+			NodeID: "node-2",
+			Key:    "k1",
+			Value:  "v1",
+		}, event)
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		node1Watcher := &updateWatcher{
+			Ch: make(chan updateEvent, 10),
+		}
+		defer node1Watcher.Close()
+
+		node1 := testNodeWithAdvertiseAddr(
+			"node-1", "127.0.0.1:0", "localhost", node1Watcher, t,
+		)
+		defer node1.Close()
+
+		node2 := testNodeWithAdvertiseAddr(
+			"node-2", "127.0.0.1:0", "localhost", newNopWatcher(), t,
+		)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+
+		// Verify node 1 learned the domain rather than the resolved IP.
+		node, ok := node1.Node("node-2")
+		require.True(t, ok)
+		assert.True(t, strings.HasPrefix(node.Addr, "localhost:"))
+
+		node2.UpsertLocal("k1", "v1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+
+		event, err := node1Watcher.Next(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, updateEvent{
+			NodeID: "node-2",
+			Key:    "k1",
+			Value:  "v1",
+		}, event)
+	})
+}
+
+func TestGossip_Metrics(t *testing.T) {
+	t.Run("gossip exchange", func(t *testing.T) {
+		node1 := testNode("node-1", t)
+		defer node1.Close()
+
+		node2 := testNode("node-2", t)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+
+		// Wait for the nodes to exchange packets.
+		for _, node := range []*Gossip{node1, node2} {
+			metrics := node.Metrics()
+			assert.Eventually(t, func() bool {
+				return promtestutil.ToFloat64(metrics.PacketsInbound) > 0 &&
+					promtestutil.ToFloat64(metrics.PacketsOutbound) > 0
+			}, time.Second*2, time.Millisecond*10)
+
+			assert.Greater(t, promtestutil.ToFloat64(metrics.PacketBytesInbound), 0.0)
+			assert.Greater(t, promtestutil.ToFloat64(metrics.PacketBytesOutbound), 0.0)
+			assert.Equal(t, 0.0, promtestutil.ToFloat64(metrics.PacketDecodeErrorsTotal))
+			assert.Equal(t, 2.0, promtestutil.ToFloat64(metrics.Nodes.WithLabelValues("live")))
+		}
+	})
+}
+
+func TestGossip_Sync(t *testing.T) {
+	t.Run("large state", func(t *testing.T) {
+		// Disable gossip rounds so the state is only propagated by syncing
+		// the full state.
+		nodeConfig := testConfig()
+		nodeConfig.Interval = time.Hour
+		nodeConfig.SyncInterval = time.Millisecond * 10
+
+		node1 := testNodeWithConfig("node-1", nodeConfig, t)
+		defer node1.Close()
+
+		node2Config := *nodeConfig
+		node2 := testNodeWithConfig("node-2", &node2Config, t)
+		defer node2.Close()
+
+		_, err := node2.Join([]string{node1.LocalNode().Addr})
+		require.NoError(t, err)
+
+		// Add state to both nodes that exceeds the max packet size.
+		value := strings.Repeat("x", 100)
+		for i := 0; i != 100; i++ {
+			node1.UpsertLocal(fmt.Sprintf("key-%d", i), value)
+			node2.UpsertLocal(fmt.Sprintf("key-%d", i), value)
+		}
+
+		// Wait for both nodes to converge.
+		assert.Eventually(t, func() bool {
+			state, ok := node1.Node("node-2")
+			if !ok || len(state.Entries) < 100 {
+				return false
+			}
+			state, ok = node2.Node("node-1")
+			if !ok || len(state.Entries) < 100 {
+				return false
+			}
+			return true
+		}, time.Second*5, time.Millisecond*10)
+	})
+}
+
+func TestGossip_WAN(t *testing.T) {
+	rootCAs, cert, err := testutil.LocalTLSPeerCert()
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+		ClientCAs:    rootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		// Disable gossip rounds so the state is only propagated by WAN
+		// gossip.
+		nodeConfig := testConfig()
+		nodeConfig.Interval = time.Hour
+
+		node1 := testNodeWithConfig("node-1", nodeConfig, t)
+		defer node1.Close()
+		node1.UpsertLocal("k1", "v1")
+
+		node1WANAddr := testServeWAN(node1, tlsConfig, t)
+
+		node2Config := *nodeConfig
+		node2Config.WAN.Peers = []string{node1WANAddr}
+		node2Config.WAN.SyncInterval = time.Millisecond * 10
+		node2 := testNodeWithConfig("node-2", &node2Config, t)
+		defer node2.Close()
+		node2.UpsertLocal("k2", "v2")
+
+		testServeWAN(node2, tlsConfig, t)
+
+		// Wait for both nodes to converge.
+		assert.Eventually(t, func() bool {
+			state, ok := node1.Node("node-2")
+			if !ok || len(state.Entries) != 1 {
+				return false
+			}
+			state, ok = node2.Node("node-1")
+			if !ok || len(state.Entries) != 1 {
+				return false
+			}
+			return true
+		}, time.Second*5, time.Millisecond*10)
+
+		// Updates continue to propagate.
+		node1.UpsertLocal("k3", "v3")
+		assert.Eventually(t, func() bool {
+			state, ok := node2.Node("node-1")
+			return ok && len(state.Entries) == 2
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("untrusted cert", func(t *testing.T) {
+		_, untrustedCert, err := testutil.LocalTLSPeerCert()
+		require.NoError(t, err)
+
+		nodeConfig := testConfig()
+		nodeConfig.Interval = time.Hour
+
+		node1 := testNodeWithConfig("node-1", nodeConfig, t)
+		defer node1.Close()
+		node1.UpsertLocal("k1", "v1")
+
+		node1WANAddr := testServeWAN(node1, tlsConfig, t)
+
+		// Node 2 trusts node 1, though presents a certificate node 1
+		// doesn't trust.
+		node2Config := *nodeConfig
+		node2Config.WAN.Peers = []string{node1WANAddr}
+		node2Config.WAN.SyncInterval = time.Millisecond * 10
+		node2 := testNodeWithConfig("node-2", &node2Config, t)
+		defer node2.Close()
+		node2.UpsertLocal("k2", "v2")
+
+		untrustedTLSConfig := tlsConfig.Clone()
+		untrustedTLSConfig.Certificates = []tls.Certificate{untrustedCert}
+		testServeWAN(node2, untrustedTLSConfig, t)
+
+		assert.Never(t, func() bool {
+			_, ok := node1.Node("node-2")
+			if ok {
+				return true
+			}
+			_, ok = node2.Node("node-1")
+			return ok
+		}, time.Millisecond*200, time.Millisecond*10)
+	})
+}
+
 func TestGossip_NodeUnreachable(t *testing.T) {
 	t.Run("detect unreachable", func(t *testing.T) {
 		node1Watcher := &livenessWatcher{
@@ -179,6 +471,98 @@ func TestGossip_NodeUnreachable(t *testing.T) {
 			Unreachable: true,
 		}, event)
 	})
+
+	// Tests the suspicion multiplier controls how long it takes to detect
+	// a node as unreachable.
+	t.Run("suspicion multiplier", func(t *testing.T) {
+		detect := func(multiplier int) chan livenessEvent {
+			node1Watcher := &livenessWatcher{
+				Ch: make(chan livenessEvent, 10),
+			}
+			t.Cleanup(node1Watcher.Close)
+
+			node1Config := testConfig()
+			node1Config.SuspicionMultiplier = multiplier
+			node1 := testNodeWithConfigAndWatcher("node-1", node1Config, node1Watcher, t)
+			t.Cleanup(func() { node1.Close() })
+
+			node2 := testNode("node-2", t)
+			_, err := node2.Join([]string{node1.LocalNode().Addr})
+			require.NoError(t, err)
+
+			// Wait for node 1 to receive messages from node 2 before
+			// closing without leaving gracefully.
+			<-time.After(time.Millisecond * 100)
+			node2.Close()
+
+			return node1Watcher.Ch
+		}
+
+		fastCh := detect(2)
+		slowCh := detect(1000)
+
+		// With a multiplier of 2, node 2 is detected within a few intervals.
+		select {
+		case event := <-fastCh:
+			assert.Equal(t, livenessEvent{
+				NodeID:      "node-2",
+				Unreachable: true,
+			}, event)
+		case <-time.After(time.Second * 5):
+			t.Fatal("node not detected as unreachable")
+		}
+
+		// With a multiplier of 1000, node 2 isn't detected for at least 1000
+		// intervals.
+		select {
+		case event := <-slowCh:
+			t.Fatalf("unexpected event: %v", event)
+		case <-time.After(time.Millisecond * 500):
+		}
+	})
+}
+
+func TestGossip_Fanout(t *testing.T) {
+	for _, fanout := range []int{1, 3} {
+		t.Run(fmt.Sprintf("fanout %d", fanout), func(t *testing.T) {
+			nodeConfig := testConfig()
+			// Use a long interval to avoid scheduled gossip rounds.
+			nodeConfig.Interval = time.Hour
+			nodeConfig.Fanout = fanout
+			node := testNodeWithConfig("node-1", nodeConfig, t)
+			defer node.Close()
+
+			// Add peers that record the packets they receive.
+			var peers []net.PacketConn
+			var peerDelta delta
+			for i := 0; i != 5; i++ {
+				peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+				require.NoError(t, err)
+				defer peer.Close()
+
+				peers = append(peers, peer)
+				peerDelta = append(peerDelta, deltaEntry{
+					ID:   fmt.Sprintf("peer-%d", i),
+					Addr: peer.LocalAddr().String(),
+				})
+			}
+			node.state.ApplyDelta(peerDelta)
+
+			require.NoError(t, node.gossipRound())
+
+			received := 0
+			for _, peer := range peers {
+				require.NoError(t, peer.SetReadDeadline(
+					time.Now().Add(time.Millisecond*100),
+				))
+				buf := make([]byte, 1500)
+				if _, _, err := peer.ReadFrom(buf); err == nil {
+					received++
+				}
+			}
+			assert.Equal(t, fanout, received)
+		})
+	}
 }
 
 type updateEvent struct {
@@ -295,8 +679,77 @@ func testNodeWithWatcher(nodeID string, w Watcher, t *testing.T) *Gossip {
 	)
 }
 
+func testEncryptedNode(nodeID string, keys []string, t *testing.T) *Gossip {
+	nodeConfig := testConfig()
+	nodeConfig.EncryptionKeys = keys
+	return testNodeWithConfig(nodeID, nodeConfig, t)
+}
+
+func testNodeWithConfig(nodeID string, nodeConfig *Config, t *testing.T) *Gossip {
+	return testNodeWithConfigAndWatcher(nodeID, nodeConfig, newNopWatcher(), t)
+}
+
+func testNodeWithConfigAndWatcher(
+	nodeID string,
+	nodeConfig *Config,
+	w Watcher,
+	t *testing.T,
+) *Gossip {
+	streamLn, packetLn := testListen(t)
+	nodeConfig.AdvertiseAddr = streamLn.Addr().String()
+	return New(
+		nodeID,
+		nodeConfig,
+		streamLn,
+		packetLn,
+		w,
+		log.NewNopLogger(),
+	)
+}
+
+// testNodeWithAdvertiseAddr creates a node bound to bindAddr that advertises
+// advertiseHost with the bound port.
+func testNodeWithAdvertiseAddr(
+	nodeID string,
+	bindAddr string,
+	advertiseHost string,
+	w Watcher,
+	t *testing.T,
+) *Gossip {
+	streamLn, packetLn := testListenAddr(bindAddr, t)
+	nodeConfig := testConfig()
+	nodeConfig.BindAddr = bindAddr
+	_, port, err := net.SplitHostPort(streamLn.Addr().String())
+	require.NoError(t, err)
+	nodeConfig.AdvertiseAddr = net.JoinHostPort(
+		strings.TrimSuffix(strings.TrimPrefix(advertiseHost, "["), "]"), port,
+	)
+	require.NoError(t, nodeConfig.Validate())
+	return New(
+		nodeID,
+		nodeConfig,
+		streamLn,
+		packetLn,
+		w,
+		log.NewNopLogger(),
+	)
+}
+
+// testServeWAN serves WAN gossip on a local listener and returns the WAN
+// address.
+func testServeWAN(node *Gossip, tlsConfig *tls.Config, t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	node.ServeWAN(ln, tlsConfig)
+	return ln.Addr().String()
+}
+
 func testListen(t *testing.T) (net.Listener, net.PacketConn) {
-	streamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	return testListenAddr("127.0.0.1:0", t)
+}
+
+func testListenAddr(addr string, t *testing.T) (net.Listener, net.PacketConn) {
+	streamLn, err := net.Listen("tcp", addr)
 	require.NoError(t, err)
 
 	packetLn, err := net.ListenUDP("udp", &net.UDPAddr{
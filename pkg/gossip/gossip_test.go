@@ -0,0 +1,43 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGossip_EnsurePort(t *testing.T) {
+	g := &Gossip{
+		config: &Config{
+			BindAddr: "[::]:8003",
+		},
+	}
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"10.26.104.56", "10.26.104.56:8003"},
+		{"10.26.104.56:9003", "10.26.104.56:9003"},
+		{"node1.cluster", "node1.cluster:8003"},
+		{"node1.cluster:9003", "node1.cluster:9003"},
+		{"fd00::1", "[fd00::1]:8003"},
+		{"[fd00::1]", "[fd00::1]:8003"},
+		{"[fd00::1]:9003", "[fd00::1]:9003"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.expected, g.ensurePort(tt.addr))
+		})
+	}
+}
+
+func TestResolveAddr(t *testing.T) {
+	addrs, err := resolveAddr("[fd00::1]:8003")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[fd00::1]:8003"}, addrs)
+
+	addrs, err = resolveAddr("10.26.104.56:8003")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.26.104.56:8003"}, addrs)
+}
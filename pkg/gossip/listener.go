@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -23,6 +24,13 @@ type streamListener struct {
 
 	streamTimeout time.Duration
 
+	// wan indicates whether the listener accepts connections from WAN peers
+	// in other datacenters.
+	wan bool
+
+	// syncs limits the number of concurrent full state syncs.
+	syncs *semaphore.Weighted
+
 	metrics *Metrics
 
 	logger log.Logger
@@ -32,6 +40,7 @@ func newStreamListener(
 	ln net.Listener,
 	state *clusterState,
 	streamTimeout time.Duration,
+	syncs *semaphore.Weighted,
 	metrics *Metrics,
 	logger log.Logger,
 ) *streamListener {
@@ -39,6 +48,7 @@ func newStreamListener(
 		ln:            ln,
 		state:         state,
 		streamTimeout: streamTimeout,
+		syncs:         syncs,
 		metrics:       metrics,
 		logger:        logger,
 	}
@@ -116,6 +126,15 @@ func (l *streamListener) handleConn(conn net.Conn) error {
 		return l.join(r, w)
 	case messageTypeLeave:
 		return l.leave(r, w)
+	case messageTypeSync:
+		// Reject the sync if we're already handling the maximum number of
+		// syncs.
+		if !l.syncs.TryAcquire(1) {
+			return fmt.Errorf("sync: too many concurrent syncs")
+		}
+		defer l.syncs.Release(1)
+
+		return l.sync(r, w)
 	default:
 		return fmt.Errorf("unsupported message type: %d", version)
 	}
@@ -195,6 +214,57 @@ func (l *streamListener) leave(r io.Reader, w *bufio.Writer) error {
 	return nil
 }
 
+func (l *streamListener) sync(r io.Reader, w *bufio.Writer) error {
+	decoder := newDecoder(r)
+	var header syncHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	var digest digest
+	if err := decoder.Decode(&digest); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	// Discover any unknown nodes from the digest.
+	l.state.ApplyDigest(digest)
+
+	localMeta := l.state.LocalNodeMetadata()
+	encoder := newEncoder(w)
+	if err := encoder.Encode(&syncHeader{
+		NodeID: localMeta.ID,
+		Addr:   localMeta.Addr,
+	}); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	// Send the state the node is missing, along with our own digest so the
+	// node can respond with the state we're missing.
+	if err := encoder.Encode(l.state.Delta(digest, true)); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := encoder.Encode(l.state.Digest()); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	var delta delta
+	if err := decoder.Decode(&delta); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	// Apply unknown state from the delta.
+	if l.wan {
+		l.state.ApplyWANDelta(header.NodeID, delta)
+	} else {
+		l.state.ApplyDelta(delta)
+	}
+
+	return nil
+}
+
 // packetListener listens for and handles incoming packets.
 type packetListener struct {
 	ln net.PacketConn
@@ -203,6 +273,8 @@ type packetListener struct {
 
 	failureDetector failureDetector
 
+	resolver *resolver
+
 	readBuf []byte
 
 	maxPacketSize int
@@ -216,6 +288,7 @@ func newPacketListener(
 	ln net.PacketConn,
 	state *clusterState,
 	failureDetector failureDetector,
+	resolver *resolver,
 	maxPacketSize int,
 	metrics *Metrics,
 	logger log.Logger,
@@ -224,6 +297,7 @@ func newPacketListener(
 		ln:              ln,
 		state:           state,
 		failureDetector: failureDetector,
+		resolver:        resolver,
 		readBuf:         make([]byte, maxPacketSize),
 		maxPacketSize:   maxPacketSize,
 		metrics:         metrics,
@@ -242,6 +316,7 @@ func (l *packetListener) Serve() {
 			continue
 		}
 
+		l.metrics.PacketsInbound.Inc()
 		l.metrics.PacketBytesInbound.Add(float64(n))
 
 		buf := l.readBuf[:n]
@@ -261,12 +336,14 @@ func (l *packetListener) Close() error {
 
 func (l *packetListener) handlePacket(b []byte) error {
 	if len(b) < 2 {
+		l.metrics.PacketDecodeErrorsTotal.Inc()
 		return fmt.Errorf("packet too small: %d", len(b))
 	}
 
 	messageType := messageType(b[0])
 	version := b[1]
 	if version != supportedVersion {
+		l.metrics.PacketDecodeErrorsTotal.Inc()
 		return fmt.Errorf("unsupported version: %d", version)
 	}
 
@@ -276,6 +353,7 @@ func (l *packetListener) handlePacket(b []byte) error {
 	case messageTypeDelta:
 		return l.delta(b)
 	default:
+		l.metrics.PacketDecodeErrorsTotal.Inc()
 		return fmt.Errorf("unsupported message type: %d", version)
 	}
 }
@@ -283,6 +361,7 @@ func (l *packetListener) handlePacket(b []byte) error {
 func (l *packetListener) digest(b []byte) error {
 	header, digest, err := decodeDigest(b)
 	if err != nil {
+		l.metrics.PacketDecodeErrorsTotal.Inc()
 		return fmt.Errorf("decode: %w", err)
 	}
 
@@ -311,6 +390,7 @@ func (l *packetListener) digest(b []byte) error {
 func (l *packetListener) delta(b []byte) error {
 	header, delta, err := decodeDelta(b)
 	if err != nil {
+		l.metrics.PacketDecodeErrorsTotal.Inc()
 		return fmt.Errorf("decode: %w", err)
 	}
 
@@ -329,12 +409,15 @@ func (l *packetListener) sendDelta(delta delta, addr string) error {
 		NodeID: localMeta.ID,
 		Addr:   localMeta.Addr,
 	}
-	b, err := encodeDelta(header, delta, l.maxPacketSize)
+	b, truncated, err := encodeDelta(header, delta, l.maxPacketSize)
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
+	if truncated {
+		l.metrics.PacketsTruncatedTotal.Inc()
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := l.resolver.Resolve(addr)
 	if err != nil {
 		return fmt.Errorf("resolve udp: %s: %w", addr, err)
 	}
@@ -342,6 +425,7 @@ func (l *packetListener) sendDelta(delta delta, addr string) error {
 		return fmt.Errorf("write packet: %s: %w", addr, err)
 	}
 
+	l.metrics.PacketsOutbound.Inc()
 	l.metrics.PacketBytesOutbound.Add(float64(len(b)))
 
 	return nil
@@ -363,12 +447,15 @@ func (l *packetListener) sendDigest(
 		Addr:    localMeta.Addr,
 		Request: request,
 	}
-	b, err := encodeDigest(header, digest, l.maxPacketSize)
+	b, truncated, err := encodeDigest(header, digest, l.maxPacketSize)
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
+	if truncated {
+		l.metrics.PacketsTruncatedTotal.Inc()
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := l.resolver.Resolve(addr)
 	if err != nil {
 		return fmt.Errorf("resolve udp: %s: %w", addr, err)
 	}
@@ -376,6 +463,7 @@ func (l *packetListener) sendDigest(
 		return fmt.Errorf("write packet: %s: %w", addr, err)
 	}
 
+	l.metrics.PacketsOutbound.Inc()
 	l.metrics.PacketBytesOutbound.Add(float64(len(b)))
 
 	return nil
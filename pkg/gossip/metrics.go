@@ -27,9 +27,31 @@ type Metrics struct {
 	// connection.
 	PacketBytesOutbound prometheus.Counter
 
+	// PacketsInbound is the total number of read packets.
+	PacketsInbound prometheus.Counter
+
+	// PacketsOutbound is the total number of written packets.
+	PacketsOutbound prometheus.Counter
+
+	// PacketsTruncatedTotal is the total number of written packets that
+	// were truncated as the digest or delta exceeded the max packet size.
+	PacketsTruncatedTotal prometheus.Counter
+
+	// PacketDecodeErrorsTotal is the total number of read packets that could
+	// not be decoded.
+	PacketDecodeErrorsTotal prometheus.Counter
+
+	// DecryptErrorsTotal is the total number of packets or stream frames
+	// that could not be decrypted with any key.
+	DecryptErrorsTotal prometheus.Counter
+
 	// Entries is the number of entries labelled by node_id, deleted and
 	// internal.
 	Entries *prometheus.GaugeVec
+
+	// Nodes is the number of known nodes labelled by status (either 'live',
+	// 'unreachable' or 'left').
+	Nodes *prometheus.GaugeVec
 }
 
 func newMetrics() *Metrics {
@@ -82,6 +104,46 @@ func newMetrics() *Metrics {
 				Help:      "Total number of written bytes via a packet connection",
 			},
 		),
+		PacketsInbound: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "packets_inbound_total",
+				Help:      "Total number of read packets",
+			},
+		),
+		PacketsOutbound: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "packets_outbound_total",
+				Help:      "Total number of written packets",
+			},
+		),
+		PacketsTruncatedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "packets_truncated_total",
+				Help:      "Total number of written packets that were truncated due to the max packet size",
+			},
+		),
+		PacketDecodeErrorsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "packet_decode_errors_total",
+				Help:      "Total number of read packets that could not be decoded",
+			},
+		),
+		DecryptErrorsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "decrypt_errors_total",
+				Help:      "Total number of packets or stream frames that could not be decrypted",
+			},
+		),
 		Entries: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: "piko",
@@ -91,6 +153,15 @@ func newMetrics() *Metrics {
 			},
 			[]string{"node_id", "deleted", "internal"},
 		),
+		Nodes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "gossip",
+				Name:      "nodes",
+				Help:      "Number of known nodes",
+			},
+			[]string{"status"},
+		),
 	}
 }
 
@@ -102,6 +173,12 @@ func (m *Metrics) Register(reg *prometheus.Registry) {
 		m.ConnectionsOutbound,
 		m.StreamBytesOutbound,
 		m.PacketBytesOutbound,
+		m.PacketsInbound,
+		m.PacketsOutbound,
+		m.PacketsTruncatedTotal,
+		m.PacketDecodeErrorsTotal,
+		m.DecryptErrorsTotal,
 		m.Entries,
+		m.Nodes,
 	)
 }
@@ -16,6 +16,7 @@ const (
 	messageTypeDelta
 	messageTypeJoin
 	messageTypeLeave
+	messageTypeSync
 )
 
 func (t messageType) String() string {
@@ -28,6 +29,8 @@ func (t messageType) String() string {
 		return "join"
 	case messageTypeLeave:
 		return "leave"
+	case messageTypeSync:
+		return "sync"
 	default:
 		return "unknown"
 	}
@@ -103,7 +106,9 @@ func (e *encoder) Encode(v interface{}) error {
 	return e.encoder.Encode(v)
 }
 
-func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte, error) {
+// encodeDigest encodes the digest entries upto the max packet size. Returns
+// whether the digest was truncated since not all entries fit in the packet.
+func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte, bool, error) {
 	// Add fixed header.
 	var buf bytes.Buffer
 	_ = buf.WriteByte(uint8(messageTypeDigest))
@@ -112,11 +117,11 @@ func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte
 	encoder := newEncoder(&buf)
 
 	if err := encoder.Encode(&header); err != nil {
-		return nil, fmt.Errorf("encode: %w", err)
+		return nil, false, fmt.Errorf("encode: %w", err)
 	}
 
 	if buf.Len() > maxPacketSize {
-		return nil, fmt.Errorf(
+		return nil, false, fmt.Errorf(
 			"max packet size too small for header: %d < %d",
 			maxPacketSize, buf.Len(),
 		)
@@ -128,7 +133,7 @@ func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte
 	bufLen := buf.Len()
 	for _, entry := range digest {
 		if err := encoder.Encode(&entry); err != nil {
-			return nil, fmt.Errorf("encode: %w", err)
+			return nil, false, fmt.Errorf("encode: %w", err)
 		}
 
 		if buf.Len() > maxPacketSize {
@@ -137,10 +142,13 @@ func encodeDigest(header digestHeader, digest digest, maxPacketSize int) ([]byte
 		bufLen = buf.Len()
 	}
 
-	return buf.Bytes()[:bufLen], nil
+	truncated := buf.Len() != bufLen
+	return buf.Bytes()[:bufLen], truncated, nil
 }
 
-func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, error) {
+// encodeDelta encodes the delta entries upto the max packet size. Returns
+// whether the delta was truncated since not all entries fit in the packet.
+func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, bool, error) {
 	// Add fixed header.
 	var buf bytes.Buffer
 	_ = buf.WriteByte(uint8(messageTypeDelta))
@@ -149,11 +157,11 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 	encoder := newEncoder(&buf)
 
 	if err := encoder.Encode(&header); err != nil {
-		return nil, fmt.Errorf("encode: %w", err)
+		return nil, false, fmt.Errorf("encode: %w", err)
 	}
 
 	if buf.Len() > maxPacketSize {
-		return nil, fmt.Errorf(
+		return nil, false, fmt.Errorf(
 			"max packet size too small for header: %d < %d",
 			maxPacketSize, buf.Len(),
 		)
@@ -170,7 +178,7 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 			Addr:    deltaEntry.Addr,
 			Entries: len(deltaEntry.Entries),
 		}); err != nil {
-			return nil, fmt.Errorf("encode: %w", err)
+			return nil, false, fmt.Errorf("encode: %w", err)
 		}
 
 		if buf.Len() > maxPacketSize {
@@ -180,7 +188,7 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 
 		for _, entry := range deltaEntry.Entries {
 			if err := encoder.Encode(entry); err != nil {
-				return nil, fmt.Errorf("encode: %w", err)
+				return nil, false, fmt.Errorf("encode: %w", err)
 			}
 
 			if buf.Len() > maxPacketSize {
@@ -191,7 +199,8 @@ func encodeDelta(header deltaHeader, delta delta, maxPacketSize int) ([]byte, er
 		}
 	}
 
-	return buf.Bytes()[:bufLen], nil
+	truncated := buf.Len() != bufLen
+	return buf.Bytes()[:bufLen], truncated, nil
 }
 
 type decoder struct {
@@ -332,3 +341,8 @@ type leaveHeader struct {
 	NodeID string `codec:"node_id"`
 	Addr   string `codec:"addr"`
 }
+
+type syncHeader struct {
+	NodeID string `codec:"node_id"`
+	Addr   string `codec:"addr"`
+}
@@ -19,8 +19,9 @@ func TestCodec_Digest(t *testing.T) {
 			{"node-3", "3.3.3.3", 13, false},
 		}
 
-		b, err := encodeDigest(sentHeader, sentDigest, 1000)
+		b, truncated, err := encodeDigest(sentHeader, sentDigest, 1000)
 		assert.NoError(t, err)
+		assert.False(t, truncated)
 
 		receivedHeader, receivedDigest, err := decodeDigest(b)
 		assert.NoError(t, err)
@@ -43,8 +44,9 @@ func TestCodec_Digest(t *testing.T) {
 			{"node-3", "3.3.3.3", 13, false},
 		}
 
-		b, err := encodeDigest(sentHeader, sentDigest, 125)
+		b, truncated, err := encodeDigest(sentHeader, sentDigest, 125)
 		assert.NoError(t, err)
+		assert.True(t, truncated)
 		assert.Equal(t, 119, len(b))
 
 		receivedHeader, receivedDigest, err := decodeDigest(b)
@@ -84,8 +86,9 @@ func TestCodec_Delta(t *testing.T) {
 				},
 			},
 		}
-		b, err := encodeDelta(sentHeader, sentDelta, 1000)
+		b, truncated, err := encodeDelta(sentHeader, sentDelta, 1000)
 		assert.NoError(t, err)
+		assert.False(t, truncated)
 
 		receivedHeader, receivedDelta, err := decodeDelta(b)
 		assert.NoError(t, err)
@@ -121,8 +124,9 @@ func TestCodec_Delta(t *testing.T) {
 				},
 			},
 		}
-		b, err := encodeDelta(sentHeader, sentDelta, 325)
+		b, truncated, err := encodeDelta(sentHeader, sentDelta, 325)
 		assert.NoError(t, err)
+		assert.True(t, truncated)
 		assert.Equal(t, 297, len(b))
 
 		receivedHeader, receivedDelta, err := decodeDelta(b)
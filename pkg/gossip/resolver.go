@@ -0,0 +1,98 @@
+package gossip
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type resolvedAddr struct {
+	addr       *net.UDPAddr
+	resolvedAt time.Time
+	usedAt     time.Time
+}
+
+// resolver resolves node addresses to UDP addresses.
+//
+// Nodes may advertise a domain name rather than an IP, such as in container
+// environments where the IP of a node may change. To avoid a DNS lookup for
+// every packet, resolved addresses are cached and re-resolved after the
+// configured interval, so changes to the IP of a node are picked up.
+//
+// If re-resolving fails, the last resolved address is used.
+type resolver struct {
+	interval time.Duration
+
+	cache map[string]*resolvedAddr
+
+	mu sync.Mutex
+
+	lookup func(addr string) (*net.UDPAddr, error)
+	now    func() time.Time
+}
+
+func newResolver(interval time.Duration) *resolver {
+	return &resolver{
+		interval: interval,
+		cache:    make(map[string]*resolvedAddr),
+		lookup: func(addr string) (*net.UDPAddr, error) {
+			return net.ResolveUDPAddr("udp", addr)
+		},
+		now: time.Now,
+	}
+}
+
+// Resolve returns the UDP address for the given 'host:port' address.
+func (r *resolver) Resolve(addr string) (*net.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid addr: %s: %w", addr, err)
+	}
+	// IP addresses don't need a DNS lookup so aren't cached.
+	if net.ParseIP(host) != nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+
+	cached, ok := r.cache[addr]
+	if ok && now.Sub(cached.resolvedAt) < r.interval {
+		cached.usedAt = now
+		return cached.addr, nil
+	}
+
+	// Only evict when resolving, so the cache is scanned at most once per
+	// interval per address.
+	defer r.evictLocked(now)
+
+	udpAddr, err := r.lookup(addr)
+	if err != nil {
+		if ok {
+			// Retry after the interval rather than on every packet.
+			cached.resolvedAt = now
+			cached.usedAt = now
+			return cached.addr, nil
+		}
+		return nil, err
+	}
+	r.cache[addr] = &resolvedAddr{
+		addr:       udpAddr,
+		resolvedAt: now,
+		usedAt:     now,
+	}
+	return udpAddr, nil
+}
+
+// evictLocked removes addresses that haven't been used recently, such as
+// the addresses of nodes that have left the cluster.
+func (r *resolver) evictLocked(now time.Time) {
+	for addr, cached := range r.cache {
+		if now.Sub(cached.usedAt) > r.interval*10 {
+			delete(r.cache, addr)
+		}
+	}
+}
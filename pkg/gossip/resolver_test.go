@@ -0,0 +1,122 @@
+package gossip
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver(t *testing.T) {
+	t.Run("ip", func(t *testing.T) {
+		r := newResolver(time.Minute)
+		r.lookup = func(_ string) (*net.UDPAddr, error) {
+			t.Fatal("unexpected lookup")
+			return nil, nil
+		}
+
+		addr, err := r.Resolve("10.26.104.56:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "10.26.104.56:8003", addr.String())
+
+		addr, err = r.Resolve("[fd00::1]:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "[fd00::1]:8003", addr.String())
+	})
+
+	t.Run("re-resolve", func(t *testing.T) {
+		now := time.Now()
+		ip := "10.26.104.56"
+		lookups := 0
+
+		r := newResolver(time.Minute)
+		r.now = func() time.Time {
+			return now
+		}
+		r.lookup = func(addr string) (*net.UDPAddr, error) {
+			assert.Equal(t, "node1.cluster:8003", addr)
+			lookups++
+			return &net.UDPAddr{IP: net.ParseIP(ip), Port: 8003}, nil
+		}
+
+		addr, err := r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "10.26.104.56:8003", addr.String())
+
+		// The node IP changes but the cached address is used until the
+		// resolve interval.
+		ip = "fd00::1"
+		now = now.Add(time.Second * 30)
+		addr, err = r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "10.26.104.56:8003", addr.String())
+		assert.Equal(t, 1, lookups)
+
+		now = now.Add(time.Minute)
+		addr, err = r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "[fd00::1]:8003", addr.String())
+		assert.Equal(t, 2, lookups)
+	})
+
+	t.Run("lookup failed", func(t *testing.T) {
+		now := time.Now()
+		var lookupErr error
+
+		r := newResolver(time.Minute)
+		r.now = func() time.Time {
+			return now
+		}
+		r.lookup = func(_ string) (*net.UDPAddr, error) {
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return &net.UDPAddr{IP: net.ParseIP("10.26.104.56"), Port: 8003}, nil
+		}
+
+		_, err := r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+
+		// If re-resolving fails, the last resolved address is used.
+		lookupErr = errors.New("lookup failed")
+		now = now.Add(time.Minute * 2)
+		addr, err := r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+		assert.Equal(t, "10.26.104.56:8003", addr.String())
+
+		// Addresses that have never been resolved return an error.
+		_, err = r.Resolve("node2.cluster:8003")
+		assert.Error(t, err)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		now := time.Now()
+
+		r := newResolver(time.Minute)
+		r.now = func() time.Time {
+			return now
+		}
+		r.lookup = func(_ string) (*net.UDPAddr, error) {
+			return &net.UDPAddr{IP: net.ParseIP("10.26.104.56"), Port: 8003}, nil
+		}
+
+		_, err := r.Resolve("node1.cluster:8003")
+		require.NoError(t, err)
+
+		// Addresses that aren't used are evicted.
+		now = now.Add(time.Hour)
+		_, err = r.Resolve("node2.cluster:8003")
+		require.NoError(t, err)
+		assert.Len(t, r.cache, 1)
+		assert.Contains(t, r.cache, "node2.cluster:8003")
+	})
+
+	t.Run("invalid addr", func(t *testing.T) {
+		r := newResolver(time.Minute)
+		_, err := r.Resolve("fd00::1:8003")
+		assert.Error(t, err)
+	})
+}
@@ -138,13 +138,15 @@ func newClusterState(
 		Entries: make(map[string]Entry),
 	}
 
-	return &clusterState{
+	s := &clusterState{
 		localID:         localID,
 		nodes:           nodes,
 		failureDetector: failureDetector,
 		metrics:         metrics,
 		watcher:         watcher,
 	}
+	s.metricsUpdateNodes()
+	return s
 }
 
 func (s *clusterState) Node(id string) (*NodeState, bool) {
@@ -294,6 +296,7 @@ func (s *clusterState) LeaveLocal() {
 	}
 
 	s.metricsAddEntry(state.ID, state.Entries[leftKey])
+	s.metricsUpdateNodes()
 }
 
 // CompactLocal compacts the entries in the local node state to remove
@@ -460,6 +463,8 @@ func (s *clusterState) ApplyDigest(digest digest) {
 
 		s.watcher.OnJoin(entry.ID)
 	}
+
+	s.metricsUpdateNodes()
 }
 
 // ApplyDelta updates the state of remote nodes given the delta state.
@@ -470,6 +475,39 @@ func (s *clusterState) ApplyDelta(delta delta) {
 	for _, entry := range delta {
 		s.applyDeltaEntry(entry)
 	}
+
+	s.metricsUpdateNodes()
+}
+
+// ApplyWANDelta updates the state of remote nodes given the delta state
+// received from the WAN peer with the given ID.
+//
+// Nodes in other datacenters can't be reached with UDP gossip, so aren't
+// reported to the failure detector by gossip rounds. Instead the WAN peer
+// is reported, along with any node whose version advanced, since only the
+// node itself can update its state.
+func (s *clusterState) ApplyWANDelta(peerID string, delta delta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failureDetector.Report(peerID)
+
+	for _, entry := range delta {
+		var version uint64
+		if state, ok := s.nodes[entry.ID]; ok {
+			version = state.Version
+		}
+
+		s.applyDeltaEntry(entry)
+
+		if state, ok := s.nodes[entry.ID]; ok &&
+			entry.ID != s.localID && entry.ID != peerID &&
+			state.Version > version {
+			s.failureDetector.Report(entry.ID)
+		}
+	}
+
+	s.metricsUpdateNodes()
 }
 
 func (s *clusterState) deltaEntry(nodeID string, fromVersion uint64) deltaEntry {
@@ -590,6 +628,8 @@ func (s *clusterState) RemoveExpiredAt(t time.Time) {
 		s.watcher.OnExpired(id)
 		s.failureDetector.Remove(id)
 	}
+
+	s.metricsUpdateNodes()
 }
 
 func (s *clusterState) UpdateLiveness(suspicionThreshold float64) {
@@ -616,6 +656,28 @@ func (s *clusterState) UpdateLiveness(suspicionThreshold float64) {
 			}
 		}
 	}
+
+	s.metricsUpdateNodes()
+}
+
+// metricsUpdateNodes updates the number of nodes with each status. Must be
+// called with the mutex held.
+func (s *clusterState) metricsUpdateNodes() {
+	var live, unreachable, left int
+	for _, node := range s.nodes {
+		switch {
+		case node.Left:
+			left++
+		case node.Unreachable:
+			unreachable++
+		default:
+			live++
+		}
+	}
+
+	s.metrics.Nodes.With(prometheus.Labels{"status": "live"}).Set(float64(live))
+	s.metrics.Nodes.With(prometheus.Labels{"status": "unreachable"}).Set(float64(unreachable))
+	s.metrics.Nodes.With(prometheus.Labels{"status": "left"}).Set(float64(left))
 }
 
 func (s *clusterState) metricsAddEntry(nodeID string, newEntry Entry) {
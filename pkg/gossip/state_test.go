@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -741,6 +742,11 @@ func TestClusterState_UpdateLiveness(t *testing.T) {
 		assert.False(t, node.Unreachable)
 		node, _ = clusterState.Node("node-3")
 		assert.True(t, node.Unreachable)
+
+		nodes := clusterState.metrics.Nodes
+		assert.Equal(t, 2.0, testutil.ToFloat64(nodes.WithLabelValues("live")))
+		assert.Equal(t, 1.0, testutil.ToFloat64(nodes.WithLabelValues("unreachable")))
+		assert.Equal(t, 0.0, testutil.ToFloat64(nodes.WithLabelValues("left")))
 	})
 
 	t.Run("node healthy", func(t *testing.T) {
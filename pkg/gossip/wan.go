@@ -0,0 +1,244 @@
+package gossip
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWANSyncInterval = time.Second * 10
+)
+
+// WANConfig configures gossip with nodes in other datacenters.
+//
+// UDP gossip often can't cross datacenter boundaries, so instead nodes
+// periodically synchronise the full cluster state with the configured WAN
+// peers using TCP connections secured with mutual TLS.
+type WANConfig struct {
+	// BindAddr is the address to listen for WAN gossip connections. If
+	// empty, WAN gossip is disabled.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+
+	// Peers contains the WAN addresses of nodes in other datacenters to
+	// synchronise with.
+	Peers []string `json:"peers" yaml:"peers"`
+
+	// SyncInterval is the rate to synchronise the cluster state with each
+	// WAN peer.
+	//
+	// If zero, defaults to 10 seconds.
+	SyncInterval time.Duration `json:"sync_interval" yaml:"sync_interval"`
+
+	// Cert is a path to the PEM encoded certificate presented to peers.
+	Cert string `json:"cert" yaml:"cert"`
+
+	// Key is a path to the PEM encoded key for Cert.
+	Key string `json:"key" yaml:"key"`
+
+	// CAs is a path to certificate authorities to verify the certificates
+	// of peers.
+	CAs string `json:"cas" yaml:"cas"`
+}
+
+// Enabled returns whether WAN gossip is configured.
+func (c *WANConfig) Enabled() bool {
+	return c.BindAddr != ""
+}
+
+func (c *WANConfig) Validate() error {
+	if !c.Enabled() {
+		if len(c.Peers) != 0 {
+			return fmt.Errorf("missing bind addr")
+		}
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.BindAddr); err != nil {
+		return fmt.Errorf("invalid bind addr: %w", err)
+	}
+	for _, peer := range c.Peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("invalid peer: %s: %w", peer, err)
+		}
+	}
+	if c.SyncInterval < 0 {
+		return fmt.Errorf("sync interval cannot be negative")
+	}
+	if c.Cert == "" {
+		return fmt.Errorf("missing cert")
+	}
+	if c.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+	if c.CAs == "" {
+		return fmt.Errorf("missing cas")
+	}
+	return nil
+}
+
+func (c *WANConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.BindAddr,
+		"gossip.wan.bind-addr",
+		c.BindAddr,
+		`
+The host/port to listen for WAN gossip connections from nodes in other
+datacenters.
+
+UDP gossip often can't cross datacenter boundaries, so WAN gossip instead
+synchronises the cluster state over TCP connections secured with mutual TLS.
+Gossip within the datacenter continues to use '--gossip.bind-addr'.
+
+If not set, WAN gossip is disabled.`,
+	)
+
+	fs.StringSliceVar(
+		&c.Peers,
+		"gossip.wan.peers",
+		c.Peers,
+		`
+The WAN gossip addresses of nodes in other datacenters to synchronise with,
+such as 'node1.eu-west-1.cluster:8004'.
+
+Nodes in the other datacenters are discovered from the peers, so only a few
+peers are needed in each datacenter.`,
+	)
+
+	fs.DurationVar(
+		&c.SyncInterval,
+		"gossip.wan.sync-interval",
+		c.SyncInterval,
+		`
+The interval to synchronise the full cluster state with each WAN peer.`,
+	)
+
+	fs.StringVar(
+		&c.Cert,
+		"gossip.wan.cert",
+		c.Cert,
+		`
+Path to the PEM encoded certificate file presented to WAN peers.
+
+The certificate is used both when accepting and when opening WAN gossip
+connections, so must be valid for both server and client authentication.`,
+	)
+
+	fs.StringVar(
+		&c.Key,
+		"gossip.wan.key",
+		c.Key,
+		`
+Path to the PEM encoded key file.`,
+	)
+
+	fs.StringVar(
+		&c.CAs,
+		"gossip.wan.cas",
+		c.CAs,
+		`
+Path to a PEM file containing certificate authorities to verify the
+certificates of WAN peers.
+
+Peers must present a valid certificate signed by one of the certificate
+authorities, otherwise the connection is rejected.`,
+	)
+}
+
+// LoadTLS loads the TLS configuration used for WAN gossip connections.
+func (c *WANConfig) LoadTLS() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair: %w", err)
+	}
+
+	caCert, err := os.ReadFile(c.CAs)
+	if err != nil {
+		return nil, fmt.Errorf("open cas: %s: %w", c.CAs, err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("parse cas: %s", c.CAs)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ServeWAN accepts WAN gossip connections from nodes in other datacenters
+// on the given listener, and periodically synchronises with the configured
+// WAN peers.
+//
+// tlsConfig is used to both accept and open connections, so must include a
+// certificate and the certificate authorities to verify peers, such as
+// loaded with WANConfig.LoadTLS.
+//
+// Since TLS already encrypts WAN traffic, the gossip encryption keys aren't
+// used for WAN connections.
+func (g *Gossip) ServeWAN(ln net.Listener, tlsConfig *tls.Config) {
+	g.wanTLSConfig = tlsConfig
+
+	wanListener := newStreamListener(
+		tls.NewListener(ln, tlsConfig),
+		g.state,
+		streamTimeout,
+		g.syncs,
+		g.metrics,
+		g.logger.With(zap.String("transport", "wan")),
+	)
+	wanListener.wan = true
+	g.wanListener.Store(wanListener)
+
+	go wanListener.Serve()
+
+	if len(g.config.WAN.Peers) == 0 {
+		return
+	}
+
+	interval := g.config.WAN.SyncInterval
+	if interval == 0 {
+		interval = defaultWANSyncInterval
+	}
+	go func() {
+		// Synchronise on startup rather than waiting for the first interval.
+		g.wanSyncRound()
+		g.scheduleFunc(interval, g.wanSyncRound)
+	}()
+}
+
+// wanSyncRound synchronises the full cluster state with each WAN peer.
+func (g *Gossip) wanSyncRound() {
+	for _, peer := range g.config.WAN.Peers {
+		if err := g.sync(peer, true); err != nil {
+			g.logger.Warn(
+				"wan sync failed",
+				zap.String("peer", peer),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// dialWAN opens a TLS connection to the WAN peer at the given address.
+func (g *Gossip) dialWAN(addr string) (net.Conn, error) {
+	if g.wanTLSConfig == nil {
+		return nil, errors.New("wan gossip not enabled")
+	}
+	dialer := &tls.Dialer{
+		NetDialer: g.dialer,
+		Config:    g.wanTLSConfig,
+	}
+	return dialer.Dial("tcp", addr)
+}
@@ -14,6 +14,34 @@ type Config struct {
 	// Subsystems enables debug logging on log records whose 'subsystem'
 	// matches one of the given values (overrides `Level`).
 	Subsystems []string `json:"subsystems" yaml:"subsystems"`
+
+	// Format is the log record encoding. Either 'json' or 'console'. Defaults
+	// to 'json' if unset.
+	Format string `json:"format" yaml:"format"`
+
+	Sampling SamplingConfig `json:"sampling" yaml:"sampling"`
+}
+
+// SamplingConfig configures sampling of debug and info records to limit the
+// log volume on busy nodes.
+type SamplingConfig struct {
+	// Initial is the number of records with the same level and message to
+	// log each second before sampling. Zero disables sampling.
+	Initial int `json:"initial" yaml:"initial"`
+
+	// Thereafter is the sampling rate after the first 'Initial' records each
+	// second, where only every 'Thereafter' record is logged.
+	Thereafter int `json:"thereafter" yaml:"thereafter"`
+}
+
+func (c *SamplingConfig) Validate() error {
+	if c.Initial < 0 {
+		return fmt.Errorf("initial cannot be negative")
+	}
+	if c.Thereafter < 0 {
+		return fmt.Errorf("thereafter cannot be negative")
+	}
+	return nil
 }
 
 func (c *Config) Validate() error {
@@ -23,9 +51,27 @@ func (c *Config) Validate() error {
 	if _, err := zapLevelFromString(c.Level); err != nil {
 		return err
 	}
+	switch c.Format {
+	case "", "json", "console":
+	default:
+		return fmt.Errorf("unsupported format: %s", c.Format)
+	}
+	if err := c.Sampling.Validate(); err != nil {
+		return fmt.Errorf("sampling: %w", err)
+	}
 	return nil
 }
 
+// Options returns the logger options for the configured format and sampling.
+func (c *Config) Options() []Option {
+	var opts []Option
+	if c.Format != "" {
+		opts = append(opts, WithFormat(c.Format))
+	}
+	opts = append(opts, WithSampling(c.Sampling.Initial, c.Sampling.Thereafter))
+	return opts
+}
+
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 	fs.StringVar(
 		&c.Level,
@@ -49,4 +95,37 @@ debug logs.
 
 Such as you can enable 'gossip' logs with '--log.subsystems gossip'.`,
 	)
+	fs.StringVar(
+		&c.Format,
+		"log.format",
+		c.Format,
+		`
+Log record format.
+
+The available formats are 'json' and 'console'. 'json' is best for log
+aggregation, and 'console' for local development.`,
+	)
+	fs.IntVar(
+		&c.Sampling.Initial,
+		"log.sampling.initial",
+		c.Sampling.Initial,
+		`
+Number of debug and info records with the same level and message to log
+each second before sampling.
+
+Sampling is disabled if set to 0 (the default). Warn and error records are
+never sampled.`,
+	)
+	fs.IntVar(
+		&c.Sampling.Thereafter,
+		"log.sampling.thereafter",
+		c.Sampling.Thereafter,
+		`
+Once '--log.sampling.initial' records with the same level and message have
+been logged in a second, only every '--log.sampling.thereafter' record is
+logged for the rest of that second.
+
+If set to 0, all records after the initial records are dropped until the
+next second.`,
+	)
 }
@@ -0,0 +1,41 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		conf := Config{
+			Level:  "info",
+			Format: "console",
+			Sampling: SamplingConfig{
+				Initial:    100,
+				Thereafter: 100,
+			},
+		}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		conf := Config{
+			Level:  "info",
+			Format: "xml",
+		}
+		assert.EqualError(t, conf.Validate(), "unsupported format: xml")
+	})
+
+	t.Run("negative sampling", func(t *testing.T) {
+		conf := Config{
+			Level: "info",
+			Sampling: SamplingConfig{
+				Initial: -1,
+			},
+		}
+		assert.EqualError(
+			t, conf.Validate(), "sampling: initial cannot be negative",
+		)
+	})
+}
@@ -22,7 +22,7 @@ func (l *loggerWriter) Write(p []byte) (int, error) {
 }
 
 // Logger is a logger which writes structured logs to stderr formatted
-// as JSON.
+// as JSON (or console).
 //
 // Logs can be filtered by level, where only logs whose level exceeds the
 // configured minimum level are logged. The log level can be overridden to
@@ -57,7 +57,18 @@ type logger struct {
 
 // NewLogger creates a new logger filtering using the given log level and
 // enabled subsystems.
-func NewLogger(lvl string, enabledSubsystems []string) (Logger, error) {
+func NewLogger(
+	lvl string,
+	enabledSubsystems []string,
+	opts ...Option,
+) (Logger, error) {
+	options := options{
+		format: "json",
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	zapLevel, err := zapLevelFromString(lvl)
 	if err != nil {
 		return nil, err
@@ -70,16 +81,34 @@ func NewLogger(lvl string, enabledSubsystems []string) (Logger, error) {
 		"2006-01-02T15:04:05.999Z07:00",
 	)
 
-	enc := zapcore.NewJSONEncoder(encoderConfig)
-	sink, _, err := zap.Open("stderr")
+	enc, err := encoderFromFormat(options.format, encoderConfig)
 	if err != nil {
-		return nil, fmt.Errorf("open sync: %w", err)
+		return nil, err
 	}
-	core := &core{core: zapcore.NewCore(
+
+	sink := options.output
+	if sink == nil {
+		sink, _, err = zap.Open("stderr")
+		if err != nil {
+			return nil, fmt.Errorf("open sync: %w", err)
+		}
+	}
+
+	c := &core{core: zapcore.NewCore(
 		enc, sink, zap.NewAtomicLevelAt(zapLevel),
 	)}
+	if options.initial > 0 {
+		// The sampled core doesn't filter by level, since records are
+		// already filtered by level (or subsystem) before being checked.
+		c.sampled = zapcore.NewSamplerWithOptions(
+			zapcore.NewCore(enc.Clone(), sink, zap.DebugLevel),
+			time.Second,
+			options.initial,
+			options.thereafter,
+		)
+	}
 	return &logger{
-		core: core,
+		core: c,
 		// Use 'main' as default subsystem.
 		subsystem:         "main",
 		subsystemEnabled:  subsystemMatch("main", enabledSubsystems),
@@ -249,11 +278,29 @@ func zapLevelFromString(s string) (zapcore.Level, error) {
 	}
 }
 
+func encoderFromFormat(
+	format string,
+	conf zapcore.EncoderConfig,
+) (zapcore.Encoder, error) {
+	switch format {
+	case "json":
+		return zapcore.NewJSONEncoder(conf), nil
+	case "console":
+		return zapcore.NewConsoleEncoder(conf), nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
 // core is a wrapper for another core, except `Check()` will not filter by
 // log level. This is required to log records matching the a configured
 // subsystem.
+//
+// If sampling is enabled, debug and info records are written via the sampled
+// core instead.
 type core struct {
-	core zapcore.Core
+	core    zapcore.Core
+	sampled zapcore.Core
 }
 
 func (c *core) Enabled(lvl zapcore.Level) bool {
@@ -261,13 +308,19 @@ func (c *core) Enabled(lvl zapcore.Level) bool {
 }
 
 func (c *core) With(fields []zap.Field) zapcore.Core {
-	inner := c.core.With(fields)
-	return &core{
-		core: inner,
+	clone := &core{
+		core: c.core.With(fields),
+	}
+	if c.sampled != nil {
+		clone.sampled = c.sampled.With(fields)
 	}
+	return clone
 }
 
 func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.sampled != nil && ent.Level <= zapcore.InfoLevel {
+		return c.sampled.Check(ent, ce)
+	}
 	return ce.AddCore(ent, c.core)
 }
 
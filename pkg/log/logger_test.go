@@ -0,0 +1,163 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogger_Format(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"info", nil, WithFormat("json"), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		logger.WithSubsystem("proxy").Info("foo", zap.String("bar", "car"))
+
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+		assert.Equal(t, "info", record["level"])
+		assert.Equal(t, "foo", record["msg"])
+		assert.Equal(t, "proxy", record["subsystem"])
+		assert.Equal(t, "car", record["bar"])
+	})
+
+	t.Run("console", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"info", nil, WithFormat("console"), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		logger.WithSubsystem("proxy").Info("foo", zap.String("bar", "car"))
+
+		line := buf.String()
+		assert.False(t, json.Valid(buf.Bytes()))
+		assert.Contains(t, line, "\tinfo\tproxy\tfoo\t")
+		assert.Contains(t, line, `{"bar": "car"}`)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"info", nil, withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		logger.Info("foo")
+
+		assert.True(t, json.Valid(buf.Bytes()))
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := NewLogger("info", nil, WithFormat("xml"))
+		assert.ErrorContains(t, err, "unsupported format: xml")
+	})
+}
+
+func TestLogger_Sampling(t *testing.T) {
+	t.Run("drops repeated records", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"debug", nil, WithSampling(2, 5), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 12; i++ {
+			logger.Info("foo")
+		}
+
+		// Logs the first 2 records, then every 5th record (the 7th and
+		// 12th).
+		assert.Equal(t, 4, countLines(buf.String()))
+	})
+
+	t.Run("drops all after initial", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"debug", nil, WithSampling(3, 0), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 10; i++ {
+			logger.Debug("foo")
+		}
+
+		assert.Equal(t, 3, countLines(buf.String()))
+	})
+
+	t.Run("samples by message", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"debug", nil, WithSampling(1, 0), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 5; i++ {
+			logger.Info("foo")
+			logger.With(zap.String("bar", "car")).Info("bar")
+		}
+
+		assert.Equal(t, 2, countLines(buf.String()))
+	})
+
+	t.Run("warn and error not sampled", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"debug", nil, WithSampling(1, 0), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 5; i++ {
+			logger.Warn("foo")
+			logger.Error("bar")
+		}
+
+		assert.Equal(t, 10, countLines(buf.String()))
+	})
+
+	t.Run("enabled subsystem", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"info",
+			[]string{"proxy"},
+			WithSampling(2, 0),
+			withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 5; i++ {
+			logger.WithSubsystem("proxy").Debug("foo")
+			logger.WithSubsystem("gossip").Debug("bar")
+		}
+
+		assert.Equal(t, 2, countLines(buf.String()))
+		assert.NotContains(t, buf.String(), "gossip")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := NewLogger(
+			"debug", nil, WithSampling(0, 0), withOutput(zapcore.AddSync(&buf)),
+		)
+		require.NoError(t, err)
+
+		for i := 0; i != 10; i++ {
+			logger.Info("foo")
+		}
+
+		assert.Equal(t, 10, countLines(buf.String()))
+	})
+}
+
+func countLines(s string) int {
+	return strings.Count(s, "\n")
+}
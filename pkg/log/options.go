@@ -0,0 +1,68 @@
+package log
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+type options struct {
+	format     string
+	initial    int
+	thereafter int
+	output     zapcore.WriteSyncer
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type formatOption struct {
+	format string
+}
+
+func (o formatOption) apply(opts *options) {
+	opts.format = o.format
+}
+
+// WithFormat configures the log record encoding. Either 'json' or 'console'.
+//
+// If not set (the default) records are formatted as JSON.
+func WithFormat(format string) Option {
+	return formatOption{format: format}
+}
+
+type samplingOption struct {
+	initial    int
+	thereafter int
+}
+
+func (o samplingOption) apply(opts *options) {
+	opts.initial = o.initial
+	opts.thereafter = o.thereafter
+}
+
+// WithSampling configures sampling of debug and info records. Each second,
+// the first 'initial' records with the same level and message are logged,
+// then only every 'thereafter' record is logged. If 'thereafter' is zero, all
+// records after the first 'initial' are dropped until the next second.
+//
+// Warn and error records are never sampled.
+//
+// If not set (the default), or 'initial' is zero, records are not sampled.
+func WithSampling(initial int, thereafter int) Option {
+	return samplingOption{initial: initial, thereafter: thereafter}
+}
+
+type outputOption struct {
+	output zapcore.WriteSyncer
+}
+
+func (o outputOption) apply(opts *options) {
+	opts.output = o.output
+}
+
+// withOutput configures the sink to write records to.
+//
+// If not set (the default) records are written to stderr.
+func withOutput(output zapcore.WriteSyncer) Option {
+	return outputOption{output: output}
+}
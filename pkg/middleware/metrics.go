@@ -15,6 +15,7 @@ type Metrics struct {
 	RequestLatency   *prometheus.HistogramVec
 	RequestSize      prometheus.Histogram
 	ResponseSize     prometheus.Histogram
+	PanicsTotal      prometheus.Counter
 }
 
 func NewMetrics(subsystem string) *Metrics {
@@ -65,6 +66,14 @@ func NewMetrics(subsystem string) *Metrics {
 				Buckets:   sizeBuckets,
 			},
 		),
+		PanicsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: subsystem,
+				Name:      "panics_total",
+				Help:      "Total recovered handler panics.",
+			},
+		),
 	}
 }
 
@@ -98,6 +107,7 @@ func (m *Metrics) Register(registry *prometheus.Registry) {
 		m.RequestLatency,
 		m.RequestSize,
 		m.ResponseSize,
+		m.PanicsTotal,
 	)
 }
 
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// PanicHook is called when a handler panics, with the recovered value and
+// the stack trace of the panic.
+type PanicHook func(r *http.Request, err any, stack []byte)
+
+// NewRecovery creates middleware that recovers from handler panics.
+//
+// The panic is logged with its stack trace and the request is aborted with a
+// '500 Internal Server Error' response. If metrics is not nil, recovered
+// panics are counted. If hook is not nil, it is called before the response
+// is written.
+func NewRecovery(logger log.Logger, metrics *Metrics, hook PanicHook) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// http.ErrAbortHandler is used to abort the response, such as
+			// by httputil.ReverseProxy when copying the response body fails,
+			// so isn't a bug. The server closes the connection without
+			// logging.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			stack := debug.Stack()
+			logger.Error(
+				"handler panic",
+				zap.String("path", c.FullPath()),
+				zap.Any("err", err),
+				zap.ByteString("stack", stack),
+			)
+			if metrics != nil {
+				metrics.PanicsTotal.Inc()
+			}
+			if hook != nil {
+				hook(c.Request, err, stack)
+			}
+
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+type errorLogger struct {
+	log.Logger
+
+	fields []zap.Field
+}
+
+func (l *errorLogger) Error(_ string, fields ...zap.Field) {
+	l.fields = append(l.fields, fields...)
+}
+
+func TestRecovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("panic", func(t *testing.T) {
+		logger := &errorLogger{Logger: log.NewNopLogger()}
+		metrics := NewMetrics("test")
+
+		var hookErr any
+		var hookStack []byte
+		hook := func(_ *http.Request, err any, stack []byte) {
+			hookErr = err
+			hookStack = stack
+		}
+
+		router := gin.New()
+		router.Use(NewRecovery(logger, metrics, hook))
+		router.GET("/", func(_ *gin.Context) {
+			panic("foo")
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.PanicsTotal))
+
+		assert.Equal(t, "foo", hookErr)
+		assert.Contains(t, string(hookStack), "goroutine")
+
+		var stack string
+		for _, f := range logger.fields {
+			if f.Key == "stack" {
+				stack = string(f.Interface.([]byte))
+			}
+		}
+		assert.Contains(t, stack, "goroutine")
+	})
+
+	t.Run("abort handler", func(t *testing.T) {
+		logger := &errorLogger{Logger: log.NewNopLogger()}
+
+		router := gin.New()
+		router.Use(NewRecovery(logger, nil, nil))
+		router.GET("/", func(_ *gin.Context) {
+			panic(http.ErrAbortHandler)
+		})
+
+		// http.ErrAbortHandler must be re-panicked for the server to abort
+		// the response.
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			router.ServeHTTP(
+				httptest.NewRecorder(),
+				httptest.NewRequest(http.MethodGet, "/", nil),
+			)
+		})
+		assert.Empty(t, logger.fields)
+	})
+}
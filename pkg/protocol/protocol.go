@@ -0,0 +1,23 @@
+// Package protocol contains the control messages sent between upstream
+// listeners and the Piko server.
+//
+// Control messages are sent on a stream opened by the listener over the
+// listener connection. Since the server only ever opens streams to forward
+// connections to the listener, any stream opened by the listener is a control
+// stream.
+package protocol
+
+// MessageType identifies a control message.
+type MessageType byte
+
+const (
+	// MessageTypeDrain is sent by a listener to request the server stops
+	// routing new connections to the listener. The server replies with
+	// MessageTypeDrain once the listener is draining.
+	MessageTypeDrain MessageType = 1
+
+	// MessageTypeResume is sent by a draining listener to request the server
+	// resumes routing new connections to the listener. The server replies
+	// with MessageTypeResume once the listener is active.
+	MessageTypeResume MessageType = 2
+)
@@ -0,0 +1,96 @@
+// Package requestmeta contains metadata about proxied requests, such as the
+// client IP and endpoint ID.
+//
+// Metadata is added to the request context by the Piko server, and
+// propagated to other Piko nodes and the agent using 'x-piko-meta-*'
+// headers.
+package requestmeta
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	headerPrefix = "x-piko-meta-"
+
+	clientIPHeader  = headerPrefix + "client-ip"
+	clientTLSHeader = headerPrefix + "client-tls"
+	endpointHeader  = headerPrefix + "endpoint"
+	forwardedHeader = headerPrefix + "forwarded"
+	requestIDHeader = headerPrefix + "request-id"
+)
+
+type contextKey struct{}
+
+// Metadata contains information about a proxied request.
+type Metadata struct {
+	// ClientIP is the IP of the client that sent the request to Piko.
+	//
+	// When the request is forwarded from another node, this is the client
+	// of the original request rather than the forwarding node.
+	ClientIP string
+
+	// ClientTLS indicates whether the client connected to Piko using TLS.
+	ClientTLS bool
+
+	// EndpointID is the ID of the endpoint the request is routed to.
+	EndpointID string
+
+	// Forwarded indicates whether the request was forwarded from another
+	// Piko node.
+	Forwarded bool
+
+	// RequestID is the ID of the request used to correlate logs.
+	RequestID string
+}
+
+// NewContext returns a copy of the context containing the given metadata.
+func NewContext(ctx context.Context, m Metadata) context.Context {
+	return context.WithValue(ctx, contextKey{}, m)
+}
+
+// FromContext returns the request metadata in the context, or false if the
+// context doesn't contain metadata.
+func FromContext(ctx context.Context) (Metadata, bool) {
+	m, ok := ctx.Value(contextKey{}).(Metadata)
+	return m, ok
+}
+
+// Inject adds the metadata to the given headers.
+func Inject(m Metadata, h http.Header) {
+	h.Set(clientIPHeader, m.ClientIP)
+	h.Set(clientTLSHeader, strconv.FormatBool(m.ClientTLS))
+	h.Set(endpointHeader, m.EndpointID)
+	h.Set(forwardedHeader, strconv.FormatBool(m.Forwarded))
+	h.Set(requestIDHeader, m.RequestID)
+}
+
+// Extract returns the metadata from the given headers, or false if the
+// headers don't contain metadata.
+//
+// Only headers from a trusted source, such as another Piko node, should be
+// extracted, since clients could set arbitrary values.
+func Extract(h http.Header) (Metadata, bool) {
+	if h.Get(endpointHeader) == "" {
+		return Metadata{}, false
+	}
+	return Metadata{
+		ClientIP:   h.Get(clientIPHeader),
+		ClientTLS:  h.Get(clientTLSHeader) == "true",
+		EndpointID: h.Get(endpointHeader),
+		Forwarded:  h.Get(forwardedHeader) == "true",
+		RequestID:  h.Get(requestIDHeader),
+	}, true
+}
+
+// Strip removes any metadata headers.
+func Strip(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(strings.ToLower(name), headerPrefix) {
+			h.Del(name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package requestmeta
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContext(t *testing.T) {
+	meta := Metadata{
+		ClientIP:   "10.0.0.1",
+		ClientTLS:  true,
+		EndpointID: "my-endpoint",
+		Forwarded:  true,
+		RequestID:  "my-request",
+	}
+	ctx := NewContext(context.Background(), meta)
+
+	m, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, meta, m)
+
+	_, ok = FromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestHeaders(t *testing.T) {
+	t.Run("inject and extract", func(t *testing.T) {
+		meta := Metadata{
+			ClientIP:   "fd00::1",
+			ClientTLS:  true,
+			EndpointID: "my-endpoint",
+			Forwarded:  true,
+			RequestID:  "my-request",
+		}
+
+		h := make(http.Header)
+		Inject(meta, h)
+
+		m, ok := Extract(h)
+		assert.True(t, ok)
+		assert.Equal(t, meta, m)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, ok := Extract(make(http.Header))
+		assert.False(t, ok)
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		h := make(http.Header)
+		Inject(Metadata{EndpointID: "my-endpoint"}, h)
+		h.Set("X-Piko-Meta-Unknown", "foo")
+		h.Set("X-Custom", "bar")
+
+		Strip(h)
+		assert.Equal(t, http.Header{"X-Custom": []string{"bar"}}, h)
+	})
+}
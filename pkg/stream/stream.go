@@ -0,0 +1,36 @@
+// Package stream detects long lived HTTP responses, which the Piko server and
+// agent exclude from request timeouts.
+package stream
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// IsStreaming returns whether the response is a long lived stream of events,
+// such as Server-Sent Events or a gRPC stream.
+//
+// Note httputil.ReverseProxy flushes streaming responses to the client after
+// each write from the upstream rather than buffering.
+func IsStreaming(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || isGRPC(mediaType)
+}
+
+// IsUnbounded returns whether the response body may be long lived, either
+// since the response is a stream or the response length is unknown, such as a
+// chunked response.
+//
+// Unlike streams, unbounded responses may be regular responses, so should
+// still be buffered, compressed and size limited as normal.
+func IsUnbounded(resp *http.Response) bool {
+	return IsStreaming(resp) || resp.ContentLength < 0
+}
+
+// isGRPC returns whether the media type is a gRPC content type, such as
+// 'application/grpc' or 'application/grpc+proto'.
+func isGRPC(mediaType string) bool {
+	return mediaType == "application/grpc" ||
+		strings.HasPrefix(mediaType, "application/grpc+")
+}
@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsStreaming(t *testing.T) {
+	tests := []struct {
+		contentType string
+		streaming   bool
+	}{
+		{"text/event-stream", true},
+		{"text/event-stream; charset=utf-8", true},
+		{"application/grpc", true},
+		{"application/grpc+proto", true},
+		{"application/json", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			resp := &http.Response{Header: make(http.Header)}
+			resp.Header.Set("Content-Type", tt.contentType)
+			assert.Equal(t, tt.streaming, IsStreaming(resp))
+		})
+	}
+}
+
+func TestIsUnbounded(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		resp := &http.Response{Header: make(http.Header), ContentLength: 10}
+		resp.Header.Set("Content-Type", "text/event-stream")
+		assert.True(t, IsUnbounded(resp))
+	})
+
+	t.Run("unknown length", func(t *testing.T) {
+		resp := &http.Response{Header: make(http.Header), ContentLength: -1}
+		assert.True(t, IsUnbounded(resp))
+	})
+
+	t.Run("known length", func(t *testing.T) {
+		resp := &http.Response{Header: make(http.Header), ContentLength: 10}
+		assert.False(t, IsUnbounded(resp))
+	})
+}
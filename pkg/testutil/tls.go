@@ -73,6 +73,119 @@ func LocalTLSServerCert() (*x509.CertPool, tls.Certificate, error) {
 	return rootCACertPool, serverTLSCert, nil
 }
 
+// LocalTLSClientCert creates a root CA and a client TLS certificate with the
+// given common name, signed by the root CA.
+func LocalTLSClientCert(commonName string) (*x509.CertPool, tls.Certificate, error) {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+	rootTemplate, err := certTemplate()
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("root cert template: %w", err)
+	}
+	// CA certificate.
+	rootTemplate.IsCA = true
+	rootTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	_, rootCert, err := cert(
+		rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey,
+	)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("root cert: %w", err)
+	}
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+	clientTemplate, err := certTemplate()
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("client cert template: %w", err)
+	}
+	clientTemplate.Subject.CommonName = commonName
+	clientTemplate.KeyUsage = x509.KeyUsageDigitalSignature
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	// Sign the cert using the root CA.
+	clientCertDER, _, err := cert(
+		clientTemplate, rootCert, &clientKey.PublicKey, rootKey,
+	)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("client cert: %w", err)
+	}
+
+	rootCACertPool := x509.NewCertPool()
+	rootCACertPool.AddCert(rootCert)
+
+	clientTLSCert := tls.Certificate{
+		Certificate: [][]byte{clientCertDER},
+		PrivateKey:  clientKey,
+	}
+
+	return rootCACertPool, clientTLSCert, nil
+}
+
+// LocalTLSPeerCert creates a root CA and a TLS certificate signed by the root
+// CA that is valid for both server and client authentication, such as for
+// peers that both accept and open connections to one another.
+func LocalTLSPeerCert() (*x509.CertPool, tls.Certificate, error) {
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+	rootTemplate, err := certTemplate()
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("root cert template: %w", err)
+	}
+	// CA certificate.
+	rootTemplate.IsCA = true
+	rootTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	rootTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
+
+	_, rootCert, err := cert(
+		rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey,
+	)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("root cert: %w", err)
+	}
+
+	peerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+	peerTemplate, err := certTemplate()
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("peer cert template: %w", err)
+	}
+	peerTemplate.KeyUsage = x509.KeyUsageDigitalSignature
+	peerTemplate.ExtKeyUsage = []x509.ExtKeyUsage{
+		x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+	}
+	peerTemplate.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+
+	// Sign the cert using the root CA.
+	peerCertDER, _, err := cert(
+		peerTemplate, rootCert, &peerKey.PublicKey, rootKey,
+	)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("peer cert: %w", err)
+	}
+
+	rootCACertPool := x509.NewCertPool()
+	rootCACertPool.AddCert(rootCert)
+
+	peerTLSCert := tls.Certificate{
+		Certificate: [][]byte{peerCertDER},
+		PrivateKey:  peerKey,
+	}
+
+	return rootCACertPool, peerTLSCert, nil
+}
+
 func cert(
 	template *x509.Certificate,
 	parent *x509.Certificate,
@@ -0,0 +1,55 @@
+// Package tracing contains shared utilities for tracing requests with
+// OpenTelemetry.
+//
+// Trace context is propagated between the proxy, other Piko nodes and the
+// agent using the W3C 'traceparent' header.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName = "github.com/andydunstall/piko"
+)
+
+// Span attributes.
+const (
+	// AttributeEndpointID is the ID of the endpoint the request is routed
+	// to.
+	AttributeEndpointID = attribute.Key("piko.endpoint_id")
+	// AttributeNodeID is the ID of the remote node the request is forwarded
+	// to.
+	AttributeNodeID = attribute.Key("piko.node_id")
+	// AttributeForward indicates whether the request is forwarded to a
+	// remote node rather than an upstream connected to the local node.
+	AttributeForward = attribute.Key("piko.forward")
+)
+
+var propagator = propagation.TraceContext{}
+
+// Tracer returns a tracer from the given provider. If the provider is nil,
+// spans are not recorded.
+func Tracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// Extract returns a context containing the trace context from the request
+// headers.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// Inject adds the trace context in the given context to the request headers.
+func Inject(ctx context.Context, h http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
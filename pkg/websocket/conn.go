@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -26,6 +27,11 @@ var retryableStatusCodes = map[int]struct{}{
 	http.StatusGatewayTimeout:      {},
 }
 
+// ErrWriteTimeout is returned when writing a message exceeds the configured
+// write timeout, such as if the peer stopped reading. The connection is
+// closed once a write times out.
+var ErrWriteTimeout = errors.New("write timeout")
+
 type errorMessage struct {
 	Error string `json:"error"`
 }
@@ -47,9 +53,25 @@ func (e *RetryableError) Error() string {
 	return e.err.Error()
 }
 
+// StatusError indicates the server rejected the WebSocket handshake with a
+// non-101 status code.
+type StatusError struct {
+	StatusCode int
+	err        error
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.err
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.err.Error())
+}
+
 type dialOptions struct {
-	token     string
-	tlsConfig *tls.Config
+	token        string
+	tlsConfig    *tls.Config
+	writeTimeout time.Duration
 }
 
 type DialOption interface {
@@ -78,6 +100,18 @@ func WithTLSConfig(config *tls.Config) DialOption {
 	return tlsConfigOption{TLSConfig: config}
 }
 
+type writeTimeoutOption time.Duration
+
+func (o writeTimeoutOption) apply(opts *dialOptions) {
+	opts.writeTimeout = time.Duration(o)
+}
+
+// WithWriteTimeout configures the connections write timeout. See
+// Conn.SetWriteTimeout.
+func WithWriteTimeout(timeout time.Duration) DialOption {
+	return writeTimeoutOption(timeout)
+}
+
 // Conn implements a [net.Conn] using WebSockets as the underlying transport.
 //
 // This adds a small amount of overhead compared to using TCP directly, though
@@ -86,6 +120,13 @@ type Conn struct {
 	wsConn *websocket.Conn
 
 	reader io.Reader
+
+	// writeTimeout is the maximum duration to write each message, or zero
+	// if there is no timeout.
+	writeTimeout time.Duration
+	// writeDeadline is the deadline set with SetWriteDeadline.
+	writeDeadline time.Time
+	writeMu       sync.Mutex
 }
 
 func New(wsConn *websocket.Conn) *Conn {
@@ -118,7 +159,9 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 		ctx, url, header,
 	)
 	if err == nil {
-		return New(wsConn), nil
+		conn := New(wsConn)
+		conn.SetWriteTimeout(options.writeTimeout)
+		return conn, nil
 	}
 	if resp == nil {
 		return nil, NewRetryableError(err)
@@ -133,7 +176,10 @@ func Dial(ctx context.Context, url string, opts ...DialOption) (*Conn, error) {
 		}
 	}
 
-	err = fmt.Errorf("%d: %w", resp.StatusCode, err)
+	err = &StatusError{
+		StatusCode: resp.StatusCode,
+		err:        err,
+	}
 	if _, ok := retryableStatusCodes[resp.StatusCode]; ok {
 		return nil, NewRetryableError(err)
 	}
@@ -181,7 +227,34 @@ func (c *Conn) Read(b []byte) (int, error) {
 }
 
 func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	timeout := c.writeTimeout
+	deadline := c.writeDeadline
+	c.writeMu.Unlock()
+
+	// Apply the write timeout if it expires before any deadline set with
+	// SetWriteDeadline.
+	timeoutApplied := false
+	if timeout != 0 {
+		timeoutDeadline := time.Now().Add(timeout)
+		if deadline.IsZero() || timeoutDeadline.Before(deadline) {
+			deadline = timeoutDeadline
+			timeoutApplied = true
+		}
+		if err := c.wsConn.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+
 	if err := c.wsConn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		var netErr net.Error
+		if timeoutApplied && errors.As(err, &netErr) && netErr.Timeout() {
+			// The write may have been partially written so the connection
+			// can't be used.
+			_ = c.wsConn.Close()
+			return 0, fmt.Errorf("%w: %s", ErrWriteTimeout, timeout)
+		}
+
 		var closeErr *websocket.CloseError
 		if errors.As(err, &closeErr) {
 			return 0, net.ErrClosed
@@ -195,6 +268,20 @@ func (c *Conn) Close() error {
 	return c.wsConn.Close()
 }
 
+// CloseGoingAway sends a close message indicating the connection is closing
+// because the peer is going away, such as the server shutting down, then
+// closes the connection.
+func (c *Conn) CloseGoingAway(reason string) error {
+	// Ignore errors sending the close message as the connection is closed
+	// anyway.
+	_ = c.wsConn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+		time.Now().Add(time.Second),
+	)
+	return c.wsConn.Close()
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.wsConn.LocalAddr()
 }
@@ -217,7 +304,27 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	c.writeDeadline = t
+	c.writeMu.Unlock()
+
 	return c.wsConn.SetWriteDeadline(t)
 }
 
+// SetWriteTimeout sets the maximum duration to write each message.
+//
+// If a write doesn't complete within the timeout, such as the peer stopped
+// reading, the connection is closed and Write returns ErrWriteTimeout.
+// Otherwise a stalled peer could block writes indefinitely.
+//
+// If a deadline set with SetWriteDeadline expires first, the write fails
+// with a timeout error as usual without closing the connection. A timeout of
+// zero means writes don't time out.
+func (c *Conn) SetWriteTimeout(timeout time.Duration) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeTimeout = timeout
+}
+
 var _ net.Conn = &Conn{}
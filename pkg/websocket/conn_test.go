@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStalledServer returns a WebSocket server that accepts connections but
+// never reads from them.
+func newStalledServer(t *testing.T) *httptest.Server {
+	upgrader := &websocket.Upgrader{}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			<-done
+		},
+	))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return server
+}
+
+func TestConn_WriteTimeout(t *testing.T) {
+	t.Run("peer stopped reading", func(t *testing.T) {
+		server := newStalledServer(t)
+
+		conn, err := Dial(
+			context.TODO(),
+			"ws"+strings.TrimPrefix(server.URL, "http"),
+			WithWriteTimeout(time.Millisecond*100),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// Write until the TCP buffers are full and the write times out.
+		b := make([]byte, 1<<20)
+		start := time.Now()
+		for {
+			_, err = conn.Write(b)
+			if err != nil {
+				break
+			}
+			require.Less(t, time.Since(start), time.Second*10)
+		}
+		assert.ErrorIs(t, err, ErrWriteTimeout)
+
+		// The connection is closed.
+		_, err = conn.Write([]byte("foo"))
+		assert.Error(t, err)
+		_, err = conn.Read(make([]byte, 10))
+		assert.Error(t, err)
+	})
+
+	t.Run("write deadline", func(t *testing.T) {
+		server := newStalledServer(t)
+
+		conn, err := Dial(
+			context.TODO(),
+			"ws"+strings.TrimPrefix(server.URL, "http"),
+			WithWriteTimeout(time.Minute),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// An earlier deadline set with SetWriteDeadline takes precedence, so
+		// fails with a regular timeout error.
+		require.NoError(t, conn.SetWriteDeadline(time.Now().Add(time.Millisecond*100)))
+
+		b := make([]byte, 1<<20)
+		for {
+			_, err = conn.Write(b)
+			if err != nil {
+				break
+			}
+		}
+		assert.False(t, errors.Is(err, ErrWriteTimeout))
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+	})
+}
@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/auth"
+)
+
+// authenticate verifies the request bearer token.
+//
+// If the token is invalid, returns 401 to the client.
+func (s *Server) authenticate(c *gin.Context) {
+	authorization := c.Request.Header.Get("Authorization")
+	authType, tokenString, ok := strings.Cut(authorization, " ")
+	if !ok {
+		s.logger.Warn("missing authorization header")
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{"error": "missing authorization"},
+		)
+		return
+	}
+	if authType != "Bearer" {
+		s.logger.Warn(
+			"unsupported auth type",
+			zap.String("auth-type", authType),
+		)
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{"error": "unsupported auth type"},
+		)
+		return
+	}
+
+	if _, err := s.verifier.VerifyEndpointToken(tokenString); err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			s.logger.Warn("auth invalid token", zap.Error(err))
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"error": "invalid token"},
+			)
+			return
+		}
+		if errors.Is(err, auth.ErrExpiredToken) {
+			s.logger.Warn("auth expired token", zap.Error(err))
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"error": "expired token"},
+			)
+			return
+		}
+
+		s.logger.Warn("unknown verification error", zap.Error(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Next()
+}
@@ -0,0 +1,22 @@
+package admin
+
+type options struct {
+	pprof bool
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type pprofOption bool
+
+func (o pprofOption) apply(opts *options) {
+	opts.pprof = bool(o)
+}
+
+// WithPprof configures whether to serve pprof profiles at '/debug/pprof'.
+//
+// If not set (the default) profiles are not served.
+func WithPprof(enabled bool) Option {
+	return pprofOption(enabled)
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
@@ -67,12 +69,19 @@ type errorMessage struct {
 }
 
 func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
+	m := &errorMessage{
+		Error: message,
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode error message: %w", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(statusCode)
 
-	m := &errorMessage{
-		Error: message,
-	}
-	return json.NewEncoder(w).Encode(m)
+	_, err = w.Write(b)
+	return err
 }
@@ -16,6 +16,8 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status"
 )
@@ -27,23 +29,42 @@ type Server struct {
 
 	ready *atomic.Bool
 
+	// readyChecks are additional checks that must pass for the node to be
+	// ready.
+	readyChecks []func() bool
+
 	registry *prometheus.Registry
 
 	proxy *ReverseProxy
 
+	// verifier authenticates status requests. If nil status requests are
+	// not authenticated.
+	verifier auth.Verifier
+
 	httpServer *http.Server
 
 	router *gin.Engine
 
+	statusGroup *gin.RouterGroup
+
+	options options
+
 	logger log.Logger
 }
 
 func NewServer(
 	clusterState *cluster.State,
 	registry *prometheus.Registry,
+	verifier auth.Verifier,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("admin")
 
 	router := gin.New()
@@ -52,17 +73,19 @@ func NewServer(
 		ready:        atomic.NewBool(false),
 		registry:     registry,
 		proxy:        NewReverseProxy(logger),
+		verifier:     verifier,
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
 			ErrorLog:  logger.StdLogger(zapcore.WarnLevel),
 		},
-		router: router,
-		logger: logger,
+		router:  router,
+		options: options,
+		logger:  logger,
 	}
 
 	// Recover from panics.
-	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
+	router.Use(middleware.NewRecovery(server.logger, nil, nil))
 
 	if clusterState != nil {
 		router.Use(server.forwardInterceptor)
@@ -99,7 +122,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 func (s *Server) AddStatus(route string, handler status.Handler) {
-	group := s.router.Group("/status").Group(route)
+	group := s.statusGroup.Group(route)
 	handler.Register(group)
 }
 
@@ -107,16 +130,46 @@ func (s *Server) SetReady(ready bool) {
 	s.ready.Store(ready)
 }
 
+// AddReadyCheck adds a check that must return true for the node to be ready.
+//
+// Must be called before the server is started.
+func (s *Server) AddReadyCheck(check func() bool) {
+	s.readyChecks = append(s.readyChecks, check)
+}
+
 func (s *Server) registerRoutes(router *gin.Engine) {
-	router.GET("/health", s.healthRoute)
+	router.GET("/health/live", s.liveRoute)
+	router.GET("/health/ready", s.readyRoute)
+
+	// Aliases for compatibility.
+	router.GET("/health", s.liveRoute)
 	router.GET("/ready", s.readyRoute)
 
+	// Status routes may inspect and modify the node state so require
+	// authentication when configured.
+	s.statusGroup = router.Group("/status")
+	if s.verifier != nil {
+		s.statusGroup.Use(s.authenticate)
+	}
+
 	if s.registry != nil {
 		router.GET("/metrics", s.metricsHandler())
 	}
 
+	if s.options.pprof {
+		s.registerPprofRoutes(router)
+	}
+}
+
+func (s *Server) registerPprofRoutes(router *gin.Engine) {
+	// Profiles expose sensitive information about the node so require
+	// authentication when configured.
+	pprofGroup := router.Group("/debug/pprof")
+	if s.verifier != nil {
+		pprofGroup.Use(s.authenticate)
+	}
+
 	// From https://github.com/gin-contrib/pprof/blob/934af36b21728278339704005bcef2eec1375091/pprof.go#L32.
-	pprofGroup := s.router.Group("/debug/pprof")
 	pprofGroup.GET("/", gin.WrapF(pprof.Index))
 	pprofGroup.GET("/cmdline", gin.WrapF(pprof.Cmdline))
 	pprofGroup.GET("/profile", gin.WrapF(pprof.Profile))
@@ -131,15 +184,25 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 	pprofGroup.GET("/threadcreate", gin.WrapH(pprof.Handler("threadcreate")))
 }
 
-func (s *Server) healthRoute(c *gin.Context) {
+// liveRoute returns 200 if the process is up.
+func (s *Server) liveRoute(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// readyRoute returns 200 if the node is ready to serve traffic, otherwise
+// 503. The node is ready once it has joined the cluster and started serving,
+// and is not ready once it starts shutting down or any ready check fails.
 func (s *Server) readyRoute(c *gin.Context) {
 	if !s.ready.Load() {
 		c.Status(http.StatusServiceUnavailable)
 		return
 	}
+	for _, check := range s.readyChecks {
+		if !check() {
+			c.Status(http.StatusServiceUnavailable)
+			return
+		}
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -168,15 +231,6 @@ func (s *Server) forwardInterceptor(c *gin.Context) {
 	c.Abort()
 }
 
-func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
-	c.AbortWithStatus(http.StatusInternalServerError)
-}
-
 func (s *Server) metricsHandler() gin.HandlerFunc {
 	h := promhttp.HandlerFor(
 		s.registry,
@@ -13,9 +13,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/testutil"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/server/status"
 )
@@ -41,6 +43,7 @@ func TestServer_AdminRoutes(t *testing.T) {
 		nil,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	go func() {
@@ -48,21 +51,56 @@ func TestServer_AdminRoutes(t *testing.T) {
 	}()
 	defer s.Shutdown(context.TODO())
 
-	t.Run("health", func(t *testing.T) {
-		url := fmt.Sprintf("http://%s/health", ln.Addr().String())
-		resp, err := http.Get(url)
-		assert.NoError(t, err)
-		defer resp.Body.Close()
+	t.Run("live", func(t *testing.T) {
+		for _, path := range []string{"/health/live", "/health"} {
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
 
-		assert.Equal(t, http.StatusOK, resp.StatusCode)
+			// Liveness doesn't depend on readiness.
+			s.SetReady(false)
+
+			resp, err := http.Get(url)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
 	})
 
 	t.Run("ready", func(t *testing.T) {
-		url := fmt.Sprintf("http://%s/ready", ln.Addr().String())
+		for _, path := range []string{"/health/ready", "/ready"} {
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+
+			// Not ready.
+
+			s.SetReady(false)
+
+			resp, err := http.Get(url)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
 
-		// Not ready.
+			// Ready.
 
-		s.SetReady(false)
+			s.SetReady(true)
+
+			resp, err = http.Get(url)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("ready check", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/health/ready", ln.Addr().String())
+
+		s.SetReady(true)
+		checkOK := atomic.NewBool(false)
+		s.AddReadyCheck(checkOK.Load)
+		defer func() {
+			s.readyChecks = nil
+		}()
 
 		resp, err := http.Get(url)
 		assert.NoError(t, err)
@@ -70,9 +108,7 @@ func TestServer_AdminRoutes(t *testing.T) {
 
 		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
 
-		// Ready.
-
-		s.SetReady(true)
+		checkOK.Store(true)
 
 		resp, err = http.Get(url)
 		assert.NoError(t, err)
@@ -108,6 +144,7 @@ func TestServer_StatusRoutes(t *testing.T) {
 		nil,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	s.AddStatus("/mystatus", &fakeStatus{})
@@ -141,6 +178,187 @@ func TestServer_StatusRoutes(t *testing.T) {
 	})
 }
 
+func TestServer_Pprof(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			nil,
+			prometheus.NewRegistry(),
+			nil,
+			nil,
+			log.NewNopLogger(),
+			WithPprof(true),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		for _, path := range []string{
+			"/debug/pprof/",
+			"/debug/pprof/goroutine",
+			"/debug/pprof/heap",
+			"/debug/pprof/cmdline",
+		} {
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+			resp, err := http.Get(url)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		s := NewServer(
+			nil,
+			prometheus.NewRegistry(),
+			nil,
+			nil,
+			log.NewNopLogger(),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		for _, path := range []string{
+			"/debug/pprof/",
+			"/debug/pprof/goroutine",
+		} {
+			url := fmt.Sprintf("http://%s%s", ln.Addr().String(), path)
+			resp, err := http.Get(url)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		verifier := &fakeVerifier{
+			handler: func(token string) (auth.EndpointToken, error) {
+				if token != "123" {
+					return auth.EndpointToken{}, auth.ErrInvalidToken
+				}
+				return auth.EndpointToken{}, nil
+			},
+		}
+		s := NewServer(
+			nil,
+			prometheus.NewRegistry(),
+			verifier,
+			nil,
+			log.NewNopLogger(),
+			WithPprof(true),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("http://%s/debug/pprof/goroutine", ln.Addr().String())
+
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer 123")
+		resp, err = http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+type fakeVerifier struct {
+	handler func(token string) (auth.EndpointToken, error)
+}
+
+func (v *fakeVerifier) VerifyEndpointToken(token string) (auth.EndpointToken, error) {
+	return v.handler(token)
+}
+
+var _ auth.Verifier = &fakeVerifier{}
+
+func TestServer_StatusAuth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	verifier := &fakeVerifier{
+		handler: func(token string) (auth.EndpointToken, error) {
+			if token != "123" {
+				return auth.EndpointToken{}, auth.ErrInvalidToken
+			}
+			return auth.EndpointToken{}, nil
+		},
+	}
+	s := NewServer(
+		nil,
+		prometheus.NewRegistry(),
+		verifier,
+		nil,
+		log.NewNopLogger(),
+	)
+	s.AddStatus("/mystatus", &fakeStatus{})
+
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	t.Run("authenticated", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/status/mystatus/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer 123")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/status/mystatus/foo", ln.Addr().String())
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer 456")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/status/mystatus/foo", ln.Addr().String())
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	// Tests the health route doesn't require authentication.
+	t.Run("health", func(t *testing.T) {
+		url := fmt.Sprintf("http://%s/health", ln.Addr().String())
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
 // TestServer_Forward tests forwarding an admin request to another node
 // in the cluster.
 func TestServer_Forward(t *testing.T) {
@@ -156,6 +374,7 @@ func TestServer_Forward(t *testing.T) {
 		state1,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 	// Note only node 1 registers the status route.
@@ -182,6 +401,7 @@ func TestServer_Forward(t *testing.T) {
 		state2,
 		prometheus.NewRegistry(),
 		nil,
+		nil,
 		log.NewNopLogger(),
 	)
 
@@ -227,6 +447,7 @@ func TestServer_TLS(t *testing.T) {
 	s := NewServer(
 		nil,
 		prometheus.NewRegistry(),
+		nil,
 		tlsConfig,
 		log.NewNopLogger(),
 	)
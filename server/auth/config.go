@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/spf13/pflag"
 )
 
@@ -9,6 +13,11 @@ type Config struct {
 	// connection JWTs.
 	TokenHMACSecretKey string `json:"token_hmac_secret_key" yaml:"token_hmac_secret_key"`
 
+	// TokenHMACSecretKeys contains additional secret keys to authenticate
+	// HMAC endpoint connection JWTs. A JWT is valid if it verifies with any
+	// key, which allows rotating keys without downtime.
+	TokenHMACSecretKeys []string `json:"token_hmac_secret_keys" yaml:"token_hmac_secret_keys"`
+
 	// TokenRSAPublicKey is the public key to authenticate RSA endpoint
 	// connection JWTs.
 	TokenRSAPublicKey string `json:"token_rsa_public_key" yaml:"token_rsa_public_key"`
@@ -17,6 +26,14 @@ type Config struct {
 	// connection JWTs.
 	TokenECDSAPublicKey string `json:"token_ecdsa_public_key" yaml:"token_ecdsa_public_key"`
 
+	// TokenJWKSURL is the URL of a JSON Web Key Set containing public keys
+	// to authenticate RSA and ECDSA endpoint connection JWTs.
+	TokenJWKSURL string `json:"token_jwks_url" yaml:"token_jwks_url"`
+
+	// TokenJWKSRefreshInterval is the interval to refresh the cached JSON
+	// Web Key Set.
+	TokenJWKSRefreshInterval time.Duration `json:"token_jwks_refresh_interval" yaml:"token_jwks_refresh_interval"`
+
 	// TokenAudience is the required 'aud' claim of the authenticated JWTs.
 	//
 	// If not given the 'aud' claim will be ignored.
@@ -26,10 +43,82 @@ type Config struct {
 	//
 	// If not given the 'iss' claim will be ignored.
 	TokenIssuer string `json:"token_issuer" yaml:"token_issuer"`
+
+	// TokenIssuers contains additional valid 'iss' claims of the
+	// authenticated JWTs. A JWT is valid if its 'iss' claim matches
+	// TokenIssuer or any of TokenIssuers.
+	TokenIssuers []string `json:"token_issuers" yaml:"token_issuers"`
+
+	// TokenLeeway is the allowed clock skew when verifying the 'exp', 'nbf'
+	// and 'iat' claims of the authenticated JWTs.
+	TokenLeeway time.Duration `json:"token_leeway" yaml:"token_leeway"`
+
+	// TokenRequireEndpoints indicates whether JWTs without a 'piko.endpoints'
+	// claim are denied from registering any endpoints. If false, such JWTs
+	// may register any endpoint.
+	TokenRequireEndpoints bool `json:"token_require_endpoints" yaml:"token_require_endpoints"`
+}
+
+func (c *Config) Validate() error {
+	if c.TokenJWKSURL != "" && c.TokenJWKSRefreshInterval <= 0 {
+		return fmt.Errorf("missing jwks refresh interval")
+	}
+	if c.TokenLeeway < 0 {
+		return fmt.Errorf("negative token leeway")
+	}
+	return nil
 }
 
 func (c *Config) AuthEnabled() bool {
-	return c.TokenHMACSecretKey != "" || c.TokenRSAPublicKey != "" || c.TokenECDSAPublicKey != ""
+	return c.TokenHMACSecretKey != "" ||
+		len(c.TokenHMACSecretKeys) > 0 ||
+		c.TokenRSAPublicKey != "" ||
+		c.TokenECDSAPublicKey != "" ||
+		c.TokenJWKSURL != ""
+}
+
+// Load returns a verifier for the configured keys.
+func (c *Config) Load() (*JWTVerifier, error) {
+	verifierConf := JWTVerifierConfig{
+		HMACSecretKey: []byte(c.TokenHMACSecretKey),
+		Audience:      c.TokenAudience,
+		Issuer:        c.TokenIssuer,
+		Issuers:       c.TokenIssuers,
+		Leeway:        c.TokenLeeway,
+
+		RequireEndpoints: c.TokenRequireEndpoints,
+	}
+
+	if c.TokenRSAPublicKey != "" {
+		rsaPublicKey, err := jwt.ParseRSAPublicKeyFromPEM(
+			[]byte(c.TokenRSAPublicKey),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("parse rsa public key: %w", err)
+		}
+		verifierConf.RSAPublicKey = rsaPublicKey
+	}
+	if c.TokenECDSAPublicKey != "" {
+		ecdsaPublicKey, err := jwt.ParseECPublicKeyFromPEM(
+			[]byte(c.TokenECDSAPublicKey),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("parse ecdsa public key: %w", err)
+		}
+		verifierConf.ECDSAPublicKey = ecdsaPublicKey
+	}
+	for _, key := range c.TokenHMACSecretKeys {
+		verifierConf.HMACSecretKeys = append(
+			verifierConf.HMACSecretKeys, []byte(key),
+		)
+	}
+	if c.TokenJWKSURL != "" {
+		verifierConf.JWKS = NewJWKS(
+			c.TokenJWKSURL,
+			c.TokenJWKSRefreshInterval,
+		)
+	}
+	return NewJWTVerifier(verifierConf), nil
 }
 
 func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
@@ -39,6 +128,17 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 		c.TokenHMACSecretKey,
 		`
 Secret key to authenticate HMAC endpoint connection JWTs.`,
+	)
+	fs.StringSliceVar(
+		&c.TokenHMACSecretKeys,
+		"auth.token-hmac-secret-keys",
+		c.TokenHMACSecretKeys,
+		`
+Additional secret keys to authenticate HMAC endpoint connection JWTs.
+
+A JWT is valid if it verifies with any of the configured keys. To rotate a
+key without downtime, add the new key, update agents to use tokens signed
+with the new key, then remove the old key.`,
 	)
 	fs.StringVar(
 		&c.TokenRSAPublicKey,
@@ -53,6 +153,25 @@ Public key to authenticate RSA endpoint connection JWTs.`,
 		c.TokenECDSAPublicKey,
 		`
 Public key to authenticate ECDSA endpoint connection JWTs.`,
+	)
+	fs.StringVar(
+		&c.TokenJWKSURL,
+		"auth.token-jwks-url",
+		c.TokenJWKSURL,
+		`
+URL of a JSON Web Key Set (JWKS) containing the public keys to authenticate
+RSA and ECDSA endpoint connection JWTs.
+
+The key is selected using the JWT 'kid' header. The key set is cached and
+refreshed periodically, and also when a JWT references an unknown key ID,
+so keys can be rotated by adding the new key to the key set.`,
+	)
+	fs.DurationVar(
+		&c.TokenJWKSRefreshInterval,
+		"auth.token-jwks-refresh-interval",
+		c.TokenJWKSRefreshInterval,
+		`
+Interval to refresh the cached JSON Web Key Set.`,
 	)
 	fs.StringVar(
 		&c.TokenAudience,
@@ -74,4 +193,38 @@ Issuer of endpoint connection JWT token to verify.
 If given the JWT 'iss' claim must match the given issuer. Otherwise it
 is ignored.`,
 	)
+	fs.StringSliceVar(
+		&c.TokenIssuers,
+		"auth.token-issuers",
+		c.TokenIssuers,
+		`
+Additional issuers of endpoint connection JWT tokens to verify.
+
+If given the JWT 'iss' claim must match either '--auth.token-issuer' or any
+of the given issuers.`,
+	)
+	fs.DurationVar(
+		&c.TokenLeeway,
+		"auth.token-leeway",
+		c.TokenLeeway,
+		`
+Allowed clock skew when verifying the 'exp', 'nbf' and 'iat' claims of
+endpoint connection JWTs.
+
+Such as with a leeway of 30s, a JWT that expired less than 30s ago is still
+accepted.`,
+	)
+	fs.BoolVar(
+		&c.TokenRequireEndpoints,
+		"auth.token-require-endpoints",
+		c.TokenRequireEndpoints,
+		`
+Whether endpoint connection JWTs must include a 'piko.endpoints' claim
+listing the endpoints the connection may register.
+
+The claim contains a list of endpoint IDs, where an endpoint ID ending with
+'*' permits all endpoints with the given prefix, such as 'team-a-*'.
+
+By default, JWTs without the claim may register any endpoint.`,
+	)
 }
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefreshInterval is the minimum interval between fetching the JWKS
+// when a token references an unknown key ID, to avoid tokens with invalid
+// key IDs causing a fetch on every request.
+const jwksMinRefreshInterval = time.Second * 10
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA parameters.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// ECDSA parameters.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// JWKS fetches and caches the public keys from a JSON Web Key Set URL.
+//
+// Keys are looked up by key ID ('kid'). The key set is refreshed once the
+// refresh interval has elapsed, or when a token references an unknown key ID
+// to support key rotation.
+type JWKS struct {
+	url string
+
+	refreshInterval time.Duration
+	// minRefreshInterval is the minimum interval between attempts to
+	// refresh the key set, such as when a token references an unknown key
+	// ID or the previous refresh failed.
+	minRefreshInterval time.Duration
+
+	// keys contains the public keys in the key set, keyed by key ID.
+	keys map[string]interface{}
+	// fetchedAt is the time the key set was last fetched.
+	fetchedAt time.Time
+	// attemptedAt is the time of the last attempt to fetch the key set,
+	// including failed attempts.
+	attemptedAt time.Time
+	// err is the error from the last attempt to fetch the key set, or nil
+	// if the last attempt succeeded.
+	err error
+
+	mu sync.Mutex
+
+	// refreshGroup ensures only one refresh is in progress, which
+	// concurrent lookups wait for. The key set is fetched without holding
+	// mu, so lookups of cached keys aren't blocked.
+	refreshGroup singleflight.Group
+
+	client *http.Client
+}
+
+func NewJWKS(url string, refreshInterval time.Duration) *JWKS {
+	return &JWKS{
+		url:                url,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: jwksMinRefreshInterval,
+		keys:               make(map[string]interface{}),
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+// Key returns the public key with the given key ID.
+func (j *JWKS) Key(kid string) (interface{}, error) {
+	j.mu.Lock()
+	stale := j.fetchedAt.IsZero() || time.Since(j.fetchedAt) > j.refreshInterval
+	key, ok := j.keys[kid]
+	j.mu.Unlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	// If the key set is stale or the key ID is unknown, refresh the key set
+	// in case a new key has been added. If the refresh fails the cached key
+	// is used if we have it.
+	// nolint
+	j.refreshGroup.Do("refresh", func() (interface{}, error) {
+		j.refresh()
+		return nil, nil
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key, ok = j.keys[kid]
+	if ok {
+		return key, nil
+	}
+	if j.err != nil {
+		return nil, fmt.Errorf("refresh jwks: %w", j.err)
+	}
+	return nil, fmt.Errorf("unknown key id: %s", kid)
+}
+
+// refresh fetches the key set, unless the last attempt was within the
+// minimum refresh interval.
+func (j *JWKS) refresh() {
+	j.mu.Lock()
+	if !j.attemptedAt.IsZero() && time.Since(j.attemptedAt) < j.minRefreshInterval {
+		j.mu.Unlock()
+		return
+	}
+	// Record the attempt before fetching so failed fetches also back off.
+	j.attemptedAt = time.Now()
+	j.mu.Unlock()
+
+	keys, err := j.fetch()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.err = err
+	if err != nil {
+		return
+	}
+	j.keys = keys
+	j.fetchedAt = time.Now()
+}
+
+func (j *JWKS) fetch() (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request: bad status: %d", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		// Ignore keys that aren't for signatures.
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Ignore unsupported keys rather than failing the whole set.
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: n,
+			E: int(e.Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     x,
+			Y:     y,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+)
+
+// fakeJWKSServer serves a JSON Web Key Set that can be updated.
+type fakeJWKSServer struct {
+	server *httptest.Server
+
+	keys []jwk
+	mu   sync.Mutex
+}
+
+func newFakeJWKSServer() *fakeJWKSServer {
+	s := &fakeJWKSServer{}
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			// nolint
+			json.NewEncoder(w).Encode(jwkSet{Keys: s.keys})
+		},
+	))
+	return s
+}
+
+func (s *fakeJWKSServer) SetKeys(keys ...jwk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = keys
+}
+
+func (s *fakeJWKSServer) URL() string {
+	return s.server.URL
+}
+
+func (s *fakeJWKSServer) Close() {
+	s.server.Close()
+}
+
+func TestJWTVerifier_JWKS(t *testing.T) {
+	endpointClaims := endpointJWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Piko: pikoEndpointClaims{
+			Endpoints: []string{"my-endpoint"},
+		},
+	}
+
+	t.Run("rs256", func(t *testing.T) {
+		privateKey, publicKey := generateTestRSAKeys(t)
+
+		server := newFakeJWKSServer()
+		defer server.Close()
+		server.SetKeys(rsaJWK("key-1", publicKey))
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, endpointClaims)
+		token.Header["kid"] = "key-1"
+		tokenString, err := token.SignedString(privateKey)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			JWKS: NewJWKS(server.URL(), time.Hour),
+		})
+		parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"my-endpoint"}, parsedToken.Endpoints)
+	})
+
+	t.Run("es256", func(t *testing.T) {
+		privateKey, publicKey := generateTestECDSAKeys(elliptic.P256(), t)
+
+		server := newFakeJWKSServer()
+		defer server.Close()
+		server.SetKeys(ecdsaJWK("key-1", "P-256", publicKey))
+
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, endpointClaims)
+		token.Header["kid"] = "key-1"
+		tokenString, err := token.SignedString(privateKey)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			JWKS: NewJWKS(server.URL(), time.Hour),
+		})
+		parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"my-endpoint"}, parsedToken.Endpoints)
+	})
+
+	t.Run("key rollover", func(t *testing.T) {
+		privateKey1, publicKey1 := generateTestRSAKeys(t)
+		privateKey2, publicKey2 := generateTestRSAKeys(t)
+
+		server := newFakeJWKSServer()
+		defer server.Close()
+		server.SetKeys(rsaJWK("key-1", publicKey1))
+
+		jwks := NewJWKS(server.URL(), time.Hour)
+		jwks.minRefreshInterval = 0
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			JWKS: jwks,
+		})
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, endpointClaims)
+		token.Header["kid"] = "key-1"
+		tokenString, err := token.SignedString(privateKey1)
+		assert.NoError(t, err)
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+
+		// Rotate to a new key. Even though the cached key set hasn't
+		// expired, the unknown key ID triggers a refresh.
+		server.SetKeys(rsaJWK("key-1", publicKey1), rsaJWK("key-2", publicKey2))
+
+		token = jwt.NewWithClaims(jwt.SigningMethodRS256, endpointClaims)
+		token.Header["kid"] = "key-2"
+		tokenString, err = token.SignedString(privateKey2)
+		assert.NoError(t, err)
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknown key id", func(t *testing.T) {
+		privateKey, publicKey := generateTestRSAKeys(t)
+
+		server := newFakeJWKSServer()
+		defer server.Close()
+		server.SetKeys(rsaJWK("key-1", publicKey))
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, endpointClaims)
+		token.Header["kid"] = "unknown"
+		tokenString, err := token.SignedString(privateKey)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			JWKS: NewJWKS(server.URL(), time.Hour),
+		})
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.Equal(t, ErrInvalidToken, err)
+	})
+
+	// Tests a key with the wrong type for the algorithm is rejected.
+	t.Run("key type mismatch", func(t *testing.T) {
+		privateKey, _ := generateTestRSAKeys(t)
+		_, ecdsaPublicKey := generateTestECDSAKeys(elliptic.P256(), t)
+
+		server := newFakeJWKSServer()
+		defer server.Close()
+		server.SetKeys(ecdsaJWK("key-1", "P-256", ecdsaPublicKey))
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, endpointClaims)
+		token.Header["kid"] = "key-1"
+		tokenString, err := token.SignedString(privateKey)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			JWKS: NewJWKS(server.URL(), time.Hour),
+		})
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.Equal(t, ErrInvalidToken, err)
+	})
+}
+
+func TestJWKS_Refresh(t *testing.T) {
+	// Tests a failed refresh backs off rather than fetching the key set on
+	// every lookup.
+	t.Run("backoff on failure", func(t *testing.T) {
+		var requests atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				requests.Inc()
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		))
+		defer server.Close()
+
+		jwks := NewJWKS(server.URL, time.Hour)
+		for i := 0; i != 5; i++ {
+			_, err := jwks.Key("key-1")
+			assert.ErrorContains(t, err, "refresh jwks: request: bad status: 500")
+		}
+		assert.Equal(t, int64(1), requests.Load())
+
+		// Once the backoff elapses the key set is fetched again.
+		jwks.minRefreshInterval = 0
+		_, err := jwks.Key("key-1")
+		assert.Error(t, err)
+		assert.Equal(t, int64(2), requests.Load())
+	})
+
+	// Tests a failed refresh uses the cached key.
+	t.Run("stale key", func(t *testing.T) {
+		_, publicKey := generateTestRSAKeys(t)
+
+		server := newFakeJWKSServer()
+		server.SetKeys(rsaJWK("key-1", publicKey))
+
+		jwks := NewJWKS(server.URL(), 0)
+		jwks.minRefreshInterval = 0
+		key, err := jwks.Key("key-1")
+		require.NoError(t, err)
+
+		server.Close()
+
+		staleKey, err := jwks.Key("key-1")
+		assert.NoError(t, err)
+		assert.Equal(t, key, staleKey)
+	})
+
+	// Tests concurrent lookups share a single fetch, and lookups of cached
+	// keys aren't blocked by the fetch.
+	t.Run("concurrent lookups", func(t *testing.T) {
+		_, publicKey := generateTestRSAKeys(t)
+
+		var requests atomic.Int64
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				if requests.Inc() > 1 {
+					<-blockCh
+				}
+				// nolint
+				json.NewEncoder(w).Encode(jwkSet{
+					Keys: []jwk{rsaJWK("key-1", publicKey)},
+				})
+			},
+		))
+		defer server.Close()
+
+		jwks := NewJWKS(server.URL, time.Hour)
+		_, err := jwks.Key("key-1")
+		require.NoError(t, err)
+		// Reset the last attempt so the next lookup refreshes.
+		jwks.attemptedAt = time.Time{}
+
+		// Lookups of an unknown key block on the refresh.
+		var wg sync.WaitGroup
+		for i := 0; i != 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := jwks.Key("unknown")
+				assert.Error(t, err)
+			}()
+		}
+
+		// Wait for the refresh to start.
+		assert.Eventually(t, func() bool {
+			return requests.Load() == 2
+		}, time.Second, time.Millisecond)
+
+		// Cached keys can still be looked up during the refresh.
+		_, err = jwks.Key("key-1")
+		assert.NoError(t, err)
+
+		close(blockCh)
+		wg.Wait()
+
+		assert.Equal(t, int64(2), requests.Load())
+	})
+}
+
+func TestJWTVerifier_AlgorithmConfusion(t *testing.T) {
+	endpointClaims := endpointJWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Piko: pikoEndpointClaims{
+			Endpoints: []string{"my-endpoint"},
+		},
+	}
+
+	// Tests a HMAC token signed using the RSA public key as the secret is
+	// rejected when only RSA is configured.
+	t.Run("hmac with rsa public key", func(t *testing.T) {
+		_, publicKey := generateTestRSAKeys(t)
+
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+		require.NoError(t, err)
+		publicKeyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: publicKeyBytes,
+		})
+
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, endpointClaims)
+		tokenString, err := token.SignedString(publicKeyPEM)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			RSAPublicKey: publicKey,
+		})
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.Equal(t, ErrInvalidToken, err)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		_, publicKey := generateTestRSAKeys(t)
+
+		token := jwt.NewWithClaims(jwt.SigningMethodNone, endpointClaims)
+		tokenString, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		assert.NoError(t, err)
+
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			RSAPublicKey: publicKey,
+		})
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.Equal(t, ErrInvalidToken, err)
+	})
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecdsaJWK(kid string, crv string, key *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: crv,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
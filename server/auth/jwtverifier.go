@@ -5,6 +5,7 @@ import (
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -20,20 +21,40 @@ type endpointJWTClaims struct {
 }
 
 type JWTVerifierConfig struct {
-	HMACSecretKey  []byte
+	HMACSecretKey []byte
+	// HMACSecretKeys contains additional HMAC secret keys. A JWT is valid if
+	// it verifies with any of the keys, to support rotating keys.
+	HMACSecretKeys [][]byte
 	RSAPublicKey   *rsa.PublicKey
 	ECDSAPublicKey *ecdsa.PublicKey
-	Audience       string
-	Issuer         string
+	// JWKS contains public keys to verify RSA and ECDSA JWTs, where the key
+	// is selected using the JWT 'kid' header.
+	JWKS     *JWKS
+	Audience string
+	Issuer   string
+	// Issuers contains additional valid issuers. A JWT is valid if its
+	// 'iss' claim matches any of the issuers.
+	Issuers []string
+	// Leeway is the allowed clock skew when verifying the 'exp', 'nbf' and
+	// 'iat' claims.
+	Leeway time.Duration
+	// RequireEndpoints indicates whether tokens without an endpoints claim
+	// are denied from registering any endpoints, rather than permitted to
+	// register all endpoints.
+	RequireEndpoints bool
 }
 
 type JWTVerifier struct {
-	hmacSecretKey  []byte
+	hmacSecretKeys [][]byte
 	rsaPublicKey   *rsa.PublicKey
 	ecdsaPublicKey *ecdsa.PublicKey
+	jwks           *JWKS
 
 	audience string
-	issuer   string
+	issuers  []string
+	leeway   time.Duration
+
+	requireEndpoints bool
 
 	// methods contains the valid JWT methods.
 	methods []string
@@ -41,22 +62,40 @@ type JWTVerifier struct {
 
 func NewJWTVerifier(conf JWTVerifierConfig) *JWTVerifier {
 	v := &JWTVerifier{
-		audience: conf.Audience,
-		issuer:   conf.Issuer,
+		audience:         conf.Audience,
+		leeway:           conf.Leeway,
+		requireEndpoints: conf.RequireEndpoints,
+	}
+
+	if conf.Issuer != "" {
+		v.issuers = append(v.issuers, conf.Issuer)
+	}
+	for _, issuer := range conf.Issuers {
+		if issuer != "" {
+			v.issuers = append(v.issuers, issuer)
+		}
 	}
 
 	if len(conf.HMACSecretKey) > 0 {
-		v.hmacSecretKey = conf.HMACSecretKey
+		v.hmacSecretKeys = append(v.hmacSecretKeys, conf.HMACSecretKey)
+	}
+	for _, key := range conf.HMACSecretKeys {
+		if len(key) > 0 {
+			v.hmacSecretKeys = append(v.hmacSecretKeys, key)
+		}
+	}
+	if len(v.hmacSecretKeys) > 0 {
 		v.methods = append(v.methods, []string{"HS256", "HS384", "HS512"}...)
 	}
-	if conf.RSAPublicKey != nil {
+	if conf.RSAPublicKey != nil || conf.JWKS != nil {
 		v.rsaPublicKey = conf.RSAPublicKey
 		v.methods = append(v.methods, []string{"RS256", "RS384", "RS512"}...)
 	}
-	if conf.ECDSAPublicKey != nil {
+	if conf.ECDSAPublicKey != nil || conf.JWKS != nil {
 		v.ecdsaPublicKey = conf.ECDSAPublicKey
 		v.methods = append(v.methods, []string{"ES256", "ES384", "ES512"}...)
 	}
+	v.jwks = conf.JWKS
 	return v
 }
 
@@ -65,40 +104,21 @@ func (v *JWTVerifier) VerifyEndpointToken(tokenString string) (EndpointToken, er
 
 	opts := []jwt.ParserOption{
 		jwt.WithValidMethods(v.methods),
+		jwt.WithIssuedAt(),
+	}
+	if v.leeway > 0 {
+		opts = append(opts, jwt.WithLeeway(v.leeway))
 	}
 	if v.audience != "" {
 		opts = append(opts, jwt.WithAudience(v.audience))
 	}
-	if v.issuer != "" {
-		opts = append(opts, jwt.WithIssuer(v.issuer))
+	if len(v.issuers) == 1 {
+		opts = append(opts, jwt.WithIssuer(v.issuers[0]))
 	}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		claims,
-		func(token *jwt.Token) (interface{}, error) {
-			switch token.Method.Alg() {
-			case "HS256":
-				fallthrough
-			case "HS384":
-				fallthrough
-			case "HS512":
-				return v.hmacSecretKey, nil
-			case "RS256":
-				fallthrough
-			case "RS384":
-				fallthrough
-			case "RS512":
-				return v.rsaPublicKey, nil
-			case "ES256":
-				fallthrough
-			case "ES384":
-				fallthrough
-			case "ES512":
-				return v.ecdsaPublicKey, nil
-			default:
-				return nil, fmt.Errorf("unsupported algorithm: %s", token.Method.Alg())
-			}
-		},
+		v.key,
 		opts...,
 	)
 	if err != nil {
@@ -110,15 +130,93 @@ func (v *JWTVerifier) VerifyEndpointToken(tokenString string) (EndpointToken, er
 	if !token.Valid {
 		return EndpointToken{}, ErrInvalidToken
 	}
+	// The parser only supports verifying a single issuer.
+	if len(v.issuers) > 1 && !slices.Contains(v.issuers, claims.Issuer) {
+		return EndpointToken{}, ErrInvalidToken
+	}
 
 	var expiry time.Time
 	if claims.ExpiresAt != nil {
 		expiry = claims.ExpiresAt.Time
 	}
 	return EndpointToken{
-		Expiry:    expiry,
-		Endpoints: claims.Piko.Endpoints,
+		Expiry:           expiry,
+		Endpoints:        claims.Piko.Endpoints,
+		RequireEndpoints: v.requireEndpoints,
 	}, nil
 }
 
+// key returns the key to verify the token.
+//
+// The key type must match the algorithm in the token header, to avoid
+// algorithm confusion such as a HMAC token signed with the RSA public key.
+// Note the 'none' algorithm is never accepted.
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(v.hmacSecretKeys) == 0 {
+			return nil, fmt.Errorf("hmac not supported")
+		}
+		if len(v.hmacSecretKeys) == 1 {
+			return v.hmacSecretKeys[0], nil
+		}
+		// The token is valid if it verifies with any key.
+		keySet := jwt.VerificationKeySet{}
+		for _, key := range v.hmacSecretKeys {
+			keySet.Keys = append(keySet.Keys, key)
+		}
+		return keySet, nil
+	case *jwt.SigningMethodRSA:
+		key, err := v.publicKey(token, v.rsaPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not rsa")
+		}
+		return rsaKey, nil
+	case *jwt.SigningMethodECDSA:
+		key, err := v.publicKey(token, v.ecdsaPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not ecdsa")
+		}
+		return ecdsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", token.Method.Alg())
+	}
+}
+
+// publicKey returns the public key to verify the token. If the token has a
+// 'kid' header and a JWKS is configured, the key is looked up in the JWKS,
+// otherwise the static key is used.
+func (v *JWTVerifier) publicKey(
+	token *jwt.Token,
+	staticKey interface{},
+) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if v.jwks != nil && (kid != "" || isNilKey(staticKey)) {
+		return v.jwks.Key(kid)
+	}
+	if isNilKey(staticKey) {
+		return nil, fmt.Errorf("no key configured")
+	}
+	return staticKey, nil
+}
+
+func isNilKey(key interface{}) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k == nil
+	case *ecdsa.PublicKey:
+		return k == nil
+	default:
+		return key == nil
+	}
+}
+
 var _ Verifier = &JWTVerifier{}
@@ -63,6 +63,51 @@ func TestJWTVerifier_HS(t *testing.T) {
 	})
 }
 
+func TestJWTVerifier_HSRotation(t *testing.T) {
+	oldKey := generateTestHSKey(t)
+	newKey := generateTestHSKey(t)
+
+	endpointClaims := endpointJWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+
+	oldToken, err := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, endpointClaims,
+	).SignedString(oldKey)
+	assert.NoError(t, err)
+	newToken, err := jwt.NewWithClaims(
+		jwt.SigningMethodHS256, endpointClaims,
+	).SignedString(newKey)
+	assert.NoError(t, err)
+
+	// Tests tokens signed with either key are valid while both keys are
+	// configured.
+	t.Run("overlap", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey:  newKey,
+			HMACSecretKeys: [][]byte{oldKey},
+		})
+
+		_, err := verifier.VerifyEndpointToken(oldToken)
+		assert.NoError(t, err)
+		_, err = verifier.VerifyEndpointToken(newToken)
+		assert.NoError(t, err)
+	})
+
+	t.Run("retired", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKeys: [][]byte{newKey},
+		})
+
+		_, err := verifier.VerifyEndpointToken(oldToken)
+		assert.Equal(t, ErrInvalidToken, err)
+		_, err = verifier.VerifyEndpointToken(newToken)
+		assert.NoError(t, err)
+	})
+}
+
 func TestJWTVerifier_RS(t *testing.T) {
 	endpointClaims := endpointJWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
@@ -255,6 +300,128 @@ func TestJWTVerifier_Invalid(t *testing.T) {
 	})
 }
 
+func TestJWTVerifier_Issuers(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	verifier := NewJWTVerifier(JWTVerifierConfig{
+		HMACSecretKey: secretKey,
+		Issuer:        "foo",
+		Issuers:       []string{"bar"},
+	})
+
+	for _, issuer := range []string{"foo", "bar"} {
+		t.Run(issuer, func(t *testing.T) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, endpointJWTClaims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+					Issuer:    issuer,
+				},
+			})
+			tokenString, err := token.SignedString(secretKey)
+			assert.NoError(t, err)
+
+			_, err = verifier.VerifyEndpointToken(tokenString)
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, endpointJWTClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				Issuer:    "car",
+			},
+		})
+		tokenString, err := token.SignedString(secretKey)
+		assert.NoError(t, err)
+
+		_, err = verifier.VerifyEndpointToken(tokenString)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestJWTVerifier_Leeway(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	verifier := NewJWTVerifier(JWTVerifierConfig{
+		HMACSecretKey: secretKey,
+		Leeway:        time.Minute,
+	})
+
+	signToken := func(claims jwt.RegisteredClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, endpointJWTClaims{
+			RegisteredClaims: claims,
+		})
+		tokenString, err := token.SignedString(secretKey)
+		require.NoError(t, err)
+		return tokenString
+	}
+
+	t.Run("expired within leeway", func(t *testing.T) {
+		tokenString := signToken(jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Second * 30)),
+		})
+		_, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+	})
+
+	t.Run("expired outside leeway", func(t *testing.T) {
+		tokenString := signToken(jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute * 2)),
+		})
+		_, err := verifier.VerifyEndpointToken(tokenString)
+		assert.ErrorIs(t, err, ErrExpiredToken)
+	})
+
+	t.Run("not before within leeway", func(t *testing.T) {
+		tokenString := signToken(jwt.RegisteredClaims{
+			NotBefore: jwt.NewNumericDate(time.Now().Add(time.Second * 30)),
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(time.Second * 30)),
+		})
+		_, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+	})
+
+	t.Run("issued at outside leeway", func(t *testing.T) {
+		tokenString := signToken(jwt.RegisteredClaims{
+			IssuedAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 2)),
+		})
+		_, err := verifier.VerifyEndpointToken(tokenString)
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+}
+
+func TestJWTVerifier_RequireEndpoints(t *testing.T) {
+	secretKey := generateTestHSKey(t)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, endpointJWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	tokenString, err := token.SignedString(secretKey)
+	assert.NoError(t, err)
+
+	t.Run("required", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey:    secretKey,
+			RequireEndpoints: true,
+		})
+		parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+		assert.False(t, parsedToken.EndpointPermitted("my-endpoint"))
+	})
+
+	t.Run("not required", func(t *testing.T) {
+		verifier := NewJWTVerifier(JWTVerifierConfig{
+			HMACSecretKey: secretKey,
+		})
+		parsedToken, err := verifier.VerifyEndpointToken(tokenString)
+		assert.NoError(t, err)
+		assert.True(t, parsedToken.EndpointPermitted("my-endpoint"))
+	})
+}
+
 func generateTestHSKey(t *testing.T) []byte {
 	b := make([]byte, 10)
 	_, err := rand.Read(b)
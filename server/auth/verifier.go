@@ -2,6 +2,7 @@ package auth
 
 import (
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -16,18 +17,33 @@ type EndpointToken struct {
 	Expiry time.Time
 
 	// Endpoints contains the list of endpoint IDs the connection is permitted
-	// to register. If empty then all endpoints are allowed.
+	// to register. If empty then all endpoints are allowed, unless
+	// RequireEndpoints is set.
+	//
+	// An endpoint ID ending with a '*' wildcard permits all endpoint IDs
+	// with the given prefix, such as 'team-a-*' permits 'team-a-foo'.
 	Endpoints []string
+
+	// RequireEndpoints indicates whether no endpoints are permitted when
+	// Endpoints is empty, rather than permitting all endpoints.
+	RequireEndpoints bool
 }
 
 // EndpointPermitted returns whether the given endpoint ID is permitted for
 // this token.
 func (t *EndpointToken) EndpointPermitted(endpointID string) bool {
 	if len(t.Endpoints) == 0 {
-		// If 'Endpoints' is empty then all endpoints are allowed.
-		return true
+		// If 'Endpoints' is empty then all endpoints are allowed, unless
+		// endpoints are required.
+		return !t.RequireEndpoints
 	}
 	for _, id := range t.Endpoints {
+		if prefix, ok := strings.CutSuffix(id, "*"); ok {
+			if strings.HasPrefix(endpointID, prefix) {
+				return true
+			}
+			continue
+		}
 		if endpointID == id {
 			return true
 		}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointToken_EndpointPermitted(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      EndpointToken
+		endpointID string
+		permitted  bool
+	}{
+		{
+			name: "exact match",
+			token: EndpointToken{
+				Endpoints: []string{"foo", "my-endpoint"},
+			},
+			endpointID: "my-endpoint",
+			permitted:  true,
+		},
+		{
+			name: "wildcard match",
+			token: EndpointToken{
+				Endpoints: []string{"team-a-*"},
+			},
+			endpointID: "team-a-foo",
+			permitted:  true,
+		},
+		{
+			name: "wildcard all",
+			token: EndpointToken{
+				Endpoints: []string{"*"},
+			},
+			endpointID: "my-endpoint",
+			permitted:  true,
+		},
+		{
+			name: "denied",
+			token: EndpointToken{
+				Endpoints: []string{"foo", "team-a-*"},
+			},
+			endpointID: "team-b-foo",
+			permitted:  false,
+		},
+		{
+			// The wildcard is only supported as a suffix.
+			name: "exact match not prefix",
+			token: EndpointToken{
+				Endpoints: []string{"team-a"},
+			},
+			endpointID: "team-a-foo",
+			permitted:  false,
+		},
+		{
+			name:       "no endpoints",
+			token:      EndpointToken{},
+			endpointID: "my-endpoint",
+			permitted:  true,
+		},
+		{
+			name: "no endpoints required",
+			token: EndpointToken{
+				RequireEndpoints: true,
+			},
+			endpointID: "my-endpoint",
+			permitted:  false,
+		},
+		{
+			name: "endpoints required",
+			token: EndpointToken{
+				Endpoints:        []string{"my-endpoint"},
+				RequireEndpoints: true,
+			},
+			endpointID: "my-endpoint",
+			permitted:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.permitted, tt.token.EndpointPermitted(tt.endpointID))
+		})
+	}
+}
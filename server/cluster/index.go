@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// endpointIndex maps endpoint ID to the active remote nodes the endpoint is
+// active on, sorted by node ID.
+//
+// The entries for each endpoint are immutable once published, so can be
+// read without a lock. Mutations copy the entries of only the affected
+// endpoints and atomically replace them. The index is only updated with the
+// state mutex held.
+type endpointIndex struct {
+	// endpoints maps endpoint ID to []endpointIndexEntry.
+	endpoints sync.Map
+}
+
+// Lookup returns the entries for the endpoint with the given ID. The
+// returned entries are shared so must not be modified.
+func (i *endpointIndex) Lookup(endpointID string) []endpointIndexEntry {
+	entries, ok := i.endpoints.Load(endpointID)
+	if !ok {
+		return nil
+	}
+	return entries.([]endpointIndexEntry)
+}
+
+// Store replaces the entries for the endpoint with the given ID.
+func (i *endpointIndex) Store(endpointID string, entries []endpointIndexEntry) {
+	if len(entries) == 0 {
+		i.endpoints.Delete(endpointID)
+		return
+	}
+	i.endpoints.Store(endpointID, entries)
+}
+
+// indexedNode is the state of a remote node shared by all of the nodes
+// entries in the endpoint index, so updating the node or refreshing its
+// endpoints doesn't require replacing the entries.
+type indexedNode struct {
+	// node is a snapshot of the node. It is shared by all readers so must
+	// not be modified.
+	node *atomic.Pointer[Node]
+
+	// refreshedAt is the time the node last refreshed its endpoints.
+	refreshedAt *atomic.Time
+
+	// endpoints contains the endpoint IDs the node is indexed under. Only
+	// accessed with the state mutex held.
+	endpoints map[string]struct{}
+}
+
+type endpointIndexEntry struct {
+	node *indexedNode
+
+	// updatedAt is the time the endpoint was last updated when it was
+	// indexed, or zero if unknown, in which case the endpoint never expires.
+	updatedAt time.Time
+
+	// refreshed indicates whether the endpoint is refreshed with the nodes
+	// refresh time. Endpoints restored from a snapshot aren't refreshed.
+	refreshed bool
+}
+
+// Node returns a snapshot of the entries node, which must not be modified.
+func (e *endpointIndexEntry) Node() *Node {
+	return e.node.node.Load()
+}
+
+// UpdatedAt returns the time the endpoint was last updated or refreshed, or
+// zero if unknown.
+func (e *endpointIndexEntry) UpdatedAt() time.Time {
+	if e.refreshed {
+		if refreshedAt := e.node.refreshedAt.Load(); refreshedAt.After(e.updatedAt) {
+			return refreshedAt
+		}
+	}
+	return e.updatedAt
+}
+
+// reindexNodesLocked updates the endpoint index to reflect the current
+// state of the nodes with the given IDs.
+//
+// This must be called whenever a remote nodes status, metadata or forward
+// key are updated, or when the node is added or removed. Updating a single
+// endpoint only requires reindexEndpointLocked, and refreshing a nodes
+// endpoints only requires updating the nodes refresh time.
+func (s *State) reindexNodesLocked(ids ...string) {
+	for _, id := range ids {
+		s.reindexNodeLocked(id, nil)
+	}
+}
+
+// reindexEndpointLocked updates the endpoint index to reflect the current
+// state of the endpoint with the given ID on the node with the given ID.
+//
+// This must be called whenever a remote nodes endpoint is updated or
+// removed.
+func (s *State) reindexEndpointLocked(id string, endpointID string) {
+	s.reindexNodeLocked(id, []string{endpointID})
+}
+
+// reindexNodeLocked updates the node with the given ID in the endpoint
+// index, along with the nodes entries for the given endpoints. If
+// endpointIDs is nil, all the nodes entries are updated.
+//
+// Entries are only replaced if they have changed, so updating the node
+// without changing its endpoints doesn't copy any entries.
+func (s *State) reindexNodeLocked(id string, endpointIDs []string) {
+	node, ok := s.nodes[id]
+	if !ok || id == s.localID {
+		if in, ok := s.indexedNodes[id]; ok {
+			for endpointID := range in.endpoints {
+				s.removeIndexEntryLocked(id, endpointID)
+			}
+			delete(s.indexedNodes, id)
+		}
+		return
+	}
+
+	in := s.indexedNodeLocked(id)
+	if endpointIDs == nil {
+		for endpointID := range in.endpoints {
+			endpointIDs = append(endpointIDs, endpointID)
+		}
+		for endpointID := range node.Endpoints {
+			if _, ok := in.endpoints[endpointID]; !ok {
+				endpointIDs = append(endpointIDs, endpointID)
+			}
+		}
+	}
+
+	active := func(endpointID string) bool {
+		return node.Status == NodeStatusActive && node.Endpoints[endpointID] > 0
+	}
+
+	// The snapshot is shared by all the nodes entries, so entries that are
+	// no longer active are removed before the snapshot is updated, and
+	// added entries are only added after, so lookups never see an entry
+	// whose node doesn't have the endpoint active.
+	for _, endpointID := range endpointIDs {
+		if !active(endpointID) {
+			s.removeIndexEntryLocked(id, endpointID)
+		}
+	}
+
+	in.node.Store(node.Copy())
+
+	for _, endpointID := range endpointIDs {
+		if !active(endpointID) {
+			continue
+		}
+
+		_, unverified := s.unverifiedEndpoints[id][endpointID]
+		entry := endpointIndexEntry{
+			node:      in,
+			updatedAt: s.remoteEndpointsUpdatedAt[id][endpointID],
+			refreshed: !unverified,
+		}
+		entries := s.index.Lookup(endpointID)
+		if i, ok := searchIndexEntry(entries, id); ok && entries[i] == entry {
+			continue
+		}
+		s.index.Store(endpointID, replaceIndexEntry(entries, id, &entry))
+		in.endpoints[endpointID] = struct{}{}
+	}
+}
+
+// removeIndexEntryLocked removes the entry for the node with the given ID
+// from the endpoint with the given ID, if indexed.
+func (s *State) removeIndexEntryLocked(id string, endpointID string) {
+	in, ok := s.indexedNodes[id]
+	if !ok {
+		return
+	}
+	if _, ok := in.endpoints[endpointID]; !ok {
+		return
+	}
+	s.index.Store(endpointID, replaceIndexEntry(
+		s.index.Lookup(endpointID), id, nil,
+	))
+	delete(in.endpoints, endpointID)
+}
+
+// indexedNodeLocked returns the indexed state of the node with the given ID,
+// creating it if it doesn't exist.
+func (s *State) indexedNodeLocked(id string) *indexedNode {
+	in, ok := s.indexedNodes[id]
+	if !ok {
+		in = &indexedNode{
+			node:        atomic.NewPointer[Node](nil),
+			refreshedAt: atomic.NewTime(time.Time{}),
+			endpoints:   make(map[string]struct{}),
+		}
+		s.indexedNodes[id] = in
+	}
+	return in
+}
+
+// searchIndexEntry returns the position of the entry for the node with the
+// given ID in the given entries, or the position it would be inserted and
+// false if not found.
+func searchIndexEntry(entries []endpointIndexEntry, id string) (int, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Node().ID >= id
+	})
+	return i, i < len(entries) && entries[i].Node().ID == id
+}
+
+// replaceIndexEntry returns a copy of the given entries, sorted by node ID,
+// with the entry for the node with the given ID replaced by entry. If entry
+// is nil the nodes entry is removed.
+func replaceIndexEntry(
+	entries []endpointIndexEntry,
+	id string,
+	entry *endpointIndexEntry,
+) []endpointIndexEntry {
+	i, ok := searchIndexEntry(entries, id)
+	next := i
+	if ok {
+		next++
+	}
+
+	updated := make([]endpointIndexEntry, 0, len(entries)+1)
+	updated = append(updated, entries[:i]...)
+	if entry != nil {
+		updated = append(updated, *entry)
+	}
+	updated = append(updated, entries[next:]...)
+	return updated
+}
@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"math/big"
 )
 
@@ -9,12 +10,21 @@ var (
 	alphaNumericChars = []byte("abcdefghijklmnopqrstuvwxyz1234567890")
 )
 
+const (
+	// MetadataZone is the node metadata key containing the availability zone
+	// of the node.
+	MetadataZone = "zone"
+)
+
 // NodeStatus contains the known status of a node.
 type NodeStatus string
 
 const (
 	// NodeStatusActive means the node is healthy and accepting traffic.
 	NodeStatusActive NodeStatus = "active"
+	// NodeStatusLeaving means the node is shutting down so is no longer
+	// accepting traffic, though hasn't yet left the cluster.
+	NodeStatusLeaving NodeStatus = "leaving"
 	// NodeStatusUnreachable means the node is considered unreachable.
 	NodeStatusUnreachable NodeStatus = "unreachable"
 	// NodeStatusLeft means the node has left the cluster.
@@ -44,12 +54,46 @@ type Node struct {
 	// The address is immutable.
 	AdminAddr string `json:"admin_addr"`
 
+	// Version is the Piko version the node is running, or empty if
+	// unknown (such as nodes running an older version that don't
+	// propagate their version).
+	//
+	// The build info is immutable.
+	Version string `json:"version,omitempty"`
+
+	// Commit is the VCS commit the node was built from, or empty if
+	// unknown.
+	Commit string `json:"commit,omitempty"`
+
+	// BuildTime is the time the node was built, or empty if unknown.
+	BuildTime string `json:"build_time,omitempty"`
+
+	// ForwardKey is a secret key used to authenticate requests forwarded to
+	// the node by other nodes in the cluster.
+	//
+	// The key is only shared with other nodes so is never encoded.
+	//
+	// The key is immutable.
+	ForwardKey string `json:"-"`
+
 	// Endpoints contains the known active endpoints on the node (endpoints
 	// with at least one upstream listener).
 	//
 	// This maps the endpoint ID to the number of known listeners for that
 	// endpoint.
 	Endpoints map[string]int `json:"endpoints"`
+
+	// DrainingEndpoints contains the endpoints with listeners that are
+	// draining. Draining listeners aren't included in Endpoints so no new
+	// connections are routed to them.
+	//
+	// This maps the endpoint ID to the number of draining listeners for that
+	// endpoint. Draining listeners are only tracked for the local node.
+	DrainingEndpoints map[string]int `json:"draining_endpoints,omitempty"`
+
+	// Metadata contains arbitrary key-value pairs describing the node, such
+	// as the region or instance type.
+	Metadata map[string]string `json:"metadata"`
 }
 
 func (n *Node) Copy() *Node {
@@ -60,16 +104,42 @@ func (n *Node) Copy() *Node {
 			endpoints[endpointID] = listeners
 		}
 	}
+	var drainingEndpoints map[string]int
+	if len(n.DrainingEndpoints) > 0 {
+		drainingEndpoints = make(map[string]int)
+		for endpointID, listeners := range n.DrainingEndpoints {
+			drainingEndpoints[endpointID] = listeners
+		}
+	}
+	var metadata map[string]string
+	if len(n.Metadata) > 0 {
+		metadata = make(map[string]string)
+		for key, value := range n.Metadata {
+			metadata[key] = value
+		}
+	}
 	return &Node{
-		ID:        n.ID,
-		Status:    n.Status,
-		ProxyAddr: n.ProxyAddr,
-		AdminAddr: n.AdminAddr,
-		Endpoints: endpoints,
+		ID:                n.ID,
+		Status:            n.Status,
+		ProxyAddr:         n.ProxyAddr,
+		AdminAddr:         n.AdminAddr,
+		Version:           n.Version,
+		Commit:            n.Commit,
+		BuildTime:         n.BuildTime,
+		ForwardKey:        n.ForwardKey,
+		Endpoints:         endpoints,
+		DrainingEndpoints: drainingEndpoints,
+		Metadata:          metadata,
 	}
 }
 
-func (n *Node) Metadata() *NodeMetadata {
+// Zone returns the availability zone of the node, or an empty string if the
+// zone is unknown.
+func (n *Node) Zone() string {
+	return n.Metadata[MetadataZone]
+}
+
+func (n *Node) NodeMetadata() *NodeMetadata {
 	upstreams := 0
 	for _, endpointUpstreams := range n.Endpoints {
 		upstreams += endpointUpstreams
@@ -79,8 +149,12 @@ func (n *Node) Metadata() *NodeMetadata {
 		Status:    n.Status,
 		ProxyAddr: n.ProxyAddr,
 		AdminAddr: n.AdminAddr,
+		Version:   n.Version,
+		Commit:    n.Commit,
+		BuildTime: n.BuildTime,
 		Endpoints: len(n.Endpoints),
 		Upstreams: upstreams,
+		Metadata:  n.Copy().Metadata,
 	}
 }
 
@@ -90,9 +164,43 @@ type NodeMetadata struct {
 	Status    NodeStatus `json:"status"`
 	ProxyAddr string     `json:"proxy_addr"`
 	AdminAddr string     `json:"admin_addr"`
+	Version   string     `json:"version,omitempty"`
+	Commit    string     `json:"commit,omitempty"`
+	BuildTime string     `json:"build_time,omitempty"`
 	Endpoints int        `json:"endpoints"`
 	// Upstreams is the number of upstreams connected to this node.
 	Upstreams int `json:"upstreams"`
+	// Metadata contains the nodes metadata key-value pairs.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// EndpointLocation describes a node that an endpoint is active on.
+type EndpointLocation struct {
+	NodeID    string     `json:"node_id"`
+	Status    NodeStatus `json:"status"`
+	ProxyAddr string     `json:"proxy_addr"`
+	// Listeners is the number of listeners for the endpoint connected to the
+	// node.
+	Listeners int `json:"listeners"`
+	// Local indicates whether the node is the local node.
+	Local bool `json:"local,omitempty"`
+	// Expired indicates the endpoint hasn't been refreshed by the node within
+	// the endpoint TTL, so requests aren't forwarded to the node.
+	Expired bool `json:"expired,omitempty"`
+	// Stale indicates requests aren't forwarded to the node, either since
+	// the node isn't active or the endpoint has expired.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Endpoint describes an endpoint across all nodes in the cluster.
+type Endpoint struct {
+	ID string `json:"id"`
+	// Listeners is the total number of listeners for the endpoint across all
+	// nodes, excluding stale nodes.
+	Listeners int `json:"listeners"`
+	// Nodes contains the nodes that the endpoint is active on, including
+	// stale nodes.
+	Nodes []EndpointLocation `json:"nodes"`
 }
 
 func GenerateNodeID() string {
@@ -108,3 +216,15 @@ func GenerateNodeID() string {
 	}
 	return string(b)
 }
+
+// GenerateForwardKey generates a random key used to authenticate requests
+// forwarded to the node.
+func GenerateForwardKey() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		// We don't expect to ever get an error so panic rather than try to
+		// handle.
+		panic("failed to generate random key: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,28 @@
+package cluster
+
+import (
+	"time"
+)
+
+type options struct {
+	endpointTTL time.Duration
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type endpointTTLOption time.Duration
+
+func (o endpointTTLOption) apply(opts *options) {
+	opts.endpointTTL = time.Duration(o)
+}
+
+// WithEndpointTTL configures the duration a remote nodes endpoint is
+// considered active without being refreshed.
+//
+// If zero (the default) remote endpoints never expire and are only removed
+// when the owning node removes them or leaves the cluster.
+func WithEndpointTTL(ttl time.Duration) Option {
+	return endpointTTLOption(ttl)
+}
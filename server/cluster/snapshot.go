@@ -0,0 +1,230 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// snapshotVersion is the version of the snapshot format.
+	snapshotVersion = 1
+)
+
+// snapshot contains the known state of the remote nodes in the cluster.
+type snapshot struct {
+	Version int `json:"version"`
+
+	// CreatedAt is the time the snapshot was taken.
+	CreatedAt time.Time `json:"created_at"`
+
+	Nodes []snapshotNode `json:"nodes"`
+}
+
+type snapshotNode struct {
+	Node *Node `json:"node"`
+
+	// ForwardKey is the nodes forward key, which isn't encoded with the
+	// node.
+	ForwardKey string `json:"forward_key,omitempty"`
+
+	// EndpointsUpdatedAt contains the time each endpoint was last updated
+	// or refreshed, keyed by endpoint ID.
+	EndpointsUpdatedAt map[string]time.Time `json:"endpoints_updated_at,omitempty"`
+}
+
+// Snapshot returns a snapshot of the known state of the remote nodes in the
+// cluster, which can be restored with Restore.
+//
+// The local node is excluded, since its state only contains the upstreams
+// currently connected to the node, which are lost on restart. Nodes that
+// aren't active are also excluded.
+func (s *State) Snapshot() ([]byte, error) {
+	s.mu.RLock()
+
+	snap := snapshot{
+		Version:   snapshotVersion,
+		CreatedAt: s.now(),
+	}
+	for id, node := range s.nodes {
+		if id == s.localID || node.Status != NodeStatusActive {
+			continue
+		}
+
+		var updatedAt map[string]time.Time
+		if len(s.remoteEndpointsUpdatedAt[id]) > 0 {
+			updatedAt = make(map[string]time.Time)
+			for endpointID, t := range s.remoteEndpointsUpdatedAt[id] {
+				updatedAt[endpointID] = t
+			}
+		}
+
+		node = node.Copy()
+		// Draining endpoints are only tracked for the local node.
+		node.DrainingEndpoints = nil
+		snap.Nodes = append(snap.Nodes, snapshotNode{
+			Node:               node,
+			ForwardKey:         node.ForwardKey,
+			EndpointsUpdatedAt: updatedAt,
+		})
+	}
+
+	s.mu.RUnlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil, fmt.Errorf("encode: %w", err)
+	}
+	return b, nil
+}
+
+// Restore adds the remote nodes from the given snapshot to the cluster.
+//
+// Restored nodes are considered unverified until updated by gossip. If a
+// restored node isn't updated by gossip within the endpoint TTL of the
+// snapshot being taken, the node is removed. Similarly restored endpoints
+// aren't refreshed by heartbeats until updated by gossip, so expire after the
+// endpoint TTL unless confirmed. Therefore snapshots should only be used
+// with an endpoint TTL.
+//
+// Nodes that are already in the cluster are not modified, since their state
+// is more recent than the snapshot.
+func (s *State) Restore(b []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported version: %d", snap.Version)
+	}
+
+	s.mu.Lock()
+
+	var restored []*Node
+	for _, n := range snap.Nodes {
+		node := n.Node
+		if node == nil || node.ID == "" || node.ID == s.localID {
+			continue
+		}
+		if _, ok := s.nodes[node.ID]; ok {
+			continue
+		}
+
+		node.Status = NodeStatusActive
+		node.ForwardKey = n.ForwardKey
+		node.DrainingEndpoints = nil
+		s.nodes[node.ID] = node
+		s.addMetricsNode(node.Status)
+
+		updatedAt := make(map[string]time.Time)
+		unverified := make(map[string]struct{})
+		for endpointID := range node.Endpoints {
+			t, ok := n.EndpointsUpdatedAt[endpointID]
+			if !ok {
+				t = snap.CreatedAt
+			}
+			updatedAt[endpointID] = t
+			unverified[endpointID] = struct{}{}
+		}
+		s.remoteEndpointsUpdatedAt[node.ID] = updatedAt
+		s.unverifiedEndpoints[node.ID] = unverified
+		s.unverifiedNodes[node.ID] = snap.CreatedAt
+
+		restored = append(restored, node.Copy())
+	}
+
+	reindex := make([]string, 0, len(restored))
+	for _, node := range restored {
+		reindex = append(reindex, node.ID)
+	}
+	s.reindexNodesLocked(reindex...)
+
+	subscribers := make([]func(node *Node), 0, len(s.nodeJoinSubscribers))
+	subscribers = append(subscribers, s.nodeJoinSubscribers...)
+
+	s.mu.Unlock()
+
+	s.logger.Info(
+		"restored cluster snapshot",
+		zap.Int("nodes", len(restored)),
+		zap.Time("created-at", snap.CreatedAt),
+	)
+
+	for _, node := range restored {
+		for _, f := range subscribers {
+			f(node)
+		}
+	}
+
+	return nil
+}
+
+// SaveSnapshot writes a snapshot of the cluster state to the file at the
+// given path.
+//
+// The snapshot is written to a temporary file then renamed, so the file is
+// never partially written.
+func (s *State) SaveSnapshot(path string) error {
+	b, err := s.Snapshot()
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores the cluster state from the snapshot file at the
+// given path.
+func (s *State) LoadSnapshot(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if err := s.Restore(b); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+// RunSnapshots periodically writes a snapshot of the cluster state to the
+// file at the given path, until the given context is cancelled. A final
+// snapshot is written when the context is cancelled.
+func (s *State) RunSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.SaveSnapshot(path); err != nil {
+				s.logger.Warn("failed to save snapshot", zap.Error(err))
+			}
+			return
+		case <-ticker.C:
+			if err := s.SaveSnapshot(path); err != nil {
+				s.logger.Warn("failed to save snapshot", zap.Error(err))
+			}
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package cluster
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -18,10 +22,44 @@ type State struct {
 
 	localEndpointSubscribers  []func(endpointID string)
 	remoteEndpointSubscribers []func(nodeID string, endpointID string)
+	localMetadataSubscribers  []func(key string)
+	nodeJoinSubscribers       []func(node *Node)
+	nodeLeaveSubscribers      []func(node *Node)
+	nodeStatusSubscribers     []func(node *Node)
+
+	// remoteEndpointsUpdatedAt contains the time each remote endpoint was
+	// last updated or refreshed, keyed by node ID then endpoint ID.
+	remoteEndpointsUpdatedAt map[string]map[string]time.Time
+
+	// unverifiedNodes contains remote nodes restored from a snapshot that
+	// haven't been updated by gossip since, mapped to the time the snapshot
+	// was taken.
+	unverifiedNodes map[string]time.Time
+	// unverifiedEndpoints contains remote endpoints restored from a snapshot
+	// that haven't been updated by gossip since, keyed by node ID then
+	// endpoint ID. Unverified endpoints aren't refreshed by heartbeats so
+	// expire unless confirmed by gossip.
+	unverifiedEndpoints map[string]map[string]struct{}
+
+	// indexedNodes contains the state of each remote node in the endpoint
+	// index, keyed by node ID.
+	indexedNodes map[string]*indexedNode
 
 	// mu protects the above fields.
 	mu sync.RWMutex
 
+	// index contains the remote nodes each endpoint is active on, so
+	// endpoints can be looked up without a lock. The index is only updated
+	// with mu held.
+	index endpointIndex
+
+	// endpointTTL is the duration a remote endpoint is considered active
+	// without being refreshed. If zero endpoints never expire.
+	endpointTTL time.Duration
+
+	// now returns the current time. Overridden in tests.
+	now func() time.Time
+
 	metrics *Metrics
 
 	logger log.Logger
@@ -30,17 +68,29 @@ type State struct {
 func NewState(
 	localNode *Node,
 	logger log.Logger,
+	opts ...Option,
 ) *State {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	// The local node is always active.
 	localNode.Status = NodeStatusActive
 	nodes := make(map[string]*Node)
 	nodes[localNode.ID] = localNode
 
 	s := &State{
-		localID: localNode.ID,
-		nodes:   nodes,
-		metrics: NewMetrics(),
-		logger:  logger.WithSubsystem("cluster"),
+		localID:                  localNode.ID,
+		nodes:                    nodes,
+		remoteEndpointsUpdatedAt: make(map[string]map[string]time.Time),
+		unverifiedNodes:          make(map[string]time.Time),
+		unverifiedEndpoints:      make(map[string]map[string]struct{}),
+		indexedNodes:             make(map[string]*indexedNode),
+		endpointTTL:              options.endpointTTL,
+		now:                      time.Now,
+		metrics:                  NewMetrics(),
+		logger:                   logger.WithSubsystem("cluster"),
 	}
 	s.addMetricsNode(localNode.Status)
 	return s
@@ -96,7 +146,7 @@ func (s *State) NodesMetadata() []*NodeMetadata {
 
 	nodes := make([]*NodeMetadata, 0, len(s.nodes))
 	for _, node := range s.nodes {
-		nodes = append(nodes, node.Metadata())
+		nodes = append(nodes, node.NodeMetadata())
 	}
 	return nodes
 }
@@ -104,24 +154,121 @@ func (s *State) NodesMetadata() []*NodeMetadata {
 // LookupEndpoint looks up a node that the endpoint with the given ID is active
 // on.
 func (s *State) LookupEndpoint(endpointID string) (*Node, bool) {
+	nodes := s.LookupEndpoints(endpointID)
+	if len(nodes) == 0 {
+		return nil, false
+	}
+	return nodes[0], true
+}
+
+// LookupEndpoints returns all remote nodes that the endpoint with the given
+// ID is active on.
+//
+// Lookups use the endpoint index so don't take a lock. The returned nodes
+// are shared so must not be modified.
+//
+// The nodes are sorted by ID so the order is deterministic.
+func (s *State) LookupEndpoints(endpointID string) []*Node {
+	entries := s.index.Lookup(endpointID)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := s.now()
+
+	nodes := make([]*Node, 0, len(entries))
+	for _, entry := range entries {
+		updatedAt := entry.UpdatedAt()
+		if s.endpointTTL != 0 && !updatedAt.IsZero() &&
+			now.Sub(updatedAt) > s.endpointTTL {
+			// Ignore endpoints that haven't been refreshed.
+			continue
+		}
+		nodes = append(nodes, entry.Node())
+	}
+	return nodes
+}
+
+// EndpointNodes returns all nodes that the endpoint with the given ID is
+// active on, including the local node.
+//
+// Unlike LookupEndpoints, this includes nodes that requests aren't forwarded
+// to, such as unreachable nodes and expired endpoints, so is used to inspect
+// where an endpoint is connected.
+//
+// The nodes are sorted by ID so the order is deterministic.
+func (s *State) EndpointNodes(endpointID string) []EndpointLocation {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	now := s.now()
+
+	var locations []EndpointLocation
 	for _, node := range s.nodes {
-		if node.ID == s.localID {
-			// Ignore ourselves.
-			continue
-		}
-		if node.Status != NodeStatusActive {
-			// Ignore unreachable and left nodes.
+		listeners, ok := node.Endpoints[endpointID]
+		if !ok || listeners == 0 {
 			continue
 		}
-		if listeners, ok := node.Endpoints[endpointID]; ok && listeners > 0 {
-			return node.Copy(), true
+
+		locations = append(
+			locations, s.endpointLocationLocked(node, endpointID, listeners, now),
+		)
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].NodeID < locations[j].NodeID
+	})
+	return locations
+}
+
+// Endpoints returns all endpoints active in the cluster, with the nodes each
+// endpoint is active on, including the local node.
+//
+// Endpoints on nodes that requests aren't forwarded to, such as unreachable
+// nodes and expired endpoints, are marked as stale and excluded from the
+// endpoints total listeners.
+//
+// The endpoints and nodes are sorted by ID so the order is deterministic.
+func (s *State) Endpoints() []Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+
+	endpoints := make(map[string]*Endpoint)
+	for _, node := range s.nodes {
+		for endpointID, listeners := range node.Endpoints {
+			if listeners == 0 {
+				continue
+			}
+
+			endpoint, ok := endpoints[endpointID]
+			if !ok {
+				endpoint = &Endpoint{
+					ID: endpointID,
+				}
+				endpoints[endpointID] = endpoint
+			}
+
+			location := s.endpointLocationLocked(node, endpointID, listeners, now)
+			if !location.Stale {
+				endpoint.Listeners += listeners
+			}
+			endpoint.Nodes = append(endpoint.Nodes, location)
 		}
 	}
 
-	return nil, false
+	sorted := make([]Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sort.Slice(endpoint.Nodes, func(i, j int) bool {
+			return endpoint.Nodes[i].NodeID < endpoint.Nodes[j].NodeID
+		})
+		sorted = append(sorted, *endpoint)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
 }
 
 // AddLocalEndpoint adds the active endpoint to the local node state.
@@ -185,6 +332,84 @@ func (s *State) RemoveLocalEndpoint(endpointID string) {
 	}
 }
 
+// DrainLocalEndpoint marks a listener for the active endpoint on the local
+// node as draining. The listener is no longer counted as active so new
+// connections aren't routed to it, though it remains draining until removed
+// with RemoveLocalDrainingEndpoint.
+func (s *State) DrainLocalEndpoint(endpointID string) {
+	s.mu.Lock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	listeners, ok := node.Endpoints[endpointID]
+	if !ok || listeners == 0 {
+		s.logger.Warn("drain local endpoint: endpoint not found")
+		s.mu.Unlock()
+		return
+	}
+
+	if listeners > 1 {
+		node.Endpoints[endpointID] = listeners - 1
+	} else {
+		delete(node.Endpoints, endpointID)
+	}
+
+	if node.DrainingEndpoints == nil {
+		node.DrainingEndpoints = make(map[string]int)
+	}
+	node.DrainingEndpoints[endpointID] = node.DrainingEndpoints[endpointID] + 1
+
+	subscribers := make([]func(endpointID string), 0, len(s.localEndpointSubscribers))
+	subscribers = append(subscribers, s.localEndpointSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(endpointID)
+	}
+}
+
+// RemoveLocalDrainingEndpoint removes a draining listener for the endpoint
+// from the local node state.
+func (s *State) RemoveLocalDrainingEndpoint(endpointID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	listeners, ok := node.DrainingEndpoints[endpointID]
+	if !ok || listeners == 0 {
+		s.logger.Warn("remove local draining endpoint: endpoint not found")
+		return
+	}
+
+	if listeners > 1 {
+		node.DrainingEndpoints[endpointID] = listeners - 1
+	} else {
+		delete(node.DrainingEndpoints, endpointID)
+	}
+}
+
+// LocalDrainingEndpointListeners returns the number of draining listeners
+// for the endpoint on the local node.
+func (s *State) LocalDrainingEndpointListeners(endpointID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	return node.DrainingEndpoints[endpointID]
+}
+
 func (s *State) LocalEndpointListeners(endpointID string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -200,11 +425,50 @@ func (s *State) LocalEndpointListeners(endpointID string) int {
 	return node.Endpoints[endpointID]
 }
 
+// SetLocalMetadata sets the metadata key-value pair on the local node state.
+func (s *State) SetLocalMetadata(key string, value string) {
+	s.mu.Lock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	if node.Metadata == nil {
+		node.Metadata = make(map[string]string)
+	}
+	node.Metadata[key] = value
+
+	subscribers := make([]func(key string), 0, len(s.localMetadataSubscribers))
+	subscribers = append(subscribers, s.localMetadataSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(key)
+	}
+}
+
+// LocalMetadata returns the value of the metadata key on the local node, or
+// false if the key is not set.
+func (s *State) LocalMetadata(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[s.localID]
+	if !ok {
+		panic("local node not in cluster")
+	}
+
+	value, ok := node.Metadata[key]
+	return value, ok
+}
+
 // OnLocalEndpointUpdate subscribes to changes to the local nodes active
 // endpoints.
 //
-// The callback is called with the cluster mutex locked so must not block or
-// call back to the cluster.
+// The callback is called after the cluster mutex is released, though must
+// not block as it is called synchronously on the update path.
 func (s *State) OnLocalEndpointUpdate(f func(endpointID string)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -219,13 +483,57 @@ func (s *State) OnRemoteEndpointUpdate(f func(nodeID string, endpointID string))
 	s.remoteEndpointSubscribers = append(s.remoteEndpointSubscribers, f)
 }
 
+// OnLocalMetadataUpdate subscribes to changes to the local nodes metadata.
+func (s *State) OnLocalMetadataUpdate(f func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localMetadataSubscribers = append(s.localMetadataSubscribers, f)
+}
+
+// OnNodeJoin subscribes to nodes being added to the cluster.
+//
+// The callback is called with the added node after the cluster mutex is
+// released, though must not block as it is called synchronously on the
+// update path.
+func (s *State) OnNodeJoin(f func(node *Node)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodeJoinSubscribers = append(s.nodeJoinSubscribers, f)
+}
+
+// OnNodeLeave subscribes to nodes being removed from the cluster.
+//
+// The callback is called with the removed node after the cluster mutex is
+// released, though must not block as it is called synchronously on the
+// update path.
+func (s *State) OnNodeLeave(f func(node *Node)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodeLeaveSubscribers = append(s.nodeLeaveSubscribers, f)
+}
+
+// OnNodeStatusChange subscribes to changes to the status of remote nodes.
+//
+// The callback is called with the updated node after the cluster mutex is
+// released, though must not block as it is called synchronously on the
+// update path.
+func (s *State) OnNodeStatusChange(f func(node *Node)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodeStatusSubscribers = append(s.nodeStatusSubscribers, f)
+}
+
 // AddNode adds the given node to the cluster.
 func (s *State) AddNode(node *Node) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	if node.ID == s.localID {
 		s.logger.Warn("add node: cannot add local node")
+		s.mu.Unlock()
 		return
 	}
 
@@ -237,26 +545,61 @@ func (s *State) AddNode(node *Node) {
 
 	s.nodes[node.ID] = node
 	s.addMetricsNode(node.Status)
+
+	now := s.now()
+	updatedAt := make(map[string]time.Time)
+	for endpointID := range node.Endpoints {
+		updatedAt[endpointID] = now
+	}
+	s.remoteEndpointsUpdatedAt[node.ID] = updatedAt
+	// The node is replaced so is no longer unverified.
+	delete(s.unverifiedNodes, node.ID)
+	delete(s.unverifiedEndpoints, node.ID)
+	s.reindexNodesLocked(node.ID)
+
+	subscribers := make([]func(node *Node), 0, len(s.nodeJoinSubscribers))
+	subscribers = append(subscribers, s.nodeJoinSubscribers...)
+	node = node.Copy()
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(node)
+	}
 }
 
 // RemoveNode removes the node with the given ID from the cluster.
 func (s *State) RemoveNode(id string) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	if id == s.localID {
 		s.logger.Warn("remove node: cannot remove local node")
+		s.mu.Unlock()
 		return false
 	}
 
 	node, ok := s.nodes[id]
 	if !ok {
 		s.logger.Warn("remove node: node not in cluster")
+		s.mu.Unlock()
 		return false
 	}
 
 	delete(s.nodes, id)
+	delete(s.remoteEndpointsUpdatedAt, id)
+	delete(s.unverifiedNodes, id)
+	delete(s.unverifiedEndpoints, id)
 	s.removeMetricsNode(node.Status)
+	s.reindexNodesLocked(id)
+
+	subscribers := make([]func(node *Node), 0, len(s.nodeLeaveSubscribers))
+	subscribers = append(subscribers, s.nodeLeaveSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(node)
+	}
 
 	return true
 }
@@ -264,22 +607,50 @@ func (s *State) RemoveNode(id string) bool {
 // UpdateRemoteStatus sets the status of the remote node with the given ID.
 func (s *State) UpdateRemoteStatus(id string, status NodeStatus) bool {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	if id == s.localID {
 		s.logger.Warn("update remote status: cannot update local node")
+		s.mu.Unlock()
 		return false
 	}
 
 	n, ok := s.nodes[id]
 	if !ok {
 		s.logger.Warn("update remote status: node not in cluster")
+		s.mu.Unlock()
 		return false
 	}
 
+	s.verifyNodeLocked(id)
+
+	// A leaving node never becomes active again, so ignore the node being
+	// detected as reachable while it shuts down.
+	if n.Status == NodeStatusLeaving && status == NodeStatusActive {
+		s.mu.Unlock()
+		return true
+	}
+
 	oldStatus := n.Status
 	n.Status = status
 	s.updateMetricsNode(oldStatus, status)
+
+	if oldStatus == status {
+		s.mu.Unlock()
+		return true
+	}
+
+	s.reindexNodesLocked(id)
+
+	subscribers := make([]func(node *Node), 0, len(s.nodeStatusSubscribers))
+	subscribers = append(subscribers, s.nodeStatusSubscribers...)
+	n = n.Copy()
+
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(n)
+	}
+
 	return true
 }
 
@@ -296,6 +667,7 @@ func (s *State) UpdateRemoteEndpoint(
 		s.mu.Unlock()
 		return false
 	}
+	s.reindexEndpointLocked(id, endpointID)
 
 	subscribers := make([]func(nodeID string, endpointID string), 0, len(s.remoteEndpointSubscribers))
 	subscribers = append(subscribers, s.remoteEndpointSubscribers...)
@@ -318,6 +690,8 @@ func (s *State) RemoveRemoteEndpoint(id string, endpointID string) bool {
 		s.mu.Unlock()
 		return false
 	}
+	s.verifyNodeLocked(id)
+	s.reindexEndpointLocked(id, endpointID)
 
 	subscribers := make([]func(nodeID string, endpointID string), 0, len(s.remoteEndpointSubscribers))
 	subscribers = append(subscribers, s.remoteEndpointSubscribers...)
@@ -331,6 +705,233 @@ func (s *State) RemoveRemoteEndpoint(id string, endpointID string) bool {
 	return true
 }
 
+// RefreshRemoteEndpoints marks the active endpoints of the node with the
+// given ID as refreshed, so they won't be expired.
+func (s *State) RefreshRemoteEndpoints(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("refresh remote endpoints: cannot refresh local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("refresh remote endpoints: node not in cluster")
+		return false
+	}
+
+	s.verifyNodeLocked(id)
+
+	now := s.now()
+	updatedAt, ok := s.remoteEndpointsUpdatedAt[id]
+	if !ok {
+		updatedAt = make(map[string]time.Time)
+		s.remoteEndpointsUpdatedAt[id] = updatedAt
+	}
+	for endpointID := range n.Endpoints {
+		if _, ok := s.unverifiedEndpoints[id][endpointID]; ok {
+			// Don't refresh endpoints restored from a snapshot, as the node
+			// may have removed the endpoint since the snapshot was taken.
+			continue
+		}
+		updatedAt[endpointID] = now
+	}
+	// Refreshing doesn't change the nodes indexed endpoints, so only the
+	// refresh time shared by the nodes index entries is updated rather
+	// than reindexing the node.
+	s.indexedNodeLocked(id).refreshedAt.Store(now)
+
+	return true
+}
+
+// ExpireRemoteEndpoints removes any remote endpoints restored from a
+// snapshot that haven't been confirmed by gossip within the endpoint TTL.
+// Returns the number of endpoints removed.
+//
+// Confirmed endpoints that haven't been refreshed within the endpoint TTL
+// aren't removed, since the node may still have the endpoint but failed to
+// send heartbeats, such as during a network partition. Instead the endpoint
+// is considered stale, so requests aren't forwarded to the node until the
+// endpoint is refreshed.
+//
+// Nodes restored from a snapshot that haven't been updated by gossip within
+// the endpoint TTL of the snapshot being taken are also removed.
+//
+// This has no affect if no TTL is configured.
+func (s *State) ExpireRemoteEndpoints() int {
+	if s.endpointTTL == 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+
+	type expiredEndpoint struct {
+		nodeID     string
+		endpointID string
+	}
+	var expired []expiredEndpoint
+
+	now := s.now()
+	for nodeID, node := range s.nodes {
+		if nodeID == s.localID {
+			continue
+		}
+		for endpointID := range node.Endpoints {
+			if _, ok := s.unverifiedEndpoints[nodeID][endpointID]; !ok {
+				continue
+			}
+			if s.remoteEndpointExpiredLocked(nodeID, endpointID, now) {
+				expired = append(expired, expiredEndpoint{
+					nodeID:     nodeID,
+					endpointID: endpointID,
+				})
+			}
+		}
+	}
+
+	var reindex []string
+	for _, e := range expired {
+		s.removeRemoteEndpointLocked(e.nodeID, e.endpointID)
+		reindex = append(reindex, e.nodeID)
+
+		s.logger.Warn(
+			"expired unverified remote endpoint",
+			zap.String("node-id", e.nodeID),
+			zap.String("endpoint-id", e.endpointID),
+		)
+	}
+
+	var expiredNodes []*Node
+	for nodeID, snapshotAt := range s.unverifiedNodes {
+		if now.Sub(snapshotAt) <= s.endpointTTL {
+			continue
+		}
+
+		node := s.nodes[nodeID]
+		delete(s.nodes, nodeID)
+		delete(s.remoteEndpointsUpdatedAt, nodeID)
+		delete(s.unverifiedNodes, nodeID)
+		delete(s.unverifiedEndpoints, nodeID)
+		s.removeMetricsNode(node.Status)
+		expiredNodes = append(expiredNodes, node)
+		reindex = append(reindex, nodeID)
+
+		s.logger.Warn(
+			"expired unverified node",
+			zap.String("node-id", nodeID),
+		)
+	}
+
+	s.reindexNodesLocked(reindex...)
+
+	subscribers := make([]func(nodeID string, endpointID string), 0, len(s.remoteEndpointSubscribers))
+	subscribers = append(subscribers, s.remoteEndpointSubscribers...)
+	leaveSubscribers := make([]func(node *Node), 0, len(s.nodeLeaveSubscribers))
+	leaveSubscribers = append(leaveSubscribers, s.nodeLeaveSubscribers...)
+
+	s.mu.Unlock()
+
+	for _, e := range expired {
+		for _, f := range subscribers {
+			f(e.nodeID, e.endpointID)
+		}
+	}
+	for _, node := range expiredNodes {
+		for _, f := range leaveSubscribers {
+			f(node)
+		}
+	}
+
+	return len(expired)
+}
+
+// RunEndpointExpiry periodically expires remote endpoints that haven't been
+// refreshed within the endpoint TTL, until the given context is cancelled.
+//
+// If no TTL is configured this does nothing until the context is cancelled.
+func (s *State) RunEndpointExpiry(ctx context.Context) {
+	if s.endpointTTL == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(s.endpointTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.ExpireRemoteEndpoints()
+		}
+	}
+}
+
+// EndpointTTL returns the duration a remote endpoint is considered active
+// without being refreshed, or zero if endpoints never expire.
+func (s *State) EndpointTTL() time.Duration {
+	return s.endpointTTL
+}
+
+// UpdateRemoteMetadata sets the metadata key-value pair for the node with the
+// given ID.
+func (s *State) UpdateRemoteMetadata(id string, key string, value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("update remote metadata: cannot update local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("update remote metadata: node not in cluster")
+		return false
+	}
+	s.verifyNodeLocked(id)
+
+	if n.Metadata == nil {
+		n.Metadata = make(map[string]string)
+	}
+	n.Metadata[key] = value
+	s.reindexNodesLocked(id)
+
+	return true
+}
+
+// UpdateRemoteForwardKey updates the forward key of the remote node with the
+// given ID.
+//
+// Although the key is immutable, nodes restored from a snapshot may not
+// have a key until it is received from the node.
+func (s *State) UpdateRemoteForwardKey(id string, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id == s.localID {
+		s.logger.Warn("update remote forward key: cannot update local node")
+		return false
+	}
+
+	n, ok := s.nodes[id]
+	if !ok {
+		s.logger.Warn("update remote forward key: node not in cluster")
+		return false
+	}
+	s.verifyNodeLocked(id)
+
+	n.ForwardKey = key
+	// The index contains copies of the node, so must be updated for
+	// forwarded requests to use the new key.
+	s.reindexNodesLocked(id)
+
+	return true
+}
+
 func (s *State) Metrics() *Metrics {
 	return s.metrics
 }
@@ -357,6 +958,18 @@ func (s *State) updateRemoteEndpointLocked(
 
 	n.Endpoints[endpointID] = listeners
 
+	s.verifyNodeLocked(id)
+	if unverified, ok := s.unverifiedEndpoints[id]; ok {
+		delete(unverified, endpointID)
+	}
+
+	updatedAt, ok := s.remoteEndpointsUpdatedAt[id]
+	if !ok {
+		updatedAt = make(map[string]time.Time)
+		s.remoteEndpointsUpdatedAt[id] = updatedAt
+	}
+	updatedAt[endpointID] = s.now()
+
 	return true
 }
 
@@ -375,10 +988,61 @@ func (s *State) removeRemoteEndpointLocked(id string, endpointID string) bool {
 	if n.Endpoints != nil {
 		delete(n.Endpoints, endpointID)
 	}
+	if updatedAt, ok := s.remoteEndpointsUpdatedAt[id]; ok {
+		delete(updatedAt, endpointID)
+	}
+	if unverified, ok := s.unverifiedEndpoints[id]; ok {
+		delete(unverified, endpointID)
+	}
 
 	return true
 }
 
+func (s *State) endpointLocationLocked(
+	node *Node,
+	endpointID string,
+	listeners int,
+	now time.Time,
+) EndpointLocation {
+	local := node.ID == s.localID
+	expired := !local && s.remoteEndpointExpiredLocked(node.ID, endpointID, now)
+	return EndpointLocation{
+		NodeID:    node.ID,
+		Status:    node.Status,
+		ProxyAddr: node.ProxyAddr,
+		Listeners: listeners,
+		Local:     local,
+		Expired:   expired,
+		Stale:     !local && (node.Status != NodeStatusActive || expired),
+	}
+}
+
+// verifyNodeLocked marks the node with the given ID as updated by gossip,
+// so it is no longer expired as an unverified node restored from a snapshot.
+//
+// Note this doesn't verify the nodes restored endpoints, which are only
+// verified when updated.
+func (s *State) verifyNodeLocked(id string) {
+	delete(s.unverifiedNodes, id)
+}
+
+// remoteEndpointExpiredLocked returns whether the endpoint on the node with
+// the given ID hasn't been refreshed within the endpoint TTL.
+func (s *State) remoteEndpointExpiredLocked(
+	id string,
+	endpointID string,
+	now time.Time,
+) bool {
+	if s.endpointTTL == 0 {
+		return false
+	}
+	updatedAt, ok := s.remoteEndpointsUpdatedAt[id][endpointID]
+	if !ok {
+		return false
+	}
+	return now.Sub(updatedAt) > s.endpointTTL
+}
+
 func (s *State) updateMetricsNode(oldStatus NodeStatus, newStatus NodeStatus) {
 	s.removeMetricsNode(oldStatus)
 	s.addMetricsNode(newStatus)
@@ -1,10 +1,14 @@
 package cluster
 
 import (
+	"fmt"
+	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/andydunstall/piko/pkg/log"
 )
@@ -70,6 +74,241 @@ func TestState_UpdateLocalEndpoint(t *testing.T) {
 	assert.Equal(t, 0, n.Endpoints["my-endpoint"])
 }
 
+func TestState_DrainLocalEndpoint(t *testing.T) {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(localNode.Copy(), log.NewNopLogger())
+
+	s.AddLocalEndpoint("my-endpoint")
+	s.AddLocalEndpoint("my-endpoint")
+
+	var notifyEndpointID string
+	var notifyListeners int
+	s.OnLocalEndpointUpdate(func(endpointID string) {
+		notifyEndpointID = endpointID
+		notifyListeners = s.LocalEndpointListeners(endpointID)
+	})
+
+	// Draining a listener should remove it from the active listeners.
+	s.DrainLocalEndpoint("my-endpoint")
+	assert.Equal(t, "my-endpoint", notifyEndpointID)
+	assert.Equal(t, 1, notifyListeners)
+	assert.Equal(t, 1, s.LocalDrainingEndpointListeners("my-endpoint"))
+
+	s.DrainLocalEndpoint("my-endpoint")
+	assert.Equal(t, 0, notifyListeners)
+	assert.Equal(t, 2, s.LocalDrainingEndpointListeners("my-endpoint"))
+	n, _ := s.Node("local")
+	assert.Equal(t, 0, n.Endpoints["my-endpoint"])
+	assert.Equal(t, 2, n.DrainingEndpoints["my-endpoint"])
+
+	// Draining an endpoint with no active listeners should have no affect.
+	s.DrainLocalEndpoint("my-endpoint")
+	assert.Equal(t, 2, s.LocalDrainingEndpointListeners("my-endpoint"))
+
+	s.RemoveLocalDrainingEndpoint("my-endpoint")
+	assert.Equal(t, 1, s.LocalDrainingEndpointListeners("my-endpoint"))
+	s.RemoveLocalDrainingEndpoint("my-endpoint")
+	assert.Equal(t, 0, s.LocalDrainingEndpointListeners("my-endpoint"))
+	n, _ = s.Node("local")
+	assert.Nil(t, n.DrainingEndpoints)
+}
+
+func TestState_SetLocalMetadata(t *testing.T) {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(localNode.Copy(), log.NewNopLogger())
+
+	var notifyKey string
+	s.OnLocalMetadataUpdate(func(key string) {
+		notifyKey = key
+	})
+
+	s.SetLocalMetadata("region", "eu-west-1")
+	assert.Equal(t, "region", notifyKey)
+	value, ok := s.LocalMetadata("region")
+	assert.True(t, ok)
+	assert.Equal(t, "eu-west-1", value)
+
+	s.SetLocalMetadata("region", "us-east-1")
+	n, _ := s.Node("local")
+	assert.Equal(t, map[string]string{"region": "us-east-1"}, n.Metadata)
+
+	// Updating the returned node must not modify the state.
+	n.Metadata["region"] = "ap-south-1"
+	value, _ = s.LocalMetadata("region")
+	assert.Equal(t, "us-east-1", value)
+
+	_, ok = s.LocalMetadata("unknown")
+	assert.False(t, ok)
+}
+
+func TestState_UpdateRemoteMetadata(t *testing.T) {
+	t.Run("update", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteMetadata("remote", "region", "eu-west-1"))
+
+		n, ok := s.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, map[string]string{"region": "eu-west-1"}, n.Metadata)
+	})
+
+	t.Run("node not found", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		assert.False(t, s.UpdateRemoteMetadata("remote", "region", "eu-west-1"))
+	})
+
+	t.Run("update local node", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		// Attempting to update the local node should have no affect.
+		assert.False(t, s.UpdateRemoteMetadata("local", "region", "eu-west-1"))
+		assert.Equal(t, localNode, s.LocalNode())
+	})
+}
+
+func TestState_UpdateRemoteForwardKey(t *testing.T) {
+	t.Run("update", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+			Endpoints: map[string]int{
+				"my-endpoint": 1,
+			},
+		})
+		assert.True(t, s.UpdateRemoteForwardKey("remote", "my-key"))
+
+		n, ok := s.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "my-key", n.ForwardKey)
+
+		// The indexed node must also be updated.
+		nodes := s.LookupEndpoints("my-endpoint")
+		assert.Len(t, nodes, 1)
+		assert.Equal(t, "my-key", nodes[0].ForwardKey)
+	})
+
+	t.Run("node not found", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		assert.False(t, s.UpdateRemoteForwardKey("remote", "my-key"))
+	})
+}
+
+func TestState_NodeSubscribers(t *testing.T) {
+	t.Run("join", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		var notifyNode *Node
+		s.OnNodeJoin(func(node *Node) {
+			notifyNode = node
+		})
+
+		newNode := &Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.98:8000",
+		}
+		s.AddNode(newNode.Copy())
+		assert.Equal(t, newNode, notifyNode)
+
+		// Adding the local node should not notify.
+		notifyNode = nil
+		s.AddNode(localNode.Copy())
+		assert.Nil(t, notifyNode)
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		var notifyNode *Node
+		s.OnNodeLeave(func(node *Node) {
+			notifyNode = node
+		})
+
+		newNode := &Node{
+			ID:        "remote",
+			Status:    NodeStatusLeft,
+			ProxyAddr: "10.26.104.98:8000",
+		}
+		s.AddNode(newNode.Copy())
+		assert.True(t, s.RemoveNode("remote"))
+		assert.Equal(t, newNode, notifyNode)
+
+		// Removing an unknown node should not notify.
+		notifyNode = nil
+		assert.False(t, s.RemoveNode("remote"))
+		assert.Nil(t, notifyNode)
+	})
+
+	t.Run("status change", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		var notifyNodes []*Node
+		s.OnNodeStatusChange(func(node *Node) {
+			notifyNodes = append(notifyNodes, node)
+		})
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusUnreachable))
+		// Updating to the same status should not notify.
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusUnreachable))
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusActive))
+
+		assert.Equal(t, []*Node{
+			{ID: "remote", Status: NodeStatusUnreachable},
+			{ID: "remote", Status: NodeStatusActive},
+		}, notifyNodes)
+	})
+}
+
 func TestState_AddNode(t *testing.T) {
 	t.Run("add node", func(t *testing.T) {
 		localNode := &Node{
@@ -190,6 +429,40 @@ func TestState_UpdateRemoteStatus(t *testing.T) {
 		assert.Equal(t, NodeStatusUnreachable, n.Status)
 	})
 
+	t.Run("leaving", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 1},
+		})
+		_, ok := s.LookupEndpoint("my-endpoint")
+		assert.True(t, ok)
+
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusLeaving))
+
+		// Leaving nodes should be excluded from lookups, even though the
+		// node still has the endpoint.
+		_, ok = s.LookupEndpoint("my-endpoint")
+		assert.False(t, ok)
+		n, _ := s.Node("remote")
+		assert.Equal(t, 1, n.Endpoints["my-endpoint"])
+
+		// A leaving node shouldn't become active again.
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusActive))
+		n, _ = s.Node("remote")
+		assert.Equal(t, NodeStatusLeaving, n.Status)
+
+		assert.True(t, s.UpdateRemoteStatus("remote", NodeStatusLeft))
+		n, _ = s.Node("remote")
+		assert.Equal(t, NodeStatusLeft, n.Status)
+	})
+
 	t.Run("update local status", func(t *testing.T) {
 		localNode := &Node{
 			ID:     "local",
@@ -365,3 +638,808 @@ func TestState_LookupEndpoint(t *testing.T) {
 		assert.False(t, ok)
 	})
 }
+
+func TestState_LookupEndpoints(t *testing.T) {
+	t.Run("sorted", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		for _, id := range []string{"remote-3", "remote-1", "remote-2"} {
+			s.AddNode(&Node{
+				ID:     id,
+				Status: NodeStatusActive,
+			})
+			assert.True(t, s.UpdateRemoteEndpoint(id, "my-endpoint", 2))
+		}
+
+		nodes := s.LookupEndpoints("my-endpoint")
+		assert.Equal(t, 3, len(nodes))
+		assert.Equal(t, "remote-1", nodes[0].ID)
+		assert.Equal(t, "remote-2", nodes[1].ID)
+		assert.Equal(t, "remote-3", nodes[2].ID)
+	})
+
+	t.Run("ignore inactive", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+			Endpoints: map[string]int{
+				"my-endpoint": 1,
+			},
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "remote-1",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1))
+		s.AddNode(&Node{
+			ID:     "remote-2",
+			Status: NodeStatusUnreachable,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1))
+		s.AddNode(&Node{
+			ID:     "remote-3",
+			Status: NodeStatusLeft,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-3", "my-endpoint", 1))
+
+		nodes := s.LookupEndpoints("my-endpoint")
+		assert.Equal(t, 1, len(nodes))
+		assert.Equal(t, "remote-1", nodes[0].ID)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		assert.Equal(t, 0, len(s.LookupEndpoints("my-endpoint")))
+	})
+
+	t.Run("mutations", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		lookupIDs := func(endpointID string) []string {
+			var ids []string
+			for _, node := range s.LookupEndpoints(endpointID) {
+				ids = append(ids, node.ID)
+			}
+			return ids
+		}
+
+		s.AddNode(&Node{
+			ID:     "remote-1",
+			Status: NodeStatusActive,
+			Endpoints: map[string]int{
+				"endpoint-1": 1,
+				"endpoint-2": 0,
+			},
+		})
+		assert.Equal(t, []string{"remote-1"}, lookupIDs("endpoint-1"))
+		// Endpoints without listeners aren't indexed.
+		assert.Nil(t, lookupIDs("endpoint-2"))
+
+		s.AddNode(&Node{
+			ID:     "remote-2",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "endpoint-1", 2))
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "endpoint-2", 1))
+		assert.Equal(t, []string{"remote-1", "remote-2"}, lookupIDs("endpoint-1"))
+		assert.Equal(t, []string{"remote-2"}, lookupIDs("endpoint-2"))
+
+		// Updated nodes are reflected in existing entries.
+		assert.True(t, s.UpdateRemoteMetadata("remote-2", MetadataZone, "zone-1"))
+		nodes := s.LookupEndpoints("endpoint-1")
+		require.Equal(t, 2, len(nodes))
+		assert.Equal(t, "zone-1", nodes[1].Zone())
+		assert.Equal(t, 1, nodes[1].Endpoints["endpoint-2"])
+
+		assert.True(t, s.UpdateRemoteStatus("remote-1", NodeStatusUnreachable))
+		assert.Equal(t, []string{"remote-2"}, lookupIDs("endpoint-1"))
+		assert.True(t, s.UpdateRemoteStatus("remote-1", NodeStatusActive))
+		assert.Equal(t, []string{"remote-1", "remote-2"}, lookupIDs("endpoint-1"))
+
+		assert.True(t, s.RemoveRemoteEndpoint("remote-2", "endpoint-1"))
+		assert.Equal(t, []string{"remote-1"}, lookupIDs("endpoint-1"))
+		assert.Equal(t, []string{"remote-2"}, lookupIDs("endpoint-2"))
+
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "endpoint-2", 0))
+		assert.Nil(t, lookupIDs("endpoint-2"))
+
+		assert.True(t, s.RemoveNode("remote-1"))
+		assert.Nil(t, lookupIDs("endpoint-1"))
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		for _, id := range []string{"remote-3", "remote-1", "remote-2"} {
+			s.AddNode(&Node{
+				ID:     id,
+				Status: NodeStatusActive,
+				Endpoints: map[string]int{
+					"my-endpoint": 1,
+				},
+			})
+		}
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 2))
+
+		var ids []string
+		for _, node := range s.LookupEndpoints("my-endpoint") {
+			ids = append(ids, node.ID)
+		}
+		assert.Equal(t, []string{"remote-1", "remote-2", "remote-3"}, ids)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			for i := 0; i != 100; i++ {
+				s.UpdateRemoteEndpoint("remote", "my-endpoint", i%2)
+				s.UpdateRemoteMetadata("remote", "key", "value")
+			}
+		}()
+
+		for i := 0; i != 100; i++ {
+			for _, node := range s.LookupEndpoints("my-endpoint") {
+				assert.Equal(t, "remote", node.ID)
+				assert.Equal(t, 1, node.Endpoints["my-endpoint"])
+			}
+		}
+		<-done
+	})
+}
+
+func TestState_EndpointNodes(t *testing.T) {
+	t.Run("multiple nodes", func(t *testing.T) {
+		localNode := &Node{
+			ID:        "local",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.1:8000",
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddLocalEndpoint("my-endpoint")
+		s.AddLocalEndpoint("my-endpoint")
+
+		s.AddNode(&Node{
+			ID:        "remote-2",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.3:8000",
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1))
+		s.AddNode(&Node{
+			ID:        "remote-1",
+			Status:    NodeStatusUnreachable,
+			ProxyAddr: "10.26.104.2:8000",
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 3))
+		// Nodes with other endpoints should be ignored.
+		s.AddNode(&Node{
+			ID:        "remote-3",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.4:8000",
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-3", "other-endpoint", 1))
+
+		assert.Equal(t, []EndpointLocation{
+			{
+				NodeID:    "local",
+				Status:    NodeStatusActive,
+				ProxyAddr: "10.26.104.1:8000",
+				Listeners: 2,
+				Local:     true,
+			},
+			{
+				NodeID:    "remote-1",
+				Status:    NodeStatusUnreachable,
+				ProxyAddr: "10.26.104.2:8000",
+				Listeners: 3,
+				Stale:     true,
+			},
+			{
+				NodeID:    "remote-2",
+				Status:    NodeStatusActive,
+				ProxyAddr: "10.26.104.3:8000",
+				Listeners: 1,
+			},
+		}, s.EndpointNodes("my-endpoint"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(
+			localNode.Copy(), log.NewNopLogger(), WithEndpointTTL(time.Minute),
+		)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+
+		s.AddLocalEndpoint("my-endpoint")
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+
+		now = now.Add(time.Minute * 2)
+
+		locations := s.EndpointNodes("my-endpoint")
+		assert.Equal(t, 2, len(locations))
+		// The local endpoint never expires.
+		assert.False(t, locations[0].Expired)
+		assert.True(t, locations[1].Expired)
+		assert.True(t, locations[1].Stale)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+		assert.True(t, s.RemoveRemoteEndpoint("remote", "my-endpoint"))
+
+		assert.Equal(t, 0, len(s.EndpointNodes("my-endpoint")))
+	})
+}
+
+func TestState_Endpoints(t *testing.T) {
+	t.Run("aggregate", func(t *testing.T) {
+		localNode := &Node{
+			ID:        "local",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.1:8000",
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		s.AddLocalEndpoint("endpoint-1")
+		s.AddLocalEndpoint("endpoint-1")
+
+		s.AddNode(&Node{
+			ID:        "remote-1",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.2:8000",
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-1", "endpoint-1", 3))
+		assert.True(t, s.UpdateRemoteEndpoint("remote-1", "endpoint-2", 1))
+
+		s.AddNode(&Node{
+			ID:        "remote-2",
+			Status:    NodeStatusActive,
+			ProxyAddr: "10.26.104.3:8000",
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "endpoint-2", 4))
+
+		assert.Equal(t, []Endpoint{
+			{
+				ID:        "endpoint-1",
+				Listeners: 5,
+				Nodes: []EndpointLocation{
+					{
+						NodeID:    "local",
+						Status:    NodeStatusActive,
+						ProxyAddr: "10.26.104.1:8000",
+						Listeners: 2,
+						Local:     true,
+					},
+					{
+						NodeID:    "remote-1",
+						Status:    NodeStatusActive,
+						ProxyAddr: "10.26.104.2:8000",
+						Listeners: 3,
+					},
+				},
+			},
+			{
+				ID:        "endpoint-2",
+				Listeners: 5,
+				Nodes: []EndpointLocation{
+					{
+						NodeID:    "remote-1",
+						Status:    NodeStatusActive,
+						ProxyAddr: "10.26.104.2:8000",
+						Listeners: 1,
+					},
+					{
+						NodeID:    "remote-2",
+						Status:    NodeStatusActive,
+						ProxyAddr: "10.26.104.3:8000",
+						Listeners: 4,
+					},
+				},
+			},
+		}, s.Endpoints())
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(
+			localNode.Copy(), log.NewNopLogger(), WithEndpointTTL(time.Minute),
+		)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+
+		s.AddLocalEndpoint("my-endpoint")
+
+		s.AddNode(&Node{
+			ID:     "remote-1",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-1", "my-endpoint", 2))
+
+		s.AddNode(&Node{
+			ID:     "remote-2",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-2", "my-endpoint", 3))
+		assert.True(t, s.UpdateRemoteStatus("remote-2", NodeStatusUnreachable))
+
+		s.AddNode(&Node{
+			ID:     "remote-3",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote-3", "my-endpoint", 4))
+
+		now = now.Add(time.Second * 30)
+		assert.True(t, s.RefreshRemoteEndpoints("remote-1"))
+		assert.True(t, s.RefreshRemoteEndpoints("remote-2"))
+		now = now.Add(time.Second * 40)
+
+		endpoints := s.Endpoints()
+		require.Equal(t, 1, len(endpoints))
+		// Only the local node and remote-1 are routable.
+		assert.Equal(t, 3, endpoints[0].Listeners)
+
+		nodes := endpoints[0].Nodes
+		require.Equal(t, 4, len(nodes))
+		assert.False(t, nodes[0].Stale)
+		assert.False(t, nodes[1].Stale)
+		// remote-2 is unreachable.
+		assert.True(t, nodes[2].Stale)
+		assert.False(t, nodes[2].Expired)
+		// remote-3's endpoint has expired.
+		assert.True(t, nodes[3].Stale)
+		assert.True(t, nodes[3].Expired)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+
+		assert.Equal(t, 0, len(s.Endpoints()))
+	})
+}
+
+func TestState_ExpireRemoteEndpoints(t *testing.T) {
+	t.Run("expired", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(
+			localNode.Copy(), log.NewNopLogger(), WithEndpointTTL(time.Minute),
+		)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+
+		var notifyNodeID, notifyEndpointID string
+		s.OnRemoteEndpointUpdate(func(nodeID string, endpointID string) {
+			notifyNodeID = nodeID
+			notifyEndpointID = endpointID
+		})
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+		assert.Equal(t, 1, len(s.LookupEndpoints("my-endpoint")))
+
+		now = now.Add(time.Minute * 2)
+
+		// Expired endpoints are ignored.
+		assert.Equal(t, 0, len(s.LookupEndpoints("my-endpoint")))
+
+		// Though they aren't removed, so the endpoint is available again
+		// once refreshed.
+		notifyNodeID, notifyEndpointID = "", ""
+		assert.Equal(t, 0, s.ExpireRemoteEndpoints())
+		assert.Equal(t, "", notifyNodeID)
+		assert.Equal(t, "", notifyEndpointID)
+
+		n, ok := s.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, map[string]int{"my-endpoint": 2}, n.Endpoints)
+
+		locations := s.EndpointNodes("my-endpoint")
+		assert.Equal(t, 1, len(locations))
+		assert.True(t, locations[0].Expired)
+
+		assert.True(t, s.RefreshRemoteEndpoints("remote"))
+		assert.Equal(t, 1, len(s.LookupEndpoints("my-endpoint")))
+	})
+
+	t.Run("refreshed", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(
+			localNode.Copy(), log.NewNopLogger(), WithEndpointTTL(time.Minute),
+		)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+
+		now = now.Add(time.Second * 50)
+		assert.True(t, s.RefreshRemoteEndpoints("remote"))
+		now = now.Add(time.Second * 50)
+
+		assert.Equal(t, 0, s.ExpireRemoteEndpoints())
+		assert.Equal(t, 1, len(s.LookupEndpoints("my-endpoint")))
+	})
+
+	t.Run("no ttl", func(t *testing.T) {
+		localNode := &Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}
+		s := NewState(localNode.Copy(), log.NewNopLogger())
+		now := time.Now()
+		s.now = func() time.Time { return now }
+
+		s.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.True(t, s.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+
+		now = now.Add(time.Hour)
+
+		assert.Equal(t, 0, s.ExpireRemoteEndpoints())
+		assert.Equal(t, 1, len(s.LookupEndpoints("my-endpoint")))
+	})
+}
+
+func TestState_Snapshot(t *testing.T) {
+	t.Run("restore", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		s.AddLocalEndpoint("local-endpoint")
+		s.AddNode(&Node{
+			ID:         "remote-1",
+			Status:     NodeStatusActive,
+			ProxyAddr:  "10.26.104.56:8000",
+			AdminAddr:  "10.26.104.56:8001",
+			ForwardKey: "my-key",
+			Endpoints:  map[string]int{"my-endpoint": 2},
+			Metadata:   map[string]string{"zone": "us-east-1a"},
+		})
+		s.AddNode(&Node{
+			ID:        "remote-2",
+			Status:    NodeStatusLeft,
+			Endpoints: map[string]int{"my-endpoint": 1},
+		})
+
+		b, err := s.Snapshot()
+		assert.NoError(t, err)
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+
+		var joined []string
+		restored.OnNodeJoin(func(node *Node) {
+			joined = append(joined, node.ID)
+		})
+
+		assert.NoError(t, restored.Restore(b))
+		assert.Equal(t, []string{"remote-1"}, joined)
+
+		// Only active remote nodes are restored.
+		n, ok := restored.Node("remote-1")
+		assert.True(t, ok)
+		assert.Equal(t, &Node{
+			ID:         "remote-1",
+			Status:     NodeStatusActive,
+			ProxyAddr:  "10.26.104.56:8000",
+			AdminAddr:  "10.26.104.56:8001",
+			ForwardKey: "my-key",
+			Endpoints:  map[string]int{"my-endpoint": 2},
+			Metadata:   map[string]string{"zone": "us-east-1a"},
+		}, n)
+		_, ok = restored.Node("remote-2")
+		assert.False(t, ok)
+		_, ok = restored.Node("local-1")
+		assert.False(t, ok)
+		assert.Equal(t, 0, restored.LocalEndpointListeners("local-endpoint"))
+
+		// Restored endpoints are routable.
+		n, ok = restored.LookupEndpoint("my-endpoint")
+		assert.True(t, ok)
+		assert.Equal(t, "remote-1", n.ID)
+	})
+
+	t.Run("unverified expired", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		})
+
+		b, err := s.Snapshot()
+		assert.NoError(t, err)
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		restored.now = func() time.Time { return now }
+		assert.NoError(t, restored.Restore(b))
+
+		var left []string
+		restored.OnNodeLeave(func(node *Node) {
+			left = append(left, node.ID)
+		})
+
+		// Heartbeats don't refresh unverified endpoints.
+		now = now.Add(time.Second * 50)
+		assert.True(t, restored.RefreshRemoteEndpoints("remote"))
+		assert.Equal(t, 1, len(restored.LookupEndpoints("my-endpoint")))
+
+		now = now.Add(time.Second * 50)
+		assert.Equal(t, 0, len(restored.LookupEndpoints("my-endpoint")))
+		assert.Equal(t, 1, restored.ExpireRemoteEndpoints())
+
+		// The node was verified by the heartbeat so isn't removed.
+		_, ok := restored.Node("remote")
+		assert.True(t, ok)
+		assert.Empty(t, left)
+	})
+
+	t.Run("unverified node expired", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		})
+
+		b, err := s.Snapshot()
+		assert.NoError(t, err)
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		restored.now = func() time.Time { return now }
+		assert.NoError(t, restored.Restore(b))
+
+		var left []string
+		restored.OnNodeLeave(func(node *Node) {
+			left = append(left, node.ID)
+		})
+
+		now = now.Add(time.Minute * 2)
+		assert.Equal(t, 1, restored.ExpireRemoteEndpoints())
+
+		_, ok := restored.Node("remote")
+		assert.False(t, ok)
+		assert.Equal(t, []string{"remote"}, left)
+	})
+
+	t.Run("verified", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		})
+
+		b, err := s.Snapshot()
+		assert.NoError(t, err)
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger(), WithEndpointTTL(time.Minute))
+		restored.now = func() time.Time { return now }
+		assert.NoError(t, restored.Restore(b))
+
+		// Gossip confirms the endpoint, after which it is refreshed by
+		// heartbeats.
+		now = now.Add(time.Second * 30)
+		assert.True(t, restored.UpdateRemoteEndpoint("remote", "my-endpoint", 2))
+		now = now.Add(time.Second * 50)
+		assert.True(t, restored.RefreshRemoteEndpoints("remote"))
+		now = now.Add(time.Second * 50)
+
+		assert.Equal(t, 0, restored.ExpireRemoteEndpoints())
+		assert.Equal(t, 1, len(restored.LookupEndpoints("my-endpoint")))
+	})
+
+	t.Run("existing node", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger())
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		})
+
+		b, err := s.Snapshot()
+		assert.NoError(t, err)
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger())
+		restored.AddNode(&Node{
+			ID:     "remote",
+			Status: NodeStatusActive,
+		})
+		assert.NoError(t, restored.Restore(b))
+
+		// Nodes already in the cluster aren't overridden.
+		n, ok := restored.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, 0, len(n.Endpoints))
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local-1",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger())
+		s.AddNode(&Node{
+			ID:        "remote",
+			Status:    NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		})
+
+		path := filepath.Join(t.TempDir(), "snapshot.json")
+		assert.NoError(t, s.SaveSnapshot(path))
+
+		restored := NewState(&Node{
+			ID:     "local-2",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger())
+		assert.NoError(t, restored.LoadSnapshot(path))
+		_, ok := restored.LookupEndpoint("my-endpoint")
+		assert.True(t, ok)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		s := NewState(&Node{
+			ID:     "local",
+			Status: NodeStatusActive,
+		}, log.NewNopLogger())
+
+		assert.Error(t, s.Restore([]byte("foo")))
+		assert.ErrorContains(t, s.Restore([]byte(`{"version":2}`)), "unsupported version")
+	})
+}
+
+// newBenchmarkState returns a state with the given number of remote nodes,
+// each with the given number of endpoints.
+func newBenchmarkState(nodes int, endpoints int) *State {
+	localNode := &Node{
+		ID:     "local",
+		Status: NodeStatusActive,
+	}
+	s := NewState(
+		localNode.Copy(), log.NewNopLogger(), WithEndpointTTL(time.Minute),
+	)
+	for i := 0; i != nodes; i++ {
+		node := &Node{
+			ID:        fmt.Sprintf("remote-%d", i),
+			Status:    NodeStatusActive,
+			Endpoints: make(map[string]int),
+		}
+		for j := 0; j != endpoints; j++ {
+			node.Endpoints[fmt.Sprintf("endpoint-%d", j)] = 1
+		}
+		s.AddNode(node)
+	}
+	return s
+}
+
+func BenchmarkState_RefreshRemoteEndpoints(b *testing.B) {
+	s := newBenchmarkState(100, 1000)
+
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		s.RefreshRemoteEndpoints(fmt.Sprintf("remote-%d", i%100))
+	}
+}
+
+func BenchmarkState_UpdateRemoteEndpoint(b *testing.B) {
+	s := newBenchmarkState(100, 1000)
+
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		s.UpdateRemoteEndpoint(
+			fmt.Sprintf("remote-%d", i%100),
+			fmt.Sprintf("endpoint-%d", i%1000),
+			i%2+1,
+		)
+	}
+}
+
+func BenchmarkState_LookupEndpoints(b *testing.B) {
+	s := newBenchmarkState(100, 1000)
+
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		s.LookupEndpoints(fmt.Sprintf("endpoint-%d", i%1000))
+	}
+}
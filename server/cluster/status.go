@@ -22,6 +22,8 @@ func (s *Status) Register(group *gin.RouterGroup) {
 	group.GET("/nodes", s.listNodesRoute)
 	group.GET("/nodes/local", s.getLocalNodeRoute)
 	group.GET("/nodes/:id", s.getNodeRoute)
+	group.GET("/endpoints", s.listEndpointsRoute)
+	group.GET("/endpoints/:id", s.getEndpointRoute)
 }
 
 func (s *Status) listNodesRoute(c *gin.Context) {
@@ -44,4 +46,18 @@ func (s *Status) getNodeRoute(c *gin.Context) {
 	c.JSON(http.StatusOK, node)
 }
 
+func (s *Status) listEndpointsRoute(c *gin.Context) {
+	endpoints := s.state.Endpoints()
+	c.JSON(http.StatusOK, endpoints)
+}
+
+func (s *Status) getEndpointRoute(c *gin.Context) {
+	id := c.Param("id")
+	locations := s.state.EndpointNodes(id)
+	if locations == nil {
+		locations = []EndpointLocation{}
+	}
+	c.JSON(http.StatusOK, locations)
+}
+
 var _ status.Handler = &Status{}
@@ -2,6 +2,13 @@ package config
 
 import (
 	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/spf13/pflag"
@@ -27,6 +34,24 @@ type ClusterConfig struct {
 	JoinTimeout time.Duration `json:"join_timeout" yaml:"join_timeout"`
 
 	AbortIfJoinFails bool `json:"abort_if_join_fails" yaml:"abort_if_join_fails"`
+
+	// Zone is the availability zone or region the node is running in.
+	//
+	// When forwarding requests to other nodes, nodes in the same zone are
+	// preferred.
+	Zone string `json:"zone" yaml:"zone"`
+
+	// EndpointTTL is the duration a remote nodes endpoint is considered
+	// active without being refreshed. If zero, endpoints never expire.
+	EndpointTTL time.Duration `json:"endpoint_ttl" yaml:"endpoint_ttl"`
+
+	// SnapshotPath is the path of a file to periodically write a snapshot
+	// of the cluster state to, which is restored on boot. If empty,
+	// snapshots are disabled.
+	SnapshotPath string `json:"snapshot_path" yaml:"snapshot_path"`
+
+	// SnapshotInterval is the interval to write cluster state snapshots.
+	SnapshotInterval time.Duration `json:"snapshot_interval" yaml:"snapshot_interval"`
 }
 
 func (c *ClusterConfig) Validate() error {
@@ -36,6 +61,16 @@ func (c *ClusterConfig) Validate() error {
 	if c.JoinTimeout == 0 {
 		return fmt.Errorf("missing join timeout")
 	}
+	if c.SnapshotPath != "" {
+		if c.SnapshotInterval <= 0 {
+			return fmt.Errorf("missing snapshot interval")
+		}
+		// Without a TTL, restored endpoints would never expire if the
+		// owning node has left.
+		if c.EndpointTTL == 0 {
+			return fmt.Errorf("snapshot path requires endpoint ttl")
+		}
+	}
 
 	return nil
 }
@@ -101,6 +136,63 @@ set.`,
 Whether the server node should abort if it is configured with more than one
 node to join (excluding itself) but fails to join any members.`,
 	)
+
+	fs.StringVar(
+		&c.Zone,
+		"cluster.zone",
+		c.Zone,
+		`
+The availability zone or region the node is running in, such as
+'us-east-1a'.
+
+When forwarding a request to another node in the cluster, Piko will prefer
+nodes in the same zone as the local node, and only forward to nodes in other
+zones when no node in the same zone has a connected upstream for the
+endpoint.`,
+	)
+
+	fs.DurationVar(
+		&c.EndpointTTL,
+		"cluster.endpoint-ttl",
+		c.EndpointTTL,
+		`
+The duration an endpoint on another node is considered active without being
+refreshed.
+
+Each node periodically sends a heartbeat to refresh its endpoints. If a node
+crashes without leaving the cluster, requests are no longer forwarded to its
+endpoints once the TTL expires, rather than forwarding requests to the node
+until it is detected as unreachable. If the node resumes sending heartbeats,
+its endpoints become active again.
+
+If zero, endpoints never expire. Note every node in the cluster should use the
+same TTL.`,
+	)
+
+	fs.StringVar(
+		&c.SnapshotPath,
+		"cluster.snapshot-path",
+		c.SnapshotPath,
+		`
+The path of a file to periodically write a snapshot of the known cluster state
+to.
+
+On boot, the node restores the snapshot so it can route requests to endpoints
+on other nodes while it re-learns the cluster state using gossip. Restored
+nodes and endpoints are considered unverified, and are removed if not
+confirmed by gossip within '--cluster.endpoint-ttl', which must be set.
+
+If empty, snapshots are disabled.`,
+	)
+
+	fs.DurationVar(
+		&c.SnapshotInterval,
+		"cluster.snapshot-interval",
+		c.SnapshotInterval,
+		`
+The interval to write cluster state snapshots when '--cluster.snapshot-path'
+is set.`,
+	)
 }
 
 // HTTPConfig contains generic configuration for the HTTP servers.
@@ -176,6 +268,853 @@ keys and values, including the request line.`,
 	)
 }
 
+// StickyConfig configures routing requests from the same client to the same
+// upstream.
+type StickyConfig struct {
+	// Enabled indicates whether to route requests with the same session key
+	// to the same upstream.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Cookie is the name of the cookie containing the session key.
+	Cookie string `json:"cookie" yaml:"cookie"`
+
+	// Header is the name of the header containing the session key.
+	Header string `json:"header" yaml:"header"`
+}
+
+func (c *StickyConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Cookie == "" && c.Header == "" {
+		return fmt.Errorf("missing cookie or header")
+	}
+	if c.Cookie != "" && c.Header != "" {
+		return fmt.Errorf("cannot set both cookie and header")
+	}
+	return nil
+}
+
+func (c *StickyConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".sticky."
+
+	fs.BoolVar(
+		&c.Enabled,
+		prefix+"enabled",
+		c.Enabled,
+		`
+Whether to route requests from the same client to the same upstream.
+
+The client is identified by a session key in either a cookie or header. If
+the request doesn't include a session key, the request is load balanced as
+normal.`,
+	)
+	fs.StringVar(
+		&c.Cookie,
+		prefix+"cookie",
+		c.Cookie,
+		`
+The name of the cookie containing the session key.
+
+If the request doesn't include the cookie, Piko will generate a session key
+and set the cookie in the response once an upstream is selected. The cookie
+uses 'SameSite=Lax', and is marked 'Secure' when the client connected using
+TLS.`,
+	)
+	fs.StringVar(
+		&c.Header,
+		prefix+"header",
+		c.Header,
+		`
+The name of the header containing the session key.`,
+	)
+}
+
+// RetryConfig configures retrying requests forwarded to other nodes.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of nodes to attempt to forward a
+	// request to. If 1, requests are not retried.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+
+	// AllMethods indicates whether to retry requests with non-idempotent
+	// methods, such as POST.
+	AllMethods bool `json:"all_methods" yaml:"all_methods"`
+
+	// BudgetRatio is the maximum ratio of retries and hedged requests to
+	// requests forwarded to other nodes, such as 0.1 allows one retry for
+	// every 10 forwarded requests. If zero, retries are not limited.
+	BudgetRatio float64 `json:"budget_ratio" yaml:"budget_ratio"`
+
+	// BudgetBurst is the maximum number of retries allowed in a burst when
+	// within the budget.
+	BudgetBurst int `json:"budget_burst" yaml:"budget_burst"`
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	if c.BudgetRatio < 0 || c.BudgetRatio > 1 {
+		return fmt.Errorf("budget ratio must be between 0 and 1")
+	}
+	if c.BudgetRatio > 0 && c.BudgetBurst < 1 {
+		return fmt.Errorf("budget burst must be at least 1")
+	}
+	return nil
+}
+
+func (c *RetryConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".retry."
+
+	fs.IntVar(
+		&c.MaxAttempts,
+		prefix+"max-attempts",
+		c.MaxAttempts,
+		`
+The maximum number of nodes to attempt when forwarding a request to another
+node in the cluster.
+
+If forwarding a request fails due to a connection error, Piko will retry
+with another node that has an upstream connected for the endpoint. Requests
+are never retried if the upstream responds, even with a 5xx status.
+
+If 1, requests are not retried.`,
+	)
+	fs.BoolVar(
+		&c.AllMethods,
+		prefix+"all-methods",
+		c.AllMethods,
+		`
+Whether to retry requests with non-idempotent methods, such as POST.
+
+By default, non-idempotent requests are only retried if the connection to
+the node could not be established so the request wasn't sent.`,
+	)
+	fs.Float64Var(
+		&c.BudgetRatio,
+		prefix+"budget-ratio",
+		c.BudgetRatio,
+		`
+The maximum ratio of retries to requests forwarded to other nodes, such as
+'0.1' allows one retry for every 10 forwarded requests.
+
+The budget is shared by all endpoints and includes hedged requests. When the
+budget is exhausted, such as when many nodes are failing, requests fail
+without retrying, so retries don't amplify the load on a struggling cluster.
+
+If zero, retries are not limited.`,
+	)
+	fs.IntVar(
+		&c.BudgetBurst,
+		prefix+"budget-burst",
+		c.BudgetBurst,
+		`
+The maximum number of retries allowed in a burst when within the retry
+budget, such as after a period with few failures.`,
+	)
+}
+
+// HedgeConfig configures hedging requests forwarded to other nodes.
+type HedgeConfig struct {
+	// Delay is the duration to wait for a node to respond before sending
+	// the request to an alternative node. If zero, requests are not
+	// hedged.
+	Delay time.Duration `json:"delay" yaml:"delay"`
+}
+
+func (c *HedgeConfig) Validate() error {
+	if c.Delay < 0 {
+		return fmt.Errorf("delay cannot be negative")
+	}
+	return nil
+}
+
+func (c *HedgeConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".hedge."
+
+	fs.DurationVar(
+		&c.Delay,
+		prefix+"delay",
+		c.Delay,
+		`
+The duration to wait for a node to respond to a forwarded request before
+sending a second 'hedged' request to an alternative node with the endpoint.
+
+Piko uses whichever response arrives first and cancels the other request.
+This reduces tail latency when a node is slow, at the cost of sending
+additional requests. The delay should typically be set to around the p95
+forwarding latency.
+
+Only requests with idempotent methods and no body are hedged, and each
+request is hedged at most once.
+
+If zero, requests are not hedged.`,
+	)
+}
+
+// ForwardConfig configures the connections used to forward requests to other
+// nodes in the cluster.
+type ForwardConfig struct {
+	// MaxIdleConns is the maximum number of idle connections to keep open to
+	// each node for reuse. If zero, connections are not reused.
+	MaxIdleConns int `json:"max_idle_conns" yaml:"max_idle_conns"`
+
+	// IdleTimeout is the maximum duration an idle connection is kept open
+	// before being closed.
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout"`
+}
+
+func (c *ForwardConfig) Validate() error {
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("max idle conns cannot be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c *ForwardConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".forward."
+
+	fs.IntVar(
+		&c.MaxIdleConns,
+		prefix+"max-idle-conns",
+		c.MaxIdleConns,
+		`
+The maximum number of idle connections to keep open to each node in the
+cluster.
+
+When a request is forwarded to another node, Piko reuses an idle connection to
+that node if there is one, to avoid the latency of establishing a new
+connection for each request.
+
+If zero, a new connection is used for each forwarded request.`,
+	)
+	fs.DurationVar(
+		&c.IdleTimeout,
+		prefix+"idle-timeout",
+		c.IdleTimeout,
+		`
+The maximum duration an idle connection to another node is kept open before
+being closed.
+
+This should be less than the '--proxy.http.idle-timeout' of the other nodes.`,
+	)
+}
+
+// RateLimitConfig configures limiting the rate of requests to each endpoint
+// using a token bucket.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of requests allowed. If zero,
+	// requests are not rate limited.
+	RequestsPerSecond float64 `json:"requests_per_second" yaml:"requests_per_second"`
+
+	// Burst is the maximum number of requests allowed in a burst above the
+	// sustained rate.
+	Burst int `json:"burst" yaml:"burst"`
+
+	// PerClient indicates whether to limit each client IP separately, rather
+	// than limiting all requests to the endpoint.
+	PerClient bool `json:"per_client" yaml:"per_client"`
+
+	// MaxKeys is the maximum number of rate limit buckets to track. When
+	// exceeded, the least recently used bucket is evicted.
+	MaxKeys int `json:"max_keys" yaml:"max_keys"`
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if c.RequestsPerSecond < 0 {
+		return fmt.Errorf("requests per second cannot be negative")
+	}
+	if c.RequestsPerSecond == 0 {
+		return nil
+	}
+	if c.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	if c.MaxKeys < 1 {
+		return fmt.Errorf("max keys must be at least 1")
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".rate-limit."
+
+	fs.Float64Var(
+		&c.RequestsPerSecond,
+		prefix+"requests-per-second",
+		c.RequestsPerSecond,
+		`
+The sustained rate of requests per second allowed to each endpoint.
+
+Requests that exceed the limit are rejected with a '429 Too Many Requests'
+response including a 'Retry-After' header.
+
+The limit can be overridden for specific endpoints in the YAML configuration
+file.
+
+If zero requests are not rate limited.`,
+	)
+	fs.IntVar(
+		&c.Burst,
+		prefix+"burst",
+		c.Burst,
+		`
+The maximum number of requests allowed in a burst above the sustained rate.`,
+	)
+	fs.BoolVar(
+		&c.PerClient,
+		prefix+"per-client",
+		c.PerClient,
+		`
+Whether to limit the requests from each client IP to an endpoint separately,
+rather than limiting all requests to the endpoint.`,
+	)
+	fs.IntVar(
+		&c.MaxKeys,
+		prefix+"max-keys",
+		c.MaxKeys,
+		`
+The maximum number of endpoints or clients to track rate limits for. When
+exceeded, the least recently used is evicted.`,
+	)
+}
+
+// ConcurrencyLimitConfig configures limiting the number of concurrent
+// requests to each endpoint.
+type ConcurrencyLimitConfig struct {
+	// MaxRequests is the maximum number of concurrent requests to each
+	// endpoint. If zero, concurrent requests are not limited.
+	MaxRequests int `json:"max_requests" yaml:"max_requests"`
+
+	// QueueTimeout is the maximum duration a request waits for a slot when
+	// the endpoint is at the limit. If zero, requests over the limit are
+	// rejected immediately.
+	QueueTimeout time.Duration `json:"queue_timeout" yaml:"queue_timeout"`
+}
+
+func (c *ConcurrencyLimitConfig) Validate() error {
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("max requests cannot be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("queue timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c *ConcurrencyLimitConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".concurrency-limit."
+
+	fs.IntVar(
+		&c.MaxRequests,
+		prefix+"max-requests",
+		c.MaxRequests,
+		`
+The maximum number of concurrent requests to each endpoint on this node.
+
+Requests over the limit wait for up to '--proxy.concurrency-limit.queue-timeout'
+for an in-flight request to complete, and are otherwise rejected with a
+'503 Service Unavailable' response including a 'Retry-After' header.
+
+The limit can be overridden for specific endpoints in the YAML configuration
+file.
+
+If zero concurrent requests are not limited.`,
+	)
+	fs.DurationVar(
+		&c.QueueTimeout,
+		prefix+"queue-timeout",
+		c.QueueTimeout,
+		`
+The maximum duration a request waits for an in-flight request to complete
+when the endpoint is at the concurrency limit.
+
+If zero requests over the limit are rejected immediately.`,
+	)
+}
+
+// ProxyMetricsConfig configures the proxy metrics.
+type ProxyMetricsConfig struct {
+	// Endpoints is an allow list of endpoint IDs to label metrics with. If
+	// set, requests to other endpoints are labelled '_other'.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// MaxEndpoints is the maximum number of distinct endpoint IDs to label
+	// metrics with. Requests to endpoints beyond the limit are labelled
+	// '_other'. If zero the number of endpoints is unlimited.
+	//
+	// Ignored if Endpoints is set.
+	MaxEndpoints int `json:"max_endpoints" yaml:"max_endpoints"`
+}
+
+func (c *ProxyMetricsConfig) Validate() error {
+	if c.MaxEndpoints < 0 {
+		return fmt.Errorf("max endpoints cannot be negative")
+	}
+	return nil
+}
+
+func (c *ProxyMetricsConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".metrics."
+
+	fs.StringSliceVar(
+		&c.Endpoints,
+		prefix+"endpoints",
+		c.Endpoints,
+		`
+An allow list of endpoint IDs to label metrics with.
+
+Requests to endpoints not in the list are labelled '_other'. Such as
+'--proxy.metrics.endpoints my-endpoint-1,my-endpoint-2'.
+
+If set, '--proxy.metrics.max-endpoints' is ignored.`,
+	)
+	fs.IntVar(
+		&c.MaxEndpoints,
+		prefix+"max-endpoints",
+		c.MaxEndpoints,
+		`
+The maximum number of distinct endpoint IDs to label metrics with, to limit
+the cardinality of the metrics.
+
+Once exceeded, requests to new endpoints are labelled '_other'.
+
+If zero the number of endpoints is unlimited.`,
+	)
+}
+
+// CORSConfig configures handling Cross-Origin Resource Sharing (CORS)
+// requests from browser clients.
+type CORSConfig struct {
+	// Enabled indicates whether to answer preflight requests and add CORS
+	// headers to responses.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// AllowedOrigins contains the origins allowed to make cross-origin
+	// requests. '*' allows any origin.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+
+	// AllowedMethods contains the methods allowed in cross-origin requests.
+	AllowedMethods []string `json:"allowed_methods" yaml:"allowed_methods"`
+
+	// AllowedHeaders contains the request headers allowed in cross-origin
+	// requests. '*' allows any header.
+	AllowedHeaders []string `json:"allowed_headers" yaml:"allowed_headers"`
+
+	// AllowCredentials indicates whether cross-origin requests may include
+	// credentials, such as cookies.
+	AllowCredentials bool `json:"allow_credentials" yaml:"allow_credentials"`
+
+	// MaxAge is the duration browsers may cache preflight responses. If zero
+	// the 'Access-Control-Max-Age' header isn't set.
+	MaxAge time.Duration `json:"max_age" yaml:"max_age"`
+}
+
+func (c *CORSConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("missing allowed origins")
+	}
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		return fmt.Errorf("cannot allow credentials with wildcard origin")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max age cannot be negative")
+	}
+	return nil
+}
+
+func (c *CORSConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".cors."
+
+	fs.BoolVar(
+		&c.Enabled,
+		prefix+"enabled",
+		c.Enabled,
+		`
+Whether to handle Cross-Origin Resource Sharing (CORS) requests.
+
+When enabled, Piko answers preflight 'OPTIONS' requests from allowed origins
+without forwarding them to the upstream, and adds CORS headers to responses.
+
+CORS can be configured for specific endpoints in the YAML configuration file.`,
+	)
+	fs.StringSliceVar(
+		&c.AllowedOrigins,
+		prefix+"allowed-origins",
+		c.AllowedOrigins,
+		`
+The origins allowed to make cross-origin requests, such as
+'--proxy.cors.allowed-origins https://example.com'.
+
+'*' allows any origin, though cannot be used with
+'--proxy.cors.allow-credentials'.`,
+	)
+	fs.StringSliceVar(
+		&c.AllowedMethods,
+		prefix+"allowed-methods",
+		c.AllowedMethods,
+		`
+The methods allowed in cross-origin requests.`,
+	)
+	fs.StringSliceVar(
+		&c.AllowedHeaders,
+		prefix+"allowed-headers",
+		c.AllowedHeaders,
+		`
+The request headers allowed in cross-origin requests. '*' allows any
+header.`,
+	)
+	fs.BoolVar(
+		&c.AllowCredentials,
+		prefix+"allow-credentials",
+		c.AllowCredentials,
+		`
+Whether cross-origin requests may include credentials, such as cookies.`,
+	)
+	fs.DurationVar(
+		&c.MaxAge,
+		prefix+"max-age",
+		c.MaxAge,
+		`
+How long browsers may cache preflight responses.
+
+If zero the 'Access-Control-Max-Age' header isn't set.`,
+	)
+}
+
+// CompressionConfig configures compressing responses with gzip.
+type CompressionConfig struct {
+	// Enabled indicates whether to compress responses when the client
+	// accepts gzip.
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// MinSize is the minimum response body size in bytes to compress.
+	// Responses with an unknown size are always compressed.
+	MinSize int64 `json:"min_size" yaml:"min_size"`
+
+	// ContentTypes contains the media types of responses to compress. A
+	// type ending with '/*' matches all subtypes, such as 'text/*'.
+	ContentTypes []string `json:"content_types" yaml:"content_types"`
+}
+
+func (c *CompressionConfig) Validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("min size cannot be negative")
+	}
+	return nil
+}
+
+func (c *CompressionConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".compression."
+
+	fs.BoolVar(
+		&c.Enabled,
+		prefix+"enabled",
+		c.Enabled,
+		`
+Whether to compress responses with gzip.
+
+When enabled, if the client accepts gzip and the upstream response isn't
+already encoded, Piko compresses responses with a compressible content type.
+
+Compression can be configured for specific endpoints in the YAML configuration
+file.`,
+	)
+	fs.Int64Var(
+		&c.MinSize,
+		prefix+"min-size",
+		c.MinSize,
+		`
+The minimum response body size in bytes to compress. Smaller responses are
+forwarded uncompressed.
+
+Responses with an unknown size are always compressed.`,
+	)
+	fs.StringSliceVar(
+		&c.ContentTypes,
+		prefix+"content-types",
+		c.ContentTypes,
+		`
+The content types of responses to compress. A type ending with '/*' matches
+all subtypes, such as 'text/*'.`,
+	)
+}
+
+// EndpointConfig overrides the proxy configuration for a specific endpoint.
+type EndpointConfig struct {
+	// MaxRequestBodyBytes overrides the maximum request body size for the
+	// endpoint.
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes" yaml:"max_request_body_bytes"`
+
+	// MaxResponseBodyBytes overrides the maximum response body size for the
+	// endpoint.
+	MaxResponseBodyBytes int64 `json:"max_response_body_bytes" yaml:"max_response_body_bytes"`
+
+	// RateLimitRequestsPerSecond overrides the sustained rate of requests
+	// allowed to the endpoint.
+	RateLimitRequestsPerSecond float64 `json:"rate_limit_requests_per_second" yaml:"rate_limit_requests_per_second"`
+
+	// RateLimitBurst overrides the maximum burst of requests allowed to the
+	// endpoint.
+	RateLimitBurst int `json:"rate_limit_burst" yaml:"rate_limit_burst"`
+
+	// MaxConcurrentRequests overrides the maximum number of concurrent
+	// requests to the endpoint.
+	MaxConcurrentRequests int `json:"max_concurrent_requests" yaml:"max_concurrent_requests"`
+
+	// DisableAuth indicates whether requests to the endpoint are not
+	// authenticated, even when proxy authentication is configured.
+	DisableAuth bool `json:"disable_auth" yaml:"disable_auth"`
+
+	// CORS overrides the CORS configuration for the endpoint.
+	CORS *CORSConfig `json:"cors" yaml:"cors"`
+
+	// Compression overrides the compression configuration for the endpoint.
+	Compression *CompressionConfig `json:"compression" yaml:"compression"`
+
+	// HTTP2 indicates whether to forward requests to the endpoint using
+	// HTTP/2, such as for gRPC services, which require trailers and
+	// bidirectional streaming.
+	//
+	// Requests are forwarded to other nodes and to the agent using
+	// cleartext HTTP/2, so the agent must support HTTP/2.
+	HTTP2 bool `json:"http2" yaml:"http2"`
+}
+
+func (c *EndpointConfig) Validate() error {
+	if c.CORS != nil {
+		if err := c.CORS.Validate(); err != nil {
+			return fmt.Errorf("cors: %w", err)
+		}
+	}
+	if c.Compression != nil {
+		if err := c.Compression.Validate(); err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+	}
+	return nil
+}
+
+// ProxyAuthConfig configures authenticating requests to the proxy using a
+// bearer token JWT.
+type ProxyAuthConfig struct {
+	// TokenHMACSecretKey is the secret key to authenticate HMAC proxy request
+	// JWTs.
+	TokenHMACSecretKey string `json:"token_hmac_secret_key" yaml:"token_hmac_secret_key"`
+
+	// TokenRSAPublicKey is the public key to authenticate RSA proxy request
+	// JWTs.
+	TokenRSAPublicKey string `json:"token_rsa_public_key" yaml:"token_rsa_public_key"`
+
+	// TokenECDSAPublicKey is the public key to authenticate ECDSA proxy
+	// request JWTs.
+	TokenECDSAPublicKey string `json:"token_ecdsa_public_key" yaml:"token_ecdsa_public_key"`
+
+	// TokenJWKSURL is the URL of a JSON Web Key Set containing public keys
+	// to authenticate RSA and ECDSA proxy request JWTs.
+	TokenJWKSURL string `json:"token_jwks_url" yaml:"token_jwks_url"`
+
+	// TokenJWKSRefreshInterval is the interval to refresh the cached JSON
+	// Web Key Set.
+	TokenJWKSRefreshInterval time.Duration `json:"token_jwks_refresh_interval" yaml:"token_jwks_refresh_interval"`
+
+	// TokenAudience is the required 'aud' claim of the authenticated JWTs.
+	//
+	// If not given the 'aud' claim will be ignored.
+	TokenAudience string `json:"token_audience" yaml:"token_audience"`
+
+	// TokenIssuer is the required 'iss' claim of the authenticated JWTs.
+	//
+	// If not given the 'iss' claim will be ignored.
+	TokenIssuer string `json:"token_issuer" yaml:"token_issuer"`
+
+	// TokenIssuers contains additional valid 'iss' claims of the
+	// authenticated JWTs.
+	TokenIssuers []string `json:"token_issuers" yaml:"token_issuers"`
+
+	// TokenLeeway is the allowed clock skew when verifying the 'exp', 'nbf'
+	// and 'iat' claims of the authenticated JWTs.
+	TokenLeeway time.Duration `json:"token_leeway" yaml:"token_leeway"`
+}
+
+func (c *ProxyAuthConfig) Validate() error {
+	if c.TokenJWKSURL != "" && c.TokenJWKSRefreshInterval <= 0 {
+		return fmt.Errorf("missing jwks refresh interval")
+	}
+	if c.TokenLeeway < 0 {
+		return fmt.Errorf("negative token leeway")
+	}
+	return nil
+}
+
+func (c *ProxyAuthConfig) AuthEnabled() bool {
+	return c.TokenHMACSecretKey != "" ||
+		c.TokenRSAPublicKey != "" ||
+		c.TokenECDSAPublicKey != "" ||
+		c.TokenJWKSURL != ""
+}
+
+// AuthConfig returns the configuration to load the verifier.
+func (c *ProxyAuthConfig) AuthConfig() auth.Config {
+	return auth.Config{
+		TokenHMACSecretKey:       c.TokenHMACSecretKey,
+		TokenRSAPublicKey:        c.TokenRSAPublicKey,
+		TokenECDSAPublicKey:      c.TokenECDSAPublicKey,
+		TokenJWKSURL:             c.TokenJWKSURL,
+		TokenJWKSRefreshInterval: c.TokenJWKSRefreshInterval,
+		TokenAudience:            c.TokenAudience,
+		TokenIssuer:              c.TokenIssuer,
+		TokenIssuers:             c.TokenIssuers,
+		TokenLeeway:              c.TokenLeeway,
+	}
+}
+
+func (c *ProxyAuthConfig) RegisterFlags(fs *pflag.FlagSet, prefix string) {
+	prefix = prefix + ".auth."
+
+	fs.StringVar(
+		&c.TokenHMACSecretKey,
+		prefix+"token-hmac-secret-key",
+		c.TokenHMACSecretKey,
+		`
+Secret key to authenticate HMAC proxy request JWTs.
+
+If a key is configured, proxy requests must include a JWT in the
+'Authorization: Bearer <token>' header, otherwise they are rejected with a
+'401 Unauthorized' response. Authentication can be disabled for specific
+endpoints in the YAML configuration file.`,
+	)
+	fs.StringVar(
+		&c.TokenRSAPublicKey,
+		prefix+"token-rsa-public-key",
+		c.TokenRSAPublicKey,
+		`
+Public key to authenticate RSA proxy request JWTs.`,
+	)
+	fs.StringVar(
+		&c.TokenECDSAPublicKey,
+		prefix+"token-ecdsa-public-key",
+		c.TokenECDSAPublicKey,
+		`
+Public key to authenticate ECDSA proxy request JWTs.`,
+	)
+	fs.StringVar(
+		&c.TokenJWKSURL,
+		prefix+"token-jwks-url",
+		c.TokenJWKSURL,
+		`
+URL of a JSON Web Key Set (JWKS) containing the public keys to authenticate
+RSA and ECDSA proxy request JWTs.`,
+	)
+	fs.DurationVar(
+		&c.TokenJWKSRefreshInterval,
+		prefix+"token-jwks-refresh-interval",
+		c.TokenJWKSRefreshInterval,
+		`
+Interval to refresh the cached JSON Web Key Set.`,
+	)
+	fs.StringVar(
+		&c.TokenAudience,
+		prefix+"token-audience",
+		c.TokenAudience,
+		`
+Audience of proxy request JWTs to verify.
+
+If given the JWT 'aud' claim must match the given audience. Otherwise it
+is ignored.`,
+	)
+	fs.StringVar(
+		&c.TokenIssuer,
+		prefix+"token-issuer",
+		c.TokenIssuer,
+		`
+Issuer of proxy request JWTs to verify.
+
+If given the JWT 'iss' claim must match the given issuer. Otherwise it
+is ignored.`,
+	)
+	fs.StringSliceVar(
+		&c.TokenIssuers,
+		prefix+"token-issuers",
+		c.TokenIssuers,
+		`
+Additional issuers of proxy request JWTs to verify.
+
+If given the JWT 'iss' claim must match either the issuer or any of the
+given issuers.`,
+	)
+	fs.DurationVar(
+		&c.TokenLeeway,
+		prefix+"token-leeway",
+		c.TokenLeeway,
+		`
+Allowed clock skew when verifying the 'exp', 'nbf' and 'iat' claims of
+proxy request JWTs.`,
+	)
+}
+
+// TCPListenerConfig configures a port that tunnels raw TCP connections to
+// an endpoint.
+type TCPListenerConfig struct {
+	// EndpointID is the endpoint to forward connections to.
+	EndpointID string `json:"endpoint_id" yaml:"endpoint_id"`
+
+	// BindAddr is the address to bind to listen for incoming TCP
+	// connections.
+	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
+}
+
+func (c *TCPListenerConfig) Validate() error {
+	if c.EndpointID == "" {
+		return fmt.Errorf("missing endpoint id")
+	}
+	if c.BindAddr == "" {
+		return fmt.Errorf("missing bind addr")
+	}
+	return nil
+}
+
+// ErrorResponseConfig overrides the error responses returned by the proxy
+// with a given status code, such as to return branded HTML error pages.
+type ErrorResponseConfig struct {
+	// StatusCode is the status code of the error responses to override,
+	// such as 503.
+	StatusCode int `json:"status_code" yaml:"status_code"`
+
+	// ContentType is the content type of the response body, such as
+	// 'text/html; charset=utf-8'.
+	ContentType string `json:"content_type" yaml:"content_type"`
+
+	// Body is a Go template used to render the response body.
+	//
+	// The template can reference '.StatusCode', '.Status', '.Message',
+	// '.EndpointID' and '.RequestID'. When the content type is 'text/html'
+	// the values are HTML escaped.
+	Body string `json:"body" yaml:"body"`
+}
+
+func (c *ErrorResponseConfig) Validate() error {
+	if c.StatusCode < 400 || c.StatusCode > 599 {
+		return fmt.Errorf("invalid status code: %d", c.StatusCode)
+	}
+	if c.ContentType == "" {
+		return fmt.Errorf("missing content type")
+	}
+	if _, _, err := mime.ParseMediaType(c.ContentType); err != nil {
+		return fmt.Errorf("invalid content type: %w", err)
+	}
+	if _, err := template.New("body").Parse(c.Body); err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+	return nil
+}
+
 type ProxyConfig struct {
 	// BindAddr is the address to bind to listen for incoming HTTP connections.
 	BindAddr string `json:"bind_addr" yaml:"bind_addr"`
@@ -186,13 +1125,78 @@ type ProxyConfig struct {
 	// Timeout is the timeout to forward incoming requests to the upstream.
 	Timeout time.Duration `json:"timeout" yaml:"timeout"`
 
+	// MaxTimeout is the maximum timeout a request can set using the
+	// 'x-piko-timeout' header. If zero, requests can only reduce the
+	// timeout.
+	MaxTimeout time.Duration `json:"max_timeout" yaml:"max_timeout"`
+
 	// AccessLog indicates whether to log all incoming connections and
 	// requests.
 	AccessLog bool `json:"access_log" yaml:"access_log"`
 
+	// MaxRequestBodyBytes is the maximum size of a request body. If zero
+	// there is no limit.
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes" yaml:"max_request_body_bytes"`
+
+	// MaxResponseBodyBytes is the maximum size of a response body. If zero
+	// there is no limit.
+	MaxResponseBodyBytes int64 `json:"max_response_body_bytes" yaml:"max_response_body_bytes"`
+
+	// TrustForwardedHeaders indicates whether to propagate the
+	// 'X-Forwarded-*' and 'Forwarded' headers from incoming requests. If
+	// false, the headers are replaced.
+	TrustForwardedHeaders bool `json:"trust_forwarded_headers" yaml:"trust_forwarded_headers"`
+
+	// BaseDomain is the domain to strip from the 'Host' header to resolve
+	// the endpoint ID, such as with a base domain of 'tunnels.example.com',
+	// 'team-a.service-b.tunnels.example.com' has endpoint ID
+	// 'team-a.service-b'.
+	//
+	// If empty, the endpoint ID is the bottom-level domain of the host.
+	BaseDomain string `json:"base_domain" yaml:"base_domain"`
+
+	// Endpoints contains configuration overrides for specific endpoints,
+	// keyed by endpoint ID.
+	//
+	// This can only be configured using the YAML configuration file.
+	Endpoints map[string]EndpointConfig `json:"endpoints" yaml:"endpoints"`
+
+	// TCPListeners contains ports to listen for raw TCP connections, where
+	// each port forwards connections to a single endpoint.
+	//
+	// This can only be configured using the YAML configuration file.
+	TCPListeners []TCPListenerConfig `json:"tcp_listeners" yaml:"tcp_listeners"`
+
+	// ErrorResponses overrides the error responses returned by the proxy
+	// for specific status codes. Error responses for other status codes
+	// use the default JSON body.
+	//
+	// This can only be configured using the YAML configuration file.
+	ErrorResponses []ErrorResponseConfig `json:"error_responses" yaml:"error_responses"`
+
 	HTTP HTTPConfig `json:"http" yaml:"http"`
 
+	Sticky StickyConfig `json:"sticky" yaml:"sticky"`
+
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+
+	Hedge HedgeConfig `json:"hedge" yaml:"hedge"`
+
+	Forward ForwardConfig `json:"forward" yaml:"forward"`
+
+	RateLimit RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+
+	ConcurrencyLimit ConcurrencyLimitConfig `json:"concurrency_limit" yaml:"concurrency_limit"`
+
+	Auth ProxyAuthConfig `json:"auth" yaml:"auth"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
+
+	Metrics ProxyMetricsConfig `json:"metrics" yaml:"metrics"`
+
+	CORS CORSConfig `json:"cors" yaml:"cors"`
+
+	Compression CompressionConfig `json:"compression" yaml:"compression"`
 }
 
 func (c *ProxyConfig) Validate() error {
@@ -202,9 +1206,93 @@ func (c *ProxyConfig) Validate() error {
 	if c.Timeout == 0 {
 		return fmt.Errorf("missing timeout")
 	}
+	if c.MaxTimeout < 0 {
+		return fmt.Errorf("max timeout cannot be negative")
+	}
+	if c.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("max request body bytes cannot be negative")
+	}
+	if c.MaxResponseBodyBytes < 0 {
+		return fmt.Errorf("max response body bytes cannot be negative")
+	}
+	if c.BaseDomain != "" {
+		for _, label := range strings.Split(c.BaseDomain, ".") {
+			if label == "" || strings.ContainsAny(label, ":/*") {
+				return fmt.Errorf("invalid base domain: %s", c.BaseDomain)
+			}
+		}
+	}
+	for endpointID, endpoint := range c.Endpoints {
+		if err := endpoint.Validate(); err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpointID, err)
+		}
+	}
+	// Each endpoint may only have a single TCP listener, since listeners
+	// are keyed by endpoint ID.
+	tcpEndpoints := make(map[string]struct{})
+	for _, ln := range c.TCPListeners {
+		if err := ln.Validate(); err != nil {
+			return fmt.Errorf("tcp listener: %w", err)
+		}
+		if _, ok := tcpEndpoints[ln.EndpointID]; ok {
+			return fmt.Errorf(
+				"tcp listener: %s: duplicate endpoint id", ln.EndpointID,
+			)
+		}
+		tcpEndpoints[ln.EndpointID] = struct{}{}
+		// TCP connections have no way to include a token, so are never
+		// authenticated.
+		if c.Auth.AuthEnabled() && !c.Endpoints[ln.EndpointID].DisableAuth {
+			return fmt.Errorf(
+				"tcp listener: %s: endpoint requires auth", ln.EndpointID,
+			)
+		}
+	}
+	statusCodes := make(map[int]struct{})
+	for _, resp := range c.ErrorResponses {
+		if err := resp.Validate(); err != nil {
+			return fmt.Errorf("error response: %w", err)
+		}
+		if _, ok := statusCodes[resp.StatusCode]; ok {
+			return fmt.Errorf(
+				"error response: duplicate status code: %d", resp.StatusCode,
+			)
+		}
+		statusCodes[resp.StatusCode] = struct{}{}
+	}
+	if err := c.Sticky.Validate(); err != nil {
+		return fmt.Errorf("sticky: %w", err)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if err := c.Hedge.Validate(); err != nil {
+		return fmt.Errorf("hedge: %w", err)
+	}
+	if err := c.Forward.Validate(); err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("rate limit: %w", err)
+	}
+	if err := c.ConcurrencyLimit.Validate(); err != nil {
+		return fmt.Errorf("concurrency limit: %w", err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
+	if err := c.Metrics.Validate(); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return fmt.Errorf("cors: %w", err)
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return fmt.Errorf("compression: %w", err)
+	}
 	return nil
 }
 
@@ -242,7 +1330,25 @@ advertise address of '10.26.104.14:8000'.`,
 		"proxy.timeout",
 		c.Timeout,
 		`
-Timeout when forwarding incoming requests to the upstream.`,
+Timeout when forwarding incoming requests to the upstream.
+
+For upgraded connections, streaming responses (Server-Sent Events and gRPC)
+and responses of unknown length (such as chunked responses), the timeout
+only applies until the upstream responds.
+
+Requests may override the timeout using the 'x-piko-timeout' header, such as
+'x-piko-timeout: 500ms'.`,
+	)
+
+	fs.DurationVar(
+		&c.MaxTimeout,
+		"proxy.max-timeout",
+		c.MaxTimeout,
+		`
+The maximum timeout a request can set using the 'x-piko-timeout' header.
+Larger timeouts are clamped to the maximum.
+
+If zero, requests can only reduce the timeout below '--proxy.timeout'.`,
 	)
 
 	fs.BoolVar(
@@ -253,9 +1359,91 @@ Timeout when forwarding incoming requests to the upstream.`,
 Whether to log all incoming connections and requests.`,
 	)
 
+	fs.Int64Var(
+		&c.MaxRequestBodyBytes,
+		"proxy.max-request-body-bytes",
+		c.MaxRequestBodyBytes,
+		`
+The maximum size of a request body in bytes. Requests that exceed the limit
+are rejected with a '413 Request Entity Too Large' response.
+
+The limit can be overridden for specific endpoints in the YAML configuration
+file.
+
+If zero there is no limit.`,
+	)
+
+	fs.Int64Var(
+		&c.MaxResponseBodyBytes,
+		"proxy.max-response-body-bytes",
+		c.MaxResponseBodyBytes,
+		`
+The maximum size of an upstream response body in bytes. Responses that exceed
+the limit are aborted.
+
+The limit can be overridden for specific endpoints in the YAML configuration
+file.
+
+If zero there is no limit.`,
+	)
+
+	fs.BoolVar(
+		&c.TrustForwardedHeaders,
+		"proxy.trust-forwarded-headers",
+		c.TrustForwardedHeaders,
+		`
+Whether to trust the 'X-Forwarded-For', 'X-Forwarded-Proto',
+'X-Forwarded-Host' and 'Forwarded' headers on incoming requests.
+
+Piko adds the client address to these headers when forwarding requests to the
+upstream. If trusted, the client address is appended to any existing headers,
+such as when Piko is behind a load balancer that sets them. Otherwise any
+existing headers are discarded, since clients could set them to arbitrary
+values.`,
+	)
+
+	fs.StringVar(
+		&c.BaseDomain,
+		"proxy.base-domain",
+		c.BaseDomain,
+		`
+The domain to strip from the 'Host' header to resolve the endpoint ID, so the
+endpoint ID may contain multiple labels.
+
+Such as with a base domain of 'tunnels.example.com', requests to
+'team-a.service-b.tunnels.example.com' are forwarded to endpoint
+'team-a.service-b'. Requests to hosts outside the base domain don't resolve
+an endpoint ID from the host.
+
+If not set, the endpoint ID is the bottom-level domain of the 'Host' header,
+such as 'my-endpoint.example.com' is forwarded to endpoint 'my-endpoint'.
+
+The 'x-piko-endpoint' header takes precedence over the 'Host' header.`,
+	)
+
 	c.HTTP.RegisterFlags(fs, "proxy")
 
+	c.Sticky.RegisterFlags(fs, "proxy")
+
+	c.Retry.RegisterFlags(fs, "proxy")
+
+	c.Hedge.RegisterFlags(fs, "proxy")
+
+	c.Forward.RegisterFlags(fs, "proxy")
+
+	c.RateLimit.RegisterFlags(fs, "proxy")
+
+	c.ConcurrencyLimit.RegisterFlags(fs, "proxy")
+
+	c.Auth.RegisterFlags(fs, "proxy")
+
 	c.TLS.RegisterFlags(fs, "proxy")
+
+	c.Metrics.RegisterFlags(fs, "proxy")
+
+	c.CORS.RegisterFlags(fs, "proxy")
+
+	c.Compression.RegisterFlags(fs, "proxy")
 }
 
 type UpstreamConfig struct {
@@ -265,6 +1453,37 @@ type UpstreamConfig struct {
 	// AdvertiseAddr is the address to advertise to other nodes.
 	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
 
+	// LoadBalancing is the policy used to select among the upstreams
+	// connected to the node for an endpoint. One of 'round-robin', 'random'
+	// or 'least-connections'.
+	LoadBalancing string `json:"load_balancing" yaml:"load_balancing"`
+
+	// RemoteLoadBalancing is the policy used to select among the other nodes
+	// in the cluster with upstreams for an endpoint, when there are no
+	// upstreams for the endpoint connected to the node. One of
+	// 'round-robin' or 'consistent-hash'.
+	RemoteLoadBalancing string `json:"remote_load_balancing" yaml:"remote_load_balancing"`
+
+	// MaxEndpoints is the maximum number of endpoints that can be registered
+	// with the node. If zero, the number of endpoints is unlimited.
+	MaxEndpoints int `json:"max_endpoints" yaml:"max_endpoints"`
+
+	// MaxEndpointsPerAgent is the maximum number of endpoints each agent can
+	// register with the node. If zero, the number of endpoints is unlimited.
+	MaxEndpointsPerAgent int `json:"max_endpoints_per_agent" yaml:"max_endpoints_per_agent"`
+
+	// WriteTimeout is the maximum duration to write each message to an
+	// upstream. If zero, writes don't time out.
+	WriteTimeout time.Duration `json:"write_timeout" yaml:"write_timeout"`
+
+	// HeartbeatFailureThreshold is the number of consecutive failed
+	// heartbeats before the upstream connection is closed.
+	HeartbeatFailureThreshold int `json:"heartbeat_failure_threshold" yaml:"heartbeat_failure_threshold"`
+
+	// ClientCertAuth configures how verified client certificates
+	// authenticate upstreams. One of 'none', 'sufficient' or 'required'.
+	ClientCertAuth string `json:"client_cert_auth" yaml:"client_cert_auth"`
+
 	TLS TLSConfig `json:"tls" yaml:"tls"`
 }
 
@@ -272,6 +1491,42 @@ func (c *UpstreamConfig) Validate() error {
 	if c.BindAddr == "" {
 		return fmt.Errorf("missing bind addr")
 	}
+	switch c.LoadBalancing {
+	case "round-robin", "random", "least-connections":
+	default:
+		return fmt.Errorf("unsupported load balancing: %s", c.LoadBalancing)
+	}
+	switch c.RemoteLoadBalancing {
+	case "round-robin", "consistent-hash":
+	default:
+		return fmt.Errorf(
+			"unsupported remote load balancing: %s", c.RemoteLoadBalancing,
+		)
+	}
+	if c.MaxEndpoints < 0 {
+		return fmt.Errorf("max endpoints cannot be negative")
+	}
+	if c.MaxEndpointsPerAgent < 0 {
+		return fmt.Errorf("max endpoints per agent cannot be negative")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout cannot be negative")
+	}
+	if c.HeartbeatFailureThreshold < 1 {
+		return fmt.Errorf("heartbeat failure threshold must be at least 1")
+	}
+	switch c.ClientCertAuth {
+	case "none":
+	case "sufficient", "required":
+		if !c.TLS.Enabled || c.TLS.ClientCAs == "" {
+			return fmt.Errorf(
+				"client cert auth: %s: requires tls client cas",
+				c.ClientCertAuth,
+			)
+		}
+	default:
+		return fmt.Errorf("unsupported client cert auth: %s", c.ClientCertAuth)
+	}
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
@@ -306,6 +1561,116 @@ private IP will be used, such as a bind address of ':8000' may have an
 advertise address of '10.26.104.14:8000'.`,
 	)
 
+	fs.StringVar(
+		&c.LoadBalancing,
+		"upstream.load-balancing",
+		c.LoadBalancing,
+		`
+The policy used to select among the upstreams connected to the node for an
+endpoint. Supports 'round-robin', 'random' and 'least-connections'.
+
+When multiple upstream listeners register the same endpoint with the node,
+requests are load balanced among them using this policy.`,
+	)
+
+	fs.StringVar(
+		&c.RemoteLoadBalancing,
+		"upstream.remote-load-balancing",
+		c.RemoteLoadBalancing,
+		`
+The policy used to select among the other nodes in the cluster with upstreams
+for an endpoint, when the node has no upstreams for the endpoint. Supports
+'round-robin' and 'consistent-hash'.
+
+'round-robin' balances requests among the nodes, weighted by the number of
+upstream listeners each node has for the endpoint.
+
+'consistent-hash' forwards all requests for an endpoint to the same node while
+the set of nodes is unchanged, such as when upstreams cache per-endpoint state.
+If sticky sessions are enabled ('--proxy.sticky.enabled'), the session key is
+also hashed, so each session is forwarded to the same node. When a node joins
+or leaves the cluster, only the endpoints mapped to that node are moved.`,
+	)
+
+	fs.IntVar(
+		&c.MaxEndpoints,
+		"upstream.max-endpoints",
+		c.MaxEndpoints,
+		`
+The maximum number of endpoints that can be registered with the node.
+
+Upstream connections that would register a new endpoint beyond the limit are
+rejected with a '429 Too Many Requests' response. Additional upstreams for an
+endpoint that is already registered are accepted.
+
+If zero, the number of endpoints is unlimited.`,
+	)
+
+	fs.IntVar(
+		&c.MaxEndpointsPerAgent,
+		"upstream.max-endpoints-per-agent",
+		c.MaxEndpointsPerAgent,
+		`
+The maximum number of endpoints each agent can register with the node.
+
+Agents are identified by their verified client certificate (see
+'--upstream.tls.client-cas'), or if not given, their IP address.
+
+Upstream connections that would register a new endpoint beyond the limit are
+rejected with a '429 Too Many Requests' response.
+
+If zero, the number of endpoints is unlimited.`,
+	)
+
+	fs.DurationVar(
+		&c.WriteTimeout,
+		"upstream.write-timeout",
+		c.WriteTimeout,
+		`
+The maximum duration to write each message to an upstream connection.
+
+If a write exceeds the timeout, such as the agent or network stops accepting
+data, the upstream connection is closed rather than blocking indefinitely.
+
+If zero, writes don't time out.`,
+	)
+
+	fs.IntVar(
+		&c.HeartbeatFailureThreshold,
+		"upstream.heartbeat-failure-threshold",
+		c.HeartbeatFailureThreshold,
+		`
+The number of consecutive failed heartbeats before an upstream connection is
+closed.
+
+The server heartbeats each upstream connection every 15 seconds, where a
+heartbeat fails if the upstream doesn't respond within 10 seconds. Increasing
+the threshold tolerates transient packet loss on lossy links, rather than
+forcing the agent to reconnect, at the cost of taking longer to detect
+failed connections.`,
+	)
+
+	fs.StringVar(
+		&c.ClientCertAuth,
+		"upstream.client-cert-auth",
+		c.ClientCertAuth,
+		`
+How verified client certificates authenticate upstream connections. Supports
+'none', 'sufficient' and 'required'.
+
+'none' only uses client certificates to identify agents, so when token
+authentication is configured upstreams must present a valid token.
+
+'sufficient' accepts a verified client certificate instead of a token. If the
+upstream also presents a token, the token must be valid and its permitted
+endpoints are enforced.
+
+'required' rejects upstreams without a verified client certificate, in
+addition to requiring a valid token when token authentication is configured.
+
+Both 'sufficient' and 'required' require '--upstream.tls.client-cas'.`,
+	)
+
 	c.TLS.RegisterFlags(fs, "upstream")
 }
 
@@ -317,6 +1682,11 @@ type AdminConfig struct {
 	AdvertiseAddr string `json:"advertise_addr" yaml:"advertise_addr"`
 
 	TLS TLSConfig `json:"tls" yaml:"tls"`
+
+	Auth AdminAuthConfig `json:"auth" yaml:"auth"`
+
+	// Pprof indicates whether to serve pprof profiles at '/debug/pprof'.
+	Pprof bool `json:"pprof" yaml:"pprof"`
 }
 
 func (c *AdminConfig) Validate() error {
@@ -326,6 +1696,9 @@ func (c *AdminConfig) Validate() error {
 	if err := c.TLS.Validate(); err != nil {
 		return fmt.Errorf("tls: %w", err)
 	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
 	return nil
 }
 
@@ -357,7 +1730,266 @@ If the bind address does not include an IP (such as ':8002') the nodes
 private IP will be used, such as a bind address of ':8002' may have an
 advertise address of '10.26.104.14:8002'.`,
 	)
+	fs.BoolVar(
+		&c.Pprof,
+		"admin.pprof",
+		c.Pprof,
+		`
+Whether to serve Go pprof profiles at '/debug/pprof' on the admin port, such
+as '/debug/pprof/profile' and '/debug/pprof/goroutine'.
+
+Profiles expose sensitive information about the server, such as the command
+line arguments (which may include secrets), goroutine stacks and heap
+contents, and collecting profiles adds overhead to the server. Therefore
+profiles are disabled by default, and when enabled you should configure admin
+authentication ('--admin.auth.*') or ensure the admin port isn't publicly
+accessible.`,
+	)
+
 	c.TLS.RegisterFlags(fs, "admin")
+	c.Auth.RegisterFlags(fs)
+}
+
+// AdminAuthConfig configures authenticating requests to the admin status API
+// using a bearer token JWT.
+type AdminAuthConfig struct {
+	// TokenHMACSecretKey is the secret key to authenticate HMAC admin request
+	// JWTs.
+	TokenHMACSecretKey string `json:"token_hmac_secret_key" yaml:"token_hmac_secret_key"`
+
+	// TokenRSAPublicKey is the public key to authenticate RSA admin request
+	// JWTs.
+	TokenRSAPublicKey string `json:"token_rsa_public_key" yaml:"token_rsa_public_key"`
+
+	// TokenECDSAPublicKey is the public key to authenticate ECDSA admin
+	// request JWTs.
+	TokenECDSAPublicKey string `json:"token_ecdsa_public_key" yaml:"token_ecdsa_public_key"`
+
+	// TokenJWKSURL is the URL of a JSON Web Key Set containing public keys
+	// to authenticate RSA and ECDSA admin request JWTs.
+	TokenJWKSURL string `json:"token_jwks_url" yaml:"token_jwks_url"`
+
+	// TokenJWKSRefreshInterval is the interval to refresh the cached JSON
+	// Web Key Set.
+	TokenJWKSRefreshInterval time.Duration `json:"token_jwks_refresh_interval" yaml:"token_jwks_refresh_interval"`
+
+	// TokenAudience is the required 'aud' claim of the authenticated JWTs.
+	//
+	// If not given the 'aud' claim will be ignored.
+	TokenAudience string `json:"token_audience" yaml:"token_audience"`
+
+	// TokenIssuer is the required 'iss' claim of the authenticated JWTs.
+	//
+	// If not given the 'iss' claim will be ignored.
+	TokenIssuer string `json:"token_issuer" yaml:"token_issuer"`
+
+	// TokenIssuers contains additional valid 'iss' claims of the
+	// authenticated JWTs.
+	TokenIssuers []string `json:"token_issuers" yaml:"token_issuers"`
+
+	// TokenLeeway is the allowed clock skew when verifying the 'exp', 'nbf'
+	// and 'iat' claims of the authenticated JWTs.
+	TokenLeeway time.Duration `json:"token_leeway" yaml:"token_leeway"`
+}
+
+func (c *AdminAuthConfig) Validate() error {
+	if c.TokenJWKSURL != "" && c.TokenJWKSRefreshInterval <= 0 {
+		return fmt.Errorf("missing jwks refresh interval")
+	}
+	if c.TokenLeeway < 0 {
+		return fmt.Errorf("negative token leeway")
+	}
+	return nil
+}
+
+func (c *AdminAuthConfig) AuthEnabled() bool {
+	return c.TokenHMACSecretKey != "" ||
+		c.TokenRSAPublicKey != "" ||
+		c.TokenECDSAPublicKey != "" ||
+		c.TokenJWKSURL != ""
+}
+
+// AuthConfig returns the configuration to load the verifier.
+func (c *AdminAuthConfig) AuthConfig() auth.Config {
+	return auth.Config{
+		TokenHMACSecretKey:       c.TokenHMACSecretKey,
+		TokenRSAPublicKey:        c.TokenRSAPublicKey,
+		TokenECDSAPublicKey:      c.TokenECDSAPublicKey,
+		TokenJWKSURL:             c.TokenJWKSURL,
+		TokenJWKSRefreshInterval: c.TokenJWKSRefreshInterval,
+		TokenAudience:            c.TokenAudience,
+		TokenIssuer:              c.TokenIssuer,
+		TokenIssuers:             c.TokenIssuers,
+		TokenLeeway:              c.TokenLeeway,
+	}
+}
+
+func (c *AdminAuthConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(
+		&c.TokenHMACSecretKey,
+		"admin.auth.token-hmac-secret-key",
+		c.TokenHMACSecretKey,
+		`
+Secret key to authenticate HMAC admin request JWTs.
+
+If a key is configured, requests to the admin status API ('/status') must
+include a JWT in the 'Authorization: Bearer <token>' header, otherwise they
+are rejected with a '401 Unauthorized' response. Health, readiness and metrics
+routes don't require authentication.`,
+	)
+	fs.StringVar(
+		&c.TokenRSAPublicKey,
+		"admin.auth.token-rsa-public-key",
+		c.TokenRSAPublicKey,
+		`
+Public key to authenticate RSA admin request JWTs.`,
+	)
+	fs.StringVar(
+		&c.TokenECDSAPublicKey,
+		"admin.auth.token-ecdsa-public-key",
+		c.TokenECDSAPublicKey,
+		`
+Public key to authenticate ECDSA admin request JWTs.`,
+	)
+	fs.StringVar(
+		&c.TokenJWKSURL,
+		"admin.auth.token-jwks-url",
+		c.TokenJWKSURL,
+		`
+URL of a JSON Web Key Set (JWKS) containing the public keys to authenticate
+RSA and ECDSA admin request JWTs.`,
+	)
+	fs.DurationVar(
+		&c.TokenJWKSRefreshInterval,
+		"admin.auth.token-jwks-refresh-interval",
+		c.TokenJWKSRefreshInterval,
+		`
+Interval to refresh the cached JSON Web Key Set.`,
+	)
+	fs.StringVar(
+		&c.TokenAudience,
+		"admin.auth.token-audience",
+		c.TokenAudience,
+		`
+Audience of admin request JWTs to verify.
+
+If given the JWT 'aud' claim must match the given audience. Otherwise it
+is ignored.`,
+	)
+	fs.StringVar(
+		&c.TokenIssuer,
+		"admin.auth.token-issuer",
+		c.TokenIssuer,
+		`
+Issuer of admin request JWTs to verify.
+
+If given the JWT 'iss' claim must match the given issuer. Otherwise it
+is ignored.`,
+	)
+	fs.StringSliceVar(
+		&c.TokenIssuers,
+		"admin.auth.token-issuers",
+		c.TokenIssuers,
+		`
+Additional issuers of admin request JWTs to verify.
+
+If given the JWT 'iss' claim must match either the issuer or any of the
+given issuers.`,
+	)
+	fs.DurationVar(
+		&c.TokenLeeway,
+		"admin.auth.token-leeway",
+		c.TokenLeeway,
+		`
+Allowed clock skew when verifying the 'exp', 'nbf' and 'iat' claims of
+admin request JWTs.`,
+	)
+}
+
+// WebhookConfig configures sending webhook notifications when endpoints are
+// registered and unregistered on the node.
+type WebhookConfig struct {
+	// URLs contains the URLs to send webhook events to. If empty, webhooks
+	// are disabled.
+	URLs []string `json:"urls" yaml:"urls"`
+
+	// Secret is the key used to sign webhook events with HMAC-SHA256. If
+	// empty, events aren't signed.
+	Secret string `json:"secret" yaml:"secret"`
+
+	// Timeout is the timeout of each attempt to send an event.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+
+	// MaxAttempts is the maximum number of attempts to send each event.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+}
+
+func (c *WebhookConfig) Validate() error {
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid url: %s", u)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid url: %s: unsupported scheme", u)
+		}
+	}
+	if len(c.URLs) == 0 {
+		return nil
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("missing timeout")
+	}
+	if c.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1")
+	}
+	return nil
+}
+
+func (c *WebhookConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.URLs,
+		"webhook.urls",
+		c.URLs,
+		`
+URLs to send webhook events to when endpoints are registered and unregistered
+on the node.
+
+Each event is sent as a JSON 'POST' request containing the action
+('register' or 'unregister'), endpoint ID, node ID and the number of
+listeners for the endpoint on the node.
+
+If empty, webhooks are disabled.`,
+	)
+	fs.StringVar(
+		&c.Secret,
+		"webhook.secret",
+		c.Secret,
+		`
+Secret key used to sign webhook events.
+
+When set, each event includes a 'X-Piko-Signature' header containing
+'sha256=' followed by the hex encoded HMAC-SHA256 of the request body, which
+receivers should verify.`,
+	)
+	fs.DurationVar(
+		&c.Timeout,
+		"webhook.timeout",
+		c.Timeout,
+		`
+Timeout of each attempt to send a webhook event.`,
+	)
+	fs.IntVar(
+		&c.MaxAttempts,
+		"webhook.max-attempts",
+		c.MaxAttempts,
+		`
+Maximum number of attempts to send each webhook event.
+
+Failed attempts, including responses with a non-2xx status, are retried with
+exponential backoff. Events are sent in the background so slow webhooks don't
+delay registering endpoints.`,
+	)
 }
 
 type UsageConfig struct {
@@ -379,6 +2011,75 @@ architecture, requests processed and upstreams registered.`,
 	)
 }
 
+// EndpointAccessConfig restricts the endpoint IDs the node will serve, such
+// as to dedicate nodes to a tenant.
+type EndpointAccessConfig struct {
+	// Allow is a list of endpoint ID glob patterns the node serves. If empty
+	// all endpoints are allowed.
+	Allow []string `json:"allow" yaml:"allow"`
+
+	// Deny is a list of endpoint ID glob patterns the node doesn't serve.
+	// Deny takes precedence over Allow.
+	Deny []string `json:"deny" yaml:"deny"`
+}
+
+// Permitted returns whether the node serves the given endpoint.
+func (c *EndpointAccessConfig) Permitted(endpointID string) bool {
+	for _, pattern := range c.Deny {
+		if ok, _ := path.Match(pattern, endpointID); ok {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range c.Allow {
+		if ok, _ := path.Match(pattern, endpointID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *EndpointAccessConfig) Validate() error {
+	for _, pattern := range c.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("allow: invalid pattern: %s", pattern)
+		}
+	}
+	for _, pattern := range c.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("deny: invalid pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+func (c *EndpointAccessConfig) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(
+		&c.Allow,
+		"endpoints.allow",
+		c.Allow,
+		`
+A list of endpoint IDs the node serves. Patterns may include globs, such as
+'--endpoints.allow tenant-a-*'.
+
+Requests for other endpoints are rejected with '403 Forbidden', and upstream
+listeners for other endpoints are rejected when registering. If empty (the
+default) all endpoints are allowed.`,
+	)
+	fs.StringSliceVar(
+		&c.Deny,
+		"endpoints.deny",
+		c.Deny,
+		`
+A list of endpoint IDs the node doesn't serve. Patterns may include globs,
+such as '--endpoints.deny internal-*'.
+
+Deny takes precedence over '--endpoints.allow'.`,
+	)
+}
+
 type Config struct {
 	Cluster ClusterConfig `json:"cluster" yaml:"cluster"`
 
@@ -392,13 +2093,18 @@ type Config struct {
 
 	Auth auth.Config `json:"auth" yaml:"auth"`
 
+	Webhook WebhookConfig `json:"webhook" yaml:"webhook"`
+
 	Usage UsageConfig `json:"usage" yaml:"usage"`
 
+	Endpoints EndpointAccessConfig `json:"endpoints" yaml:"endpoints"`
+
 	Log log.Config `json:"log" yaml:"log"`
 
 	// GracePeriod is the duration to gracefully shutdown the server. During
-	// the grace period, listeners and idle connections are closed, then waits
-	// for active requests to complete and closes their connections.
+	// the grace period, the node stops accepting new proxy and upstream
+	// connections, waits for in-flight requests to complete, then closes the
+	// remaining upstream connections.
 	GracePeriod time.Duration `json:"grace_period" yaml:"grace_period"`
 }
 
@@ -407,11 +2113,13 @@ func Default() *Config {
 		Cluster: ClusterConfig{
 			JoinTimeout:      time.Minute,
 			AbortIfJoinFails: true,
+			SnapshotInterval: time.Second * 30,
 		},
 		Proxy: ProxyConfig{
-			BindAddr:  ":8000",
-			Timeout:   time.Second * 30,
-			AccessLog: true,
+			BindAddr:   ":8000",
+			Timeout:    time.Second * 30,
+			MaxTimeout: time.Minute * 5,
+			AccessLog:  true,
 			HTTP: HTTPConfig{
 				ReadTimeout:       time.Second * 10,
 				ReadHeaderTimeout: time.Second * 10,
@@ -419,20 +2127,82 @@ func Default() *Config {
 				IdleTimeout:       time.Minute * 5,
 				MaxHeaderBytes:    1 << 20,
 			},
+			Retry: RetryConfig{
+				MaxAttempts: 3,
+				BudgetRatio: 0.1,
+				BudgetBurst: 10,
+			},
+			Forward: ForwardConfig{
+				MaxIdleConns: 32,
+				IdleTimeout:  time.Second * 90,
+			},
+			RateLimit: RateLimitConfig{
+				Burst:   10,
+				MaxKeys: 10000,
+			},
+			Auth: ProxyAuthConfig{
+				TokenJWKSRefreshInterval: time.Hour,
+			},
+			Metrics: ProxyMetricsConfig{
+				MaxEndpoints: 1000,
+			},
+			CORS: CORSConfig{
+				AllowedMethods: []string{
+					http.MethodGet,
+					http.MethodHead,
+					http.MethodPost,
+					http.MethodPut,
+					http.MethodPatch,
+					http.MethodDelete,
+				},
+			},
+			Compression: CompressionConfig{
+				MinSize: 1024,
+				ContentTypes: []string{
+					"text/*",
+					"application/json",
+					"application/javascript",
+					"application/xml",
+					"image/svg+xml",
+				},
+			},
 		},
 		Upstream: UpstreamConfig{
-			BindAddr: ":8001",
+			BindAddr:                  ":8001",
+			LoadBalancing:             "round-robin",
+			RemoteLoadBalancing:       "round-robin",
+			HeartbeatFailureThreshold: 1,
+			ClientCertAuth:            "none",
 		},
 		Admin: AdminConfig{
 			BindAddr: ":8002",
+			Auth: AdminAuthConfig{
+				TokenJWKSRefreshInterval: time.Hour,
+			},
 		},
 		Gossip: gossip.Config{
-			BindAddr:      ":8003",
-			Interval:      time.Millisecond * 100,
-			MaxPacketSize: 1400,
+			BindAddr:            ":8003",
+			Interval:            time.Millisecond * 100,
+			MaxPacketSize:       1400,
+			Fanout:              1,
+			SuspicionMultiplier: 20,
+			SyncInterval:        time.Second * 30,
+			MaxConcurrentSyncs:  2,
+			ResolveInterval:     time.Second * 30,
+			WAN: gossip.WANConfig{
+				SyncInterval: time.Second * 10,
+			},
+		},
+		Auth: auth.Config{
+			TokenJWKSRefreshInterval: time.Hour,
+		},
+		Webhook: WebhookConfig{
+			Timeout:     time.Second * 5,
+			MaxAttempts: 3,
 		},
 		Log: log.Config{
-			Level: "info",
+			Level:  "info",
+			Format: "json",
 		},
 		GracePeriod: time.Minute,
 	}
@@ -459,6 +2229,18 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("gossip: %w", err)
 	}
 
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+
+	if err := c.Webhook.Validate(); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	if err := c.Endpoints.Validate(); err != nil {
+		return fmt.Errorf("endpoints: %w", err)
+	}
+
 	if err := c.Log.Validate(); err != nil {
 		return fmt.Errorf("log: %w", err)
 	}
@@ -483,8 +2265,12 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 
 	c.Auth.RegisterFlags(fs)
 
+	c.Webhook.RegisterFlags(fs)
+
 	c.Usage.RegisterFlags(fs)
 
+	c.Endpoints.RegisterFlags(fs)
+
 	c.Log.RegisterFlags(fs)
 
 	fs.DurationVar(
@@ -494,8 +2280,8 @@ func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
 		`
 Maximum duration after a shutdown signal is received (SIGTERM or
 SIGINT) to gracefully shutdown the server node before terminating.
-This includes handling in-progress HTTP requests, gracefully closing
-connections to upstream listeners and announcing to the cluster the node is
-leaving.`,
+The node first announces to the cluster it is leaving and stops accepting
+new proxy and upstream connections, then waits for in-flight requests to
+complete before closing the connections to upstream listeners.`,
 	)
 }
@@ -12,3 +12,235 @@ func TestConfig_Default(t *testing.T) {
 	conf.Cluster.NodeID = "my-node"
 	assert.NoError(t, conf.Validate())
 }
+
+func TestCORSConfig_Validate(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		conf := CORSConfig{}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("missing origins", func(t *testing.T) {
+		conf := CORSConfig{Enabled: true}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("wildcard origin with credentials", func(t *testing.T) {
+		conf := CORSConfig{
+			Enabled:          true,
+			AllowedOrigins:   []string{"*"},
+			AllowCredentials: true,
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("endpoint override", func(t *testing.T) {
+		conf := Default()
+		conf.Cluster.NodeID = "my-node"
+		conf.Proxy.Endpoints = map[string]EndpointConfig{
+			"my-endpoint": {
+				CORS: &CORSConfig{Enabled: true},
+			},
+		}
+		assert.Error(t, conf.Validate())
+	})
+}
+
+func TestErrorResponseConfig_Validate(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		conf := ErrorResponseConfig{
+			StatusCode:  503,
+			ContentType: "text/html; charset=utf-8",
+			Body:        "<h1>{{.Status}}</h1>",
+		}
+		assert.NoError(t, conf.Validate())
+	})
+
+	t.Run("invalid status code", func(t *testing.T) {
+		conf := ErrorResponseConfig{
+			StatusCode:  200,
+			ContentType: "text/html",
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("missing content type", func(t *testing.T) {
+		conf := ErrorResponseConfig{StatusCode: 503}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		conf := ErrorResponseConfig{
+			StatusCode:  503,
+			ContentType: "text/html",
+			Body:        "{{.Status",
+		}
+		assert.Error(t, conf.Validate())
+	})
+
+	t.Run("duplicate status code", func(t *testing.T) {
+		conf := Default()
+		conf.Cluster.NodeID = "my-node"
+		conf.Proxy.ErrorResponses = []ErrorResponseConfig{
+			{StatusCode: 503, ContentType: "text/html"},
+			{StatusCode: 503, ContentType: "text/plain"},
+		}
+		assert.Error(t, conf.Validate())
+	})
+}
+
+func TestProxyConfig_ValidateBaseDomain(t *testing.T) {
+	for _, baseDomain := range []string{
+		"",
+		"example.com",
+		"tunnels.example.com",
+	} {
+		conf := Default()
+		conf.Cluster.NodeID = "my-node"
+		conf.Proxy.BaseDomain = baseDomain
+		assert.NoError(t, conf.Validate(), baseDomain)
+	}
+
+	for _, baseDomain := range []string{
+		".example.com",
+		"*.example.com",
+		"example.com:8000",
+		"example..com",
+		"example.com/foo",
+	} {
+		conf := Default()
+		conf.Cluster.NodeID = "my-node"
+		conf.Proxy.BaseDomain = baseDomain
+		assert.Error(t, conf.Validate(), baseDomain)
+	}
+}
+
+func TestProxyConfig_ValidateTCPListeners(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		conf := Default()
+		conf.Proxy.TCPListeners = []TCPListenerConfig{
+			{EndpointID: "endpoint-1", BindAddr: ":9001"},
+			{EndpointID: "endpoint-2", BindAddr: ":9002"},
+		}
+		assert.NoError(t, conf.Proxy.Validate())
+	})
+
+	t.Run("duplicate endpoint id", func(t *testing.T) {
+		conf := Default()
+		conf.Proxy.TCPListeners = []TCPListenerConfig{
+			{EndpointID: "endpoint-1", BindAddr: ":9001"},
+			{EndpointID: "endpoint-1", BindAddr: ":9002"},
+		}
+		assert.EqualError(
+			t,
+			conf.Proxy.Validate(),
+			"tcp listener: endpoint-1: duplicate endpoint id",
+		)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		conf := Default()
+		conf.Proxy.Auth.TokenHMACSecretKey = "my-secret-key"
+		conf.Proxy.TCPListeners = []TCPListenerConfig{
+			{EndpointID: "endpoint-1", BindAddr: ":9001"},
+		}
+		assert.EqualError(
+			t,
+			conf.Proxy.Validate(),
+			"tcp listener: endpoint-1: endpoint requires auth",
+		)
+
+		conf.Proxy.Endpoints = map[string]EndpointConfig{
+			"endpoint-1": {DisableAuth: true},
+		}
+		assert.NoError(t, conf.Proxy.Validate())
+	})
+}
+
+func TestEndpointAccessConfig_Permitted(t *testing.T) {
+	t.Run("empty allow", func(t *testing.T) {
+		conf := EndpointAccessConfig{}
+		assert.True(t, conf.Permitted("my-endpoint"))
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		conf := EndpointAccessConfig{
+			Allow: []string{"my-endpoint"},
+		}
+		assert.True(t, conf.Permitted("my-endpoint"))
+		assert.False(t, conf.Permitted("other-endpoint"))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		conf := EndpointAccessConfig{
+			Deny: []string{"my-endpoint"},
+		}
+		assert.False(t, conf.Permitted("my-endpoint"))
+		assert.True(t, conf.Permitted("other-endpoint"))
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		conf := EndpointAccessConfig{
+			Allow: []string{"tenant-a-*", "svc-?"},
+		}
+		assert.True(t, conf.Permitted("tenant-a-api"))
+		assert.True(t, conf.Permitted("svc-1"))
+		assert.False(t, conf.Permitted("tenant-b-api"))
+		assert.False(t, conf.Permitted("svc-10"))
+	})
+
+	t.Run("deny overrides allow", func(t *testing.T) {
+		conf := EndpointAccessConfig{
+			Allow: []string{"tenant-a-*"},
+			Deny:  []string{"tenant-a-internal-*"},
+		}
+		assert.True(t, conf.Permitted("tenant-a-api"))
+		assert.False(t, conf.Permitted("tenant-a-internal-db"))
+	})
+}
+
+func TestEndpointAccessConfig_Validate(t *testing.T) {
+	conf := EndpointAccessConfig{
+		Allow: []string{"tenant-a-*"},
+		Deny:  []string{"[a-"},
+	}
+	assert.EqualError(t, conf.Validate(), "deny: invalid pattern: [a-")
+}
+
+func TestUpstreamConfig_ValidateClientCertAuth(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		conf := Default()
+		assert.NoError(t, conf.Upstream.Validate())
+	})
+
+	t.Run("missing client cas", func(t *testing.T) {
+		conf := Default()
+		conf.Upstream.ClientCertAuth = "sufficient"
+		assert.EqualError(
+			t,
+			conf.Upstream.Validate(),
+			"client cert auth: sufficient: requires tls client cas",
+		)
+	})
+
+	t.Run("client cas", func(t *testing.T) {
+		conf := Default()
+		conf.Upstream.ClientCertAuth = "required"
+		conf.Upstream.TLS = TLSConfig{
+			Enabled:   true,
+			Cert:      "cert.pem",
+			Key:       "key.pem",
+			ClientCAs: "ca.pem",
+		}
+		assert.NoError(t, conf.Upstream.Validate())
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		conf := Default()
+		conf.Upstream.ClientCertAuth = "foo"
+		assert.EqualError(
+			t,
+			conf.Upstream.Validate(),
+			"unsupported client cert auth: foo",
+		)
+	})
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
 
 	"github.com/spf13/pflag"
 )
@@ -11,6 +13,15 @@ type TLSConfig struct {
 	Enabled bool   `json:"enabled" yaml:"enabled"`
 	Cert    string `json:"cert" yaml:"cert"`
 	Key     string `json:"key" yaml:"key"`
+
+	// ClientCAs contains a path to certificate authorities to verify client
+	// certificates. If not given client certificates are not requested.
+	ClientCAs string `json:"client_cas" yaml:"client_cas"`
+
+	// RequireClientCert indicates whether clients must present a valid
+	// certificate signed by ClientCAs. If false client certificates are
+	// verified if given.
+	RequireClientCert bool `json:"require_client_cert" yaml:"require_client_cert"`
 }
 
 func (c *TLSConfig) Validate() error {
@@ -24,6 +35,9 @@ func (c *TLSConfig) Validate() error {
 	if c.Key == "" {
 		return fmt.Errorf("missing key")
 	}
+	if c.RequireClientCert && c.ClientCAs == "" {
+		return fmt.Errorf("missing client cas")
+	}
 	return nil
 }
 
@@ -53,6 +67,28 @@ Path to the PEM encoded certificate file.`,
 		`
 Path to the PEM encoded key file.`,
 	)
+	fs.StringVar(
+		&c.ClientCAs,
+		prefix+"client-cas",
+		c.ClientCAs,
+		`
+Path to a PEM file containing certificate authorities to verify client
+certificates (mutual TLS).
+
+If given, clients may authenticate using a certificate signed by one of the
+certificate authorities. The verified certificate identity (its common name
+or subject alternative name) is logged with the connection.`,
+	)
+	fs.BoolVar(
+		&c.RequireClientCert,
+		prefix+"require-client-cert",
+		c.RequireClientCert,
+		`
+Whether clients must present a valid certificate signed by the configured
+client certificate authorities.
+
+By default client certificates are verified if given but not required.`,
+	)
 }
 
 func (c *TLSConfig) Load() (*tls.Config, error) {
@@ -67,5 +103,23 @@ func (c *TLSConfig) Load() (*tls.Config, error) {
 	}
 	tlsConfig.Certificates = []tls.Certificate{cert}
 
+	if c.ClientCAs != "" {
+		caCert, err := os.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, fmt.Errorf("open client cas: %s: %w", c.ClientCAs, err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("parse client cas: %s", c.ClientCAs)
+		}
+		tlsConfig.ClientCAs = caCertPool
+
+		if c.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
 	return tlsConfig, nil
 }
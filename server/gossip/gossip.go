@@ -2,6 +2,7 @@ package gossip
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -27,6 +28,8 @@ type Gossip struct {
 	// updates.
 	gossiper *gossip.Gossip
 
+	syncer *syncer
+
 	logger log.Logger
 }
 
@@ -53,6 +56,7 @@ func NewGossip(
 	return &Gossip{
 		clusterState: clusterState,
 		gossiper:     gossiper,
+		syncer:       syncer,
 		logger:       logger,
 	}
 }
@@ -70,7 +74,7 @@ func (g *Gossip) JoinOnBoot(addrs []string) ([]string, error) {
 //
 // This will retry 5 times (with backoff).
 func (g *Gossip) JoinOnStartup(ctx context.Context, addrs []string) ([]string, error) {
-	backoff := backoff.New(5, time.Second, time.Minute)
+	backoff := backoff.New(5, time.Second, time.Minute, 2)
 	var lastErr error
 	for {
 		nodeIDs, err := g.gossiper.Join(addrs)
@@ -106,6 +110,51 @@ func (g *Gossip) Leave(ctx context.Context) error {
 	}
 }
 
+// Leaving notifies the known members that this node is leaving the cluster
+// so they stop routing requests to this node, though the node remains a
+// member of the cluster until Leave is called.
+//
+// This will attempt to send the leaving status to up to 3 nodes and wait for
+// them to acknowledge, to ensure the status is propagated.
+//
+// Returns an error if no known members could be notified.
+func (g *Gossip) Leaving(ctx context.Context) error {
+	g.syncer.Leaving()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- g.gossiper.Propagate()
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RunHeartbeat periodically propagates a heartbeat for the local node, until
+// the given context is cancelled.
+//
+// Other nodes use the heartbeat to refresh the local nodes endpoints, so
+// the endpoints aren't expired when an endpoint TTL is configured.
+func (g *Gossip) RunHeartbeat(ctx context.Context, interval time.Duration) {
+	g.syncer.Heartbeat()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.syncer.Heartbeat()
+		}
+	}
+}
+
 // Nodes returns the metadata of all known nodes in the cluster.
 func (g *Gossip) Nodes() []gossip.NodeMetadata {
 	return g.gossiper.Nodes()
@@ -120,6 +169,12 @@ func (g *Gossip) Metrics() *gossip.Metrics {
 	return g.gossiper.Metrics()
 }
 
+// ServeWAN accepts WAN gossip connections from nodes in other datacenters
+// and synchronises with the configured WAN peers.
+func (g *Gossip) ServeWAN(ln net.Listener, tlsConfig *tls.Config) {
+	g.gossiper.ServeWAN(ln, tlsConfig)
+}
+
 func (g *Gossip) Close() error {
 	return g.gossiper.Close()
 }
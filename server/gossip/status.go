@@ -43,6 +43,14 @@ func (s *Status) getNodeRoute(c *gin.Context) {
 		return
 	}
 
+	// Redact the forward key since it must only be shared with other
+	// nodes.
+	for i, entry := range state.Entries {
+		if entry.Key == "forward_key" {
+			state.Entries[i].Value = "redacted"
+		}
+	}
+
 	c.JSON(http.StatusOK, state)
 }
 
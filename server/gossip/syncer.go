@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -50,9 +51,24 @@ func (s *syncer) Sync(gossiper gossiper) {
 	s.gossiper = gossiper
 
 	s.clusterState.OnLocalEndpointUpdate(s.onLocalEndpointUpdate)
+	s.clusterState.OnLocalMetadataUpdate(s.onLocalMetadataUpdate)
 
 	localNode := s.clusterState.LocalNode()
-	// First add immutable fields.
+	// First add immutable fields. The build info is optional so is added
+	// before the addresses, which are required to add the node to the
+	// cluster.
+	if localNode.Version != "" {
+		s.gossiper.UpsertLocal("version", localNode.Version)
+	}
+	if localNode.Commit != "" {
+		s.gossiper.UpsertLocal("commit", localNode.Commit)
+	}
+	if localNode.BuildTime != "" {
+		s.gossiper.UpsertLocal("build_time", localNode.BuildTime)
+	}
+	if localNode.ForwardKey != "" {
+		s.gossiper.UpsertLocal("forward_key", localNode.ForwardKey)
+	}
 	s.gossiper.UpsertLocal("proxy_addr", localNode.ProxyAddr)
 	s.gossiper.UpsertLocal("admin_addr", localNode.AdminAddr)
 	// Finally add mutable fields.
@@ -60,6 +76,9 @@ func (s *syncer) Sync(gossiper gossiper) {
 		key := "endpoint:" + endpointID
 		s.gossiper.UpsertLocal(key, strconv.Itoa(listeners))
 	}
+	for key, value := range localNode.Metadata {
+		s.gossiper.UpsertLocal("metadata:"+key, value)
+	}
 }
 
 func (s *syncer) OnJoin(nodeID string) {
@@ -258,7 +277,20 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 		return
 	}
 
-	if key == "proxy_addr" || key == "admin_addr" {
+	if key == "status" {
+		s.onStatus(nodeID, value)
+		return
+	}
+
+	if key == "heartbeat" {
+		// The heartbeat only refreshes the nodes endpoints so is ignored
+		// for pending nodes.
+		s.clusterState.RefreshRemoteEndpoints(nodeID)
+		return
+	}
+
+	if key == "proxy_addr" || key == "admin_addr" ||
+		key == "version" || key == "commit" || key == "build_time" {
 		// Ignore immutable fields if the node is in the cluster state. This
 		// may occur after a compaction so immutable fields are re-versioned.
 		if _, ok := s.clusterState.Node(nodeID); ok {
@@ -266,6 +298,12 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 		}
 	}
 
+	if key == "forward_key" {
+		if s.clusterState.UpdateRemoteForwardKey(nodeID, value) {
+			return
+		}
+	}
+
 	// First check if the node is already in the cluster. Only check mutable
 	// fields.
 	if strings.HasPrefix(key, "endpoint:") {
@@ -284,6 +322,12 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 			return
 		}
 	}
+	if strings.HasPrefix(key, "metadata:") {
+		metadataKey, _ := strings.CutPrefix(key, "metadata:")
+		if s.clusterState.UpdateRemoteMetadata(nodeID, metadataKey, value) {
+			return
+		}
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -301,6 +345,14 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 		node.ProxyAddr = value
 	} else if key == "admin_addr" {
 		node.AdminAddr = value
+	} else if key == "version" {
+		node.Version = value
+	} else if key == "commit" {
+		node.Commit = value
+	} else if key == "build_time" {
+		node.BuildTime = value
+	} else if key == "forward_key" {
+		node.ForwardKey = value
 	} else if strings.HasPrefix(key, "endpoint:") {
 		endpointID, _ := strings.CutPrefix(key, "endpoint:")
 		listeners, err := strconv.Atoi(value)
@@ -317,6 +369,12 @@ func (s *syncer) OnUpsertKey(nodeID, key, value string) {
 			node.Endpoints = make(map[string]int)
 		}
 		node.Endpoints[endpointID] = listeners
+	} else if strings.HasPrefix(key, "metadata:") {
+		metadataKey, _ := strings.CutPrefix(key, "metadata:")
+		if node.Metadata == nil {
+			node.Metadata = make(map[string]string)
+		}
+		node.Metadata[metadataKey] = value
 	} else {
 		s.logger.Error(
 			"node upsert state; unsupported key",
@@ -407,6 +465,57 @@ func (s *syncer) OnDeleteKey(nodeID, key string) {
 	)
 }
 
+// Leaving updates the local nodes status to leaving, so other nodes stop
+// routing requests to the local node.
+func (s *syncer) Leaving() {
+	s.gossiper.UpsertLocal("status", string(cluster.NodeStatusLeaving))
+}
+
+func (s *syncer) onStatus(nodeID string, value string) {
+	if value != string(cluster.NodeStatusLeaving) {
+		s.logger.Error(
+			"node upsert state; unsupported status",
+			zap.String("node-id", nodeID),
+			zap.String("status", value),
+		)
+		return
+	}
+
+	if updated := s.clusterState.UpdateRemoteStatus(
+		nodeID, cluster.NodeStatusLeaving,
+	); updated {
+		s.logger.Info(
+			"node leaving; updated cluster",
+			zap.String("node-id", nodeID),
+		)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.pendingNodes[nodeID]
+	if ok {
+		pending.Status = cluster.NodeStatusLeaving
+
+		s.logger.Info(
+			"node leaving; updated pending",
+			zap.String("node-id", nodeID),
+		)
+	} else {
+		s.logger.Warn(
+			"node leaving; unknown node",
+			zap.String("node-id", nodeID),
+		)
+	}
+}
+
+// Heartbeat updates the local nodes heartbeat, which refreshes the local
+// nodes endpoints on the other nodes in the cluster.
+func (s *syncer) Heartbeat() {
+	s.gossiper.UpsertLocal("heartbeat", strconv.FormatInt(time.Now().UnixMilli(), 10))
+}
+
 func (s *syncer) onLocalEndpointUpdate(endpointID string) {
 	key := "endpoint:" + endpointID
 	listeners := s.clusterState.LocalEndpointListeners(endpointID)
@@ -417,4 +526,12 @@ func (s *syncer) onLocalEndpointUpdate(endpointID string) {
 	}
 }
 
+func (s *syncer) onLocalMetadataUpdate(key string) {
+	value, ok := s.clusterState.LocalMetadata(key)
+	if !ok {
+		return
+	}
+	s.gossiper.UpsertLocal("metadata:"+key, value)
+}
+
 var _ gossip.Watcher = &syncer{}
@@ -59,6 +59,39 @@ func TestSyncer_Sync(t *testing.T) {
 	)
 }
 
+func TestSyncer_SyncBuildInfo(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:         "local",
+		ProxyAddr:  "10.26.104.56:8000",
+		AdminAddr:  "10.26.104.56:8001",
+		Version:    "v0.8.0",
+		Commit:     "0f2e6d1",
+		BuildTime:  "2024-09-01T10:00:00Z",
+		ForwardKey: "my-key",
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	// The build info must be propagated before the addresses, so it is
+	// known when the node is added to the cluster.
+	assert.Equal(
+		t,
+		[]upsert{
+			{"version", "v0.8.0"},
+			{"commit", "0f2e6d1"},
+			{"build_time", "2024-09-01T10:00:00Z"},
+			{"forward_key", "my-key"},
+			{"proxy_addr", "10.26.104.56:8000"},
+			{"admin_addr", "10.26.104.56:8001"},
+		},
+		gossiper.upserts,
+	)
+}
+
 func TestSyncer_OnLocalEndpointUpdate(t *testing.T) {
 	localNode := &cluster.Node{
 		ID:        "local",
@@ -101,6 +134,78 @@ func TestSyncer_OnLocalEndpointUpdate(t *testing.T) {
 	)
 }
 
+func TestSyncer_OnLocalMetadataUpdate(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+		Metadata: map[string]string{
+			"region": "eu-west-1",
+		},
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	assert.Equal(
+		t,
+		upsert{"metadata:region", "eu-west-1"},
+		gossiper.upserts[len(gossiper.upserts)-1],
+	)
+
+	m.SetLocalMetadata("region", "us-east-1")
+	assert.Equal(
+		t,
+		upsert{"metadata:region", "us-east-1"},
+		gossiper.upserts[len(gossiper.upserts)-1],
+	)
+}
+
+func TestSyncer_Heartbeat(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	sync.Heartbeat()
+	assert.Equal(
+		t,
+		"heartbeat",
+		gossiper.upserts[len(gossiper.upserts)-1].Key,
+	)
+}
+
+func TestSyncer_Leaving(t *testing.T) {
+	localNode := &cluster.Node{
+		ID:        "local",
+		ProxyAddr: "10.26.104.56:8000",
+		AdminAddr: "10.26.104.56:8001",
+	}
+	m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+	sync := newSyncer(m, log.NewNopLogger())
+
+	gossiper := &fakeGossiper{}
+	sync.Sync(gossiper)
+
+	sync.Leaving()
+	assert.Equal(
+		t,
+		upsert{"status", "leaving"},
+		gossiper.upserts[len(gossiper.upserts)-1],
+	)
+}
+
 func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 	t.Run("add node", func(t *testing.T) {
 		localNode := &cluster.Node{
@@ -133,6 +238,73 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 		})
 	})
 
+	t.Run("add node with build info", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "version", "v0.8.0")
+		sync.OnUpsertKey("remote", "commit", "0f2e6d1")
+		sync.OnUpsertKey("remote", "build_time", "2024-09-01T10:00:00Z")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		// Build info is immutable so ignored once the node is added.
+		sync.OnUpsertKey("remote", "version", "v0.9.0")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, node, &cluster.Node{
+			ID:        "remote",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.98:8000",
+			AdminAddr: "10.26.104.98:8001",
+			Version:   "v0.8.0",
+			Commit:    "0f2e6d1",
+			BuildTime: "2024-09-01T10:00:00Z",
+		})
+	})
+
+	t.Run("add node with forward key", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "forward_key", "my-key")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "my-key", node.ForwardKey)
+
+		// Nodes restored from a snapshot may not have a forward key, so
+		// the key is updated once the node is in the cluster.
+		sync.OnUpsertKey("remote", "forward_key", "my-key-2")
+
+		node, ok = m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, "my-key-2", node.ForwardKey)
+	})
+
 	t.Run("add node missing state", func(t *testing.T) {
 		localNode := &cluster.Node{
 			ID:        "local",
@@ -213,6 +385,97 @@ func TestSyncer_RemoteNodeUpdate(t *testing.T) {
 			},
 		})
 	})
+
+	t.Run("update metadata", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		// Metadata received before the node is added to the cluster.
+		sync.OnUpsertKey("remote", "metadata:region", "eu-west-1")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+		// Metadata received after the node is added to the cluster.
+		sync.OnUpsertKey("remote", "metadata:color", "blue")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, node, &cluster.Node{
+			ID:        "remote",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.98:8000",
+			AdminAddr: "10.26.104.98:8001",
+			Metadata: map[string]string{
+				"region": "eu-west-1",
+				"color":  "blue",
+			},
+		})
+	})
+}
+
+func TestSyncer_RemoteNodeLeaving(t *testing.T) {
+	t.Run("active node leaving", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		// Add remote node.
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+		sync.OnUpsertKey("remote", "endpoint:my-endpoint", "5")
+
+		sync.OnUpsertKey("remote", "status", "leaving")
+
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, cluster.NodeStatusLeaving, node.Status)
+
+		_, ok = m.LookupEndpoint("my-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("pending node leaving", func(t *testing.T) {
+		localNode := &cluster.Node{
+			ID:        "local",
+			ProxyAddr: "10.26.104.56:8000",
+			AdminAddr: "10.26.104.56:8001",
+		}
+		m := cluster.NewState(localNode.Copy(), log.NewNopLogger())
+
+		sync := newSyncer(m, log.NewNopLogger())
+
+		gossiper := &fakeGossiper{}
+		sync.Sync(gossiper)
+
+		sync.OnJoin("remote")
+		sync.OnUpsertKey("remote", "status", "leaving")
+		sync.OnUpsertKey("remote", "proxy_addr", "10.26.104.98:8000")
+		sync.OnUpsertKey("remote", "admin_addr", "10.26.104.98:8001")
+
+		// The node should be added with the leaving status.
+		node, ok := m.Node("remote")
+		assert.True(t, ok)
+		assert.Equal(t, cluster.NodeStatusLeaving, node.Status)
+	})
 }
 
 func TestSyncer_RemoteNodeLeave(t *testing.T) {
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/andydunstall/piko/server/proxy"
+)
+
+type options struct {
+	tracerProvider   trace.TracerProvider
+	endpointResolver proxy.EndpointResolver
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type tracerProviderOption struct {
+	provider trace.TracerProvider
+}
+
+func (o tracerProviderOption) apply(opts *options) {
+	opts.tracerProvider = o.provider
+}
+
+// WithTracerProvider configures the OpenTelemetry tracer provider used to
+// trace proxied requests.
+//
+// If not set (the default) requests are not traced.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return tracerProviderOption{provider: provider}
+}
+
+type endpointResolverOption struct {
+	resolver proxy.EndpointResolver
+}
+
+func (o endpointResolverOption) apply(opts *options) {
+	opts.endpointResolver = o.resolver
+}
+
+// WithEndpointResolver configures the resolver used to resolve the endpoint
+// ID of proxied HTTP requests.
+//
+// If not set (the default) the endpoint ID is resolved from the
+// 'x-piko-endpoint' header or 'Host' header.
+func WithEndpointResolver(resolver proxy.EndpointResolver) Option {
+	return endpointResolverOption{resolver: resolver}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/server/auth"
+)
+
+// authenticate verifies the request bearer token permits access to the
+// endpoint.
+//
+// If the request isn't authenticated, returns false and replies to the
+// client with 401.
+func (p *HTTPProxy) authenticate(
+	w http.ResponseWriter,
+	r *http.Request,
+	endpointID string,
+) bool {
+	if p.verifier == nil || p.endpoints[endpointID].DisableAuth {
+		return true
+	}
+
+	logger := requestLogger(p.logger, r)
+
+	authorization := r.Header.Get("Authorization")
+	authType, tokenString, ok := strings.Cut(authorization, " ")
+	if !ok {
+		logger.Warn(
+			"missing authorization header",
+			zap.String("endpoint-id", endpointID),
+		)
+		p.unauthorizedResponse(w, r, "missing authorization")
+		return false
+	}
+	if authType != "Bearer" {
+		logger.Warn(
+			"unsupported auth type",
+			zap.String("endpoint-id", endpointID),
+			zap.String("auth-type", authType),
+		)
+		p.unauthorizedResponse(w, r, "unsupported auth type")
+		return false
+	}
+
+	token, err := p.verifier.VerifyEndpointToken(tokenString)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			logger.Warn(
+				"auth invalid token",
+				zap.String("endpoint-id", endpointID),
+				zap.Error(err),
+			)
+			p.unauthorizedResponse(w, r, "invalid token")
+			return false
+		}
+		if errors.Is(err, auth.ErrExpiredToken) {
+			logger.Warn(
+				"auth expired token",
+				zap.String("endpoint-id", endpointID),
+				zap.Error(err),
+			)
+			p.unauthorizedResponse(w, r, "expired token")
+			return false
+		}
+
+		logger.Warn(
+			"unknown verification error",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		p.writeError(w, r, http.StatusInternalServerError, "internal error")
+		return false
+	}
+
+	if !token.EndpointPermitted(endpointID) {
+		logger.Warn(
+			"endpoint not permitted",
+			zap.String("endpoint-id", endpointID),
+		)
+		p.unauthorizedResponse(w, r, "endpoint not permitted")
+		return false
+	}
+
+	return true
+}
+
+func (p *HTTPProxy) unauthorizedResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	message string,
+) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	p.writeError(w, r, http.StatusUnauthorized, message)
+}
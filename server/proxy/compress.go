@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andydunstall/piko/pkg/stream"
+	"github.com/andydunstall/piko/server/config"
+)
+
+// compressionPolicy decides whether to compress responses for an endpoint.
+type compressionPolicy struct {
+	minSize int64
+
+	// contentTypes contains the compressible media types.
+	contentTypes map[string]struct{}
+	// contentTypePrefixes contains the compressible media type prefixes,
+	// such as 'text/' for 'text/*'.
+	contentTypePrefixes []string
+}
+
+// newCompressionPolicy returns the compression policy for the given
+// configuration. If compression is disabled, returns nil.
+func newCompressionPolicy(conf config.CompressionConfig) *compressionPolicy {
+	if !conf.Enabled {
+		return nil
+	}
+
+	policy := &compressionPolicy{
+		minSize:      conf.MinSize,
+		contentTypes: make(map[string]struct{}),
+	}
+	for _, contentType := range conf.ContentTypes {
+		contentType = strings.ToLower(contentType)
+		if prefix, ok := strings.CutSuffix(contentType, "/*"); ok {
+			policy.contentTypePrefixes = append(
+				policy.contentTypePrefixes, prefix+"/",
+			)
+			continue
+		}
+		policy.contentTypes[contentType] = struct{}{}
+	}
+	return policy
+}
+
+// newEndpointCompressionPolicies returns the compression policies for
+// endpoints that override the proxy compression configuration.
+//
+// An endpoint override replaces the proxy configuration, except if the
+// override doesn't configure any content types the proxy content types are
+// used.
+func newEndpointCompressionPolicies(
+	conf config.CompressionConfig,
+	endpoints map[string]config.EndpointConfig,
+) map[string]*compressionPolicy {
+	policies := make(map[string]*compressionPolicy)
+	for endpointID, endpoint := range endpoints {
+		if endpoint.Compression == nil {
+			continue
+		}
+
+		override := *endpoint.Compression
+		if len(override.ContentTypes) == 0 {
+			override.ContentTypes = conf.ContentTypes
+		}
+		policies[endpointID] = newCompressionPolicy(override)
+	}
+	return policies
+}
+
+// Compress compresses the response body with gzip if the client accepts
+// gzip and the response is compressible.
+func (c *compressionPolicy) Compress(resp *http.Response) {
+	if !c.compressible(resp) {
+		return
+	}
+
+	// Whether the response is compressed depends on the clients
+	// 'Accept-Encoding' header.
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	if !acceptsGzip(resp.Request.Header) {
+		return
+	}
+
+	resp.Body = newGzipReadCloser(resp.Body)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	// The compressed body differs from the upstream body so is no longer
+	// byte for byte equivalent.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+func (c *compressionPolicy) compressible(resp *http.Response) bool {
+	// Don't compress responses that are already encoded.
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if resp.Request.Method == http.MethodHead ||
+		resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	// Streams are forwarded without buffering.
+	if stream.IsStreaming(resp) {
+		return false
+	}
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if _, ok := c.contentTypes[mediaType]; ok {
+		return true
+	}
+	for _, prefix := range c.contentTypePrefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip returns whether the 'Accept-Encoding' header accepts gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(encoding, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+
+			// Ignore encodings with a quality of zero, which indicates
+			// the encoding is not acceptable.
+			name, q, ok := strings.Cut(strings.TrimSpace(params), "=")
+			if ok && strings.TrimSpace(name) == "q" {
+				if quality, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && quality == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipReadCloser compresses the underlying reader as it is read.
+type gzipReadCloser struct {
+	src io.ReadCloser
+
+	gz *gzip.Writer
+	// buf contains compressed bytes that have not yet been read.
+	buf bytes.Buffer
+	// chunk is a buffer for reading from src.
+	chunk []byte
+
+	// err is the error to return once buf is drained.
+	err error
+}
+
+func newGzipReadCloser(src io.ReadCloser) *gzipReadCloser {
+	r := &gzipReadCloser{
+		src:   src,
+		chunk: make([]byte, 32*1024),
+	}
+	r.gz = gzip.NewWriter(&r.buf)
+	return r
+}
+
+func (r *gzipReadCloser) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && r.err == nil {
+		n, err := r.src.Read(r.chunk)
+		if n > 0 {
+			// Writes to a bytes.Buffer don't fail.
+			_, _ = r.gz.Write(r.chunk[:n])
+			// Flush so the compressed bytes are forwarded as the upstream
+			// writes rather than buffered until the response completes.
+			_ = r.gz.Flush()
+		}
+		if err == io.EOF {
+			_ = r.gz.Close()
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+		}
+	}
+
+	if r.buf.Len() > 0 {
+		return r.buf.Read(p)
+	}
+	return 0, r.err
+}
+
+func (r *gzipReadCloser) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		accepts        bool
+	}{
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"br;q=1.0, gzip;q=0.8", true},
+		{"*", true},
+		{"", false},
+		{"deflate, br", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.acceptEncoding != "" {
+			h.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		assert.Equal(t, tt.accepts, acceptsGzip(h), tt.acceptEncoding)
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// semaphore limits the number of concurrent requests to an endpoint.
+type semaphore struct {
+	slots chan struct{}
+
+	// refs is the number of requests either holding or waiting for a slot.
+	// Once zero the semaphore is removed.
+	refs int
+}
+
+// concurrencyLimiter limits the number of concurrent requests to each
+// endpoint.
+//
+// Requests over the limit wait up to the configured queue timeout for a
+// slot, and are otherwise rejected.
+type concurrencyLimiter struct {
+	conf config.ConcurrencyLimitConfig
+
+	// endpoints contains configuration overrides for specific endpoints.
+	endpoints map[string]config.EndpointConfig
+
+	// semaphores contains the semaphores for endpoints with in-flight or
+	// waiting requests, keyed by endpoint ID.
+	semaphores map[string]*semaphore
+
+	mu sync.Mutex
+}
+
+func newConcurrencyLimiter(
+	conf config.ConcurrencyLimitConfig,
+	endpoints map[string]config.EndpointConfig,
+) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		conf:       conf,
+		endpoints:  endpoints,
+		semaphores: make(map[string]*semaphore),
+	}
+}
+
+// Acquire acquires a slot for a request to the endpoint, waiting up to the
+// queue timeout if the endpoint is at the limit.
+//
+// If acquired, returns a function to release the slot, which must be called
+// once the request completes. Otherwise returns false.
+func (l *concurrencyLimiter) Acquire(
+	ctx context.Context,
+	endpointID string,
+) (func(), bool) {
+	limit := l.limit(endpointID)
+	if limit == 0 {
+		return func() {}, true
+	}
+
+	sem := l.ref(endpointID, limit)
+
+	select {
+	case sem.slots <- struct{}{}:
+		return l.releaseFunc(endpointID, sem), true
+	default:
+	}
+
+	if l.conf.QueueTimeout == 0 {
+		l.unref(endpointID, sem)
+		return nil, false
+	}
+
+	timer := time.NewTimer(l.conf.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case sem.slots <- struct{}{}:
+		return l.releaseFunc(endpointID, sem), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.unref(endpointID, sem)
+	return nil, false
+}
+
+// limit returns the maximum concurrent requests for the endpoint.
+func (l *concurrencyLimiter) limit(endpointID string) int {
+	if override, ok := l.endpoints[endpointID]; ok {
+		if override.MaxConcurrentRequests > 0 {
+			return override.MaxConcurrentRequests
+		}
+	}
+	return l.conf.MaxRequests
+}
+
+func (l *concurrencyLimiter) releaseFunc(
+	endpointID string,
+	sem *semaphore,
+) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-sem.slots
+			l.unref(endpointID, sem)
+		})
+	}
+}
+
+func (l *concurrencyLimiter) ref(endpointID string, limit int) *semaphore {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, ok := l.semaphores[endpointID]
+	if !ok {
+		sem = &semaphore{
+			slots: make(chan struct{}, limit),
+		}
+		l.semaphores[endpointID] = sem
+	}
+	sem.refs++
+	return sem
+}
+
+func (l *concurrencyLimiter) unref(endpointID string, sem *semaphore) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem.refs--
+	if sem.refs == 0 {
+		delete(l.semaphores, endpointID)
+	}
+}
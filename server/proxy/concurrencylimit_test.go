@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests: 2,
+		}, nil)
+
+		release1, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+		release2, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+
+		_, ok = limiter.Acquire(context.TODO(), "my-endpoint")
+		assert.False(t, ok)
+
+		// Other endpoints are limited separately.
+		release3, ok := limiter.Acquire(context.TODO(), "other-endpoint")
+		require.True(t, ok)
+		release3()
+
+		release1()
+		release4, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+
+		release2()
+		release4()
+
+		// Once all slots are released the semaphore is removed.
+		assert.Empty(t, limiter.semaphores)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests:  1,
+			QueueTimeout: time.Minute,
+		}, nil)
+
+		release, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+
+		acquiredCh := make(chan struct{})
+		go func() {
+			release, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+			assert.True(t, ok)
+			release()
+			close(acquiredCh)
+		}()
+
+		select {
+		case <-acquiredCh:
+			t.Fatal("acquired over limit")
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		release()
+		<-acquiredCh
+
+		assert.Empty(t, limiter.semaphores)
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests:  1,
+			QueueTimeout: time.Millisecond * 10,
+		}, nil)
+
+		release, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+
+		_, ok = limiter.Acquire(context.TODO(), "my-endpoint")
+		assert.False(t, ok)
+
+		release()
+		assert.Empty(t, limiter.semaphores)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests:  1,
+			QueueTimeout: time.Minute,
+		}, nil)
+
+		release, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+		defer release()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, ok = limiter.Acquire(ctx, "my-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("release twice", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests: 1,
+		}, nil)
+
+		release, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		require.True(t, ok)
+		release()
+		release()
+
+		assert.Empty(t, limiter.semaphores)
+	})
+
+	t.Run("endpoint override", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{
+			MaxRequests: 1,
+		}, map[string]config.EndpointConfig{
+			"my-endpoint": {
+				MaxConcurrentRequests: 2,
+			},
+		})
+
+		for i := 0; i != 2; i++ {
+			_, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+			assert.True(t, ok)
+		}
+		_, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+		assert.False(t, ok)
+
+		_, ok = limiter.Acquire(context.TODO(), "other-endpoint")
+		assert.True(t, ok)
+		_, ok = limiter.Acquire(context.TODO(), "other-endpoint")
+		assert.False(t, ok)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		limiter := newConcurrencyLimiter(config.ConcurrencyLimitConfig{}, nil)
+
+		for i := 0; i != 100; i++ {
+			_, ok := limiter.Acquire(context.TODO(), "my-endpoint")
+			assert.True(t, ok)
+		}
+		assert.Empty(t, limiter.semaphores)
+	})
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// corsPolicy handles Cross-Origin Resource Sharing (CORS) requests for an
+// endpoint.
+type corsPolicy struct {
+	// origins contains the allowed origins.
+	origins map[string]struct{}
+	// anyOrigin indicates whether any origin is allowed.
+	anyOrigin bool
+
+	methods string
+
+	headers string
+	// anyHeader indicates whether any request header is allowed, in which
+	// case the requested headers are reflected.
+	anyHeader bool
+
+	credentials bool
+
+	// maxAge is the 'Access-Control-Max-Age' header value, or empty if not
+	// set.
+	maxAge string
+}
+
+// newCORSPolicy returns the CORS policy for the given configuration. If CORS
+// is disabled, returns nil.
+func newCORSPolicy(conf config.CORSConfig) *corsPolicy {
+	if !conf.Enabled {
+		return nil
+	}
+
+	origins := make(map[string]struct{}, len(conf.AllowedOrigins))
+	for _, origin := range conf.AllowedOrigins {
+		origins[origin] = struct{}{}
+	}
+	_, anyOrigin := origins["*"]
+
+	var maxAge string
+	if conf.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(conf.MaxAge.Seconds()))
+	}
+
+	return &corsPolicy{
+		origins: origins,
+		// Never allow any origin with credentials, which must only reflect
+		// an explicitly allowed origin.
+		anyOrigin:   anyOrigin && !conf.AllowCredentials,
+		methods:     strings.Join(conf.AllowedMethods, ", "),
+		headers:     strings.Join(conf.AllowedHeaders, ", "),
+		anyHeader:   slices.Contains(conf.AllowedHeaders, "*"),
+		credentials: conf.AllowCredentials,
+		maxAge:      maxAge,
+	}
+}
+
+// newEndpointCORSPolicies returns the CORS policies for endpoints that
+// override the proxy CORS configuration.
+//
+// An endpoint override replaces the proxy configuration, except if the
+// override doesn't configure any methods the proxy methods are used.
+func newEndpointCORSPolicies(
+	conf config.CORSConfig,
+	endpoints map[string]config.EndpointConfig,
+) map[string]*corsPolicy {
+	policies := make(map[string]*corsPolicy)
+	for endpointID, endpoint := range endpoints {
+		if endpoint.CORS == nil {
+			continue
+		}
+
+		override := *endpoint.CORS
+		if len(override.AllowedMethods) == 0 {
+			override.AllowedMethods = conf.AllowedMethods
+		}
+		policies[endpointID] = newCORSPolicy(override)
+	}
+	return policies
+}
+
+// Preflight responds to the given preflight request without forwarding the
+// request to the upstream.
+func (c *corsPolicy) Preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if !c.setOrigin(w, r) {
+		_ = errorResponse(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", c.methods)
+	if c.anyHeader {
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+	} else if c.headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", c.headers)
+	}
+	if c.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetHeaders adds the CORS headers to the response of an actual (not
+// preflight) request.
+func (c *corsPolicy) SetHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	c.setOrigin(w, r)
+}
+
+// setOrigin sets the allowed origin response headers if the request origin
+// is allowed. Returns false if the origin is not allowed.
+func (c *corsPolicy) setOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	if c.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	if _, ok := c.origins[origin]; !ok {
+		return false
+	}
+
+	// Reflect the single matching origin rather than the full list.
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// isPreflight returns whether the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// removeCORSHeaders removes any CORS headers set by the upstream, since the
+// proxy sets the CORS headers when CORS is enabled.
+func removeCORSHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// errorResponseData contains the values error response templates can
+// reference.
+type errorResponseData struct {
+	StatusCode int
+	Status     string
+	Message    string
+	EndpointID string
+	RequestID  string
+}
+
+type errorTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+type errorResponseTemplate struct {
+	contentType string
+	body        errorTemplate
+}
+
+// errorResponses writes error responses using the configured templates,
+// falling back to the default JSON error response.
+type errorResponses struct {
+	// templates contains the error response templates keyed by status
+	// code.
+	templates map[int]*errorResponseTemplate
+}
+
+func newErrorResponses(conf []config.ErrorResponseConfig) *errorResponses {
+	templates := make(map[int]*errorResponseTemplate)
+	for _, resp := range conf {
+		// HTML templates escape the values, since the endpoint ID and
+		// message may be derived from the request.
+		var body errorTemplate
+		var err error
+		mediaType, _, _ := mime.ParseMediaType(resp.ContentType)
+		if mediaType == "text/html" {
+			body, err = htmltemplate.New("body").Parse(resp.Body)
+		} else {
+			body, err = template.New("body").Parse(resp.Body)
+		}
+		if err != nil {
+			// Templates are checked when validating the configuration.
+			continue
+		}
+
+		templates[resp.StatusCode] = &errorResponseTemplate{
+			contentType: resp.ContentType,
+			body:        body,
+		}
+	}
+	return &errorResponses{
+		templates: templates,
+	}
+}
+
+// Enabled returns whether there is a template for the status code.
+func (e *errorResponses) Enabled(statusCode int) bool {
+	_, ok := e.templates[statusCode]
+	return ok
+}
+
+// Write writes an error response with the given data.
+//
+// If there is no template for the status code, or rendering the template
+// fails, the default JSON error response is written.
+func (e *errorResponses) Write(w http.ResponseWriter, data errorResponseData) {
+	tmpl, ok := e.templates[data.StatusCode]
+	if !ok {
+		_ = errorResponse(w, data.StatusCode, data.Message)
+		return
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.body.Execute(&b, data); err != nil {
+		_ = errorResponse(w, data.StatusCode, data.Message)
+		return
+	}
+
+	w.Header().Set("Content-Type", tmpl.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.StatusCode)
+
+	_, _ = w.Write(b.Bytes())
+}
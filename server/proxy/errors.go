@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"errors"
+)
+
+var (
+	// ErrMissingEndpointID indicates the endpoint ID could not be resolved
+	// from the request.
+	ErrMissingEndpointID = errors.New("missing endpoint id")
+
+	// ErrEndpointNotPermitted indicates the node is configured not to serve
+	// the endpoint.
+	ErrEndpointNotPermitted = errors.New("endpoint not permitted on this node")
+
+	// ErrEndpointNotFound indicates there are no upstreams available for
+	// the endpoint, either connected to this node or other nodes in the
+	// cluster.
+	ErrEndpointNotFound = errors.New("no available upstreams")
+
+	// ErrEndpointUnreachable indicates an upstream for the endpoint was
+	// selected but the request could not be proxied, such as the upstream
+	// connection failed.
+	ErrEndpointUnreachable = errors.New("upstream unreachable")
+
+	// ErrEndpointTimeout indicates the upstream didn't respond within the
+	// request timeout.
+	ErrEndpointTimeout = errors.New("upstream timeout")
+)
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// setForwardedHeaders adds the 'X-Forwarded-Proto', 'X-Forwarded-Host' and
+// RFC 7239 'Forwarded' headers to the request before it is forwarded to the
+// upstream.
+//
+// If trusted is false, any existing forwarding headers from the client are
+// removed rather than propagated, since the client could set them to
+// arbitrary values.
+//
+// Note 'X-Forwarded-For' is appended to by httputil.ReverseProxy, so is only
+// removed when untrusted.
+func setForwardedHeaders(r *http.Request, trusted bool) {
+	if !trusted {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		r.Header.Del("Forwarded")
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// Only set the protocol and host if not already set, so when the request
+	// is forwarded via another node they refer to the original request.
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" && r.Host != "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	element := forwardedElement(r.RemoteAddr, r.Host, proto)
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	r.Header.Set("Forwarded", element)
+}
+
+// forwardedElement returns a 'Forwarded' header element for the client with
+// the given address.
+func forwardedElement(remoteAddr string, host string, proto string) string {
+	var params []string
+
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		// IPv6 addresses must be bracketed and quoted.
+		if strings.Contains(ip, ":") {
+			params = append(params, `for="[`+ip+`]"`)
+		} else {
+			params = append(params, "for="+ip)
+		}
+	}
+	if host != "" {
+		params = append(params, "host="+quoteForwardedValue(host))
+	}
+	params = append(params, "proto="+proto)
+
+	return strings.Join(params, ";")
+}
+
+// quoteForwardedValue quotes the value if it contains characters that are
+// not allowed in a token, such as the ':' in a host with a port.
+func quoteForwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
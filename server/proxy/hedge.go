@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// hedgeTransport hedges requests forwarded to a remote node.
+//
+// If the node hasn't responded within the hedge delay, the request is sent
+// to an alternative node with the endpoint, and whichever response arrives
+// first is used and the other request is cancelled.
+//
+// Requests are hedged at most once, only if they can be safely sent twice,
+// and only if within the retry budget.
+type hedgeTransport struct {
+	// transport forwards requests to other nodes.
+	transport http.RoundTripper
+
+	delay time.Duration
+
+	// budget limits the number of hedged requests, which is shared with
+	// retries.
+	budget *retryBudget
+
+	metrics *Metrics
+
+	logger log.Logger
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedged bool
+}
+
+func (t *hedgeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	primary := r.Context().Value(upstreamContextKey).(*upstream.NodeUpstream)
+	next, ok := primary.Next()
+	if !ok || !hedgeable(r) {
+		return t.transport.RoundTrip(r)
+	}
+
+	// Buffer both results so the request that loses never blocks.
+	results := make(chan hedgeResult, 2)
+
+	primaryCtx, primaryCancel := context.WithCancel(r.Context())
+	go t.roundTrip(r.WithContext(primaryCtx), primaryCancel, false, results)
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		// The node responded within the hedge delay so there is no need to
+		// hedge.
+		return res.resp, res.err
+	case <-r.Context().Done():
+		// The primary request uses the same context so will be cancelled.
+		res := <-results
+		return res.resp, res.err
+	case <-timer.C:
+	}
+
+	if !t.budget.Withdraw() {
+		// Wait for the primary request rather than adding load when the
+		// retry budget is exhausted.
+		res := <-results
+		return res.resp, res.err
+	}
+
+	requestLogger(t.logger, r).Debug(
+		"forward request slow; hedging with alternative node",
+		zap.String("node-id", primary.NodeID()),
+		zap.String("alternative-node-id", next.NodeID()),
+	)
+
+	endpointLabel := t.metrics.EndpointLabel(primary.EndpointID())
+	t.metrics.HedgedRequestsTotal.With(prometheus.Labels{
+		"endpoint_id": endpointLabel,
+	}).Inc()
+
+	hedgeCtx, hedgeCancel := context.WithCancel(
+		context.WithValue(r.Context(), upstreamContextKey, next),
+	)
+	go t.roundTrip(r.WithContext(hedgeCtx), hedgeCancel, true, results)
+
+	first := <-results
+	if first.err != nil {
+		// Wait for the other request, though if both fail return the
+		// error from the primary node.
+		second := <-results
+		if second.err != nil {
+			if first.hedged {
+				return nil, second.err
+			}
+			return nil, first.err
+		}
+		first = second
+	} else {
+		// Cancel the losing request and discard its response if it
+		// arrives.
+		if first.hedged {
+			primaryCancel()
+		} else {
+			hedgeCancel()
+		}
+		go func() {
+			res := <-results
+			if res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}()
+	}
+
+	if first.hedged {
+		t.metrics.HedgedWinsTotal.With(prometheus.Labels{
+			"endpoint_id": endpointLabel,
+		}).Inc()
+	}
+	return first.resp, nil
+}
+
+// roundTrip forwards the request and sends the result to the given channel.
+//
+// The request context is cancelled when the response body is closed, or
+// when the request fails.
+func (t *hedgeTransport) roundTrip(
+	r *http.Request,
+	cancel context.CancelFunc,
+	hedged bool,
+	results chan<- hedgeResult,
+) {
+	resp, err := t.transport.RoundTrip(r)
+	if err != nil {
+		cancel()
+		results <- hedgeResult{err: err, hedged: hedged}
+		return
+	}
+	resp.Body = &cancelBody{
+		ReadCloser: resp.Body,
+		cancel:     cancel,
+	}
+	results <- hedgeResult{resp: resp, hedged: hedged}
+}
+
+// hedgeable returns whether the request can be safely sent to multiple
+// nodes.
+func hedgeable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	// Upgrade responses require the response body to be writable, and
+	// there is no benefit to hedging long-lived connections.
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return isIdempotent(r.Method)
+}
+
+// cancelBody cancels the request context when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// protocolTransport forwards requests to upstreams connected to this node,
+// using HTTP/2 for endpoints configured to use HTTP/2 and HTTP/1.1
+// otherwise.
+type protocolTransport struct {
+	http1 http.RoundTripper
+	http2 http.RoundTripper
+}
+
+func (t *protocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if useHTTP2(r) {
+		return t.http2.RoundTrip(r)
+	}
+	return t.http1.RoundTrip(r)
+}
+
+// upstreamHTTP2Transport forwards requests to upstreams using cleartext
+// HTTP/2 (h2c).
+//
+// Like the HTTP/1.1 upstream transport, connections aren't reused, so each
+// request is sent to the upstream selected for that request.
+type upstreamHTTP2Transport struct {
+	transport *http2.Transport
+
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newUpstreamHTTP2Transport(
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) *upstreamHTTP2Transport {
+	return &upstreamHTTP2Transport{
+		transport: &http2.Transport{
+			AllowHTTP: true,
+			// Forward responses unchanged rather than decompressing.
+			DisableCompression: true,
+		},
+		dial: dial,
+	}
+}
+
+func (t *upstreamHTTP2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	conn, err := t.dial(r.Context(), "tcp", r.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := t.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := cc.RoundTrip(r)
+	if err != nil {
+		cc.Close()
+		return nil, err
+	}
+	// Close the connection once the response has been forwarded.
+	resp.Body = &closeConnBody{
+		ReadCloser: resp.Body,
+		closeConn:  cc.Close,
+	}
+	return resp, nil
+}
+
+// newNodeHTTP2Transport returns a transport that forwards requests to other
+// nodes using cleartext HTTP/2 (h2c). Requests are multiplexed over a single
+// connection to each node.
+func newNodeHTTP2Transport(
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(
+			ctx context.Context, network, addr string, _ *tls.Config,
+		) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		// Forward responses unchanged rather than decompressing.
+		DisableCompression: true,
+	}
+}
+
+// useHTTP2 returns whether the request should be forwarded using HTTP/2.
+func useHTTP2(r *http.Request) bool {
+	http2, _ := r.Context().Value(http2ContextKey).(bool)
+	return http2
+}
+
+// closeConnBody closes the connection when the body is closed.
+type closeConnBody struct {
+	io.ReadCloser
+
+	closeConn func() error
+	closeOnce sync.Once
+}
+
+func (b *closeConnBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		_ = b.closeConn()
+	})
+	return err
+}
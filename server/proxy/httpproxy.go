@@ -2,18 +2,32 @@ package proxy
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/requestmeta"
+	"github.com/andydunstall/piko/pkg/stream"
+	"github.com/andydunstall/piko/pkg/tracing"
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -22,8 +36,25 @@ type contextKey int
 const (
 	endpointContextKey contextKey = iota
 	upstreamContextKey
+	timeoutTimerContextKey
+	responseControllerContextKey
+	requestStateContextKey
+	http2ContextKey
+	forwardStateContextKey
 )
 
+// requestState records whether a proxied request failed, which is set by the
+// proxy error handler.
+type requestState struct {
+	failed bool
+}
+
+// forwardState records the error a request failed with when proxied using
+// Forward.
+type forwardState struct {
+	err error
+}
+
 // HTTPProxy proxies HTTP traffic to upsteam listeners.
 type HTTPProxy struct {
 	upstreams upstream.Manager
@@ -32,18 +63,133 @@ type HTTPProxy struct {
 
 	timeout time.Duration
 
+	// maxTimeout is the maximum timeout requests can set with the
+	// 'x-piko-timeout' header.
+	maxTimeout time.Duration
+
+	sticky config.StickyConfig
+
+	// trustForwardedHeaders indicates whether to propagate forwarding
+	// headers set by the client.
+	trustForwardedHeaders bool
+
+	maxRequestBodyBytes  int64
+	maxResponseBodyBytes int64
+
+	// endpoints contains configuration overrides for specific endpoints.
+	endpoints map[string]config.EndpointConfig
+
+	rateLimiter *rateLimiter
+
+	concurrencyLimiter *concurrencyLimiter
+
+	// nodeTransport forwards requests to other nodes.
+	nodeTransport *nodeTransport
+
+	// cors is the CORS policy for endpoints that don't override the CORS
+	// configuration. If nil CORS is disabled.
+	cors *corsPolicy
+	// endpointCORS contains the CORS policies for endpoints that override
+	// the CORS configuration.
+	endpointCORS map[string]*corsPolicy
+
+	// compression is the compression policy for endpoints that don't
+	// override the compression configuration. If nil compression is
+	// disabled.
+	compression *compressionPolicy
+	// endpointCompression contains the compression policies for endpoints
+	// that override the compression configuration.
+	endpointCompression map[string]*compressionPolicy
+
+	// verifier authenticates requests. If nil requests aren't authenticated.
+	verifier auth.Verifier
+
+	resolver EndpointResolver
+
+	// endpointAccess restricts the endpoints the node serves.
+	endpointAccess config.EndpointAccessConfig
+
+	// forwardKey authenticates requests forwarded from other nodes.
+	forwardKey string
+
+	// errorResponses writes error responses using the configured
+	// templates.
+	errorResponses *errorResponses
+
+	// inflight tracks the requests currently being proxied.
+	inflight *inflightRegistry
+
+	metrics *Metrics
+
+	tracer trace.Tracer
+
 	logger log.Logger
 }
 
 func NewHTTPProxy(
 	upstreams upstream.Manager,
-	timeout time.Duration,
+	conf config.ProxyConfig,
+	verifier auth.Verifier,
 	logger log.Logger,
+	opts ...Option,
 ) *HTTPProxy {
+	options := options{
+		endpointResolver: NewDefaultEndpointResolverWithBaseDomain(conf.BaseDomain),
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	rp := &HTTPProxy{
-		upstreams: upstreams,
-		timeout:   timeout,
-		logger:    logger.WithSubsystem("proxy.http"),
+		upstreams:  upstreams,
+		timeout:    conf.Timeout,
+		maxTimeout: conf.MaxTimeout,
+		sticky:     conf.Sticky,
+
+		trustForwardedHeaders: conf.TrustForwardedHeaders,
+
+		maxRequestBodyBytes:  conf.MaxRequestBodyBytes,
+		maxResponseBodyBytes: conf.MaxResponseBodyBytes,
+		endpoints:            conf.Endpoints,
+
+		rateLimiter: newRateLimiter(conf.RateLimit, conf.Endpoints),
+		concurrencyLimiter: newConcurrencyLimiter(
+			conf.ConcurrencyLimit, conf.Endpoints,
+		),
+		nodeTransport: newNodeTransport(conf.Forward),
+		cors:          newCORSPolicy(conf.CORS),
+		endpointCORS:  newEndpointCORSPolicies(conf.CORS, conf.Endpoints),
+
+		compression: newCompressionPolicy(conf.Compression),
+		endpointCompression: newEndpointCompressionPolicies(
+			conf.Compression, conf.Endpoints,
+		),
+
+		verifier:       verifier,
+		resolver:       options.endpointResolver,
+		endpointAccess: options.endpointAccess,
+		forwardKey:     options.forwardKey,
+		errorResponses: newErrorResponses(conf.ErrorResponses),
+		inflight:       newInflightRegistry(),
+		metrics:        NewMetrics(conf.Metrics),
+		tracer:         tracing.Tracer(options.tracerProvider),
+
+		logger: logger.WithSubsystem("proxy.http"),
+	}
+
+	// Retries and hedged requests share a budget.
+	budget := newRetryBudget(conf.Retry, rp.metrics)
+
+	// Hedge requests forwarded to other nodes if enabled.
+	var nodeTransport http.RoundTripper = rp.nodeTransport
+	if conf.Hedge.Delay > 0 {
+		nodeTransport = &hedgeTransport{
+			transport: rp.nodeTransport,
+			delay:     conf.Hedge.Delay,
+			budget:    budget,
+			metrics:   rp.metrics,
+			logger:    rp.logger,
+		}
 	}
 
 	rp.proxy = &httputil.ReverseProxy{
@@ -51,88 +197,824 @@ func NewHTTPProxy(
 			req.URL.Scheme = "http"
 			req.URL.Host = req.Context().Value(endpointContextKey).(string)
 		},
-		Transport: &http.Transport{
-			DialContext: rp.dialUpstream,
-			// 'connections' to the upstream are multiplexed over a single TCP
-			// connection so theres no overhead to creating new connections,
-			// therefore it doesn't make sense to keep them alive.
-			DisableKeepAlives: true,
+		Transport: &retryTransport{
+			transport: &protocolTransport{
+				http1: &http.Transport{
+					DialContext: rp.dialUpstream,
+					// 'connections' to the upstream are multiplexed over a
+					// single TCP connection so theres no overhead to creating
+					// new connections, therefore it doesn't make sense to
+					// keep them alive.
+					DisableKeepAlives: true,
+				},
+				http2: newUpstreamHTTP2Transport(rp.dialUpstream),
+			},
+			nodeTransport: nodeTransport,
+			maxAttempts:   conf.Retry.MaxAttempts,
+			allMethods:    conf.Retry.AllMethods,
+			budget:        budget,
+			logger:        rp.logger,
 		},
-		ErrorLog:     logger.StdLogger(zapcore.WarnLevel),
-		ErrorHandler: rp.errorHandler,
+		ModifyResponse: rp.modifyResponse,
+		ErrorLog:       logger.StdLogger(zapcore.WarnLevel),
+		ErrorHandler:   rp.errorHandler,
 	}
 
 	return rp
 }
 
 func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	endpointID := EndpointIDFromRequest(r)
+	start := time.Now()
+
+	// Use the request ID to correlate logs for the request, and echo the ID
+	// to the client.
+	requestID := ensureRequestID(r)
+	w.Header().Set(requestIDHeader, requestID)
+	logger := requestLogger(p.logger, r)
+
+	// Whether the request was forwarded from another Piko node. Requests
+	// that claim to be forwarded without the nodes forward key are handled
+	// as client requests, so the internal forwarding headers are removed.
+	forwarded := p.isForwarded(r)
+	if !forwarded && r.Header.Get(forwardHeader) != "" {
+		r.Header.Del(forwardHeader)
+		r.Header.Del(endpointHeader)
+	}
+	if !forwarded {
+		r.Header.Del(stickyKeyHeader)
+	}
+
+	var endpointID string
+	if forwarded {
+		// Requests forwarded from another node have already been resolved
+		// by that node, which sets the endpoint ID header.
+		endpointID = r.Header.Get(endpointHeader)
+	}
 	if endpointID == "" {
-		p.logger.Warn("request missing endpoint id")
+		endpointID = p.resolver.Resolve(r)
+	}
+	// The endpoint may contain an ordered list of endpoint IDs, where the
+	// request is forwarded to the first endpoint with an available upstream.
+	endpointIDs := splitEndpointIDs(endpointID)
+	if len(endpointIDs) == 0 {
+		logger.Warn("request missing endpoint id")
 
-		_ = errorResponse(w, http.StatusBadRequest, "missing endpoint id")
+		p.proxyError(w, r, http.StatusBadRequest, ErrMissingEndpointID)
 		return
 	}
+	endpointID = endpointIDs[0]
+
+	for _, id := range endpointIDs {
+		if !p.endpointAccess.Permitted(id) {
+			logger.Warn(
+				"endpoint not permitted on node",
+				zap.String("endpoint-id", id),
+			)
 
-	// Whether the request was forwarded from another Piko node.
-	forwarded := r.Header.Get("x-piko-forward") == "true"
+			p.proxyError(w, r, http.StatusForbidden, ErrEndpointNotPermitted)
+			return
+		}
+	}
+
+	// When given fallback endpoints, the upstream is selected before
+	// handling the request so the request is handled as if it were sent to
+	// the selected endpoint. If none of the endpoints have an available
+	// upstream, the request is handled as the first endpoint.
+	var upstream upstream.Upstream
+	var ok bool
+	key, newKey := p.stickyKey(r, forwarded)
+	if len(endpointIDs) > 1 {
+		for _, id := range endpointIDs {
+			upstream, ok = p.selectUpstream(id, key, forwarded)
+			if ok {
+				endpointID = id
+				break
+			}
+		}
+	}
+
+	r = r.WithContext(requestmeta.NewContext(
+		r.Context(), p.requestMetadata(r, endpointID, forwarded),
+	))
+
+	// If the request includes a trace context, such as when forwarded from
+	// another node, the span is added as a child.
+	ctx, span := p.tracer.Start(
+		tracing.Extract(r.Context(), r.Header),
+		"proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.AttributeEndpointID.String(endpointID)),
+	)
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	// Requests forwarded from another node have already been authenticated
+	// and limited by that node, and the node adds any CORS headers. Since
+	// forwarded requests are verified using the forward key, clients can't
+	// skip these checks by claiming the request was forwarded.
+	if !forwarded {
+		// Answer preflight requests before authenticating, since browsers
+		// don't include credentials in preflight requests.
+		if cors := p.corsPolicy(endpointID); cors != nil {
+			if isPreflight(r) {
+				cors.Preflight(w, r)
+				return
+			}
+			cors.SetHeaders(w, r)
+		}
+
+		// The client must be permitted to access every endpoint, so
+		// clients can't discover whether endpoints they aren't permitted
+		// to access have available upstreams.
+		for _, id := range endpointIDs {
+			if !p.authenticate(w, r, id) {
+				return
+			}
+		}
+
+		ok, retryAfter := p.rateLimiter.Allow(endpointID, p.clientIP(r))
+		if !ok {
+			logger.Debug(
+				"rate limited",
+				zap.String("endpoint-id", endpointID),
+			)
+			p.metrics.RateLimitedRequestsTotal.With(prometheus.Labels{
+				"endpoint_id": p.metrics.EndpointLabel(endpointID),
+			}).Inc()
+
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			p.writeError(w, r, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+
+		// Hold the slot until the request completes, including when the
+		// request fails or times out.
+		release, ok := p.concurrencyLimiter.Acquire(r.Context(), endpointID)
+		if !ok {
+			logger.Debug(
+				"concurrency limited",
+				zap.String("endpoint-id", endpointID),
+			)
+			p.metrics.ConcurrencyLimitedRequestsTotal.With(prometheus.Labels{
+				"endpoint_id": p.metrics.EndpointLabel(endpointID),
+			}).Inc()
+
+			w.Header().Set("Retry-After", "1")
+			p.writeError(
+				w, r, http.StatusServiceUnavailable, "too many concurrent requests",
+			)
+			return
+		}
+		defer release()
+
+		concurrent := p.metrics.ConcurrentRequests.With(prometheus.Labels{
+			"endpoint_id": p.metrics.EndpointLabel(endpointID),
+		})
+		concurrent.Inc()
+		defer concurrent.Dec()
+	}
 
 	// If there is a connected upstream, attempt to forward the request to one
 	// of those upstreams. Note this includes remote nodes that are reporting
 	// they have an available upstream. We don't allow multiple hops, so if
 	// forwarded is true we only select from local nodes.
-	upstream, ok := p.upstreams.Select(endpointID, !forwarded)
+	if len(endpointIDs) == 1 {
+		upstream, ok = p.selectUpstream(endpointID, key, forwarded)
+	}
 	if !ok {
-		p.logger.Warn(
+		logger.Warn(
 			"no available upstreams",
-			zap.String("endpoint-id", endpointID),
+			zap.Strings("endpoint-ids", endpointIDs),
 		)
 
-		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+		span.SetStatus(codes.Error, "no available upstreams")
+		p.proxyError(w, r, http.StatusBadGateway, ErrEndpointNotFound)
+		p.observeRequest(endpointID, resultError, start)
 		return
 	}
 
+	// If the session key was generated for this request, the cookie is
+	// only set once a local upstream is selected. When forwarding to
+	// another node, the key is passed to that node instead so it selects
+	// its upstream using the same key and sets the cookie itself.
+	if newKey {
+		if upstream.Forward() {
+			r.Header.Set(stickyKeyHeader, key)
+		} else {
+			p.setStickyCookie(w, r, key)
+		}
+	}
+
 	p.ServeHTTPWithUpstream(w, r, endpointID, upstream)
 }
 
+// selectUpstream selects an upstream for the endpoint. If the sticky key is
+// set, requests with the same key are routed to the same upstream.
+func (p *HTTPProxy) selectUpstream(
+	endpointID string,
+	key string,
+	forwarded bool,
+) (upstream.Upstream, bool) {
+	if key != "" {
+		return p.upstreams.SelectSticky(endpointID, key, !forwarded)
+	}
+	return p.upstreams.Select(endpointID, !forwarded)
+}
+
+// Forward proxies the request to the endpoint and returns the response.
+//
+// Unlike ServeHTTP, if proxying the request fails Forward also returns an
+// error describing the failure, which wraps one of ErrMissingEndpointID,
+// ErrEndpointNotPermitted, ErrEndpointNotFound, ErrEndpointUnreachable or
+// ErrEndpointTimeout. This lets callers handle failures programmatically,
+// such as rendering custom error pages.
+//
+// The returned response is always non-nil and contains the response
+// ServeHTTP would have written, including error responses. Requests
+// rejected before being proxied, such as by authentication or rate
+// limiting, return the error response with a nil error.
+//
+// The response is buffered in memory, so Forward doesn't support protocol
+// upgrades or long lived streaming responses.
+func (p *HTTPProxy) Forward(
+	ctx context.Context,
+	r *http.Request,
+) (*http.Response, error) {
+	state := &forwardState{}
+	r = r.WithContext(context.WithValue(ctx, forwardStateContextKey, state))
+
+	w := newResponseBuffer()
+	p.ServeHTTP(w, r)
+	return w.Response(r), state.err
+}
+
+// corsPolicy returns the CORS policy for the given endpoint. If CORS is
+// disabled for the endpoint, returns nil.
+func (p *HTTPProxy) corsPolicy(endpointID string) *corsPolicy {
+	if policy, ok := p.endpointCORS[endpointID]; ok {
+		return policy
+	}
+	return p.cors
+}
+
+// compressionPolicy returns the compression policy for the given endpoint. If
+// compression is disabled for the endpoint, returns nil.
+func (p *HTTPProxy) compressionPolicy(endpointID string) *compressionPolicy {
+	if policy, ok := p.endpointCompression[endpointID]; ok {
+		return policy
+	}
+	return p.compression
+}
+
+// EvictNode closes any idle connections to the node with the given ID, such
+// as when the node leaves the cluster.
+func (p *HTTPProxy) EvictNode(nodeID string) {
+	p.nodeTransport.Evict(nodeID)
+}
+
+func (p *HTTPProxy) Metrics() *Metrics {
+	return p.metrics
+}
+
+// Inflight returns a snapshot of the requests currently being proxied.
+func (p *HTTPProxy) Inflight() InflightStatus {
+	return p.inflight.Snapshot()
+}
+
 func (p *HTTPProxy) ServeHTTPWithUpstream(
 	w http.ResponseWriter,
 	r *http.Request,
 	endpointID string,
 	upstream upstream.Upstream,
 ) {
-	if p.timeout != 0 {
-		ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
-		defer cancel()
+	start := time.Now()
 
+	logger := requestLogger(p.logger, r)
+
+	// Record the request latency once the request completes. The result is
+	// only updated once the request is proxied without error.
+	result := resultError
+	defer func() {
+		p.observeRequest(endpointID, result, start)
+	}()
+
+	inflight := &InflightRequest{
+		EndpointID: endpointID,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Remote:     upstream.Forward(),
+		StartedAt:  start,
+	}
+	if u, ok := upstream.(interface{ Addr() string }); ok {
+		inflight.UpstreamAddr = u.Addr()
+	}
+	defer p.inflight.Add(inflight)()
+
+	timeout, err := p.requestTimeout(r)
+	if err != nil {
+		logger.Warn(
+			"invalid timeout",
+			zap.String("endpoint-id", endpointID),
+			zap.Error(err),
+		)
+		p.writeError(w, r, http.StatusBadRequest, "invalid timeout")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if isUpgrade(r) {
+		// The connection is hijacked on upgrade, so clear the servers
+		// read and write deadlines to avoid closing the connection.
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+	}
+	r = r.WithContext(context.WithValue(r.Context(), responseControllerContextKey, rc))
+
+	if timeout != 0 {
+		// Apply the timeout using a timer rather than a context deadline, so
+		// the timer can be stopped when the upstream responds for upgrades
+		// and streaming responses, which may be long lived.
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+
+		timer := time.AfterFunc(timeout, func() {
+			cancel(context.DeadlineExceeded)
+		})
+		defer timer.Stop()
+
+		ctx = context.WithValue(ctx, timeoutTimerContextKey, timer)
 		r = r.WithContext(ctx)
 	}
 
-	r.Header.Set("x-piko-forward", "true")
+	limit := p.maxRequestBodyBytes
+	if override, ok := p.endpoints[endpointID]; ok && override.MaxRequestBodyBytes > 0 {
+		limit = override.MaxRequestBodyBytes
+	}
+	if limit > 0 {
+		if r.ContentLength > limit {
+			logger.Warn(
+				"request body too large",
+				zap.String("endpoint-id", endpointID),
+				zap.Int64("content-length", r.ContentLength),
+				zap.Int64("limit", limit),
+			)
+			p.writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		// If the content length is unknown, limit the body as it is read.
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+	}
+
+	meta, ok := requestmeta.FromContext(r.Context())
+	if !ok {
+		meta = p.requestMetadata(r, endpointID, p.isForwarded(r))
+		r = r.WithContext(requestmeta.NewContext(r.Context(), meta))
+	}
+
+	// Requests forwarded from another node have already had their
+	// forwarding headers checked, so are trusted.
+	setForwardedHeaders(r, p.trustForwardedHeaders || meta.Forwarded)
+
+	if upstream.Forward() {
+		// The node transport adds the forward key of the node the request
+		// is sent to.
+		r.Header.Del(forwardHeader)
+		r.Header.Set(endpointHeader, endpointID)
+		// Propagate the timeout so the remote node applies the same
+		// timeout to the upstream.
+		if timeout != 0 {
+			r.Header.Set("x-piko-timeout", timeout.String())
+		}
+	} else {
+		// Strip internal headers before forwarding to the upstream.
+		stripPikoHeaders(r.Header)
+	}
+	// Propagate the metadata to the remote node or agent. The agent strips
+	// the metadata headers before forwarding to the upstream.
+	requestmeta.Inject(meta, r.Header)
+
+	// Propagate the trace context so the remote node or agent adds its span
+	// as a child.
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(tracing.AttributeForward.Bool(upstream.Forward()))
+	if u, ok := upstream.(interface{ NodeID() string }); ok {
+		span.SetAttributes(tracing.AttributeNodeID.String(u.NodeID()))
+	}
+	tracing.Inject(r.Context(), r.Header)
 
 	r = r.WithContext(context.WithValue(r.Context(), endpointContextKey, endpointID))
 
+	if p.endpoints[endpointID].HTTP2 {
+		r = r.WithContext(context.WithValue(r.Context(), http2ContextKey, true))
+	}
+
 	// Add the upstream to the context to pass to 'DialContext'.
 	r = r.WithContext(context.WithValue(r.Context(), upstreamContextKey, upstream))
 
+	state := &requestState{}
+	r = r.WithContext(context.WithValue(r.Context(), requestStateContextKey, state))
+
 	p.proxy.ServeHTTP(w, r)
+
+	if !state.failed {
+		if upstream.Forward() {
+			result = resultRemote
+		} else {
+			result = resultLocal
+		}
+	}
+}
+
+func (p *HTTPProxy) observeRequest(endpointID string, result string, start time.Time) {
+	p.metrics.RequestLatency.With(prometheus.Labels{
+		"endpoint_id": p.metrics.EndpointLabel(endpointID),
+		"result":      result,
+	}).Observe(time.Since(start).Seconds())
+}
+
+// requestTimeout returns the timeout to forward the request.
+//
+// Requests may override the configured timeout with the 'x-piko-timeout'
+// header, which is clamped to the maximum timeout.
+func (p *HTTPProxy) requestTimeout(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("x-piko-timeout")
+	if header == "" {
+		return p.timeout, nil
+	}
+
+	timeout, err := time.ParseDuration(header)
+	if err != nil {
+		return 0, fmt.Errorf("parse timeout: %w", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+
+	maxTimeout := p.maxTimeout
+	if maxTimeout == 0 {
+		maxTimeout = p.timeout
+	}
+	if maxTimeout != 0 && timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return timeout, nil
+}
+
+// stickyKey returns the session key used to route the request to the same
+// upstream, or an empty string if sticky sessions are disabled.
+//
+// When using a cookie and the request doesn't include a session key, this
+// generates a new key and returns true, so the caller sets the cookie once
+// an upstream is selected. Requests forwarded from another node use the key
+// generated by that node.
+func (p *HTTPProxy) stickyKey(r *http.Request, forwarded bool) (string, bool) {
+	if !p.sticky.Enabled {
+		return "", false
+	}
+
+	if p.sticky.Header != "" {
+		return r.Header.Get(p.sticky.Header), false
+	}
+
+	cookie, err := r.Cookie(p.sticky.Cookie)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value, false
+	}
+
+	if forwarded {
+		if key := r.Header.Get(stickyKeyHeader); key != "" {
+			return key, true
+		}
+	}
+	return uuid.New().String(), true
+}
+
+// setStickyCookie sets the session key cookie on the response. The cookie is
+// only sent over HTTPS if the client connected using TLS.
+func (p *HTTPProxy) setStickyCookie(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+) {
+	meta, _ := requestmeta.FromContext(r.Context())
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.sticky.Cookie,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   meta.ClientTLS,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requestMetadata returns the metadata of the request.
+//
+// Requests forwarded from another node use the client metadata from that
+// node, so the metadata describes the original client rather than the
+// forwarding node.
+func (p *HTTPProxy) requestMetadata(
+	r *http.Request,
+	endpointID string,
+	forwarded bool,
+) requestmeta.Metadata {
+	meta := requestmeta.Metadata{
+		ClientIP:  p.clientIP(r),
+		ClientTLS: r.TLS != nil,
+	}
+	if forwarded {
+		if remote, ok := requestmeta.Extract(r.Header); ok {
+			meta.ClientIP = remote.ClientIP
+			meta.ClientTLS = remote.ClientTLS
+		}
+	}
+	meta.EndpointID = endpointID
+	meta.Forwarded = forwarded
+	meta.RequestID = r.Header.Get(requestIDHeader)
+	return meta
+}
+
+// isForwarded returns whether the request was forwarded from another node,
+// which must include this nodes forward key in the 'x-piko-forward' header.
+func (p *HTTPProxy) isForwarded(r *http.Request) bool {
+	if p.forwardKey == "" {
+		return false
+	}
+	key := r.Header.Get(forwardHeader)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(p.forwardKey)) == 1
+}
+
+// clientIP returns the IP of the client that sent the request.
+//
+// If forwarding headers are trusted, this is the first address in
+// 'X-Forwarded-For'.
+func (p *HTTPProxy) clientIP(r *http.Request) string {
+	if p.trustForwardedHeaders {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
 }
 
 func (p *HTTPProxy) dialUpstream(ctx context.Context, _, _ string) (net.Conn, error) {
 	// As a bit of a hack to work with http.Transport, we add the upstream
 	// to the dial context.
 	upstream := ctx.Value(upstreamContextKey).(upstream.Upstream)
-	return upstream.Dial()
+	conn, err := upstream.Dial()
+	if err != nil {
+		return nil, &dialError{err: err}
+	}
+	// Only count bytes exchanged with local upstreams, since requests
+	// forwarded to another node are counted by that node.
+	if !upstream.Forward() {
+		endpointID, _ := ctx.Value(endpointContextKey).(string)
+		conn = p.metrics.countBytes(conn, endpointID)
+	}
+	return conn, nil
 }
 
-func (p *HTTPProxy) errorHandler(w http.ResponseWriter, _ *http.Request, err error) {
-	p.logger.Warn("proxy request", zap.Error(err))
+// modifyResponse stops the timeout for upgrades, streaming responses and
+// responses of unknown length, removes headers set by the proxy, enforces the
+// maximum response body size and compresses the response.
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	if resp.StatusCode == http.StatusSwitchingProtocols || stream.IsUnbounded(resp) {
+		// Only apply the timeout until the upstream responds rather than
+		// the lifetime of the connection or stream. Responses of unknown
+		// length, such as chunked responses, may also be long lived.
+		if timer, ok := ctx.Value(timeoutTimerContextKey).(*time.Timer); ok {
+			timer.Stop()
+		}
+	}
+	if stream.IsStreaming(resp) {
+		// Clear the servers write deadline to avoid closing long lived
+		// streams.
+		if rc, ok := ctx.Value(responseControllerContextKey).(*http.ResponseController); ok {
+			_ = rc.SetWriteDeadline(time.Time{})
+		}
+	}
+
+	// The proxy sets the request ID response header, so ignore the request ID
+	// returned by the upstream to avoid duplicate headers.
+	if resp.Request.Header.Get(requestIDHeader) != "" {
+		resp.Header.Del(requestIDHeader)
+	}
+
+	// Internal headers must not be returned to the client. Note hop-by-hop
+	// headers, such as 'Connection' and 'Keep-Alive', and any headers listed
+	// in 'Connection', are already removed by httputil.ReverseProxy in both
+	// directions.
+	stripPikoHeaders(resp.Header)
+
+	endpointID, _ := ctx.Value(endpointContextKey).(string)
+
+	// When CORS is enabled the proxy sets the CORS headers, so ignore any
+	// CORS headers returned by the upstream.
+	if p.corsPolicy(endpointID) != nil {
+		removeCORSHeaders(resp.Header)
+	}
 
-	if errors.Is(err, context.DeadlineExceeded) {
-		_ = errorResponse(w, http.StatusGatewayTimeout, "upstream timeout")
+	if err := p.limitResponseBody(resp, endpointID); err != nil {
+		return err
+	}
+
+	// Compress after limiting the body so the limit applies to the
+	// uncompressed upstream response.
+	if compression := p.compressionPolicy(endpointID); compression != nil {
+		compression.Compress(resp)
+	}
+	return nil
+}
+
+// limitResponseBody enforces the maximum response body size.
+func (p *HTTPProxy) limitResponseBody(resp *http.Response, endpointID string) error {
+	limit := p.maxResponseBodyBytes
+	if override, ok := p.endpoints[endpointID]; ok && override.MaxResponseBodyBytes > 0 {
+		limit = override.MaxResponseBodyBytes
+	}
+	// Upgraded connections and streams are not limited.
+	if limit == 0 || resp.StatusCode == http.StatusSwitchingProtocols || stream.IsStreaming(resp) {
+		return nil
+	}
+
+	if resp.ContentLength > limit {
+		return &responseTooLargeError{limit: limit}
+	}
+	// If the content length is unknown, abort the response once the limit
+	// is exceeded.
+	resp.Body = &limitedReadCloser{
+		ReadCloser: resp.Body,
+		limit:      limit,
+		remaining:  limit,
+	}
+	return nil
+}
+
+func (p *HTTPProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(p.logger, r).Warn("proxy request", zap.Error(err))
+
+	if state, ok := r.Context().Value(requestStateContextKey).(*requestState); ok {
+		state.failed = true
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "proxy request")
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p.writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	var responseTooLargeErr *responseTooLargeError
+	if errors.As(err, &responseTooLargeErr) {
+		p.writeError(w, r, http.StatusBadGateway, "upstream response too large")
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(context.Cause(r.Context()), context.DeadlineExceeded) {
+		p.proxyError(
+			w, r, http.StatusGatewayTimeout,
+			fmt.Errorf("%w: %w", ErrEndpointTimeout, err),
+		)
 		return
 	}
-	_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
+	p.proxyError(
+		w, r, http.StatusBadGateway,
+		fmt.Errorf("%w: %w", ErrEndpointUnreachable, err),
+	)
+}
+
+// proxyError writes an error response for one of the proxy errors, and
+// records the error if the request is proxied using Forward.
+//
+// The response message is the proxy error, such as 'upstream unreachable',
+// rather than including the underlying cause.
+func (p *HTTPProxy) proxyError(
+	w http.ResponseWriter,
+	r *http.Request,
+	statusCode int,
+	err error,
+) {
+	if state, ok := r.Context().Value(forwardStateContextKey).(*forwardState); ok {
+		state.err = err
+	}
+
+	message := err.Error()
+	for _, proxyErr := range []error{
+		ErrMissingEndpointID,
+		ErrEndpointNotPermitted,
+		ErrEndpointNotFound,
+		ErrEndpointUnreachable,
+		ErrEndpointTimeout,
+	} {
+		if errors.Is(err, proxyErr) {
+			message = proxyErr.Error()
+			break
+		}
+	}
+	p.writeError(w, r, statusCode, message)
+}
+
+// writeError writes an error response, using the configured error response
+// template for the status code if there is one.
+func (p *HTTPProxy) writeError(
+	w http.ResponseWriter,
+	r *http.Request,
+	statusCode int,
+	message string,
+) {
+	if !p.errorResponses.Enabled(statusCode) {
+		_ = errorResponse(w, statusCode, message)
+		return
+	}
+
+	data := errorResponseData{
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Message:    message,
+		RequestID:  w.Header().Get(requestIDHeader),
+	}
+	if data.RequestID == "" {
+		data.RequestID = r.Header.Get(requestIDHeader)
+	}
+	if meta, ok := requestmeta.FromContext(r.Context()); ok {
+		data.EndpointID = meta.EndpointID
+	} else {
+		// Errors may be returned before the endpoint is resolved, such as
+		// in maintenance mode.
+		data.EndpointID = p.resolver.Resolve(r)
+	}
+	p.errorResponses.Write(w, data)
+}
+
+// stripPikoHeaders removes all Piko internal 'x-piko-*' headers.
+func stripPikoHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(strings.ToLower(name), "x-piko-") {
+			h.Del(name)
+		}
+	}
+}
+
+// isUpgrade returns whether the request is a protocol upgrade, such as a
+// WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type responseTooLargeError struct {
+	limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("response body exceeds limit of %d bytes", e.limit)
+}
+
+// limitedReadCloser returns a responseTooLargeError once more than the
+// remaining bytes are read.
+type limitedReadCloser struct {
+	io.ReadCloser
+
+	limit     int64
+	remaining int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, &responseTooLargeError{limit: r.limit}
+	}
+	// Read one byte more than the limit to detect when it is exceeded.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n + int(r.remaining), &responseTooLargeError{limit: r.limit}
+	}
+	return n, err
 }
 
 type errorMessage struct {
@@ -140,36 +1022,19 @@ type errorMessage struct {
 }
 
 func errorResponse(w http.ResponseWriter, statusCode int, message string) error {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(statusCode)
-
 	m := &errorMessage{
 		Error: message,
 	}
-	return json.NewEncoder(w).Encode(m)
-}
-
-// EndpointIDFromRequest returns the endpoint ID from the HTTP request, or an
-// empty string if no endpoint ID is specified.
-//
-// This will check both the 'x-piko-endpoint' header and 'Host' header, where
-// x-piko-endpoint takes precedence.
-func EndpointIDFromRequest(r *http.Request) string {
-	endpointID := r.Header.Get("x-piko-endpoint")
-	if endpointID != "" {
-		return endpointID
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode error message: %w", err)
 	}
 
-	host := r.Host
-	if host != "" && strings.Contains(host, ".") {
-		// If a host is given and contains a separator, use the bottom-level
-		// domain as the endpoint ID.
-		//
-		// Such as if the domain is 'xyz.piko.example.com', then 'xyz' is the
-		// endpoint ID.
-		return strings.Split(host, ".")[0]
-	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
 
-	return ""
+	_, err = w.Write(b)
+	return err
 }
@@ -1,19 +1,40 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/atomic"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/requestmeta"
+	"github.com/andydunstall/piko/pkg/tracing"
+	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/cluster"
+	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
@@ -28,12 +49,41 @@ func (m *fakeManager) Select(
 	return m.handler(endpointID, allowForward)
 }
 
+func (m *fakeManager) SelectSticky(
+	endpointID string,
+	_ string,
+	allowForward bool,
+) (upstream.Upstream, bool) {
+	return m.handler(endpointID, allowForward)
+}
+
 func (m *fakeManager) AddConn(_ upstream.Upstream) {
 }
 
+func (m *fakeManager) DrainConn(_ upstream.Upstream) {
+}
+
+func (m *fakeManager) ResumeConn(_ upstream.Upstream) {
+}
+
 func (m *fakeManager) RemoveConn(_ upstream.Upstream) {
 }
 
+// stickyManager is a fake manager that only supports sticky selection.
+type stickyManager struct {
+	fakeManager
+
+	handler func(endpointID string, key string, allowForward bool) (upstream.Upstream, bool)
+}
+
+func (m *stickyManager) SelectSticky(
+	endpointID string,
+	key string,
+	allowForward bool,
+) (upstream.Upstream, bool) {
+	return m.handler(endpointID, key, allowForward)
+}
+
 type tcpUpstream struct {
 	addr    string
 	forward bool
@@ -51,6 +101,10 @@ func (u *tcpUpstream) Forward() bool {
 	return u.forward
 }
 
+func (u *tcpUpstream) Addr() string {
+	return u.addr
+}
+
 func TestHTTPProxy_Forward(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(
@@ -79,7 +133,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 					}, true
 				},
 			},
-			time.Second,
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -121,7 +176,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 					}, true
 				},
 			},
-			time.Millisecond,
+			config.ProxyConfig{Timeout: time.Millisecond},
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -152,7 +208,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 					}, true
 				},
 			},
-			time.Second,
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -181,7 +238,8 @@ func TestHTTPProxy_Forward(t *testing.T) {
 					return nil, false
 				},
 			},
-			time.Second,
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -210,13 +268,15 @@ func TestHTTPProxy_Forward(t *testing.T) {
 					return nil, false
 				},
 			},
-			time.Second,
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
 			log.NewNopLogger(),
+			WithForwardKey("my-key"),
 		)
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 		r.Header.Add("x-piko-endpoint", "my-endpoint")
-		r.Header.Add("x-piko-forward", "true")
+		r.Header.Add("x-piko-forward", "my-key")
 
 		w := httptest.NewRecorder()
 		proxy.ServeHTTP(w, r)
@@ -232,7 +292,12 @@ func TestHTTPProxy_Forward(t *testing.T) {
 	})
 
 	t.Run("missing endpoint id", func(t *testing.T) {
-		proxy := NewHTTPProxy(nil, time.Second, log.NewNopLogger())
+		proxy := NewHTTPProxy(
+			nil,
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
 
 		r := httptest.NewRequest(http.MethodGet, "/", nil)
 		// The host must have a '.' separator to be parsed as an endpoint ID.
@@ -252,30 +317,3636 @@ func TestHTTPProxy_Forward(t *testing.T) {
 	})
 }
 
-func TestEndpointIDFromRequest(t *testing.T) {
-	t.Run("host header", func(t *testing.T) {
-		endpointID := EndpointIDFromRequest(&http.Request{
-			Host: "my-endpoint.piko.com:9000",
-		})
-		assert.Equal(t, "my-endpoint", endpointID)
+func TestHTTPProxy_TimeoutOverride(t *testing.T) {
+	t.Run("short override", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				<-blockCh
+			},
+		))
+		defer server.Close()
+		defer close(blockCh)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Minute},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-timeout", "10ms")
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+		assert.Less(t, time.Since(start), time.Second*10)
+	})
+
+	t.Run("clamped to max", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				<-blockCh
+			},
+		))
+		defer server.Close()
+		defer close(blockCh)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:    time.Millisecond,
+				MaxTimeout: time.Millisecond * 10,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-timeout", "1h")
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+		assert.Less(t, time.Since(start), time.Second*10)
+	})
+
+	t.Run("header stripped", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "", r.Header.Get("x-piko-timeout"))
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-timeout", "500ms")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	// Tests the timeout is propagated when the request is forwarded to
+	// another node.
+	t.Run("forwarded", func(t *testing.T) {
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "", r.Header.Get("x-piko-timeout"))
+				<-r.Context().Done()
+			},
+		))
+		defer upstreamServer.Close()
+
+		// Node 2 has a local upstream for the endpoint, which never
+		// responds.
+		node2Proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Minute},
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("my-key"),
+		)
+		timeoutCh := make(chan string, 1)
+		node2 := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				timeoutCh <- r.Header.Get("x-piko-timeout")
+				node2Proxy.ServeHTTP(w, r)
+			},
+		))
+		defer node2.Close()
+
+		// Node 1 forwards the request to node 2.
+		node1 := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream("my-endpoint", &cluster.Node{
+						ID:         "node-2",
+						ProxyAddr:  node2.Listener.Addr().String(),
+						ForwardKey: "my-key",
+					}), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:    time.Minute,
+				MaxTimeout: time.Minute,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-timeout", "50ms")
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		node1.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+		assert.Less(t, time.Since(start), time.Second*10)
+		assert.Equal(t, "50ms", <-timeoutCh)
 	})
 
-	t.Run("x-piko-endpoint header", func(t *testing.T) {
+	t.Run("invalid", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-timeout", "foo")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "invalid timeout", m.Error)
+	})
+}
+
+func TestHTTPProxy_WebSocket(t *testing.T) {
+	t.Run("timeout only applies to handshake", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				assert.NoError(t, err)
+				defer c.Close()
+
+				for {
+					mt, message, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					assert.NoError(t, c.WriteMessage(mt, message))
+				}
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Millisecond * 50,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
 		header := make(http.Header)
 		header.Add("x-piko-endpoint", "my-endpoint")
-		endpointID := EndpointIDFromRequest(&http.Request{
-			// Even though the host header is provided, 'x-piko-endpoint'
-			// takes precedence.
-			Host:   "another-endpoint.piko.com:9000",
-			Header: header,
-		})
-		assert.Equal(t, "my-endpoint", endpointID)
+		c, _, err := websocket.DefaultDialer.Dial(
+			"ws://"+proxyServer.Listener.Addr().String(), header,
+		)
+		assert.NoError(t, err)
+		defer c.Close()
+
+		for i := 0; i != 3; i++ {
+			assert.NoError(t, c.WriteMessage(websocket.TextMessage, []byte("echo")))
+
+			_, message, err := c.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("echo"), message)
+
+			// Wait longer than the proxy timeout.
+			<-time.After(time.Millisecond * 60)
+		}
 	})
 
-	t.Run("no endpoint", func(t *testing.T) {
-		endpointID := EndpointIDFromRequest(&http.Request{
-			Host: "localhost:9000",
-		})
-		assert.Equal(t, "", endpointID)
+	t.Run("handshake timeout", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				<-blockCh
+			},
+		))
+		defer server.Close()
+		defer close(blockCh)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Millisecond,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Connection", "Upgrade")
+		r.Header.Add("Upgrade", "websocket")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Result().StatusCode)
+	})
+}
+
+func TestHTTPProxy_Streaming(t *testing.T) {
+	// Tests the timeout only applies until the upstream responds for
+	// streaming responses.
+	t.Run("timeout only applies to response headers", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				for i := 0; i != 3; i++ {
+					<-time.After(time.Millisecond * 20)
+					// nolint
+					w.Write([]byte("data: foo\n\n"))
+					w.(http.Flusher).Flush()
+				}
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Millisecond * 20},
+			nil,
+			log.NewNopLogger(),
+		)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("data: foo\n\n", 3), string(b))
+	})
+
+	// Tests the timeout only applies until the upstream responds for
+	// responses of unknown length.
+	t.Run("chunked response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				for i := 0; i != 3; i++ {
+					<-time.After(time.Millisecond * 20)
+					// nolint
+					w.Write([]byte("{}\n"))
+					w.(http.Flusher).Flush()
+				}
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Millisecond * 20},
+			nil,
+			log.NewNopLogger(),
+		)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("{}\n", 3), string(b))
 	})
 }
+
+func TestHTTPProxy_HTTP2(t *testing.T) {
+	t.Run("trailers", func(t *testing.T) {
+		server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, 2, r.ProtoMajor)
+
+				w.Header().Set("Content-Type", "application/grpc")
+				w.WriteHeader(http.StatusOK)
+				// nolint
+				w.Write([]byte("foo"))
+				w.(http.Flusher).Flush()
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			},
+		), &http2.Server{}))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Endpoints: map[string]config.EndpointConfig{
+					"my-endpoint": {
+						HTTP2: true,
+					},
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, proxyServer.URL, nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", string(b))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("http1 endpoint", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, 1, r.ProtoMajor)
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
+func TestHTTPProxy_BodyLimits(t *testing.T) {
+	t.Run("request too large", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				t.Error("request should not be forwarded")
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:             time.Second,
+				MaxRequestBodyBytes: 4,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foobar")))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "request body too large", m.Error)
+	})
+
+	t.Run("request too large unknown length", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				// nolint
+				io.Copy(io.Discard, r.Body)
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:             time.Second,
+				MaxRequestBodyBytes: 4,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foobar")))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.ContentLength = -1
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+	})
+
+	t.Run("endpoint override", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:             time.Second,
+				MaxRequestBodyBytes: 4,
+				Endpoints: map[string]config.EndpointConfig{
+					"my-endpoint": {
+						MaxRequestBodyBytes: 10,
+					},
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foobar")))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	// Tests an endpoint can set a limit when there is no global limit.
+	t.Run("endpoint override no global limit", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Endpoints: map[string]config.EndpointConfig{
+					"my-endpoint": {
+						MaxRequestBodyBytes: 4,
+					},
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foobar")))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+
+		// Other endpoints aren't limited.
+		r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foobar")))
+		r.Header.Add("x-piko-endpoint", "other-endpoint")
+
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("response too large", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("foobar"))
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:              time.Second,
+				MaxResponseBodyBytes: 4,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "upstream response too large", m.Error)
+	})
+
+	t.Run("response too large unknown length", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// Flush to use chunked encoding with an unknown length.
+				// nolint
+				w.Write([]byte("foo"))
+				w.(http.Flusher).Flush()
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:              time.Second,
+				MaxResponseBodyBytes: 4,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		// The response is aborted after the limit.
+		assert.LessOrEqual(t, w.Body.Len(), 4)
+	})
+}
+
+func TestHTTPProxy_Retry(t *testing.T) {
+	t.Run("alternative node", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// Forwarded requests include the forward key of the node
+				// the request is retried with.
+				assert.Equal(t, "node-2-key", r.Header.Get("x-piko-forward"))
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{
+							ID:         "node-1",
+							ProxyAddr:  "localhost:55555",
+							ForwardKey: "node-1-key",
+						},
+						&cluster.Node{
+							ID:         "node-2",
+							ProxyAddr:  server.Listener.Addr().String(),
+							ForwardKey: "node-2-key",
+						},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Retry: config.RetryConfig{
+					MaxAttempts: 3,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("foo")))
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "bar", buf.String())
+	})
+
+	// Tests a request with a body is retried, since the body isn't read
+	// when the connection to the first node is refused.
+	t.Run("alternative node with body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				// nolint
+				w.Write(b)
+			},
+		))
+		defer server.Close()
+
+		// Refuse connections to the first node.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		refusedAddr := ln.Addr().String()
+		ln.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: refusedAddr},
+						&cluster.Node{ID: "node-2", ProxyAddr: server.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Retry: config.RetryConfig{
+					MaxAttempts: 3,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+		// Use a server rather than calling the proxy directly, so the
+		// request body is closed like any other server request.
+		proxyServer := httptest.NewServer(proxy)
+		defer proxyServer.Close()
+
+		req, err := http.NewRequest(
+			http.MethodPost, proxyServer.URL, strings.NewReader("foo"),
+		)
+		require.NoError(t, err)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(b))
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: "localhost:55555"},
+						&cluster.Node{ID: "node-2", ProxyAddr: "localhost:55556"},
+						&cluster.Node{ID: "node-3", ProxyAddr: server.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Retry: config.RetryConfig{
+					MaxAttempts: 2,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	})
+
+	t.Run("budget exhausted", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: "localhost:55555"},
+						&cluster.Node{ID: "node-2", ProxyAddr: server.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Retry: config.RetryConfig{
+					MaxAttempts: 2,
+					// Allow one retry for every two requests.
+					BudgetRatio: 0.5,
+					BudgetBurst: 1,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		forward := func() int {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			return w.Result().StatusCode
+		}
+
+		// The first request is retried within the budget, which exhausts
+		// the budget.
+		assert.Equal(t, http.StatusOK, forward())
+		assert.Equal(t, 1.0, testutil.ToFloat64(proxy.Metrics().RetryBudgetUtilization))
+
+		// The second request fails without retrying.
+		assert.Equal(t, http.StatusBadGateway, forward())
+		assert.Equal(t, 1.0, testutil.ToFloat64(proxy.Metrics().RetryBudgetExhaustedTotal))
+
+		// The third request is retried once the budget is replenished.
+		assert.Equal(t, http.StatusOK, forward())
+	})
+
+	t.Run("no retry on response", func(t *testing.T) {
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				requests++
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+						&cluster.Node{ID: "node-2", ProxyAddr: server.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Retry: config.RetryConfig{
+					MaxAttempts: 3,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+		assert.Equal(t, 1, requests)
+	})
+}
+
+func TestHTTPProxy_Hedge(t *testing.T) {
+	t.Run("slow node", func(t *testing.T) {
+		// The primary node stalls until the request is cancelled.
+		slowCancelled := make(chan struct{})
+		slowServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				close(slowCancelled)
+				// nolint
+				w.Write([]byte("slow"))
+			},
+		))
+		defer slowServer.Close()
+
+		fastServer := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("fast"))
+			},
+		))
+		defer fastServer.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: slowServer.Listener.Addr().String()},
+						&cluster.Node{ID: "node-2", ProxyAddr: fastServer.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second * 5,
+				Retry: config.RetryConfig{
+					MaxAttempts: 1,
+				},
+				Hedge: config.HedgeConfig{
+					Delay: time.Millisecond * 10,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "fast", buf.String())
+
+		// The slow request must be cancelled and its response discarded.
+		select {
+		case <-slowCancelled:
+		case <-time.After(time.Second):
+			t.Fatal("slow request not cancelled")
+		}
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.Metrics().HedgedRequestsTotal.WithLabelValues("my-endpoint"),
+		))
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.Metrics().HedgedWinsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("fast node", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer server.Close()
+
+		var hedged atomic.Bool
+		alternativeServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				hedged.Store(true)
+			},
+		))
+		defer alternativeServer.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+						&cluster.Node{ID: "node-2", ProxyAddr: alternativeServer.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second * 5,
+				Retry: config.RetryConfig{
+					MaxAttempts: 1,
+				},
+				Hedge: config.HedgeConfig{
+					Delay: time.Second,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "bar", buf.String())
+
+		assert.False(t, hedged.Load())
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			proxy.Metrics().HedgedRequestsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("non-idempotent", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				<-time.After(time.Millisecond * 50)
+				// nolint
+				w.Write([]byte("bar"))
+			},
+		))
+		defer server.Close()
+
+		var hedged atomic.Bool
+		alternativeServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				hedged.Store(true)
+			},
+		))
+		defer alternativeServer.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream(
+						"my-endpoint",
+						&cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()},
+						&cluster.Node{ID: "node-2", ProxyAddr: alternativeServer.Listener.Addr().String()},
+					), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second * 5,
+				Retry: config.RetryConfig{
+					MaxAttempts: 1,
+				},
+				Hedge: config.HedgeConfig{
+					Delay: time.Millisecond,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		buf := new(strings.Builder)
+		// nolint
+		io.Copy(buf, resp.Body)
+		assert.Equal(t, "bar", buf.String())
+
+		assert.False(t, hedged.Load())
+	})
+}
+
+func TestHTTPProxy_ForwardConnReuse(t *testing.T) {
+	conns := atomic.NewInt64(0)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			// nolint
+			w.Write([]byte("bar"))
+		},
+	))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Inc()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	node := &cluster.Node{ID: "node-1", ProxyAddr: server.Listener.Addr().String()}
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				return upstream.NewNodeUpstream(endpointID, node), true
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			Retry: config.RetryConfig{
+				MaxAttempts: 1,
+			},
+			Forward: config.ForwardConfig{
+				MaxIdleConns: 2,
+				IdleTimeout:  time.Minute,
+			},
+		},
+		nil,
+		log.NewNopLogger(),
+	)
+
+	forward := func(endpointID string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", endpointID)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Successive requests to the same node reuse the connection, including
+	// requests to different endpoints.
+	forward("endpoint-1")
+	forward("endpoint-1")
+	forward("endpoint-2")
+	assert.Equal(t, int64(1), conns.Load())
+
+	// Once the node is evicted, a new connection is required.
+	proxy.EvictNode("node-1")
+	forward("endpoint-1")
+	assert.Equal(t, int64(2), conns.Load())
+}
+
+func TestHTTPProxy_Sticky(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer server.Close()
+
+	t.Run("header", func(t *testing.T) {
+		var selectedKey string
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, _ bool) (upstream.Upstream, bool) {
+					selectedKey = key
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Header:  "x-session-id",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-session-id", "my-session")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, "my-session", selectedKey)
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		var selectedKey string
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, _ bool) (upstream.Upstream, bool) {
+					selectedKey = key
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Cookie:  "piko-session",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.AddCookie(&http.Cookie{Name: "piko-session", Value: "my-session"})
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, "my-session", selectedKey)
+		// The cookie was already set so shouldn't be set again.
+		assert.Equal(t, 0, len(w.Result().Cookies()))
+	})
+
+	t.Run("cookie missing", func(t *testing.T) {
+		var selectedKey string
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, _ bool) (upstream.Upstream, bool) {
+					selectedKey = key
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Cookie:  "piko-session",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// A new session key should be generated and set as a cookie.
+		assert.NotEqual(t, "", selectedKey)
+		cookies := resp.Cookies()
+		assert.Equal(t, 1, len(cookies))
+		assert.Equal(t, "piko-session", cookies[0].Name)
+		assert.Equal(t, selectedKey, cookies[0].Value)
+		assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+		assert.False(t, cookies[0].Secure)
+	})
+
+	t.Run("cookie missing tls", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, _ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Cookie:  "piko-session",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		cookies := w.Result().Cookies()
+		assert.Equal(t, 1, len(cookies))
+		assert.True(t, cookies[0].Secure)
+	})
+
+	t.Run("cookie missing no upstream", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, _ string, _ bool) (upstream.Upstream, bool) {
+					return nil, false
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Cookie:  "piko-session",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		// The cookie isn't set if no upstream was selected.
+		assert.Equal(t, 0, len(resp.Cookies()))
+	})
+
+	t.Run("cookie missing forwarded", func(t *testing.T) {
+		stickyConf := config.StickyConfig{
+			Enabled: true,
+			Cookie:  "piko-session",
+		}
+
+		// node2 has a local upstream for the endpoint.
+		var node2Key string
+		node2 := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, allowForward bool) (upstream.Upstream, bool) {
+					assert.False(t, allowForward)
+					node2Key = key
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky:  stickyConf,
+			},
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("node-2-key"),
+		)
+		node2Server := httptest.NewServer(node2)
+		defer node2Server.Close()
+
+		// node1 forwards the request to node2.
+		var node1Key string
+		node1 := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, _ bool) (upstream.Upstream, bool) {
+					node1Key = key
+					return upstream.NewNodeUpstream("my-endpoint", &cluster.Node{
+						ID:         "node-2",
+						ProxyAddr:  node2Server.Listener.Addr().String(),
+						ForwardKey: "node-2-key",
+					}), true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky:  stickyConf,
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		node1.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// Both nodes use the same key, and only node2 sets the cookie.
+		assert.NotEqual(t, "", node1Key)
+		assert.Equal(t, node1Key, node2Key)
+		cookies := resp.Cookies()
+		assert.Equal(t, 1, len(cookies))
+		assert.Equal(t, node1Key, cookies[0].Value)
+	})
+
+	t.Run("spoofed key", func(t *testing.T) {
+		var selectedKey string
+		proxy := NewHTTPProxy(
+			&stickyManager{
+				handler: func(_ string, key string, _ bool) (upstream.Upstream, bool) {
+					selectedKey = key
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Sticky: config.StickyConfig{
+					Enabled: true,
+					Cookie:  "piko-session",
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("my-key"),
+		)
+
+		// Clients can't choose the session key using the internal header.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-sticky-key", "my-session")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.NotEqual(t, "", selectedKey)
+		assert.NotEqual(t, "my-session", selectedKey)
+	})
+}
+
+func TestHTTPProxy_ForwardedHeaders(t *testing.T) {
+	// forwardedHeaders proxies the request and returns the forwarding headers
+	// received by the upstream.
+	forwardedHeaders := func(
+		t *testing.T,
+		conf config.ProxyConfig,
+		r *http.Request,
+	) http.Header {
+		headerCh := make(chan http.Header, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer server.Close()
+
+		conf.Timeout = time.Second
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			conf,
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("my-key"),
+		)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		return <-headerCh
+	}
+
+	t.Run("single hop", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+
+		h := forwardedHeaders(t, config.ProxyConfig{}, r)
+		assert.Equal(t, "10.0.0.1", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", h.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "my-endpoint.example.com", h.Get("X-Forwarded-Host"))
+		assert.Equal(
+			t,
+			"for=10.0.0.1;host=my-endpoint.example.com;proto=http",
+			h.Get("Forwarded"),
+		)
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com:8000/", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+
+		h := forwardedHeaders(t, config.ProxyConfig{}, r)
+		assert.Equal(t, "2001:db8::1", h.Get("X-Forwarded-For"))
+		assert.Equal(
+			t,
+			`for="[2001:db8::1]";host="my-endpoint.example.com:8000";proto=http`,
+			h.Get("Forwarded"),
+		)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "spoofed.com")
+		r.Header.Set("Forwarded", "for=1.2.3.4")
+
+		h := forwardedHeaders(t, config.ProxyConfig{}, r)
+		assert.Equal(t, "10.0.0.1", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", h.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "my-endpoint.example.com", h.Get("X-Forwarded-Host"))
+		assert.Equal(
+			t,
+			"for=10.0.0.1;host=my-endpoint.example.com;proto=http",
+			h.Get("Forwarded"),
+		)
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "my-endpoint.example.com")
+		r.Header.Set("Forwarded", "for=1.2.3.4;proto=https")
+
+		h := forwardedHeaders(t, config.ProxyConfig{
+			TrustForwardedHeaders: true,
+		}, r)
+		assert.Equal(t, "1.2.3.4, 10.0.0.1", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "my-endpoint.example.com", h.Get("X-Forwarded-Host"))
+		assert.Equal(
+			t,
+			"for=1.2.3.4;proto=https, for=10.0.0.1;host=my-endpoint.example.com;proto=http",
+			h.Get("Forwarded"),
+		)
+	})
+
+	// Tests a request forwarded from another node preserves the chain added
+	// by that node, even when client headers are untrusted.
+	t.Run("forwarded", func(t *testing.T) {
+		// Request as sent by the first node.
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("x-piko-forward", "my-key")
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "my-endpoint.example.com")
+		r.Header.Set("Forwarded", "for=10.0.0.1;host=my-endpoint.example.com;proto=https")
+
+		h := forwardedHeaders(t, config.ProxyConfig{}, r)
+		assert.Equal(t, "10.0.0.1, 10.0.0.2", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "my-endpoint.example.com", h.Get("X-Forwarded-Host"))
+		assert.Equal(
+			t,
+			"for=10.0.0.1;host=my-endpoint.example.com;proto=https, for=10.0.0.2;host=my-endpoint.example.com;proto=http",
+			h.Get("Forwarded"),
+		)
+	})
+
+	// Tests a client can't spoof forwarding headers by claiming the request
+	// was forwarded from another node.
+	t.Run("spoofed forward", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		r.Header.Set("Forwarded", "for=1.2.3.4;host=spoofed.example.com;proto=https")
+
+		h := forwardedHeaders(t, config.ProxyConfig{}, r)
+		assert.Equal(t, "10.0.0.2", h.Get("X-Forwarded-For"))
+		assert.Equal(t, "http", h.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "my-endpoint.example.com", h.Get("X-Forwarded-Host"))
+		assert.Equal(
+			t,
+			"for=10.0.0.2;host=my-endpoint.example.com;proto=http",
+			h.Get("Forwarded"),
+		)
+	})
+}
+
+func TestHTTPProxy_PikoHeaders(t *testing.T) {
+	t.Run("stripped for upstream", func(t *testing.T) {
+		headerCh := make(chan http.Header, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("X-Piko-Foo", "bar")
+		r.Header.Add("x-custom", "bar")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		h := <-headerCh
+		assert.Equal(t, "", h.Get("x-piko-endpoint"))
+		assert.Equal(t, "", h.Get("x-piko-foo"))
+		assert.Equal(t, "", h.Get("x-piko-forward"))
+		assert.Equal(t, "bar", h.Get("x-custom"))
+	})
+
+	t.Run("preserved for remote node", func(t *testing.T) {
+		headerCh := make(chan http.Header, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream("my-endpoint", &cluster.Node{
+						ID:         "node-2",
+						ProxyAddr:  server.Listener.Addr().String(),
+						ForwardKey: "node-key",
+					}), true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		h := <-headerCh
+		assert.Equal(t, "my-endpoint", h.Get("x-piko-endpoint"))
+		// The forward key of the remote node authenticates the request.
+		assert.Equal(t, "node-key", h.Get("x-piko-forward"))
+	})
+
+	t.Run("stripped from response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("X-Piko-Foo", "bar")
+				w.Header().Set("x-custom", "bar")
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("x-piko-foo"))
+		assert.Equal(t, "bar", resp.Header.Get("x-custom"))
+	})
+}
+
+func TestHTTPProxy_HopByHopHeaders(t *testing.T) {
+	t.Run("stripped for upstream", func(t *testing.T) {
+		headerCh := make(chan http.Header, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				headerCh <- r.Header
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Connection", "x-hop")
+		r.Header.Add("Keep-Alive", "timeout=5")
+		r.Header.Add("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		r.Header.Add("x-hop", "bar")
+		r.Header.Add("x-custom", "bar")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		h := <-headerCh
+		assert.Equal(t, "", h.Get("Keep-Alive"))
+		assert.Equal(t, "", h.Get("Proxy-Authorization"))
+		// Headers listed in 'Connection' are also hop-by-hop.
+		assert.Equal(t, "", h.Get("x-hop"))
+		assert.Equal(t, "bar", h.Get("x-custom"))
+	})
+
+	t.Run("stripped from response", func(t *testing.T) {
+		// Use a raw listener as http.Server manages the 'Connection' header
+		// itself.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(
+				"HTTP/1.1 200 OK\r\n" +
+					"Connection: x-hop\r\n" +
+					"Keep-Alive: timeout=5\r\n" +
+					"Upgrade: foo\r\n" +
+					"X-Hop: bar\r\n" +
+					"X-Custom: bar\r\n" +
+					"Content-Length: 0\r\n" +
+					"\r\n",
+			))
+		}()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: ln.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Connection"))
+		assert.Equal(t, "", resp.Header.Get("Keep-Alive"))
+		assert.Equal(t, "", resp.Header.Get("Upgrade"))
+		assert.Equal(t, "", resp.Header.Get("x-hop"))
+		assert.Equal(t, "bar", resp.Header.Get("x-custom"))
+	})
+}
+
+func TestHTTPProxy_RequestMetadata(t *testing.T) {
+	metadata := func(
+		t *testing.T,
+		forward bool,
+		r *http.Request,
+	) requestmeta.Metadata {
+		metaCh := make(chan requestmeta.Metadata, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				meta, ok := requestmeta.Extract(r.Header)
+				assert.True(t, ok)
+				metaCh <- meta
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    server.Listener.Addr().String(),
+						forward: forward,
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("my-key"),
+		)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		return <-metaCh
+	}
+
+	t.Run("local", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Request-Id", "my-request")
+		// Metadata from the client is ignored.
+		r.Header.Set("x-piko-meta-client-ip", "1.2.3.4")
+		r.Header.Set("x-piko-meta-forwarded", "true")
+
+		assert.Equal(t, requestmeta.Metadata{
+			ClientIP:   "10.0.0.1",
+			EndpointID: "my-endpoint",
+			RequestID:  "my-request",
+		}, metadata(t, false, r))
+	})
+
+	t.Run("forward to node", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "https://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Request-Id", "my-request")
+
+		assert.Equal(t, requestmeta.Metadata{
+			ClientIP:   "10.0.0.1",
+			ClientTLS:  true,
+			EndpointID: "my-endpoint",
+			RequestID:  "my-request",
+		}, metadata(t, true, r))
+	})
+
+	// Tests a request forwarded from another node uses the client metadata
+	// from that node.
+	t.Run("forwarded", func(t *testing.T) {
+		// Request as sent by the first node.
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("x-piko-forward", "my-key")
+		r.Header.Set("x-piko-endpoint", "my-endpoint")
+		r.Header.Set("X-Request-Id", "my-request")
+		requestmeta.Inject(requestmeta.Metadata{
+			ClientIP:   "10.0.0.1",
+			ClientTLS:  true,
+			EndpointID: "my-endpoint",
+			RequestID:  "my-request",
+		}, r.Header)
+
+		assert.Equal(t, requestmeta.Metadata{
+			ClientIP:   "10.0.0.1",
+			ClientTLS:  true,
+			EndpointID: "my-endpoint",
+			Forwarded:  true,
+			RequestID:  "my-request",
+		}, metadata(t, false, r))
+	})
+
+	// Tests a client can't spoof the client metadata by claiming the
+	// request was forwarded from another node.
+	t.Run("spoofed forward", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("x-piko-forward", "true")
+		r.Header.Set("X-Request-Id", "my-request")
+		requestmeta.Inject(requestmeta.Metadata{
+			ClientIP:   "1.2.3.4",
+			ClientTLS:  true,
+			EndpointID: "my-endpoint",
+			RequestID:  "my-request",
+		}, r.Header)
+
+		assert.Equal(t, requestmeta.Metadata{
+			ClientIP:   "10.0.0.2",
+			EndpointID: "my-endpoint",
+			RequestID:  "my-request",
+		}, metadata(t, false, r))
+	})
+}
+
+func TestHTTPProxy_RequestID(t *testing.T) {
+	t.Run("generated", func(t *testing.T) {
+		idCh := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				idCh <- r.Header.Get("X-Request-Id")
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		id := <-idCh
+		assert.Len(t, id, 16)
+		assert.Equal(t, id, w.Result().Header.Get("X-Request-Id"))
+	})
+
+	t.Run("preserved", func(t *testing.T) {
+		idCh := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				idCh <- r.Header.Get("X-Request-Id")
+				// The upstream request ID is ignored.
+				w.Header().Set("X-Request-Id", "upstream-request")
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("X-Request-Id", "my-request")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		assert.Equal(t, "my-request", <-idCh)
+		assert.Equal(
+			t, []string{"my-request"}, w.Result().Header.Values("X-Request-Id"),
+		)
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		idCh := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				idCh <- r.Header.Get("X-Request-Id")
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    server.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		// The remote node receives the same request ID.
+		assert.Equal(t, w.Result().Header.Get("X-Request-Id"), <-idCh)
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return nil, false
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("X-Request-Id", "my-request")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+		assert.Equal(t, "my-request", w.Result().Header.Get("X-Request-Id"))
+	})
+}
+
+func TestHTTPProxy_RateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			RateLimit: config.RateLimitConfig{
+				RequestsPerSecond: 0.1,
+				Burst:             2,
+				MaxKeys:           10,
+			},
+		},
+		nil,
+		log.NewNopLogger(),
+		WithForwardKey("my-key"),
+	)
+
+	for i := 0; i != 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("x-piko-endpoint", "my-endpoint")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	m := errorMessage{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	assert.Equal(t, "too many requests", m.Error)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(
+		proxy.Metrics().RateLimitedRequestsTotal.WithLabelValues("my-endpoint"),
+	))
+
+	// Clients can't bypass the rate limit by claiming the request was
+	// forwarded from another node.
+	r = httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+	r.Header.Add("x-piko-forward", "true")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+
+	// Requests forwarded from another node have already been rate limited
+	// by that node.
+	r = httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+	r.Header.Add("x-piko-endpoint", "my-endpoint")
+	r.Header.Add("x-piko-forward", "my-key")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestHTTPProxy_ConcurrencyLimit(t *testing.T) {
+	newProxy := func(
+		conf config.ConcurrencyLimitConfig,
+	) (*HTTPProxy, chan struct{}, chan struct{}) {
+		receivedCh := make(chan struct{})
+		releaseCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				receivedCh <- struct{}{}
+				<-releaseCh
+			},
+		))
+		t.Cleanup(server.Close)
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout:          time.Minute,
+				ConcurrencyLimit: conf,
+			},
+			nil,
+			log.NewNopLogger(),
+			WithForwardKey("my-key"),
+		)
+		return proxy, receivedCh, releaseCh
+	}
+
+	serveForwarded := func(proxy *HTTPProxy, key string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "http://my-endpoint.example.com/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		if key != "" {
+			r.Header.Add("x-piko-forward", key)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	serve := func(proxy *HTTPProxy) *http.Response {
+		return serveForwarded(proxy, "")
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		proxy, receivedCh, releaseCh := newProxy(config.ConcurrencyLimitConfig{
+			MaxRequests: 1,
+		})
+
+		respCh := make(chan *http.Response)
+		go func() {
+			respCh <- serve(proxy)
+		}()
+		<-receivedCh
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.Metrics().ConcurrentRequests.WithLabelValues("my-endpoint"),
+		))
+
+		resp := serve(proxy)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "too many concurrent requests", m.Error)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			proxy.Metrics().ConcurrencyLimitedRequestsTotal.WithLabelValues("my-endpoint"),
+		))
+
+		close(releaseCh)
+		assert.Equal(t, http.StatusOK, (<-respCh).StatusCode)
+
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			proxy.Metrics().ConcurrentRequests.WithLabelValues("my-endpoint"),
+		))
+
+		// Once the slot is released, requests are accepted.
+		go func() {
+			<-receivedCh
+		}()
+		assert.Equal(t, http.StatusOK, serve(proxy).StatusCode)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		proxy, receivedCh, releaseCh := newProxy(config.ConcurrencyLimitConfig{
+			MaxRequests:  1,
+			QueueTimeout: time.Minute,
+		})
+
+		respCh := make(chan *http.Response)
+		go func() {
+			respCh <- serve(proxy)
+		}()
+		<-receivedCh
+
+		queuedRespCh := make(chan *http.Response)
+		go func() {
+			queuedRespCh <- serve(proxy)
+		}()
+
+		// The queued request isn't forwarded until the first completes.
+		select {
+		case <-receivedCh:
+			t.Fatal("request forwarded over limit")
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		close(releaseCh)
+		assert.Equal(t, http.StatusOK, (<-respCh).StatusCode)
+
+		<-receivedCh
+		assert.Equal(t, http.StatusOK, (<-queuedRespCh).StatusCode)
+
+		assert.Equal(t, 0.0, testutil.ToFloat64(
+			proxy.Metrics().ConcurrencyLimitedRequestsTotal.WithLabelValues("my-endpoint"),
+		))
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		proxy, receivedCh, releaseCh := newProxy(config.ConcurrencyLimitConfig{
+			MaxRequests: 1,
+		})
+
+		respCh := make(chan *http.Response)
+		go func() {
+			respCh <- serve(proxy)
+		}()
+		<-receivedCh
+
+		// Clients can't bypass the limit by claiming the request was
+		// forwarded from another node.
+		resp := serveForwarded(proxy, "true")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+		// Requests forwarded from another node have already been limited
+		// by that node.
+		forwardedRespCh := make(chan *http.Response)
+		go func() {
+			forwardedRespCh <- serveForwarded(proxy, "my-key")
+		}()
+		<-receivedCh
+
+		close(releaseCh)
+		assert.Equal(t, http.StatusOK, (<-respCh).StatusCode)
+		assert.Equal(t, http.StatusOK, (<-forwardedRespCh).StatusCode)
+	})
+
+	// Tests the slot is released when the request fails.
+	t.Run("release on error", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						// Unreachable address.
+						addr: "127.0.0.1:1",
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				ConcurrencyLimit: config.ConcurrencyLimitConfig{
+					MaxRequests: 1,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		for i := 0; i != 3; i++ {
+			assert.Equal(t, http.StatusBadGateway, serve(proxy).StatusCode)
+		}
+		assert.Empty(t, proxy.concurrencyLimiter.semaphores)
+	})
+}
+
+func TestHTTPProxy_CORS(t *testing.T) {
+	methodCh := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			methodCh <- r.Method
+			// CORS headers from the upstream are ignored.
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			CORS: config.CORSConfig{
+				Enabled:          true,
+				AllowedOrigins:   []string{"https://foo.com", "https://bar.com"},
+				AllowedMethods:   []string{http.MethodGet, http.MethodPost},
+				AllowedHeaders:   []string{"Content-Type", "X-Custom"},
+				AllowCredentials: true,
+				MaxAge:           time.Minute,
+			},
+			Endpoints: map[string]config.EndpointConfig{
+				"public-endpoint": {
+					CORS: &config.CORSConfig{
+						Enabled:        true,
+						AllowedOrigins: []string{"*"},
+						AllowedHeaders: []string{"*"},
+					},
+				},
+				"disabled-endpoint": {
+					CORS: &config.CORSConfig{},
+				},
+			},
+		},
+		nil,
+		log.NewNopLogger(),
+	)
+
+	t.Run("preflight", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Origin", "https://bar.com")
+		r.Header.Add("Access-Control-Request-Method", http.MethodPost)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "https://bar.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Content-Type, X-Custom", resp.Header.Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+		assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+
+		// The preflight request must not be forwarded.
+		assert.Len(t, methodCh, 0)
+	})
+
+	t.Run("preflight origin not allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Origin", "https://evil.com")
+		r.Header.Add("Access-Control-Request-Method", http.MethodPost)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Len(t, methodCh, 0)
+	})
+
+	t.Run("actual request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Origin", "https://foo.com")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, http.MethodPost, <-methodCh)
+
+		// Only the single matching origin is reflected.
+		assert.Equal(
+			t,
+			[]string{"https://foo.com"},
+			resp.Header.Values("Access-Control-Allow-Origin"),
+		)
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+	})
+
+	t.Run("actual request origin not allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Origin", "https://evil.com")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, http.MethodGet, <-methodCh)
+
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("endpoint override", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/", nil)
+		r.Header.Add("x-piko-endpoint", "public-endpoint")
+		r.Header.Add("Origin", "https://evil.com")
+		r.Header.Add("Access-Control-Request-Method", http.MethodPut)
+		r.Header.Add("Access-Control-Request-Headers", "X-Foo")
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+		// Inherits the proxy methods.
+		assert.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "X-Foo", resp.Header.Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Len(t, methodCh, 0)
+	})
+
+	t.Run("endpoint disabled", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodOptions, "/", nil)
+		r.Header.Add("x-piko-endpoint", "disabled-endpoint")
+		r.Header.Add("Origin", "https://foo.com")
+		r.Header.Add("Access-Control-Request-Method", http.MethodPost)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		// The preflight request is forwarded to the upstream, including
+		// the upstream CORS headers.
+		resp := w.Result()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, http.MethodOptions, <-methodCh)
+		assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestHTTPProxy_Compression(t *testing.T) {
+	body := strings.Repeat("foo", 1000)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/encoded":
+				w.Header().Set("Content-Encoding", "br")
+			case "/small":
+				w.Header().Set("Content-Type", "text/plain")
+				// nolint
+				w.Write([]byte("foo"))
+				return
+			case "/image":
+				w.Header().Set("Content-Type", "image/png")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			// nolint
+			w.Write([]byte(body))
+		},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			Compression: config.CompressionConfig{
+				Enabled:      true,
+				MinSize:      100,
+				ContentTypes: []string{"text/*", "application/json"},
+			},
+			Endpoints: map[string]config.EndpointConfig{
+				"disabled-endpoint": {
+					Compression: &config.CompressionConfig{},
+				},
+			},
+		},
+		nil,
+		log.NewNopLogger(),
+	)
+
+	request := func(endpointID string, path string, acceptEncoding string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Add("x-piko-endpoint", endpointID)
+		if acceptEncoding != "" {
+			r.Header.Add("Accept-Encoding", acceptEncoding)
+		}
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		resp := request("my-endpoint", "/", "deflate, gzip")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "", resp.Header.Get("Content-Length"))
+		assert.Contains(t, resp.Header.Values("Vary"), "Accept-Encoding")
+
+		gz, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		b, err := io.ReadAll(gz)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(b))
+	})
+
+	t.Run("gzip not accepted", func(t *testing.T) {
+		for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+			resp := request("my-endpoint", "/", acceptEncoding)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+			assert.Contains(t, resp.Header.Values("Vary"), "Accept-Encoding")
+
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(b))
+		}
+	})
+
+	t.Run("pass through", func(t *testing.T) {
+		// Responses that are already encoded, are below the minimum size,
+		// aren't compressible, or where compression is disabled for the
+		// endpoint are forwarded unchanged.
+		for _, tc := range []struct {
+			endpointID      string
+			path            string
+			contentEncoding string
+			body            string
+		}{
+			{"my-endpoint", "/encoded", "br", body},
+			{"my-endpoint", "/small", "", "foo"},
+			{"my-endpoint", "/image", "", body},
+			{"disabled-endpoint", "/", "", body},
+		} {
+			resp := request(tc.endpointID, tc.path, "gzip")
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.contentEncoding, resp.Header.Get("Content-Encoding"))
+
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, string(b))
+		}
+	})
+}
+
+func TestHTTPProxy_Auth(t *testing.T) {
+	secretKey := []byte("secret-key")
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			Endpoints: map[string]config.EndpointConfig{
+				"public-endpoint": {
+					DisableAuth: true,
+				},
+			},
+		},
+		auth.NewJWTVerifier(auth.JWTVerifierConfig{
+			HMACSecretKey: secretKey,
+		}),
+		log.NewNopLogger(),
+		WithForwardKey("my-key"),
+	)
+
+	signToken := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		tokenString, err := token.SignedString(secretKey)
+		assert.NoError(t, err)
+		return tokenString
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Authorization", "Bearer "+signToken(jwt.MapClaims{
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("missing authorization", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "missing authorization", m.Error)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{})
+		tokenString, err := token.SignedString([]byte("invalid-key"))
+		assert.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Authorization", "Bearer "+tokenString)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "invalid token", m.Error)
+	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("Authorization", "Bearer "+signToken(jwt.MapClaims{
+			"piko": map[string]interface{}{
+				"endpoints": []string{"other-endpoint"},
+			},
+		}))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		resp := w.Result()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "endpoint not permitted", m.Error)
+	})
+
+	t.Run("public endpoint", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "public-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		// Clients can't bypass authentication by claiming the request was
+		// forwarded from another node.
+		for _, key := range []string{"true", "invalid-key", ""} {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Add("x-piko-endpoint", "my-endpoint")
+			r.Header.Add("x-piko-forward", key)
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+		}
+	})
+
+	t.Run("forwarded with key", func(t *testing.T) {
+		// Requests forwarded from another node are authenticated by that
+		// node.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		r.Header.Add("x-piko-forward", "my-key")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
+func TestHTTPProxy_ForwardErrors(t *testing.T) {
+	newProxy := func(u upstream.Upstream, timeout time.Duration) *HTTPProxy {
+		return NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return u, u != nil
+				},
+			},
+			config.ProxyConfig{Timeout: timeout},
+			nil,
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("x-foo", "bar")
+				w.WriteHeader(http.StatusCreated)
+				// nolint
+				w.Write([]byte("foo"))
+			},
+		))
+		defer server.Close()
+
+		proxy := newProxy(&tcpUpstream{
+			addr: server.Listener.Addr().String(),
+		}, time.Second)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "bar", resp.Header.Get("x-foo"))
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(b))
+	})
+
+	t.Run("missing endpoint id", func(t *testing.T) {
+		proxy := newProxy(nil, time.Second)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		// Set a host without a subdomain so no endpoint is resolved.
+		r.Host = "foo"
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrMissingEndpointID)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("endpoint not found", func(t *testing.T) {
+		proxy := newProxy(nil, time.Second)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointNotFound)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "no available upstreams", m.Error)
+	})
+
+	t.Run("endpoint unreachable", func(t *testing.T) {
+		proxy := newProxy(&tcpUpstream{addr: "localhost:55555"}, time.Second)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointUnreachable)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		// The error response doesn't include the underlying cause.
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "upstream unreachable", m.Error)
+	})
+
+	t.Run("endpoint timeout", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {
+				<-blockCh
+			},
+		))
+		defer server.Close()
+		defer close(blockCh)
+
+		proxy := newProxy(&tcpUpstream{
+			addr: server.Listener.Addr().String(),
+		}, time.Millisecond)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointTimeout)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	})
+}
+
+func TestErrorResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	assert.NoError(t, errorResponse(w, http.StatusBadGateway, "upstream unreachable"))
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "502 Bad Gateway", resp.Status)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"error":"upstream unreachable"}`, string(b))
+	assert.Equal(t, strconv.Itoa(len(b)), resp.Header.Get("Content-Length"))
+}
+
+func TestHTTPProxy_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer server.Close()
+
+	t.Run("local", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "my-endpoint", "local",
+		))
+		assert.Equal(t, 1, testutil.CollectAndCount(proxy.Metrics().RequestLatency))
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr:    server.Listener.Addr().String(),
+						forward: true,
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "my-endpoint", "remote",
+		))
+		assert.Equal(t, 1, testutil.CollectAndCount(proxy.Metrics().RequestLatency))
+		// Bytes are only counted by the node the upstream is connected to.
+		assert.Equal(t, 0, testutil.CollectAndCount(proxy.Metrics().EndpointBytesTotal))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: "localhost:55555",
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "my-endpoint", "error",
+		))
+		assert.Equal(t, 1, testutil.CollectAndCount(proxy.Metrics().RequestLatency))
+	})
+
+	t.Run("no available upstreams", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return nil, false
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "my-endpoint", "error",
+		))
+	})
+
+	t.Run("max endpoints", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Metrics: config.ProxyMetricsConfig{
+					MaxEndpoints: 2,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		for i := 0; i != 5; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Add("x-piko-endpoint", "endpoint-"+strconv.Itoa(i))
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		}
+
+		// The first 2 endpoints have their own label, then the rest are
+		// grouped as '_other'.
+		assert.Equal(t, 3, testutil.CollectAndCount(proxy.Metrics().RequestLatency))
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "endpoint-0", "local",
+		))
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "endpoint-1", "local",
+		))
+		assert.Equal(t, uint64(3), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "_other", "local",
+		))
+	})
+
+	t.Run("allow list", func(t *testing.T) {
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{
+				Timeout: time.Second,
+				Metrics: config.ProxyMetricsConfig{
+					Endpoints:    []string{"endpoint-3"},
+					MaxEndpoints: 2,
+				},
+			},
+			nil,
+			log.NewNopLogger(),
+		)
+
+		for i := 0; i != 5; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Add("x-piko-endpoint", "endpoint-"+strconv.Itoa(i))
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		}
+
+		assert.Equal(t, 2, testutil.CollectAndCount(proxy.Metrics().RequestLatency))
+		assert.Equal(t, uint64(1), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "endpoint-3", "local",
+		))
+		assert.Equal(t, uint64(4), histogramSampleCount(
+			t, proxy.Metrics().RequestLatency, "_other", "local",
+		))
+	})
+}
+
+// histogramSampleCount returns the number of observations in the histogram
+// with the given label values.
+func histogramSampleCount(
+	t *testing.T,
+	histogram *prometheus.HistogramVec,
+	labelValues ...string,
+) uint64 {
+	m := &dto.Metric{}
+	require.NoError(
+		t,
+		histogram.WithLabelValues(labelValues...).(prometheus.Metric).Write(m),
+	)
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestHTTPProxy_EndpointBytes(t *testing.T) {
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nbar"
+
+	// Use a raw TCP upstream to count the exact number of bytes received.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	requestBytesCh := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		cr := &countingReader{r: conn}
+		req, err := http.ReadRequest(bufio.NewReader(cr))
+		if !assert.NoError(t, err) {
+			return
+		}
+		// nolint
+		io.Copy(io.Discard, req.Body)
+
+		_, err = conn.Write([]byte(response))
+		assert.NoError(t, err)
+
+		requestBytesCh <- cr.n
+	}()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: ln.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{Timeout: time.Second},
+		nil,
+		log.NewNopLogger(),
+	)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("foo"))
+	r.Header.Add("x-piko-endpoint", "my-endpoint")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "bar", w.Body.String())
+
+	requestBytes := <-requestBytesCh
+	assert.Equal(t, float64(requestBytes), testutil.ToFloat64(
+		proxy.Metrics().EndpointBytesTotal.WithLabelValues("my-endpoint", "out"),
+	))
+	assert.Equal(t, float64(len(response)), testutil.ToFloat64(
+		proxy.Metrics().EndpointBytesTotal.WithLabelValues("my-endpoint", "in"),
+	))
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += n
+	return n, err
+}
+
+func TestHTTPProxy_Tracing(t *testing.T) {
+	t.Run("forwarded", func(t *testing.T) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+		traceparentCh := make(chan string, 1)
+		upstreamServer := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				traceparentCh <- r.Header.Get("traceparent")
+			},
+		))
+		defer upstreamServer.Close()
+
+		// Node 2 has a local upstream for the endpoint.
+		node2 := httptest.NewServer(NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+					assert.False(t, allowForward)
+					return &tcpUpstream{
+						addr: upstreamServer.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithTracerProvider(provider),
+			WithForwardKey("my-key"),
+		))
+		defer node2.Close()
+
+		// Node 1 forwards the request to node 2.
+		node1 := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return upstream.NewNodeUpstream("my-endpoint", &cluster.Node{
+						ID:         "node-2",
+						ProxyAddr:  node2.Listener.Addr().String(),
+						ForwardKey: "my-key",
+					}), true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithTracerProvider(provider),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		node1.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 2)
+
+		var node1Span, node2Span tracetest.SpanStub
+		for _, span := range spans {
+			if span.Parent.IsValid() {
+				node2Span = span
+			} else {
+				node1Span = span
+			}
+		}
+
+		// Node 1's span is the root span, which is forwarded to node 2.
+		assert.Equal(t, "proxy.request", node1Span.Name)
+		assert.Contains(t, node1Span.Attributes, tracing.AttributeEndpointID.String("my-endpoint"))
+		assert.Contains(t, node1Span.Attributes, tracing.AttributeForward.Bool(true))
+		assert.Contains(t, node1Span.Attributes, tracing.AttributeNodeID.String("node-2"))
+
+		// Node 2's span is a child of node 1's span, which is forwarded to
+		// the local upstream.
+		assert.Equal(t, "proxy.request", node2Span.Name)
+		assert.Equal(t, node1Span.SpanContext.TraceID(), node2Span.SpanContext.TraceID())
+		assert.Equal(t, node1Span.SpanContext.SpanID(), node2Span.Parent.SpanID())
+		assert.True(t, node2Span.Parent.IsRemote())
+		assert.Contains(t, node2Span.Attributes, tracing.AttributeEndpointID.String("my-endpoint"))
+		assert.Contains(t, node2Span.Attributes, tracing.AttributeForward.Bool(false))
+
+		// The upstream receives node 2's span as its parent.
+		traceparent := <-traceparentCh
+		assert.Contains(t, traceparent, node2Span.SpanContext.TraceID().String())
+		assert.Contains(t, traceparent, node2Span.SpanContext.SpanID().String())
+	})
+
+	t.Run("upstream unreachable", func(t *testing.T) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: "localhost:55555",
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithTracerProvider(provider),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+	})
+}
+
+func TestHTTPProxy_EndpointResolver(t *testing.T) {
+	// Tests the path prefix resolver strips the endpoint ID from the
+	// forwarded request.
+	t.Run("path prefix", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/foo/bar", r.URL.Path)
+				assert.Equal(t, "a=b", r.URL.RawQuery)
+			},
+		))
+		defer server.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithEndpointResolver(NewPathPrefixEndpointResolver()),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/my-endpoint/foo/bar?a=b", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	// Tests a request forwarded to another node isn't resolved again, since
+	// the forwarding node has already stripped the endpoint ID from the path.
+	t.Run("forwarded", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/foo/bar", r.URL.Path)
+				assert.Equal(t, "", r.Header.Get("x-piko-endpoint"))
+			},
+		))
+		defer server.Close()
+
+		remoteProxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					assert.False(t, allowForward)
+					return &tcpUpstream{
+						addr: server.Listener.Addr().String(),
+					}, true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithEndpointResolver(NewPathPrefixEndpointResolver()),
+			WithForwardKey("my-key"),
+		)
+		remoteServer := httptest.NewServer(remoteProxy)
+		defer remoteServer.Close()
+
+		proxy := NewHTTPProxy(
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					return upstream.NewNodeUpstream("my-endpoint", &cluster.Node{
+						ID:         "node-2",
+						ProxyAddr:  remoteServer.Listener.Addr().String(),
+						ForwardKey: "my-key",
+					}), true
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			nil,
+			log.NewNopLogger(),
+			WithEndpointResolver(NewPathPrefixEndpointResolver()),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/my-endpoint/foo/bar", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
+func TestHTTPProxy_EndpointFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The endpoint header is stripped before forwarding.
+			assert.Equal(t, "", r.Header.Get("x-piko-endpoint"))
+			// nolint
+			w.Write([]byte("ok"))
+		},
+	))
+	defer server.Close()
+
+	// newProxy returns a proxy where only the given endpoints have an
+	// available upstream, and records the endpoints looked up.
+	newProxy := func(
+		available []string,
+		lookups *[]string,
+		verifier auth.Verifier,
+	) *HTTPProxy {
+		return NewHTTPProxy(
+			&fakeManager{
+				handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+					*lookups = append(*lookups, endpointID)
+					for _, id := range available {
+						if id == endpointID {
+							return &tcpUpstream{
+								addr: server.Listener.Addr().String(),
+							}, true
+						}
+					}
+					return nil, false
+				},
+			},
+			config.ProxyConfig{Timeout: time.Second},
+			verifier,
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("primary available", func(t *testing.T) {
+		var lookups []string
+		proxy := newProxy([]string{"primary", "secondary"}, &lookups, nil)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "primary,secondary")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Equal(t, []string{"primary"}, lookups)
+	})
+
+	t.Run("primary absent", func(t *testing.T) {
+		var lookups []string
+		proxy := newProxy([]string{"secondary"}, &lookups, nil)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "primary, secondary")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(b))
+
+		assert.Equal(t, []string{"primary", "secondary"}, lookups)
+	})
+
+	t.Run("all absent", func(t *testing.T) {
+		var lookups []string
+		proxy := newProxy(nil, &lookups, nil)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "primary,secondary,tertiary")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointNotFound)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, []string{"primary", "secondary", "tertiary"}, lookups)
+	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		secretKey := []byte("secret-key")
+
+		var lookups []string
+		proxy := newProxy(
+			[]string{"secondary"},
+			&lookups,
+			auth.NewJWTVerifier(auth.JWTVerifierConfig{
+				HMACSecretKey: secretKey,
+			}),
+		)
+
+		// The token only permits the secondary endpoint, so the request
+		// is rejected even though the primary has no upstreams.
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"piko": map[string]interface{}{
+				"endpoints": []string{"secondary"},
+			},
+		})
+		tokenString, err := token.SignedString(secretKey)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "primary,secondary")
+		r.Header.Add("Authorization", "Bearer "+tokenString)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	})
+}
+
+func TestHTTPProxy_EndpointAccess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			// nolint
+			w.Write([]byte("foo"))
+		},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(endpointID string, _ bool) (upstream.Upstream, bool) {
+				assert.Equal(t, "tenant-a-api", endpointID)
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{Timeout: time.Second},
+		nil,
+		log.NewNopLogger(),
+		WithEndpointAccess(config.EndpointAccessConfig{
+			Allow: []string{"tenant-a-*"},
+			Deny:  []string{"tenant-a-internal"},
+		}),
+	)
+
+	t.Run("allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "tenant-a-api")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "tenant-b-api")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointNotPermitted)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "endpoint not permitted on this node", m.Error)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "tenant-a-internal")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointNotPermitted)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	// Tests a fallback list is rejected if any of the endpoints aren't
+	// permitted.
+	t.Run("fallback denied", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("x-piko-endpoint", "tenant-a-api,tenant-a-internal")
+
+		resp, err := proxy.Forward(context.TODO(), r)
+		assert.ErrorIs(t, err, ErrEndpointNotPermitted)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestHTTPProxy_Inflight(t *testing.T) {
+	requestCh := make(chan struct{})
+	blockCh := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {
+			close(requestCh)
+			<-blockCh
+		},
+	))
+	defer server.Close()
+
+	proxy := NewHTTPProxy(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: server.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{Timeout: time.Second * 10},
+		nil,
+		log.NewNopLogger(),
+	)
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+
+		r := httptest.NewRequest(http.MethodPost, "/foo/bar?a=b", nil)
+		r.Header.Add("x-piko-endpoint", "my-endpoint")
+		proxy.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	// Wait for the request to reach the upstream.
+	<-requestCh
+
+	status := proxy.Inflight()
+	require.Len(t, status.Requests, 1)
+	assert.Equal(t, "my-endpoint", status.Requests[0].EndpointID)
+	assert.Equal(t, http.MethodPost, status.Requests[0].Method)
+	assert.Equal(t, "/foo/bar", status.Requests[0].Path)
+	assert.False(t, status.Requests[0].Remote)
+	assert.Equal(t, server.Listener.Addr().String(), status.Requests[0].UpstreamAddr)
+	assert.NotEmpty(t, status.Requests[0].Age)
+
+	close(blockCh)
+	<-doneCh
+
+	// Once the request completes it is removed.
+	assert.Empty(t, proxy.Inflight().Requests)
+}
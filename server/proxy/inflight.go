@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxInflightRequests is the maximum number of in-flight requests
+	// tracked. Requests beyond the limit are counted but not tracked, to
+	// bound the memory used by the registry.
+	maxInflightRequests = 10000
+)
+
+// InflightRequest contains a proxy request that is currently being processed.
+type InflightRequest struct {
+	EndpointID string `json:"endpoint_id"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+
+	// Remote indicates whether the request is forwarded to a remote node
+	// rather than an upstream connected to the local node.
+	Remote bool `json:"remote"`
+
+	// UpstreamAddr is the address of the upstream the request is proxied
+	// to. If the request is forwarded to another node, this is the proxy
+	// address of the node.
+	UpstreamAddr string `json:"upstream_addr"`
+
+	StartedAt time.Time `json:"started_at"`
+	// Age is the duration since the request started, such as '1.5s'.
+	Age string `json:"age"`
+}
+
+// InflightStatus contains a snapshot of the in-flight proxy requests.
+type InflightStatus struct {
+	// Requests contains the in-flight requests, ordered from oldest to
+	// newest.
+	Requests []InflightRequest `json:"requests"`
+
+	// Untracked is the number of in-flight requests that aren't included
+	// in Requests since the registry is full.
+	Untracked int `json:"untracked"`
+}
+
+// inflightRegistry tracks the proxy requests currently being processed.
+type inflightRegistry struct {
+	requests map[uint64]*InflightRequest
+	nextID   uint64
+
+	untracked int
+
+	limit int
+
+	mu sync.Mutex
+}
+
+func newInflightRegistry() *inflightRegistry {
+	return &inflightRegistry{
+		requests: make(map[uint64]*InflightRequest),
+		limit:    maxInflightRequests,
+	}
+}
+
+// Add adds the given request to the registry, and returns a function to
+// remove the request once it completes.
+func (r *inflightRegistry) Add(req *InflightRequest) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.requests) >= r.limit {
+		r.untracked++
+		return func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.untracked--
+		}
+	}
+
+	id := r.nextID
+	r.nextID++
+	r.requests[id] = req
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		delete(r.requests, id)
+	}
+}
+
+// Snapshot returns the requests currently in the registry.
+func (r *inflightRegistry) Snapshot() InflightStatus {
+	now := time.Now()
+
+	r.mu.Lock()
+	requests := make([]InflightRequest, 0, len(r.requests))
+	for _, req := range r.requests {
+		requests = append(requests, *req)
+	}
+	untracked := r.untracked
+	r.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].StartedAt.Before(requests[j].StartedAt)
+	})
+	for i := range requests {
+		age := now.Sub(requests[i].StartedAt)
+		requests[i].Age = age.Round(time.Millisecond).String()
+	}
+
+	return InflightStatus{
+		Requests:  requests,
+		Untracked: untracked,
+	}
+}
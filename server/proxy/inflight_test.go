@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightRegistry(t *testing.T) {
+	t.Run("add and remove", func(t *testing.T) {
+		registry := newInflightRegistry()
+
+		start := time.Now()
+		removeNew := registry.Add(&InflightRequest{
+			EndpointID: "new",
+			StartedAt:  start,
+		})
+		removeOld := registry.Add(&InflightRequest{
+			EndpointID: "old",
+			StartedAt:  start.Add(-time.Second),
+		})
+
+		// Requests are ordered from oldest to newest.
+		status := registry.Snapshot()
+		require.Len(t, status.Requests, 2)
+		assert.Equal(t, "old", status.Requests[0].EndpointID)
+		assert.Equal(t, "new", status.Requests[1].EndpointID)
+
+		removeOld()
+
+		status = registry.Snapshot()
+		require.Len(t, status.Requests, 1)
+		assert.Equal(t, "new", status.Requests[0].EndpointID)
+
+		removeNew()
+
+		assert.Empty(t, registry.Snapshot().Requests)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		registry := newInflightRegistry()
+		registry.limit = 2
+
+		var removes []func()
+		for i := 0; i != 3; i++ {
+			removes = append(removes, registry.Add(&InflightRequest{
+				StartedAt: time.Now(),
+			}))
+		}
+
+		status := registry.Snapshot()
+		assert.Len(t, status.Requests, 2)
+		assert.Equal(t, 1, status.Untracked)
+
+		for _, remove := range removes {
+			remove()
+		}
+
+		status = registry.Snapshot()
+		assert.Empty(t, status.Requests)
+		assert.Equal(t, 0, status.Untracked)
+	})
+}
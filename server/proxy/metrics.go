@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// otherEndpointLabel is the endpoint ID label used for endpoints that
+	// are not allowed their own label.
+	otherEndpointLabel = "_other"
+)
+
+// Request results for RequestLatency.
+const (
+	// resultLocal indicates the request was forwarded to an upstream
+	// connected to this node.
+	resultLocal = "local"
+	// resultRemote indicates the request was forwarded to another node.
+	resultRemote = "remote"
+	// resultError indicates the request failed.
+	resultError = "error"
+)
+
+type Metrics struct {
+	// RateLimitedRequestsTotal is the number of requests rejected due to
+	// exceeding the rate limit. Labelled by endpoint ID.
+	RateLimitedRequestsTotal *prometheus.CounterVec
+
+	// ConcurrencyLimitedRequestsTotal is the number of requests rejected
+	// due to exceeding the concurrency limit. Labelled by endpoint ID.
+	ConcurrencyLimitedRequestsTotal *prometheus.CounterVec
+
+	// ConcurrentRequests is the number of requests to an endpoint currently
+	// being handled. Labelled by endpoint ID.
+	ConcurrentRequests *prometheus.GaugeVec
+
+	// RequestLatency is the latency of requests proxied to an endpoint.
+	// Labelled by endpoint ID and result.
+	RequestLatency *prometheus.HistogramVec
+
+	// EndpointBytesTotal is the number of bytes exchanged with upstreams
+	// connected to this node. Labelled by endpoint ID and direction, where
+	// 'in' is bytes received from the upstream and 'out' is bytes sent to
+	// the upstream.
+	EndpointBytesTotal *prometheus.CounterVec
+
+	// HedgedRequestsTotal is the number of forwarded requests that were
+	// hedged by sending the request to an alternative node. Labelled by
+	// endpoint ID.
+	HedgedRequestsTotal *prometheus.CounterVec
+
+	// HedgedWinsTotal is the number of hedged requests where the
+	// alternative node responded first. Labelled by endpoint ID.
+	HedgedWinsTotal *prometheus.CounterVec
+
+	// RetryBudgetUtilization is the fraction of the retry budget in use,
+	// where 1 means the budget is exhausted.
+	RetryBudgetUtilization prometheus.Gauge
+
+	// RetryBudgetExhaustedTotal is the number of retries and hedged requests
+	// that were suppressed due to the retry budget being exhausted.
+	RetryBudgetExhaustedTotal prometheus.Counter
+
+	endpointLabels *endpointLabels
+}
+
+func NewMetrics(conf config.ProxyMetricsConfig) *Metrics {
+	return &Metrics{
+		RateLimitedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "rate_limited_requests_total",
+				Help:      "Number of requests rejected due to exceeding the rate limit",
+			},
+			[]string{"endpoint_id"},
+		),
+		ConcurrencyLimitedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "concurrency_limited_requests_total",
+				Help:      "Number of requests rejected due to exceeding the concurrency limit",
+			},
+			[]string{"endpoint_id"},
+		),
+		ConcurrentRequests: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "concurrent_requests",
+				Help:      "Number of requests to an endpoint currently being handled",
+			},
+			[]string{"endpoint_id"},
+		),
+		RequestLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "endpoint_request_latency_seconds",
+				Help:      "Latency of requests proxied to an endpoint",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"endpoint_id", "result"},
+		),
+		EndpointBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "endpoint_bytes_total",
+				Help:      "Number of bytes exchanged with upstreams connected to this node",
+			},
+			[]string{"endpoint_id", "direction"},
+		),
+		HedgedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "hedged_requests_total",
+				Help:      "Number of forwarded requests hedged to an alternative node",
+			},
+			[]string{"endpoint_id"},
+		),
+		HedgedWinsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "hedged_wins_total",
+				Help:      "Number of hedged requests where the alternative node responded first",
+			},
+			[]string{"endpoint_id"},
+		),
+		RetryBudgetUtilization: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "retry_budget_utilization",
+				Help:      "Fraction of the retry budget in use",
+			},
+		),
+		RetryBudgetExhaustedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "proxy",
+				Name:      "retry_budget_exhausted_total",
+				Help:      "Number of retries and hedged requests suppressed due to the retry budget being exhausted",
+			},
+		),
+		endpointLabels: newEndpointLabels(conf),
+	}
+}
+
+// EndpointLabel returns the 'endpoint_id' label value for the given
+// endpoint.
+//
+// To limit cardinality, endpoints that aren't in the configured allow list,
+// or that exceed the maximum number of endpoints, are labelled '_other'.
+func (m *Metrics) EndpointLabel(endpointID string) string {
+	return m.endpointLabels.Label(endpointID)
+}
+
+// countBytes wraps the connection to an upstream connected to this node to
+// record the bytes sent and received in EndpointBytesTotal.
+func (m *Metrics) countBytes(conn net.Conn, endpointID string) net.Conn {
+	endpointLabel := m.EndpointLabel(endpointID)
+	return &countedConn{
+		Conn: conn,
+		bytesIn: m.EndpointBytesTotal.With(prometheus.Labels{
+			"endpoint_id": endpointLabel,
+			"direction":   "in",
+		}),
+		bytesOut: m.EndpointBytesTotal.With(prometheus.Labels{
+			"endpoint_id": endpointLabel,
+			"direction":   "out",
+		}),
+	}
+}
+
+func (m *Metrics) Register(registry *prometheus.Registry) {
+	registry.MustRegister(
+		m.RateLimitedRequestsTotal,
+		m.ConcurrencyLimitedRequestsTotal,
+		m.ConcurrentRequests,
+		m.RequestLatency,
+		m.EndpointBytesTotal,
+		m.HedgedRequestsTotal,
+		m.HedgedWinsTotal,
+		m.RetryBudgetUtilization,
+		m.RetryBudgetExhaustedTotal,
+	)
+}
+
+// endpointLabels limits the number of distinct endpoint ID label values.
+type endpointLabels struct {
+	// allowed contains the endpoints allowed their own label. If empty all
+	// endpoints are allowed, up to maxEndpoints.
+	allowed map[string]struct{}
+
+	// maxEndpoints is the maximum number of distinct endpoints to label. If
+	// zero the number of endpoints is unlimited.
+	maxEndpoints int
+
+	// seen contains the endpoints that have been assigned their own label.
+	seen map[string]struct{}
+
+	mu sync.Mutex
+}
+
+func newEndpointLabels(conf config.ProxyMetricsConfig) *endpointLabels {
+	var allowed map[string]struct{}
+	if len(conf.Endpoints) > 0 {
+		allowed = make(map[string]struct{}, len(conf.Endpoints))
+		for _, endpointID := range conf.Endpoints {
+			allowed[endpointID] = struct{}{}
+		}
+	}
+	return &endpointLabels{
+		allowed:      allowed,
+		maxEndpoints: conf.MaxEndpoints,
+		seen:         make(map[string]struct{}),
+	}
+}
+
+func (l *endpointLabels) Label(endpointID string) string {
+	if l.allowed != nil {
+		if _, ok := l.allowed[endpointID]; ok {
+			return endpointID
+		}
+		return otherEndpointLabel
+	}
+	if l.maxEndpoints == 0 {
+		return endpointID
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[endpointID]; ok {
+		return endpointID
+	}
+	if len(l.seen) >= l.maxEndpoints {
+		return otherEndpointLabel
+	}
+	l.seen[endpointID] = struct{}{}
+	return endpointID
+}
+
+// countedConn counts the bytes read from and written to the connection.
+type countedConn struct {
+	net.Conn
+
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(float64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+const (
+	// forwardHeader is the header containing the forward key of the node
+	// the request is forwarded to, which authenticates the request as
+	// forwarded from another node in the cluster.
+	forwardHeader = "x-piko-forward"
+
+	// stickyKeyHeader is the header containing the sticky session key
+	// generated by the node forwarding the request, when the client didn't
+	// include a session key.
+	stickyKeyHeader = "x-piko-sticky-key"
+)
+
+// nodeTransport forwards requests to other Piko nodes.
+//
+// To avoid establishing a new connection for each forwarded request, it
+// maintains a pool of idle connections to each node, keyed by node ID. Idle
+// connections are closed after the configured idle timeout, or when the node
+// is evicted (such as when it leaves the cluster).
+type nodeTransport struct {
+	conf config.ForwardConfig
+
+	// pools contains the connection pool for each node, keyed by node ID.
+	pools map[string]*nodeConnPool
+
+	mu sync.Mutex
+}
+
+// nodeConnPool contains the connections to a single node.
+type nodeConnPool struct {
+	addr      string
+	transport *http.Transport
+	// http2Transport forwards requests for endpoints that use HTTP/2.
+	http2Transport *http2.Transport
+}
+
+func (p *nodeConnPool) CloseIdleConnections() {
+	p.transport.CloseIdleConnections()
+	p.http2Transport.CloseIdleConnections()
+}
+
+func newNodeTransport(conf config.ForwardConfig) *nodeTransport {
+	return &nodeTransport{
+		conf:  conf,
+		pools: make(map[string]*nodeConnPool),
+	}
+}
+
+// RoundTrip forwards the request to the node in the requests upstream.
+func (t *nodeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	node := r.Context().Value(upstreamContextKey).(*upstream.NodeUpstream)
+
+	// The request URL host is the endpoint ID, so replace it with the node
+	// address to share connections across endpoints. The 'Host' header is
+	// unchanged.
+	r = r.Clone(r.Context())
+	r.URL.Host = node.Addr()
+	// Set the forward key per node, since the request may be retried or
+	// hedged with an alternative node.
+	r.Header.Set(forwardHeader, node.ForwardKey())
+
+	pool := t.pool(node.NodeID(), node.Addr())
+	if useHTTP2(r) {
+		return pool.http2Transport.RoundTrip(r)
+	}
+	return pool.transport.RoundTrip(r)
+}
+
+// Evict closes the idle connections to the node with the given ID and
+// removes its pool.
+func (t *nodeTransport) Evict(nodeID string) {
+	t.mu.Lock()
+	pool, ok := t.pools[nodeID]
+	delete(t.pools, nodeID)
+	t.mu.Unlock()
+
+	if ok {
+		pool.CloseIdleConnections()
+	}
+}
+
+// pool returns the connection pool for the node with the given ID and
+// address, creating a new pool if it doesn't exist.
+func (t *nodeTransport) pool(nodeID string, addr string) *nodeConnPool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pool, ok := t.pools[nodeID]
+	if ok && pool.addr == addr {
+		return pool
+	}
+	if ok {
+		// If the node address has changed, connections to the old address
+		// are discarded.
+		pool.CloseIdleConnections()
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, &dialError{err: err}
+		}
+		return conn, nil
+	}
+	pool = &nodeConnPool{
+		addr: addr,
+		transport: &http.Transport{
+			DialContext:         dial,
+			DisableKeepAlives:   t.conf.MaxIdleConns == 0,
+			MaxIdleConns:        t.conf.MaxIdleConns,
+			MaxIdleConnsPerHost: t.conf.MaxIdleConns,
+			IdleConnTimeout:     t.conf.IdleTimeout,
+			// Forward responses unchanged rather than decompressing.
+			DisableCompression: true,
+		},
+		http2Transport: newNodeHTTP2Transport(dial),
+	}
+	t.pools[nodeID] = pool
+	return pool
+}
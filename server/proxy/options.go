@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type options struct {
+	tracerProvider   trace.TracerProvider
+	endpointResolver EndpointResolver
+	panicHook        middleware.PanicHook
+	endpointAccess   config.EndpointAccessConfig
+	forwardKey       string
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type tracerProviderOption struct {
+	provider trace.TracerProvider
+}
+
+func (o tracerProviderOption) apply(opts *options) {
+	opts.tracerProvider = o.provider
+}
+
+// WithTracerProvider configures the OpenTelemetry tracer provider used to
+// trace proxied requests.
+//
+// If not set (the default) requests are not traced.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return tracerProviderOption{provider: provider}
+}
+
+type endpointResolverOption struct {
+	resolver EndpointResolver
+}
+
+func (o endpointResolverOption) apply(opts *options) {
+	opts.endpointResolver = o.resolver
+}
+
+// WithEndpointResolver configures the resolver used to resolve the endpoint
+// ID of HTTP requests.
+//
+// If not set (the default) the endpoint ID is resolved from the
+// 'x-piko-endpoint' header or 'Host' header.
+func WithEndpointResolver(resolver EndpointResolver) Option {
+	return endpointResolverOption{resolver: resolver}
+}
+
+type panicHookOption struct {
+	hook middleware.PanicHook
+}
+
+func (o panicHookOption) apply(opts *options) {
+	opts.panicHook = o.hook
+}
+
+// WithPanicHook configures a hook called when a proxy handler panics, such
+// as to report the panic to an error tracking service. The hook is called
+// with the recovered value and stack trace before the request is aborted.
+//
+// If not set (the default) panics are only logged.
+func WithPanicHook(hook middleware.PanicHook) Option {
+	return panicHookOption{hook: hook}
+}
+
+type endpointAccessOption struct {
+	access config.EndpointAccessConfig
+}
+
+func (o endpointAccessOption) apply(opts *options) {
+	opts.endpointAccess = o.access
+}
+
+// WithEndpointAccess configures the endpoints the node serves. Requests for
+// endpoints that aren't permitted are rejected with '403 Forbidden'.
+//
+// If not set (the default) all endpoints are permitted.
+func WithEndpointAccess(access config.EndpointAccessConfig) Option {
+	return endpointAccessOption{access: access}
+}
+
+type forwardKeyOption struct {
+	key string
+}
+
+func (o forwardKeyOption) apply(opts *options) {
+	opts.forwardKey = o.key
+}
+
+// WithForwardKey configures the key used to authenticate requests forwarded
+// from other nodes in the cluster. Forwarded requests must include the key
+// in the 'x-piko-forward' header, otherwise they are handled as client
+// requests.
+//
+// If not set (the default) requests are never accepted as forwarded.
+func WithForwardKey(key string) Option {
+	return forwardKeyOption{key: key}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// tokenBucket limits the rate of requests, allowing bursts up to the bucket
+// size.
+type tokenBucket struct {
+	key string
+
+	tokens float64
+	// updatedAt is the time tokens was last updated.
+	updatedAt time.Time
+}
+
+// rateLimiter limits the rate of requests to each endpoint, optionally
+// keyed by client IP.
+//
+// To bound memory usage, the limiter tracks at most 'MaxKeys' buckets, and
+// evicts the least recently used bucket when exceeded.
+type rateLimiter struct {
+	conf config.RateLimitConfig
+
+	// endpoints contains configuration overrides for specific endpoints.
+	endpoints map[string]config.EndpointConfig
+
+	// buckets contains the elements in lru, keyed by bucket key.
+	buckets map[string]*list.Element
+	// lru contains the buckets ordered by last use, where the front is the
+	// most recently used.
+	lru *list.List
+
+	mu sync.Mutex
+
+	now func() time.Time
+}
+
+func newRateLimiter(
+	conf config.RateLimitConfig,
+	endpoints map[string]config.EndpointConfig,
+) *rateLimiter {
+	return &rateLimiter{
+		conf:      conf,
+		endpoints: endpoints,
+		buckets:   make(map[string]*list.Element),
+		lru:       list.New(),
+		now:       time.Now,
+	}
+}
+
+// Allow returns whether a request from the given client to the endpoint is
+// allowed. If not allowed, returns the duration until the next request
+// will be allowed.
+func (l *rateLimiter) Allow(endpointID string, clientIP string) (bool, time.Duration) {
+	rate, burst := l.limit(endpointID)
+	if rate == 0 {
+		return true, 0
+	}
+
+	key := endpointID
+	if l.conf.PerClient {
+		key = endpointID + "/" + clientIP
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket := l.bucket(key, burst, now)
+
+	bucket.tokens = math.Min(
+		float64(burst),
+		bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate,
+	)
+	bucket.updatedAt = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	retryAfter := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	return false, retryAfter
+}
+
+// limit returns the rate and burst for the endpoint.
+func (l *rateLimiter) limit(endpointID string) (float64, int) {
+	rate := l.conf.RequestsPerSecond
+	burst := l.conf.Burst
+	if override, ok := l.endpoints[endpointID]; ok {
+		if override.RateLimitRequestsPerSecond > 0 {
+			rate = override.RateLimitRequestsPerSecond
+		}
+		if override.RateLimitBurst > 0 {
+			burst = override.RateLimitBurst
+		}
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate, burst
+}
+
+// bucket returns the bucket with the given key, creating a full bucket if
+// it doesn't exist.
+//
+// Must be called with l.mu held.
+func (l *rateLimiter) bucket(key string, burst int, now time.Time) *tokenBucket {
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*tokenBucket)
+	}
+
+	bucket := &tokenBucket{
+		key:       key,
+		tokens:    float64(burst),
+		updatedAt: now,
+	}
+	l.buckets[key] = l.lru.PushFront(bucket)
+
+	for l.conf.MaxKeys > 0 && l.lru.Len() > l.conf.MaxKeys {
+		e := l.lru.Back()
+		l.lru.Remove(e)
+		delete(l.buckets, e.Value.(*tokenBucket).key)
+	}
+
+	return bucket
+}
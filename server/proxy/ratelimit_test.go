@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("burst", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{
+			RequestsPerSecond: 1,
+			Burst:             5,
+			MaxKeys:           10,
+		}, nil)
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		for i := 0; i != 5; i++ {
+			ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+			assert.True(t, ok)
+		}
+
+		ok, retryAfter := limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.False(t, ok)
+		assert.Equal(t, time.Second, retryAfter)
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{
+			RequestsPerSecond: 10,
+			Burst:             1,
+			MaxKeys:           10,
+		}, nil)
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.False(t, ok)
+
+		now = now.Add(time.Millisecond * 100)
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{}, nil)
+		for i := 0; i != 100; i++ {
+			ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+			assert.True(t, ok)
+		}
+	})
+
+	t.Run("endpoint override", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{
+			RequestsPerSecond: 1,
+			Burst:             1,
+			MaxKeys:           10,
+		}, map[string]config.EndpointConfig{
+			"my-endpoint": {
+				RateLimitBurst: 3,
+			},
+		})
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		for i := 0; i != 3; i++ {
+			ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+			assert.True(t, ok)
+		}
+		ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.False(t, ok)
+
+		ok, _ = limiter.Allow("other-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+		ok, _ = limiter.Allow("other-endpoint", "10.0.0.1")
+		assert.False(t, ok)
+	})
+
+	t.Run("per client", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{
+			RequestsPerSecond: 1,
+			Burst:             1,
+			PerClient:         true,
+			MaxKeys:           10,
+		}, nil)
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.False(t, ok)
+
+		// A different client has its own limit.
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.2")
+		assert.True(t, ok)
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		limiter := newRateLimiter(config.RateLimitConfig{
+			RequestsPerSecond: 1,
+			Burst:             1,
+			PerClient:         true,
+			MaxKeys:           2,
+		}, nil)
+		now := time.Now()
+		limiter.now = func() time.Time { return now }
+
+		ok, _ := limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.2")
+		assert.True(t, ok)
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.3")
+		assert.True(t, ok)
+
+		assert.Equal(t, 2, limiter.lru.Len())
+		// The least recently used client was evicted so has a full bucket.
+		ok, _ = limiter.Allow("my-endpoint", "10.0.0.1")
+		assert.True(t, ok)
+	})
+}
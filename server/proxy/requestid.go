@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+const (
+	// requestIDHeader is the header containing the request ID, which
+	// correlates the logs for a request across the proxy, any forwarding
+	// node and the upstream.
+	requestIDHeader = "X-Request-Id"
+
+	// maxRequestIDLen is the maximum length of a client supplied request ID.
+	// Longer IDs are replaced.
+	maxRequestIDLen = 128
+)
+
+// ensureRequestID returns the request ID of the request. If the request
+// doesn't have an ID, a new ID is generated and added to the request headers
+// so it is forwarded to the upstream.
+func ensureRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id != "" && len(id) <= maxRequestIDLen {
+		return id
+	}
+
+	id = newRequestID()
+	r.Header.Set(requestIDHeader, id)
+	return id
+}
+
+// newRequestID generates a random request ID.
+//
+// The ID is only used to correlate logs so doesn't need to be
+// cryptographically random.
+func newRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// requestLogger returns a logger that includes the request ID of the request,
+// if any.
+func requestLogger(logger log.Logger, r *http.Request) log.Logger {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		return logger
+	}
+	return logger.With(zap.String("request-id", id))
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+)
+
+// fieldsLogger is a fake logger that records the fields added with With.
+type fieldsLogger struct {
+	log.Logger
+
+	fields []zap.Field
+}
+
+func (l *fieldsLogger) With(fields ...zap.Field) log.Logger {
+	return &fieldsLogger{
+		Logger: l.Logger,
+		fields: append(append([]zap.Field{}, l.fields...), fields...),
+	}
+}
+
+func TestEnsureRequestID(t *testing.T) {
+	t.Run("generated", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		id := ensureRequestID(r)
+		assert.Len(t, id, 16)
+		assert.Equal(t, id, r.Header.Get(requestIDHeader))
+
+		// Each request has a unique ID.
+		assert.NotEqual(t, id, ensureRequestID(
+			httptest.NewRequest(http.MethodGet, "/", nil),
+		))
+	})
+
+	t.Run("preserved", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestIDHeader, "my-request")
+
+		assert.Equal(t, "my-request", ensureRequestID(r))
+		assert.Equal(t, "my-request", r.Header.Get(requestIDHeader))
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestIDHeader, strings.Repeat("a", maxRequestIDLen+1))
+
+		id := ensureRequestID(r)
+		assert.Len(t, id, 16)
+		assert.Equal(t, id, r.Header.Get(requestIDHeader))
+	})
+}
+
+func TestRequestLogger(t *testing.T) {
+	t.Run("request id", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(requestIDHeader, "my-request")
+
+		logger := requestLogger(&fieldsLogger{Logger: log.NewNopLogger()}, r)
+		assert.Equal(
+			t,
+			[]zap.Field{zap.String("request-id", "my-request")},
+			logger.(*fieldsLogger).fields,
+		)
+	})
+
+	t.Run("no request id", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		logger := requestLogger(&fieldsLogger{Logger: log.NewNopLogger()}, r)
+		assert.Empty(t, logger.(*fieldsLogger).fields)
+	})
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// endpointHeader is the header used to specify the endpoint ID.
+	endpointHeader = "x-piko-endpoint"
+)
+
+// EndpointResolver resolves the endpoint ID of a proxied HTTP request.
+type EndpointResolver interface {
+	// Resolve returns the endpoint ID of the request, or an empty string if
+	// the request doesn't specify an endpoint.
+	//
+	// Resolve may modify the request before it is forwarded, such as to strip
+	// the endpoint ID from the path.
+	Resolve(r *http.Request) string
+}
+
+// DefaultEndpointResolver resolves the endpoint ID from the 'x-piko-endpoint'
+// header, or if not set, the bottom-level domain of the 'Host' header.
+//
+// The 'x-piko-endpoint' header may contain a comma-separated list of
+// endpoint IDs in order of preference, which is returned as is.
+//
+// If configured with a base domain, the endpoint ID is instead the part of
+// the host before the base domain, which may contain multiple labels.
+type DefaultEndpointResolver struct {
+	// baseDomain is the domain to strip from the host, or empty to use the
+	// bottom-level domain.
+	baseDomain string
+}
+
+func NewDefaultEndpointResolver() *DefaultEndpointResolver {
+	return &DefaultEndpointResolver{}
+}
+
+// NewDefaultEndpointResolverWithBaseDomain returns a resolver that strips
+// the base domain from the host, such as with a base domain of
+// 'tunnels.example.com', 'team-a.service-b.tunnels.example.com' resolves to
+// 'team-a.service-b'.
+//
+// If the base domain is empty, this is equivalent to
+// NewDefaultEndpointResolver.
+func NewDefaultEndpointResolverWithBaseDomain(
+	baseDomain string,
+) *DefaultEndpointResolver {
+	return &DefaultEndpointResolver{
+		baseDomain: strings.ToLower(strings.Trim(baseDomain, ".")),
+	}
+}
+
+func (r *DefaultEndpointResolver) Resolve(req *http.Request) string {
+	endpointID := req.Header.Get(endpointHeader)
+	if endpointID != "" {
+		return endpointID
+	}
+
+	host := req.Host
+	// Strip the port if given.
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// An IP address doesn't contain an endpoint ID, such as when accessing
+	// the proxy directly.
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+
+	if r.baseDomain != "" {
+		// Hosts are case-insensitive and may be fully qualified.
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		endpointID, ok := strings.CutSuffix(host, "."+r.baseDomain)
+		if !ok {
+			return ""
+		}
+		return endpointID
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 || labels[0] == "" {
+		return ""
+	}
+
+	// If a host is given and contains a separator, use the bottom-level
+	// domain as the endpoint ID.
+	//
+	// Such as if the domain is 'xyz.piko.example.com', then 'xyz' is the
+	// endpoint ID.
+	return labels[0]
+}
+
+// splitEndpointIDs splits a comma-separated list of endpoint IDs, such as
+// 'primary,secondary', ignoring empty entries.
+func splitEndpointIDs(endpointID string) []string {
+	var endpointIDs []string
+	for _, id := range strings.Split(endpointID, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			endpointIDs = append(endpointIDs, id)
+		}
+	}
+	return endpointIDs
+}
+
+// HeaderEndpointResolver resolves the endpoint ID from a custom header.
+type HeaderEndpointResolver struct {
+	header string
+}
+
+func NewHeaderEndpointResolver(header string) *HeaderEndpointResolver {
+	return &HeaderEndpointResolver{
+		header: header,
+	}
+}
+
+func (r *HeaderEndpointResolver) Resolve(req *http.Request) string {
+	return req.Header.Get(r.header)
+}
+
+// PathPrefixEndpointResolver resolves the endpoint ID from the first segment
+// of the request path, then strips the endpoint ID from the path before the
+// request is forwarded.
+//
+// Such as a request to '/my-endpoint/foo/bar' is forwarded to endpoint
+// 'my-endpoint' with path '/foo/bar'.
+type PathPrefixEndpointResolver struct {
+}
+
+func NewPathPrefixEndpointResolver() *PathPrefixEndpointResolver {
+	return &PathPrefixEndpointResolver{}
+}
+
+func (r *PathPrefixEndpointResolver) Resolve(req *http.Request) string {
+	endpointID, path := splitPathPrefix(req.URL.Path)
+	if endpointID == "" {
+		return ""
+	}
+	req.URL.Path = path
+
+	if req.URL.RawPath != "" {
+		// Keep the escaped path consistent with the path.
+		_, rawPath := splitPathPrefix(req.URL.RawPath)
+		req.URL.RawPath = rawPath
+	}
+
+	return endpointID
+}
+
+// splitPathPrefix splits the first segment from the path, such as
+// '/my-endpoint/foo' returns 'my-endpoint' and '/foo'.
+func splitPathPrefix(path string) (string, string) {
+	prefix, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return prefix, "/" + rest
+}
+
+var _ EndpointResolver = &DefaultEndpointResolver{}
+var _ EndpointResolver = &HeaderEndpointResolver{}
+var _ EndpointResolver = &PathPrefixEndpointResolver{}
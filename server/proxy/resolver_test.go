@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultEndpointResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		header     string
+		endpointID string
+	}{
+		{
+			name:       "host",
+			host:       "my-endpoint.piko.com",
+			endpointID: "my-endpoint",
+		},
+		{
+			name:       "host with port",
+			host:       "my-endpoint.piko.com:9000",
+			endpointID: "my-endpoint",
+		},
+		{
+			name: "ipv4",
+			host: "127.0.0.1",
+		},
+		{
+			name: "ipv4 with port",
+			host: "127.0.0.1:8000",
+		},
+		{
+			name: "ipv6",
+			host: "[::1]",
+		},
+		{
+			name: "ipv6 with port",
+			host: "[2001:db8::1]:8000",
+		},
+		{
+			name: "single label",
+			host: "localhost",
+		},
+		{
+			name: "single label with port",
+			host: "localhost:9000",
+		},
+		{
+			name: "empty label",
+			host: ".piko.com",
+		},
+		{
+			name: "no host",
+		},
+		{
+			// Even though the host header is provided, 'x-piko-endpoint'
+			// takes precedence.
+			name:       "x-piko-endpoint header",
+			host:       "another-endpoint.piko.com:9000",
+			header:     "my-endpoint",
+			endpointID: "my-endpoint",
+		},
+		{
+			name:       "x-piko-endpoint header with ip",
+			host:       "127.0.0.1:8000",
+			header:     "my-endpoint",
+			endpointID: "my-endpoint",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.header != "" {
+				header.Add("x-piko-endpoint", tt.header)
+			}
+			endpointID := NewDefaultEndpointResolver().Resolve(&http.Request{
+				Host:   tt.host,
+				Header: header,
+			})
+			assert.Equal(t, tt.endpointID, endpointID)
+		})
+	}
+}
+
+func TestDefaultEndpointResolver_BaseDomain(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		header     string
+		endpointID string
+	}{
+		{
+			name:       "single label",
+			host:       "my-endpoint.tunnels.example.com",
+			endpointID: "my-endpoint",
+		},
+		{
+			name:       "multiple labels",
+			host:       "team-a.service-b.tunnels.example.com",
+			endpointID: "team-a.service-b",
+		},
+		{
+			name:       "multiple labels with port",
+			host:       "team-a.service-b.tunnels.example.com:8000",
+			endpointID: "team-a.service-b",
+		},
+		{
+			name:       "case insensitive",
+			host:       "Team-A.Tunnels.Example.COM",
+			endpointID: "team-a",
+		},
+		{
+			name:       "fully qualified",
+			host:       "my-endpoint.tunnels.example.com.",
+			endpointID: "my-endpoint",
+		},
+		{
+			name: "base domain",
+			host: "tunnels.example.com",
+		},
+		{
+			// The base domain must match complete labels.
+			name: "partial label",
+			host: "my-endpoint.othertunnels.example.com",
+		},
+		{
+			name: "outside base domain",
+			host: "my-endpoint.example.com",
+		},
+		{
+			name: "ip",
+			host: "127.0.0.1:8000",
+		},
+		{
+			name:       "x-piko-endpoint header",
+			host:       "team-a.service-b.tunnels.example.com",
+			header:     "my-endpoint",
+			endpointID: "my-endpoint",
+		},
+	}
+
+	resolver := NewDefaultEndpointResolverWithBaseDomain("tunnels.example.com")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.header != "" {
+				header.Add("x-piko-endpoint", tt.header)
+			}
+			endpointID := resolver.Resolve(&http.Request{
+				Host:   tt.host,
+				Header: header,
+			})
+			assert.Equal(t, tt.endpointID, endpointID)
+		})
+	}
+
+	t.Run("empty base domain", func(t *testing.T) {
+		endpointID := NewDefaultEndpointResolverWithBaseDomain("").Resolve(&http.Request{
+			Host:   "team-a.service-b.tunnels.example.com",
+			Header: make(http.Header),
+		})
+		assert.Equal(t, "team-a", endpointID)
+	})
+}
+
+func TestSplitEndpointIDs(t *testing.T) {
+	assert.Equal(t, []string{"my-endpoint"}, splitEndpointIDs("my-endpoint"))
+	assert.Equal(
+		t,
+		[]string{"primary", "secondary", "tertiary"},
+		splitEndpointIDs("primary, secondary,,tertiary "),
+	)
+	assert.Empty(t, splitEndpointIDs(""))
+	assert.Empty(t, splitEndpointIDs(" , "))
+}
+
+func TestHeaderEndpointResolver(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		header := make(http.Header)
+		header.Add("x-tenant", "my-endpoint")
+		endpointID := NewHeaderEndpointResolver("X-Tenant").Resolve(&http.Request{
+			Host:   "another-endpoint.piko.com",
+			Header: header,
+		})
+		assert.Equal(t, "my-endpoint", endpointID)
+	})
+
+	// Tests the resolver ignores the default 'x-piko-endpoint' header and
+	// 'Host' header.
+	t.Run("missing header", func(t *testing.T) {
+		header := make(http.Header)
+		header.Add("x-piko-endpoint", "my-endpoint")
+		endpointID := NewHeaderEndpointResolver("X-Tenant").Resolve(&http.Request{
+			Host:   "another-endpoint.piko.com",
+			Header: header,
+		})
+		assert.Equal(t, "", endpointID)
+	})
+}
+
+func TestPathPrefixEndpointResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		endpointID string
+		// strippedPath is the request path after the endpoint ID is
+		// stripped.
+		strippedPath string
+	}{
+		{
+			name:         "path",
+			path:         "/my-endpoint/foo/bar",
+			endpointID:   "my-endpoint",
+			strippedPath: "/foo/bar",
+		},
+		{
+			name:         "trailing slash",
+			path:         "/my-endpoint/",
+			endpointID:   "my-endpoint",
+			strippedPath: "/",
+		},
+		{
+			name:         "endpoint only",
+			path:         "/my-endpoint",
+			endpointID:   "my-endpoint",
+			strippedPath: "/",
+		},
+		{
+			name:         "root",
+			path:         "/",
+			strippedPath: "/",
+		},
+		{
+			name:         "empty segment",
+			path:         "//foo",
+			strippedPath: "//foo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{
+				URL: &url.URL{Path: tt.path},
+			}
+			endpointID := NewPathPrefixEndpointResolver().Resolve(r)
+			assert.Equal(t, tt.endpointID, endpointID)
+			assert.Equal(t, tt.strippedPath, r.URL.Path)
+		})
+	}
+
+	t.Run("escaped path", func(t *testing.T) {
+		u, err := url.Parse("http://piko.com/my-endpoint/foo%2Fbar")
+		require.NoError(t, err)
+
+		r := &http.Request{URL: u}
+		endpointID := NewPathPrefixEndpointResolver().Resolve(r)
+		assert.Equal(t, "my-endpoint", endpointID)
+		assert.Equal(t, "/foo/bar", r.URL.Path)
+		assert.Equal(t, "/foo%2Fbar", r.URL.RawPath)
+	})
+}
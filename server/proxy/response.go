@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// responseBuffer is a http.ResponseWriter that buffers the response in
+// memory.
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{
+		header: make(http.Header),
+	}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(statusCode int) {
+	// Ignore informational responses, such as '103 Early Hints', which
+	// precede the final response.
+	if statusCode >= 100 && statusCode < 200 &&
+		statusCode != http.StatusSwitchingProtocols {
+		return
+	}
+	if b.statusCode != 0 {
+		return
+	}
+	b.statusCode = statusCode
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.body.Write(p)
+}
+
+// Flush is a no-op as the response is buffered.
+func (b *responseBuffer) Flush() {
+}
+
+// Response returns the buffered response to the given request.
+func (b *responseBuffer) Response(r *http.Request) *http.Response {
+	statusCode := b.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        b.header,
+		Body:          io.NopCloser(bytes.NewReader(b.body.Bytes())),
+		ContentLength: int64(b.body.Len()),
+		Request:       r,
+	}
+}
+
+var _ http.Flusher = &responseBuffer{}
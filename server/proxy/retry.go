@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// dialError indicates the connection to the upstream could not be
+// established, so the request was never sent.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return "dial: " + e.err.Error()
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+// retryTransport retries requests forwarded to a remote node that fail due
+// to a transport error using an alternative node with the endpoint.
+//
+// Requests are never retried if the node responds, even if the response
+// has a 5xx status, or if the retry budget is exhausted.
+type retryTransport struct {
+	// transport forwards requests to upstreams connected to this node.
+	transport http.RoundTripper
+	// nodeTransport forwards requests to other nodes.
+	nodeTransport http.RoundTripper
+
+	maxAttempts int
+	allMethods  bool
+
+	// budget limits the number of retries.
+	budget *retryBudget
+
+	logger log.Logger
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, _ := r.Context().Value(upstreamContextKey).(upstream.Upstream)
+
+	if _, ok := u.(*upstream.NodeUpstream); ok {
+		t.budget.Deposit()
+
+		// The transport closes the request body when the request fails,
+		// so wrap the body to replay it to an alternative node.
+		if r.Body != nil && r.Body != http.NoBody {
+			r = r.Clone(r.Context())
+			r.Body = &replayableBody{body: r.Body}
+		}
+	}
+
+	attempt := 1
+	for {
+		nodeUpstream, ok := u.(*upstream.NodeUpstream)
+		if !ok {
+			// Only forwarded requests are retried.
+			return t.transport.RoundTrip(r)
+		}
+
+		resp, err := t.nodeTransport.RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= t.maxAttempts || r.Context().Err() != nil {
+			return nil, err
+		}
+		if !t.retryable(r, err) {
+			return nil, err
+		}
+		next, ok := nodeUpstream.Next()
+		if !ok {
+			return nil, err
+		}
+		if !t.budget.Withdraw() {
+			requestLogger(t.logger, r).Warn(
+				"forward request failed; retry budget exhausted",
+				zap.String("node-id", nodeUpstream.NodeID()),
+				zap.Int("attempt", attempt),
+				zap.Error(err),
+			)
+			return nil, err
+		}
+
+		requestLogger(t.logger, r).Warn(
+			"forward request failed; retrying with alternative node",
+			zap.String("node-id", nodeUpstream.NodeID()),
+			zap.String("alternative-node-id", next.NodeID()),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+
+		u = next
+		r = r.WithContext(context.WithValue(r.Context(), upstreamContextKey, u))
+		attempt++
+	}
+}
+
+// retryable returns whether the request can be safely retried after failing
+// with the given error.
+func (t *retryTransport) retryable(r *http.Request, err error) bool {
+	// If we failed to connect the request was never sent so can be retried,
+	// as long as none of the body was read.
+	var dialErr *dialError
+	if errors.As(err, &dialErr) {
+		body, ok := r.Body.(*replayableBody)
+		return !ok || !body.read.Load()
+	}
+
+	// Otherwise the request may have been partially sent so we can only
+	// retry if there is no body to replay.
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	return t.allMethods || isIdempotent(r.Method)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// replayableBody wraps a request body so it can be resent to an alternative
+// node if the request failed before the body was read.
+//
+// The transport closes the body when the request fails, so closing is a
+// no-op until the body has been read. Otherwise the body is closed by the
+// server once the request completes.
+type replayableBody struct {
+	body io.ReadCloser
+
+	// read indicates whether any of the body has been read.
+	read atomic.Bool
+}
+
+func (b *replayableBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.body.Read(p)
+}
+
+func (b *replayableBody) Close() error {
+	if !b.read.Load() {
+		return nil
+	}
+	return b.body.Close()
+}
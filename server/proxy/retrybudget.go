@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+// retryBudget limits the number of retries and hedged requests to a ratio
+// of the requests forwarded to other nodes, so when many requests fail,
+// retries don't amplify the load on the cluster.
+//
+// The budget is a token bucket, where each forwarded request adds 'ratio'
+// tokens and each retry takes a token. The bucket starts full and holds at
+// most 'burst' tokens.
+type retryBudget struct {
+	ratio float64
+	burst float64
+
+	tokens float64
+
+	mu sync.Mutex
+
+	metrics *Metrics
+}
+
+func newRetryBudget(conf config.RetryConfig, metrics *Metrics) *retryBudget {
+	return &retryBudget{
+		ratio:   conf.BudgetRatio,
+		burst:   float64(conf.BudgetBurst),
+		tokens:  float64(conf.BudgetBurst),
+		metrics: metrics,
+	}
+}
+
+// Deposit adds to the budget for a request forwarded to another node.
+func (b *retryBudget) Deposit() {
+	if b.ratio == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+b.ratio)
+	b.updateMetricsLocked()
+}
+
+// Withdraw returns whether a retry is allowed within the budget, and if so
+// takes the retry from the budget.
+func (b *retryBudget) Withdraw() bool {
+	if b.ratio == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Allow for floating point error when adding fractional tokens, such as
+	// adding 0.1 ten times.
+	if b.tokens < 1-1e-9 {
+		b.metrics.RetryBudgetExhaustedTotal.Inc()
+		return false
+	}
+	b.tokens = math.Max(0, b.tokens-1)
+	b.updateMetricsLocked()
+	return true
+}
+
+func (b *retryBudget) updateMetricsLocked() {
+	b.metrics.RetryBudgetUtilization.Set(1 - b.tokens/b.burst)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Run("within budget", func(t *testing.T) {
+		metrics := NewMetrics(config.ProxyMetricsConfig{})
+		budget := newRetryBudget(config.RetryConfig{
+			BudgetRatio: 0.1,
+			BudgetBurst: 2,
+		}, metrics)
+
+		// The budget starts full.
+		assert.True(t, budget.Withdraw())
+		assert.True(t, budget.Withdraw())
+		assert.False(t, budget.Withdraw())
+
+		// Every 10 requests allow another retry.
+		for i := 0; i != 10; i++ {
+			budget.Deposit()
+		}
+		assert.True(t, budget.Withdraw())
+		assert.False(t, budget.Withdraw())
+
+		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.RetryBudgetExhaustedTotal))
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		metrics := NewMetrics(config.ProxyMetricsConfig{})
+		budget := newRetryBudget(config.RetryConfig{
+			BudgetRatio: 0.5,
+			BudgetBurst: 2,
+		}, metrics)
+
+		// Deposits don't exceed the burst.
+		for i := 0; i != 100; i++ {
+			budget.Deposit()
+		}
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.RetryBudgetUtilization))
+
+		assert.True(t, budget.Withdraw())
+		assert.Equal(t, 0.5, testutil.ToFloat64(metrics.RetryBudgetUtilization))
+		assert.True(t, budget.Withdraw())
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RetryBudgetUtilization))
+		assert.False(t, budget.Withdraw())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		metrics := NewMetrics(config.ProxyMetricsConfig{})
+		budget := newRetryBudget(config.RetryConfig{}, metrics)
+
+		for i := 0; i != 100; i++ {
+			assert.True(t, budget.Withdraw())
+		}
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.RetryBudgetExhaustedTotal))
+	})
+}
@@ -6,44 +6,74 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
 
+const (
+	// maintenanceRetryAfter is the 'Retry-After' duration returned to
+	// clients when the node is in maintenance mode.
+	maintenanceRetryAfter = time.Second * 30
+)
+
 type Server struct {
 	httpProxy *HTTPProxy
 	tcpProxy  *TCPProxy
 
 	httpServer *http.Server
 
+	// maintenance indicates whether the node is in maintenance mode, where
+	// all proxy requests are rejected.
+	maintenance *atomic.Bool
+
 	logger log.Logger
 }
 
 func NewServer(
 	upstreams upstream.Manager,
 	proxyConfig config.ProxyConfig,
+	verifier auth.Verifier,
 	registry *prometheus.Registry,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("proxy")
 
-	httpProxy := NewHTTPProxy(upstreams, proxyConfig.Timeout, logger)
+	httpProxy := NewHTTPProxy(upstreams, proxyConfig, verifier, logger, opts...)
+	if registry != nil {
+		httpProxy.Metrics().Register(registry)
+	}
 
 	router := gin.New()
 	s := &Server{
 		httpProxy: httpProxy,
 		tcpProxy:  NewTCPProxy(upstreams, httpProxy, logger),
 		httpServer: &http.Server{
-			Handler:           router,
+			// Accept cleartext HTTP/2 (h2c) as well as HTTP/1.1. HTTP/2 over
+			// TLS is negotiated with ALPN.
+			Handler: h2c.NewHandler(router, &http2.Server{
+				IdleTimeout: proxyConfig.HTTP.IdleTimeout,
+			}),
 			TLSConfig:         tlsConfig,
 			ReadTimeout:       proxyConfig.HTTP.ReadTimeout,
 			ReadHeaderTimeout: proxyConfig.HTTP.ReadHeaderTimeout,
@@ -52,20 +82,24 @@ func NewServer(
 			MaxHeaderBytes:    proxyConfig.HTTP.MaxHeaderBytes,
 			ErrorLog:          logger.StdLogger(zapcore.WarnLevel),
 		},
-		logger: logger,
+		maintenance: atomic.NewBool(false),
+		logger:      logger,
 	}
 
-	// Recover from panics.
-	router.Use(gin.CustomRecoveryWithWriter(nil, s.panicRoute))
-
-	router.Use(middleware.NewLogger(proxyConfig.AccessLog, logger))
-
 	metrics := middleware.NewMetrics("proxy")
 	if registry != nil {
 		metrics.Register(registry)
 	}
+
+	// Recover from panics.
+	router.Use(middleware.NewRecovery(logger, metrics, options.panicHook))
+
+	router.Use(middleware.NewLogger(proxyConfig.AccessLog, logger))
+
 	router.Use(metrics.Handler())
 
+	router.Use(s.maintenanceInterceptor)
+
 	s.registerRoutes(router)
 
 	return s
@@ -97,6 +131,37 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// SetMaintenance sets whether the node is in maintenance mode.
+//
+// When in maintenance mode, all proxy requests are rejected with a
+// '503 Service Unavailable' response.
+func (s *Server) SetMaintenance(maintenance bool) {
+	if s.maintenance.Swap(maintenance) == maintenance {
+		return
+	}
+	if maintenance {
+		s.logger.Info("maintenance mode enabled")
+	} else {
+		s.logger.Info("maintenance mode disabled")
+	}
+}
+
+// Maintenance returns whether the node is in maintenance mode.
+func (s *Server) Maintenance() bool {
+	return s.maintenance.Load()
+}
+
+// EvictNode closes any idle connections used to forward requests to the node
+// with the given ID.
+func (s *Server) EvictNode(nodeID string) {
+	s.httpProxy.EvictNode(nodeID)
+}
+
+// Inflight returns a snapshot of the requests currently being proxied.
+func (s *Server) Inflight() InflightStatus {
+	return s.httpProxy.Inflight()
+}
+
 func (s *Server) registerRoutes(router *gin.Engine) {
 	// All /_piko routes are reserved.
 	piko := router.Group("/_piko")
@@ -115,13 +180,22 @@ func (s *Server) proxyTCPRoute(c *gin.Context) {
 	s.tcpProxy.ServeHTTP(c.Writer, c.Request, endpointID)
 }
 
-func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
+// maintenanceInterceptor rejects all requests when the node is in
+// maintenance mode.
+func (s *Server) maintenanceInterceptor(c *gin.Context) {
+	if !s.maintenance.Load() {
+		c.Next()
+		return
+	}
+
+	c.Header(
+		"Retry-After",
+		strconv.Itoa(int(maintenanceRetryAfter.Seconds())),
+	)
+	s.httpProxy.writeError(
+		c.Writer, c.Request, http.StatusServiceUnavailable, "maintenance",
 	)
-	c.AbortWithStatus(http.StatusInternalServerError)
+	c.Abort()
 }
 
 func init() {
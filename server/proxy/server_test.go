@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestServer_Maintenance(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer upstreamServer.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return &tcpUpstream{
+					addr: upstreamServer.Listener.Addr().String(),
+				}, true
+			},
+		},
+		config.ProxyConfig{Timeout: time.Second},
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	request := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Enable maintenance mode.
+
+	s.SetMaintenance(true)
+	assert.True(t, s.Maintenance())
+
+	resp = request()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+	b, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"error":"maintenance"}`, string(b))
+
+	// Disable maintenance mode.
+
+	s.SetMaintenance(false)
+	assert.False(t, s.Maintenance())
+
+	resp = request()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServer_ErrorResponses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewServer(
+		&fakeManager{
+			handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+				return nil, false
+			},
+		},
+		config.ProxyConfig{
+			Timeout: time.Second,
+			ErrorResponses: []config.ErrorResponseConfig{
+				{
+					StatusCode:  http.StatusServiceUnavailable,
+					ContentType: "text/html; charset=utf-8",
+					Body:        "<h1>{{.StatusCode}} {{.Status}}</h1><p>{{.EndpointID}} ({{.RequestID}}): {{.Message}}</p>",
+				},
+			},
+		},
+		nil,
+		nil,
+		nil,
+		log.NewNopLogger(),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	request := func(endpointID string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		req.Header.Add("x-piko-endpoint", endpointID)
+		req.Header.Add("x-request-id", "my-request")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("html template", func(t *testing.T) {
+		s.SetMaintenance(true)
+		defer s.SetMaintenance(false)
+
+		resp := request("my-endpoint")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(
+			t,
+			"<h1>503 Service Unavailable</h1><p>my-endpoint (my-request): maintenance</p>",
+			string(b),
+		)
+	})
+
+	t.Run("html escaped", func(t *testing.T) {
+		s.SetMaintenance(true)
+		defer s.SetMaintenance(false)
+
+		resp := request("<b>my-endpoint</b>")
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), "&lt;b&gt;my-endpoint&lt;/b&gt;")
+	})
+
+	t.Run("default", func(t *testing.T) {
+		// Status codes without a template use the default JSON response.
+		resp := request("my-endpoint")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"error":"no available upstreams"}`, string(b))
+	})
+}
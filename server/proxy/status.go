@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andydunstall/piko/server/status"
+)
+
+// MaintenanceStatus contains whether the node is in maintenance mode.
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+type Status struct {
+	server *Server
+}
+
+func NewStatus(server *Server) *Status {
+	return &Status{
+		server: server,
+	}
+}
+
+func (s *Status) Register(group *gin.RouterGroup) {
+	group.GET("/maintenance", s.maintenanceRoute)
+	group.PUT("/maintenance", s.setMaintenanceRoute)
+	group.GET("/inflight", s.inflightRoute)
+}
+
+func (s *Status) maintenanceRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, &MaintenanceStatus{
+		Enabled: s.server.Maintenance(),
+	})
+}
+
+// inflightRoute returns the requests currently being proxied by the node.
+func (s *Status) inflightRoute(c *gin.Context) {
+	c.JSON(http.StatusOK, s.server.Inflight())
+}
+
+// setMaintenanceRoute enables or disables maintenance mode.
+func (s *Status) setMaintenanceRoute(c *gin.Context) {
+	var req MaintenanceStatus
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	s.server.SetMaintenance(req.Enabled)
+
+	c.JSON(http.StatusOK, &MaintenanceStatus{
+		Enabled: s.server.Maintenance(),
+	})
+}
+
+var _ status.Handler = &Status{}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -42,7 +43,25 @@ func NewTCPProxy(
 }
 
 func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID string) {
-	forwarded := r.Header.Get("x-piko-forward") == "true"
+	forwarded := p.httpProxy.isForwarded(r)
+
+	if !p.httpProxy.endpointAccess.Permitted(endpointID) {
+		p.logger.Warn(
+			"endpoint not permitted on node",
+			zap.String("endpoint-id", endpointID),
+		)
+
+		p.httpProxy.proxyError(
+			w, r, http.StatusForbidden, ErrEndpointNotPermitted,
+		)
+		return
+	}
+
+	// Requests forwarded from another node have already been authenticated
+	// by that node.
+	if !forwarded && !p.httpProxy.authenticate(w, r, endpointID) {
+		return
+	}
 
 	// If there is a connected upstream, attempt to forward the request to one
 	// of those upstreams. Note this includes remote nodes that are reporting
@@ -55,7 +74,7 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 			zap.String("endpoint-id", endpointID),
 		)
 
-		_ = errorResponse(w, http.StatusBadGateway, "no available upstreams")
+		p.httpProxy.proxyError(w, r, http.StatusBadGateway, ErrEndpointNotFound)
 		return
 	}
 
@@ -70,10 +89,14 @@ func (p *TCPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, endpointID
 
 	upstreamConn, err := u.Dial()
 	if err != nil {
-		_ = errorResponse(w, http.StatusBadGateway, "upstream unreachable")
+		p.httpProxy.proxyError(
+			w, r, http.StatusBadGateway,
+			fmt.Errorf("%w: %w", ErrEndpointUnreachable, err),
+		)
 		return
 	}
 	defer upstreamConn.Close()
+	upstreamConn = p.httpProxy.metrics.countBytes(upstreamConn, endpointID)
 
 	wsConn, err := p.websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -10,10 +10,12 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/auth"
 	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/server/upstream"
 )
@@ -60,6 +62,7 @@ func TestTCPProxy_Forward(t *testing.T) {
 			config.ProxyConfig{},
 			nil,
 			nil,
+			nil,
 			log.NewNopLogger(),
 		)
 
@@ -88,6 +91,14 @@ func TestTCPProxy_Forward(t *testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, 3, n)
 		}
+
+		bytesTotal := server.httpProxy.Metrics().EndpointBytesTotal
+		assert.Equal(t, 30.0, testutil.ToFloat64(
+			bytesTotal.WithLabelValues("my-endpoint", "out"),
+		))
+		assert.Equal(t, 30.0, testutil.ToFloat64(
+			bytesTotal.WithLabelValues("my-endpoint", "in"),
+		))
 	})
 
 	t.Run("upstream unreachable", func(t *testing.T) {
@@ -101,7 +112,7 @@ func TestTCPProxy_Forward(t *testing.T) {
 					}, true
 				},
 			},
-			nil,
+			NewHTTPProxy(nil, config.ProxyConfig{}, nil, log.NewNopLogger()),
 			log.NewNopLogger(),
 		)
 
@@ -129,7 +140,7 @@ func TestTCPProxy_Forward(t *testing.T) {
 					return nil, false
 				},
 			},
-			nil,
+			NewHTTPProxy(nil, config.ProxyConfig{}, nil, log.NewNopLogger()),
 			log.NewNopLogger(),
 		)
 
@@ -147,4 +158,95 @@ func TestTCPProxy_Forward(t *testing.T) {
 		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
 		assert.Equal(t, "no available upstreams", m.Error)
 	})
+
+	t.Run("endpoint not permitted", func(t *testing.T) {
+		proxy := NewTCPProxy(
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					t.Fatal("upstream selected")
+					return nil, false
+				},
+			},
+			NewHTTPProxy(
+				nil,
+				config.ProxyConfig{},
+				nil,
+				log.NewNopLogger(),
+				WithEndpointAccess(config.EndpointAccessConfig{
+					Deny: []string{"my-*"},
+				}),
+			),
+			log.NewNopLogger(),
+		)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r, "my-endpoint")
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		m := errorMessage{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		assert.Equal(t, "endpoint not permitted on this node", m.Error)
+	})
+}
+
+func TestTCPProxy_Auth(t *testing.T) {
+	newProxy := func(t *testing.T, forwarded bool) *TCPProxy {
+		return NewTCPProxy(
+			&fakeManager{
+				handler: func(_ string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, !forwarded, allowForward)
+					return nil, false
+				},
+			},
+			NewHTTPProxy(
+				nil,
+				config.ProxyConfig{},
+				auth.NewJWTVerifier(auth.JWTVerifierConfig{
+					HMACSecretKey: []byte("secret-key"),
+				}),
+				log.NewNopLogger(),
+				WithForwardKey("my-key"),
+			),
+			log.NewNopLogger(),
+		)
+	}
+
+	t.Run("missing authorization", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		w := httptest.NewRecorder()
+		newProxy(t, false).ServeHTTP(w, r, "my-endpoint")
+
+		assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		// Clients can't bypass authentication by claiming the connection
+		// was forwarded from another node.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-forward", "true")
+
+		w := httptest.NewRecorder()
+		newProxy(t, false).ServeHTTP(w, r, "my-endpoint")
+
+		assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	})
+
+	t.Run("forwarded with key", func(t *testing.T) {
+		// Connections forwarded from another node are authenticated by
+		// that node, and only forwarded to local upstreams.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("x-piko-forward", "my-key")
+
+		w := httptest.NewRecorder()
+		newProxy(t, true).ServeHTTP(w, r, "my-endpoint")
+
+		assert.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	})
 }
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/log"
+	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+// TCPServer accepts raw TCP connections and tunnels them to an upstream
+// listener for a single endpoint.
+//
+// Unlike TCPProxy, clients connect with plain TCP rather than WebSockets, so
+// the endpoint is selected by the port the client connects to.
+type TCPServer struct {
+	endpointID string
+
+	upstreams upstream.Manager
+
+	// timeout is the timeout to connect to the upstream.
+	timeout time.Duration
+
+	// ln is the listener passed to Serve. Guarded by mu, since Close may
+	// be called concurrently with Serve.
+	ln net.Listener
+	// closed indicates whether the server has been closed.
+	closed bool
+
+	conns map[net.Conn]struct{}
+
+	mu sync.Mutex
+
+	logger log.Logger
+}
+
+func NewTCPServer(
+	endpointID string,
+	upstreams upstream.Manager,
+	timeout time.Duration,
+	logger log.Logger,
+) *TCPServer {
+	logger = logger.WithSubsystem("proxy.tcp")
+	logger = logger.With(zap.String("endpoint-id", endpointID))
+
+	return &TCPServer{
+		endpointID: endpointID,
+		upstreams:  upstreams,
+		timeout:    timeout,
+		conns:      make(map[net.Conn]struct{}),
+		logger:     logger,
+	}
+}
+
+func (s *TCPServer) EndpointID() string {
+	return s.endpointID
+}
+
+func (s *TCPServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	s.logger.Info(
+		"starting tcp proxy server",
+		zap.String("addr", ln.Addr().String()),
+	)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		if !s.addConn(conn) {
+			// The server was closed after accepting the connection.
+			conn.Close()
+			return nil
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes all active connections.
+func (s *TCPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *TCPServer) serveConn(c net.Conn) {
+	defer s.removeConn(c)
+	defer c.Close()
+
+	upstreamConn, err := s.dialUpstream()
+	if err != nil {
+		s.logger.Warn("failed to dial upstream", zap.Error(err))
+		return
+	}
+	defer upstreamConn.Close()
+
+	forward(c, upstreamConn)
+}
+
+func (s *TCPServer) dialUpstream() (net.Conn, error) {
+	u, ok := s.upstreams.Select(s.endpointID, true)
+	if !ok {
+		return nil, ErrEndpointNotFound
+	}
+
+	if !u.Forward() {
+		conn, err := u.Dial()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrEndpointUnreachable, err)
+		}
+		return conn, nil
+	}
+
+	// If the upstream is a remote node, connect to the nodes TCP proxy
+	// using a WebSocket. The remote node won't forward the connection again
+	// since the 'x-piko-forward' header is set to the nodes forward key.
+	dialer := &websocket.Dialer{
+		NetDialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return u.Dial()
+		},
+		HandshakeTimeout: s.timeout,
+	}
+	header := make(http.Header)
+	if node, ok := u.(*upstream.NodeUpstream); ok {
+		header.Set(forwardHeader, node.ForwardKey())
+	}
+	wsConn, resp, err := dialer.Dial(
+		"ws://"+s.endpointID+"/_piko/v1/tcp/"+s.endpointID, header,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dial node: %w", ErrEndpointUnreachable, err)
+	}
+	resp.Body.Close()
+	return pikowebsocket.New(wsConn), nil
+}
+
+// addConn adds the connection to the active connections. Returns false if
+// the server is closed.
+func (s *TCPServer) addConn(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *TCPServer) removeConn(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
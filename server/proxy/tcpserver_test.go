@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestTCPServer(t *testing.T) {
+	t.Run("forward", func(t *testing.T) {
+		echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer echoLn.Close()
+
+		go echoListener(echoLn)
+
+		server := NewTCPServer(
+			"my-endpoint",
+			&fakeManager{
+				handler: func(endpointID string, allowForward bool) (upstream.Upstream, bool) {
+					assert.Equal(t, "my-endpoint", endpointID)
+					assert.True(t, allowForward)
+					return &tcpUpstream{
+						addr: echoLn.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			log.NewNopLogger(),
+		)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		serveErrCh := make(chan error, 1)
+		go func() {
+			serveErrCh <- server.Serve(ln)
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		buf := make([]byte, 512)
+		for i := 0; i != 10; i++ {
+			_, err = conn.Write([]byte("foo"))
+			require.NoError(t, err)
+
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, "foo", string(buf[:n]))
+		}
+
+		// Closing the server closes the active connection.
+		require.NoError(t, server.Close())
+		assert.NoError(t, <-serveErrCh)
+
+		_, err = conn.Read(buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("close concurrently", func(t *testing.T) {
+		server := NewTCPServer(
+			"my-endpoint", &fakeManager{}, time.Second, log.NewNopLogger(),
+		)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		serveErrCh := make(chan error, 1)
+		go func() {
+			serveErrCh <- server.Serve(ln)
+		}()
+		// Close may be called before or after Serve starts, so must not
+		// race with Serve.
+		require.NoError(t, server.Close())
+		assert.NoError(t, <-serveErrCh)
+
+		// The listener is closed either way.
+		_, err = net.Dial("tcp", ln.Addr().String())
+		assert.Error(t, err)
+	})
+
+	t.Run("no available upstreams", func(t *testing.T) {
+		server := NewTCPServer(
+			"my-endpoint",
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return nil, false
+				},
+			},
+			time.Second,
+			log.NewNopLogger(),
+		)
+
+		_, err := server.dialUpstream()
+		assert.ErrorIs(t, err, ErrEndpointNotFound)
+	})
+
+	t.Run("upstream unreachable", func(t *testing.T) {
+		// Close the listener so the upstream is unreachable.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ln.Close()
+
+		server := NewTCPServer(
+			"my-endpoint",
+			&fakeManager{
+				handler: func(_ string, _ bool) (upstream.Upstream, bool) {
+					return &tcpUpstream{
+						addr: ln.Addr().String(),
+					}, true
+				},
+			},
+			time.Second,
+			log.NewNopLogger(),
+		)
+
+		_, err = server.dialUpstream()
+		assert.ErrorIs(t, err, ErrEndpointUnreachable)
+	})
+}
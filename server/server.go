@@ -2,12 +2,13 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"sync"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/hashicorp/go-sockaddr"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
@@ -23,6 +24,7 @@ import (
 	"github.com/andydunstall/piko/server/proxy"
 	"github.com/andydunstall/piko/server/upstream"
 	"github.com/andydunstall/piko/server/usage"
+	"github.com/andydunstall/piko/server/webhook"
 )
 
 // Server is a Piko server node.
@@ -32,6 +34,10 @@ type Server struct {
 	proxyLn     net.Listener
 	proxyServer *proxy.Server
 
+	// tcpLns contains the raw TCP proxy listeners, keyed by endpoint ID.
+	tcpLns     map[string]net.Listener
+	tcpServers []*proxy.TCPServer
+
 	upstreamLn     net.Listener
 	upstreamServer *upstream.Server
 
@@ -40,8 +46,16 @@ type Server struct {
 
 	gossiper *gossip.Gossip
 
+	// clusterCtx is cancelled on shutdown to stop the cluster background
+	// tasks.
+	clusterCtx    context.Context
+	clusterCancel context.CancelFunc
+
 	reporter *usage.Reporter
 
+	// webhooks is nil if no webhook URLs are configured.
+	webhooks *webhook.Notifier
+
 	conf *config.Config
 
 	// fatalCh triggers a shutdown when a fatal error occurs.
@@ -64,48 +78,40 @@ type Server struct {
 //
 // This loads the server configuration and open the server TCP listens, though
 // won't start accepting traffic.
-func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
+func NewServer(
+	conf *config.Config,
+	logger log.Logger,
+	opts ...Option,
+) (*Server, error) {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
 	logger = logger.WithSubsystem("server")
 
 	registry := prometheus.NewRegistry()
 
+	clusterCtx, clusterCancel := context.WithCancel(context.Background())
 	s := &Server{
-		fatalCh:  make(chan struct{}),
-		shutdown: atomic.NewBool(false),
-		conf:     conf,
-		registry: registry,
-		logger:   logger,
+		clusterCtx:    clusterCtx,
+		clusterCancel: clusterCancel,
+		fatalCh:       make(chan struct{}),
+		shutdown:      atomic.NewBool(false),
+		conf:          conf,
+		registry:      registry,
+		logger:        logger,
 	}
 
 	// Auth config.
 
 	var verifier auth.Verifier
 	if conf.Auth.AuthEnabled() {
-		verifierConf := auth.JWTVerifierConfig{
-			HMACSecretKey: []byte(conf.Auth.TokenHMACSecretKey),
-			Audience:      conf.Auth.TokenAudience,
-			Issuer:        conf.Auth.TokenIssuer,
-		}
-
-		if conf.Auth.TokenRSAPublicKey != "" {
-			rsaPublicKey, err := jwt.ParseRSAPublicKeyFromPEM(
-				[]byte(conf.Auth.TokenRSAPublicKey),
-			)
-			if err != nil {
-				return nil, fmt.Errorf("parse rsa public key: %w", err)
-			}
-			verifierConf.RSAPublicKey = rsaPublicKey
-		}
-		if conf.Auth.TokenECDSAPublicKey != "" {
-			ecdsaPublicKey, err := jwt.ParseECPublicKeyFromPEM(
-				[]byte(conf.Auth.TokenECDSAPublicKey),
-			)
-			if err != nil {
-				return nil, fmt.Errorf("parse ecdsa public key: %w", err)
-			}
-			verifierConf.ECDSAPublicKey = ecdsaPublicKey
+		jwtVerifier, err := conf.Auth.Load()
+		if err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
 		}
-		verifier = auth.NewJWTVerifier(verifierConf)
+		verifier = jwtVerifier
 	}
 
 	// Proxy listener.
@@ -116,6 +122,19 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	}
 	s.proxyLn = proxyLn
 
+	// TCP proxy listeners.
+
+	s.tcpLns = make(map[string]net.Listener)
+	for _, lnConf := range conf.Proxy.TCPListeners {
+		ln, err := net.Listen("tcp", lnConf.BindAddr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"tcp proxy listen: %s: %w", lnConf.BindAddr, err,
+			)
+		}
+		s.tcpLns[lnConf.EndpointID] = ln
+	}
+
 	// Upstream listener.
 
 	upstreamLn, err := s.upstreamListen()
@@ -134,14 +153,41 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 
 	// Cluster.
 
-	s.clusterState = cluster.NewState(&cluster.Node{
-		ID:        conf.Cluster.NodeID,
-		ProxyAddr: conf.Proxy.AdvertiseAddr,
-		AdminAddr: conf.Admin.AdvertiseAddr,
-	}, logger)
+	localNode := &cluster.Node{
+		ID:         conf.Cluster.NodeID,
+		ProxyAddr:  conf.Proxy.AdvertiseAddr,
+		AdminAddr:  conf.Admin.AdvertiseAddr,
+		Version:    build.Version,
+		Commit:     build.Commit,
+		BuildTime:  build.BuildTime,
+		ForwardKey: cluster.GenerateForwardKey(),
+	}
+	if conf.Cluster.Zone != "" {
+		localNode.Metadata = map[string]string{
+			cluster.MetadataZone: conf.Cluster.Zone,
+		}
+	}
+	s.clusterState = cluster.NewState(
+		localNode,
+		logger,
+		cluster.WithEndpointTTL(conf.Cluster.EndpointTTL),
+	)
 	s.clusterState.Metrics().Register(registry)
+	if conf.Cluster.SnapshotPath != "" {
+		err := s.clusterState.LoadSnapshot(conf.Cluster.SnapshotPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			// The snapshot is only an optimisation so continue booting.
+			logger.Warn("failed to load cluster snapshot", zap.Error(err))
+		}
+	}
 
-	upstreams := upstream.NewLoadBalancedManager(s.clusterState)
+	upstreams := upstream.NewLoadBalancedManager(
+		s.clusterState,
+		upstream.LoadBalancingPolicy(conf.Upstream.LoadBalancing),
+		upstream.WithRemoteLoadBalancing(upstream.RemoteLoadBalancingPolicy(
+			conf.Upstream.RemoteLoadBalancing,
+		)),
+	)
 	upstreams.Metrics().Register(registry)
 
 	// Proxy server.
@@ -150,13 +196,46 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("proxy tls: %w", err)
 	}
+	var proxyVerifier auth.Verifier
+	if conf.Proxy.Auth.AuthEnabled() {
+		proxyAuthConf := conf.Proxy.Auth.AuthConfig()
+		jwtVerifier, err := proxyAuthConf.Load()
+		if err != nil {
+			return nil, fmt.Errorf("proxy auth: %w", err)
+		}
+		proxyVerifier = jwtVerifier
+	}
+	proxyOpts := []proxy.Option{
+		proxy.WithTracerProvider(options.tracerProvider),
+		proxy.WithEndpointAccess(conf.Endpoints),
+		proxy.WithForwardKey(localNode.ForwardKey),
+	}
+	if options.endpointResolver != nil {
+		proxyOpts = append(
+			proxyOpts, proxy.WithEndpointResolver(options.endpointResolver),
+		)
+	}
 	s.proxyServer = proxy.NewServer(
 		upstreams,
 		conf.Proxy,
+		proxyVerifier,
 		registry,
 		proxyTLSConfig,
 		logger,
+		proxyOpts...,
 	)
+	// Close connections to nodes that leave the cluster.
+	s.clusterState.OnNodeLeave(func(node *cluster.Node) {
+		s.proxyServer.EvictNode(node.ID)
+	})
+	for endpointID := range s.tcpLns {
+		s.tcpServers = append(s.tcpServers, proxy.NewTCPServer(
+			endpointID,
+			upstreams,
+			conf.Proxy.Timeout,
+			logger,
+		))
+	}
 
 	// Upstream server.
 
@@ -169,6 +248,18 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 		verifier,
 		upstreamTLSConfig,
 		logger,
+		upstream.WithEndpointLimits(
+			conf.Upstream.MaxEndpoints, conf.Upstream.MaxEndpointsPerAgent,
+		),
+		upstream.WithWriteTimeout(conf.Upstream.WriteTimeout),
+		upstream.WithHeartbeatFailureThreshold(
+			conf.Upstream.HeartbeatFailureThreshold,
+		),
+		upstream.WithMetrics(upstreams.Metrics()),
+		upstream.WithEndpointAccess(conf.Endpoints),
+		upstream.WithClientCertAuth(
+			upstream.ClientCertAuth(conf.Upstream.ClientCertAuth),
+		),
 	)
 
 	// Admin server.
@@ -177,19 +268,46 @@ func NewServer(conf *config.Config, logger log.Logger) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("admin tls: %w", err)
 	}
+	var adminVerifier auth.Verifier
+	if conf.Admin.Auth.AuthEnabled() {
+		adminAuthConf := conf.Admin.Auth.AuthConfig()
+		jwtVerifier, err := adminAuthConf.Load()
+		if err != nil {
+			return nil, fmt.Errorf("admin auth: %w", err)
+		}
+		adminVerifier = jwtVerifier
+	}
 	s.adminServer = admin.NewServer(
 		s.clusterState,
 		registry,
+		adminVerifier,
 		adminTLSConfig,
 		logger,
+		admin.WithPprof(conf.Admin.Pprof),
 	)
+	s.adminServer.AddStatus("/proxy", proxy.NewStatus(s.proxyServer))
 	s.adminServer.AddStatus("/upstream", upstream.NewStatus(upstreams))
+	// The node isn't ready to receive traffic while in maintenance mode.
+	s.adminServer.AddReadyCheck(func() bool {
+		return !s.proxyServer.Maintenance()
+	})
 	s.adminServer.AddStatus("/cluster", cluster.NewStatus(s.clusterState))
 
 	// Usage reporting.
 
 	s.reporter = usage.NewReporter(upstreams.Usage(), logger)
 
+	// Webhooks.
+
+	if len(conf.Webhook.URLs) > 0 {
+		s.webhooks = webhook.NewNotifier(conf.Webhook, conf.Cluster.NodeID, logger)
+		s.clusterState.OnLocalEndpointUpdate(func(endpointID string) {
+			s.webhooks.Notify(
+				endpointID, s.clusterState.LocalEndpointListeners(endpointID),
+			)
+		})
+	}
+
 	return s, nil
 }
 
@@ -202,8 +320,8 @@ func (s *Server) Start() error {
 	)
 	s.logger.Debug("piko config", zap.Any("config", s.conf))
 
-	// Start the admin server. This includes a '/ready' route that will be
-	// false until the server has started.
+	// Start the admin server. This includes a '/health/ready' route that will
+	// be false until the server has joined the cluster and started.
 	s.startAdminServer()
 
 	// Usage reporting.
@@ -223,6 +341,14 @@ func (s *Server) Start() error {
 		return fmt.Errorf("gossip: %w", err)
 	}
 
+	if s.conf.Cluster.EndpointTTL != 0 {
+		s.startEndpointExpiry()
+	}
+
+	if s.conf.Cluster.SnapshotPath != "" {
+		s.startSnapshots()
+	}
+
 	// Attempt to join the cluster.
 	//
 	// When running on Kubernetes using a headless DNS record for service
@@ -287,20 +413,31 @@ func (s *Server) Shutdown() {
 	// Set the ready to false to stop incoming traffic.
 	s.adminServer.SetReady(false)
 
-	// Shutdown the upstream server and close active upstream connections.
-	//
-	// We close upstream connections first since as long as we have upstream
-	// connections, we'll receive requests from other nodes in the cluster
-	// routing requests to our upstreams.
-	//
-	// We could still get requests from the proxy server but they'll be routed
-	// to other nodes.
-	s.shutdownUpstreamServer(ctx)
+	// Notify the cluster that we're leaving so other nodes stop forwarding
+	// requests to this node, rather than waiting for the node to be detected
+	// as unreachable.
+	if err := s.gossiper.Leaving(ctx); err != nil {
+		s.logger.Warn("failed to notify cluster of leaving", zap.Error(err))
+	} else {
+		s.logger.Info("notified cluster of leaving")
+	}
 
-	// Now we no longer have any connected upstreams, we'll no longer get
-	// requests from other cluster nodes so can shut down the proxy server.
+	// Stop accepting new upstream connections, though keep the connected
+	// upstreams so requests already being forwarded to them can complete.
+	s.drainUpstreamServer(ctx)
+
+	// Shutdown the proxy server, which stops accepting new requests then
+	// waits for in-flight requests to complete, up to the grace period.
+	//
+	// Since we've notified the cluster that we're leaving, other nodes no
+	// longer forward requests to our upstreams.
 	s.shutdownProxyServer(ctx)
 
+	// Now there are no in-flight requests, close the upstream connections,
+	// which notifies the upstreams the server is going away so they
+	// reconnect to another node.
+	s.shutdownUpstreamServer(ctx)
+
 	// Leave the cluster.
 	if err := s.gossiper.Leave(ctx); err != nil {
 		s.logger.Warn("failed to leave cluster", zap.Error(err))
@@ -308,9 +445,17 @@ func (s *Server) Shutdown() {
 		s.logger.Info("left cluster")
 	}
 
+	s.clusterCancel()
+
 	// Now we've left the cluster we can safely close the gossip listeners.
 	s.gossiper.Close()
 
+	if s.webhooks != nil {
+		// Wait for pending webhook events, such as endpoints unregistered
+		// when closing upstream connections, to be sent.
+		s.webhooks.Shutdown(ctx)
+	}
+
 	s.shutdownAdminServer(ctx)
 
 	s.shutdownUsageReporting()
@@ -324,6 +469,16 @@ func (s *Server) Config() *config.Config {
 	return s.conf
 }
 
+// TCPProxyAddr returns the address of the raw TCP proxy listener for the
+// given endpoint, or false if there is no listener for the endpoint.
+func (s *Server) TCPProxyAddr(endpointID string) (string, bool) {
+	ln, ok := s.tcpLns[endpointID]
+	if !ok {
+		return "", false
+	}
+	return ln.Addr().String(), true
+}
+
 func (s *Server) ClusterState() *cluster.State {
 	return s.clusterState
 }
@@ -378,15 +533,57 @@ func (s *Server) startGossip() error {
 	s.gossiper.Metrics().Register(s.registry)
 	s.adminServer.AddStatus("/gossip", gossip.NewStatus(s.gossiper))
 
+	if s.conf.Gossip.WAN.Enabled() {
+		wanTLSConfig, err := s.conf.Gossip.WAN.LoadTLS()
+		if err != nil {
+			return fmt.Errorf("wan tls: %w", err)
+		}
+		wanLn, err := net.Listen("tcp", s.conf.Gossip.WAN.BindAddr)
+		if err != nil {
+			return fmt.Errorf("listen: %s: %w", s.conf.Gossip.WAN.BindAddr, err)
+		}
+		s.gossiper.ServeWAN(wanLn, wanTLSConfig)
+	}
+
 	return nil
 }
 
+func (s *Server) startEndpointExpiry() {
+	s.runGoroutine(func() {
+		// Heartbeat more frequently than the TTL to avoid our endpoints
+		// expiring on other nodes.
+		s.gossiper.RunHeartbeat(s.clusterCtx, s.conf.Cluster.EndpointTTL/3)
+	})
+	s.runGoroutine(func() {
+		s.clusterState.RunEndpointExpiry(s.clusterCtx)
+	})
+}
+
+func (s *Server) startSnapshots() {
+	s.runGoroutine(func() {
+		s.clusterState.RunSnapshots(
+			s.clusterCtx,
+			s.conf.Cluster.SnapshotPath,
+			s.conf.Cluster.SnapshotInterval,
+		)
+	})
+}
+
 func (s *Server) startProxyServer() {
 	s.runGoroutine(func() {
 		if err := s.proxyServer.Serve(s.proxyLn); err != nil {
 			s.logger.Error("failed to run proxy server", zap.Error(err))
 		}
 	})
+
+	for _, tcpServer := range s.tcpServers {
+		tcpServer := tcpServer
+		s.runGoroutine(func() {
+			if err := tcpServer.Serve(s.tcpLns[tcpServer.EndpointID()]); err != nil {
+				s.logger.Error("failed to run tcp proxy server", zap.Error(err))
+			}
+		})
+	}
 }
 
 func (s *Server) startUpstreamServer() {
@@ -415,6 +612,9 @@ func (s *Server) shutdownProxyServer(ctx context.Context) {
 	if err := s.proxyServer.Shutdown(ctx); err != nil {
 		s.logger.Error("failed to shutdown proxy server", zap.Error(err))
 	}
+	for _, tcpServer := range s.tcpServers {
+		tcpServer.Close()
+	}
 	s.logger.Info("shutdown proxy server")
 }
 
@@ -422,6 +622,13 @@ func (s *Server) shutdownUsageReporting() {
 	s.reporter.Stop()
 }
 
+func (s *Server) drainUpstreamServer(ctx context.Context) {
+	if err := s.upstreamServer.Drain(ctx); err != nil {
+		s.logger.Error("failed to drain upstream server", zap.Error(err))
+	}
+	s.logger.Info("draining upstream server")
+}
+
 func (s *Server) shutdownUpstreamServer(ctx context.Context) {
 	if err := s.upstreamServer.Shutdown(ctx); err != nil {
 		s.logger.Error("failed to shutdown upstream server", zap.Error(err))
@@ -534,7 +741,7 @@ func advertiseAddrFromListenAddr(bindAddr string) (string, error) {
 		if ip == "" {
 			return "", fmt.Errorf("no private ip found")
 		}
-		return ip + ":" + port, nil
+		return net.JoinHostPort(ip, port), nil
 	}
 	return bindAddr, nil
 }
@@ -1,20 +1,44 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	fspath "path"
+	"strings"
 	"time"
 )
 
+// StatusError indicates the server responded with a non-200 status code.
+type StatusError struct {
+	StatusCode int
+
+	// Message is the error message from the response body, if any.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bad status: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("bad status: %d: %s", e.StatusCode, e.Message)
+}
+
+type errorMessage struct {
+	Error string `json:"error"`
+}
+
 type Client struct {
 	httpClient *http.Client
 
 	url *url.URL
 
 	forward string
+
+	token string
 }
 
 func NewClient(url *url.URL) *Client {
@@ -34,7 +58,26 @@ func (c *Client) SetForward(forward string) {
 	c.forward = forward
 }
 
-func (c *Client) Request(path string) (io.ReadCloser, error) {
+// SetToken sets the bearer token used to authenticate requests.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+func (c *Client) Request(ctx context.Context, path string) (io.ReadCloser, error) {
+	return c.Do(ctx, http.MethodGet, path, nil)
+}
+
+// Do sends a request to the server and returns the response body, which the
+// caller must close.
+//
+// If the server responds with a non-200 status code, returns an error
+// wrapping a *StatusError.
+func (c *Client) Do(
+	ctx context.Context,
+	method string,
+	path string,
+	body io.Reader,
+) (io.ReadCloser, error) {
 	url := new(url.URL)
 	*url = *c.url
 
@@ -44,10 +87,16 @@ func (c *Client) Request(path string) (io.ReadCloser, error) {
 
 	url.Path = fspath.Join(url.Path, path)
 
-	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
 	if err != nil {
 		return nil, fmt.Errorf("request: %w", err)
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -57,7 +106,17 @@ func (c *Client) Request(path string) (io.ReadCloser, error) {
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
 
-		return nil, fmt.Errorf("request: bad status: %d", resp.StatusCode)
+		statusErr := &StatusError{
+			StatusCode: resp.StatusCode,
+		}
+		// If the error has a JSON response parse the error message.
+		if strings.HasPrefix(resp.Header.Get("content-type"), "application/json") {
+			var m errorMessage
+			if err := json.NewDecoder(resp.Body).Decode(&m); err == nil {
+				statusErr.Message = m.Error
+			}
+		}
+		return nil, fmt.Errorf("request: %w", statusErr)
 	}
 
 	return resp.Body, nil
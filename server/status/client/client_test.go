@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client for a server handling requests with the
+// given handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return NewClient(u)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	// nolint
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestClient_Do(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPut, r.Method)
+			assert.Equal(t, "/status/foo", r.URL.Path)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "bar", string(b))
+
+			// nolint
+			w.Write([]byte("car"))
+		})
+
+		r, err := c.Do(
+			context.TODO(), http.MethodPut, "/status/foo", strings.NewReader("bar"),
+		)
+		require.NoError(t, err)
+		defer r.Close()
+
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "car", string(b))
+	})
+
+	t.Run("forward and token", func(t *testing.T) {
+		c := newTestClient(t, func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "node-1", r.URL.Query().Get("forward"))
+			assert.Equal(t, "Bearer my-token", r.Header.Get("Authorization"))
+		})
+		c.SetForward("node-1")
+		c.SetToken("my-token")
+
+		r, err := c.Request(context.TODO(), "/status/foo")
+		require.NoError(t, err)
+		r.Close()
+	})
+
+	t.Run("status error", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			// nolint
+			w.Write([]byte(`{"error": "invalid token"}`))
+		})
+
+		_, err := c.Request(context.TODO(), "/status/foo")
+		assert.EqualError(t, err, "request: bad status: 401: invalid token")
+
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+		assert.Equal(t, "invalid token", statusErr.Message)
+	})
+
+	t.Run("status error without message", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+
+		_, err := c.Request(context.TODO(), "/status/foo")
+		assert.EqualError(t, err, "request: bad status: 404")
+
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		c := newTestClient(t, func(_ http.ResponseWriter, _ *http.Request) {
+			t.Error("unexpected request")
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := c.Request(ctx, "/status/foo")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -17,8 +18,8 @@ func NewCluster(client *Client) *Cluster {
 	}
 }
 
-func (c *Cluster) Nodes() ([]*cluster.NodeMetadata, error) {
-	r, err := c.client.Request("/status/cluster/nodes")
+func (c *Cluster) Nodes(ctx context.Context) ([]*cluster.NodeMetadata, error) {
+	r, err := c.client.Request(ctx, "/status/cluster/nodes")
 	if err != nil {
 		return nil, err
 	}
@@ -31,8 +32,10 @@ func (c *Cluster) Nodes() ([]*cluster.NodeMetadata, error) {
 	return nodes, nil
 }
 
-func (c *Cluster) Node(nodeID string) (*cluster.Node, error) {
-	r, err := c.client.Request("/status/cluster/nodes/" + nodeID)
+// LocalNode returns the state of the node the request is sent to (or
+// forwarded to).
+func (c *Cluster) LocalNode(ctx context.Context) (*cluster.Node, error) {
+	r, err := c.client.Request(ctx, "/status/cluster/nodes/local")
 	if err != nil {
 		return nil, err
 	}
@@ -44,3 +47,48 @@ func (c *Cluster) Node(nodeID string) (*cluster.Node, error) {
 	}
 	return &node, nil
 }
+
+func (c *Cluster) Node(ctx context.Context, nodeID string) (*cluster.Node, error) {
+	r, err := c.client.Request(ctx, "/status/cluster/nodes/"+nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var node cluster.Node
+	if err := json.NewDecoder(r).Decode(&node); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &node, nil
+}
+
+// Endpoints returns the endpoints active across all nodes in the cluster.
+func (c *Cluster) Endpoints(ctx context.Context) ([]cluster.Endpoint, error) {
+	r, err := c.client.Request(ctx, "/status/cluster/endpoints")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var endpoints []cluster.Endpoint
+	if err := json.NewDecoder(r).Decode(&endpoints); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return endpoints, nil
+}
+
+// EndpointNodes returns the nodes that the endpoint with the given ID is
+// active on.
+func (c *Cluster) EndpointNodes(ctx context.Context, endpointID string) ([]cluster.EndpointLocation, error) {
+	r, err := c.client.Request(ctx, "/status/cluster/endpoints/"+endpointID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var locations []cluster.EndpointLocation
+	if err := json.NewDecoder(r).Decode(&locations); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return locations, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/cluster"
+)
+
+func TestCluster_Nodes(t *testing.T) {
+	nodes := []*cluster.NodeMetadata{
+		{
+			ID:        "node-1",
+			Status:    cluster.NodeStatusActive,
+			ProxyAddr: "10.26.104.14:8000",
+			Endpoints: 2,
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/cluster/nodes", r.URL.Path)
+		writeJSON(w, nodes)
+	})
+
+	status, err := NewCluster(c).Nodes(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, nodes, status)
+}
+
+func TestCluster_Node(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		node := &cluster.Node{
+			ID:        "node-1",
+			Status:    cluster.NodeStatusActive,
+			Endpoints: map[string]int{"my-endpoint": 2},
+		}
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/status/cluster/nodes/node-1", r.URL.Path)
+			writeJSON(w, node)
+		})
+
+		status, err := NewCluster(c).Node(context.TODO(), "node-1")
+		require.NoError(t, err)
+		assert.Equal(t, node, status)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+
+		_, err := NewCluster(c).Node(context.TODO(), "node-1")
+		var statusErr *StatusError
+		require.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	})
+}
+
+func TestCluster_LocalNode(t *testing.T) {
+	node := &cluster.Node{
+		ID:     "node-1",
+		Status: cluster.NodeStatusActive,
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/cluster/nodes/local", r.URL.Path)
+		writeJSON(w, node)
+	})
+
+	status, err := NewCluster(c).LocalNode(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, node, status)
+}
+
+func TestCluster_Endpoints(t *testing.T) {
+	endpoints := []cluster.Endpoint{
+		{
+			ID:        "my-endpoint",
+			Listeners: 2,
+			Nodes: []cluster.EndpointLocation{
+				{NodeID: "node-1", Listeners: 2},
+			},
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/cluster/endpoints", r.URL.Path)
+		writeJSON(w, endpoints)
+	})
+
+	status, err := NewCluster(c).Endpoints(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, endpoints, status)
+}
+
+func TestCluster_EndpointNodes(t *testing.T) {
+	locations := []cluster.EndpointLocation{
+		{
+			NodeID:    "node-1",
+			Status:    cluster.NodeStatusActive,
+			Listeners: 2,
+			Local:     true,
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/cluster/endpoints/my-endpoint", r.URL.Path)
+		writeJSON(w, locations)
+	})
+
+	status, err := NewCluster(c).EndpointNodes(context.TODO(), "my-endpoint")
+	require.NoError(t, err)
+	assert.Equal(t, locations, status)
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -17,8 +18,8 @@ func NewGossip(client *Client) *Gossip {
 	}
 }
 
-func (c *Gossip) Nodes() ([]gossip.NodeMetadata, error) {
-	r, err := c.client.Request("/status/gossip/nodes")
+func (c *Gossip) Nodes(ctx context.Context) ([]gossip.NodeMetadata, error) {
+	r, err := c.client.Request(ctx, "/status/gossip/nodes")
 	if err != nil {
 		return nil, err
 	}
@@ -31,8 +32,8 @@ func (c *Gossip) Nodes() ([]gossip.NodeMetadata, error) {
 	return nodes, nil
 }
 
-func (c *Gossip) Node(nodeID string) (*gossip.NodeState, error) {
-	r, err := c.client.Request("/status/gossip/nodes/" + nodeID)
+func (c *Gossip) Node(ctx context.Context, nodeID string) (*gossip.NodeState, error) {
+	r, err := c.client.Request(ctx, "/status/gossip/nodes/"+nodeID)
 	if err != nil {
 		return nil, err
 	}
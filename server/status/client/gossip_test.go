@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/gossip"
+)
+
+func TestGossip_Nodes(t *testing.T) {
+	nodes := []gossip.NodeMetadata{
+		{
+			ID:      "node-1",
+			Addr:    "10.26.104.14:8003",
+			Version: 5,
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/gossip/nodes", r.URL.Path)
+		writeJSON(w, nodes)
+	})
+
+	status, err := NewGossip(c).Nodes(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, nodes, status)
+}
+
+func TestGossip_Node(t *testing.T) {
+	node := &gossip.NodeState{
+		NodeMetadata: gossip.NodeMetadata{
+			ID:      "node-1",
+			Addr:    "10.26.104.14:8003",
+			Version: 5,
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/gossip/nodes/node-1", r.URL.Path)
+		writeJSON(w, node)
+	})
+
+	status, err := NewGossip(c).Node(context.TODO(), "node-1")
+	require.NoError(t, err)
+	assert.Equal(t, node, status)
+}
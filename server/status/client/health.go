@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+type Health struct {
+	client *Client
+}
+
+func NewHealth(client *Client) *Health {
+	return &Health{
+		client: client,
+	}
+}
+
+// Live returns an error if the node isn't live.
+func (c *Health) Live(ctx context.Context) error {
+	r, err := c.client.Request(ctx, "/health/live")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return nil
+}
+
+// Ready returns whether the node is ready to serve traffic.
+func (c *Health) Ready(ctx context.Context) (bool, error) {
+	r, err := c.client.Request(ctx, "/health/ready")
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) &&
+			statusErr.StatusCode == http.StatusServiceUnavailable {
+			return false, nil
+		}
+		return false, err
+	}
+	defer r.Close()
+
+	return true, nil
+}
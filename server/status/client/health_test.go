@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth_Live(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		c := newTestClient(t, func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/health/live", r.URL.Path)
+		})
+
+		assert.NoError(t, NewHealth(c).Live(context.TODO()))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+
+		assert.EqualError(
+			t, NewHealth(c).Live(context.TODO()), "request: bad status: 500",
+		)
+	})
+}
+
+func TestHealth_Ready(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		c := newTestClient(t, func(_ http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/health/ready", r.URL.Path)
+		})
+
+		ready, err := NewHealth(c).Ready(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, ready)
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		ready, err := NewHealth(c).Ready(context.TODO())
+		require.NoError(t, err)
+		assert.False(t, ready)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+
+		_, err := NewHealth(c).Ready(context.TODO())
+		assert.EqualError(t, err, "request: bad status: 401")
+	})
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/andydunstall/piko/server/proxy"
+)
+
+type Proxy struct {
+	client *Client
+}
+
+func NewProxy(client *Client) *Proxy {
+	return &Proxy{
+		client: client,
+	}
+}
+
+// Maintenance returns whether the node is in maintenance mode.
+func (c *Proxy) Maintenance(ctx context.Context) (bool, error) {
+	r, err := c.client.Request(ctx, "/status/proxy/maintenance")
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	var status proxy.MaintenanceStatus
+	if err := json.NewDecoder(r).Decode(&status); err != nil {
+		return false, fmt.Errorf("decode response: %w", err)
+	}
+	return status.Enabled, nil
+}
+
+// SetMaintenance enables or disables maintenance mode on the node.
+func (c *Proxy) SetMaintenance(ctx context.Context, enabled bool) error {
+	b, err := json.Marshal(&proxy.MaintenanceStatus{
+		Enabled: enabled,
+	})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+
+	r, err := c.client.Do(
+		ctx, http.MethodPut, "/status/proxy/maintenance", bytes.NewReader(b),
+	)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return nil
+}
+
+// Inflight returns the requests currently being proxied by the node.
+func (c *Proxy) Inflight(ctx context.Context) (proxy.InflightStatus, error) {
+	r, err := c.client.Request(ctx, "/status/proxy/inflight")
+	if err != nil {
+		return proxy.InflightStatus{}, err
+	}
+	defer r.Close()
+
+	var status proxy.InflightStatus
+	if err := json.NewDecoder(r).Decode(&status); err != nil {
+		return proxy.InflightStatus{}, fmt.Errorf("decode response: %w", err)
+	}
+	return status, nil
+}
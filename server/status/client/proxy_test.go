@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/proxy"
+)
+
+func TestProxy_Maintenance(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/status/proxy/maintenance", r.URL.Path)
+		writeJSON(w, proxy.MaintenanceStatus{Enabled: true})
+	})
+
+	enabled, err := NewProxy(c).Maintenance(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, enabled)
+}
+
+func TestProxy_SetMaintenance(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPut, r.Method)
+			assert.Equal(t, "/status/proxy/maintenance", r.URL.Path)
+
+			var status proxy.MaintenanceStatus
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&status))
+			assert.True(t, status.Enabled)
+
+			writeJSON(w, status)
+		})
+
+		assert.NoError(t, NewProxy(c).SetMaintenance(context.TODO(), true))
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			// nolint
+			w.Write([]byte(`{"error": "invalid request"}`))
+		})
+
+		err := NewProxy(c).SetMaintenance(context.TODO(), true)
+		assert.EqualError(t, err, "request: bad status: 400: invalid request")
+	})
+}
+
+func TestProxy_Inflight(t *testing.T) {
+	status := proxy.InflightStatus{
+		Requests: []proxy.InflightRequest{
+			{
+				EndpointID: "my-endpoint",
+				Method:     http.MethodGet,
+				Path:       "/foo",
+			},
+		},
+		Untracked: 2,
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/proxy/inflight", r.URL.Path)
+		writeJSON(w, status)
+	})
+
+	inflight, err := NewProxy(c).Inflight(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, status, inflight)
+}
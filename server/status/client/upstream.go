@@ -1,8 +1,12 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+
+	"github.com/andydunstall/piko/server/upstream"
 )
 
 type Upstream struct {
@@ -15,8 +19,8 @@ func NewUpstream(client *Client) *Upstream {
 	}
 }
 
-func (c *Upstream) Endpoints() (map[string]int, error) {
-	r, err := c.client.Request("/status/upstream/endpoints")
+func (c *Upstream) Endpoints(ctx context.Context) (map[string]int, error) {
+	r, err := c.client.Request(ctx, "/status/upstream/endpoints")
 	if err != nil {
 		return nil, err
 	}
@@ -28,3 +32,40 @@ func (c *Upstream) Endpoints() (map[string]int, error) {
 	}
 	return endpoints, nil
 }
+
+func (c *Upstream) Conns(ctx context.Context) ([]upstream.ConnStatus, error) {
+	r, err := c.client.Request(ctx, "/status/upstream/connections")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var conns []upstream.ConnStatus
+	if err := json.NewDecoder(r).Decode(&conns); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return conns, nil
+}
+
+// Disconnect force closes the upstream connection with the given ID. Returns
+// whether a connection was closed.
+func (c *Upstream) Disconnect(ctx context.Context, id string) (bool, error) {
+	r, err := c.client.Do(
+		ctx,
+		http.MethodDelete,
+		"/status/upstream/connections/"+id,
+		nil,
+	)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	var resp struct {
+		Closed bool `json:"closed"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return false, fmt.Errorf("decode response: %w", err)
+	}
+	return resp.Closed, nil
+}
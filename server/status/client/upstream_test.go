@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/server/upstream"
+)
+
+func TestUpstream_Endpoints(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/upstream/endpoints", r.URL.Path)
+		writeJSON(w, map[string]int{"my-endpoint": 2})
+	})
+
+	endpoints, err := NewUpstream(c).Endpoints(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"my-endpoint": 2}, endpoints)
+}
+
+func TestUpstream_Conns(t *testing.T) {
+	conns := []upstream.ConnStatus{
+		{
+			ID:         "conn-1",
+			EndpointID: "my-endpoint",
+		},
+	}
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status/upstream/connections", r.URL.Path)
+		writeJSON(w, conns)
+	})
+
+	status, err := NewUpstream(c).Conns(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, conns, status)
+}
+
+func TestUpstream_Disconnect(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		assert.Equal(t, "/status/upstream/connections/conn-1", r.URL.Path)
+		writeJSON(w, map[string]bool{"closed": true})
+	})
+
+	closed, err := NewUpstream(c).Disconnect(context.TODO(), "conn-1")
+	require.NoError(t, err)
+	assert.True(t, closed)
+}
@@ -10,6 +10,9 @@ import (
 type ServerConfig struct {
 	// URL is the server URL.
 	URL string `json:"url"`
+
+	// Token is the bearer token to authenticate requests to the server.
+	Token string `json:"token"`
 }
 
 func (c *ServerConfig) Validate() error {
@@ -26,12 +29,37 @@ type Config struct {
 	Server ServerConfig `json:"server"`
 
 	Forward string `json:"forward"`
+
+	// Output is the output format, either 'yaml' or 'json'.
+	Output string `json:"output"`
+
+	// Compact indicates whether to output compact JSON rather than
+	// pretty-printing.
+	Compact bool `json:"compact"`
+
+	// Filter filters the output nodes and endpoints by ID.
+	Filter string `json:"filter"`
+
+	// OutputFile is a path to write the output to, in addition to stdout.
+	OutputFile string `json:"output_file"`
+
+	// Quiet indicates whether to only write the output to OutputFile rather
+	// than also writing to stdout.
+	Quiet bool `json:"quiet"`
 }
 
 func (c *Config) Validate() error {
 	if err := c.Server.Validate(); err != nil {
 		return fmt.Errorf("server: %w", err)
 	}
+	switch c.Output {
+	case "yaml", "json":
+	default:
+		return fmt.Errorf("unsupported output: %s", c.Output)
+	}
+	if c.Quiet && c.OutputFile == "" {
+		return fmt.Errorf("quiet requires output file")
+	}
 	return nil
 }
 
@@ -45,6 +73,16 @@ Piko server URL. This URL should point to the server admin port.
 `,
 	)
 
+	fs.StringVar(
+		&c.Server.Token,
+		"server.token",
+		"",
+		`
+Bearer token to authenticate requests to the server. Required if the server
+has admin authentication enabled.
+`,
+	)
+
 	fs.StringVar(
 		&c.Forward,
 		"forward",
@@ -52,6 +90,60 @@ Piko server URL. This URL should point to the server admin port.
 		`
 Node ID to forward the request to. This can be useful when all nodes are behind
 a load balancer and you want to inspect the status of a particular node.
+`,
+	)
+
+	fs.StringVarP(
+		&c.Output,
+		"output",
+		"o",
+		"yaml",
+		`
+Output format, either 'yaml' or 'json'.
+`,
+	)
+
+	fs.BoolVar(
+		&c.Compact,
+		"compact",
+		false,
+		`
+Whether to output compact JSON rather than pretty-printing. Only applies to
+the 'json' output format.
+`,
+	)
+
+	fs.StringVar(
+		&c.Filter,
+		"filter",
+		"",
+		`
+Filter the output nodes and endpoints by ID.
+
+The filter is case-insensitive and may include '*' wildcards, such as
+'my-*-endpoint'. A filter without wildcards matches IDs with the given prefix.
+`,
+	)
+
+	fs.StringVar(
+		&c.OutputFile,
+		"output-file",
+		"",
+		`
+Path to write the output to, in the configured output format. Any missing
+parent directories are created and an existing file is overwritten.
+
+The output is still written to stdout unless '--quiet' is set.
+`,
+	)
+
+	fs.BoolVar(
+		&c.Quiet,
+		"quiet",
+		false,
+		`
+Whether to only write the output to '--output-file' rather than also writing
+to stdout.
 `,
 	)
 }
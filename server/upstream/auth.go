@@ -16,24 +16,75 @@ const (
 	TokenContextKey = "_piko_token"
 )
 
-// AuthMiddleware verifies the request token.
+// ClientCertAuth configures how verified client certificates are used to
+// authenticate upstreams.
+type ClientCertAuth string
+
+const (
+	// ClientCertAuthNone doesn't use client certificates for
+	// authentication, so upstreams must always present a valid token (when
+	// token authentication is configured).
+	ClientCertAuthNone ClientCertAuth = "none"
+	// ClientCertAuthSufficient accepts either a verified client certificate
+	// or a valid token. If the upstream presents a token, it is always
+	// verified.
+	ClientCertAuthSufficient ClientCertAuth = "sufficient"
+	// ClientCertAuthRequired requires a verified client certificate, in
+	// addition to a valid token when token authentication is configured.
+	ClientCertAuthRequired ClientCertAuth = "required"
+)
+
+// AuthMiddleware verifies the request token and client certificate.
 type AuthMiddleware struct {
-	verifier auth.Verifier
-	logger   log.Logger
+	// verifier verifies endpoint tokens. If nil token authentication is
+	// disabled.
+	verifier       auth.Verifier
+	clientCertAuth ClientCertAuth
+	logger         log.Logger
 }
 
-func NewAuthMiddleware(verifier auth.Verifier, logger log.Logger) *AuthMiddleware {
+func NewAuthMiddleware(
+	verifier auth.Verifier,
+	clientCertAuth ClientCertAuth,
+	logger log.Logger,
+) *AuthMiddleware {
 	return &AuthMiddleware{
-		verifier: verifier,
-		logger:   logger,
+		verifier:       verifier,
+		clientCertAuth: clientCertAuth,
+		logger:         logger,
 	}
 }
 
 // VerifyEndpointToken verifies the request endpoint token and adds to the
 // context.
 //
-// If the token is invalid, returns 401 to the client.
+// If the token is invalid, returns 401 to the client. Depending on the
+// client certificate auth mode, a verified client certificate may be used
+// instead of a token, or be required in addition to a token.
 func (m *AuthMiddleware) VerifyEndpointToken(c *gin.Context) {
+	hasCert := hasVerifiedCert(c.Request)
+	switch m.clientCertAuth {
+	case ClientCertAuthSufficient:
+		if hasCert && c.Request.Header.Get("Authorization") == "" {
+			c.Next()
+			return
+		}
+	case ClientCertAuthRequired:
+		if !hasCert {
+			m.logger.Warn("missing client certificate")
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"error": "missing client certificate"},
+			)
+			return
+		}
+	}
+
+	if m.verifier == nil {
+		c.Next()
+		return
+	}
+
 	tokenString, ok := m.parseToken(c)
 	if !ok {
 		return
@@ -101,3 +152,36 @@ func (m *AuthMiddleware) parseToken(c *gin.Context) (string, bool) {
 
 	return tokenString, true
 }
+
+// ClientIdentity returns the identity of the verified client certificate, or
+// an empty string if the client didn't present a verified certificate.
+//
+// The identity is the certificate common name, or if not set, the first
+// DNS, URI or email subject alternative name.
+func ClientIdentity(r *http.Request) string {
+	if !hasVerifiedCert(r) {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// hasVerifiedCert returns whether the client presented a certificate that
+// was verified by the configured client certificate authorities.
+func hasVerifiedCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 &&
+		len(r.TLS.VerifiedChains[0]) > 0
+}
@@ -1,6 +1,9 @@
 package upstream
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -40,7 +43,7 @@ func TestAuthMiddleware(t *testing.T) {
 				}, nil
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -65,7 +68,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("foo: %w", auth.ErrInvalidToken)
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -89,7 +92,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("foo: %w", auth.ErrExpiredToken)
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -113,7 +116,7 @@ func TestAuthMiddleware(t *testing.T) {
 				return auth.EndpointToken{}, fmt.Errorf("unknown")
 			},
 		}
-		m := NewAuthMiddleware(verifier, log.NewNopLogger())
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -127,7 +130,13 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 
 	t.Run("unsupported auth type", func(t *testing.T) {
-		m := NewAuthMiddleware(nil, log.NewNopLogger())
+		verifier := &fakeVerifier{
+			handler: func(token string) (auth.EndpointToken, error) {
+				assert.Fail(t, "unexpected verify")
+				return auth.EndpointToken{}, nil
+			},
+		}
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -145,7 +154,13 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 
 	t.Run("missing authorization header", func(t *testing.T) {
-		m := NewAuthMiddleware(nil, log.NewNopLogger())
+		verifier := &fakeVerifier{
+			handler: func(token string) (auth.EndpointToken, error) {
+				assert.Fail(t, "unexpected verify")
+				return auth.EndpointToken{}, nil
+			},
+		}
+		m := NewAuthMiddleware(verifier, ClientCertAuthNone, log.NewNopLogger())
 
 		w := httptest.NewRecorder()
 		c, _ := gin.CreateTestContext(w)
@@ -162,6 +177,64 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 }
 
+func TestAuthMiddleware_ClientCert(t *testing.T) {
+	verifier := &fakeVerifier{
+		handler: func(token string) (auth.EndpointToken, error) {
+			if token != "123" {
+				return auth.EndpointToken{}, auth.ErrInvalidToken
+			}
+			return auth.EndpointToken{
+				Expiry:    time.Now().Add(time.Hour),
+				Endpoints: []string{"e1"},
+			}, nil
+		},
+	}
+
+	verifiedTLS := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{
+			Subject: pkix.Name{CommonName: "my-agent"},
+		}}},
+	}
+
+	tests := []struct {
+		name           string
+		clientCertAuth ClientCertAuth
+		verifier       auth.Verifier
+		tls            *tls.ConnectionState
+		token          string
+		status         int
+	}{
+		{"none with cert", ClientCertAuthNone, verifier, verifiedTLS, "", http.StatusUnauthorized},
+		{"none with token", ClientCertAuthNone, verifier, nil, "123", http.StatusOK},
+		{"sufficient with cert", ClientCertAuthSufficient, verifier, verifiedTLS, "", http.StatusOK},
+		{"sufficient with token", ClientCertAuthSufficient, verifier, nil, "123", http.StatusOK},
+		{"sufficient with cert and invalid token", ClientCertAuthSufficient, verifier, verifiedTLS, "456", http.StatusUnauthorized},
+		{"sufficient unverified cert", ClientCertAuthSufficient, verifier, &tls.ConnectionState{}, "", http.StatusUnauthorized},
+		{"required with cert and token", ClientCertAuthRequired, verifier, verifiedTLS, "123", http.StatusOK},
+		{"required with cert only", ClientCertAuthRequired, verifier, verifiedTLS, "", http.StatusUnauthorized},
+		{"required with token only", ClientCertAuthRequired, verifier, nil, "123", http.StatusUnauthorized},
+		{"required with cert no verifier", ClientCertAuthRequired, nil, verifiedTLS, "", http.StatusOK},
+		{"required missing cert no verifier", ClientCertAuthRequired, nil, nil, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewAuthMiddleware(tt.verifier, tt.clientCertAuth, log.NewNopLogger())
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "http://example.com/foo", nil)
+			c.Request.TLS = tt.tls
+			if tt.token != "" {
+				c.Request.Header.Add("Authorization", "Bearer "+tt.token)
+			}
+
+			m.VerifyEndpointToken(c)
+
+			assert.Equal(t, tt.status, w.Result().StatusCode)
+		})
+	}
+}
+
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
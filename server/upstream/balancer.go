@@ -0,0 +1,286 @@
+package upstream
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+// BalancerRequest describes the request being load balanced.
+type BalancerRequest struct {
+	// EndpointID is the ID of the endpoint the request is for.
+	EndpointID string
+
+	// Key is the sticky key of the request, or empty if the request isn't
+	// sticky.
+	Key string
+}
+
+// Balancer selects an upstream for a request among the upstreams connected
+// to the local node for the endpoint.
+//
+// Pick is called with the managers lock held, so it is never called
+// concurrently, though it must not block. The candidates are ordered by when
+// the upstreams connected and must not be modified. Returning false
+// indicates none of the candidates are suitable for the request, in which
+// case the request may be forwarded to another node.
+//
+// If the balancer keeps state for each endpoint, it may also implement
+// RemoveEndpoint(endpointID string), which is called when the endpoint has no
+// remaining local upstreams so the state can be discarded.
+type Balancer interface {
+	Pick(candidates []Upstream, req BalancerRequest) (Upstream, bool)
+}
+
+// endpointRemover is an optional interface implemented by balancers that
+// keep state for each endpoint.
+type endpointRemover interface {
+	RemoveEndpoint(endpointID string)
+}
+
+// NewBalancer returns the built-in balancer for the given policy. Defaults
+// to round-robin.
+func NewBalancer(policy LoadBalancingPolicy) Balancer {
+	switch policy {
+	case LoadBalancingRandom:
+		return NewRandomBalancer()
+	case LoadBalancingLeastConnections:
+		return NewLeastConnectionsBalancer()
+	default:
+		return NewRoundRobinBalancer()
+	}
+}
+
+type roundRobinBalancer struct {
+	// nextIndex maps the endpoint ID to the next index to select.
+	nextIndex map[string]uint64
+}
+
+// NewRoundRobinBalancer returns a balancer that selects upstreams in a
+// round-robin fashion.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{
+		nextIndex: make(map[string]uint64),
+	}
+}
+
+func (b *roundRobinBalancer) Pick(
+	candidates []Upstream,
+	req BalancerRequest,
+) (Upstream, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	index := b.nextIndex[req.EndpointID] % uint64(len(candidates))
+	b.nextIndex[req.EndpointID] = index + 1
+	return candidates[index], true
+}
+
+func (b *roundRobinBalancer) RemoveEndpoint(endpointID string) {
+	delete(b.nextIndex, endpointID)
+}
+
+type randomBalancer struct{}
+
+// NewRandomBalancer returns a balancer that selects a random upstream.
+func NewRandomBalancer() Balancer {
+	return randomBalancer{}
+}
+
+func (b randomBalancer) Pick(
+	candidates []Upstream,
+	_ BalancerRequest,
+) (Upstream, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+type leastConnectionsBalancer struct {
+	// nextIndex maps the endpoint ID to the index to start searching from,
+	// used to break ties in a round-robin fashion.
+	nextIndex map[string]uint64
+
+	// active maps the endpoint ID to the number of active connections to
+	// each upstream.
+	active map[string]map[Upstream]*atomic.Int64
+}
+
+// NewLeastConnectionsBalancer returns a balancer that selects the upstream
+// with the fewest active connections. Ties are broken in a round-robin
+// fashion.
+//
+// Connections are tracked by wrapping the selected upstream, so only
+// connections dialed using the returned upstream are counted.
+func NewLeastConnectionsBalancer() Balancer {
+	return &leastConnectionsBalancer{
+		nextIndex: make(map[string]uint64),
+		active:    make(map[string]map[Upstream]*atomic.Int64),
+	}
+}
+
+func (b *leastConnectionsBalancer) Pick(
+	candidates []Upstream,
+	req BalancerRequest,
+) (Upstream, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	active, ok := b.active[req.EndpointID]
+	if !ok {
+		active = make(map[Upstream]*atomic.Int64)
+		b.active[req.EndpointID] = active
+	}
+	for _, u := range candidates {
+		if _, ok := active[u]; !ok {
+			active[u] = atomic.NewInt64(0)
+		}
+	}
+	// Discard the counts of removed upstreams. Any open connections keep a
+	// reference to their count so are unaffected.
+	pruneUpstreams(active, candidates)
+
+	start := b.nextIndex[req.EndpointID] % uint64(len(candidates))
+	b.nextIndex[req.EndpointID] = start + 1
+
+	var selected Upstream
+	var selectedActive int64
+	for i := 0; i != len(candidates); i++ {
+		u := candidates[(int(start)+i)%len(candidates)]
+		n := active[u].Load()
+		if selected == nil || n < selectedActive {
+			selected = u
+			selectedActive = n
+		}
+	}
+
+	return &trackedUpstream{
+		Upstream: selected,
+		active:   active[selected],
+	}, true
+}
+
+func (b *leastConnectionsBalancer) RemoveEndpoint(endpointID string) {
+	delete(b.nextIndex, endpointID)
+	delete(b.active, endpointID)
+}
+
+type consistentHashBalancer struct {
+	// ids maps the endpoint ID to a unique ID for each upstream, used to
+	// consistently hash keys to upstreams.
+	ids    map[string]map[Upstream]uint64
+	nextID uint64
+}
+
+// NewConsistentHashBalancer returns a balancer that selects the upstream for
+// the requests sticky key, or the endpoint ID if the request isn't sticky.
+//
+// This uses rendezvous hashing, so the same key always maps to the same
+// upstream, and when an upstream is removed only the keys mapped to that
+// upstream are moved.
+func NewConsistentHashBalancer() Balancer {
+	return &consistentHashBalancer{
+		ids: make(map[string]map[Upstream]uint64),
+	}
+}
+
+func (b *consistentHashBalancer) Pick(
+	candidates []Upstream,
+	req BalancerRequest,
+) (Upstream, bool) {
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	ids, ok := b.ids[req.EndpointID]
+	if !ok {
+		ids = make(map[Upstream]uint64)
+		b.ids[req.EndpointID] = ids
+	}
+	for _, u := range candidates {
+		if _, ok := ids[u]; !ok {
+			ids[u] = b.nextID
+			b.nextID++
+		}
+	}
+	pruneUpstreams(ids, candidates)
+
+	key := req.Key
+	if key == "" {
+		key = req.EndpointID
+	}
+
+	var selected Upstream
+	var selectedScore uint64
+	for _, u := range candidates {
+		score := rendezvousScore(key, ids[u])
+		if selected == nil || score > selectedScore {
+			selected = u
+			selectedScore = score
+		}
+	}
+	return selected, true
+}
+
+func (b *consistentHashBalancer) RemoveEndpoint(endpointID string) {
+	delete(b.ids, endpointID)
+}
+
+// pruneUpstreams removes the upstreams from m that aren't in candidates,
+// where m must contain every candidate.
+func pruneUpstreams[V any](m map[Upstream]V, candidates []Upstream) {
+	if len(m) == len(candidates) {
+		return
+	}
+
+	keep := make(map[Upstream]struct{}, len(candidates))
+	for _, u := range candidates {
+		keep[u] = struct{}{}
+	}
+	for u := range m {
+		if _, ok := keep[u]; !ok {
+			delete(m, u)
+		}
+	}
+}
+
+// trackedUpstream wraps an upstream to track the number of active
+// connections.
+type trackedUpstream struct {
+	Upstream
+
+	active *atomic.Int64
+}
+
+func (u *trackedUpstream) Dial() (net.Conn, error) {
+	conn, err := u.Upstream.Dial()
+	if err != nil {
+		return nil, err
+	}
+	u.active.Inc()
+	return &trackedConn{
+		Conn:   conn,
+		active: u.active,
+	}, nil
+}
+
+// trackedConn decrements the number of active connections to the upstream
+// when closed.
+type trackedConn struct {
+	net.Conn
+
+	active    *atomic.Int64
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.active.Dec()
+	})
+	return c.Conn.Close()
+}
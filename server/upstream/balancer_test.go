@@ -0,0 +1,228 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pick(t *testing.T, b Balancer, candidates []Upstream) Upstream {
+	u, ok := b.Pick(candidates, BalancerRequest{EndpointID: "my-endpoint"})
+	require.True(t, ok)
+	return u
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := NewRoundRobinBalancer()
+
+	_, ok := b.Pick(nil, BalancerRequest{EndpointID: "my-endpoint"})
+	assert.False(t, ok)
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2"}
+	u3 := &fakeUpstream{endpointID: "3"}
+	u4 := &fakeUpstream{endpointID: "4"}
+	candidates := []Upstream{u1, u2, u3, u4}
+
+	assert.Equal(t, u1, pick(t, b, candidates))
+	assert.Equal(t, u2, pick(t, b, candidates))
+	assert.Equal(t, u3, pick(t, b, candidates))
+	assert.Equal(t, u4, pick(t, b, candidates))
+	assert.Equal(t, u1, pick(t, b, candidates))
+
+	// Removing upstreams should rotate among the remaining upstreams.
+	candidates = []Upstream{u1, u4}
+	selected := make(map[Upstream]int)
+	for i := 0; i != 10; i++ {
+		selected[pick(t, b, candidates)]++
+	}
+	assert.Equal(t, map[Upstream]int{u1: 5, u4: 5}, selected)
+
+	// Endpoints are balanced independently.
+	u, ok := b.Pick(candidates, BalancerRequest{EndpointID: "other-endpoint"})
+	assert.True(t, ok)
+	assert.Equal(t, u1, u)
+}
+
+func TestRandomBalancer(t *testing.T) {
+	b := NewRandomBalancer()
+
+	_, ok := b.Pick(nil, BalancerRequest{EndpointID: "my-endpoint"})
+	assert.False(t, ok)
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2"}
+	u3 := &fakeUpstream{endpointID: "3"}
+
+	selected := make(map[Upstream]int)
+	for i := 0; i != 300; i++ {
+		selected[pick(t, b, []Upstream{u1, u2, u3})]++
+	}
+	// Every upstream should be selected at least once.
+	assert.Equal(t, 3, len(selected))
+
+	for i := 0; i != 100; i++ {
+		assert.NotEqual(t, u2, pick(t, b, []Upstream{u1, u3}))
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	b := NewLeastConnectionsBalancer()
+
+	_, ok := b.Pick(nil, BalancerRequest{EndpointID: "my-endpoint"})
+	assert.False(t, ok)
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2"}
+	u3 := &fakeUpstream{endpointID: "3"}
+	candidates := []Upstream{u1, u2, u3}
+
+	// With no active connections, should select in a round-robin fashion.
+	next := pick(t, b, candidates)
+	assert.Equal(t, "1", next.EndpointID())
+	conn1, err := next.Dial()
+	assert.NoError(t, err)
+
+	next = pick(t, b, candidates)
+	assert.Equal(t, "2", next.EndpointID())
+	conn2, err := next.Dial()
+	assert.NoError(t, err)
+
+	next = pick(t, b, candidates)
+	assert.Equal(t, "3", next.EndpointID())
+	_, err = next.Dial()
+	assert.NoError(t, err)
+
+	// Closing connections should make the upstreams preferred.
+	conn2.Close()
+	next = pick(t, b, candidates)
+	assert.Equal(t, "2", next.EndpointID())
+	_, err = next.Dial()
+	assert.NoError(t, err)
+	conn1.Close()
+	// Closing multiple times must not affect the count.
+	conn1.Close()
+	assert.Equal(t, "1", pick(t, b, candidates).EndpointID())
+
+	assert.Equal(t, "3", pick(t, b, []Upstream{u3}).EndpointID())
+}
+
+// Tests the active connection counts are accurate with concurrent requests
+// and when requests fail to connect.
+func TestLeastConnectionsBalancer_Accuracy(t *testing.T) {
+	t.Run("concurrent", func(t *testing.T) {
+		b := NewLeastConnectionsBalancer().(*leastConnectionsBalancer)
+		u1 := &fakeUpstream{endpointID: "1"}
+		u2 := &fakeUpstream{endpointID: "2"}
+		candidates := []Upstream{u1, u2}
+
+		// Select upstreams sequentially (as the manager holds a lock), though
+		// dial and close connections concurrently.
+		var wg sync.WaitGroup
+		for i := 0; i != 100; i++ {
+			next := pick(t, b, candidates)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, err := next.Dial()
+				assert.NoError(t, err)
+				conn.Close()
+			}()
+		}
+		wg.Wait()
+
+		active := b.active["my-endpoint"]
+		assert.Equal(t, int64(0), active[u1].Load())
+		assert.Equal(t, int64(0), active[u2].Load())
+	})
+
+	t.Run("dial failed", func(t *testing.T) {
+		b := NewLeastConnectionsBalancer().(*leastConnectionsBalancer)
+		u1 := &failingUpstream{fakeUpstream{endpointID: "1"}}
+		u2 := &fakeUpstream{endpointID: "2"}
+		candidates := []Upstream{u1, u2}
+
+		next := pick(t, b, candidates)
+		assert.Equal(t, "1", next.EndpointID())
+		_, err := next.Dial()
+		assert.Error(t, err)
+		assert.Equal(t, int64(0), b.active["my-endpoint"][u1].Load())
+
+		// u2 is busy, so the failed upstream is preferred.
+		next = pick(t, b, candidates)
+		assert.Equal(t, "2", next.EndpointID())
+		_, err = next.Dial()
+		assert.NoError(t, err)
+		assert.Equal(t, "1", pick(t, b, candidates).EndpointID())
+		assert.Equal(t, "1", pick(t, b, candidates).EndpointID())
+	})
+
+	t.Run("remove upstream", func(t *testing.T) {
+		b := NewLeastConnectionsBalancer().(*leastConnectionsBalancer)
+		u1 := &fakeUpstream{endpointID: "1"}
+		u2 := &fakeUpstream{endpointID: "2"}
+
+		pick(t, b, []Upstream{u1, u2})
+		pick(t, b, []Upstream{u1})
+		assert.Equal(t, 1, len(b.active["my-endpoint"]))
+
+		b.RemoveEndpoint("my-endpoint")
+		assert.Equal(t, 0, len(b.active))
+	})
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	b := NewConsistentHashBalancer()
+
+	_, ok := b.Pick(nil, BalancerRequest{EndpointID: "my-endpoint", Key: "key"})
+	assert.False(t, ok)
+
+	u1 := &fakeUpstream{endpointID: "1"}
+	u2 := &fakeUpstream{endpointID: "2"}
+	u3 := &fakeUpstream{endpointID: "3"}
+	candidates := []Upstream{u1, u2, u3}
+
+	pickKey := func(candidates []Upstream, key string) Upstream {
+		u, ok := b.Pick(candidates, BalancerRequest{
+			EndpointID: "my-endpoint",
+			Key:        key,
+		})
+		require.True(t, ok)
+		return u
+	}
+
+	keys := make(map[string]Upstream)
+	selected := make(map[Upstream]int)
+	for i := 0; i != 100; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		u := pickKey(candidates, key)
+		keys[key] = u
+		selected[u]++
+
+		// The same key should always map to the same upstream.
+		assert.Equal(t, u, pickKey(candidates, key))
+	}
+	// Keys should be spread across all upstreams.
+	assert.Equal(t, 3, len(selected))
+
+	// Removing an upstream should only move the keys that mapped to the
+	// removed upstream.
+	candidates = []Upstream{u1, u3}
+	for key, u := range keys {
+		if u == u2 {
+			assert.NotEqual(t, u2, pickKey(candidates, key))
+		} else {
+			assert.Equal(t, u, pickKey(candidates, key))
+		}
+	}
+
+	// Without a key, requests consistently map to the same upstream.
+	u := pick(t, b, candidates)
+	for i := 0; i != 10; i++ {
+		assert.Equal(t, u, pick(t, b, candidates))
+	}
+}
@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+)
+
+// endpointLimitError is returned when registering an endpoint would exceed
+// the configured endpoint limits.
+type endpointLimitError struct {
+	// scope is the scope of the exceeded limit, either 'node' or 'agent'.
+	scope string
+	limit int
+}
+
+func (e *endpointLimitError) Error() string {
+	return fmt.Sprintf(
+		"endpoint limit exceeded: max %d endpoints per %s", e.limit, e.scope,
+	)
+}
+
+// endpointLimiter limits the number of endpoints registered with the node
+// and by each agent.
+//
+// An endpoint counts towards a limit while it has at least one upstream
+// connection, so additional upstreams for an already registered endpoint are
+// always accepted.
+type endpointLimiter struct {
+	// maxEndpoints is the maximum number of endpoints registered with the
+	// node, or zero if unlimited.
+	maxEndpoints int
+	// maxEndpointsPerAgent is the maximum number of endpoints registered by
+	// each agent, or zero if unlimited.
+	maxEndpointsPerAgent int
+
+	// endpoints contains the number of upstream connections for each
+	// endpoint registered with the node.
+	endpoints map[string]int
+	// agents contains the number of upstream connections for each endpoint
+	// registered by each agent.
+	agents map[string]map[string]int
+
+	mu sync.Mutex
+
+	metrics *Metrics
+}
+
+func newEndpointLimiter(
+	maxEndpoints int,
+	maxEndpointsPerAgent int,
+	metrics *Metrics,
+) *endpointLimiter {
+	return &endpointLimiter{
+		maxEndpoints:         maxEndpoints,
+		maxEndpointsPerAgent: maxEndpointsPerAgent,
+		endpoints:            make(map[string]int),
+		agents:               make(map[string]map[string]int),
+		metrics:              metrics,
+	}
+}
+
+// Acquire registers an upstream connection for the endpoint from the given
+// agent. Returns an *endpointLimitError if registering the endpoint would
+// exceed a limit, otherwise the caller must call Release once the upstream
+// disconnects.
+func (l *endpointLimiter) Acquire(agent string, endpointID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	agentEndpoints := l.agents[agent]
+
+	if l.endpoints[endpointID] == 0 &&
+		l.maxEndpoints != 0 && len(l.endpoints) >= l.maxEndpoints {
+		l.metrics.RejectedEndpointsTotal.WithLabelValues("node").Inc()
+		return &endpointLimitError{scope: "node", limit: l.maxEndpoints}
+	}
+	if agentEndpoints[endpointID] == 0 &&
+		l.maxEndpointsPerAgent != 0 &&
+		len(agentEndpoints) >= l.maxEndpointsPerAgent {
+		l.metrics.RejectedEndpointsTotal.WithLabelValues("agent").Inc()
+		return &endpointLimitError{scope: "agent", limit: l.maxEndpointsPerAgent}
+	}
+
+	l.endpoints[endpointID]++
+	if agentEndpoints == nil {
+		agentEndpoints = make(map[string]int)
+		l.agents[agent] = agentEndpoints
+	}
+	agentEndpoints[endpointID]++
+
+	l.metrics.Agents.Set(float64(len(l.agents)))
+
+	return nil
+}
+
+// Release removes an upstream connection registered with Acquire.
+func (l *endpointLimiter) Release(agent string, endpointID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.endpoints[endpointID]--
+	if l.endpoints[endpointID] <= 0 {
+		delete(l.endpoints, endpointID)
+	}
+
+	agentEndpoints := l.agents[agent]
+	agentEndpoints[endpointID]--
+	if agentEndpoints[endpointID] <= 0 {
+		delete(agentEndpoints, endpointID)
+	}
+	if len(agentEndpoints) == 0 {
+		delete(l.agents, agent)
+	}
+
+	l.metrics.Agents.Set(float64(len(l.agents)))
+}
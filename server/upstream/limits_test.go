@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointLimiter(t *testing.T) {
+	t.Run("node limit", func(t *testing.T) {
+		metrics := NewMetrics()
+		l := newEndpointLimiter(2, 0, metrics)
+
+		require.NoError(t, l.Acquire("agent-1", "endpoint-1"))
+		require.NoError(t, l.Acquire("agent-2", "endpoint-2"))
+
+		err := l.Acquire("agent-3", "endpoint-3")
+		var limitErr *endpointLimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "node", limitErr.scope)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.RejectedEndpointsTotal.WithLabelValues("node"),
+		))
+
+		// Additional upstreams for registered endpoints are accepted.
+		require.NoError(t, l.Acquire("agent-3", "endpoint-1"))
+
+		// Once an endpoint is removed, new endpoints are accepted.
+		l.Release("agent-2", "endpoint-2")
+		require.NoError(t, l.Acquire("agent-3", "endpoint-3"))
+	})
+
+	t.Run("agent limit", func(t *testing.T) {
+		metrics := NewMetrics()
+		l := newEndpointLimiter(0, 2, metrics)
+
+		require.NoError(t, l.Acquire("agent-1", "endpoint-1"))
+		require.NoError(t, l.Acquire("agent-1", "endpoint-2"))
+
+		err := l.Acquire("agent-1", "endpoint-3")
+		var limitErr *endpointLimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "agent", limitErr.scope)
+		assert.Equal(t, 1.0, testutil.ToFloat64(
+			metrics.RejectedEndpointsTotal.WithLabelValues("agent"),
+		))
+
+		// Other agents aren't affected.
+		require.NoError(t, l.Acquire("agent-2", "endpoint-3"))
+		assert.Equal(t, 2.0, testutil.ToFloat64(metrics.Agents))
+
+		// The agent can add upstreams for its registered endpoints.
+		require.NoError(t, l.Acquire("agent-1", "endpoint-1"))
+
+		// The endpoint remains registered until all its upstreams are
+		// removed.
+		l.Release("agent-1", "endpoint-1")
+		assert.Error(t, l.Acquire("agent-1", "endpoint-3"))
+		l.Release("agent-1", "endpoint-1")
+		require.NoError(t, l.Acquire("agent-1", "endpoint-3"))
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		l := newEndpointLimiter(0, 0, NewMetrics())
+
+		for i := 0; i != 100; i++ {
+			require.NoError(t, l.Acquire("agent-1", string(rune('a'+i))))
+		}
+	})
+}
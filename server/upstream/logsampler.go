@@ -0,0 +1,57 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+// logSampler limits how often a repeated log message is logged, so a peer
+// repeatedly triggering the same log can't flood the logs.
+//
+// The first occurrence for each key is always logged, then subsequent
+// occurrences are logged at most once per interval.
+type logSampler struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*logSamplerEntry
+}
+
+type logSamplerEntry struct {
+	lastLogged time.Time
+	suppressed int
+}
+
+func newLogSampler(interval time.Duration) *logSampler {
+	return &logSampler{
+		interval: interval,
+		entries:  make(map[string]*logSamplerEntry),
+	}
+}
+
+// Allow returns whether an occurrence with the given key should be logged.
+// When true, also returns the number of occurrences suppressed since the
+// key was last logged.
+func (s *logSampler) Allow(key string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.entries[key]
+	if !ok {
+		s.entries[key] = &logSamplerEntry{
+			lastLogged: now,
+		}
+		return true, 0
+	}
+
+	if now.Sub(entry.lastLogged) < s.interval {
+		entry.suppressed++
+		return false, 0
+	}
+
+	suppressed := entry.suppressed
+	entry.lastLogged = now
+	entry.suppressed = 0
+	return true, suppressed
+}
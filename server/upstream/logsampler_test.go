@@ -0,0 +1,34 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSampler(t *testing.T) {
+	s := newLogSampler(time.Millisecond * 50)
+
+	// The first occurrence of each key is logged.
+	ok, suppressed := s.Allow("1")
+	assert.True(t, ok)
+	assert.Equal(t, 0, suppressed)
+	ok, _ = s.Allow("2")
+	assert.True(t, ok)
+
+	for i := 0; i != 10; i++ {
+		ok, _ = s.Allow("1")
+		assert.False(t, ok)
+	}
+
+	// Once the interval has passed, logs the number of suppressed
+	// occurrences.
+	time.Sleep(time.Millisecond * 60)
+	ok, suppressed = s.Allow("1")
+	assert.True(t, ok)
+	assert.Equal(t, 10, suppressed)
+
+	ok, _ = s.Allow("1")
+	assert.False(t, ok)
+}
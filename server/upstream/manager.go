@@ -1,7 +1,10 @@
 package upstream
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/atomic"
@@ -24,48 +27,221 @@ type Manager interface {
 	// upstream connection for the endpoint and use that node as the upstream.
 	Select(endpointID string, allowForward bool) (Upstream, bool)
 
+	// SelectSticky looks up an upstream for the given endpoint ID, where
+	// requests with the same key are routed to the same local upstream.
+	//
+	// If the selected upstream is removed, keys that mapped to that upstream
+	// are deterministically rehashed to the remaining upstreams.
+	SelectSticky(endpointID string, key string, allowForward bool) (Upstream, bool)
+
 	// AddConn adds a local upstream connection.
 	AddConn(u Upstream)
 
+	// DrainConn stops routing new connections to a local upstream
+	// connection. The upstream remains draining until removed with
+	// RemoveConn.
+	DrainConn(u Upstream)
+
+	// ResumeConn resumes routing new connections to a draining local
+	// upstream connection.
+	ResumeConn(u Upstream)
+
 	// RemoveConn removes a local upstream connection.
 	RemoveConn(u Upstream)
 }
 
-// loadBalancer load balances requests among upstreams in a round-robin
-// fashion.
+// LoadBalancingPolicy is the policy used to select among the upstreams
+// connected to the local node for an endpoint.
+type LoadBalancingPolicy string
+
+const (
+	// LoadBalancingRoundRobin selects upstreams in a round-robin fashion.
+	LoadBalancingRoundRobin LoadBalancingPolicy = "round-robin"
+	// LoadBalancingRandom selects a random upstream.
+	LoadBalancingRandom LoadBalancingPolicy = "random"
+	// LoadBalancingLeastConnections selects the upstream with the fewest
+	// active connections.
+	LoadBalancingLeastConnections LoadBalancingPolicy = "least-connections"
+)
+
+// RemoteLoadBalancingPolicy is the policy used to select among the remote
+// nodes with upstreams for an endpoint.
+type RemoteLoadBalancingPolicy string
+
+const (
+	// RemoteLoadBalancingRoundRobin selects nodes in a round-robin fashion,
+	// weighted by the number of listeners each node has for the endpoint.
+	RemoteLoadBalancingRoundRobin RemoteLoadBalancingPolicy = "round-robin"
+	// RemoteLoadBalancingConsistentHash consistently selects the same node
+	// for an endpoint (and sticky key if given) while the set of nodes is
+	// unchanged.
+	RemoteLoadBalancingConsistentHash RemoteLoadBalancingPolicy = "consistent-hash"
+)
+
+// loadBalancer contains the upstreams connected to the local node for an
+// endpoint.
 type loadBalancer struct {
 	upstreams []Upstream
-	nextIndex int
 }
 
 func (lb *loadBalancer) Add(u Upstream) {
 	lb.upstreams = append(lb.upstreams, u)
 }
 
+// Remove removes the given upstream, returning true if there are no
+// remaining upstreams.
 func (lb *loadBalancer) Remove(u Upstream) bool {
 	for i := 0; i != len(lb.upstreams); i++ {
 		if lb.upstreams[i] != u {
 			continue
 		}
 		lb.upstreams = append(lb.upstreams[:i], lb.upstreams[i+1:]...)
-		if len(lb.upstreams) == 0 {
-			return true
-		}
-		lb.nextIndex %= len(lb.upstreams)
-		return false
+		break
 	}
 	return len(lb.upstreams) == 0
 }
 
-func (lb *loadBalancer) Next() Upstream {
-	if len(lb.upstreams) == 0 {
+// rendezvousScore returns the score of the given key for the upstream with
+// the given ID.
+func rendezvousScore(key string, id uint64) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_ = binary.Write(h, binary.BigEndian, id)
+
+	// FNV has poor avalanche properties, so mix the hash to spread keys
+	// evenly among upstreams (using the splitmix64 finalizer).
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// remoteLoadBalancer load balances requests among remote nodes in a weighted
+// round-robin fashion.
+//
+// Each node is weighted by the number of listeners it has for the endpoint,
+// so nodes with more connected upstreams receive proportionally more
+// requests.
+//
+// Alternatively NextHashed consistently selects nodes by key.
+type remoteLoadBalancer struct {
+	// nextIndex maps the endpoint ID to the next index to select.
+	nextIndex map[string]uint64
+}
+
+func newRemoteLoadBalancer() *remoteLoadBalancer {
+	return &remoteLoadBalancer{
+		nextIndex: make(map[string]uint64),
+	}
+}
+
+// Next selects a node from the given nodes for the endpoint.
+//
+// The nodes must be sorted in a deterministic order.
+func (lb *remoteLoadBalancer) Next(endpointID string, nodes []*cluster.Node) *cluster.Node {
+	if len(nodes) == 0 {
+		delete(lb.nextIndex, endpointID)
+		return nil
+	}
+
+	var total uint64
+	for _, node := range nodes {
+		total += uint64(node.Endpoints[endpointID])
+	}
+	if total == 0 {
 		return nil
 	}
 
-	u := lb.upstreams[lb.nextIndex]
-	lb.nextIndex++
-	lb.nextIndex %= len(lb.upstreams)
-	return u
+	index := lb.nextIndex[endpointID] % total
+	lb.nextIndex[endpointID] = index + 1
+
+	for _, node := range nodes {
+		listeners := uint64(node.Endpoints[endpointID])
+		if index < listeners {
+			return node
+		}
+		index -= listeners
+	}
+
+	// Unreachable as index < total.
+	return nil
+}
+
+// Remove removes the state for the endpoint.
+func (lb *remoteLoadBalancer) Remove(endpointID string) {
+	delete(lb.nextIndex, endpointID)
+}
+
+// NextHashed selects a node from the given nodes for the key.
+//
+// This uses rendezvous hashing on the node IDs, so the same key always maps
+// to the same node while the set of nodes is unchanged, and when a node is
+// added or removed only the keys mapped to that node are moved. Since the
+// score is computed from the given nodes, there is no state to rebuild when
+// the cluster membership changes.
+func (lb *remoteLoadBalancer) NextHashed(key string, nodes []*cluster.Node) *cluster.Node {
+	var selected *cluster.Node
+	var selectedScore uint64
+	for _, node := range nodes {
+		score := rendezvousScore(key, nodeHash(node.ID))
+		if selected == nil || score > selectedScore {
+			selected = node
+			selectedScore = score
+		}
+	}
+	return selected
+}
+
+// nodeHash returns a hash of the node ID, used as the node ID when scoring
+// rendezvous hashes.
+func nodeHash(nodeID string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeID))
+	return h.Sum64()
+}
+
+// preferZone filters the given nodes to those in the given zone. If no nodes
+// are in the zone, or the zone is unknown, all nodes are returned.
+func preferZone(nodes []*cluster.Node, zone string) []*cluster.Node {
+	if zone == "" {
+		return nodes
+	}
+
+	var zoneNodes []*cluster.Node
+	for _, node := range nodes {
+		if node.Zone() == zone {
+			zoneNodes = append(zoneNodes, node)
+		}
+	}
+	if len(zoneNodes) == 0 {
+		return nodes
+	}
+	return zoneNodes
+}
+
+// alternativeNodes returns the candidate nodes excluding the selected node,
+// with nodes in the given zone first.
+func alternativeNodes(
+	candidates []*cluster.Node,
+	selected *cluster.Node,
+	zone string,
+) []*cluster.Node {
+	var sameZone []*cluster.Node
+	var otherZone []*cluster.Node
+	for _, node := range candidates {
+		if node.ID == selected.ID {
+			continue
+		}
+		if zone != "" && node.Zone() == zone {
+			sameZone = append(sameZone, node)
+		} else {
+			otherZone = append(otherZone, node)
+		}
+	}
+	return append(sameZone, otherZone...)
 }
 
 type Usage struct {
@@ -74,7 +250,20 @@ type Usage struct {
 }
 
 type LoadBalancedManager struct {
+	// balancer selects among the local upstreams for an endpoint.
+	balancer Balancer
+	// sticky selects among the local upstreams for an endpoint for sticky
+	// requests.
+	sticky Balancer
+
+	remotePolicy RemoteLoadBalancingPolicy
+
 	localUpstreams map[string]*loadBalancer
+	remoteNodes    *remoteLoadBalancer
+
+	// draining contains the local upstreams that are draining, which are
+	// excluded from localUpstreams.
+	draining map[Upstream]struct{}
 
 	mu sync.Mutex
 
@@ -85,9 +274,30 @@ type LoadBalancedManager struct {
 	metrics *Metrics
 }
 
-func NewLoadBalancedManager(cluster *cluster.State) *LoadBalancedManager {
-	return &LoadBalancedManager{
+func NewLoadBalancedManager(
+	cluster *cluster.State,
+	policy LoadBalancingPolicy,
+	opts ...Option,
+) *LoadBalancedManager {
+	options := options{
+		remoteLoadBalancing: RemoteLoadBalancingRoundRobin,
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+
+	balancer := options.balancer
+	if balancer == nil {
+		balancer = NewBalancer(policy)
+	}
+
+	m := &LoadBalancedManager{
+		balancer:       balancer,
+		sticky:         NewConsistentHashBalancer(),
+		remotePolicy:   options.remoteLoadBalancing,
 		localUpstreams: make(map[string]*loadBalancer),
+		remoteNodes:    newRemoteLoadBalancer(),
+		draining:       make(map[Upstream]struct{}),
 		cluster:        cluster,
 		usage: &Usage{
 			Requests:  atomic.NewUint64(0),
@@ -95,6 +305,9 @@ func NewLoadBalancedManager(cluster *cluster.State) *LoadBalancedManager {
 		},
 		metrics: NewMetrics(),
 	}
+
+	m.subscribeRemoteEndpoints()
+	return m
 }
 
 func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstream, bool) {
@@ -103,22 +316,107 @@ func (m *LoadBalancedManager) Select(endpointID string, allowRemote bool) (Upstr
 
 	lb, ok := m.localUpstreams[endpointID]
 	if ok {
-		m.metrics.UpstreamRequestsTotal.Inc()
-		return lb.Next(), true
+		u, ok := m.balancer.Pick(lb.upstreams, BalancerRequest{
+			EndpointID: endpointID,
+		})
+		if ok {
+			m.metrics.UpstreamRequestsTotal.Inc()
+			return u, true
+		}
 	}
 	if !allowRemote {
 		return nil, false
 	}
 
-	node, ok := m.cluster.LookupEndpoint(endpointID)
-	if !ok {
+	return m.selectRemoteLocked(endpointID, "")
+}
+
+func (m *LoadBalancedManager) SelectSticky(
+	endpointID string,
+	key string,
+	allowRemote bool,
+) (Upstream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lb, ok := m.localUpstreams[endpointID]
+	if ok {
+		u, ok := m.sticky.Pick(lb.upstreams, BalancerRequest{
+			EndpointID: endpointID,
+			Key:        key,
+		})
+		if ok {
+			m.metrics.UpstreamRequestsTotal.Inc()
+			return u, true
+		}
+	}
+	if !allowRemote {
+		return nil, false
+	}
+
+	return m.selectRemoteLocked(endpointID, key)
+}
+
+// subscribeRemoteEndpoints removes the remote load balancing state for
+// endpoints that are no longer active on any remote node, otherwise the state
+// would grow with every endpoint ever registered in the cluster.
+func (m *LoadBalancedManager) subscribeRemoteEndpoints() {
+	m.cluster.OnRemoteEndpointUpdate(func(_ string, endpointID string) {
+		m.pruneRemoteEndpoint(endpointID)
+	})
+	m.cluster.OnNodeLeave(func(node *cluster.Node) {
+		for endpointID := range node.Endpoints {
+			m.pruneRemoteEndpoint(endpointID)
+		}
+	})
+}
+
+// pruneRemoteEndpoint removes the remote load balancing state for the
+// endpoint if it isn't active on any remote node.
+func (m *LoadBalancedManager) pruneRemoteEndpoint(endpointID string) {
+	if len(m.cluster.LookupEndpoints(endpointID)) > 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remoteNodes.Remove(endpointID)
+}
+
+// selectRemoteLocked selects a remote node with upstreams for the endpoint.
+//
+// When using consistent hashing, nodes are selected by the endpoint ID and
+// the sticky key if given.
+func (m *LoadBalancedManager) selectRemoteLocked(
+	endpointID string,
+	key string,
+) (Upstream, bool) {
+	candidates := m.cluster.LookupEndpoints(endpointID)
+	localZone, _ := m.cluster.LocalMetadata(cluster.MetadataZone)
+
+	var node *cluster.Node
+	if m.remotePolicy == RemoteLoadBalancingConsistentHash {
+		hashKey := endpointID
+		if key != "" {
+			hashKey = endpointID + "/" + key
+		}
+		node = m.remoteNodes.NextHashed(
+			hashKey, preferZone(candidates, localZone),
+		)
+	} else {
+		node = m.remoteNodes.Next(endpointID, preferZone(candidates, localZone))
+	}
+	if node == nil {
 		return nil, false
 	}
 	m.metrics.RemoteRequestsTotal.With(prometheus.Labels{
 		"node_id": node.ID,
 	}).Inc()
 	m.usage.Requests.Inc()
-	return NewNodeUpstream(endpointID, node), true
+	return NewNodeUpstream(
+		endpointID, node, alternativeNodes(candidates, node, localZone)...,
+	), true
 }
 
 func (m *LoadBalancedManager) AddConn(u Upstream) {
@@ -141,18 +439,69 @@ func (m *LoadBalancedManager) AddConn(u Upstream) {
 	m.usage.Upstreams.Inc()
 }
 
-func (m *LoadBalancedManager) RemoveConn(u Upstream) {
+func (m *LoadBalancedManager) DrainConn(u Upstream) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if _, ok := m.draining[u]; ok {
+		return
+	}
+
 	lb, ok := m.localUpstreams[u.EndpointID()]
 	if !ok {
 		return
 	}
 	if lb.Remove(u) {
-		delete(m.localUpstreams, u.EndpointID())
+		m.removeEndpointLocked(u.EndpointID())
+	}
+	m.draining[u] = struct{}{}
+
+	m.cluster.DrainLocalEndpoint(u.EndpointID())
+}
+
+func (m *LoadBalancedManager) ResumeConn(u Upstream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.draining[u]; !ok {
+		return
+	}
+	delete(m.draining, u)
+
+	m.cluster.RemoveLocalDrainingEndpoint(u.EndpointID())
+
+	lb, ok := m.localUpstreams[u.EndpointID()]
+	if !ok {
+		lb = &loadBalancer{}
+
+		m.metrics.RegisteredEndpoints.Inc()
+	}
+
+	lb.Add(u)
+	m.localUpstreams[u.EndpointID()] = lb
+
+	m.cluster.AddLocalEndpoint(u.EndpointID())
+}
+
+func (m *LoadBalancedManager) RemoveConn(u Upstream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.draining[u]; ok {
+		delete(m.draining, u)
+
+		m.cluster.RemoveLocalDrainingEndpoint(u.EndpointID())
+
+		m.metrics.ConnectedUpstreams.Dec()
+		return
+	}
 
-		m.metrics.RegisteredEndpoints.Dec()
+	lb, ok := m.localUpstreams[u.EndpointID()]
+	if !ok {
+		return
+	}
+	if lb.Remove(u) {
+		m.removeEndpointLocked(u.EndpointID())
 	}
 
 	m.cluster.RemoveLocalEndpoint(u.EndpointID())
@@ -160,6 +509,20 @@ func (m *LoadBalancedManager) RemoveConn(u Upstream) {
 	m.metrics.ConnectedUpstreams.Dec()
 }
 
+// removeEndpointLocked removes an endpoint with no remaining local
+// upstreams.
+func (m *LoadBalancedManager) removeEndpointLocked(endpointID string) {
+	delete(m.localUpstreams, endpointID)
+
+	for _, b := range []Balancer{m.balancer, m.sticky} {
+		if r, ok := b.(endpointRemover); ok {
+			r.RemoveEndpoint(endpointID)
+		}
+	}
+
+	m.metrics.RegisteredEndpoints.Dec()
+}
+
 func (m *LoadBalancedManager) Endpoints() map[string]int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -171,6 +534,97 @@ func (m *LoadBalancedManager) Endpoints() map[string]int {
 	return endpoints
 }
 
+// ConnStatus contains the status of an upstream connected to the local node.
+type ConnStatus struct {
+	ID         string `json:"id"`
+	EndpointID string `json:"endpoint_id"`
+	// Addr is the remote address of the upstream.
+	Addr string `json:"addr"`
+	// LocalAddr is the local address of the connection to the upstream.
+	LocalAddr string `json:"local_addr"`
+	Draining  bool   `json:"draining"`
+
+	// RTT is the last measured round-trip time to the upstream, or zero if
+	// no heartbeat has succeeded.
+	RTT time.Duration `json:"rtt"`
+	// LastHeartbeat is the time of the last successful heartbeat, or nil if
+	// no heartbeat has succeeded.
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// MissedHeartbeats is the number of consecutive failed heartbeats.
+	MissedHeartbeats int `json:"missed_heartbeats"`
+}
+
+// Conns returns the upstreams connected to the local node.
+func (m *LoadBalancedManager) Conns() []ConnStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var conns []ConnStatus
+	for _, lb := range m.localUpstreams {
+		for _, u := range lb.upstreams {
+			if conn, ok := u.(*ConnUpstream); ok {
+				conns = append(conns, connStatus(conn, false))
+			}
+		}
+	}
+	for u := range m.draining {
+		if conn, ok := u.(*ConnUpstream); ok {
+			conns = append(conns, connStatus(conn, true))
+		}
+	}
+	return conns
+}
+
+func connStatus(conn *ConnUpstream, draining bool) ConnStatus {
+	status := ConnStatus{
+		ID:               conn.ID(),
+		EndpointID:       conn.EndpointID(),
+		Addr:             conn.RemoteAddr(),
+		LocalAddr:        conn.LocalAddr(),
+		Draining:         draining,
+		RTT:              conn.RTT(),
+		MissedHeartbeats: conn.MissedHeartbeats(),
+	}
+	if lastHeartbeat := conn.LastHeartbeat(); !lastHeartbeat.IsZero() {
+		status.LastHeartbeat = &lastHeartbeat
+	}
+	return status
+}
+
+// CloseConn closes the local upstream connection with the given ID.
+//
+// Closing the connection causes the upstream server to remove the upstream,
+// so it is removed asynchronously.
+//
+// Returns false if no connection with the ID was found or it was already
+// closed.
+func (m *LoadBalancedManager) CloseConn(id string) bool {
+	conn, ok := m.conn(id)
+	if !ok {
+		return false
+	}
+	return conn.Close()
+}
+
+func (m *LoadBalancedManager) conn(id string) (*ConnUpstream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, lb := range m.localUpstreams {
+		for _, u := range lb.upstreams {
+			if conn, ok := u.(*ConnUpstream); ok && conn.ID() == id {
+				return conn, true
+			}
+		}
+	}
+	for u := range m.draining {
+		if conn, ok := u.(*ConnUpstream); ok && conn.ID() == id {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
 func (m *LoadBalancedManager) Usage() *Usage {
 	return m.usage
 }
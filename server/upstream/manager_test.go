@@ -1,10 +1,19 @@
 package upstream
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/cluster"
 )
 
 type fakeUpstream struct {
@@ -16,45 +25,517 @@ func (u *fakeUpstream) EndpointID() string {
 }
 
 func (u *fakeUpstream) Dial() (net.Conn, error) {
-	return nil, nil
+	conn, _ := net.Pipe()
+	return conn, nil
 }
 
 func (u *fakeUpstream) Forward() bool {
 	return false
 }
 
-func TestLocalLoadBalancer(t *testing.T) {
-	lb := &loadBalancer{}
+// failingUpstream is a fake upstream that fails to connect.
+type failingUpstream struct {
+	fakeUpstream
+}
+
+func (u *failingUpstream) Dial() (net.Conn, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLoadBalancedManager_SelectLocal(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+	u1 := &fakeUpstream{endpointID: "my-endpoint"}
+	u2 := &fakeUpstream{endpointID: "my-endpoint"}
+	u3 := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u1)
+	m.AddConn(u2)
+	m.AddConn(u3)
+	assert.Equal(t, 3, state.LocalEndpointListeners("my-endpoint"))
+
+	selected := make(map[Upstream]int)
+	for i := 0; i != 30; i++ {
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+		selected[u]++
+	}
+	assert.Equal(t, map[Upstream]int{u1: 10, u2: 10, u3: 10}, selected)
+
+	m.RemoveConn(u2)
+	assert.Equal(t, 2, state.LocalEndpointListeners("my-endpoint"))
+
+	selected = make(map[Upstream]int)
+	for i := 0; i != 30; i++ {
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+		selected[u]++
+	}
+	assert.Equal(t, map[Upstream]int{u1: 15, u3: 15}, selected)
+
+	m.RemoveConn(u1)
+	m.RemoveConn(u3)
+	_, ok := m.Select("my-endpoint", false)
+	assert.False(t, ok)
+}
+
+// lastBalancer is a custom balancer that selects the most recently connected
+// upstream.
+type lastBalancer struct {
+	requests []BalancerRequest
+}
+
+func (b *lastBalancer) Pick(
+	candidates []Upstream,
+	req BalancerRequest,
+) (Upstream, bool) {
+	b.requests = append(b.requests, req)
+	if req.EndpointID == "rejected-endpoint" {
+		return nil, false
+	}
+	return candidates[len(candidates)-1], true
+}
+
+func TestLoadBalancedManager_WithBalancer(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	balancer := &lastBalancer{}
+	m := NewLoadBalancedManager(
+		state, LoadBalancingRoundRobin, WithBalancer(balancer),
+	)
+
+	u1 := &fakeUpstream{endpointID: "my-endpoint"}
+	u2 := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u1)
+	m.AddConn(u2)
+
+	for i := 0; i != 10; i++ {
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+		assert.Equal(t, u2, u)
+	}
+	assert.Equal(t, 10, len(balancer.requests))
+	assert.Equal(t, BalancerRequest{EndpointID: "my-endpoint"}, balancer.requests[0])
+
+	m.RemoveConn(u2)
+	u, ok := m.Select("my-endpoint", false)
+	assert.True(t, ok)
+	assert.Equal(t, u1, u)
+
+	// Sticky requests are selected using consistent hashing rather than the
+	// custom balancer.
+	u, ok = m.SelectSticky("my-endpoint", "key", false)
+	assert.True(t, ok)
+	assert.Equal(t, u1, u)
+	assert.Equal(t, 11, len(balancer.requests))
+
+	// If the balancer rejects all candidates, no upstream is selected.
+	m.AddConn(&fakeUpstream{endpointID: "rejected-endpoint"})
+	_, ok = m.Select("rejected-endpoint", false)
+	assert.False(t, ok)
+}
+
+func TestLoadBalancedManager_DrainConn(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+	u1 := &fakeUpstream{endpointID: "my-endpoint"}
+	u2 := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u1)
+	m.AddConn(u2)
+
+	// Draining an upstream should stop new requests being routed to it.
+	m.DrainConn(u1)
+	assert.Equal(t, 1, state.LocalEndpointListeners("my-endpoint"))
+	assert.Equal(t, 1, state.LocalDrainingEndpointListeners("my-endpoint"))
+
+	for i := 0; i != 10; i++ {
+		u, ok := m.Select("my-endpoint", false)
+		assert.True(t, ok)
+		assert.Equal(t, u2, u)
+	}
+
+	// Draining the same upstream again should have no affect.
+	m.DrainConn(u1)
+	assert.Equal(t, 1, state.LocalDrainingEndpointListeners("my-endpoint"))
+
+	m.RemoveConn(u1)
+	assert.Equal(t, 1, state.LocalEndpointListeners("my-endpoint"))
+	assert.Equal(t, 0, state.LocalDrainingEndpointListeners("my-endpoint"))
+
+	m.DrainConn(u2)
+	_, ok := m.Select("my-endpoint", false)
+	assert.False(t, ok)
+
+	m.RemoveConn(u2)
+	assert.Equal(t, 0, state.LocalDrainingEndpointListeners("my-endpoint"))
+	assert.Equal(t, map[string]int{}, m.Endpoints())
+}
+
+func TestLoadBalancedManager_ResumeConn(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+	u := &fakeUpstream{endpointID: "my-endpoint"}
+	m.AddConn(u)
+
+	m.DrainConn(u)
+	_, ok := m.Select("my-endpoint", false)
+	assert.False(t, ok)
+
+	// Resuming the upstream should route new requests to it again.
+	m.ResumeConn(u)
+	assert.Equal(t, 1, state.LocalEndpointListeners("my-endpoint"))
+	assert.Equal(t, 0, state.LocalDrainingEndpointListeners("my-endpoint"))
+
+	selected, ok := m.Select("my-endpoint", false)
+	assert.True(t, ok)
+	assert.Equal(t, u, selected)
+
+	// Resuming an upstream that isn't draining should have no affect.
+	m.ResumeConn(u)
+	assert.Equal(t, 1, state.LocalEndpointListeners("my-endpoint"))
+
+	m.RemoveConn(u)
+	assert.Equal(t, 0, state.LocalEndpointListeners("my-endpoint"))
+	assert.Equal(t, map[string]int{}, m.Endpoints())
+}
+
+func TestLoadBalancedManager_ConnsHeartbeat(t *testing.T) {
+	state := cluster.NewState(&cluster.Node{
+		ID: "local",
+	}, log.NewNopLogger())
+	m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+	muxConfig := yamux.DefaultConfig()
+	muxConfig.LogOutput = io.Discard
+
+	serverConn, clientConn := net.Pipe()
+	serverSess, err := yamux.Server(serverConn, muxConfig)
+	require.NoError(t, err)
+	defer serverSess.Close()
+	clientSess, err := yamux.Client(clientConn, muxConfig)
+	require.NoError(t, err)
+
+	u := NewConnUpstream("my-endpoint", serverSess)
+	m.AddConn(u)
+
+	conns := m.Conns()
+	require.Equal(t, 1, len(conns))
+	assert.Equal(t, time.Duration(0), conns[0].RTT)
+	assert.Nil(t, conns[0].LastHeartbeat)
+
+	start := time.Now()
+	rtt, err := u.Heartbeat()
+	require.NoError(t, err)
+
+	conns = m.Conns()
+	require.Equal(t, 1, len(conns))
+	assert.Equal(t, rtt, conns[0].RTT)
+	assert.Greater(t, conns[0].RTT, time.Duration(0))
+	require.NotNil(t, conns[0].LastHeartbeat)
+	assert.False(t, conns[0].LastHeartbeat.Before(start))
+	assert.Equal(t, 0, conns[0].MissedHeartbeats)
+
+	// Heartbeats fail once the client closes.
+	clientSess.Close()
+	_, err = u.Heartbeat()
+	assert.Error(t, err)
+	_, err = u.Heartbeat()
+	assert.Error(t, err)
+
+	conns = m.Conns()
+	require.Equal(t, 1, len(conns))
+	assert.Equal(t, 2, conns[0].MissedHeartbeats)
+	// The last successful heartbeat is still reported.
+	assert.Equal(t, rtt, conns[0].RTT)
+	assert.NotNil(t, conns[0].LastHeartbeat)
+}
+
+func TestRemoteLoadBalancer(t *testing.T) {
+	t.Run("rotate", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+
+		nodes := []*cluster.Node{
+			{ID: "1", Endpoints: map[string]int{"my-endpoint": 1}},
+			{ID: "2", Endpoints: map[string]int{"my-endpoint": 1}},
+			{ID: "3", Endpoints: map[string]int{"my-endpoint": 1}},
+		}
+
+		assert.Equal(t, "1", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "2", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "3", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "1", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "2", lb.Next("my-endpoint", nodes).ID)
+
+		// Removing a node should continue rotating among the remaining
+		// nodes.
+		nodes = nodes[1:]
+		assert.Equal(t, "2", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "3", lb.Next("my-endpoint", nodes).ID)
+		assert.Equal(t, "2", lb.Next("my-endpoint", nodes).ID)
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+
+		nodes := []*cluster.Node{
+			{ID: "1", Endpoints: map[string]int{"my-endpoint": 3}},
+			{ID: "2", Endpoints: map[string]int{"my-endpoint": 1}},
+		}
+
+		selected := make(map[string]int)
+		for i := 0; i != 100; i++ {
+			selected[lb.Next("my-endpoint", nodes).ID]++
+		}
+		assert.Equal(t, 75, selected["1"])
+		assert.Equal(t, 25, selected["2"])
+	})
+
+	t.Run("no nodes", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+		assert.Nil(t, lb.Next("my-endpoint", nil))
+		assert.Nil(t, lb.NextHashed("my-endpoint", nil))
+	})
+}
+
+func TestRemoteLoadBalancer_Hashed(t *testing.T) {
+	var nodes []*cluster.Node
+	for i := 0; i != 5; i++ {
+		nodes = append(nodes, &cluster.Node{
+			ID: fmt.Sprintf("node-%d", i),
+		})
+	}
+
+	t.Run("stable", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+
+		for i := 0; i != 100; i++ {
+			key := fmt.Sprintf("endpoint-%d", i)
+			selected := lb.NextHashed(key, nodes)
+			for j := 0; j != 10; j++ {
+				assert.Equal(t, selected.ID, lb.NextHashed(key, nodes).ID)
+			}
+
+			// The selection doesn't depend on the order of the nodes.
+			reversed := make([]*cluster.Node, len(nodes))
+			for j, node := range nodes {
+				reversed[len(nodes)-j-1] = node
+			}
+			assert.Equal(t, selected.ID, lb.NextHashed(key, reversed).ID)
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+
+		selected := make(map[string]int)
+		for i := 0; i != 1000; i++ {
+			selected[lb.NextHashed(fmt.Sprintf("endpoint-%d", i), nodes).ID]++
+		}
+		for _, node := range nodes {
+			assert.Greater(t, selected[node.ID], 100)
+		}
+	})
+
+	// Tests removing a node only moves the keys mapped to that node.
+	t.Run("remove node", func(t *testing.T) {
+		lb := newRemoteLoadBalancer()
+
+		before := make(map[string]string)
+		for i := 0; i != 1000; i++ {
+			key := fmt.Sprintf("endpoint-%d", i)
+			before[key] = lb.NextHashed(key, nodes).ID
+		}
+
+		removed := nodes[2]
+		remaining := append(append([]*cluster.Node{}, nodes[:2]...), nodes[3:]...)
+
+		moved := 0
+		for key, nodeID := range before {
+			selected := lb.NextHashed(key, remaining).ID
+			if nodeID == removed.ID {
+				moved++
+				assert.NotEqual(t, removed.ID, selected)
+			} else {
+				assert.Equal(t, nodeID, selected)
+			}
+		}
+		// Roughly 1/5 of keys should be moved.
+		assert.Greater(t, moved, 100)
+		assert.Less(t, moved, 300)
+	})
+}
+
+func TestLoadBalancedManager_SelectRemote(t *testing.T) {
+	newState := func(localZone string) *cluster.State {
+		state := cluster.NewState(&cluster.Node{
+			ID: "local",
+			Metadata: map[string]string{
+				cluster.MetadataZone: localZone,
+			},
+		}, log.NewNopLogger())
+		for _, node := range []*cluster.Node{
+			{ID: "remote-1", Metadata: map[string]string{"zone": "us-east-1a"}},
+			{ID: "remote-2", Metadata: map[string]string{"zone": "us-east-1b"}},
+			{ID: "remote-3", Metadata: map[string]string{"zone": "us-east-1a"}},
+			{ID: "remote-4", Metadata: map[string]string{"zone": "us-east-1c"}},
+		} {
+			node.Status = cluster.NodeStatusActive
+			state.AddNode(node)
+		}
+		return state
+	}
+
+	selectNodeID := func(m *LoadBalancedManager) string {
+		u, ok := m.Select("my-endpoint", true)
+		assert.True(t, ok)
+		return u.(*NodeUpstream).node.ID
+	}
+
+	t.Run("prefer same zone", func(t *testing.T) {
+		state := newState("us-east-1a")
+		for _, id := range []string{"remote-1", "remote-2", "remote-3"} {
+			state.UpdateRemoteEndpoint(id, "my-endpoint", 1)
+		}
+
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+		// Should round-robin among the nodes in the same zone.
+		assert.Equal(t, "remote-1", selectNodeID(m))
+		assert.Equal(t, "remote-3", selectNodeID(m))
+		assert.Equal(t, "remote-1", selectNodeID(m))
+		assert.Equal(t, "remote-3", selectNodeID(m))
+	})
+
+	t.Run("fallback to other zones", func(t *testing.T) {
+		state := newState("us-east-1a")
+		for _, id := range []string{"remote-2", "remote-4"} {
+			state.UpdateRemoteEndpoint(id, "my-endpoint", 1)
+		}
+
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+		assert.Equal(t, "remote-2", selectNodeID(m))
+		assert.Equal(t, "remote-4", selectNodeID(m))
+		assert.Equal(t, "remote-2", selectNodeID(m))
+	})
+
+	t.Run("no local zone", func(t *testing.T) {
+		state := newState("")
+		for _, id := range []string{"remote-1", "remote-2"} {
+			state.UpdateRemoteEndpoint(id, "my-endpoint", 1)
+		}
+
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+		assert.Equal(t, "remote-1", selectNodeID(m))
+		assert.Equal(t, "remote-2", selectNodeID(m))
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		state := newState("")
+		for _, id := range []string{"remote-1", "remote-2", "remote-3"} {
+			state.UpdateRemoteEndpoint(id, "my-endpoint", 1)
+		}
+
+		m := NewLoadBalancedManager(
+			state,
+			LoadBalancingRoundRobin,
+			WithRemoteLoadBalancing(RemoteLoadBalancingConsistentHash),
+		)
+
+		selected := selectNodeID(m)
+		for i := 0; i != 10; i++ {
+			assert.Equal(t, selected, selectNodeID(m))
+		}
+
+		// Sticky keys are hashed with the endpoint ID, so may map to
+		// different nodes, though each key maps to the same node.
+		stickyNodes := make(map[string]bool)
+		for i := 0; i != 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			u, ok := m.SelectSticky("my-endpoint", key, true)
+			assert.True(t, ok)
+			nodeID := u.(*NodeUpstream).node.ID
+			stickyNodes[nodeID] = true
+
+			u, ok = m.SelectSticky("my-endpoint", key, true)
+			assert.True(t, ok)
+			assert.Equal(t, nodeID, u.(*NodeUpstream).node.ID)
+		}
+		assert.Len(t, stickyNodes, 3)
+
+		// Once the selected node leaves, requests are moved to another
+		// node.
+		state.RemoveNode(selected)
+		assert.NotEqual(t, selected, selectNodeID(m))
+	})
+
+	// Tests nodes are selected in proportion to their listener count, and
+	// the weights are updated when the listener counts change.
+	t.Run("weighted by listeners", func(t *testing.T) {
+		state := newState("")
+		state.UpdateRemoteEndpoint("remote-1", "my-endpoint", 3)
+		state.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1)
+
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
+
+		selected := make(map[string]int)
+		for i := 0; i != 400; i++ {
+			selected[selectNodeID(m)]++
+		}
+		assert.Equal(t, 300, selected["remote-1"])
+		assert.Equal(t, 100, selected["remote-2"])
+
+		state.UpdateRemoteEndpoint("remote-2", "my-endpoint", 2)
+		state.UpdateRemoteEndpoint("remote-3", "my-endpoint", 5)
+
+		selected = make(map[string]int)
+		for i := 0; i != 1000; i++ {
+			selected[selectNodeID(m)]++
+		}
+		assert.Equal(t, 300, selected["remote-1"])
+		assert.Equal(t, 200, selected["remote-2"])
+		assert.Equal(t, 500, selected["remote-3"])
+	})
+	// Tests the load balancing state is removed once the endpoint is no
+	// longer active on any remote node.
+	t.Run("remove endpoint", func(t *testing.T) {
+		state := newState("")
+		state.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1)
+		state.UpdateRemoteEndpoint("remote-2", "my-endpoint", 1)
+
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
 
-	assert.Nil(t, lb.Next())
+		selectNodeID(m)
+		assert.Contains(t, m.remoteNodes.nextIndex, "my-endpoint")
 
-	u1 := &fakeUpstream{endpointID: "1"}
-	lb.Add(u1)
-	assert.Equal(t, "1", lb.Next().EndpointID())
+		// The endpoint is still active on remote-2.
+		state.RemoveRemoteEndpoint("remote-1", "my-endpoint")
+		assert.Contains(t, m.remoteNodes.nextIndex, "my-endpoint")
 
-	u2 := &fakeUpstream{endpointID: "2"}
-	u3 := &fakeUpstream{endpointID: "3"}
-	u4 := &fakeUpstream{endpointID: "4"}
-	lb.Add(u2)
-	lb.Add(u3)
-	lb.Add(u4)
+		state.RemoveRemoteEndpoint("remote-2", "my-endpoint")
+		assert.NotContains(t, m.remoteNodes.nextIndex, "my-endpoint")
+	})
 
-	assert.Equal(t, "1", lb.Next().EndpointID())
-	assert.Equal(t, "2", lb.Next().EndpointID())
-	assert.Equal(t, "3", lb.Next().EndpointID())
-	assert.Equal(t, "4", lb.Next().EndpointID())
-	assert.Equal(t, "1", lb.Next().EndpointID())
-	assert.Equal(t, "2", lb.Next().EndpointID())
-	assert.Equal(t, "3", lb.Next().EndpointID())
+	t.Run("node leave", func(t *testing.T) {
+		state := newState("")
+		state.UpdateRemoteEndpoint("remote-1", "my-endpoint", 1)
 
-	assert.False(t, lb.Remove(u2))
-	assert.False(t, lb.Remove(u3))
-	assert.Equal(t, "1", lb.Next().EndpointID())
-	assert.Equal(t, "4", lb.Next().EndpointID())
-	assert.Equal(t, "1", lb.Next().EndpointID())
+		m := NewLoadBalancedManager(state, LoadBalancingRoundRobin)
 
-	assert.False(t, lb.Remove(u1))
-	assert.True(t, lb.Remove(u4))
+		selectNodeID(m)
+		assert.Contains(t, m.remoteNodes.nextIndex, "my-endpoint")
 
-	assert.Nil(t, lb.Next())
+		state.RemoveNode("remote-1")
+		assert.NotContains(t, m.remoteNodes.nextIndex, "my-endpoint")
+	})
 }
@@ -16,6 +16,19 @@ type Metrics struct {
 	// RemoteRequestsTotal is the number of requests sent to another node.
 	// Labelled by target node ID.
 	RemoteRequestsTotal *prometheus.CounterVec
+
+	// Agents is the number of agents with endpoints registered to this node.
+	Agents prometheus.Gauge
+
+	// RejectedEndpointsTotal is the number of endpoint registrations
+	// rejected for exceeding an endpoint limit. Labelled by the exceeded
+	// limit, either 'node' or 'agent'.
+	RejectedEndpointsTotal *prometheus.CounterVec
+
+	// UnknownControlMessagesTotal is the number of control messages
+	// received from upstreams with an unknown message type, such as when
+	// the agent runs an incompatible version. Labelled by message type.
+	UnknownControlMessagesTotal *prometheus.CounterVec
 }
 
 func NewMetrics() *Metrics {
@@ -53,6 +66,32 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"node_id"},
 		),
+		Agents: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "agents",
+				Help:      "Number of agents with endpoints registered to this node",
+			},
+		),
+		RejectedEndpointsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "rejected_endpoints_total",
+				Help:      "Number of endpoint registrations rejected for exceeding an endpoint limit",
+			},
+			[]string{"limit"},
+		),
+		UnknownControlMessagesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "piko",
+				Subsystem: "upstreams",
+				Name:      "unknown_control_messages_total",
+				Help:      "Number of control messages with an unknown type received from upstreams",
+			},
+			[]string{"type"},
+		),
 	}
 }
 
@@ -62,5 +101,8 @@ func (m *Metrics) Register(registry *prometheus.Registry) {
 		m.RegisteredEndpoints,
 		m.UpstreamRequestsTotal,
 		m.RemoteRequestsTotal,
+		m.Agents,
+		m.RejectedEndpointsTotal,
+		m.UnknownControlMessagesTotal,
 	)
 }
@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/andydunstall/piko/server/config"
+)
+
+type options struct {
+	balancer            Balancer
+	remoteLoadBalancing RemoteLoadBalancingPolicy
+
+	maxEndpoints         int
+	maxEndpointsPerAgent int
+	writeTimeout         time.Duration
+	heartbeatThreshold   int
+	metrics              *Metrics
+	endpointAccess       config.EndpointAccessConfig
+	clientCertAuth       ClientCertAuth
+}
+
+type Option interface {
+	apply(*options)
+}
+
+type balancerOption struct {
+	balancer Balancer
+}
+
+func (o balancerOption) apply(opts *options) {
+	opts.balancer = o.balancer
+}
+
+// WithBalancer configures the balancer used to select among the upstreams
+// connected to the local node for an endpoint, overriding the configured
+// load balancing policy.
+//
+// Sticky requests are always selected using consistent hashing, so requests
+// with the same key are routed to the same upstream.
+func WithBalancer(balancer Balancer) Option {
+	return balancerOption{balancer: balancer}
+}
+
+type remoteLoadBalancingOption struct {
+	policy RemoteLoadBalancingPolicy
+}
+
+func (o remoteLoadBalancingOption) apply(opts *options) {
+	opts.remoteLoadBalancing = o.policy
+}
+
+// WithRemoteLoadBalancing configures the policy used to select among the
+// remote nodes with upstreams for an endpoint.
+//
+// If not set (the default) nodes are selected using weighted round-robin.
+func WithRemoteLoadBalancing(policy RemoteLoadBalancingPolicy) Option {
+	return remoteLoadBalancingOption{policy: policy}
+}
+
+type endpointLimitsOption struct {
+	maxEndpoints         int
+	maxEndpointsPerAgent int
+}
+
+func (o endpointLimitsOption) apply(opts *options) {
+	opts.maxEndpoints = o.maxEndpoints
+	opts.maxEndpointsPerAgent = o.maxEndpointsPerAgent
+}
+
+// WithEndpointLimits configures the server to reject upstream connections
+// that would register more than maxEndpoints endpoints with the node, or more
+// than maxEndpointsPerAgent endpoints from a single agent.
+//
+// Agents are identified by their verified client certificate, or if not
+// given, their IP address. A limit of zero is unlimited.
+func WithEndpointLimits(maxEndpoints, maxEndpointsPerAgent int) Option {
+	return endpointLimitsOption{
+		maxEndpoints:         maxEndpoints,
+		maxEndpointsPerAgent: maxEndpointsPerAgent,
+	}
+}
+
+type writeTimeoutOption time.Duration
+
+func (o writeTimeoutOption) apply(opts *options) {
+	opts.writeTimeout = time.Duration(o)
+}
+
+// WithWriteTimeout configures the server to close upstream connections when
+// writing a message takes longer than the timeout, such as if the upstream
+// stopped reading.
+//
+// If not set, writes don't time out.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return writeTimeoutOption(timeout)
+}
+
+type heartbeatFailureThresholdOption int
+
+func (o heartbeatFailureThresholdOption) apply(opts *options) {
+	opts.heartbeatThreshold = int(o)
+}
+
+// WithHeartbeatFailureThreshold configures the server to close upstream
+// connections after the given number of consecutive failed heartbeats.
+//
+// If not set, connections are closed after the first failed heartbeat.
+func WithHeartbeatFailureThreshold(threshold int) Option {
+	return heartbeatFailureThresholdOption(threshold)
+}
+
+type metricsOption struct {
+	metrics *Metrics
+}
+
+func (o metricsOption) apply(opts *options) {
+	opts.metrics = o.metrics
+}
+
+// WithMetrics configures the server to record metrics, such as rejected
+// endpoint registrations, using the given metrics.
+//
+// If not set, the server metrics aren't exported.
+func WithMetrics(metrics *Metrics) Option {
+	return metricsOption{metrics: metrics}
+}
+
+type endpointAccessOption struct {
+	access config.EndpointAccessConfig
+}
+
+func (o endpointAccessOption) apply(opts *options) {
+	opts.endpointAccess = o.access
+}
+
+// WithEndpointAccess configures the endpoints the node serves. Upstream
+// listeners for endpoints that aren't permitted are rejected when
+// registering.
+//
+// If not set (the default) all endpoints are permitted.
+func WithEndpointAccess(access config.EndpointAccessConfig) Option {
+	return endpointAccessOption{access: access}
+}
+
+type clientCertAuthOption struct {
+	clientCertAuth ClientCertAuth
+}
+
+func (o clientCertAuthOption) apply(opts *options) {
+	opts.clientCertAuth = o.clientCertAuth
+}
+
+// WithClientCertAuth configures whether a verified client certificate can be
+// used to authenticate upstreams instead of a token, or is required in
+// addition to a token.
+//
+// Client certificates are only verified if the server TLS configuration
+// includes client certificate authorities.
+//
+// If not set (the default) client certificates aren't used for
+// authentication.
+func WithClientCertAuth(clientCertAuth ClientCertAuth) Option {
+	return clientCertAuthOption{clientCertAuth: clientCertAuth}
+}
@@ -5,24 +5,62 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/middleware"
+	"github.com/andydunstall/piko/pkg/protocol"
 	pikowebsocket "github.com/andydunstall/piko/pkg/websocket"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// controlStreamTimeout is the timeout to read and write a control
+	// message.
+	controlStreamTimeout = time.Second * 10
+
+	// heartbeatInterval is the interval to heartbeat each upstream
+	// connection to measure the round-trip time.
+	heartbeatInterval = time.Second * 15
+
+	// unknownControlLogInterval is the minimum interval between logging
+	// unknown control messages of the same type, to avoid flooding the logs
+	// when upstreams run an incompatible version.
+	unknownControlLogInterval = time.Minute
 )
 
 // Server accepts connections from upstream services.
 type Server struct {
 	upstreams Manager
 
+	limiter *endpointLimiter
+
+	writeTimeout time.Duration
+
+	// heartbeatFailureThreshold is the number of consecutive failed
+	// heartbeats before closing an upstream connection.
+	heartbeatFailureThreshold int
+
+	// endpointAccess restricts the endpoints upstreams may register.
+	endpointAccess config.EndpointAccessConfig
+
+	// unknownControlSampler limits logging unknown control messages.
+	unknownControlSampler *logSampler
+
+	metrics *Metrics
+
 	httpServer *http.Server
 
 	websocketUpgrader *websocket.Upgrader
@@ -38,13 +76,37 @@ func NewServer(
 	verifier auth.Verifier,
 	tlsConfig *tls.Config,
 	logger log.Logger,
+	opts ...Option,
 ) *Server {
+	options := options{
+		heartbeatThreshold: 1,
+	}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+	metrics := options.metrics
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+
 	logger = logger.WithSubsystem("admin")
 
 	router := gin.New()
+	// Agents connect to the node directly, so forwarding headers like
+	// 'X-Forwarded-For' are never trusted, otherwise agents could spoof
+	// their IP to bypass the per-agent endpoint limit.
+	_ = router.SetTrustedProxies(nil)
 	ctx, cancel := context.WithCancel(context.Background())
 	server := &Server{
 		upstreams: upstreams,
+		limiter: newEndpointLimiter(
+			options.maxEndpoints, options.maxEndpointsPerAgent, metrics,
+		),
+		writeTimeout:              options.writeTimeout,
+		endpointAccess:            options.endpointAccess,
+		heartbeatFailureThreshold: options.heartbeatThreshold,
+		unknownControlSampler:     newLogSampler(unknownControlLogInterval),
+		metrics:                   metrics,
 		httpServer: &http.Server{
 			Handler:   router,
 			TLSConfig: tlsConfig,
@@ -57,10 +119,12 @@ func NewServer(
 	}
 
 	// Recover from panics.
-	router.Use(gin.CustomRecoveryWithWriter(nil, server.panicRoute))
+	router.Use(middleware.NewRecovery(server.logger, nil, nil))
 
-	if verifier != nil {
-		authMiddleware := NewAuthMiddleware(verifier, logger)
+	if verifier != nil || options.clientCertAuth == ClientCertAuthRequired {
+		authMiddleware := NewAuthMiddleware(
+			verifier, options.clientCertAuth, logger,
+		)
 		router.Use(authMiddleware.VerifyEndpointToken)
 	}
 
@@ -88,6 +152,16 @@ func (s *Server) Serve(ln net.Listener) error {
 	return nil
 }
 
+// Drain stops accepting new upstream connections, though keeps existing
+// upstream connections open so requests already being forwarded to the
+// upstreams can complete.
+//
+// Shutdown must still be called after draining to close the upstream
+// connections.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 // Shutdown attempts to gracefully shutdown the server by waiting for pending
 // requests to complete.
 func (s *Server) Shutdown(ctx context.Context) error {
@@ -101,6 +175,18 @@ func (s *Server) Shutdown(ctx context.Context) error {
 func (s *Server) upstreamRoute(c *gin.Context) {
 	endpointID := c.Param("endpointID")
 
+	if !s.endpointAccess.Permitted(endpointID) {
+		s.logger.Warn(
+			"endpoint not permitted on node",
+			zap.String("endpoint-id", endpointID),
+		)
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{"error": "endpoint not permitted on this node"},
+		)
+		return
+	}
+
 	token, ok := c.Get(TokenContextKey)
 	if ok {
 		endpointToken := token.(*auth.EndpointToken)
@@ -118,6 +204,22 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 		}
 	}
 
+	agent := ClientIdentity(c.Request)
+	if agent == "" {
+		agent = c.ClientIP()
+	}
+	if err := s.limiter.Acquire(agent, endpointID); err != nil {
+		s.logger.Warn(
+			"endpoint rejected",
+			zap.String("endpoint-id", endpointID),
+			zap.String("agent", agent),
+			zap.Error(err),
+		)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	defer s.limiter.Release(agent, endpointID)
+
 	wsConn, err := s.websocketUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		// Upgrade replies to the client so nothing else to do.
@@ -125,18 +227,20 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 		return
 	}
 	conn := pikowebsocket.New(wsConn)
+	conn.SetWriteTimeout(s.writeTimeout)
 	defer conn.Close()
 
-	s.logger.Info(
-		"upstream connected",
+	fields := []zap.Field{
 		zap.String("endpoint-id", endpointID),
 		zap.String("client-ip", c.ClientIP()),
-	)
-	defer s.logger.Info(
-		"upstream disconnected",
-		zap.String("endpoint-id", endpointID),
-		zap.String("client-ip", c.ClientIP()),
-	)
+		zap.String("local-addr", conn.LocalAddr().String()),
+		zap.String("remote-addr", conn.RemoteAddr().String()),
+	}
+	if identity := ClientIdentity(c.Request); identity != "" {
+		fields = append(fields, zap.String("client-identity", identity))
+	}
+	s.logger.Info("upstream connected", fields...)
+	defer s.logger.Info("upstream disconnected", fields...)
 
 	ctx := s.ctx
 	if ok {
@@ -153,6 +257,10 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 	muxConfig := yamux.DefaultConfig()
 	muxConfig.Logger = s.logger.StdLogger(zap.WarnLevel)
 	muxConfig.LogOutput = nil
+	// The yamux keep-alive closes the session after a single failed ping,
+	// so it's disabled in favour of monitor, which tolerates the configured
+	// number of failed heartbeats.
+	muxConfig.EnableKeepAlive = false
 	sess, err := yamux.Server(conn, muxConfig)
 	if err != nil {
 		// Will not happen.
@@ -165,15 +273,25 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 	s.upstreams.AddConn(upstream)
 	defer s.upstreams.RemoveConn(upstream)
 
+	go s.monitor(upstream, fields)
+
 	for {
-		// The client will never open streams but block on accept to wait for
-		// close or an error.
-		if _, err := sess.AcceptStreamWithContext(ctx); err != nil {
+		// The client only opens streams to send control messages, otherwise
+		// block on accept to wait for close or an error.
+		stream, err := sess.AcceptStreamWithContext(ctx)
+		if err != nil {
+			if upstream.closed.Load() {
+				s.logger.Info("upstream closed by admin", fields...)
+				return
+			}
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
 			if errors.Is(err, context.Canceled) {
-				// Server shutdown.
+				// Server shutdown. Close the session then notify the
+				// upstream the server is going away.
+				sess.Close()
+				_ = conn.CloseGoingAway("server shutting down")
 				return
 			}
 			if errors.Is(err, context.DeadlineExceeded) {
@@ -183,6 +301,131 @@ func (s *Server) upstreamRoute(c *gin.Context) {
 			s.logger.Warn("session closed unexpectedly", zap.Error(err))
 			return
 		}
+
+		s.handleControlStream(stream, upstream, fields)
+	}
+}
+
+// monitor periodically heartbeats the upstream until the session is closed.
+func (s *Server) monitor(upstream *ConnUpstream, fields []zap.Field) {
+	logger := s.logger.With(fields...)
+
+	heartbeat := func() error {
+		rtt, err := upstream.Heartbeat()
+		if err != nil {
+			logger.Debug(
+				"upstream heartbeat failed",
+				zap.Int("missed", upstream.MissedHeartbeats()),
+				zap.Error(err),
+			)
+			return err
+		}
+		logger.Debug("upstream heartbeat", zap.Duration("rtt", rtt))
+		return nil
+	}
+
+	err := monitorHeartbeats(
+		heartbeat,
+		heartbeatInterval,
+		s.heartbeatFailureThreshold,
+		upstream.sess.CloseChan(),
+	)
+	if err != nil {
+		logger.Warn("upstream unhealthy; closing", zap.Error(err))
+		upstream.sess.Close()
+	}
+}
+
+// monitorHeartbeats calls heartbeat every interval until either closeCh is
+// closed, which returns nil, or threshold consecutive heartbeats fail, which
+// returns the last heartbeat error. A successful heartbeat resets the
+// failure count.
+func monitorHeartbeats(
+	heartbeat func() error,
+	interval time.Duration,
+	threshold int,
+	closeCh <-chan struct{},
+) error {
+	var failures int
+	check := func() error {
+		err := heartbeat()
+		if err == nil {
+			failures = 0
+			return nil
+		}
+		failures++
+		if failures >= threshold {
+			return fmt.Errorf("%d consecutive heartbeats failed: %w", failures, err)
+		}
+		return nil
+	}
+
+	if err := check(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := check(); err != nil {
+				return err
+			}
+		case <-closeCh:
+			return nil
+		}
+	}
+}
+
+// handleControlStream handles a control message sent by the upstream.
+func (s *Server) handleControlStream(
+	stream net.Conn,
+	upstream *ConnUpstream,
+	fields []zap.Field,
+) {
+	defer stream.Close()
+
+	// nolint
+	stream.SetDeadline(time.Now().Add(controlStreamTimeout))
+
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		s.logger.Warn("failed to read control message", zap.Error(err))
+		return
+	}
+
+	switch protocol.MessageType(buf[0]) {
+	case protocol.MessageTypeDrain:
+		s.upstreams.DrainConn(upstream)
+		s.logger.Info("upstream draining", fields...)
+
+		if _, err := stream.Write(buf); err != nil {
+			s.logger.Warn("failed to write control message", zap.Error(err))
+		}
+	case protocol.MessageTypeResume:
+		s.upstreams.ResumeConn(upstream)
+		s.logger.Info("upstream resumed", fields...)
+
+		if _, err := stream.Write(buf); err != nil {
+			s.logger.Warn("failed to write control message", zap.Error(err))
+		}
+	default:
+		// Close the stream without replying so the upstream fails the
+		// request.
+		messageType := strconv.Itoa(int(buf[0]))
+		s.metrics.UnknownControlMessagesTotal.With(prometheus.Labels{
+			"type": messageType,
+		}).Inc()
+
+		if ok, suppressed := s.unknownControlSampler.Allow(messageType); ok {
+			s.logger.With(fields...).Warn(
+				"unknown control message",
+				zap.Uint8("type", buf[0]),
+				zap.Int("suppressed", suppressed),
+			)
+		}
 	}
 }
 
@@ -191,15 +434,6 @@ func (s *Server) registerRoutes(router *gin.Engine) {
 	piko.GET("/upstream/:endpointID", s.upstreamRoute)
 }
 
-func (s *Server) panicRoute(c *gin.Context, err any) {
-	s.logger.Error(
-		"handler panic",
-		zap.String("path", c.FullPath()),
-		zap.Any("err", err),
-	)
-	c.AbortWithStatus(http.StatusInternalServerError)
-}
-
 func init() {
 	// Disable Gin debug logs.
 	gin.SetMode(gin.ReleaseMode)
@@ -3,28 +3,45 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/pkg/protocol"
 	"github.com/andydunstall/piko/pkg/testutil"
 	"github.com/andydunstall/piko/pkg/websocket"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type fakeManager struct {
 	addConnCh    chan Upstream
+	drainConnCh  chan Upstream
+	resumeConnCh chan Upstream
 	removeConnCh chan Upstream
 }
 
 func newFakeManager() *fakeManager {
 	return &fakeManager{
 		addConnCh:    make(chan Upstream),
+		drainConnCh:  make(chan Upstream),
+		resumeConnCh: make(chan Upstream),
 		removeConnCh: make(chan Upstream),
 	}
 }
@@ -33,10 +50,22 @@ func (m *fakeManager) Select(_ string, _ bool) (Upstream, bool) {
 	return nil, false
 }
 
+func (m *fakeManager) SelectSticky(_ string, _ string, _ bool) (Upstream, bool) {
+	return nil, false
+}
+
 func (m *fakeManager) AddConn(u Upstream) {
 	m.addConnCh <- u
 }
 
+func (m *fakeManager) DrainConn(u Upstream) {
+	m.drainConnCh <- u
+}
+
+func (m *fakeManager) ResumeConn(u Upstream) {
+	m.resumeConnCh <- u
+}
+
 func (m *fakeManager) RemoveConn(u Upstream) {
 	m.removeConnCh <- u
 }
@@ -101,6 +130,323 @@ func TestServer_Register(t *testing.T) {
 	})
 }
 
+func TestServer_EndpointLimits(t *testing.T) {
+	t.Run("node limit", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithEndpointLimits(1, 0),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("ws://%s/piko/v1/upstream/", ln.Addr().String())
+
+		conn1, err := websocket.Dial(context.TODO(), url+"endpoint-1")
+		require.NoError(t, err)
+		defer conn1.Close()
+		<-manager.addConnCh
+
+		_, err = websocket.Dial(context.TODO(), url+"endpoint-2")
+		require.Error(t, err)
+		assert.ErrorContains(
+			t, err, "429: endpoint limit exceeded: max 1 endpoints per node",
+		)
+
+		// Additional upstreams for the registered endpoint are accepted.
+		conn2, err := websocket.Dial(context.TODO(), url+"endpoint-1")
+		require.NoError(t, err)
+		defer conn2.Close()
+		<-manager.addConnCh
+
+		// The existing upstreams are unaffected.
+		select {
+		case <-manager.removeConnCh:
+			t.Fatal("upstream removed")
+		case <-time.After(time.Millisecond * 10):
+		}
+	})
+
+	t.Run("agent limit", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		s := NewServer(
+			manager, nil, nil, log.NewNopLogger(), WithEndpointLimits(0, 1),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf("ws://%s/piko/v1/upstream/", ln.Addr().String())
+
+		conn, err := websocket.Dial(context.TODO(), url+"endpoint-1")
+		require.NoError(t, err)
+		<-manager.addConnCh
+
+		_, err = websocket.Dial(context.TODO(), url+"endpoint-2")
+		require.Error(t, err)
+		assert.ErrorContains(
+			t, err, "429: endpoint limit exceeded: max 1 endpoints per agent",
+		)
+
+		// The agent can't bypass the limit by spoofing its IP.
+		header := make(http.Header)
+		header.Set("X-Forwarded-For", "1.2.3.4")
+		_, resp, err := gorillawebsocket.DefaultDialer.Dial(
+			url+"endpoint-2", header,
+		)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+		// Once the agent removes its endpoint, it can register another.
+		conn.Close()
+		<-manager.removeConnCh
+
+		assert.Eventually(t, func() bool {
+			conn, err := websocket.Dial(context.TODO(), url+"endpoint-2")
+			if err != nil {
+				return false
+			}
+			<-manager.addConnCh
+			conn.Close()
+			<-manager.removeConnCh
+			return true
+		}, time.Second, time.Millisecond*10)
+	})
+}
+
+func TestServer_EndpointAccess(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	s := NewServer(
+		manager,
+		nil,
+		nil,
+		log.NewNopLogger(),
+		WithEndpointAccess(config.EndpointAccessConfig{
+			Allow: []string{"tenant-a-*"},
+			Deny:  []string{"tenant-a-internal"},
+		}),
+	)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf("ws://%s/piko/v1/upstream/", ln.Addr().String())
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, err := websocket.Dial(context.TODO(), url+"tenant-a-api")
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+		<-manager.removeConnCh
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, err := websocket.Dial(context.TODO(), url+"tenant-b-api")
+		require.ErrorContains(t, err, "403: endpoint not permitted on this node")
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		_, err := websocket.Dial(context.TODO(), url+"tenant-a-internal")
+		require.ErrorContains(t, err, "403: endpoint not permitted on this node")
+	})
+}
+
+func TestServer_Drain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+
+	s := NewServer(manager, nil, nil, log.NewNopLogger())
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"ws://%s/piko/v1/upstream/my-endpoint",
+		ln.Addr().String(),
+	)
+	conn, err := websocket.Dial(context.TODO(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	addedUpstream := <-manager.addConnCh
+
+	sess, err := yamux.Client(conn, nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	// Send a drain message and wait for the server to acknowledge.
+	stream, err := sess.OpenStream()
+	require.NoError(t, err)
+	defer stream.Close()
+
+	_, err = stream.Write([]byte{byte(protocol.MessageTypeDrain)})
+	require.NoError(t, err)
+
+	drainedUpstream := <-manager.drainConnCh
+	assert.Equal(t, addedUpstream, drainedUpstream)
+
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.MessageTypeDrain, protocol.MessageType(buf[0]))
+
+	// Send a resume message and wait for the server to acknowledge.
+	resumeStream, err := sess.OpenStream()
+	require.NoError(t, err)
+	defer resumeStream.Close()
+
+	_, err = resumeStream.Write([]byte{byte(protocol.MessageTypeResume)})
+	require.NoError(t, err)
+
+	resumedUpstream := <-manager.resumeConnCh
+	assert.Equal(t, addedUpstream, resumedUpstream)
+
+	_, err = io.ReadFull(resumeStream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.MessageTypeResume, protocol.MessageType(buf[0]))
+
+	sess.Close()
+
+	removedUpstream := <-manager.removeConnCh
+	assert.Equal(t, addedUpstream, removedUpstream)
+}
+
+// Tests repeated unknown control messages are all rejected, though only the
+// first is logged.
+func TestMonitorHeartbeats(t *testing.T) {
+	// scripted returns a heartbeat function that fails according to the
+	// given results, then succeeds once exhausted.
+	scripted := func(results ...bool) (func() error, *atomic.Int64) {
+		calls := atomic.NewInt64(0)
+		return func() error {
+			n := int(calls.Inc())
+			if n <= len(results) && !results[n-1] {
+				return errors.New("timeout")
+			}
+			return nil
+		}, calls
+	}
+
+	t.Run("intermittent failures", func(t *testing.T) {
+		heartbeat, calls := scripted(
+			false, true, false, false, true, false, true,
+		)
+
+		closeCh := make(chan struct{})
+		errCh := make(chan error)
+		go func() {
+			errCh <- monitorHeartbeats(heartbeat, time.Millisecond, 3, closeCh)
+		}()
+
+		assert.Eventually(t, func() bool {
+			select {
+			case err := <-errCh:
+				t.Fatalf("monitor failed: %s", err)
+			default:
+			}
+			return calls.Load() > 10
+		}, time.Second, time.Millisecond)
+
+		close(closeCh)
+		assert.NoError(t, <-errCh)
+	})
+
+	t.Run("consecutive failures", func(t *testing.T) {
+		heartbeat, calls := scripted(true, false, false, true, false, false, false)
+
+		err := monitorHeartbeats(
+			heartbeat, time.Millisecond, 3, make(chan struct{}),
+		)
+		assert.EqualError(t, err, "3 consecutive heartbeats failed: timeout")
+		assert.Equal(t, int64(7), calls.Load())
+	})
+
+	t.Run("single failure", func(t *testing.T) {
+		heartbeat, calls := scripted(true, false)
+
+		err := monitorHeartbeats(
+			heartbeat, time.Millisecond, 1, make(chan struct{}),
+		)
+		assert.EqualError(t, err, "1 consecutive heartbeats failed: timeout")
+		assert.Equal(t, int64(2), calls.Load())
+	})
+}
+
+func TestServer_UnknownControlMessage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+	logger := newFakeLogger()
+	metrics := NewMetrics()
+
+	s := NewServer(manager, nil, nil, logger, WithMetrics(metrics))
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"ws://%s/piko/v1/upstream/my-endpoint",
+		ln.Addr().String(),
+	)
+	conn, err := websocket.Dial(context.TODO(), url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	<-manager.addConnCh
+
+	sess, err := yamux.Client(conn, nil)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	for i := 0; i != 50; i++ {
+		stream, err := sess.OpenStream()
+		require.NoError(t, err)
+
+		_, err = stream.Write([]byte{0xff})
+		require.NoError(t, err)
+
+		// The server closes the stream without acknowledging.
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(stream, buf)
+		assert.ErrorIs(t, err, io.EOF)
+
+		stream.Close()
+	}
+
+	assert.Equal(t, 50.0, promtestutil.ToFloat64(
+		metrics.UnknownControlMessagesTotal.WithLabelValues("255"),
+	))
+
+	warns := logger.Warns()
+	require.Equal(t, 1, len(warns))
+	assert.True(t, strings.HasPrefix(warns[0], "unknown control message"))
+
+	sess.Close()
+	<-manager.removeConnCh
+}
+
 func TestServer_Authentication(t *testing.T) {
 	t.Run("ok", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -180,6 +526,71 @@ func TestServer_Authentication(t *testing.T) {
 		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
 	})
 
+	t.Run("endpoint wildcard permitted", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		verifier := &fakeVerifier{
+			handler: func(_ string) (auth.EndpointToken, error) {
+				return auth.EndpointToken{
+					Expiry:    time.Now().Add(time.Hour),
+					Endpoints: []string{"my-*"},
+				}, nil
+			},
+		}
+
+		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		conn, err := websocket.Dial(context.TODO(), url, websocket.WithToken("123"))
+		require.NoError(t, err)
+
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
+
+		conn.Close()
+
+		<-manager.removeConnCh
+	})
+
+	t.Run("endpoints required", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+
+		verifier := &fakeVerifier{
+			handler: func(_ string) (auth.EndpointToken, error) {
+				return auth.EndpointToken{
+					Expiry:           time.Now().Add(time.Hour),
+					RequireEndpoints: true,
+				}, nil
+			},
+		}
+
+		s := NewServer(manager, verifier, nil, log.NewNopLogger())
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		defer s.Shutdown(context.TODO())
+
+		url := fmt.Sprintf(
+			"ws://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		_, err = websocket.Dial(context.TODO(), url, websocket.WithToken("123"))
+		require.ErrorContains(t, err, "401: endpoint not permitted")
+	})
+
 	t.Run("endpoint not permitted", func(t *testing.T) {
 		ln, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
@@ -296,3 +707,247 @@ func TestServer_TLS(t *testing.T) {
 		require.ErrorContains(t, err, "bad handshake")
 	})
 }
+
+type fakeLogger struct {
+	log.Logger
+
+	mu    sync.Mutex
+	infos []string
+	warns []string
+}
+
+func newFakeLogger() *fakeLogger {
+	return &fakeLogger{
+		Logger: log.NewNopLogger(),
+	}
+}
+
+func (l *fakeLogger) WithSubsystem(_ string) log.Logger {
+	return l
+}
+
+func (l *fakeLogger) Info(msg string, fields ...zap.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	l.infos = append(l.infos, fmt.Sprintf("%s %v", msg, enc.Fields))
+}
+
+func (l *fakeLogger) With(_ ...zap.Field) log.Logger {
+	return l
+}
+
+func (l *fakeLogger) Warn(msg string, fields ...zap.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	l.warns = append(l.warns, fmt.Sprintf("%s %v", msg, enc.Fields))
+}
+
+func (l *fakeLogger) Infos() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.infos...)
+}
+
+func (l *fakeLogger) Warns() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.warns...)
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	clientCAPool, clientCert, err := testutil.LocalTLSClientCert("my-agent")
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	manager := newFakeManager()
+	logger := newFakeLogger()
+
+	s := NewServer(manager, nil, tlsConfig, logger)
+	go func() {
+		require.NoError(t, s.Serve(ln))
+	}()
+	defer s.Shutdown(context.TODO())
+
+	url := fmt.Sprintf(
+		"wss://%s/piko/v1/upstream/my-endpoint",
+		ln.Addr().String(),
+	)
+
+	t.Run("ok", func(t *testing.T) {
+		clientTLSConfig := &tls.Config{
+			RootCAs:      rootCAPool,
+			Certificates: []tls.Certificate{clientCert},
+		}
+		conn, err := websocket.Dial(
+			context.TODO(), url, websocket.WithTLSConfig(clientTLSConfig),
+		)
+		require.NoError(t, err)
+
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
+
+		conn.Close()
+
+		removedUpstream := <-manager.removeConnCh
+		assert.Equal(t, "my-endpoint", removedUpstream.EndpointID())
+
+		// Verify the client identity is logged.
+		var connectedLog string
+		for _, info := range logger.Infos() {
+			if strings.HasPrefix(info, "upstream connected") {
+				connectedLog = info
+			}
+		}
+		assert.Contains(t, connectedLog, "client-identity:my-agent")
+	})
+
+	t.Run("untrusted cert", func(t *testing.T) {
+		_, untrustedCert, err := testutil.LocalTLSClientCert("my-agent")
+		require.NoError(t, err)
+
+		clientTLSConfig := &tls.Config{
+			RootCAs:      rootCAPool,
+			Certificates: []tls.Certificate{untrustedCert},
+		}
+		_, err = websocket.Dial(
+			context.TODO(), url, websocket.WithTLSConfig(clientTLSConfig),
+		)
+		require.Error(t, err)
+	})
+
+	t.Run("missing cert", func(t *testing.T) {
+		clientTLSConfig := &tls.Config{
+			RootCAs: rootCAPool,
+		}
+		_, err = websocket.Dial(
+			context.TODO(), url, websocket.WithTLSConfig(clientTLSConfig),
+		)
+		require.Error(t, err)
+	})
+}
+
+func TestServer_ClientCertAuth(t *testing.T) {
+	rootCAPool, cert, err := testutil.LocalTLSServerCert()
+	require.NoError(t, err)
+
+	clientCAPool, clientCert, err := testutil.LocalTLSClientCert("my-agent")
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+
+	verifier := &fakeVerifier{
+		handler: func(token string) (auth.EndpointToken, error) {
+			if token != "123" {
+				return auth.EndpointToken{}, auth.ErrInvalidToken
+			}
+			return auth.EndpointToken{
+				Expiry: time.Now().Add(time.Hour),
+			}, nil
+		},
+	}
+
+	startServer := func(t *testing.T, clientCertAuth ClientCertAuth) (string, *fakeManager) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		manager := newFakeManager()
+		s := NewServer(
+			manager, verifier, tlsConfig, log.NewNopLogger(),
+			WithClientCertAuth(clientCertAuth),
+		)
+		go func() {
+			require.NoError(t, s.Serve(ln))
+		}()
+		t.Cleanup(func() {
+			s.Shutdown(context.TODO())
+		})
+
+		url := fmt.Sprintf(
+			"wss://%s/piko/v1/upstream/my-endpoint",
+			ln.Addr().String(),
+		)
+		return url, manager
+	}
+
+	withCert := websocket.WithTLSConfig(&tls.Config{
+		RootCAs:      rootCAPool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	withoutCert := websocket.WithTLSConfig(&tls.Config{
+		RootCAs: rootCAPool,
+	})
+
+	t.Run("none", func(t *testing.T) {
+		url, _ := startServer(t, ClientCertAuthNone)
+
+		_, err := websocket.Dial(context.TODO(), url, withCert)
+		require.ErrorContains(t, err, "401: missing authorization")
+	})
+
+	t.Run("sufficient", func(t *testing.T) {
+		url, manager := startServer(t, ClientCertAuthSufficient)
+
+		conn, err := websocket.Dial(context.TODO(), url, withCert)
+		require.NoError(t, err)
+		addedUpstream := <-manager.addConnCh
+		assert.Equal(t, "my-endpoint", addedUpstream.EndpointID())
+		conn.Close()
+		<-manager.removeConnCh
+
+		conn, err = websocket.Dial(
+			context.TODO(), url, withoutCert, websocket.WithToken("123"),
+		)
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+		<-manager.removeConnCh
+
+		_, err = websocket.Dial(context.TODO(), url, withoutCert)
+		require.ErrorContains(t, err, "401: missing authorization")
+	})
+
+	t.Run("required", func(t *testing.T) {
+		url, manager := startServer(t, ClientCertAuthRequired)
+
+		conn, err := websocket.Dial(
+			context.TODO(), url, withCert, websocket.WithToken("123"),
+		)
+		require.NoError(t, err)
+		<-manager.addConnCh
+		conn.Close()
+		<-manager.removeConnCh
+
+		_, err = websocket.Dial(context.TODO(), url, withCert)
+		require.ErrorContains(t, err, "401: missing authorization")
+
+		_, err = websocket.Dial(
+			context.TODO(), url, withoutCert, websocket.WithToken("123"),
+		)
+		require.ErrorContains(t, err, "401: missing client certificate")
+	})
+}
@@ -20,6 +20,8 @@ func NewStatus(manager *LoadBalancedManager) *Status {
 
 func (s *Status) Register(group *gin.RouterGroup) {
 	group.GET("/endpoints", s.listEndpointsRoute)
+	group.GET("/connections", s.listConnectionsRoute)
+	group.DELETE("/connections/:id", s.closeConnectionRoute)
 }
 
 func (s *Status) listEndpointsRoute(c *gin.Context) {
@@ -27,4 +29,19 @@ func (s *Status) listEndpointsRoute(c *gin.Context) {
 	c.JSON(http.StatusOK, endpoints)
 }
 
+func (s *Status) listConnectionsRoute(c *gin.Context) {
+	conns := s.manager.Conns()
+	if conns == nil {
+		conns = []ConnStatus{}
+	}
+	c.JSON(http.StatusOK, conns)
+}
+
+// closeConnectionRoute force closes the upstream connection with the given
+// ID. Returns whether a connection was closed.
+func (s *Status) closeConnectionRoute(c *gin.Context) {
+	closed := s.manager.CloseConn(c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"closed": closed})
+}
+
 var _ status.Handler = &Status{}
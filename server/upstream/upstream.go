@@ -2,8 +2,11 @@ package upstream
 
 import (
 	"net"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/hashicorp/yamux"
+	"go.uber.org/atomic"
 
 	"github.com/andydunstall/piko/server/cluster"
 )
@@ -23,25 +26,106 @@ type Upstream interface {
 // ConnUpstream represents a connection to an upstream service thats connected
 // to the local node.
 type ConnUpstream struct {
+	// id is a unique identifier for the connection.
+	id string
+
 	endpointID string
 	sess       *yamux.Session
+
+	closed *atomic.Bool
+
+	// rtt is the last measured round-trip time to the upstream.
+	rtt *atomic.Duration
+	// lastHeartbeat is the time of the last successful heartbeat.
+	lastHeartbeat *atomic.Time
+	// missedHeartbeats is the number of consecutive failed heartbeats.
+	missedHeartbeats *atomic.Int64
 }
 
 func NewConnUpstream(endpointID string, sess *yamux.Session) *ConnUpstream {
 	return &ConnUpstream{
+		id:         uuid.New().String(),
 		endpointID: endpointID,
 		sess:       sess,
+		closed:     atomic.NewBool(false),
+
+		rtt:              atomic.NewDuration(0),
+		lastHeartbeat:    atomic.NewTime(time.Time{}),
+		missedHeartbeats: atomic.NewInt64(0),
 	}
 }
 
+// ID returns the unique identifier of the connection.
+func (u *ConnUpstream) ID() string {
+	return u.id
+}
+
 func (u *ConnUpstream) EndpointID() string {
 	return u.endpointID
 }
 
+// Addr returns the remote address of the upstream. Addr is an alias for
+// RemoteAddr, kept for compatibility.
+func (u *ConnUpstream) Addr() string {
+	return u.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection to the upstream.
+func (u *ConnUpstream) LocalAddr() string {
+	return u.sess.LocalAddr().String()
+}
+
+// RemoteAddr returns the remote address of the connection to the upstream.
+func (u *ConnUpstream) RemoteAddr() string {
+	return u.sess.RemoteAddr().String()
+}
+
+// Close closes the connection to the upstream.
+//
+// Returns false if the connection was already closed.
+func (u *ConnUpstream) Close() bool {
+	if !u.closed.CompareAndSwap(false, true) {
+		return false
+	}
+	_ = u.sess.Close()
+	return true
+}
+
 func (u *ConnUpstream) Dial() (net.Conn, error) {
 	return u.sess.OpenStream()
 }
 
+// Heartbeat pings the upstream to measure the round-trip time and check the
+// connection is healthy.
+func (u *ConnUpstream) Heartbeat() (time.Duration, error) {
+	rtt, err := u.sess.Ping()
+	if err != nil {
+		u.missedHeartbeats.Inc()
+		return 0, err
+	}
+	u.rtt.Store(rtt)
+	u.lastHeartbeat.Store(time.Now())
+	u.missedHeartbeats.Store(0)
+	return rtt, nil
+}
+
+// RTT returns the last measured round-trip time to the upstream, or zero if
+// no heartbeat has succeeded.
+func (u *ConnUpstream) RTT() time.Duration {
+	return u.rtt.Load()
+}
+
+// LastHeartbeat returns the time of the last successful heartbeat, or the
+// zero time if no heartbeat has succeeded.
+func (u *ConnUpstream) LastHeartbeat() time.Time {
+	return u.lastHeartbeat.Load()
+}
+
+// MissedHeartbeats returns the number of consecutive failed heartbeats.
+func (u *ConnUpstream) MissedHeartbeats() int {
+	return int(u.missedHeartbeats.Load())
+}
+
 func (u *ConnUpstream) Forward() bool {
 	return false
 }
@@ -50,13 +134,49 @@ func (u *ConnUpstream) Forward() bool {
 type NodeUpstream struct {
 	endpointID string
 	node       *cluster.Node
+
+	// alternatives contains other nodes with the endpoint, which can be
+	// used if the node is unreachable.
+	alternatives []*cluster.Node
 }
 
-func NewNodeUpstream(endpointID string, node *cluster.Node) *NodeUpstream {
+func NewNodeUpstream(
+	endpointID string,
+	node *cluster.Node,
+	alternatives ...*cluster.Node,
+) *NodeUpstream {
 	return &NodeUpstream{
-		endpointID: endpointID,
-		node:       node,
+		endpointID:   endpointID,
+		node:         node,
+		alternatives: alternatives,
+	}
+}
+
+// NodeID returns the ID of the remote node.
+func (u *NodeUpstream) NodeID() string {
+	return u.node.ID
+}
+
+// Addr returns the proxy address of the remote node.
+func (u *NodeUpstream) Addr() string {
+	return u.node.ProxyAddr
+}
+
+// ForwardKey returns the key used to authenticate requests forwarded to the
+// remote node.
+func (u *NodeUpstream) ForwardKey() string {
+	return u.node.ForwardKey
+}
+
+// Next returns an upstream for the next alternative node with the endpoint,
+// or false if there are no more alternatives.
+func (u *NodeUpstream) Next() (*NodeUpstream, bool) {
+	if len(u.alternatives) == 0 {
+		return nil, false
 	}
+	return NewNodeUpstream(
+		u.endpointID, u.alternatives[0], u.alternatives[1:]...,
+	), true
 }
 
 func (u *NodeUpstream) EndpointID() string {
@@ -0,0 +1,42 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnUpstream_Addrs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	serverConn, err := ln.Accept()
+	require.NoError(t, err)
+
+	muxConfig := yamux.DefaultConfig()
+	muxConfig.LogOutput = io.Discard
+	sess, err := yamux.Server(serverConn, muxConfig)
+	require.NoError(t, err)
+	defer sess.Close()
+
+	u := NewConnUpstream("my-endpoint", sess)
+
+	assert.Equal(t, ln.Addr().String(), u.LocalAddr())
+	assert.Equal(t, clientConn.LocalAddr().String(), u.RemoteAddr())
+	assert.NotEqual(t, u.LocalAddr(), u.RemoteAddr())
+	// Addr is an alias for RemoteAddr.
+	assert.Equal(t, u.RemoteAddr(), u.Addr())
+
+	status := connStatus(u, false)
+	assert.Equal(t, u.RemoteAddr(), status.Addr)
+	assert.Equal(t, u.LocalAddr(), status.LocalAddr)
+}
@@ -0,0 +1,287 @@
+// Package webhook sends webhook notifications when endpoints are registered
+// and unregistered on the local node.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/andydunstall/piko/pkg/backoff"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+const (
+	// SignatureHeader contains the HMAC-SHA256 signature of the request
+	// body, in the form 'sha256=<hex>'.
+	SignatureHeader = "X-Piko-Signature"
+
+	// queueSize is the maximum number of events waiting to be sent to each
+	// URL. If exceeded, new events are dropped.
+	queueSize = 1024
+
+	minBackoff = time.Second
+	maxBackoff = time.Second * 30
+)
+
+type Action string
+
+const (
+	// ActionRegister indicates a listener for the endpoint was registered
+	// on the node.
+	ActionRegister Action = "register"
+	// ActionUnregister indicates a listener for the endpoint was
+	// unregistered from the node.
+	ActionUnregister Action = "unregister"
+)
+
+// Event is sent to the webhook URLs when an endpoint is registered or
+// unregistered.
+type Event struct {
+	Action     Action `json:"action"`
+	EndpointID string `json:"endpoint_id"`
+	NodeID     string `json:"node_id"`
+	// Listeners is the number of listeners for the endpoint on the node
+	// after the update.
+	Listeners int       `json:"listeners"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Notifier sends events to the configured webhook URLs when the endpoints
+// on the local node are updated.
+//
+// Events are sent in the background, so notifying never blocks the caller.
+// Each URL has its own queue, so a slow webhook doesn't delay events to the
+// other webhooks, and events are sent to each URL in order.
+type Notifier struct {
+	nodeID string
+
+	secret      []byte
+	timeout     time.Duration
+	maxAttempts int
+
+	// listeners contains the last known number of listeners for each
+	// endpoint.
+	listeners map[string]int
+	closed    bool
+
+	mu sync.Mutex
+
+	queues []chan Event
+
+	client *http.Client
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	logger log.Logger
+}
+
+func NewNotifier(
+	conf config.WebhookConfig,
+	nodeID string,
+	logger log.Logger,
+) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		nodeID:      nodeID,
+		secret:      []byte(conf.Secret),
+		timeout:     conf.Timeout,
+		maxAttempts: conf.MaxAttempts,
+		listeners:   make(map[string]int),
+		client:      &http.Client{},
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		ctx:         ctx,
+		cancel:      cancel,
+		logger:      logger.WithSubsystem("webhook"),
+	}
+	for _, url := range conf.URLs {
+		queue := make(chan Event, queueSize)
+		n.queues = append(n.queues, queue)
+
+		n.wg.Add(1)
+		go func(url string) {
+			defer n.wg.Done()
+			n.run(url, queue)
+		}(url)
+	}
+	return n
+}
+
+// Notify sends an event for the endpoint given its current number of
+// listeners on the node.
+//
+// If the number of listeners hasn't changed since the last notification no
+// event is sent.
+func (n *Notifier) Notify(endpointID string, listeners int) {
+	n.mu.Lock()
+	// Hold the lock while queueing events so events are queued in order.
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	prev := n.listeners[endpointID]
+	if listeners == prev {
+		return
+	}
+	if listeners == 0 {
+		delete(n.listeners, endpointID)
+	} else {
+		n.listeners[endpointID] = listeners
+	}
+
+	action := ActionRegister
+	if listeners < prev {
+		action = ActionUnregister
+	}
+	event := Event{
+		Action:     action,
+		EndpointID: endpointID,
+		NodeID:     n.nodeID,
+		Listeners:  listeners,
+		Timestamp:  time.Now(),
+	}
+
+	for _, queue := range n.queues {
+		select {
+		case queue <- event:
+		default:
+			n.logger.Warn(
+				"webhook queue full; dropping event",
+				zap.String("endpoint-id", endpointID),
+				zap.String("action", string(action)),
+			)
+		}
+	}
+}
+
+// Shutdown stops accepting new events and waits for queued events to be
+// sent. If the context is cancelled first, remaining events are discarded.
+func (n *Notifier) Shutdown(ctx context.Context) {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, queue := range n.queues {
+			close(queue)
+		}
+	}
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	n.cancel()
+	<-done
+}
+
+func (n *Notifier) run(url string, queue <-chan Event) {
+	for event := range queue {
+		if n.ctx.Err() != nil {
+			continue
+		}
+		n.send(url, event)
+	}
+}
+
+// send sends the event to the URL, retrying with backoff up to the maximum
+// number of attempts.
+func (n *Notifier) send(url string, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		// Event is always valid JSON.
+		panic("marshal event: " + err.Error())
+	}
+
+	backoff := backoff.New(0, n.minBackoff, n.maxBackoff, 2)
+	for attempt := 1; ; attempt++ {
+		err := n.sendAttempt(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= n.maxAttempts {
+			n.logger.Warn(
+				"failed to send webhook event",
+				zap.String("url", url),
+				zap.String("endpoint-id", event.EndpointID),
+				zap.String("action", string(event.Action)),
+				zap.Int("attempts", attempt),
+				zap.Error(err),
+			)
+			return
+		}
+
+		n.logger.Debug(
+			"failed to send webhook event; retrying",
+			zap.String("url", url),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+
+		select {
+		case <-time.After(backoff.Next()):
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *Notifier) sendAttempt(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(n.ctx, n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Discard a bounded amount of the body so the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the signature of the given body, in the form 'sha256=<hex>'.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
+)
+
+type request struct {
+	Event     Event
+	Signature string
+}
+
+func TestNotifier(t *testing.T) {
+	t.Run("register and unregister", func(t *testing.T) {
+		requestCh := make(chan request, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, Sign([]byte("my-secret"), body), r.Header.Get(SignatureHeader))
+
+			var event Event
+			assert.NoError(t, json.Unmarshal(body, &event))
+			requestCh <- request{
+				Event:     event,
+				Signature: r.Header.Get(SignatureHeader),
+			}
+		}))
+		defer server.Close()
+
+		notifier := NewNotifier(config.WebhookConfig{
+			URLs:        []string{server.URL},
+			Secret:      "my-secret",
+			Timeout:     time.Second,
+			MaxAttempts: 1,
+		}, "my-node", log.NewNopLogger())
+		defer notifier.Shutdown(context.Background())
+
+		notifier.Notify("my-endpoint", 1)
+		notifier.Notify("my-endpoint", 2)
+		notifier.Notify("my-endpoint", 1)
+		notifier.Notify("my-endpoint", 0)
+
+		expected := []struct {
+			action    Action
+			listeners int
+		}{
+			{ActionRegister, 1},
+			{ActionRegister, 2},
+			{ActionUnregister, 1},
+			{ActionUnregister, 0},
+		}
+		for _, e := range expected {
+			req := <-requestCh
+			assert.Equal(t, e.action, req.Event.Action)
+			assert.Equal(t, e.listeners, req.Event.Listeners)
+			assert.Equal(t, "my-endpoint", req.Event.EndpointID)
+			assert.Equal(t, "my-node", req.Event.NodeID)
+			assert.NotEmpty(t, req.Signature)
+		}
+	})
+
+	t.Run("unchanged", func(t *testing.T) {
+		requestCh := make(chan Event, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			var event Event
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+			requestCh <- event
+		}))
+		defer server.Close()
+
+		notifier := NewNotifier(config.WebhookConfig{
+			URLs:        []string{server.URL},
+			Timeout:     time.Second,
+			MaxAttempts: 1,
+		}, "my-node", log.NewNopLogger())
+
+		notifier.Notify("my-endpoint", 1)
+		// The number of listeners hasn't changed so no event is sent.
+		notifier.Notify("my-endpoint", 1)
+		// Unknown endpoints have no listeners.
+		notifier.Notify("unknown", 0)
+
+		// Shutdown waits for queued events to be sent.
+		notifier.Shutdown(context.Background())
+
+		require.Len(t, requestCh, 1)
+		event := <-requestCh
+		assert.Equal(t, ActionRegister, event.Action)
+		assert.Equal(t, "my-endpoint", event.EndpointID)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		attempts := 0
+		requestCh := make(chan Event, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Fail the first two attempts.
+			attempts++
+			if attempts <= 2 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			var event Event
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+			requestCh <- event
+		}))
+		defer server.Close()
+
+		notifier := NewNotifier(config.WebhookConfig{
+			URLs:        []string{server.URL},
+			Timeout:     time.Second,
+			MaxAttempts: 3,
+		}, "my-node", log.NewNopLogger())
+		notifier.minBackoff = time.Millisecond
+		notifier.maxBackoff = time.Millisecond * 10
+		defer notifier.Shutdown(context.Background())
+
+		notifier.Notify("my-endpoint", 1)
+
+		event := <-requestCh
+		assert.Equal(t, ActionRegister, event.Action)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		blockCh := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			select {
+			case <-blockCh:
+			case <-r.Context().Done():
+			}
+		}))
+		defer server.Close()
+		defer close(blockCh)
+
+		notifier := NewNotifier(config.WebhookConfig{
+			URLs:        []string{server.URL},
+			Timeout:     time.Millisecond * 10,
+			MaxAttempts: 1,
+		}, "my-node", log.NewNopLogger())
+
+		// Notifying must not block on the webhook.
+		notifier.Notify("my-endpoint", 1)
+		notifier.Notify("my-endpoint", 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		notifier.Shutdown(ctx)
+		assert.NoError(t, ctx.Err())
+	})
+}
+
+func TestSign(t *testing.T) {
+	// Verified with 'echo -n "foo" | openssl dgst -sha256 -hmac "secret"'.
+	assert.Equal(
+		t,
+		"sha256=773ba44693c7553d6ee20f61ea5d2757a9a4f4a44d2841ae4e95b52e4cd62db4",
+		Sign([]byte("secret"), []byte("foo")),
+	)
+}
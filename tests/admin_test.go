@@ -3,11 +3,23 @@
 package tests
 
 import (
+	"context"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/andydunstall/piko/agent/client"
+	agentconfig "github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/reverseproxy"
+	"github.com/andydunstall/piko/pkg/log"
+	statusclient "github.com/andydunstall/piko/server/status/client"
 	cluster "github.com/andydunstall/piko/workloadv2/cluster"
 )
 
@@ -39,6 +51,172 @@ func TestAdmin(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	// Tests /health/live returns 200 and /health/ready returns 200 once the
+	// node is serving.
+	t.Run("health serving", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node, "/health/live"))
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node, "/health/ready"))
+	})
+
+	// Tests /health/ready returns 503 until the node has joined the cluster.
+	t.Run("health before join", func(t *testing.T) {
+		node1 := cluster.NewNode()
+		node1.Start()
+		defer node1.Stop()
+
+		// Relay gossip traffic to node1, though block until the test
+		// unblocks the relay, so node2 is blocked joining the cluster.
+		joinLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer joinLn.Close()
+
+		unblock := make(chan struct{})
+		go func() {
+			for {
+				conn, err := joinLn.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+
+					<-unblock
+
+					node1Conn, err := net.Dial("tcp", node1.GossipAddr())
+					if err != nil {
+						return
+					}
+					defer node1Conn.Close()
+
+					go func() {
+						_, _ = io.Copy(node1Conn, conn)
+					}()
+					_, _ = io.Copy(conn, node1Conn)
+				}()
+			}
+		}()
+
+		node2 := cluster.NewNode(
+			cluster.WithJoin([]string{joinLn.Addr().String()}),
+		)
+		started := make(chan struct{})
+		go func() {
+			node2.Start()
+			close(started)
+		}()
+		defer node2.Stop()
+
+		assert.Eventually(t, func() bool {
+			return adminStatusCode(t, node2, "/health/live") == http.StatusOK
+		}, time.Second, time.Millisecond*10)
+		assert.Equal(
+			t,
+			http.StatusServiceUnavailable,
+			adminStatusCode(t, node2, "/health/ready"),
+		)
+
+		close(unblock)
+		<-started
+
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node2, "/health/ready"))
+	})
+
+	// Tests /health/ready returns 503 while the node is shutting down.
+	t.Run("health during shutdown", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+
+		// Open a connection to the proxy with an incomplete request, which
+		// blocks the proxy server from shutting down.
+		conn, err := net.Dial("tcp", node.ProxyAddr())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+		require.NoError(t, err)
+
+		stopped := make(chan struct{})
+		go func() {
+			node.Stop()
+			close(stopped)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return adminStatusCode(t, node, "/health/ready") == http.StatusServiceUnavailable
+		}, time.Second, time.Millisecond*10)
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node, "/health/live"))
+
+		conn.Close()
+		<-stopped
+	})
+
+	// Tests enabling maintenance mode rejects proxy requests and marks the
+	// node as not ready, then disabling maintenance mode resumes forwarding.
+	t.Run("maintenance", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		defer upstream.Close()
+
+		pikoClient := client.New(
+			client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+		)
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		proxyServer := reverseproxy.NewServer(agentconfig.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       upstream.URL,
+		}, nil, nil, log.NewNopLogger())
+		go func() {
+			_ = proxyServer.Serve(ln)
+		}()
+		defer proxyServer.Shutdown(context.TODO())
+
+		proxyStatusCode := func() (int, string) {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+node.ProxyAddr(), nil)
+			req.Header.Add("x-piko-endpoint", "my-endpoint")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode, resp.Header.Get("Retry-After")
+		}
+
+		adminURL, _ := url.Parse("http://" + node.AdminAddr())
+		proxyStatus := statusclient.NewProxy(statusclient.NewClient(adminURL))
+
+		statusCode, _ := proxyStatusCode()
+		assert.Equal(t, http.StatusOK, statusCode)
+
+		require.NoError(t, proxyStatus.SetMaintenance(context.TODO(), true))
+		enabled, err := proxyStatus.Maintenance(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, enabled)
+
+		statusCode, retryAfter := proxyStatusCode()
+		assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+		assert.NotEmpty(t, retryAfter)
+		assert.Equal(
+			t,
+			http.StatusServiceUnavailable,
+			adminStatusCode(t, node, "/health/ready"),
+		)
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node, "/health/live"))
+
+		require.NoError(t, proxyStatus.SetMaintenance(context.TODO(), false))
+
+		statusCode, _ = proxyStatusCode()
+		assert.Equal(t, http.StatusOK, statusCode)
+		assert.Equal(t, http.StatusOK, adminStatusCode(t, node, "/health/ready"))
+	})
+
 	// Tests /metrics returns 200.
 	t.Run("metrics", func(t *testing.T) {
 		node := cluster.NewNode()
@@ -51,4 +229,68 @@ func TestAdmin(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
+	// Tests force disconnecting an upstream connection removes the upstream.
+	t.Run("disconnect upstream", func(t *testing.T) {
+		node := cluster.NewNode()
+		node.Start()
+		defer node.Stop()
+
+		pikoClient := client.New(
+			client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+		)
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		adminURL, _ := url.Parse("http://" + node.AdminAddr())
+		upstream := statusclient.NewUpstream(statusclient.NewClient(adminURL))
+
+		var id string
+		require.Eventually(t, func() bool {
+			conns, err := upstream.Conns(context.TODO())
+			require.NoError(t, err)
+			// Wait for the initial heartbeat.
+			if len(conns) != 1 || conns[0].LastHeartbeat == nil {
+				return false
+			}
+			assert.Equal(t, "my-endpoint", conns[0].EndpointID)
+			assert.NotEmpty(t, conns[0].Addr)
+			assert.Greater(t, conns[0].RTT, time.Duration(0))
+			assert.Equal(t, 0, conns[0].MissedHeartbeats)
+			id = conns[0].ID
+			return true
+		}, time.Second, time.Millisecond*10)
+
+		closed, err := upstream.Disconnect(context.TODO(), id)
+		require.NoError(t, err)
+		assert.True(t, closed)
+
+		// Wait for the endpoint to be removed.
+		assert.Eventually(t, func() bool {
+			endpoints, err := upstream.Endpoints(context.TODO())
+			require.NoError(t, err)
+			if len(endpoints) != 0 {
+				return false
+			}
+			_, ok := node.ClusterState().LocalNode().Endpoints["my-endpoint"]
+			return !ok
+		}, time.Second, time.Millisecond*10)
+
+		conns, err := upstream.Conns(context.TODO())
+		require.NoError(t, err)
+		assert.Empty(t, conns)
+
+		// Disconnecting again should have no effect.
+		closed, err = upstream.Disconnect(context.TODO(), id)
+		require.NoError(t, err)
+		assert.False(t, closed)
+	})
+}
+
+func adminStatusCode(t *testing.T, node *cluster.Node, path string) int {
+	resp, err := http.Get("http://" + node.AdminAddr() + path)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	return resp.StatusCode
 }
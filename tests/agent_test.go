@@ -0,0 +1,204 @@
+//go:build system
+
+package tests
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/andydunstall/piko/agent/client"
+	agentconfig "github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/healthcheck"
+	"github.com/andydunstall/piko/agent/reverseproxy"
+	agentserver "github.com/andydunstall/piko/agent/server"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/workloadv2/cluster"
+)
+
+// Tests the agent exports metrics for forwarded requests.
+func TestAgent_Metrics(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(_ http.ResponseWriter, _ *http.Request) {},
+	))
+	defer upstream.Close()
+
+	registry := prometheus.NewRegistry()
+
+	pikoClient := client.New(
+		client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+	)
+	pikoClient.Metrics().Register(registry)
+
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	metrics := reverseproxy.NewMetrics()
+	metrics.Register(registry)
+
+	proxyServer := reverseproxy.NewServer(agentconfig.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+	}, nil, metrics, log.NewNopLogger())
+	go func() {
+		_ = proxyServer.Serve(ln)
+	}()
+	defer proxyServer.Shutdown(context.TODO())
+
+	agentLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	agentServer := agentserver.NewServer(registry, log.NewNopLogger())
+	go func() {
+		_ = agentServer.Serve(agentLn)
+	}()
+	defer agentServer.Shutdown(context.TODO())
+
+	// Send a request to the upstream via Piko.
+
+	req, _ := http.NewRequest(
+		http.MethodGet,
+		"http://"+node.ProxyAddr(),
+		nil,
+	)
+	req.Header.Add("x-piko-endpoint", "my-endpoint")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Verify the agent metrics.
+
+	resp, err = http.Get("http://" + agentLn.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(
+		t,
+		string(b),
+		`piko_agent_http_forward_requests_total{endpoint_id="my-endpoint",outcome="success"} 1`,
+	)
+	assert.Contains(
+		t,
+		string(b),
+		`piko_agent_http_forward_request_latency_seconds_count{endpoint_id="my-endpoint",outcome="success"} 1`,
+	)
+	assert.Contains(
+		t,
+		string(b),
+		`piko_agent_connected_listeners{endpoint_id="my-endpoint"} 1`,
+	)
+	assert.Contains(t, string(b), `piko_agent_requests_total`)
+}
+
+// Tests the agent pauses a listener when its upstream fails health checks,
+// so the server stops routing requests to the listener, then resumes the
+// listener when the upstream recovers.
+func TestAgent_HealthCheck(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	listenersCh := make(chan int, 8)
+	node.ClusterState().OnLocalEndpointUpdate(func(endpointID string) {
+		listenersCh <- node.ClusterState().LocalEndpointListeners(endpointID)
+	})
+
+	var healthy atomic.Bool
+	healthy.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			// nolint
+			w.Write([]byte("ok"))
+		},
+	))
+	defer upstream.Close()
+
+	pikoClient := client.New(
+		client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+	)
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	require.NoError(t, err)
+	defer ln.Close()
+	assert.Equal(t, 1, <-listenersCh)
+
+	listenerConfig := agentconfig.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		Timeout:    time.Second,
+		HealthCheck: agentconfig.HealthCheckConfig{
+			Enabled:            true,
+			Path:               "/health",
+			Interval:           time.Millisecond * 10,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+		},
+	}
+
+	proxyServer := reverseproxy.NewServer(
+		listenerConfig, nil, nil, log.NewNopLogger(),
+	)
+	go func() {
+		_ = proxyServer.Serve(ln)
+	}()
+	defer proxyServer.Shutdown(context.TODO())
+
+	checker := healthcheck.NewChecker(listenerConfig, nil, log.NewNopLogger())
+	checker.OnChange(func(healthy bool) {
+		if healthy {
+			assert.NoError(t, ln.Resume(context.TODO()))
+		} else {
+			assert.NoError(t, ln.Pause(context.TODO()))
+		}
+	})
+	checkerCtx, checkerCancel := context.WithCancel(context.Background())
+	defer checkerCancel()
+	go checker.Run(checkerCtx)
+
+	request := func() int {
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, request())
+
+	// Fail the health check, which should remove the endpoint.
+	healthy.Store(false)
+	assert.Equal(t, 0, <-listenersCh)
+	assert.Equal(t, http.StatusBadGateway, request())
+
+	// Recover the upstream, which should restore the endpoint.
+	healthy.Store(true)
+	assert.Equal(t, 1, <-listenersCh)
+	assert.Equal(t, http.StatusOK, request())
+}
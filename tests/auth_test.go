@@ -5,6 +5,8 @@ package tests
 import (
 	"context"
 	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 
 	"github.com/andydunstall/piko/agent/client"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
 	"github.com/andydunstall/piko/workloadv2/cluster"
 )
 
@@ -97,6 +100,88 @@ func TestAuth_Upstream(t *testing.T) {
 	})
 }
 
+// Tests authenticating proxy requests.
+func TestAuth_Proxy(t *testing.T) {
+	secretKey := generateTestHSKey()
+	node := cluster.NewNode(
+		cluster.WithProxyAuthConfig(config.ProxyAuthConfig{
+			TokenHMACSecretKey: string(secretKey),
+			TokenAudience:      "my-audience",
+		}),
+		cluster.WithEndpoints(map[string]config.EndpointConfig{
+			"public-endpoint": {
+				DisableAuth: true,
+			},
+		}),
+	)
+	node.Start()
+	defer node.Stop()
+
+	pikoClient := client.New(
+		client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+	)
+	for _, endpointID := range []string{"my-endpoint", "public-endpoint"} {
+		ln, err := pikoClient.Listen(context.TODO(), endpointID)
+		assert.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(_ http.ResponseWriter, _ *http.Request) {},
+		))
+		server.Listener = ln
+		go server.Start()
+		defer server.Close()
+	}
+
+	request := func(endpointID string, token string) *http.Response {
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", endpointID)
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Audience:  jwt.ClaimStrings{"my-audience"},
+		})
+		tokenString, err := token.SignedString(secretKey)
+		assert.NoError(t, err)
+
+		resp := request("my-endpoint", tokenString)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("invalid audience", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.RegisteredClaims{
+			Audience: jwt.ClaimStrings{"other-audience"},
+		})
+		tokenString, err := token.SignedString(secretKey)
+		assert.NoError(t, err)
+
+		resp := request("my-endpoint", tokenString)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		resp := request("my-endpoint", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("public", func(t *testing.T) {
+		resp := request("public-endpoint", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
 func generateTestHSKey() []byte {
 	b := make([]byte, 10)
 	_, err := rand.Read(b)
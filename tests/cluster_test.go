@@ -3,16 +3,25 @@
 package tests
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/andydunstall/piko/agent/client"
+	agentconfig "github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/tcpproxy"
+	"github.com/andydunstall/piko/pkg/log"
+	servercluster "github.com/andydunstall/piko/server/cluster"
 	"github.com/andydunstall/piko/workloadv2/cluster"
 	"github.com/andydunstall/piko/workloadv2/cluster/config"
 )
@@ -67,6 +76,159 @@ func TestCluster_Proxy(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	t.Run("sse", func(t *testing.T) {
+		manager := cluster.NewManager()
+		defer manager.Close()
+
+		manager.Update(&config.Config{
+			Nodes: 3,
+		})
+
+		remoteEndpointCh := make(chan string, 1)
+		manager.Nodes()[1].ClusterState().OnRemoteEndpointUpdate(
+			func(_ string, endpointID string) {
+				remoteEndpointCh <- endpointID
+			},
+		)
+
+		// Add upstream listener with a HTTP server that streams an event
+		// each time nextCh is signalled.
+
+		upstreamURL := "http://" + manager.Nodes()[0].UpstreamAddr()
+		pikoClient := client.New(client.WithUpstreamURL(upstreamURL))
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		nextCh := make(chan struct{})
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+
+				for i := 0; i != 5; i++ {
+					select {
+					case <-nextCh:
+					case <-r.Context().Done():
+						return
+					}
+					fmt.Fprintf(w, "data: %d\n\n", i)
+					w.(http.Flusher).Flush()
+				}
+			},
+		))
+		server.Listener = ln
+		go server.Start()
+		defer server.Close()
+
+		// Wait for node 2 to learn about the new upstream.
+		assert.Equal(t, "my-endpoint", <-remoteEndpointCh)
+
+		// Send a request to the upstream via Piko and verify each event is
+		// received before the next is sent, so the response isn't buffered
+		// by either node.
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			"http://"+manager.Nodes()[1].ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		httpClient := &http.Client{}
+		resp, err := httpClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		reader := bufio.NewReader(resp.Body)
+		for i := 0; i != 5; i++ {
+			nextCh <- struct{}{}
+
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("data: %d\n", i), line)
+
+			line, err = reader.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "\n", line)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		manager := cluster.NewManager()
+		defer manager.Close()
+
+		manager.Update(&config.Config{
+			Nodes: 3,
+		})
+
+		remoteEndpointCh := make(chan string, 1)
+		manager.Nodes()[1].ClusterState().OnRemoteEndpointUpdate(
+			func(_ string, endpointID string) {
+				remoteEndpointCh <- endpointID
+			},
+		)
+
+		// Add upstream listener with a WebSocket server that echos back
+		// messages.
+
+		upstreamURL := "http://" + manager.Nodes()[0].UpstreamAddr()
+		pikoClient := client.New(client.WithUpstreamURL(upstreamURL))
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				var upgrader = websocket.Upgrader{}
+
+				c, err := upgrader.Upgrade(w, r, nil)
+				assert.NoError(t, err)
+				defer c.Close()
+
+				for {
+					mt, message, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					assert.NoError(t, c.WriteMessage(mt, message))
+				}
+			},
+		))
+		server.Listener = ln
+		go server.Start()
+		defer server.Close()
+
+		// Wait for node 2 to learn about the new upstream.
+		assert.Equal(t, "my-endpoint", <-remoteEndpointCh)
+
+		// Send WebSocket messages via node 2 and wait for them to be echoed
+		// back.
+
+		header := make(http.Header)
+		header.Add("x-piko-endpoint", "my-endpoint")
+
+		c, _, err := websocket.DefaultDialer.Dial(
+			"ws://"+manager.Nodes()[1].ProxyAddr(), header,
+		)
+		assert.NoError(t, err)
+		defer c.Close()
+
+		for i := 0; i != 10; i++ {
+			assert.NoError(t, c.WriteMessage(websocket.TextMessage, []byte("echo")))
+
+			mt, message, err := c.ReadMessage()
+			assert.NoError(t, err)
+
+			assert.Equal(t, websocket.TextMessage, mt)
+			assert.Equal(t, []byte("echo"), message)
+		}
+	})
+
 	t.Run("tcp", func(t *testing.T) {
 		manager := cluster.NewManager()
 		defer manager.Close()
@@ -137,4 +299,122 @@ func TestCluster_Proxy(t *testing.T) {
 		conn.Close()
 		wg.Wait()
 	})
+	t.Run("raw tcp", func(t *testing.T) {
+		node1 := cluster.NewNode()
+		node1.Start()
+		defer node1.Stop()
+
+		// Node 2 accepts raw TCP connections for the endpoint, though the
+		// upstream listener is connected to node 1.
+		node2 := cluster.NewNode(
+			cluster.WithJoin([]string{node1.GossipAddr()}),
+			cluster.WithTCPEndpoints("my-endpoint"),
+		)
+		node2.Start()
+		defer node2.Stop()
+
+		remoteEndpointCh := make(chan string, 1)
+		node2.ClusterState().OnRemoteEndpointUpdate(
+			func(_ string, endpointID string) {
+				remoteEndpointCh <- endpointID
+			},
+		)
+
+		echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer echoLn.Close()
+		go serveTCPEcho(echoLn)
+
+		pikoClient := client.New(
+			client.WithUpstreamURL("http://" + node1.UpstreamAddr()),
+		)
+		ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+		assert.NoError(t, err)
+
+		agentServer := tcpproxy.NewServer(agentconfig.ListenerConfig{
+			EndpointID: "my-endpoint",
+			Addr:       echoLn.Addr().String(),
+			Protocol:   agentconfig.ListenerProtocolTCP,
+			Timeout:    time.Second,
+		}, nil, nil, log.NewNopLogger())
+		go func() {
+			_ = agentServer.Serve(ln)
+		}()
+		defer agentServer.Close()
+
+		// Wait for node 2 to learn about the new upstream.
+		assert.Equal(t, "my-endpoint", <-remoteEndpointCh)
+
+		conn, err := net.Dial("tcp", node2.TCPProxyAddr("my-endpoint"))
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		buf := make([]byte, 512)
+		for i := 0; i != 10; i++ {
+			_, err = conn.Write([]byte("foo"))
+			assert.NoError(t, err)
+
+			n, err := conn.Read(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("foo"), buf[:n])
+		}
+	})
+}
+
+// Tests a node shutting down notifies the other nodes that it is leaving,
+// so they stop routing requests to the node before it disconnects its
+// upstreams and before the node would be detected as unreachable.
+func TestCluster_Leaving(t *testing.T) {
+	manager := cluster.NewManager()
+	defer manager.Close()
+
+	manager.Update(&config.Config{
+		Nodes: 2,
+	})
+
+	remoteEndpointCh := make(chan string, 8)
+	manager.Nodes()[1].ClusterState().OnRemoteEndpointUpdate(
+		func(_ string, endpointID string) {
+			remoteEndpointCh <- endpointID
+		},
+	)
+
+	type statusChange struct {
+		Status servercluster.NodeStatus
+		Found  bool
+	}
+	statusCh := make(chan statusChange, 8)
+	state := manager.Nodes()[1].ClusterState()
+	state.OnNodeStatusChange(func(node *servercluster.Node) {
+		_, found := state.LookupEndpoint("my-endpoint")
+		statusCh <- statusChange{
+			Status: node.Status,
+			Found:  found,
+		}
+	})
+
+	// Add an upstream listener to node 0.
+
+	upstreamURL := "http://" + manager.Nodes()[0].UpstreamAddr()
+	pikoClient := client.New(client.WithUpstreamURL(upstreamURL))
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// Wait for node 1 to learn about the new upstream.
+	assert.Equal(t, "my-endpoint", <-remoteEndpointCh)
+	_, ok := state.LookupEndpoint("my-endpoint")
+	assert.True(t, ok)
+
+	// Remove node 0, which should first notify node 1 it is leaving, at
+	// which point node 1 should no longer route requests to node 0 even
+	// though the upstream is still connected.
+	manager.Update(&config.Config{
+		Nodes: 1,
+	})
+
+	assert.Equal(t, statusChange{
+		Status: servercluster.NodeStatusLeaving,
+		Found:  false,
+	}, <-statusCh)
 }
@@ -7,18 +7,28 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/andydunstall/piko/agent/client"
+	agentconfig "github.com/andydunstall/piko/agent/config"
+	"github.com/andydunstall/piko/agent/reverseproxy"
+	"github.com/andydunstall/piko/agent/tcpproxy"
+	"github.com/andydunstall/piko/pkg/log"
+	"github.com/andydunstall/piko/server/config"
 	cluster "github.com/andydunstall/piko/workloadv2/cluster"
 )
 
@@ -213,6 +223,119 @@ func TestProxy_HTTP(t *testing.T) {
 	})
 }
 
+// Tests proxying a gRPC-style bidirectional stream over HTTP/2, from the
+// client, through the Piko server and agent, to an upstream echo service.
+//
+// Messages use the gRPC length-prefixed framing and the upstream returns the
+// status in a 'Grpc-Status' trailer.
+func TestProxy_GRPC(t *testing.T) {
+	node := cluster.NewNode(
+		cluster.WithEndpoints(map[string]config.EndpointConfig{
+			"my-endpoint": {
+				HTTP2: true,
+			},
+		}),
+	)
+	node.Start()
+	defer node.Stop()
+
+	// Add an upstream echo service, which echoes each message as it is
+	// received.
+
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, 2, r.ProtoMajor)
+			assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			for {
+				msg, err := readGRPCMessage(r.Body)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					w.Header().Set("Grpc-Status", "13")
+					return
+				}
+				if err := writeGRPCMessage(w, msg); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			}
+			w.Header().Set("Grpc-Status", "0")
+		},
+	), &http2.Server{}))
+	defer upstream.Close()
+
+	pikoClient := client.New(
+		client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+	)
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	proxyServer := reverseproxy.NewServer(agentconfig.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       upstream.URL,
+		HTTP2:      true,
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = proxyServer.Serve(ln)
+	}()
+	defer proxyServer.Shutdown(context.TODO())
+
+	// Open a stream to the upstream via Piko using cleartext HTTP/2.
+
+	httpClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(
+				ctx context.Context, network, addr string, _ *tls.Config,
+			) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(
+		http.MethodPost,
+		"http://"+node.ProxyAddr()+"/echo.Echo/Stream",
+		pr,
+	)
+	req.Header.Add("x-piko-endpoint", "my-endpoint")
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := httpClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+
+	// Send each message and wait for the echo before sending the next, which
+	// verifies messages are streamed in both directions rather than buffered.
+	for i := 0; i != 5; i++ {
+		msg := randomBytes(1024)
+		assert.NoError(t, writeGRPCMessage(pw, msg))
+
+		echo, err := readGRPCMessage(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, echo)
+	}
+	assert.NoError(t, pw.Close())
+
+	_, err = readGRPCMessage(resp.Body)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
 func TestProxy_TCP(t *testing.T) {
 	t.Run("tcp", func(t *testing.T) {
 		node := cluster.NewNode()
@@ -271,6 +394,295 @@ func TestProxy_TCP(t *testing.T) {
 	})
 }
 
+// Tests tunnelling raw TCP connections to an agent TCP listener.
+func TestProxy_RawTCP(t *testing.T) {
+	node := cluster.NewNode(cluster.WithTCPEndpoints("my-endpoint"))
+	node.Start()
+	defer node.Stop()
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer echoLn.Close()
+	go serveTCPEcho(echoLn)
+
+	pikoClient := client.New(
+		client.WithUpstreamURL("http://" + node.UpstreamAddr()),
+	)
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+
+	agentServer := tcpproxy.NewServer(agentconfig.ListenerConfig{
+		EndpointID: "my-endpoint",
+		Addr:       echoLn.Addr().String(),
+		Protocol:   agentconfig.ListenerProtocolTCP,
+		Timeout:    time.Second,
+	}, nil, nil, log.NewNopLogger())
+	go func() {
+		_ = agentServer.Serve(ln)
+	}()
+	defer agentServer.Close()
+
+	conn, err := net.Dial("tcp", node.TCPProxyAddr("my-endpoint"))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+	for i := 0; i != 10; i++ {
+		_, err = conn.Write([]byte("foo"))
+		assert.NoError(t, err)
+
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("foo"), buf[:n])
+	}
+}
+
+// serveTCPEcho echos all bytes received on connections accepted by ln.
+// Tests draining a listener completes in-flight requests while routing new
+// requests to other listeners.
+func TestProxy_Drain(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+	defer node.Stop()
+
+	listenersCh := make(chan int, 8)
+	node.ClusterState().OnLocalEndpointUpdate(func(endpointID string) {
+		listenersCh <- node.ClusterState().LocalEndpointListeners(endpointID)
+	})
+
+	upstreamURL := "http://" + node.UpstreamAddr()
+	pikoClient := client.New(client.WithUpstreamURL(upstreamURL))
+
+	// Add a listener whose handler blocks until released.
+
+	lnA, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, <-listenersCh)
+
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	serverA := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			close(startedCh)
+			<-releaseCh
+			// nolint
+			w.Write([]byte("a"))
+		},
+	))
+	serverA.Listener = lnA
+	go serverA.Start()
+	defer serverA.Close()
+
+	request := func() (*http.Response, string) {
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(b)
+	}
+
+	// Send an in-flight request to listener A.
+
+	inFlightCh := make(chan string, 1)
+	go func() {
+		_, body := request()
+		inFlightCh <- body
+	}()
+	<-startedCh
+
+	// Add a second listener.
+
+	lnB, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, <-listenersCh)
+
+	serverB := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			// nolint
+			w.Write([]byte("b"))
+		},
+	))
+	serverB.Listener = lnB
+	go serverB.Start()
+	defer serverB.Close()
+
+	// Drain listener A, which should block until the in-flight request
+	// completes.
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		drainErrCh <- lnA.Drain(ctx)
+	}()
+	assert.Equal(t, 1, <-listenersCh)
+
+	// New requests should be routed to listener B.
+	for i := 0; i != 5; i++ {
+		resp, body := request()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "b", body)
+	}
+
+	select {
+	case <-drainErrCh:
+		t.Error("drain completed with in-flight requests")
+	default:
+	}
+
+	// Complete the in-flight request.
+	close(releaseCh)
+	assert.Equal(t, "a", <-inFlightCh)
+
+	assert.NoError(t, <-drainErrCh)
+}
+
+// Tests shutting down the server waits for in-flight requests to complete
+// before closing upstream connections, while refusing new requests.
+func TestProxy_Shutdown(t *testing.T) {
+	node := cluster.NewNode()
+	node.Start()
+
+	upstreamURL := "http://" + node.UpstreamAddr()
+	pikoClient := client.New(client.WithUpstreamURL(upstreamURL))
+
+	ln, err := pikoClient.Listen(context.TODO(), "my-endpoint")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			close(startedCh)
+			<-releaseCh
+			// nolint
+			w.Write([]byte("foo"))
+		},
+	))
+	server.Listener = ln
+	go server.Start()
+	defer server.Close()
+
+	request := func() (*http.Response, error) {
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"http://"+node.ProxyAddr(),
+			nil,
+		)
+		req.Header.Add("x-piko-endpoint", "my-endpoint")
+		// Use a new connection for each request.
+		httpClient := &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+		return httpClient.Do(req)
+	}
+
+	// Send an in-flight request that blocks until released.
+
+	type result struct {
+		StatusCode int
+		Body       string
+		Err        error
+	}
+	inFlightCh := make(chan result, 1)
+	go func() {
+		resp, err := request()
+		if err != nil {
+			inFlightCh <- result{Err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		inFlightCh <- result{
+			StatusCode: resp.StatusCode,
+			Body:       string(b),
+			Err:        err,
+		}
+	}()
+	<-startedCh
+
+	shutdownCh := make(chan struct{})
+	go func() {
+		node.Stop()
+		close(shutdownCh)
+	}()
+
+	// New requests should be refused while shutting down.
+	assert.Eventually(t, func() bool {
+		resp, err := request()
+		if err != nil {
+			return true
+		}
+		resp.Body.Close()
+		return false
+	}, time.Second*5, time.Millisecond*10)
+
+	select {
+	case <-shutdownCh:
+		t.Error("shutdown completed with in-flight requests")
+	default:
+	}
+
+	// Complete the in-flight request, which should succeed.
+	close(releaseCh)
+	assert.Equal(t, result{
+		StatusCode: http.StatusOK,
+		Body:       "foo",
+	}, <-inFlightCh)
+
+	<-shutdownCh
+}
+
+func serveTCPEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			// nolint
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// writeGRPCMessage writes a message using the gRPC length-prefixed framing,
+// with a 1 byte compression flag and a 4 byte big endian length.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(append(header, msg...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readGRPCMessage reads a message written with writeGRPCMessage.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 func randomBytes(n int) []byte {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
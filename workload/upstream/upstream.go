@@ -55,7 +55,7 @@ func (u *Upstream) Run(ctx context.Context) error {
 	proxy := reverseproxy.NewServer(config.ListenerConfig{
 		EndpointID: u.endpointID,
 		Addr:       server.Listener.Addr().String(),
-	}, nil, u.logger)
+	}, nil, nil, u.logger)
 	go func() {
 		_ = proxy.Serve(ln)
 	}()
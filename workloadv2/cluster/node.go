@@ -39,6 +39,17 @@ func NewNode(opts ...Option) *Node {
 	conf.Gossip.BindAddr = "127.0.0.1:0"
 	conf.Gossip.Interval = time.Millisecond * 10
 	conf.Auth = options.authConfig
+	conf.Proxy.Auth = options.proxyAuthConfig
+	conf.Proxy.Endpoints = options.endpoints
+	for _, endpointID := range options.tcpEndpoints {
+		conf.Proxy.TCPListeners = append(
+			conf.Proxy.TCPListeners,
+			config.TCPListenerConfig{
+				EndpointID: endpointID,
+				BindAddr:   "127.0.0.1:0",
+			},
+		)
+	}
 
 	// If TLS is enabled, generate a certificate and root CA then write to a
 	// file.
@@ -112,6 +123,16 @@ func (n *Node) ProxyAddr() string {
 	return n.server.Config().Proxy.AdvertiseAddr
 }
 
+// TCPProxyAddr returns the address of the raw TCP proxy listener for the
+// given endpoint.
+func (n *Node) TCPProxyAddr(endpointID string) string {
+	addr, ok := n.server.TCPProxyAddr(endpointID)
+	if !ok {
+		panic("no tcp listener for endpoint: " + endpointID)
+	}
+	return addr
+}
+
 func (n *Node) UpstreamAddr() string {
 	return n.server.Config().Upstream.AdvertiseAddr
 }
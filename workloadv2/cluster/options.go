@@ -3,13 +3,17 @@ package cluster
 import (
 	"github.com/andydunstall/piko/pkg/log"
 	"github.com/andydunstall/piko/server/auth"
+	"github.com/andydunstall/piko/server/config"
 )
 
 type options struct {
-	join       []string
-	authConfig auth.Config
-	tls        bool
-	logger     log.Logger
+	join            []string
+	authConfig      auth.Config
+	proxyAuthConfig config.ProxyAuthConfig
+	endpoints       map[string]config.EndpointConfig
+	tls             bool
+	tcpEndpoints    []string
+	logger          log.Logger
 }
 
 type joinOption struct {
@@ -38,6 +42,31 @@ func WithAuthConfig(config auth.Config) Option {
 	return authConfigOption{AuthConfig: config}
 }
 
+type proxyAuthConfigOption struct {
+	ProxyAuthConfig config.ProxyAuthConfig
+}
+
+func (o proxyAuthConfigOption) apply(opts *options) {
+	opts.proxyAuthConfig = o.ProxyAuthConfig
+}
+
+// WithProxyAuthConfig configures the proxy authentication config.
+func WithProxyAuthConfig(config config.ProxyAuthConfig) Option {
+	return proxyAuthConfigOption{ProxyAuthConfig: config}
+}
+
+type endpointsOption map[string]config.EndpointConfig
+
+func (o endpointsOption) apply(opts *options) {
+	opts.endpoints = map[string]config.EndpointConfig(o)
+}
+
+// WithEndpoints configures the proxy configuration overrides for specific
+// endpoints.
+func WithEndpoints(endpoints map[string]config.EndpointConfig) Option {
+	return endpointsOption(endpoints)
+}
+
 type tlsOption bool
 
 func (o tlsOption) apply(opts *options) {
@@ -49,6 +78,18 @@ func WithTLS(tls bool) Option {
 	return tlsOption(tls)
 }
 
+type tcpEndpointsOption []string
+
+func (o tcpEndpointsOption) apply(opts *options) {
+	opts.tcpEndpoints = []string(o)
+}
+
+// WithTCPEndpoints configures the node to listen for raw TCP connections for
+// each of the given endpoints.
+func WithTCPEndpoints(endpointIDs ...string) Option {
+	return tcpEndpointsOption(endpointIDs)
+}
+
 type loggerOption struct {
 	Logger log.Logger
 }